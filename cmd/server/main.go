@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/c4gt/tornado-nginx-go-backend/internal/config"
 	"github.com/c4gt/tornado-nginx-go-backend/internal/handlers"
@@ -12,6 +16,8 @@ import (
 	"github.com/joho/godotenv"
 )
 
+const shutdownTimeout = 15 * time.Second
+
 func main() {
 	// Load environment variables
 	if err := godotenv.Load(); err != nil {
@@ -32,11 +38,20 @@ func main() {
 	}
 	
 	router := gin.Default()
+	// Client IPs key the sign-in and share link throttles and the audit
+	// log, so X-Forwarded-For is only believed from the proxies in front
+	if err := router.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
 
 	// Apply middleware
-	router.Use(middleware.CORS())
+	router.Use(middleware.CORS(cfg.CORSAllowedOrigins))
 	router.Use(middleware.Logger())
 	router.Use(middleware.Recovery())
+	router.Use(middleware.CSRF(middleware.CSRFOptions{
+		Secret: cfg.CookieSecret,
+		Secure: cfg.CookieSecure,
+	}))
 
 	// Initialize handlers
 	handler := handlers.NewHandler(cfg)
@@ -52,9 +67,34 @@ func main() {
 
 	log.Printf("Server starting on port %s", port)
 	log.Printf("Storage backend: %s", cfg.StorageBackend)
-	if err := router.Run(":" + port); err != nil {
-		log.Fatal("Failed to start server:", err)
+
+	server := &http.Server{
+		Addr:    ":" + port,
+		Handler: router,
+	}
+
+	// Stop on SIGINT or SIGTERM, letting requests in flight finish first
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal("Failed to start server:", err)
+		}
+	}()
+
+	<-ctx.Done()
+	log.Println("Shutting down server...")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Server shutdown: %v", err)
+	}
+	if err := handler.Close(); err != nil {
+		log.Printf("Failed to release handler resources: %v", err)
 	}
+	log.Println("Server stopped")
 }
 
 func setupRoutes(router *gin.Engine, handler *handlers.Handler) {
@@ -76,6 +116,14 @@ func setupRoutes(router *gin.Engine, handler *handlers.Handler) {
 		})
 	})
 
+	// CSRF token for clients that cannot read it from a rendered page
+	router.GET("/csrf", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"data": middleware.CSRFToken(c),
+			"result": "ok",
+		})
+	})
+
 	// API routes
 	api := router.Group("/")
 	{
@@ -90,8 +138,39 @@ func setupRoutes(router *gin.Engine, handler *handlers.Handler) {
 		api.GET("/pwreset", handler.Auth.HandlePasswordResetGet)
 		api.POST("/pwreset", handler.Auth.HandlePasswordResetPost)
 
+		// OpenID Connect sign-in routes
+		api.GET("/oidc/:provider/login", handler.OIDC.HandleLogin)
+		api.GET("/oidc/:provider/callback", handler.OIDC.HandleCallback)
+
+		// Account routes
+		api.GET("/account/delete", handler.Account.HandleDeletionStatus)
+		api.POST("/account/delete", handler.Account.HandleRequestDeletion)
+		api.POST("/account/delete/cancel", handler.Account.HandleCancelDeletion)
+		api.POST("/account/email", handler.Account.HandleRequestEmailChange)
+		api.GET("/account/email/verify", handler.Account.HandleVerifyEmailChange)
+		api.GET("/account/sessions", handler.Account.HandleListSessions)
+		api.DELETE("/account/sessions", handler.Account.HandleRevokeAllSessions)
+		api.DELETE("/account/sessions/:id", handler.Account.HandleRevokeSession)
+
 		// Web app routes
 		api.POST("/iwebapp", handler.WebApp.HandleWebApp)
+		api.GET("/export/:app/:file", handler.Export.HandleExport)
+		api.POST("/import/:app", handler.Import.HandleImport)
+		api.GET("/collab/:app/:file", handler.Collab.HandleCollab)
+
+		// Sharing routes
+		api.GET("/shares", handler.Share.HandleListShares)
+		api.GET("/shares/:app", handler.Share.HandleListShares)
+		api.POST("/shares/:app", handler.Share.HandleShare)
+		api.DELETE("/shares/:app", handler.Share.HandleUnshare)
+		api.GET("/shared", handler.Share.HandleSharedWithMe)
+
+		// Share link routes; /view pages need no account
+		api.GET("/links", handler.ShareLink.HandleListLinks)
+		api.POST("/links/:app/:file", handler.ShareLink.HandleCreateLink)
+		api.DELETE("/links/:token", handler.ShareLink.HandleRevokeLink)
+		api.GET("/view/:token", handler.ShareLink.HandleView)
+		api.POST("/view/:token", handler.ShareLink.HandleUnlock)
 		
 		// Email routes
 		api.POST("/irunasemailer", handler.Email.HandleRunAsEmail)
@@ -105,4 +184,28 @@ func setupRoutes(router *gin.Engine, handler *handlers.Handler) {
 		// Generic browser verification
 		api.GET("/browser/static/*filepath", handler.App.HandleGoogleVerification)
 	}
+
+	// Admin routes
+	admin := router.Group("/admin")
+	admin.Use(middleware.Authentication(handler.CurrentUser), handler.Admin.RequireAdmin())
+	{
+		admin.GET("/users", handler.Admin.HandleListUsers)
+		admin.GET("/users/:email", handler.Admin.HandleGetUser)
+		admin.DELETE("/users/:email", handler.Admin.HandleDeleteUser)
+		admin.GET("/users/:email/usage", handler.Admin.HandleUsage)
+		admin.POST("/users/:email/confirm", handler.Admin.HandleConfirmUser)
+		admin.POST("/users/:email/disable", handler.Admin.HandleDisableUser)
+		admin.POST("/users/:email/enable", handler.Admin.HandleEnableUser)
+		admin.POST("/users/:email/unlock", handler.Admin.HandleUnlockUser)
+		admin.POST("/users/:email/role", handler.Admin.HandleSetRole)
+		admin.POST("/users/:email/password", handler.Admin.HandleResetPassword)
+		admin.POST("/users/:email/delete/cancel", handler.Admin.HandleCancelDeletion)
+		admin.GET("/lockouts", handler.Admin.HandleLockouts)
+		admin.GET("/deletions", handler.Admin.HandleDeletions)
+		admin.GET("/audit", handler.Admin.HandleAuditLog)
+		admin.GET("/audit/export", handler.Admin.HandleAuditExport)
+		admin.GET("/invites", handler.Admin.HandleListInvites)
+		admin.POST("/invites", handler.Admin.HandleCreateInvite)
+		admin.DELETE("/invites/:code", handler.Admin.HandleDeleteInvite)
+	}
 }
\ No newline at end of file
@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/c4gt/tornado-nginx-go-backend/internal/models"
+	"github.com/c4gt/tornado-nginx-go-backend/internal/storage"
+)
+
+// SetBootstrapAdmins lists accounts that always get the admin role. Existing
+// accounts are promoted immediately; the others when they are created.
+func (s *Service) SetBootstrapAdmins(emails []string) {
+	s.bootstrapAdmins = make(map[string]bool)
+	for _, email := range emails {
+		email = NormalizeEmail(email)
+		if email == "" {
+			continue
+		}
+		s.bootstrapAdmins[email] = true
+
+		user, err := s.GetUser(email)
+		if err != nil {
+			continue
+		}
+		if !user.IsAdmin() {
+			user.Role = models.RoleAdmin
+			if err := s.setUser(user); err != nil {
+				log.Printf("Failed to promote %s to admin: %v", email, err)
+			} else {
+				log.Printf("Promoted %s to admin", email)
+			}
+		}
+	}
+}
+
+func (s *Service) isBootstrapAdmin(email string) bool {
+	return s.bootstrapAdmins[NormalizeEmail(email)]
+}
+
+func (s *Service) initialRole(email string) string {
+	if s.isBootstrapAdmin(email) {
+		return models.RoleAdmin
+	}
+	return models.RoleUser
+}
+
+// GetUserRole returns the role of an enabled user
+func (s *Service) GetUserRole(email string) (string, error) {
+	user, err := s.GetUser(email)
+	if err != nil {
+		return "", err
+	}
+	if user.Disabled {
+		return "", ErrUserDisabled
+	}
+	return user.GetRole(), nil
+}
+
+func (s *Service) SetUserRole(email, role string) error {
+	if !models.ValidRole(role) {
+		return fmt.Errorf("invalid role: %s", role)
+	}
+
+	user, err := s.GetUser(email)
+	if err != nil {
+		return err
+	}
+
+	user.Role = role
+	return s.setUser(user)
+}
+
+func (s *Service) SetUserDisabled(email string, disabled bool) error {
+	user, err := s.GetUser(email)
+	if err != nil {
+		return err
+	}
+
+	user.Disabled = disabled
+	return s.setUser(user)
+}
+
+// ListUsers returns users whose email contains query, sorted by email, along
+// with the total number of matches.
+func (s *Service) ListUsers(query string, offset, limit int) ([]*models.User, int, error) {
+	prefix := strings.Join([]string{"home", UserDir}, "/") + "/"
+	paths, err := s.storage.ListItems(strings.TrimSuffix(prefix, "/"))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	query = strings.ToLower(query)
+	var emails []string
+	for _, path := range paths {
+		segment := strings.TrimPrefix(path, prefix)
+		if segment == "" || strings.Contains(segment, "/") {
+			continue
+		}
+		email, err := storage.DecodeSegment(segment)
+		if err != nil {
+			continue
+		}
+		if query != "" && !strings.Contains(strings.ToLower(email), query) {
+			continue
+		}
+		emails = append(emails, email)
+	}
+	sort.Strings(emails)
+
+	total := len(emails)
+	if offset > total {
+		offset = total
+	}
+	emails = emails[offset:]
+	if limit > 0 && len(emails) > limit {
+		emails = emails[:limit]
+	}
+
+	users := make([]*models.User, 0, len(emails))
+	for _, email := range emails {
+		user, err := s.GetUser(email)
+		if err != nil {
+			log.Printf("Skipping unreadable user record %s: %v", email, err)
+			continue
+		}
+		users = append(users, user)
+	}
+	return users, total, nil
+}
+
+// StorageUsage reports the number of stored items and bytes in a user's home
+func (s *Service) StorageUsage(email string) (int, int64, error) {
+	return storage.Usage(s.storage, HomePath(email))
+}
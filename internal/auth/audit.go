@@ -0,0 +1,261 @@
+package auth
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/c4gt/tornado-nginx-go-backend/internal/models"
+	"github.com/c4gt/tornado-nginx-go-backend/internal/storage"
+)
+
+// Audit events are stored one item each, under the UTC day they happened,
+// named by their time so that listing a day gives them in order. Items are
+// only ever added, never rewritten, so recording an event costs one write
+// however busy the day, and no flood of events can push others out; only
+// PruneAuditLog removes them, a day at a time once past the retention. Each
+// day also has a marker item, so that the days can be listed without
+// listing every event.
+const (
+	AuditDir     = "audit"
+	AuditDaysDir = "auditdays"
+
+	DefaultAuditRetention = 90 * 24 * time.Hour
+
+	// auditDayFormat names the bucket holding one UTC day of audit events
+	auditDayFormat = "2006-01-02"
+)
+
+// SetAuditRetention sets how long audit events are kept. Zero keeps them
+// forever.
+func (s *Service) SetAuditRetention(retention time.Duration) {
+	s.auditRetention = retention
+}
+
+func (s *Service) getAuditDirPath() []string {
+	return []string{"home", SecurityDir, AuditDir}
+}
+
+func (s *Service) getAuditPath(day string) []string {
+	return append(s.getAuditDirPath(), day)
+}
+
+func (s *Service) getAuditDaysPath() []string {
+	return []string{"home", SecurityDir, AuditDaysDir}
+}
+
+func (s *Service) getAuditDayMarkerPath(day string) []string {
+	return append(s.getAuditDaysPath(), day)
+}
+
+// RecordAuditEvent adds an event to the audit log. Failures are logged
+// rather than returned so that auditing never blocks authentication.
+func (s *Service) RecordAuditEvent(event *models.AuditEvent) {
+	if event.At.IsZero() {
+		event.At = s.now()
+	}
+	event.At = event.At.UTC()
+
+	if err := s.putAuditEvent(event); err != nil {
+		log.Printf("Failed to record audit event %s for %s: %v", event.Type, event.Actor, err)
+	}
+}
+
+func (s *Service) putAuditEvent(event *models.AuditEvent) error {
+	day := event.At.Format(auditDayFormat)
+	// The marker goes first, so that no event is stored under a day that
+	// cannot be listed; it is written once per day and process
+	if last, _ := s.lastAuditDay.Load().(string); last != day {
+		path := s.getAuditDayMarkerPath(day)
+		item, err := models.NewStorageItem(path, "file", day).ToJSON()
+		if err != nil {
+			return err
+		}
+		if err := s.storage.PutItem(strings.Join(path, "/"), item); err != nil {
+			return err
+		}
+		s.lastAuditDay.Store(day)
+	}
+	return putEventItem(s, s.getAuditPath(day), event.At, event)
+}
+
+// auditDays returns the days that have audit events, oldest first
+func (s *Service) auditDays() ([]time.Time, error) {
+	prefix := strings.Join(s.getAuditDaysPath(), "/")
+	items, err := s.storage.ListItems(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var days []time.Time
+	for _, item := range items {
+		day, err := time.Parse(auditDayFormat, strings.TrimPrefix(item, prefix+"/"))
+		if err != nil {
+			continue
+		}
+		days = append(days, day)
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Before(days[j]) })
+	return days, nil
+}
+
+// auditDayKeys returns the items of the day's events in the filter's time
+// range, oldest first
+func (s *Service) auditDayKeys(day time.Time, filter models.AuditFilter) ([]string, error) {
+	keys, err := listEventItems(s, s.getAuditPath(day.Format(auditDayFormat)))
+	if err != nil {
+		return nil, err
+	}
+	inRange := keys[:0]
+	for _, key := range keys {
+		if at, ok := eventItemTime(key); ok {
+			if !filter.From.IsZero() && at.Before(filter.From) {
+				continue
+			}
+			if !filter.To.IsZero() && !at.Before(filter.To) {
+				continue
+			}
+		}
+		inRange = append(inRange, key)
+	}
+	return inRange, nil
+}
+
+// auditDaysInRange returns the days that may have events in the filter's
+// time range, oldest first
+func (s *Service) auditDaysInRange(filter models.AuditFilter) ([]time.Time, error) {
+	days, err := s.auditDays()
+	if err != nil {
+		return nil, err
+	}
+	inRange := days[:0]
+	for _, day := range days {
+		if !filter.To.IsZero() && !day.Before(filter.To) {
+			continue
+		}
+		if !filter.From.IsZero() && !day.Add(24*time.Hour).After(filter.From) {
+			continue
+		}
+		inRange = append(inRange, day)
+	}
+	return inRange, nil
+}
+
+// AuditEvents returns up to limit events matching the filter, newest first.
+// A limit of zero returns every match.
+func (s *Service) AuditEvents(filter models.AuditFilter, limit int) ([]models.AuditEvent, error) {
+	days, err := s.auditDaysInRange(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []models.AuditEvent
+	for i := len(days) - 1; i >= 0; i-- {
+		keys, err := s.auditDayKeys(days[i], filter)
+		if err != nil {
+			return nil, err
+		}
+		for j := len(keys) - 1; j >= 0; j-- {
+			event, err := readEventItem[models.AuditEvent](s, keys[j])
+			if errors.Is(err, storage.ErrNotFound) {
+				// Pruned meanwhile
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if !filter.Matches(event) {
+				continue
+			}
+			result = append(result, *event)
+			if limit > 0 && len(result) >= limit {
+				return result, nil
+			}
+		}
+	}
+	return result, nil
+}
+
+// EachAuditEvent calls fn with every event matching the filter, oldest
+// first, reading a day of events at a time, and stops at the first error fn
+// returns
+func (s *Service) EachAuditEvent(filter models.AuditFilter, fn func(*models.AuditEvent) error) error {
+	days, err := s.auditDaysInRange(filter)
+	if err != nil {
+		return err
+	}
+	for _, day := range days {
+		keys, err := s.auditDayKeys(day, filter)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			event, err := readEventItem[models.AuditEvent](s, key)
+			if errors.Is(err, storage.ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if !filter.Matches(event) {
+				continue
+			}
+			if err := fn(event); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// PruneAuditLog removes the days of audit events older than the retention
+// period and returns how many were removed
+func (s *Service) PruneAuditLog() int {
+	if s.auditRetention <= 0 {
+		return 0
+	}
+	days, err := s.auditDays()
+	if err != nil {
+		log.Printf("Failed to list audit log: %v", err)
+		return 0
+	}
+
+	cutoff := s.now().UTC().Add(-s.auditRetention)
+	removed := 0
+	for _, day := range days {
+		// Keep a day until its last event has expired
+		if !day.Add(24 * time.Hour).Before(cutoff) {
+			break
+		}
+		name := day.Format(auditDayFormat)
+		keys, err := listEventItems(s, s.getAuditPath(name))
+		if err != nil {
+			log.Printf("Failed to list audit events of %s: %v", name, err)
+			continue
+		}
+		failed := 0
+		for _, key := range keys {
+			if err := s.storage.DeleteItem(key); err != nil && !errors.Is(err, storage.ErrNotFound) {
+				failed++
+			}
+		}
+		if failed > 0 {
+			log.Printf("Failed to prune %d audit events of %s", failed, name)
+			continue
+		}
+		// The marker goes last, so that a day only partly pruned is pruned
+		// again next time
+		err = s.storage.DeleteItem(strings.Join(s.getAuditDayMarkerPath(name), "/"))
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			log.Printf("Failed to prune audit events of %s: %v", name, err)
+			continue
+		}
+		removed++
+	}
+	if removed > 0 {
+		log.Printf("Pruned %d days of audit events", removed)
+	}
+	return removed
+}
@@ -1,36 +1,101 @@
 package auth
 
 import (
+	"crypto/subtle"
+	"errors"
 	"fmt"
+	"log"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
 
 	"github.com/c4gt/tornado-nginx-go-backend/internal/models"
 	"github.com/c4gt/tornado-nginx-go-backend/internal/storage"
+	"golang.org/x/text/unicode/norm"
 )
 
 const (
 	UserDir     = "users"
 	UserDirPath = "home/users"
+
+	maxEmailLength = 254
+
+	// PasswordResetTTL is how long an emailed password reset link works
+	PasswordResetTTL        = time.Hour
+	passwordResetTokenBytes = 24
+)
+
+var (
+	ErrUserNotFound = errors.New("user not found")
+	ErrUserDisabled = errors.New("user disabled")
+
+	ErrPasswordResetInvalid = errors.New("password reset link is invalid or has expired")
 )
 
 type Service struct {
-	storage storage.Storage
+	storage  storage.Storage
+	lockout  LockoutPolicy
+	password PasswordPolicy
+	now      func() time.Time
+
+	bootstrapAdmins map[string]bool
+	deletionGrace   time.Duration
+	redirectPeriod  time.Duration
+	auditRetention  time.Duration
+	registration    RegistrationPolicy
+
+	// inviteMutex serializes uses of invite codes
+	inviteMutex sync.Mutex
+	// resetMutex serializes uses of password reset tokens
+	resetMutex sync.Mutex
+	// shareMutex serializes changes to shares and the indexes of them
+	shareMutex sync.Mutex
+	// linkMutex serializes changes to share links, such as counting views
+	linkMutex sync.Mutex
+	// homeLocks are held for reading while a request changes files in a
+	// home and for writing while the home moves, each shared by a few homes
+	homeLocks [homeLockCount]sync.RWMutex
+	// lastAuditDay is the last day this process marked as having audit
+	// events
+	lastAuditDay atomic.Value
 }
 
 func NewService(storage storage.Storage) *Service {
 	return &Service{
-		storage: storage,
+		storage:  storage,
+		lockout:  DefaultLockoutPolicy(),
+		password: DefaultPasswordPolicy(),
+		now:      time.Now,
+
+		deletionGrace:  DefaultDeletionGracePeriod,
+		redirectPeriod: DefaultEmailRedirectPeriod,
+		auditRetention: DefaultAuditRetention,
+		registration:   DefaultRegistrationPolicy(),
 	}
 }
 
+func (s *Service) SetPasswordPolicy(policy PasswordPolicy) {
+	s.password = policy
+}
+
+// ValidatePassword checks a new password against the password policy
+func (s *Service) ValidatePassword(email, password string) error {
+	return s.password.Validate(email, password)
+}
+
 func (s *Service) getUserPath(email string) []string {
-	return []string{"home", UserDir, email}
+	return []string{"home", UserDir, emailSegment(email)}
 }
 
 func (s *Service) UserExists(email string) (bool, error) {
 	path := s.getUserPath(email)
 	item, err := s.storage.GetFile(path)
 	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return false, nil
+		}
 		return false, err
 	}
 	return item != nil, nil
@@ -40,10 +105,13 @@ func (s *Service) GetUser(email string) (*models.User, error) {
 	path := s.getUserPath(email)
 	item, err := s.storage.GetFile(path)
 	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil, ErrUserNotFound
+		}
 		return nil, err
 	}
 	if item == nil {
-		return nil, fmt.Errorf("user not found")
+		return nil, ErrUserNotFound
 	}
 
 	// Convert the data to string and then parse as User
@@ -61,7 +129,7 @@ func (s *Service) GetUser(email string) (*models.User, error) {
 }
 
 func (s *Service) CreateUser(email, password string) error {
-	exists, err := s.UserExists(email)
+	exists, err := s.EmailInUse(email)
 	if err != nil {
 		return err
 	}
@@ -69,10 +137,16 @@ func (s *Service) CreateUser(email, password string) error {
 		return fmt.Errorf("user already exists")
 	}
 
+	if err := s.ValidatePassword(email, password); err != nil {
+		return err
+	}
+
+	email = NormalizeEmail(email)
 	user, err := models.NewUser(email, password)
 	if err != nil {
 		return err
 	}
+	user.Role = s.initialRole(email)
 
 	path := s.getUserPath(email)
 	userData, err := user.ToJSON()
@@ -91,7 +165,16 @@ func (s *Service) CreateUser(email, password string) error {
 		}
 	}
 
-	return s.storage.CreateFile(path, userData)
+	// Of two registrations, or a registration and an email change, to the
+	// same address only one creates the account
+	created, err := s.createFile(path, userData)
+	if err != nil {
+		return err
+	}
+	if !created {
+		return fmt.Errorf("user already exists")
+	}
+	return nil
 }
 
 func (s *Service) AuthenticateUser(email, password string) (bool, error) {
@@ -104,7 +187,27 @@ func (s *Service) AuthenticateUser(email, password string) (bool, error) {
 		return false, fmt.Errorf("user not confirmed")
 	}
 
-	return user.Authenticate(password), nil
+	if !user.Authenticate(password) {
+		return false, nil
+	}
+
+	if user.Disabled {
+		return false, ErrUserDisabled
+	}
+
+	// Transparently upgrade hashes made with an outdated algorithm or cost
+	if user.NeedsRehash() {
+		if err := user.SetPassword(password); err != nil {
+			log.Printf("Failed to upgrade password hash for %s: %v", email, err)
+		}
+	}
+
+	user.LastLogin = s.now()
+	if err := s.setUser(user); err != nil {
+		log.Printf("Failed to update user record for %s: %v", email, err)
+	}
+
+	return true, nil
 }
 
 func (s *Service) UpdatePassword(email, newPassword string) error {
@@ -113,6 +216,10 @@ func (s *Service) UpdatePassword(email, newPassword string) error {
 		return err
 	}
 
+	if err := s.ValidatePassword(email, newPassword); err != nil {
+		return err
+	}
+
 	err = user.SetPassword(newPassword)
 	if err != nil {
 		return err
@@ -121,46 +228,90 @@ func (s *Service) UpdatePassword(email, newPassword string) error {
 	return s.setUser(user)
 }
 
-func (s *Service) SetUserDongle(email, dongle string) error {
-	user, err := s.GetUser(email)
+// StartPasswordReset gives the user a new password reset token, replacing
+// any earlier one. The token can be used once, within PasswordResetTTL.
+func (s *Service) StartPasswordReset(email string) (string, error) {
+	token, err := randomToken(passwordResetTokenBytes)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	user.SetDongle(dongle)
-	return s.setUser(user)
-}
+	s.resetMutex.Lock()
+	defer s.resetMutex.Unlock()
 
-func (s *Service) GetUserDongle(email string) (string, error) {
 	user, err := s.GetUser(email)
 	if err != nil {
 		return "", err
 	}
+	user.SetDongle(token)
+	user.DongleExpires = s.now().Add(PasswordResetTTL)
+	if err := s.setUser(user); err != nil {
+		return "", err
+	}
+	return token, nil
+}
 
-	return user.GetDongle(), nil
+// CheckPasswordReset returns ErrPasswordResetInvalid unless token is the
+// user's current, unexpired password reset token
+func (s *Service) CheckPasswordReset(email, token string) error {
+	user, err := s.GetUser(email)
+	if err != nil {
+		if errors.Is(err, ErrUserNotFound) {
+			return ErrPasswordResetInvalid
+		}
+		return err
+	}
+	return s.checkResetToken(user, token)
 }
 
-func (s *Service) ConfirmUser(email string) error {
+// ResetPassword sets a new password for the holder of a password reset
+// token and uses the token up. A password the policy refuses leaves the
+// token valid so the user can try another.
+func (s *Service) ResetPassword(email, token, newPassword string) error {
+	s.resetMutex.Lock()
+	defer s.resetMutex.Unlock()
+
 	user, err := s.GetUser(email)
 	if err != nil {
+		if errors.Is(err, ErrUserNotFound) {
+			return ErrPasswordResetInvalid
+		}
+		return err
+	}
+	if err := s.checkResetToken(user, token); err != nil {
+		return err
+	}
+	if err := s.ValidatePassword(user.Email, newPassword); err != nil {
 		return err
 	}
 
-	user.SetConfirmed()
+	if err := user.SetPassword(newPassword); err != nil {
+		return err
+	}
+	user.SetDongle("")
+	user.DongleExpires = time.Time{}
 	return s.setUser(user)
 }
 
-func (s *Service) DeleteUser(email string) error {
-	exists, err := s.UserExists(email)
+func (s *Service) checkResetToken(user *models.User, token string) error {
+	dongle := user.GetDongle()
+	if token == "" || dongle == "" || !s.now().Before(user.DongleExpires) {
+		return ErrPasswordResetInvalid
+	}
+	if subtle.ConstantTimeCompare([]byte(dongle), []byte(token)) != 1 {
+		return ErrPasswordResetInvalid
+	}
+	return nil
+}
+
+func (s *Service) ConfirmUser(email string) error {
+	user, err := s.GetUser(email)
 	if err != nil {
 		return err
 	}
-	if !exists {
-		return fmt.Errorf("user does not exist")
-	}
 
-	path := s.getUserPath(email)
-	return s.storage.DeleteFile(path)
+	user.SetConfirmed()
+	return s.setUser(user)
 }
 
 func (s *Service) setUser(user *models.User) error {
@@ -173,7 +324,62 @@ func (s *Service) setUser(user *models.User) error {
 	return s.storage.UpdateFile(path, userData)
 }
 
-// ValidateEmail performs basic email validation
+// createFile stores a record that must not exist yet, in one conditional
+// write, and reports whether it did. The record is readable with GetFile
+// but not listed in its parent directory.
+func (s *Service) createFile(path []string, data string) (bool, error) {
+	item, err := models.NewStorageItem(path, "file", data).ToJSON()
+	if err != nil {
+		return false, err
+	}
+	return s.storage.SwapItem(strings.Join(path, "/"), "", item)
+}
+
+// putFile creates or replaces a record, creating its parent directory first
+func (s *Service) putFile(path []string, data string) error {
+	parentPath := path[:len(path)-1]
+	if _, err := s.storage.GetFile(parentPath); err != nil {
+		if err := s.storage.CreateDir(parentPath); err != nil {
+			return err
+		}
+	}
+
+	if _, err := s.storage.GetFile(path); err != nil {
+		return s.storage.CreateFile(path, data)
+	}
+	return s.storage.UpdateFile(path, data)
+}
+
+// ValidateEmail performs basic email validation: a local part and a domain
+// separated by '@', without spaces or control characters
 func ValidateEmail(email string) bool {
-	return strings.Contains(email, "@") && len(email) > 3
-}
\ No newline at end of file
+	at := strings.LastIndex(email, "@")
+	if at <= 0 || at == len(email)-1 || len(email) > maxEmailLength {
+		return false
+	}
+	for _, r := range email {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// NormalizeEmail returns the canonical form of an email address, which
+// identifies an account: trimmed, in Unicode normal form and lower case, so
+// that addresses differing only in case belong to the same account.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(norm.NFC.String(strings.TrimSpace(email)))
+}
+
+// HomePath returns the storage path of a user's home directory, or of the
+// item below it named by segments. Every segment is encoded, so no name can
+// reach outside the home directory.
+func HomePath(email string, segments ...string) []string {
+	return append([]string{"home", emailSegment(email)}, storage.EncodePath(segments...)...)
+}
+
+// emailSegment is the path segment that stands for an account
+func emailSegment(email string) string {
+	return storage.EncodeSegment(NormalizeEmail(email))
+}
@@ -1,14 +1,20 @@
 package auth
 
 import (
+	"errors"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/c4gt/tornado-nginx-go-backend/internal/models"
 	"github.com/c4gt/tornado-nginx-go-backend/internal/storage"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // MockStorage implements the Storage interface for testing
 type MockStorage struct {
+	mu    sync.Mutex
 	files map[string]*models.StorageItem
 }
 
@@ -30,12 +36,16 @@ func (m *MockStorage) pathToString(path []string) string {
 }
 
 func (m *MockStorage) CreateFile(path []string, data string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	key := m.pathToString(path)
 	m.files[key] = models.NewStorageItem(path, "file", data)
 	return nil
 }
 
 func (m *MockStorage) GetFile(path []string) (*models.StorageItem, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	key := m.pathToString(path)
 	item, exists := m.files[key]
 	if !exists {
@@ -45,6 +55,8 @@ func (m *MockStorage) GetFile(path []string) (*models.StorageItem, error) {
 }
 
 func (m *MockStorage) UpdateFile(path []string, data string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	key := m.pathToString(path)
 	if _, exists := m.files[key]; !exists {
 		return storage.ErrNotFound
@@ -54,6 +66,8 @@ func (m *MockStorage) UpdateFile(path []string, data string) error {
 }
 
 func (m *MockStorage) DeleteFile(path []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	key := m.pathToString(path)
 	if _, exists := m.files[key]; !exists {
 		return storage.ErrNotFound
@@ -63,40 +77,93 @@ func (m *MockStorage) DeleteFile(path []string) error {
 }
 
 func (m *MockStorage) CreateDir(path []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	key := m.pathToString(path)
 	m.files[key] = models.NewStorageItem(path, "dir", []string{})
 	return nil
 }
 
 func (m *MockStorage) DeleteDir(path []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	key := m.pathToString(path)
 	if _, exists := m.files[key]; !exists {
 		return storage.ErrNotFound
 	}
-	delete(m.files, key)
+	for k := range m.files {
+		if k == key || strings.HasPrefix(k, key+"/") {
+			delete(m.files, k)
+		}
+	}
 	return nil
 }
 
 func (m *MockStorage) PutItem(path string, data string, bucket ...string) error {
-	// Not implemented for mock
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	item, err := models.StorageItemFromJSON(data)
+	if err != nil {
+		return err
+	}
+	m.files[path] = item
 	return nil
 }
 
 func (m *MockStorage) GetItem(path string, bucket ...string) (string, error) {
-	// Not implemented for mock
-	return "", nil
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	item, exists := m.files[path]
+	if !exists {
+		return "", storage.ErrNotFound
+	}
+	return item.ToJSON()
 }
 
 func (m *MockStorage) ExistsItem(path string, bucket ...string) (bool, error) {
-	// Not implemented for mock
-	return false, nil
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, exists := m.files[path]
+	return exists, nil
 }
 
 func (m *MockStorage) DeleteItem(path string, bucket ...string) error {
-	// Not implemented for mock
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.files, path)
 	return nil
 }
 
+func (m *MockStorage) ListItems(prefix string, bucket ...string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var paths []string
+	for key := range m.files {
+		if strings.HasPrefix(key, prefix+"/") {
+			paths = append(paths, key)
+		}
+	}
+	return paths, nil
+}
+
+func (m *MockStorage) SwapItem(path, old, data string, bucket ...string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	current := ""
+	if item, exists := m.files[path]; exists {
+		current, _ = item.ToJSON()
+	}
+	if current != old {
+		return false, nil
+	}
+	item, err := models.StorageItemFromJSON(data)
+	if err != nil {
+		return false, err
+	}
+	m.files[path] = item
+	return true, nil
+}
+
 func TestCreateUser(t *testing.T) {
 	mockStorage := NewMockStorage()
 	service := NewService(mockStorage)
@@ -228,4 +295,1253 @@ func TestUpdatePassword(t *testing.T) {
 	if !authenticated {
 		t.Error("Authentication should succeed with new password")
 	}
-}
\ No newline at end of file
+}
+func TestPasswordResetExpires(t *testing.T) {
+	service := NewService(NewMockStorage())
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	service.now = func() time.Time { return now }
+
+	const email = "reset@example.com"
+	if err := service.CreateUser(email, "correct horse battery"); err != nil {
+		t.Fatal(err)
+	}
+	dongle, err := service.StartPasswordReset(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := service.CheckPasswordReset(email, dongle); err != nil {
+		t.Fatalf("CheckPasswordReset = %v", err)
+	}
+	if err := service.CheckPasswordReset("other@example.com", dongle); !errors.Is(err, ErrPasswordResetInvalid) {
+		t.Errorf("token of another user = %v, want ErrPasswordResetInvalid", err)
+	}
+
+	now = now.Add(PasswordResetTTL)
+	if err := service.ResetPassword(email, dongle, "a different passphrase"); !errors.Is(err, ErrPasswordResetInvalid) {
+		t.Errorf("expired token = %v, want ErrPasswordResetInvalid", err)
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	mockStorage := NewMockStorage()
+	service := NewService(mockStorage)
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	service.now = func() time.Time { return now }
+	service.SetLockoutPolicy(LockoutPolicy{
+		MaxAttempts:     3,
+		IPMaxAttempts:   10,
+		Window:          15 * time.Minute,
+		LockoutDuration: 10 * time.Minute,
+		BaseDelay:       time.Second,
+		MaxDelay:        4 * time.Second,
+	})
+
+	email := "test@example.com"
+	password := "testpassword"
+	if err := service.CreateUser(email, password); err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		authenticated, err := service.AuthenticateUserFrom(email, "wrongpassword", "10.0.0.1")
+		if err != nil {
+			t.Fatalf("attempt %d: unexpected error: %v", i+1, err)
+		}
+		if authenticated {
+			t.Fatalf("attempt %d: authentication should fail", i+1)
+		}
+		now = now.Add(5 * time.Second)
+	}
+
+	// The correct password is refused while the account is locked
+	_, err := service.AuthenticateUserFrom(email, password, "10.0.0.2")
+	var throttleErr *ThrottleError
+	if !errors.As(err, &throttleErr) || !throttleErr.Locked {
+		t.Fatalf("expected lockout error, got %v", err)
+	}
+
+	locked, err := service.IsLocked(email)
+	if err != nil || !locked {
+		t.Errorf("IsLocked = %v, %v; want true", locked, err)
+	}
+
+	events, err := service.LockoutEvents(10)
+	if err != nil {
+		t.Fatalf("LockoutEvents failed: %v", err)
+	}
+	if len(events) != 1 || events[0].Email != email {
+		t.Errorf("expected one lockout event for %s, got %+v", email, events)
+	}
+
+	// Lockout expires
+	now = now.Add(11 * time.Minute)
+	authenticated, err := service.AuthenticateUserFrom(email, password, "10.0.0.2")
+	if err != nil || !authenticated {
+		t.Errorf("authentication after lockout = %v, %v; want true", authenticated, err)
+	}
+}
+
+// slowStorage delays reads of items
+type slowStorage struct {
+	*MockStorage
+}
+
+func (s *slowStorage) GetItem(path string, bucket ...string) (string, error) {
+	data, err := s.MockStorage.GetItem(path, bucket...)
+	time.Sleep(time.Millisecond)
+	return data, err
+}
+
+func TestLoginLockoutConcurrent(t *testing.T) {
+	// Two instances sharing the storage, which answers slowly enough for
+	// the guesses to overlap
+	mockStorage := &slowStorage{NewMockStorage()}
+	instances := []*Service{NewService(mockStorage), NewService(mockStorage)}
+	for _, instance := range instances {
+		instance.SetLockoutPolicy(LockoutPolicy{MaxAttempts: 3, LockoutDuration: 10 * time.Minute})
+	}
+	service := instances[0]
+
+	email := "test@example.com"
+	if err := service.CreateUser(email, "testpassword"); err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+
+	// Parallel guesses must not all see the same failure count
+	const attempts = 20
+	var wg sync.WaitGroup
+	results := make(chan error, attempts)
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func(instance *Service) {
+			defer wg.Done()
+			_, err := instance.AuthenticateUserFrom(email, "wrongpassword", "10.0.0.1")
+			results <- err
+		}(instances[i%len(instances)])
+	}
+	wg.Wait()
+	close(results)
+
+	checked := 0
+	for err := range results {
+		var throttleErr *ThrottleError
+		if err == nil {
+			checked++
+		} else if !errors.As(err, &throttleErr) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if checked != 3 {
+		t.Errorf("%d guesses were checked, want 3", checked)
+	}
+	if locked, err := service.IsLocked(email); err != nil || !locked {
+		t.Errorf("IsLocked = %v, %v; want true", locked, err)
+	}
+}
+
+func TestLoginProgressiveDelay(t *testing.T) {
+	mockStorage := NewMockStorage()
+	service := NewService(mockStorage)
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	service.now = func() time.Time { return now }
+
+	email := "test@example.com"
+	if err := service.CreateUser(email, "testpassword"); err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+
+	if _, err := service.AuthenticateUserFrom(email, "wrong", "10.0.0.1"); err != nil {
+		t.Fatalf("first attempt: unexpected error: %v", err)
+	}
+	if _, err := service.AuthenticateUserFrom(email, "wrong", "10.0.0.1"); err == nil {
+		t.Fatal("immediate retry should be throttled")
+	}
+
+	now = now.Add(time.Second)
+	if _, err := service.AuthenticateUserFrom(email, "wrong", "10.0.0.1"); err != nil {
+		t.Fatalf("retry after delay: unexpected error: %v", err)
+	}
+
+	// The second failure doubles the delay
+	now = now.Add(time.Second)
+	_, err := service.AuthenticateUserFrom(email, "wrong", "10.0.0.1")
+	var throttleErr *ThrottleError
+	if !errors.As(err, &throttleErr) || throttleErr.Locked {
+		t.Fatalf("expected delay error, got %v", err)
+	}
+	if throttleErr.RetryAfter != time.Second {
+		t.Errorf("RetryAfter = %s, want 1s", throttleErr.RetryAfter)
+	}
+
+	// Unknown accounts are throttled too
+	if _, err := service.AuthenticateUserFrom("nobody@example.com", "wrong", ""); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("expected ErrUserNotFound, got %v", err)
+	}
+	if _, err := service.AuthenticateUserFrom("nobody@example.com", "wrong", ""); !errors.As(err, &throttleErr) {
+		t.Fatalf("expected throttle error for unknown account, got %v", err)
+	}
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	policy := DefaultPasswordPolicy()
+
+	tests := []struct {
+		password string
+		valid    bool
+	}{
+		{"", false},
+		{"short", false},
+		{"password123", false},
+		{"QWERTY123", false},
+		{"tester@example.com", false},
+		{"tester", false},
+		{"correct horse battery", true},
+		{"Xk9#mLp2vQ", true},
+	}
+
+	for _, test := range tests {
+		err := policy.Validate("tester@example.com", test.password)
+		if (err == nil) != test.valid {
+			t.Errorf("Validate(%q) = %v, want valid=%v", test.password, err, test.valid)
+		}
+	}
+
+	mockStorage := NewMockStorage()
+	service := NewService(mockStorage)
+	err := service.CreateUser("test@example.com", "password")
+	var policyErr *PasswordPolicyError
+	if !errors.As(err, &policyErr) {
+		t.Errorf("CreateUser with common password: got %v, want PasswordPolicyError", err)
+	}
+}
+
+func TestPasswordPolicyBcryptLimit(t *testing.T) {
+	defer models.SetPasswordHasher(models.GetPasswordHasher())
+	models.SetPasswordHasher(models.NewBcryptHasher(bcrypt.MinCost))
+	policy := DefaultPasswordPolicy()
+
+	for _, test := range []struct {
+		password string
+		valid    bool
+	}{
+		{strings.Repeat("k", 72), true},
+		{strings.Repeat("k", 73), false},
+		// 40 characters, 80 bytes
+		{strings.Repeat("é", 40), false},
+	} {
+		if err := policy.Validate("tester@example.com", test.password); (err == nil) != test.valid {
+			t.Errorf("Validate(%d bytes) = %v, want valid=%v", len(test.password), err, test.valid)
+		}
+	}
+
+	// Passwords the policy accepts can be hashed
+	service := NewService(NewMockStorage())
+	service.SetPasswordPolicy(policy)
+	if err := service.CreateUser("long@example.com", strings.Repeat("k", 72)); err != nil {
+		t.Errorf("CreateUser with a 72-byte password: %v", err)
+	}
+	var policyErr *PasswordPolicyError
+	if err := service.CreateUser("longer@example.com", strings.Repeat("k", 73)); !errors.As(err, &policyErr) {
+		t.Errorf("CreateUser with a 73-byte password: got %v, want PasswordPolicyError", err)
+	}
+	if _, err := service.CreateShareLink("long@example.com", "touchcalc", "book", 0, strings.Repeat("k", 73)); !errors.As(err, &policyErr) {
+		t.Errorf("CreateShareLink with a 73-byte password: got %v, want PasswordPolicyError", err)
+	}
+
+	// argon2id has no such limit
+	models.SetPasswordHasher(models.NewArgon2idHasher())
+	if err := DefaultPasswordPolicy().Validate("tester@example.com", strings.Repeat("k", 73)); err != nil {
+		t.Errorf("Validate(73 bytes) with argon2id = %v", err)
+	}
+}
+
+func TestPasswordRehashOnLogin(t *testing.T) {
+	defer models.SetPasswordHasher(models.GetPasswordHasher())
+
+	mockStorage := NewMockStorage()
+	service := NewService(mockStorage)
+
+	email := "test@example.com"
+	password := "testpassword"
+
+	models.SetPasswordHasher(models.NewBcryptHasher(bcrypt.MinCost))
+	if err := service.CreateUser(email, password); err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+
+	models.SetPasswordHasher(&models.Argon2idHasher{Time: 1, Memory: 1024, Threads: 1, KeyLen: 32, SaltLen: 16})
+	authenticated, err := service.AuthenticateUser(email, password)
+	if err != nil || !authenticated {
+		t.Fatalf("AuthenticateUser = %v, %v; want true", authenticated, err)
+	}
+
+	user, err := service.GetUser(email)
+	if err != nil {
+		t.Fatalf("GetUser failed: %v", err)
+	}
+	if !strings.HasPrefix(user.PWHash, "$argon2id$") {
+		t.Errorf("password hash was not upgraded: %s", user.PWHash)
+	}
+
+	authenticated, err = service.AuthenticateUser(email, password)
+	if err != nil || !authenticated {
+		t.Errorf("AuthenticateUser after rehash = %v, %v; want true", authenticated, err)
+	}
+	authenticated, _ = service.AuthenticateUser(email, "wrongpassword")
+	if authenticated {
+		t.Error("Authentication should fail with incorrect password after rehash")
+	}
+}
+
+func TestLinkExternalIdentity(t *testing.T) {
+	mockStorage := NewMockStorage()
+	service := NewService(mockStorage)
+
+	email := "alice@example.com"
+	if err := service.CreateExternalUser(email); err != nil {
+		t.Fatalf("CreateExternalUser failed: %v", err)
+	}
+
+	// External users have no usable password
+	if authenticated, _ := service.AuthenticateUser(email, ""); authenticated {
+		t.Error("external user should not authenticate with an empty password")
+	}
+
+	if _, err := service.FindUserByIdentity("google", "sub-1"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("FindUserByIdentity before linking = %v, want ErrUserNotFound", err)
+	}
+
+	if err := service.LinkIdentity(email, "google", "sub-1", email); err != nil {
+		t.Fatalf("LinkIdentity failed: %v", err)
+	}
+
+	user, err := service.FindUserByIdentity("google", "sub-1")
+	if err != nil {
+		t.Fatalf("FindUserByIdentity failed: %v", err)
+	}
+	if user.Email != email {
+		t.Errorf("FindUserByIdentity returned %s, want %s", user.Email, email)
+	}
+
+	if err := service.CreateUser("bob@example.com", "testpassword"); err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+	if err := service.LinkIdentity("bob@example.com", "google", "sub-1", email); err == nil {
+		t.Error("linking an identity to a second account should fail")
+	}
+}
+
+func TestUserRolesAndListing(t *testing.T) {
+	mockStorage := NewMockStorage()
+	service := NewService(mockStorage)
+	service.SetBootstrapAdmins([]string{"root@example.com"})
+
+	for _, email := range []string{"carol@example.com", "root@example.com", "bob@test.org"} {
+		if err := service.CreateUser(email, "testpassword"); err != nil {
+			t.Fatalf("CreateUser(%s) failed: %v", email, err)
+		}
+	}
+
+	if role, _ := service.GetUserRole("root@example.com"); role != models.RoleAdmin {
+		t.Errorf("bootstrap admin role = %q, want %q", role, models.RoleAdmin)
+	}
+	if role, _ := service.GetUserRole("bob@test.org"); role != models.RoleUser {
+		t.Errorf("new user role = %q, want %q", role, models.RoleUser)
+	}
+
+	if err := service.SetUserRole("bob@test.org", "superuser"); err == nil {
+		t.Error("SetUserRole should reject unknown roles")
+	}
+	if err := service.SetUserRole("bob@test.org", models.RoleAdmin); err != nil {
+		t.Fatalf("SetUserRole failed: %v", err)
+	}
+	if role, _ := service.GetUserRole("bob@test.org"); role != models.RoleAdmin {
+		t.Errorf("promoted user role = %q, want %q", role, models.RoleAdmin)
+	}
+
+	users, total, err := service.ListUsers("example", 0, 10)
+	if err != nil {
+		t.Fatalf("ListUsers failed: %v", err)
+	}
+	if total != 2 || len(users) != 2 || users[0].Email != "carol@example.com" {
+		t.Errorf("ListUsers(example) = %d users of %d, want carol and root", len(users), total)
+	}
+
+	users, total, _ = service.ListUsers("", 1, 1)
+	if total != 3 || len(users) != 1 || users[0].Email != "carol@example.com" {
+		t.Errorf("ListUsers page = %v of %d, want carol of 3", users, total)
+	}
+
+	// Disabled users cannot sign in and have no role
+	if err := service.SetUserDisabled("carol@example.com", true); err != nil {
+		t.Fatalf("SetUserDisabled failed: %v", err)
+	}
+	service.ConfirmUser("carol@example.com")
+	if _, err := service.AuthenticateUser("carol@example.com", "testpassword"); !errors.Is(err, ErrUserDisabled) {
+		t.Errorf("AuthenticateUser for disabled user = %v, want ErrUserDisabled", err)
+	}
+	if _, err := service.GetUserRole("carol@example.com"); !errors.Is(err, ErrUserDisabled) {
+		t.Errorf("GetUserRole for disabled user = %v, want ErrUserDisabled", err)
+	}
+}
+
+func TestAccountDeletion(t *testing.T) {
+	mockStorage := NewMockStorage()
+	service := NewService(mockStorage)
+	service.SetDeletionGracePeriod(48 * time.Hour)
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	service.now = func() time.Time { return now }
+
+	email := "gone@example.com"
+	if err := service.CreateUser(email, "testpassword"); err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+	if err := service.LinkIdentity(email, "google", "sub-9", email); err != nil {
+		t.Fatalf("LinkIdentity failed: %v", err)
+	}
+	mockStorage.CreateDir([]string{"home", email})
+	mockStorage.CreateDir([]string{"home", email, "securespreadsheet"})
+	mockStorage.CreateFile([]string{"home", email, "securespreadsheet", "budget"}, "sheet data")
+	// A sibling whose name shares the prefix must survive
+	mockStorage.CreateDir([]string{"home", email + ".old"})
+
+	pending, err := service.ScheduleDeletion(email, email)
+	if err != nil {
+		t.Fatalf("ScheduleDeletion failed: %v", err)
+	}
+	if !pending.PurgeAfter.Equal(now.Add(48 * time.Hour)) {
+		t.Errorf("PurgeAfter = %v, want %v", pending.PurgeAfter, now.Add(48*time.Hour))
+	}
+	if due, _ := service.DueDeletions(); len(due) != 0 {
+		t.Errorf("deletion should not be due during the grace period, got %d", len(due))
+	}
+
+	if err := service.CancelDeletion(email, email); err != nil {
+		t.Fatalf("CancelDeletion failed: %v", err)
+	}
+	if pending, _ := service.PendingDeletion(email); pending != nil {
+		t.Error("deletion should no longer be pending after cancelling")
+	}
+
+	service.ScheduleDeletion(email, "admin@example.com")
+	now = now.Add(49 * time.Hour)
+	due, err := service.DueDeletions()
+	if err != nil || len(due) != 1 || due[0].Email != email {
+		t.Fatalf("DueDeletions = %v, %v, want the scheduled account", due, err)
+	}
+
+	if err := service.DeleteUser(email, due[0].RequestedBy); err != nil {
+		t.Fatalf("DeleteUser failed: %v", err)
+	}
+
+	if exists, _ := service.UserExists(email); exists {
+		t.Error("user record should be deleted")
+	}
+	if _, err := mockStorage.GetFile([]string{"home", email, "securespreadsheet", "budget"}); err == nil {
+		t.Error("user files should be purged")
+	}
+	if _, err := mockStorage.GetFile([]string{"home", email + ".old"}); err != nil {
+		t.Error("sibling directory should not be purged")
+	}
+	if _, err := mockStorage.GetFile(service.getIdentityPath("google", "sub-9")); err == nil {
+		t.Error("identity link should be removed")
+	}
+	if pending, _ := service.PendingDeletion(email); pending != nil {
+		t.Error("pending deletion should be removed after purging")
+	}
+	if err := service.DeleteUser(email, "admin@example.com"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("deleting a purged account = %v, want ErrUserNotFound", err)
+	}
+
+	events, err := service.DeletionEvents(0)
+	if err != nil {
+		t.Fatalf("DeletionEvents failed: %v", err)
+	}
+	var actions []string
+	for _, event := range events {
+		actions = append(actions, event.Action)
+	}
+	want := []string{models.DeletionPurged, models.DeletionRequested, models.DeletionCancelled, models.DeletionRequested}
+	if strings.Join(actions, ",") != strings.Join(want, ",") {
+		t.Errorf("deletion events = %v, want %v", actions, want)
+	}
+	if events[0].Actor != "admin@example.com" {
+		t.Errorf("purge actor = %q, want admin@example.com", events[0].Actor)
+	}
+}
+
+func TestChangeEmail(t *testing.T) {
+	mockStorage := NewMockStorage()
+	service := NewService(mockStorage)
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	service.now = func() time.Time { return now }
+
+	oldEmail, newEmail := "old@example.com", "new@example.com"
+	if err := service.CreateUser(oldEmail, "testpassword"); err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+	service.ConfirmUser(oldEmail)
+	service.LinkIdentity(oldEmail, "google", "sub-1", oldEmail)
+	service.CreateUser("taken@example.com", "testpassword")
+	mockStorage.CreateDir([]string{"home", oldEmail})
+	mockStorage.CreateDir([]string{"home", oldEmail, "securestore"})
+	mockStorage.CreateFile([]string{"home", oldEmail, "securestore", "budget"}, "sheet data")
+
+	if _, err := service.RequestEmailChange(oldEmail, "taken@example.com"); !errors.Is(err, ErrEmailInUse) {
+		t.Errorf("changing to a taken address = %v, want ErrEmailInUse", err)
+	}
+
+	change, err := service.RequestEmailChange(oldEmail, newEmail)
+	if err != nil {
+		t.Fatalf("RequestEmailChange failed: %v", err)
+	}
+	if exists, _ := service.UserExists(newEmail); exists {
+		t.Fatal("email must not change before the new address is verified")
+	}
+
+	if _, err := service.ChangeEmail("wrong-token"); !errors.Is(err, ErrEmailChangeNotFound) {
+		t.Errorf("ChangeEmail with an unknown token = %v, want ErrEmailChangeNotFound", err)
+	}
+	if _, err := service.ChangeEmail(change.Token); err != nil {
+		t.Fatalf("ChangeEmail failed: %v", err)
+	}
+	if _, err := service.ChangeEmail(change.Token); !errors.Is(err, ErrEmailChangeNotFound) {
+		t.Errorf("reusing a token = %v, want ErrEmailChangeNotFound", err)
+	}
+
+	if exists, _ := service.UserExists(oldEmail); exists {
+		t.Error("old user record should be removed")
+	}
+	if authenticated, err := service.AuthenticateUser(newEmail, "testpassword"); !authenticated || err != nil {
+		t.Errorf("AuthenticateUser with the new address = %v, %v", authenticated, err)
+	}
+	item, err := mockStorage.GetFile([]string{"home", newEmail, "securestore", "budget"})
+	if err != nil || item.Data != "sheet data" {
+		t.Errorf("user data should move to the new home, got %v, %v", item, err)
+	}
+	if _, err := mockStorage.GetFile([]string{"home", oldEmail, "securestore", "budget"}); err == nil {
+		t.Error("old home should be removed")
+	}
+	if user, err := service.FindUserByIdentity("google", "sub-1"); err != nil || user.Email != newEmail {
+		t.Errorf("identity should follow the account, got %v, %v", user, err)
+	}
+
+	// The old address redirects and cannot be registered by someone else
+	if resolved := service.ResolveEmail(oldEmail); resolved != newEmail {
+		t.Errorf("ResolveEmail(old) = %s, want %s", resolved, newEmail)
+	}
+	if err := service.CreateUser(oldEmail, "testpassword"); err == nil {
+		t.Error("registering a redirected address should fail")
+	}
+
+	// Redirects expire
+	now = now.Add(DefaultEmailRedirectPeriod + time.Hour)
+	if resolved := service.ResolveEmail(oldEmail); resolved != oldEmail {
+		t.Errorf("ResolveEmail after expiry = %s, want %s", resolved, oldEmail)
+	}
+}
+
+// failingListStorage fails listings while fail is set
+type failingListStorage struct {
+	*MockStorage
+	fail bool
+}
+
+func (s *failingListStorage) ListItems(prefix string, bucket ...string) ([]string, error) {
+	if s.fail {
+		return nil, errors.New("storage unavailable")
+	}
+	return s.MockStorage.ListItems(prefix, bucket...)
+}
+
+func TestChangeEmailKeepsTokenOnFailure(t *testing.T) {
+	mockStorage := &failingListStorage{MockStorage: NewMockStorage()}
+	service := NewService(mockStorage)
+
+	oldEmail, newEmail := "old@example.com", "new@example.com"
+	if err := service.CreateUser(oldEmail, "testpassword"); err != nil {
+		t.Fatal(err)
+	}
+	change, err := service.RequestEmailChange(oldEmail, newEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mockStorage.fail = true
+	if _, err := service.ChangeEmail(change.Token); err == nil {
+		t.Fatal("ChangeEmail succeeded although the data could not be copied")
+	}
+	mockStorage.fail = false
+	if _, err := service.ChangeEmail(change.Token); err != nil {
+		t.Errorf("ChangeEmail after a failure = %v, want the link to work again", err)
+	}
+	if exists, _ := service.UserExists(newEmail); !exists {
+		t.Error("account should have moved to the new address")
+	}
+}
+
+// registeringStorage registers an account through register on the first
+// listing, as a registration racing an email change would
+type registeringStorage struct {
+	*MockStorage
+	register func()
+}
+
+func (s *registeringStorage) ListItems(prefix string, bucket ...string) ([]string, error) {
+	if register := s.register; register != nil {
+		s.register = nil
+		register()
+	}
+	return s.MockStorage.ListItems(prefix, bucket...)
+}
+
+func TestChangeEmailDoesNotReplaceNewAccount(t *testing.T) {
+	mockStorage := &registeringStorage{MockStorage: NewMockStorage()}
+	service := NewService(mockStorage)
+
+	oldEmail, newEmail := "old@example.com", "new@example.com"
+	if err := service.CreateUser(oldEmail, "testpassword"); err != nil {
+		t.Fatal(err)
+	}
+	change, err := service.RequestEmailChange(oldEmail, newEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Registered by another instance after the checks, during the copy
+	mockStorage.register = func() {
+		if err := NewService(mockStorage).CreateUser(newEmail, "otherpassword"); err != nil {
+			t.Errorf("registration during the move: %v", err)
+		}
+	}
+	if _, err := service.ChangeEmail(change.Token); !errors.Is(err, ErrEmailInUse) {
+		t.Fatalf("ChangeEmail = %v, want ErrEmailInUse", err)
+	}
+	user, err := service.GetUser(newEmail)
+	if err != nil || !user.Authenticate("otherpassword") {
+		t.Errorf("account registered at %s was replaced", newEmail)
+	}
+	if exists, _ := service.UserExists(oldEmail); !exists {
+		t.Error("account should have stayed at the old address")
+	}
+	if err := service.CreateUser(newEmail, "thirdpassword"); err == nil {
+		t.Error("CreateUser replaced an existing account")
+	}
+}
+
+func TestLockHomeAfterEmailChange(t *testing.T) {
+	service := NewService(NewMockStorage())
+
+	oldEmail, newEmail := "old@example.com", "new@example.com"
+	if err := service.CreateUser(oldEmail, "testpassword"); err != nil {
+		t.Fatal(err)
+	}
+	change, err := service.RequestEmailChange(oldEmail, newEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A request that locked the home first delays the move
+	unlock, err := service.LockHome(oldEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		_, err := service.ChangeEmail(change.Token)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("ChangeEmail = %v while the home was locked", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// Requests for the old address are not saved into a home that moved
+	if _, err := service.LockHome(oldEmail); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("LockHome of the old address = %v, want ErrUserNotFound", err)
+	}
+	unlock, err = service.LockHome(newEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+}
+
+func TestDeleteUserRemovesRedirects(t *testing.T) {
+	mockStorage := NewMockStorage()
+	service := NewService(mockStorage)
+
+	// '%' is encoded in the storage path of the redirect
+	oldEmail, newEmail := "100%club@example.com", "club@example.com"
+	if err := service.CreateUser(oldEmail, "testpassword"); err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+	change, err := service.RequestEmailChange(oldEmail, newEmail)
+	if err != nil {
+		t.Fatalf("RequestEmailChange failed: %v", err)
+	}
+	if _, err := service.ChangeEmail(change.Token); err != nil {
+		t.Fatalf("ChangeEmail failed: %v", err)
+	}
+	if resolved := service.ResolveEmail(oldEmail); resolved != newEmail {
+		t.Fatalf("ResolveEmail(old) = %s, want %s", resolved, newEmail)
+	}
+
+	if err := service.DeleteUser(newEmail, newEmail); err != nil {
+		t.Fatalf("DeleteUser failed: %v", err)
+	}
+	if resolved := service.ResolveEmail(oldEmail); resolved != oldEmail {
+		t.Errorf("ResolveEmail(old) after deletion = %s, want %s", resolved, oldEmail)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	mockStorage := NewMockStorage()
+	service := NewService(mockStorage)
+	service.SetAuditRetention(30 * 24 * time.Hour)
+	now := time.Date(2024, 3, 1, 23, 0, 0, 0, time.UTC)
+	service.now = func() time.Time { return now }
+
+	record := func(eventType, outcome, actor, ip string) {
+		service.RecordAuditEvent(&models.AuditEvent{
+			Type:    eventType,
+			Outcome: outcome,
+			Actor:   actor,
+			Subject: actor,
+			IP:      ip,
+		})
+		now = now.Add(time.Hour)
+	}
+	record(models.AuditLogin, models.AuditFailure, "alice@example.com", "10.0.0.1")
+	record(models.AuditLogin, models.AuditSuccess, "alice@example.com", "10.0.0.1")
+	record(models.AuditRegister, models.AuditSuccess, "bob@example.com", "10.0.0.2")
+	record(models.AuditLogout, models.AuditSuccess, "Alice@Example.com", "10.0.0.3")
+
+	events, err := service.AuditEvents(models.AuditFilter{}, 0)
+	if err != nil {
+		t.Fatalf("AuditEvents failed: %v", err)
+	}
+	if len(events) != 4 || events[0].Type != models.AuditLogout || events[3].Outcome != models.AuditFailure {
+		t.Fatalf("expected all four events newest first across days, got %+v", events)
+	}
+
+	events, _ = service.AuditEvents(models.AuditFilter{User: "alice@example.com"}, 0)
+	if len(events) != 3 {
+		t.Errorf("user filter matched %d events, want 3", len(events))
+	}
+	events, _ = service.AuditEvents(models.AuditFilter{Type: models.AuditLogin, Outcome: models.AuditFailure}, 0)
+	if len(events) != 1 || events[0].IP != "10.0.0.1" {
+		t.Errorf("type and outcome filter = %+v, want the failed login", events)
+	}
+	from := time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC)
+	events, _ = service.AuditEvents(models.AuditFilter{From: from, To: from.Add(2 * time.Hour)}, 0)
+	if len(events) != 2 {
+		t.Errorf("time range matched %d events, want 2", len(events))
+	}
+	if events, _ = service.AuditEvents(models.AuditFilter{}, 1); len(events) != 1 {
+		t.Errorf("limit returned %d events, want 1", len(events))
+	}
+
+	// Exports walk the events oldest first
+	var exported []models.AuditEvent
+	err = service.EachAuditEvent(models.AuditFilter{User: "alice@example.com"}, func(event *models.AuditEvent) error {
+		exported = append(exported, *event)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("EachAuditEvent failed: %v", err)
+	}
+	if len(exported) != 3 || exported[0].Outcome != models.AuditFailure || exported[2].Type != models.AuditLogout {
+		t.Errorf("EachAuditEvent = %+v, want alice's three events oldest first", exported)
+	}
+
+	// Lockouts are audited by the service itself
+	service.SetLockoutPolicy(LockoutPolicy{MaxAttempts: 1, LockoutDuration: time.Minute})
+	if err := service.CreateUser("carol@example.com", "testpassword"); err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+	service.AuthenticateUserFrom("carol@example.com", "wrongpassword", "10.0.0.4")
+	events, _ = service.AuditEvents(models.AuditFilter{Type: models.AuditLockout}, 0)
+	if len(events) != 1 || events[0].Subject != "carol@example.com" || events[0].IP != "10.0.0.4" {
+		t.Errorf("expected a lockout event for carol, got %+v", events)
+	}
+
+	// Only days entirely past the retention period are pruned
+	now = time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+	if removed := service.PruneAuditLog(); removed != 1 {
+		t.Errorf("PruneAuditLog removed %d days, want 1", removed)
+	}
+	events, _ = service.AuditEvents(models.AuditFilter{}, 0)
+	if len(events) != 4 {
+		t.Errorf("%d events left after pruning, want 4", len(events))
+	}
+}
+
+func TestAuditLogKeepsEveryEvent(t *testing.T) {
+	mockStorage := NewMockStorage()
+	service := NewService(mockStorage)
+	service.SetAuditRetention(30 * 24 * time.Hour)
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	service.now = func() time.Time { return now }
+
+	// A flood of failures at one instant does not push out other events
+	service.RecordAuditEvent(&models.AuditEvent{Type: models.AuditRegister, Outcome: models.AuditSuccess, Actor: "bob@example.com"})
+	const flood = 10050
+	for i := 0; i < flood; i++ {
+		service.RecordAuditEvent(&models.AuditEvent{Type: models.AuditLogin, Outcome: models.AuditFailure, Actor: "alice@example.com"})
+	}
+
+	events, err := service.AuditEvents(models.AuditFilter{}, 0)
+	if err != nil {
+		t.Fatalf("AuditEvents failed: %v", err)
+	}
+	if len(events) != flood+1 {
+		t.Fatalf("AuditEvents returned %d events, want %d", len(events), flood+1)
+	}
+	events, _ = service.AuditEvents(models.AuditFilter{Type: models.AuditRegister}, 0)
+	if len(events) != 1 || events[0].Actor != "bob@example.com" {
+		t.Errorf("expected bob's registration to survive the flood, got %+v", events)
+	}
+
+	now = time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+	if removed := service.PruneAuditLog(); removed != 1 {
+		t.Errorf("PruneAuditLog removed %d days, want 1", removed)
+	}
+	if events, _ = service.AuditEvents(models.AuditFilter{}, 0); len(events) != 0 {
+		t.Errorf("%d events left after pruning, want 0", len(events))
+	}
+}
+
+func TestRegistrationPolicy(t *testing.T) {
+	mockStorage := NewMockStorage()
+	service := NewService(mockStorage)
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	service.now = func() time.Time { return now }
+
+	reason := func(err error) string {
+		var refused *RegistrationError
+		if errors.As(err, &refused) {
+			return refused.Reason
+		}
+		if err != nil {
+			return err.Error()
+		}
+		return ""
+	}
+
+	if err := service.CheckRegistration("anyone@example.com", ""); err != nil {
+		t.Errorf("open registration refused: %v", err)
+	}
+
+	service.SetRegistrationPolicy(RegistrationPolicy{
+		Mode:           RegistrationOpen,
+		AllowedDomains: []string{" @Example.com", ""},
+		DeniedDomains:  []string{"spam.example.com"},
+	})
+	for email, want := range map[string]string{
+		"a@example.com":        "",
+		"a@EXAMPLE.COM":        "",
+		"a@eu.example.com":     "",
+		"a@x.spam.example.com": ReasonDomainNotAllowed,
+		"a@example.org":        ReasonDomainNotAllowed,
+		"a@badexample.com":     ReasonDomainNotAllowed,
+	} {
+		if got := reason(service.CheckRegistration(email, "")); got != want {
+			t.Errorf("CheckRegistration(%s) = %q, want %q", email, got, want)
+		}
+	}
+
+	// Email changes cannot move an account outside the allowed domains
+	if err := service.CreateUser("a@example.com", "testpassword"); err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+	for _, newEmail := range []string{"a@example.org", "a@x.spam.example.com"} {
+		if _, err := service.RequestEmailChange("a@example.com", newEmail); reason(err) != ReasonDomainNotAllowed {
+			t.Errorf("RequestEmailChange to %s = %v, want %q", newEmail, err, ReasonDomainNotAllowed)
+		}
+	}
+	change, err := service.RequestEmailChange("a@example.com", "a@eu.example.com")
+	if err != nil {
+		t.Fatalf("RequestEmailChange within the allowed domains failed: %v", err)
+	}
+	service.SetRegistrationPolicy(RegistrationPolicy{Mode: RegistrationOpen, DeniedDomains: []string{"eu.example.com"}})
+	if _, err := service.ChangeEmail(change.Token); reason(err) != ReasonDomainNotAllowed {
+		t.Errorf("ChangeEmail after the domain was denied = %v, want %q", err, ReasonDomainNotAllowed)
+	}
+
+	service.SetRegistrationPolicy(RegistrationPolicy{Mode: RegistrationInvite})
+	if got := reason(service.CheckRegistration("a@example.com", "")); got != ReasonInviteRequired {
+		t.Errorf("missing invite = %q, want %q", got, ReasonInviteRequired)
+	}
+	if got := reason(service.CheckRegistration("a@example.com", "NOPE")); got != ReasonInviteInvalid {
+		t.Errorf("unknown invite = %q, want %q", got, ReasonInviteInvalid)
+	}
+
+	single, err := service.CreateInvite("admin@example.com", 1, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("CreateInvite failed: %v", err)
+	}
+	// Codes are not case sensitive
+	code := strings.ToLower(single.Code)
+	if err := service.CheckRegistration("a@example.com", code); err != nil {
+		t.Errorf("valid invite refused: %v", err)
+	}
+	if err := service.ClaimRegistration("a@example.com", code); err != nil {
+		t.Fatalf("ClaimRegistration failed: %v", err)
+	}
+	if got := reason(service.ClaimRegistration("b@example.com", code)); got != ReasonInviteInvalid {
+		t.Errorf("reusing a single-use invite = %q, want %q", got, ReasonInviteInvalid)
+	}
+
+	multi, _ := service.CreateInvite("admin@example.com", 0, time.Hour)
+	for _, email := range []string{"c@example.com", "d@example.com", "e@example.com"} {
+		if err := service.ClaimRegistration(email, multi.Code); err != nil {
+			t.Errorf("multi-use invite refused for %s: %v", email, err)
+		}
+	}
+	now = now.Add(time.Hour)
+	if got := reason(service.ClaimRegistration("f@example.com", multi.Code)); got != ReasonInviteInvalid {
+		t.Errorf("expired invite = %q, want %q", got, ReasonInviteInvalid)
+	}
+
+	invites, err := service.ListInvites()
+	if err != nil || len(invites) != 2 {
+		t.Fatalf("ListInvites = %d invites (%v), want 2", len(invites), err)
+	}
+	if stored, _ := service.GetInvite(multi.Code); stored.Uses != 3 || len(stored.UsedBy) != 3 {
+		t.Errorf("multi-use invite recorded %d uses by %v, want 3", stored.Uses, stored.UsedBy)
+	}
+	if err := service.DeleteInvite(multi.Code); err != nil {
+		t.Errorf("DeleteInvite failed: %v", err)
+	}
+	if err := service.DeleteInvite(multi.Code); !errors.Is(err, ErrInviteNotFound) {
+		t.Errorf("deleting a deleted invite = %v, want ErrInviteNotFound", err)
+	}
+
+	// Bootstrap admins can always register
+	service.SetBootstrapAdmins([]string{"root@example.org"})
+	if err := service.ClaimRegistration("root@example.org", ""); err != nil {
+		t.Errorf("bootstrap admin refused: %v", err)
+	}
+}
+
+func TestMigrateIdentities(t *testing.T) {
+	mockStorage := NewMockStorage()
+	service := NewService(mockStorage)
+
+	// Records as they were stored before addresses were normalized
+	legacy := func(email string) {
+		user, err := models.NewUser(email, "password123")
+		if err != nil {
+			t.Fatal(err)
+		}
+		user.Identities = []models.ExternalIdentity{{Provider: "google", Subject: "a/b", Email: email}}
+		data, _ := user.ToJSON()
+		mockStorage.CreateFile([]string{"home", UserDir, email}, data)
+		mockStorage.CreateFile([]string{"home", IdentityDir, "google:a/b"}, email)
+	}
+	legacy("Bob@Example.com")
+	mockStorage.CreateDir([]string{"home", "Bob@Example.com", "securestore"})
+	mockStorage.files["home/Bob@Example.com/securestore"].Data = []string{"50%.msc"}
+	mockStorage.CreateFile([]string{"home", "Bob@Example.com", "securestore", "50%.msc"}, "sheet")
+
+	result, err := service.MigrateIdentities()
+	if err != nil {
+		t.Fatalf("MigrateIdentities failed: %v", err)
+	}
+	if result.Users != 1 || len(result.Conflicts) != 0 {
+		t.Errorf("unexpected migration result %+v", result)
+	}
+
+	if _, err := service.GetUser("Bob@Example.com"); err != nil {
+		t.Fatalf("migrated user not found: %v", err)
+	}
+	if ok, err := service.AuthenticateUser("BOB@example.com ", "password123"); err != nil || !ok {
+		t.Errorf("login with differently cased address failed: %v", err)
+	}
+	if _, exists := mockStorage.files["home/users/Bob@Example.com"]; exists {
+		t.Error("old user record left behind")
+	}
+
+	file, err := mockStorage.GetFile(HomePath("bob@example.com", "securestore", "50%.msc"))
+	if err != nil {
+		t.Fatalf("home file not moved: %v", err)
+	}
+	if file.Data != "sheet" {
+		t.Errorf("moved file has data %v", file.Data)
+	}
+	if dir, _ := mockStorage.GetItem("home/bob@example.com/securestore"); !strings.Contains(dir, "50%25.msc") {
+		t.Errorf("directory listing not encoded: %s", dir)
+	}
+	if user, err := service.FindUserByIdentity("google", "a/b"); err != nil || user == nil || user.Email != "bob@example.com" {
+		t.Errorf("identity link resolves to %+v, %v", user, err)
+	}
+
+	// The migration runs once
+	if result, err := service.MigrateIdentities(); err != nil || result != nil {
+		t.Errorf("second migration ran: %+v, %v", result, err)
+	}
+
+	// An address whose normalized form is already registered is left alone
+	conflicts := NewService(NewMockStorage())
+	if err := conflicts.CreateUser("carol@example.com", "correct horse battery"); err != nil {
+		t.Fatal(err)
+	}
+	mockStorage = conflicts.storage.(*MockStorage)
+	legacy("Carol@Example.com")
+	result, err = conflicts.MigrateIdentities()
+	if err != nil {
+		t.Fatalf("MigrateIdentities failed: %v", err)
+	}
+	if len(result.Conflicts) != 1 || result.Conflicts[0] != "Carol@Example.com" {
+		t.Errorf("expected a conflict, got %+v", result)
+	}
+}
+
+func TestSharing(t *testing.T) {
+	mockStorage := NewMockStorage()
+	service := NewService(mockStorage)
+
+	owner, viewer, editor := "owner@example.com", "viewer@example.com", "editor@example.com"
+	for _, email := range []string{owner, viewer, editor} {
+		if err := service.CreateUser(email, "testpassword"); err != nil {
+			t.Fatalf("CreateUser failed: %v", err)
+		}
+	}
+
+	if _, err := service.Share(owner, "touchcalc", "", "nobody@example.com", models.ShareViewer); !errors.Is(err, ErrShareUnknownUser) {
+		t.Errorf("sharing with an unknown user = %v, want ErrShareUnknownUser", err)
+	}
+	if _, err := service.Share(owner, "touchcalc", "", "Owner@Example.com", models.ShareViewer); !errors.Is(err, ErrShareWithOwner) {
+		t.Errorf("sharing with the owner = %v, want ErrShareWithOwner", err)
+	}
+	if _, err := service.Share(owner, "touchcalc", "", viewer, models.ShareOwner); !errors.Is(err, ErrShareRole) {
+		t.Errorf("sharing as owner = %v, want ErrShareRole", err)
+	}
+
+	if _, err := service.Share(owner, "touchcalc", "budget.msc", viewer, models.ShareViewer); err != nil {
+		t.Fatalf("Share failed: %v", err)
+	}
+	if _, err := service.Share(owner, "touchcalc", "", editor, models.ShareViewer); err != nil {
+		t.Fatalf("Share failed: %v", err)
+	}
+	// Sharing again changes the role
+	if _, err := service.Share(owner, "touchcalc", "", "EDITOR@example.com", models.ShareEditor); err != nil {
+		t.Fatalf("Share failed: %v", err)
+	}
+
+	access := []struct {
+		user, file, want string
+	}{
+		{owner, "", models.ShareOwner},
+		{viewer, "budget", models.ShareViewer},
+		{viewer, "budget.msc", models.ShareViewer},
+		{viewer, "other", ""},
+		{viewer, "", ""},
+		{editor, "", models.ShareEditor},
+		{editor, "other", models.ShareEditor},
+		{"nobody@example.com", "budget", ""},
+	}
+	for _, tc := range access {
+		role, err := service.Access(tc.user, owner, "touchcalc", tc.file)
+		if err != nil || role != tc.want {
+			t.Errorf("Access(%s, %q) = %q, %v, want %q", tc.user, tc.file, role, err, tc.want)
+		}
+	}
+	if role, _ := service.Access(editor, owner, "other", "budget"); role != "" {
+		t.Errorf("access to another folder = %q, want none", role)
+	}
+
+	shares, err := service.ListShares(owner, "")
+	if err != nil || len(shares) != 2 {
+		t.Fatalf("ListShares = %v, %v, want 2 shares", shares, err)
+	}
+	if shares[0].User != editor || shares[0].Role != models.ShareEditor || shares[1].File != "budget" {
+		t.Errorf("ListShares = %+v, %+v", shares[0], shares[1])
+	}
+
+	shared, err := service.SharedWith(viewer)
+	if err != nil || len(shared) != 1 || shared[0].Owner != owner || shared[0].File != "budget" {
+		t.Errorf("SharedWith(viewer) = %v, %v", shared, err)
+	}
+
+	if err := service.Unshare(owner, "touchcalc", "", viewer); !errors.Is(err, ErrShareNotFound) {
+		t.Errorf("revoking a share never given = %v, want ErrShareNotFound", err)
+	}
+	if err := service.Unshare(owner, "touchcalc", "budget", viewer); err != nil {
+		t.Fatalf("Unshare failed: %v", err)
+	}
+	if role, _ := service.Access(viewer, owner, "touchcalc", "budget"); role != "" {
+		t.Errorf("access after revoking = %q, want none", role)
+	}
+	if shared, _ := service.SharedWith(viewer); len(shared) != 0 {
+		t.Errorf("SharedWith after revoking = %v, want none", shared)
+	}
+	if _, err := mockStorage.GetFile(service.getSharedWithMePath(viewer)); err == nil {
+		t.Error("index of shared folders should be removed with the last share")
+	}
+}
+
+func TestSharesFollowAccounts(t *testing.T) {
+	mockStorage := NewMockStorage()
+	service := NewService(mockStorage)
+
+	owner, user := "owner@example.com", "user@example.com"
+	for _, email := range []string{owner, user} {
+		if err := service.CreateUser(email, "testpassword"); err != nil {
+			t.Fatalf("CreateUser failed: %v", err)
+		}
+	}
+	if _, err := service.Share(owner, "touchcalc", "", user, models.ShareEditor); err != nil {
+		t.Fatalf("Share failed: %v", err)
+	}
+	link, err := service.CreateShareLink(owner, "touchcalc", "budget", 0, "")
+	if err != nil {
+		t.Fatalf("CreateShareLink failed: %v", err)
+	}
+
+	// Both ends of a share move with an account's address
+	change, err := service.RequestEmailChange(user, "moved@example.com")
+	if err != nil {
+		t.Fatalf("RequestEmailChange failed: %v", err)
+	}
+	if _, err := service.ChangeEmail(change.Token); err != nil {
+		t.Fatalf("ChangeEmail failed: %v", err)
+	}
+	if role, _ := service.Access("moved@example.com", owner, "touchcalc", "budget"); role != models.ShareEditor {
+		t.Errorf("access after changing the user's address = %q, want editor", role)
+	}
+	change, err = service.RequestEmailChange(owner, "owner2@example.com")
+	if err != nil {
+		t.Fatalf("RequestEmailChange failed: %v", err)
+	}
+	if _, err := service.ChangeEmail(change.Token); err != nil {
+		t.Fatalf("ChangeEmail failed: %v", err)
+	}
+	shared, err := service.SharedWith("moved@example.com")
+	if err != nil || len(shared) != 1 || shared[0].Owner != "owner2@example.com" {
+		t.Errorf("SharedWith after changing the owner's address = %v, %v", shared, err)
+	}
+	if link, err := service.GetShareLink(link.Token); err != nil || link.Owner != "owner2@example.com" {
+		t.Errorf("share link after changing the owner's address = %v, %v", link, err)
+	}
+
+	// A deleted account's grants are not inherited by a new account at its
+	// address
+	if err := service.DeleteUser("moved@example.com", "admin@example.com"); err != nil {
+		t.Fatalf("DeleteUser failed: %v", err)
+	}
+	if shares, _ := service.ListShares("owner2@example.com", ""); len(shares) != 0 {
+		t.Errorf("shares with a deleted user = %v, want none", shares)
+	}
+	if err := service.CreateUser("moved@example.com", "testpassword"); err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+	if role, _ := service.Access("moved@example.com", "owner2@example.com", "touchcalc", ""); role != "" {
+		t.Errorf("access of a new account at a deleted address = %q, want none", role)
+	}
+
+	if err := service.DeleteUser("owner2@example.com", "admin@example.com"); err != nil {
+		t.Fatalf("DeleteUser failed: %v", err)
+	}
+	if _, err := service.GetShareLink(link.Token); !errors.Is(err, ErrShareLinkNotFound) {
+		t.Errorf("share link of a deleted owner = %v, want ErrShareLinkNotFound", err)
+	}
+}
+
+func TestShareLinks(t *testing.T) {
+	mockStorage := NewMockStorage()
+	service := NewService(mockStorage)
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	service.now = func() time.Time { return now }
+	service.SetLockoutPolicy(LockoutPolicy{MaxAttempts: 3, IPMaxAttempts: 3, LockoutDuration: time.Hour})
+
+	owner := "owner@example.com"
+	open, err := service.CreateShareLink(owner, "touchcalc", "budget.msc", 0, "")
+	if err != nil {
+		t.Fatalf("CreateShareLink failed: %v", err)
+	}
+	if len(open.Token) < 32 || open.File != "budget" || open.HasPassword() {
+		t.Errorf("CreateShareLink = %+v", open)
+	}
+	protected, err := service.CreateShareLink(owner, "touchcalc", "forecast", 24*time.Hour, "s3cret")
+	if err != nil {
+		t.Fatalf("CreateShareLink failed: %v", err)
+	}
+	if protected.PasswordHash == "s3cret" || !protected.HasPassword() {
+		t.Error("link passwords must be stored hashed")
+	}
+
+	if _, err := service.UnlockShareLink(open.Token, "", "10.0.0.1"); err != nil {
+		t.Errorf("links without a password need none, got %v", err)
+	}
+	if _, err := service.UnlockShareLink(protected.Token, "wrong", "10.0.0.1"); !errors.Is(err, ErrShareLinkPassword) {
+		t.Errorf("wrong password = %v, want ErrShareLinkPassword", err)
+	}
+	if _, err := service.UnlockShareLink(protected.Token, "s3cret", "10.0.0.1"); err != nil {
+		t.Errorf("right password = %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		service.UnlockShareLink(protected.Token, "wrong", "10.0.0.2")
+	}
+	var throttled *ThrottleError
+	if _, err := service.UnlockShareLink(protected.Token, "s3cret", "10.0.0.3"); !errors.As(err, &throttled) {
+		t.Errorf("guessing passwords should lock the link, got %v", err)
+	}
+	// The address that guessed is throttled on other links, but can still
+	// sign in
+	other, err := service.CreateShareLink(owner, "touchcalc", "plans", 0, "0th3r")
+	if err != nil {
+		t.Fatalf("CreateShareLink failed: %v", err)
+	}
+	if _, err := service.UnlockShareLink(other.Token, "0th3r", "10.0.0.2"); !errors.As(err, &throttled) {
+		t.Errorf("guessing passwords should throttle the address on other links, got %v", err)
+	}
+	if err := service.RevokeShareLink(owner, other.Token); err != nil {
+		t.Fatalf("RevokeShareLink failed: %v", err)
+	}
+	if err := service.CreateUser(owner, "testpassword"); err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+	if ok, err := service.AuthenticateUserFrom(owner, "testpassword", "10.0.0.2"); !ok || err != nil {
+		t.Errorf("sign-in from an address that guessed link passwords = %v, %v, want it allowed", ok, err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := service.ViewShareLink(open.Token); err != nil {
+			t.Fatalf("ViewShareLink failed: %v", err)
+		}
+	}
+	links, err := service.ListShareLinks(owner, "touchcalc", "budget")
+	if err != nil || len(links) != 1 || links[0].Views != 2 || !links[0].LastViewedAt.Equal(now) {
+		t.Errorf("ListShareLinks = %v, %v, want one link viewed twice", links, err)
+	}
+	if links, _ := service.ListShareLinks(owner, "", ""); len(links) != 2 {
+		t.Errorf("ListShareLinks of every file = %d links, want 2", len(links))
+	}
+
+	now = now.Add(25 * time.Hour)
+	if _, err := service.GetShareLink(protected.Token); !errors.Is(err, ErrShareLinkNotFound) {
+		t.Errorf("expired link = %v, want ErrShareLinkNotFound", err)
+	}
+
+	if err := service.RevokeShareLink("other@example.com", open.Token); !errors.Is(err, ErrShareLinkNotFound) {
+		t.Errorf("revoking another owner's link = %v, want ErrShareLinkNotFound", err)
+	}
+	if err := service.RevokeShareLink(owner, open.Token); err != nil {
+		t.Fatalf("RevokeShareLink failed: %v", err)
+	}
+	if _, err := service.ViewShareLink(open.Token); !errors.Is(err, ErrShareLinkNotFound) {
+		t.Errorf("revoked link = %v, want ErrShareLinkNotFound", err)
+	}
+	if _, err := service.GetShareLink(""); !errors.Is(err, ErrShareLinkNotFound) {
+		t.Errorf("empty token = %v, want ErrShareLinkNotFound", err)
+	}
+}
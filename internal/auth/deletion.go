@@ -0,0 +1,248 @@
+package auth
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/c4gt/tornado-nginx-go-backend/internal/models"
+	"github.com/c4gt/tornado-nginx-go-backend/internal/storage"
+)
+
+const (
+	DeletionDir = "deletions"
+
+	DefaultDeletionGracePeriod = 14 * 24 * time.Hour
+
+	maxDeletionEvents = 1000
+)
+
+// SetDeletionGracePeriod sets how long a requested account deletion can be
+// cancelled. Zero deletes accounts immediately.
+func (s *Service) SetDeletionGracePeriod(grace time.Duration) {
+	s.deletionGrace = grace
+}
+
+func (s *Service) DeletionGracePeriod() time.Duration {
+	return s.deletionGrace
+}
+
+func (s *Service) getDeletionPath(email string) []string {
+	return []string{"home", DeletionDir, emailSegment(email)}
+}
+
+// ScheduleDeletion marks an account for deletion once the grace period has
+// passed. Scheduling an already pending deletion returns the existing one.
+func (s *Service) ScheduleDeletion(email, actor string) (*models.PendingDeletion, error) {
+	user, err := s.GetUser(email)
+	if err != nil {
+		return nil, err
+	}
+	email = user.Email
+
+	if pending, err := s.PendingDeletion(email); err != nil || pending != nil {
+		return pending, err
+	}
+
+	now := s.now()
+	pending := &models.PendingDeletion{
+		Email:       email,
+		RequestedBy: actor,
+		RequestedAt: now,
+		PurgeAfter:  now.Add(s.deletionGrace),
+	}
+	data, err := pending.ToJSON()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.putFile(s.getDeletionPath(email), data); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Account deletion of %s requested by %s, purge after %s",
+		email, actor, pending.PurgeAfter.Format(time.RFC3339))
+	s.recordDeletionEvent(&models.DeletionEvent{
+		Email:      email,
+		Action:     models.DeletionRequested,
+		Actor:      actor,
+		At:         now,
+		PurgeAfter: pending.PurgeAfter,
+	})
+	return pending, nil
+}
+
+// PendingDeletion returns the scheduled deletion of an account, or nil when
+// none is pending.
+func (s *Service) PendingDeletion(email string) (*models.PendingDeletion, error) {
+	item, err := s.storage.GetFile(s.getDeletionPath(email))
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	dataStr, ok := item.Data.(string)
+	if !ok {
+		return nil, nil
+	}
+	return models.PendingDeletionFromJSON(dataStr)
+}
+
+// CancelDeletion keeps an account that was scheduled for deletion
+func (s *Service) CancelDeletion(email, actor string) error {
+	pending, err := s.PendingDeletion(email)
+	if err != nil {
+		return err
+	}
+	if pending == nil {
+		return nil
+	}
+
+	if err := s.storage.DeleteFile(s.getDeletionPath(email)); err != nil {
+		return err
+	}
+
+	log.Printf("Account deletion of %s cancelled by %s", email, actor)
+	s.recordDeletionEvent(&models.DeletionEvent{
+		Email:  email,
+		Action: models.DeletionCancelled,
+		Actor:  actor,
+		At:     s.now(),
+	})
+	return nil
+}
+
+// DueDeletions returns the pending deletions whose grace period has passed
+func (s *Service) DueDeletions() ([]*models.PendingDeletion, error) {
+	prefix := "home/" + DeletionDir
+	paths, err := s.storage.ListItems(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	now := s.now()
+	var due []*models.PendingDeletion
+	for _, path := range paths {
+		email, err := storage.DecodeSegment(path[len(prefix)+1:])
+		if err != nil {
+			continue
+		}
+		pending, err := s.PendingDeletion(email)
+		if err != nil {
+			log.Printf("Skipping unreadable deletion record %s: %v", email, err)
+			continue
+		}
+		if pending != nil && pending.IsDue(now) {
+			due = append(due, pending)
+		}
+	}
+	return due, nil
+}
+
+// DeleteUser permanently removes an account: its home directory on the
+// storage backend, linked identities, login throttling state, the user
+// record and any pending deletion.
+func (s *Service) DeleteUser(email, actor string) error {
+	user, err := s.GetUser(email)
+	if err != nil && !errors.Is(err, ErrUserNotFound) {
+		return err
+	}
+	pending, err := s.PendingDeletion(email)
+	if err != nil {
+		return err
+	}
+	if user == nil && pending == nil {
+		return ErrUserNotFound
+	}
+
+	items, bytes, _ := s.StorageUsage(email)
+
+	// Shares are found through the home, so they go before it
+	s.dropShares(email)
+	s.dropShareLinks(email)
+
+	// Data goes first so a failed purge leaves the account to retry against
+	if err := s.storage.DeleteDir(HomePath(email)); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return err
+	}
+
+	if user != nil {
+		for _, identity := range user.Identities {
+			linked, err := s.FindUserByIdentity(identity.Provider, identity.Subject)
+			if err != nil || linked.Email != email {
+				continue
+			}
+			if err := s.storage.DeleteFile(s.getIdentityPath(identity.Provider, identity.Subject)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := s.clearThrottle(throttleKey("user", NormalizeEmail(email))); err != nil {
+		log.Printf("Failed to clear login throttle of %s: %v", email, err)
+	}
+	s.removeRedirectsTo(email)
+
+	if user != nil {
+		if err := s.storage.DeleteFile(s.getUserPath(email)); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return err
+		}
+	}
+	if pending != nil {
+		if err := s.storage.DeleteFile(s.getDeletionPath(email)); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return err
+		}
+	}
+
+	log.Printf("Account %s purged by %s (%d items, %d bytes)", email, actor, items, bytes)
+	s.recordDeletionEvent(&models.DeletionEvent{
+		Email:  email,
+		Action: models.DeletionPurged,
+		Actor:  actor,
+		At:     s.now(),
+		Items:  items,
+		Bytes:  bytes,
+	})
+	return nil
+}
+
+// removeRedirectsTo drops redirects from former addresses of an account so
+// they no longer resolve to it
+func (s *Service) removeRedirectsTo(email string) {
+	prefix := "home/" + RedirectDir
+	paths, err := s.storage.ListItems(prefix)
+	if err != nil {
+		log.Printf("Failed to list email redirects: %v", err)
+		return
+	}
+
+	for _, path := range paths {
+		oldEmail, err := storage.DecodeSegment(path[len(prefix)+1:])
+		if err != nil {
+			continue
+		}
+		if redirect, err := s.getRedirect(oldEmail); err == nil && redirect != nil && redirect.NewEmail == email {
+			s.storage.DeleteFile(s.getRedirectPath(oldEmail))
+		}
+	}
+}
+
+// DeletionEvents returns the most recent account deletion events, newest first.
+func (s *Service) DeletionEvents(limit int) ([]*models.DeletionEvent, error) {
+	events, err := readEventLog[*models.DeletionEvent](s, s.getDeletionLogPath())
+	if err != nil {
+		return nil, err
+	}
+	return newestEvents(events, limit), nil
+}
+
+func (s *Service) getDeletionLogPath() []string {
+	return []string{"home", SecurityDir, "deletions"}
+}
+
+func (s *Service) recordDeletionEvent(event *models.DeletionEvent) {
+	if err := appendEventLog(s, s.getDeletionLogPath(), event, maxDeletionEvents); err != nil {
+		log.Printf("Failed to record deletion event for %s: %v", event.Email, err)
+	}
+}
@@ -0,0 +1,352 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/c4gt/tornado-nginx-go-backend/internal/models"
+	"github.com/c4gt/tornado-nginx-go-backend/internal/storage"
+)
+
+const (
+	EmailChangeDir = "emailchanges"
+	RedirectDir    = "redirects"
+
+	EmailChangeTTL             = 24 * time.Hour
+	DefaultEmailRedirectPeriod = 30 * 24 * time.Hour
+	maxEmailRedirectHops       = 5
+	emailChangeTokenBytes      = 24
+	// homeLockCount is the number of locks shared by homes
+	homeLockCount = 64
+)
+
+var (
+	ErrEmailInUse          = errors.New("email address is already in use")
+	ErrEmailChangeNotFound = errors.New("email change request not found or expired")
+)
+
+// SetEmailRedirectPeriod sets how long a former email address keeps
+// resolving to the account after a change
+func (s *Service) SetEmailRedirectPeriod(period time.Duration) {
+	s.redirectPeriod = period
+}
+
+func (s *Service) getEmailChangePath(token string) []string {
+	return []string{"home", EmailChangeDir, storage.EncodeSegment(token)}
+}
+
+func (s *Service) getRedirectPath(email string) []string {
+	return []string{"home", RedirectDir, emailSegment(email)}
+}
+
+// EmailInUse reports whether an address belongs to an account or is still
+// reserved by a redirect from a recent email change
+func (s *Service) EmailInUse(email string) (bool, error) {
+	exists, err := s.UserExists(email)
+	if err != nil || exists {
+		return exists, err
+	}
+
+	redirect, err := s.getRedirect(email)
+	if err != nil {
+		return false, err
+	}
+	return redirect != nil, nil
+}
+
+// RequestEmailChange records a pending change to newEmail. The change takes
+// effect once the returned token is presented to ChangeEmail.
+func (s *Service) RequestEmailChange(oldEmail, newEmail string) (*models.EmailChange, error) {
+	oldEmail, newEmail = NormalizeEmail(oldEmail), NormalizeEmail(newEmail)
+	if !ValidateEmail(newEmail) {
+		return nil, fmt.Errorf("invalid email address")
+	}
+	if newEmail == oldEmail {
+		return nil, fmt.Errorf("new email address is the same as the current one")
+	}
+	// Moving to an address registration would refuse is refused too
+	if err := s.checkDomain(newEmail); err != nil {
+		return nil, err
+	}
+	if _, err := s.GetUser(oldEmail); err != nil {
+		return nil, err
+	}
+	if err := s.checkEmailAvailable(oldEmail, newEmail); err != nil {
+		return nil, err
+	}
+
+	token, err := randomToken(emailChangeTokenBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	now := s.now()
+	change := &models.EmailChange{
+		Token:       token,
+		OldEmail:    oldEmail,
+		NewEmail:    newEmail,
+		RequestedAt: now,
+		ExpiresAt:   now.Add(EmailChangeTTL),
+	}
+	data, err := change.ToJSON()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.putFile(s.getEmailChangePath(token), data); err != nil {
+		return nil, err
+	}
+	return change, nil
+}
+
+// ChangeEmail completes a verified email change: the user's home tree and
+// record move to the new address, linked identities follow, and the old
+// address redirects to the new one for the redirect period.
+func (s *Service) ChangeEmail(token string) (*models.EmailChange, error) {
+	change, err := s.getEmailChange(token)
+	if err != nil {
+		return nil, err
+	}
+	if change.IsExpired(s.now()) {
+		s.storage.DeleteFile(s.getEmailChangePath(token))
+		return nil, ErrEmailChangeNotFound
+	}
+
+	oldEmail, newEmail := change.OldEmail, change.NewEmail
+
+	// Nothing is saved in either home, and no share or share link of the
+	// account changes, until the account has moved
+	unlock := s.lockHomes(oldEmail, newEmail)
+	defer unlock()
+	s.shareMutex.Lock()
+	defer s.shareMutex.Unlock()
+	s.linkMutex.Lock()
+	defer s.linkMutex.Unlock()
+	// Another request may have used the token while this one waited
+	if _, err := s.getEmailChange(token); err != nil {
+		return nil, err
+	}
+
+	user, err := s.GetUser(oldEmail)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkDomain(newEmail); err != nil {
+		return nil, err
+	}
+	if err := s.checkEmailAvailable(oldEmail, newEmail); err != nil {
+		return nil, err
+	}
+	if pending, err := s.PendingDeletion(oldEmail); err != nil || pending != nil {
+		if err == nil {
+			err = fmt.Errorf("account is scheduled for deletion")
+		}
+		return nil, err
+	}
+
+	// Copy everything to the new address before anything is removed
+	if _, err := storage.CopyTree(s.storage, HomePath(oldEmail), HomePath(newEmail)); err != nil {
+		s.storage.DeleteDir(HomePath(newEmail))
+		return nil, fmt.Errorf("failed to copy user data: %w", err)
+	}
+
+	// Created only if no account took the address meanwhile
+	user.Email = newEmail
+	userData, err := user.ToJSON()
+	created := false
+	if err == nil {
+		created, err = s.createFile(s.getUserPath(newEmail), userData)
+	}
+	if err != nil || !created {
+		s.storage.DeleteDir(HomePath(newEmail))
+		if err == nil {
+			return nil, ErrEmailInUse
+		}
+		return nil, fmt.Errorf("failed to write user record: %w", err)
+	}
+
+	// Tokens are single use. It is kept until the account has moved, so
+	// that the link can be followed again after a failure.
+	if err := s.storage.DeleteFile(s.getEmailChangePath(token)); err != nil {
+		log.Printf("Failed to remove used email change token of %s: %v", oldEmail, err)
+	}
+
+	s.moveShares(oldEmail, newEmail)
+	s.moveShareLinks(oldEmail, newEmail)
+
+	// The account now lives at the new address; clean up the old one
+	if err := s.storage.DeleteFile(s.getUserPath(oldEmail)); err != nil {
+		log.Printf("Failed to remove old user record %s: %v", oldEmail, err)
+	}
+	if err := s.storage.DeleteDir(HomePath(oldEmail)); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		log.Printf("Failed to remove old home of %s: %v", oldEmail, err)
+	}
+	for _, identity := range user.Identities {
+		if err := s.putFile(s.getIdentityPath(identity.Provider, identity.Subject), newEmail); err != nil {
+			log.Printf("Failed to relink identity %s:%s to %s: %v", identity.Provider, identity.Subject, newEmail, err)
+		}
+	}
+	s.clearThrottle(throttleKey("user", NormalizeEmail(oldEmail)))
+
+	// Changing back to a recent address replaces its redirect with the account
+	s.storage.DeleteFile(s.getRedirectPath(newEmail))
+	if s.redirectPeriod > 0 {
+		now := s.now()
+		redirect := &models.EmailRedirect{
+			OldEmail:  oldEmail,
+			NewEmail:  newEmail,
+			ChangedAt: now,
+			ExpiresAt: now.Add(s.redirectPeriod),
+		}
+		if data, err := redirect.ToJSON(); err == nil {
+			if err := s.putFile(s.getRedirectPath(oldEmail), data); err != nil {
+				log.Printf("Failed to record email redirect from %s: %v", oldEmail, err)
+			}
+		}
+	}
+
+	log.Printf("Email address of %s changed to %s", oldEmail, newEmail)
+	s.RecordAuditEvent(&models.AuditEvent{
+		Type:    models.AuditEmailChange,
+		Outcome: models.AuditSuccess,
+		Actor:   oldEmail,
+		Subject: newEmail,
+	})
+	return change, nil
+}
+
+// LockHome keeps the home of email from moving to another address until
+// the returned function is called. It returns ErrUserNotFound, holding
+// nothing, when there is no account with the address, as after its home
+// moved away while the caller waited.
+func (s *Service) LockHome(email string) (func(), error) {
+	lock := &s.homeLocks[homeLockIndex(email)]
+	lock.RLock()
+	exists, err := s.UserExists(email)
+	if err == nil && !exists {
+		err = ErrUserNotFound
+	}
+	if err != nil {
+		lock.RUnlock()
+		return nil, err
+	}
+	return lock.RUnlock, nil
+}
+
+// lockHomes keeps requests from changing the homes of emails until the
+// returned function is called. The locks are taken in a fixed order, so
+// moves that share some of them cannot deadlock.
+func (s *Service) lockHomes(emails ...string) func() {
+	var indexes []int
+	for _, email := range emails {
+		indexes = append(indexes, homeLockIndex(email))
+	}
+	slices.Sort(indexes)
+	indexes = slices.Compact(indexes)
+	for _, i := range indexes {
+		s.homeLocks[i].Lock()
+	}
+	return func() {
+		for _, i := range indexes {
+			s.homeLocks[i].Unlock()
+		}
+	}
+}
+
+func homeLockIndex(email string) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(NormalizeEmail(email)))
+	return int(hash.Sum32() % homeLockCount)
+}
+
+// ResolveEmail returns the current address of the account an email address
+// refers to, following redirects left by email changes
+func (s *Service) ResolveEmail(email string) string {
+	email = NormalizeEmail(email)
+	for i := 0; i < maxEmailRedirectHops; i++ {
+		if exists, err := s.UserExists(email); err != nil || exists {
+			return email
+		}
+		redirect, err := s.getRedirect(email)
+		if err != nil || redirect == nil {
+			return email
+		}
+		email = redirect.NewEmail
+	}
+	return email
+}
+
+// checkEmailAvailable allows newEmail unless another account holds it. An
+// address the user gave up recently can be taken back.
+func (s *Service) checkEmailAvailable(oldEmail, newEmail string) error {
+	exists, err := s.UserExists(newEmail)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return ErrEmailInUse
+	}
+
+	redirect, err := s.getRedirect(newEmail)
+	if err != nil {
+		return err
+	}
+	if redirect != nil && s.ResolveEmail(newEmail) != oldEmail {
+		return ErrEmailInUse
+	}
+	return nil
+}
+
+func (s *Service) getEmailChange(token string) (*models.EmailChange, error) {
+	if token == "" {
+		return nil, ErrEmailChangeNotFound
+	}
+
+	item, err := s.storage.GetFile(s.getEmailChangePath(token))
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil, ErrEmailChangeNotFound
+		}
+		return nil, err
+	}
+
+	dataStr, ok := item.Data.(string)
+	if !ok {
+		return nil, ErrEmailChangeNotFound
+	}
+	return models.EmailChangeFromJSON(dataStr)
+}
+
+// getRedirect returns the active redirect from email, or nil
+func (s *Service) getRedirect(email string) (*models.EmailRedirect, error) {
+	item, err := s.storage.GetFile(s.getRedirectPath(email))
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	dataStr, ok := item.Data.(string)
+	if !ok {
+		return nil, nil
+	}
+	redirect, err := models.EmailRedirectFromJSON(dataStr)
+	if err != nil || !redirect.IsActive(s.now()) {
+		return nil, nil
+	}
+	return redirect, nil
+}
+
+func randomToken(size int) (string, error) {
+	bytes := make([]byte, size)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(bytes), nil
+}
@@ -0,0 +1,135 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/c4gt/tornado-nginx-go-backend/internal/models"
+	"github.com/c4gt/tornado-nginx-go-backend/internal/storage"
+)
+
+// putEventItem stores an event as an item of its own below dir, named by
+// its time and a random part that keeps events of the same instant apart,
+// so that listing dir gives the events in the order they happened
+func putEventItem(s *Service, dir []string, at time.Time, event any) error {
+	suffix, err := randomToken(6)
+	if err != nil {
+		return err
+	}
+	path := append(append([]string{}, dir...), fmt.Sprintf("%019d-%s", at.UnixNano(), suffix))
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	item, err := models.NewStorageItem(path, "file", string(data)).ToJSON()
+	if err != nil {
+		return err
+	}
+	return s.storage.PutItem(strings.Join(path, "/"), item)
+}
+
+// listEventItems returns the items putEventItem stored below dir, oldest
+// first
+func listEventItems(s *Service, dir []string) ([]string, error) {
+	prefix := strings.Join(dir, "/")
+	items, err := s.storage.ListItems(prefix)
+	if err != nil {
+		return nil, err
+	}
+	keys := items[:0]
+	for _, item := range items {
+		if name := strings.TrimPrefix(item, prefix+"/"); name != "" && !strings.Contains(name, "/") {
+			keys = append(keys, item)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// eventItemTime returns the time an event item is named by
+func eventItemTime(key string) (time.Time, bool) {
+	name := key[strings.LastIndex(key, "/")+1:]
+	stamp, _, _ := strings.Cut(name, "-")
+	nanos, err := strconv.ParseInt(stamp, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, nanos).UTC(), true
+}
+
+// readEventItem loads an event putEventItem stored
+func readEventItem[T any](s *Service, key string) (*T, error) {
+	data, err := s.storage.GetItem(key)
+	if err != nil {
+		return nil, err
+	}
+	item, err := models.StorageItemFromJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	dataStr, _ := item.Data.(string)
+	var event T
+	if err := json.Unmarshal([]byte(dataStr), &event); err != nil {
+		return nil, fmt.Errorf("invalid event %s: %w", key, err)
+	}
+	return &event, nil
+}
+
+// readEventLog loads a capped event log stored as a JSON array, oldest first
+func readEventLog[T any](s *Service, path []string) ([]T, error) {
+	item, err := s.storage.GetFile(path)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	dataStr, ok := item.Data.(string)
+	if !ok {
+		return nil, nil
+	}
+
+	var events []T
+	if err := json.Unmarshal([]byte(dataStr), &events); err != nil {
+		return nil, fmt.Errorf("invalid event log %s: %w", path[len(path)-1], err)
+	}
+	return events, nil
+}
+
+// appendEventLog adds an event, dropping the oldest ones beyond max
+func appendEventLog[T any](s *Service, path []string, event T, max int) error {
+	events, err := readEventLog[T](s, path)
+	if err != nil {
+		return err
+	}
+
+	events = append(events, event)
+	if len(events) > max {
+		events = events[len(events)-max:]
+	}
+
+	data, err := json.Marshal(events)
+	if err != nil {
+		return err
+	}
+	return s.putFile(path, string(data))
+}
+
+// newestEvents returns up to limit events, newest first
+func newestEvents[T any](events []T, limit int) []T {
+	result := make([]T, 0, len(events))
+	for i := len(events) - 1; i >= 0; i-- {
+		if limit > 0 && len(result) >= limit {
+			break
+		}
+		result = append(result, events[i])
+	}
+	return result
+}
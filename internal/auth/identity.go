@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/c4gt/tornado-nginx-go-backend/internal/models"
+	"github.com/c4gt/tornado-nginx-go-backend/internal/storage"
+)
+
+const IdentityDir = "identities"
+
+func (s *Service) getIdentityPath(provider, subject string) []string {
+	return []string{"home", IdentityDir, storage.EncodeSegment(provider + ":" + subject)}
+}
+
+// FindUserByIdentity returns the user linked to an external identity
+func (s *Service) FindUserByIdentity(provider, subject string) (*models.User, error) {
+	item, err := s.storage.GetFile(s.getIdentityPath(provider, subject))
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+
+	email, ok := item.Data.(string)
+	if !ok || email == "" {
+		return nil, ErrUserNotFound
+	}
+
+	user, err := s.GetUser(email)
+	if err != nil {
+		return nil, err
+	}
+	// Ignore stale index entries left behind by an unlinked identity
+	if !user.HasIdentity(provider, subject) {
+		return nil, ErrUserNotFound
+	}
+	return user, nil
+}
+
+// LinkIdentity attaches an external identity to an existing user
+func (s *Service) LinkIdentity(email, provider, subject, identityEmail string) error {
+	if provider == "" || subject == "" || strings.Contains(provider, "/") {
+		return fmt.Errorf("invalid external identity")
+	}
+
+	user, err := s.GetUser(email)
+	if err != nil {
+		return err
+	}
+
+	if existing, err := s.FindUserByIdentity(provider, subject); err == nil && existing.Email != user.Email {
+		return fmt.Errorf("identity is already linked to another account")
+	}
+
+	user.AddIdentity(provider, subject, identityEmail)
+	if err := s.setUser(user); err != nil {
+		return err
+	}
+	return s.putFile(s.getIdentityPath(provider, subject), user.Email)
+}
+
+// CreateExternalUser creates a confirmed user without a usable password for
+// accounts that sign in through an external identity provider.
+func (s *Service) CreateExternalUser(email string) error {
+	email = NormalizeEmail(email)
+	exists, err := s.EmailInUse(email)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("user already exists")
+	}
+
+	user := &models.User{
+		Email:     email,
+		Confirmed: true,
+		CreatedOn: s.now(),
+		Role:      s.initialRole(email),
+	}
+	userData, err := user.ToJSON()
+	if err != nil {
+		return err
+	}
+	return s.putFile(s.getUserPath(email), userData)
+}
@@ -0,0 +1,365 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/c4gt/tornado-nginx-go-backend/internal/models"
+	"github.com/c4gt/tornado-nginx-go-backend/internal/storage"
+)
+
+const (
+	ThrottleDir = "throttle"
+	SecurityDir = "security"
+
+	maxLockoutEvents = 500
+	// maxThrottleRetries is how often a change to a throttle record is
+	// retried when other attempts changed it first
+	maxThrottleRetries = 10
+)
+
+// LockoutPolicy controls progressive delays and temporary lockout after
+// failed login attempts. Zero values disable the corresponding check.
+type LockoutPolicy struct {
+	MaxAttempts     int           // failures per account before lockout
+	IPMaxAttempts   int           // failures per client IP before lockout
+	Window          time.Duration // failures older than this are forgotten
+	LockoutDuration time.Duration
+	BaseDelay       time.Duration // delay after the first failure, doubled for each further one
+	MaxDelay        time.Duration
+}
+
+func DefaultLockoutPolicy() LockoutPolicy {
+	return LockoutPolicy{
+		MaxAttempts:     5,
+		IPMaxAttempts:   20,
+		Window:          15 * time.Minute,
+		LockoutDuration: 15 * time.Minute,
+		BaseDelay:       1 * time.Second,
+		MaxDelay:        30 * time.Second,
+	}
+}
+
+// ThrottleError is returned when a login attempt is refused before the
+// password is checked.
+type ThrottleError struct {
+	Locked     bool
+	RetryAfter time.Duration
+}
+
+func (e *ThrottleError) Error() string {
+	if e.Locked {
+		return fmt.Sprintf("account temporarily locked, retry after %s", e.RetryAfter.Round(time.Second))
+	}
+	return fmt.Sprintf("too many failed login attempts, retry after %s", e.RetryAfter.Round(time.Second))
+}
+
+func (s *Service) SetLockoutPolicy(policy LockoutPolicy) {
+	s.lockout = policy
+}
+
+// AuthenticateUserFrom authenticates a user like AuthenticateUser, but first
+// enforces the lockout policy for the account and the client IP and records
+// the outcome afterwards.
+func (s *Service) AuthenticateUserFrom(email, password, ip string) (bool, error) {
+	now := s.now()
+	userKey := throttleKey("user", NormalizeEmail(email))
+
+	// Counted before the password is checked, so that parallel guesses,
+	// on this or other instances, each see the ones before them
+	userAttempt, err := s.beginAttempt(userKey, s.lockout.MaxAttempts, now)
+	if err != nil {
+		return false, err
+	}
+	var ipAttempt *throttleAttempt
+	if ip != "" {
+		ipAttempt, err = s.beginAttempt(throttleKey("ip", ip), s.lockout.IPMaxAttempts, now)
+		if err != nil {
+			s.cancelAttempt(userAttempt)
+			return false, err
+		}
+	}
+
+	authenticated, err := s.AuthenticateUser(email, password)
+	if err != nil && !errors.Is(err, ErrUserNotFound) {
+		s.cancelAttempt(userAttempt)
+		if ipAttempt != nil {
+			s.cancelAttempt(ipAttempt)
+		}
+		return false, err
+	}
+
+	if authenticated {
+		s.clearThrottle(userKey)
+		if ipAttempt != nil {
+			s.cancelAttempt(ipAttempt)
+		}
+		return true, nil
+	}
+
+	// Unknown accounts are throttled like known ones so the response does
+	// not reveal which addresses are registered.
+	s.failAttempt(userAttempt, email, ip)
+	if ipAttempt != nil {
+		s.failAttempt(ipAttempt, email, ip)
+	}
+	return false, err
+}
+
+// IsLocked reports whether the account is currently locked out.
+func (s *Service) IsLocked(email string) (bool, error) {
+	_, throttle, err := s.getThrottle(throttleKey("user", NormalizeEmail(email)))
+	if err != nil {
+		return false, err
+	}
+	return throttle.IsLocked(s.now()), nil
+}
+
+// UnlockAccount clears the failed-attempt record for an account.
+func (s *Service) UnlockAccount(email string) error {
+	return s.clearThrottle(throttleKey("user", NormalizeEmail(email)))
+}
+
+// LockoutEvents returns the most recent lockout events, newest first.
+func (s *Service) LockoutEvents(limit int) ([]*models.LockoutEvent, error) {
+	events, err := readEventLog[*models.LockoutEvent](s, s.getLockoutLogPath())
+	if err != nil {
+		return nil, err
+	}
+	return newestEvents(events, limit), nil
+}
+
+// refuseAttempt returns a *ThrottleError while the throttle record refuses
+// attempts, and the record with failures outside the window forgotten
+func (s *Service) refuseAttempt(throttle *models.LoginThrottle, now time.Time) (*models.LoginThrottle, error) {
+	if throttle.IsLocked(now) {
+		return throttle, &ThrottleError{Locked: true, RetryAfter: throttle.LockedUntil.Sub(now)}
+	}
+
+	// Forget old failures once the window has passed
+	if throttle.Failures > 0 && s.lockout.Window > 0 && now.Sub(throttle.LastFailure) > s.lockout.Window {
+		throttle = models.NewLoginThrottle(throttle.Key)
+	}
+
+	if delay := s.delayFor(throttle.Failures); delay > 0 {
+		next := throttle.LastFailure.Add(delay)
+		if now.Before(next) {
+			return throttle, &ThrottleError{RetryAfter: next.Sub(now)}
+		}
+	}
+
+	return throttle, nil
+}
+
+// throttleAttempt is an attempt counted as a failure against a throttle
+// record while its outcome is not known yet
+type throttleAttempt struct {
+	key string
+	at  time.Time
+	// previous is the record as the attempt found it
+	previous *models.LoginThrottle
+	// lockedUntil is set when counting the attempt locked the record
+	lockedUntil time.Time
+	maxAttempts int
+}
+
+// beginAttempt counts an attempt against the throttle record of key as a
+// failure, or returns a *ThrottleError while the record refuses attempts.
+// The record is replaced only if no other attempt changed it meanwhile, so
+// instances sharing the storage cannot together exceed maxAttempts.
+func (s *Service) beginAttempt(key string, maxAttempts int, now time.Time) (*throttleAttempt, error) {
+	for i := 0; i < maxThrottleRetries; i++ {
+		current, throttle, err := s.getThrottle(key)
+		if err != nil {
+			return nil, err
+		}
+		throttle, err = s.refuseAttempt(throttle, now)
+		if err != nil {
+			return nil, err
+		}
+
+		attempt := &throttleAttempt{key: key, at: now, maxAttempts: maxAttempts}
+		previous := *throttle
+		attempt.previous = &previous
+		if throttle.Failures == 0 {
+			throttle.FirstFailure = now
+		}
+		throttle.Failures++
+		throttle.LastFailure = now
+		if maxAttempts > 0 && throttle.Failures >= maxAttempts && s.lockout.LockoutDuration > 0 {
+			throttle.LockedUntil = now.Add(s.lockout.LockoutDuration)
+			throttle.Failures = 0
+			attempt.lockedUntil = throttle.LockedUntil
+		}
+
+		swapped, err := s.swapThrottle(current, throttle)
+		if err != nil {
+			return nil, err
+		}
+		if swapped {
+			return attempt, nil
+		}
+	}
+	// So many attempts at once are refused like a burst of failures
+	return nil, &ThrottleError{RetryAfter: time.Second}
+}
+
+// failAttempt records the lockout that counting a failed attempt caused
+func (s *Service) failAttempt(attempt *throttleAttempt, email, ip string) {
+	if attempt.lockedUntil.IsZero() {
+		return
+	}
+	s.recordLockout(&models.LockoutEvent{
+		Key:         attempt.key,
+		Email:       email,
+		IP:          ip,
+		Failures:    attempt.maxAttempts,
+		LockedAt:    attempt.at,
+		LockedUntil: attempt.lockedUntil,
+	})
+}
+
+// cancelAttempt takes back an attempt that did not fail, restoring what it
+// changed in the throttle record unless later attempts changed it too
+func (s *Service) cancelAttempt(attempt *throttleAttempt) {
+	for i := 0; i < maxThrottleRetries; i++ {
+		current, throttle, err := s.getThrottle(attempt.key)
+		if err != nil {
+			log.Printf("Failed to take back an attempt counted for %s: %v", attempt.key, err)
+			return
+		}
+
+		if !attempt.lockedUntil.IsZero() {
+			if !throttle.LockedUntil.Equal(attempt.lockedUntil) {
+				return
+			}
+			throttle.LockedUntil = attempt.previous.LockedUntil
+			throttle.Failures = attempt.previous.Failures
+		} else if throttle.Failures > 0 {
+			throttle.Failures--
+		} else {
+			return
+		}
+		if throttle.LastFailure.Equal(attempt.at) {
+			throttle.FirstFailure = attempt.previous.FirstFailure
+			throttle.LastFailure = attempt.previous.LastFailure
+		}
+
+		swapped, err := s.swapThrottle(current, throttle)
+		if err != nil {
+			log.Printf("Failed to take back an attempt counted for %s: %v", attempt.key, err)
+			return
+		}
+		if swapped {
+			return
+		}
+	}
+	log.Printf("Failed to take back an attempt counted for %s: changed by too many other attempts", attempt.key)
+}
+
+// recordLockout logs a throttle record being locked
+func (s *Service) recordLockout(event *models.LockoutEvent) {
+	log.Printf("Login lockout: %s locked until %s (email=%s ip=%s)",
+		event.Key, event.LockedUntil.Format(time.RFC3339), event.Email, event.IP)
+
+	if err := s.appendLockoutEvent(event); err != nil {
+		log.Printf("Failed to record lockout event for %s: %v", event.Key, err)
+	}
+	s.RecordAuditEvent(&models.AuditEvent{
+		At:      event.LockedAt,
+		Type:    models.AuditLockout,
+		Outcome: models.AuditFailure,
+		Actor:   event.Email,
+		Subject: event.Email,
+		IP:      event.IP,
+		Reason:  event.Key,
+	})
+}
+
+func (s *Service) delayFor(failures int) time.Duration {
+	if s.lockout.BaseDelay <= 0 || failures <= 0 {
+		return 0
+	}
+
+	delay := s.lockout.BaseDelay
+	for i := 1; i < failures; i++ {
+		delay *= 2
+		if s.lockout.MaxDelay > 0 && delay >= s.lockout.MaxDelay {
+			return s.lockout.MaxDelay
+		}
+	}
+	return delay
+}
+
+func throttleKey(kind, value string) string {
+	return kind + ":" + value
+}
+
+func (s *Service) getThrottlePath(key string) []string {
+	return []string{"home", ThrottleDir, storage.EncodeSegment(key)}
+}
+
+// getThrottleItem returns the item a throttle record is stored in, which is
+// also readable as the file at getThrottlePath
+func (s *Service) getThrottleItem(key string) string {
+	return strings.Join(s.getThrottlePath(key), "/")
+}
+
+// getThrottle returns the throttle record of key, along with the stored
+// item it was read from, which is empty when there is none
+func (s *Service) getThrottle(key string) (string, *models.LoginThrottle, error) {
+	current, err := s.storage.GetItem(s.getThrottleItem(key))
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return "", models.NewLoginThrottle(key), nil
+		}
+		return "", nil, err
+	}
+
+	throttle := models.NewLoginThrottle(key)
+	if item, err := models.StorageItemFromJSON(current); err == nil {
+		if dataStr, ok := item.Data.(string); ok {
+			if stored, err := models.LoginThrottleFromJSON(dataStr); err == nil {
+				throttle = stored
+				throttle.Key = key
+			}
+		}
+	}
+	return current, throttle, nil
+}
+
+// swapThrottle replaces the stored item current with the throttle record,
+// unless the item changed since it was read
+func (s *Service) swapThrottle(current string, throttle *models.LoginThrottle) (bool, error) {
+	data, err := throttle.ToJSON()
+	if err != nil {
+		return false, err
+	}
+	path := s.getThrottlePath(throttle.Key)
+	item, err := models.NewStorageItem(path, "file", data).ToJSON()
+	if err != nil {
+		return false, err
+	}
+	return s.storage.SwapItem(strings.Join(path, "/"), current, item)
+}
+
+// clearThrottle deletes the throttle record of key. It is deleted as an
+// item, since records SwapItem created are missing from the directory.
+func (s *Service) clearThrottle(key string) error {
+	err := s.storage.DeleteItem(s.getThrottleItem(key))
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
+func (s *Service) getLockoutLogPath() []string {
+	return []string{"home", SecurityDir, "lockouts"}
+}
+
+func (s *Service) appendLockoutEvent(event *models.LockoutEvent) error {
+	return appendEventLog(s, s.getLockoutLogPath(), event, maxLockoutEvents)
+}
@@ -0,0 +1,313 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/c4gt/tornado-nginx-go-backend/internal/models"
+	"github.com/c4gt/tornado-nginx-go-backend/internal/storage"
+)
+
+const (
+	MigrationDir = "migrations"
+
+	// identityMigration marks that records stored under verbatim email
+	// addresses and names have been moved to normalized, encoded paths
+	identityMigration = "identities-v1"
+)
+
+// IdentityMigration reports what MigrateIdentities changed
+type IdentityMigration struct {
+	Users int // accounts moved to their normalized address
+	Items int // stored items moved or rewritten
+	// Conflicts lists addresses left in place because their normalized
+	// address already belongs to another account
+	Conflicts []string
+}
+
+func (s *Service) getMigrationPath(name string) []string {
+	return []string{"home", SecurityDir, MigrationDir, name}
+}
+
+// MigrateIdentities moves records written before email addresses were
+// normalized and path segments encoded: accounts, their home directories,
+// identity links, pending deletions and email change records. It runs once;
+// later calls return a nil report.
+func (s *Service) MigrateIdentities() (*IdentityMigration, error) {
+	marker := s.getMigrationPath(identityMigration)
+	if _, err := s.storage.GetFile(marker); err == nil {
+		return nil, nil
+	} else if !errors.Is(err, storage.ErrNotFound) {
+		return nil, err
+	}
+
+	result := &IdentityMigration{}
+	prefix := strings.Join([]string{"home", UserDir}, "/")
+	paths, err := s.storage.ListItems(prefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		if err := s.migrateUser(path, result); err != nil {
+			return result, fmt.Errorf("failed to migrate %s: %w", path, err)
+		}
+	}
+
+	if err := s.migrateEmailChanges(result); err != nil {
+		return result, err
+	}
+
+	// Throttles keyed by a verbatim address simply expire
+	if err := s.putFile(marker, s.now().UTC().Format("2006-01-02T15:04:05Z")); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// migrateUser moves the account stored at path, whose key is the address
+// as it was typed at registration
+func (s *Service) migrateUser(path string, result *IdentityMigration) error {
+	user, err := readRecord(s, path, models.UserFromJSON)
+	if err != nil {
+		return err
+	}
+	if user == nil || user.Email == "" {
+		return nil
+	}
+
+	oldEmail := user.Email
+	email := NormalizeEmail(oldEmail)
+	newPath := strings.Join(s.getUserPath(email), "/")
+	if newPath != path {
+		if exists, err := s.storage.ExistsItem(newPath); err != nil {
+			return err
+		} else if exists {
+			log.Printf("Not migrating %s: %s already has an account", oldEmail, email)
+			result.Conflicts = append(result.Conflicts, oldEmail)
+			return nil
+		}
+	}
+
+	// Move the home directory first so that a failure leaves the account
+	// pointing at its files
+	moved, err := s.migrateTree([]string{"home", oldEmail}, HomePath(email))
+	result.Items += moved
+	if err != nil {
+		return err
+	}
+
+	for _, identity := range user.Identities {
+		oldKey := strings.Join([]string{"home", IdentityDir, identity.Provider + ":" + identity.Subject}, "/")
+		if err := s.putFile(s.getIdentityPath(identity.Provider, identity.Subject), email); err != nil {
+			return err
+		}
+		if newKey := strings.Join(s.getIdentityPath(identity.Provider, identity.Subject), "/"); newKey != oldKey {
+			s.storage.DeleteItem(oldKey)
+		}
+	}
+
+	if err := s.migrateDeletion(oldEmail, email); err != nil {
+		return err
+	}
+
+	if newPath == path && oldEmail == email {
+		return nil
+	}
+	user.Email = email
+	userData, err := user.ToJSON()
+	if err != nil {
+		return err
+	}
+	if err := s.putFile(s.getUserPath(email), userData); err != nil {
+		return err
+	}
+	if newPath != path {
+		if err := s.storage.DeleteItem(path); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Migrated account %s to %s", oldEmail, email)
+	result.Users++
+	return nil
+}
+
+// migrateTree moves the tree stored under the verbatim segments from to the
+// encoded path to, encoding the names of everything below it. Items whose
+// key does not change still have their directory listings encoded.
+func (s *Service) migrateTree(from, to []string) (int, error) {
+	fromPath := strings.Join(from, "/")
+	items, err := s.storage.ListItems(fromPath)
+	if err != nil {
+		return 0, err
+	}
+	items = append([]string{fromPath}, items...)
+
+	moved := 0
+	for _, key := range items {
+		data, err := s.storage.GetItem(key)
+		if err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				continue
+			}
+			return moved, err
+		}
+
+		target := append([]string{}, to...)
+		if rest := strings.TrimPrefix(key, fromPath); rest != "" {
+			target = append(target, storage.EncodePath(strings.Split(rest[1:], "/")...)...)
+		}
+		targetKey := strings.Join(target, "/")
+
+		changed := targetKey != key
+		if item, err := models.StorageItemFromJSON(data); err == nil && item.Path != nil {
+			item.Path = target
+			if names, ok := item.Data.([]interface{}); ok && item.Type == "dir" {
+				encoded := make([]string, 0, len(names))
+				for _, name := range names {
+					if name, ok := name.(string); ok {
+						encoded = append(encoded, storage.EncodeSegment(name))
+						changed = changed || encoded[len(encoded)-1] != name
+					}
+				}
+				item.Data = encoded
+			}
+			if data, err = item.ToJSON(); err != nil {
+				return moved, err
+			}
+		}
+		if !changed {
+			continue
+		}
+
+		if err := s.storage.PutItem(targetKey, data); err != nil {
+			return moved, err
+		}
+		if targetKey != key {
+			if err := s.storage.DeleteItem(key); err != nil {
+				return moved, err
+			}
+		}
+		moved++
+	}
+	return moved, nil
+}
+
+// migrateDeletion moves a pending deletion of oldEmail to the normalized
+// address
+func (s *Service) migrateDeletion(oldEmail, email string) error {
+	oldKey := strings.Join([]string{"home", DeletionDir, oldEmail}, "/")
+	deletion, err := readRecord(s, oldKey, models.PendingDeletionFromJSON)
+	if err != nil || deletion == nil {
+		return err
+	}
+
+	deletion.Email = email
+	deletionData, err := deletion.ToJSON()
+	if err != nil {
+		return err
+	}
+	if err := s.putFile(s.getDeletionPath(email), deletionData); err != nil {
+		return err
+	}
+	if newKey := strings.Join(s.getDeletionPath(email), "/"); newKey != oldKey {
+		return s.storage.DeleteItem(oldKey)
+	}
+	return nil
+}
+
+// migrateEmailChanges normalizes the addresses of pending email changes and
+// moves redirects from past changes to their normalized address
+func (s *Service) migrateEmailChanges(result *IdentityMigration) error {
+	prefix := strings.Join([]string{"home", EmailChangeDir}, "/")
+	paths, err := s.storage.ListItems(prefix)
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		emailChange, err := readRecord(s, path, models.EmailChangeFromJSON)
+		if err != nil {
+			return err
+		}
+		if emailChange == nil {
+			continue
+		}
+		emailChange.OldEmail = NormalizeEmail(emailChange.OldEmail)
+		emailChange.NewEmail = NormalizeEmail(emailChange.NewEmail)
+		data, err := emailChange.ToJSON()
+		if err != nil {
+			return err
+		}
+		if err := s.putFile(s.getEmailChangePath(emailChange.Token), data); err != nil {
+			return err
+		}
+		if newKey := strings.Join(s.getEmailChangePath(emailChange.Token), "/"); newKey != path {
+			s.storage.DeleteItem(path)
+		}
+		result.Items++
+	}
+
+	prefix = strings.Join([]string{"home", RedirectDir}, "/")
+	if paths, err = s.storage.ListItems(prefix); err != nil {
+		return err
+	}
+	for _, path := range paths {
+		redirect, err := readRecord(s, path, models.EmailRedirectFromJSON)
+		if err != nil {
+			return err
+		}
+		if redirect == nil {
+			continue
+		}
+		redirect.OldEmail = NormalizeEmail(redirect.OldEmail)
+		redirect.NewEmail = NormalizeEmail(redirect.NewEmail)
+		newKey := strings.Join(s.getRedirectPath(redirect.OldEmail), "/")
+		if newKey != path {
+			if exists, err := s.storage.ExistsItem(newKey); err != nil {
+				return err
+			} else if exists {
+				s.storage.DeleteItem(path)
+				continue
+			}
+		}
+		data, err := redirect.ToJSON()
+		if err != nil {
+			return err
+		}
+		if err := s.putFile(s.getRedirectPath(redirect.OldEmail), data); err != nil {
+			return err
+		}
+		if newKey != path {
+			s.storage.DeleteItem(path)
+		}
+		result.Items++
+	}
+	return nil
+}
+
+// readRecord reads the record stored as a file under the low-level key path.
+// Missing items and items that are not records of this kind return nil.
+func readRecord[T any](s *Service, path string, parse func(string) (*T, error)) (*T, error) {
+	data, err := s.storage.GetItem(path)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	item, err := models.StorageItemFromJSON(data)
+	if err != nil {
+		return nil, nil
+	}
+	dataStr, ok := item.Data.(string)
+	if !ok {
+		return nil, nil
+	}
+	record, err := parse(dataStr)
+	if err != nil {
+		return nil, nil
+	}
+	return record, nil
+}
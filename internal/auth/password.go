@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/c4gt/tornado-nginx-go-backend/internal/models"
+)
+
+//go:embed common_passwords.txt
+var commonPasswords string
+
+// PasswordPolicy describes the requirements a new password must meet
+type PasswordPolicy struct {
+	MinLength int
+	MaxLength int
+	// MaxBytes is the longest password the password hasher accepts, since
+	// characters outside ASCII take more than one byte
+	MaxBytes  int
+	blocklist map[string]struct{}
+}
+
+// PasswordPolicyError explains why a password was rejected. The message is
+// safe to show to users.
+type PasswordPolicyError struct {
+	Message string
+}
+
+func (e *PasswordPolicyError) Error() string {
+	return e.Message
+}
+
+// DefaultPasswordPolicy requires 8 to 128 characters, no more than the
+// current password hasher accepts, and rejects passwords from the bundled
+// list of common and breached passwords.
+func DefaultPasswordPolicy() PasswordPolicy {
+	policy := PasswordPolicy{
+		MinLength: 8,
+		MaxLength: 128,
+		MaxBytes:  models.MaxPasswordBytes(models.GetPasswordHasher()),
+		blocklist: make(map[string]struct{}),
+	}
+	policy.addBlocklist(commonPasswords)
+	return policy
+}
+
+// LoadBlocklistFile adds the passwords listed in a local file (one per line,
+// '#' starts a comment) to the blocklist.
+func (p *PasswordPolicy) LoadBlocklistFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read password blocklist: %w", err)
+	}
+	p.addBlocklist(string(data))
+	return nil
+}
+
+func (p *PasswordPolicy) addBlocklist(list string) {
+	if p.blocklist == nil {
+		p.blocklist = make(map[string]struct{})
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(list))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p.blocklist[strings.ToLower(line)] = struct{}{}
+	}
+}
+
+// Validate checks a password for the given account against the policy
+func (p PasswordPolicy) Validate(email, password string) error {
+	length := utf8.RuneCountInString(password)
+	if length < p.MinLength || length == 0 {
+		return &PasswordPolicyError{Message: fmt.Sprintf("Password must be at least %d characters long", max(p.MinLength, 1))}
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		return &PasswordPolicyError{Message: fmt.Sprintf("Password must be at most %d characters long", p.MaxLength)}
+	}
+	if err := checkPasswordBytes(password, p.MaxBytes); err != nil {
+		return err
+	}
+
+	lower := strings.ToLower(password)
+	if _, found := p.blocklist[lower]; found {
+		return &PasswordPolicyError{Message: "Password is too common, please choose another one"}
+	}
+
+	email = strings.ToLower(email)
+	localPart, _, _ := strings.Cut(email, "@")
+	if lower == email || (localPart != "" && lower == localPart) {
+		return &PasswordPolicyError{Message: "Password must not be the same as your email address"}
+	}
+
+	return nil
+}
+
+// checkPasswordBytes refuses passwords longer than maxBytes, when it is not 0
+func checkPasswordBytes(password string, maxBytes int) error {
+	if maxBytes > 0 && len(password) > maxBytes {
+		return &PasswordPolicyError{Message: fmt.Sprintf(
+			"Password must be at most %d bytes long; accented letters and symbols count as more than one", maxBytes)}
+	}
+	return nil
+}
@@ -0,0 +1,279 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/c4gt/tornado-nginx-go-backend/internal/models"
+	"github.com/c4gt/tornado-nginx-go-backend/internal/storage"
+)
+
+const (
+	InviteDir = "invites"
+
+	// Registration modes
+	RegistrationOpen   = "open"
+	RegistrationInvite = "invite"
+
+	inviteCodeBytes = 10
+)
+
+// Reasons a registration is refused, also used as the data of JSON responses
+const (
+	ReasonInviteRequired   = "inviterequired"
+	ReasonInviteInvalid    = "inviteinvalid"
+	ReasonDomainNotAllowed = "domainnotallowed"
+)
+
+var ErrInviteNotFound = errors.New("invite not found")
+
+// RegistrationPolicy decides who may create an account. The domain lists
+// apply in every mode; a domain also covers its subdomains.
+type RegistrationPolicy struct {
+	Mode           string
+	AllowedDomains []string
+	DeniedDomains  []string
+}
+
+// RegistrationError explains why a registration was refused. The message is
+// safe to show to users.
+type RegistrationError struct {
+	Reason  string
+	Message string
+}
+
+func (e *RegistrationError) Error() string {
+	return e.Message
+}
+
+func DefaultRegistrationPolicy() RegistrationPolicy {
+	return RegistrationPolicy{Mode: RegistrationOpen}
+}
+
+// ValidRegistrationMode reports whether mode is a known registration mode
+func ValidRegistrationMode(mode string) bool {
+	return mode == RegistrationOpen || mode == RegistrationInvite
+}
+
+func (s *Service) SetRegistrationPolicy(policy RegistrationPolicy) {
+	policy.AllowedDomains = normalizeDomains(policy.AllowedDomains)
+	policy.DeniedDomains = normalizeDomains(policy.DeniedDomains)
+	s.registration = policy
+}
+
+func (s *Service) RegistrationPolicy() RegistrationPolicy {
+	return s.registration
+}
+
+// InviteRequired reports whether new accounts need an invite code
+func (s *Service) InviteRequired() bool {
+	return s.registration.Mode == RegistrationInvite
+}
+
+// CheckRegistration reports whether an account may be registered for email
+// with the given invite code, without using up the code. Bootstrap admins
+// can always register.
+func (s *Service) CheckRegistration(email, code string) error {
+	if s.isBootstrapAdmin(email) {
+		return nil
+	}
+	if err := s.checkDomain(email); err != nil {
+		return err
+	}
+	if !s.InviteRequired() {
+		return nil
+	}
+	_, err := s.validInvite(code)
+	return err
+}
+
+// ClaimRegistration checks the registration like CheckRegistration and, in
+// invite mode, uses up one registration of the invite code for email.
+func (s *Service) ClaimRegistration(email, code string) error {
+	if err := s.CheckRegistration(email, code); err != nil {
+		return err
+	}
+	if !s.InviteRequired() || s.isBootstrapAdmin(email) {
+		return nil
+	}
+
+	// Concurrent registrations must not use a code more often than allowed
+	s.inviteMutex.Lock()
+	defer s.inviteMutex.Unlock()
+
+	invite, err := s.validInvite(code)
+	if err != nil {
+		return err
+	}
+	invite.Uses++
+	invite.UsedBy = append(invite.UsedBy, NormalizeEmail(email))
+	if err := s.putInvite(invite); err != nil {
+		return err
+	}
+	log.Printf("Invite %s used by %s (%d of %d)", invite.Code, email, invite.Uses, invite.MaxUses)
+	return nil
+}
+
+func (s *Service) checkDomain(email string) error {
+	domain := strings.ToLower(email[strings.LastIndex(email, "@")+1:])
+	refused := &RegistrationError{
+		Reason:  ReasonDomainNotAllowed,
+		Message: "Registration is not open to " + domain + " addresses",
+	}
+
+	if len(s.registration.AllowedDomains) > 0 && !matchesDomain(domain, s.registration.AllowedDomains) {
+		return refused
+	}
+	if matchesDomain(domain, s.registration.DeniedDomains) {
+		return refused
+	}
+	return nil
+}
+
+func (s *Service) validInvite(code string) (*models.Invite, error) {
+	if strings.TrimSpace(code) == "" {
+		return nil, &RegistrationError{
+			Reason:  ReasonInviteRequired,
+			Message: "An invite code is required to register",
+		}
+	}
+
+	invite, err := s.GetInvite(code)
+	if err == nil && !invite.IsValid(s.now()) {
+		err = ErrInviteNotFound
+	}
+	if err != nil {
+		if !errors.Is(err, ErrInviteNotFound) {
+			return nil, err
+		}
+		return nil, &RegistrationError{
+			Reason:  ReasonInviteInvalid,
+			Message: "The invite code is invalid, expired or already used",
+		}
+	}
+	return invite, nil
+}
+
+func (s *Service) getInvitePath(code string) []string {
+	return []string{"home", InviteDir, storage.EncodeSegment(code)}
+}
+
+// CreateInvite issues an invite code that can register maxUses accounts, or
+// any number when maxUses is 0, until validFor has passed. A validFor of 0
+// never expires.
+func (s *Service) CreateInvite(actor string, maxUses int, validFor time.Duration) (*models.Invite, error) {
+	if maxUses < 0 || validFor < 0 {
+		return nil, fmt.Errorf("invalid invite limits")
+	}
+
+	bytes := make([]byte, inviteCodeBytes)
+	if _, err := rand.Read(bytes); err != nil {
+		return nil, err
+	}
+
+	now := s.now()
+	invite := &models.Invite{
+		Code:      base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(bytes),
+		CreatedBy: actor,
+		CreatedAt: now,
+		MaxUses:   maxUses,
+	}
+	if validFor > 0 {
+		invite.ExpiresAt = now.Add(validFor)
+	}
+	if err := s.putInvite(invite); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Invite %s created by %s", invite.Code, actor)
+	return invite, nil
+}
+
+// GetInvite returns an invite by its code, which is not case sensitive
+func (s *Service) GetInvite(code string) (*models.Invite, error) {
+	item, err := s.storage.GetFile(s.getInvitePath(normalizeInviteCode(code)))
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil, ErrInviteNotFound
+		}
+		return nil, err
+	}
+
+	dataStr, ok := item.Data.(string)
+	if !ok {
+		return nil, ErrInviteNotFound
+	}
+	return models.InviteFromJSON(dataStr)
+}
+
+// ListInvites returns every invite, newest first, including expired and
+// used up ones
+func (s *Service) ListInvites() ([]*models.Invite, error) {
+	prefix := "home/" + InviteDir
+	paths, err := s.storage.ListItems(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var invites []*models.Invite
+	for _, path := range paths {
+		invite, err := s.GetInvite(path[len(prefix)+1:])
+		if err != nil {
+			log.Printf("Skipping unreadable invite %s: %v", path, err)
+			continue
+		}
+		invites = append(invites, invite)
+	}
+	sort.Slice(invites, func(i, j int) bool {
+		return invites[i].CreatedAt.After(invites[j].CreatedAt)
+	})
+	return invites, nil
+}
+
+// DeleteInvite revokes an invite code
+func (s *Service) DeleteInvite(code string) error {
+	if _, err := s.GetInvite(code); err != nil {
+		return err
+	}
+	return s.storage.DeleteFile(s.getInvitePath(normalizeInviteCode(code)))
+}
+
+func (s *Service) putInvite(invite *models.Invite) error {
+	data, err := invite.ToJSON()
+	if err != nil {
+		return err
+	}
+	return s.putFile(s.getInvitePath(invite.Code), data)
+}
+
+func normalizeInviteCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+func normalizeDomains(domains []string) []string {
+	var normalized []string
+	for _, domain := range domains {
+		domain = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(domain), "@"))
+		if domain != "" {
+			normalized = append(normalized, domain)
+		}
+	}
+	return normalized
+}
+
+// matchesDomain reports whether domain is one of the listed domains or a
+// subdomain of one
+func matchesDomain(domain string, domains []string) bool {
+	for _, candidate := range domains {
+		if domain == candidate || strings.HasSuffix(domain, "."+candidate) {
+			return true
+		}
+	}
+	return false
+}
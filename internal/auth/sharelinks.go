@@ -0,0 +1,287 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/c4gt/tornado-nginx-go-backend/internal/models"
+	"github.com/c4gt/tornado-nginx-go-backend/internal/storage"
+)
+
+// Share links let people without an account view one spreadsheet. Links
+// are kept by token outside the owners' homes, like email changes, so that
+// a token finds its link without knowing the owner.
+const (
+	ShareLinkDir        = "links"
+	shareLinkTokenBytes = 24
+)
+
+var (
+	ErrShareLinkNotFound = errors.New("share link not found or expired")
+	ErrShareLinkPassword = errors.New("wrong share link password")
+)
+
+func (s *Service) getShareLinkPath(token string) []string {
+	return []string{"home", ShareLinkDir, storage.EncodeSegment(token)}
+}
+
+// CreateShareLink issues a link to view a spreadsheet of the owner, valid
+// for validFor or forever when it is 0, and protected by password unless it
+// is empty
+func (s *Service) CreateShareLink(owner, app, file string, validFor time.Duration, password string) (*models.ShareLink, error) {
+	token, err := randomToken(shareLinkTokenBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	now := s.now()
+	link := &models.ShareLink{
+		Token:     token,
+		Owner:     NormalizeEmail(owner),
+		App:       app,
+		File:      ShareFileName(file),
+		CreatedAt: now,
+	}
+	if validFor > 0 {
+		link.ExpiresAt = now.Add(validFor)
+	}
+	if password != "" {
+		hasher := models.GetPasswordHasher()
+		if err := checkPasswordBytes(password, models.MaxPasswordBytes(hasher)); err != nil {
+			return nil, err
+		}
+		hash, err := hasher.Hash(password)
+		if err != nil {
+			return nil, err
+		}
+		link.PasswordHash = hash
+	}
+	if err := s.putShareLink(link); err != nil {
+		return nil, err
+	}
+
+	log.Printf("%s created a share link to %s", link.Owner, shareName(app, link.File))
+	return link, nil
+}
+
+// GetShareLink returns the link with a token, or ErrShareLinkNotFound when
+// there is none or it has expired
+func (s *Service) GetShareLink(token string) (*models.ShareLink, error) {
+	link, err := s.readShareLink(token)
+	if err != nil {
+		return nil, err
+	}
+	if link.IsExpired(s.now()) {
+		return nil, ErrShareLinkNotFound
+	}
+	return link, nil
+}
+
+// UnlockShareLink checks the password of a link. Failures are throttled
+// like sign-ins, per link and per client IP, and return a *ThrottleError
+// while the link is locked. The IP is counted apart from sign-ins, so that
+// guessing link passwords does not lock others out of signing in from a
+// shared address, nor failed sign-ins lock links.
+func (s *Service) UnlockShareLink(token, password, ip string) (*models.ShareLink, error) {
+	link, err := s.GetShareLink(token)
+	if err != nil {
+		return nil, err
+	}
+	if !link.HasPassword() {
+		return link, nil
+	}
+
+	now := s.now()
+	linkKey := throttleKey("link", shareLinkID(token))
+	linkAttempt, err := s.beginAttempt(linkKey, s.lockout.MaxAttempts, now)
+	if err != nil {
+		return nil, err
+	}
+	var ipAttempt *throttleAttempt
+	if ip != "" {
+		ipAttempt, err = s.beginAttempt(throttleKey("linkip", ip), s.lockout.IPMaxAttempts, now)
+		if err != nil {
+			s.cancelAttempt(linkAttempt)
+			return nil, err
+		}
+	}
+
+	if models.VerifyPassword(link.PasswordHash, password) {
+		s.clearThrottle(linkKey)
+		if ipAttempt != nil {
+			s.cancelAttempt(ipAttempt)
+		}
+		return link, nil
+	}
+	s.failAttempt(linkAttempt, "", ip)
+	if ipAttempt != nil {
+		s.failAttempt(ipAttempt, "", ip)
+	}
+	return nil, ErrShareLinkPassword
+}
+
+// ViewShareLink counts a view of a link and returns it
+func (s *Service) ViewShareLink(token string) (*models.ShareLink, error) {
+	s.linkMutex.Lock()
+	defer s.linkMutex.Unlock()
+
+	link, err := s.GetShareLink(token)
+	if err != nil {
+		return nil, err
+	}
+	link.Views++
+	link.LastViewedAt = s.now()
+	if err := s.putShareLink(link); err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
+// ListShareLinks returns the owner's links, newest first, including expired
+// ones. Empty app and file match any.
+func (s *Service) ListShareLinks(owner, app, file string) ([]*models.ShareLink, error) {
+	owner, file = NormalizeEmail(owner), ShareFileName(file)
+	links, err := s.allShareLinks()
+	if err != nil {
+		return nil, err
+	}
+
+	var owned []*models.ShareLink
+	for _, link := range links {
+		if link.Owner == owner && (app == "" || link.App == app) && (file == "" || link.File == file) {
+			owned = append(owned, link)
+		}
+	}
+	sort.Slice(owned, func(i, j int) bool {
+		return owned[i].CreatedAt.After(owned[j].CreatedAt)
+	})
+	return owned, nil
+}
+
+// RevokeShareLink deletes a link of the owner
+func (s *Service) RevokeShareLink(owner, token string) error {
+	s.linkMutex.Lock()
+	defer s.linkMutex.Unlock()
+
+	link, err := s.readShareLink(token)
+	if err != nil {
+		return err
+	}
+	if link.Owner != NormalizeEmail(owner) {
+		return ErrShareLinkNotFound
+	}
+	if err := s.storage.DeleteFile(s.getShareLinkPath(token)); err != nil {
+		return err
+	}
+
+	log.Printf("%s revoked a share link to %s", link.Owner, shareName(link.App, link.File))
+	return nil
+}
+
+// dropShareLinks deletes the links of an account being deleted
+func (s *Service) dropShareLinks(email string) {
+	s.updateShareLinks(NormalizeEmail(email), func(link *models.ShareLink) *models.ShareLink {
+		return nil
+	})
+}
+
+// moveShareLinks follows an account to its new address. The caller holds
+// linkMutex.
+func (s *Service) moveShareLinks(oldEmail, newEmail string) {
+	s.rewriteShareLinks(NormalizeEmail(oldEmail), func(link *models.ShareLink) *models.ShareLink {
+		link.Owner = NormalizeEmail(newEmail)
+		return link
+	})
+}
+
+// updateShareLinks rewrites the links of an owner with update, which
+// returns nil for links to delete
+func (s *Service) updateShareLinks(owner string, update func(*models.ShareLink) *models.ShareLink) {
+	s.linkMutex.Lock()
+	defer s.linkMutex.Unlock()
+	s.rewriteShareLinks(owner, update)
+}
+
+// rewriteShareLinks is updateShareLinks for callers holding linkMutex
+func (s *Service) rewriteShareLinks(owner string, update func(*models.ShareLink) *models.ShareLink) {
+	links, err := s.allShareLinks()
+	if err != nil {
+		log.Printf("Failed to list share links of %s: %v", owner, err)
+		return
+	}
+	for _, link := range links {
+		if link.Owner != owner {
+			continue
+		}
+		token := link.Token
+		if link = update(link); link == nil {
+			err = s.storage.DeleteFile(s.getShareLinkPath(token))
+		} else {
+			err = s.putShareLink(link)
+		}
+		if err != nil {
+			log.Printf("Failed to update a share link of %s: %v", owner, err)
+		}
+	}
+}
+
+func (s *Service) allShareLinks() ([]*models.ShareLink, error) {
+	prefix := "home/" + ShareLinkDir
+	paths, err := s.storage.ListItems(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var links []*models.ShareLink
+	for _, path := range paths {
+		token, err := storage.DecodeSegment(path[len(prefix)+1:])
+		if err != nil {
+			continue
+		}
+		link, err := s.readShareLink(token)
+		if err != nil {
+			log.Printf("Skipping unreadable share link %s: %v", shareLinkID(token), err)
+			continue
+		}
+		links = append(links, link)
+	}
+	return links, nil
+}
+
+func (s *Service) readShareLink(token string) (*models.ShareLink, error) {
+	if token == "" {
+		return nil, ErrShareLinkNotFound
+	}
+	item, err := s.storage.GetFile(s.getShareLinkPath(token))
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil, ErrShareLinkNotFound
+		}
+		return nil, err
+	}
+
+	dataStr, ok := item.Data.(string)
+	if !ok {
+		return nil, ErrShareLinkNotFound
+	}
+	return models.ShareLinkFromJSON(dataStr)
+}
+
+func (s *Service) putShareLink(link *models.ShareLink) error {
+	data, err := link.ToJSON()
+	if err != nil {
+		return err
+	}
+	return s.putFile(s.getShareLinkPath(link.Token), data)
+}
+
+// shareLinkID names a link in logs and throttles without its token, which
+// would let anyone reading them view the spreadsheet
+func shareLinkID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,473 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/c4gt/tornado-nginx-go-backend/internal/models"
+	"github.com/c4gt/tornado-nginx-go-backend/internal/storage"
+)
+
+// Owners share an app folder of their securestore, or one file in it, with
+// other registered users. The grants of a folder are kept in the owner's
+// home under shares/<app>, where they decide access. Each user's home also
+// holds an index of the folders shared with them, to list those without
+// looking through every account.
+const (
+	ShareDir         = "shares"
+	SharedWithMeName = "sharedwithme"
+)
+
+var (
+	ErrShareNotFound    = errors.New("share not found")
+	ErrShareUnknownUser = errors.New("no registered user with that email address")
+	ErrShareWithOwner   = errors.New("files cannot be shared with their owner")
+	ErrShareRole        = errors.New("role must be viewer or editor")
+)
+
+// sharedFolder is an entry of a user's index of folders shared with them
+type sharedFolder struct {
+	Owner string `json:"owner"`
+	App   string `json:"app"`
+}
+
+// ShareFileName returns the name a file is shared under: without the .msc
+// extension SocialCalc saves add, so that one grant covers the file however
+// it is reached
+func ShareFileName(name string) string {
+	return strings.TrimSuffix(name, ".msc")
+}
+
+func (s *Service) getSharesPath(owner, app string) []string {
+	return HomePath(owner, ShareDir, app)
+}
+
+func (s *Service) getSharedWithMePath(user string) []string {
+	return HomePath(user, SharedWithMeName)
+}
+
+// Share grants user a role on the owner's app folder, or on one file in it
+// when file is not empty. Sharing again with the same user changes the role.
+func (s *Service) Share(owner, app, file, user, role string) (*models.Share, error) {
+	owner, user = NormalizeEmail(owner), s.ResolveEmail(user)
+	if !models.ValidShareRole(role) {
+		return nil, ErrShareRole
+	}
+	if user == owner {
+		return nil, ErrShareWithOwner
+	}
+	exists, err := s.UserExists(user)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrShareUnknownUser
+	}
+
+	s.shareMutex.Lock()
+	defer s.shareMutex.Unlock()
+
+	shares, err := s.folderShares(owner, app)
+	if err != nil {
+		return nil, err
+	}
+	share := &models.Share{
+		Owner:    owner,
+		App:      app,
+		File:     ShareFileName(file),
+		User:     user,
+		Role:     role,
+		SharedAt: s.now(),
+	}
+	replaced := false
+	for i, existing := range shares {
+		if existing.User == share.User && existing.File == share.File {
+			shares[i] = share
+			replaced = true
+		}
+	}
+	if !replaced {
+		shares = append(shares, share)
+	}
+	if err := s.putFolderShares(owner, app, shares); err != nil {
+		return nil, err
+	}
+	if err := s.indexSharedFolder(user, owner, app); err != nil {
+		return nil, err
+	}
+
+	log.Printf("%s shared %s with %s as %s", owner, shareName(app, share.File), user, role)
+	return share, nil
+}
+
+// Unshare revokes what Share granted user on the owner's app folder, or on
+// one file in it. Grants on the folder and on its files are revoked
+// separately.
+func (s *Service) Unshare(owner, app, file, user string) error {
+	owner, user, file = NormalizeEmail(owner), NormalizeEmail(user), ShareFileName(file)
+
+	s.shareMutex.Lock()
+	defer s.shareMutex.Unlock()
+
+	shares, err := s.folderShares(owner, app)
+	if err != nil {
+		return err
+	}
+	kept := shares[:0]
+	revoked, others := false, false
+	for _, share := range shares {
+		switch {
+		case share.User != user:
+			kept = append(kept, share)
+		case share.File == file:
+			revoked = true
+		default:
+			kept = append(kept, share)
+			others = true
+		}
+	}
+	if !revoked {
+		return ErrShareNotFound
+	}
+	if err := s.putFolderShares(owner, app, kept); err != nil {
+		return err
+	}
+	if !others {
+		if err := s.unindexSharedFolder(user, owner, app); err != nil {
+			log.Printf("Failed to update shared folders of %s: %v", user, err)
+		}
+	}
+
+	log.Printf("%s revoked %s from %s", owner, shareName(app, file), user)
+	return nil
+}
+
+// ListShares returns what the owner shares in an app folder, or in every
+// folder when app is empty, ordered by folder, file and user
+func (s *Service) ListShares(owner, app string) ([]*models.Share, error) {
+	if app != "" {
+		shares, err := s.folderShares(owner, app)
+		if err != nil {
+			return nil, err
+		}
+		sortShares(shares)
+		return shares, nil
+	}
+
+	prefix := strings.Join(HomePath(owner, ShareDir), "/")
+	paths, err := s.storage.ListItems(prefix)
+	if err != nil {
+		return nil, err
+	}
+	var shares []*models.Share
+	for _, path := range paths {
+		folder, err := storage.DecodeSegment(path[len(prefix)+1:])
+		if err != nil {
+			continue
+		}
+		folderShares, err := s.folderShares(owner, folder)
+		if err != nil {
+			log.Printf("Skipping unreadable shares %s: %v", path, err)
+			continue
+		}
+		shares = append(shares, folderShares...)
+	}
+	sortShares(shares)
+	return shares, nil
+}
+
+// SharedWith returns what other users share with user, ordered by owner,
+// folder and file
+func (s *Service) SharedWith(user string) ([]*models.Share, error) {
+	user = NormalizeEmail(user)
+	folders, err := s.sharedFolders(user)
+	if err != nil {
+		return nil, err
+	}
+
+	var shares []*models.Share
+	for _, folder := range folders {
+		granted, err := s.UserShares(user, folder.Owner, folder.App)
+		if err != nil {
+			log.Printf("Skipping unreadable shares of %s/%s: %v", folder.Owner, folder.App, err)
+			continue
+		}
+		shares = append(shares, granted...)
+	}
+	sort.Slice(shares, func(i, j int) bool {
+		if shares[i].Owner != shares[j].Owner {
+			return shares[i].Owner < shares[j].Owner
+		}
+		return lessShare(shares[i], shares[j])
+	})
+	return shares, nil
+}
+
+// UserShares returns the grants user holds on the owner's app folder and on
+// the files in it
+func (s *Service) UserShares(user, owner, app string) ([]*models.Share, error) {
+	user = NormalizeEmail(user)
+	shares, err := s.folderShares(owner, app)
+	if err != nil {
+		return nil, err
+	}
+	var granted []*models.Share
+	for _, share := range shares {
+		if share.User == user {
+			granted = append(granted, share)
+		}
+	}
+	return granted, nil
+}
+
+// Access returns the role user has on a file in the owner's app folder, or
+// on the folder itself when file is empty: models.ShareOwner for the owner,
+// the higher of the roles granted on the folder and on the file, or "" when
+// user has no access
+func (s *Service) Access(user, owner, app, file string) (string, error) {
+	user, owner = NormalizeEmail(user), NormalizeEmail(owner)
+	if user == owner {
+		return models.ShareOwner, nil
+	}
+
+	granted, err := s.UserShares(user, owner, app)
+	if err != nil {
+		return "", err
+	}
+	file = ShareFileName(file)
+	role := ""
+	for _, share := range granted {
+		if share.File == "" || (file != "" && share.File == file) {
+			role = models.HigherShareRole(role, share.Role)
+		}
+	}
+	return role, nil
+}
+
+// dropShares removes the grants other users gave an account being deleted,
+// so that nobody registering the address later inherits them, and the
+// account's folders from the indexes of the users it shared them with
+func (s *Service) dropShares(email string) {
+	email = NormalizeEmail(email)
+
+	s.shareMutex.Lock()
+	defer s.shareMutex.Unlock()
+
+	folders, err := s.sharedFolders(email)
+	if err != nil {
+		log.Printf("Failed to read shared folders of %s: %v", email, err)
+	}
+	for _, folder := range folders {
+		err := s.updateFolderShares(folder.Owner, folder.App, func(share *models.Share) *models.Share {
+			if share.User == email {
+				return nil
+			}
+			return share
+		})
+		if err != nil {
+			log.Printf("Failed to revoke shares of %s/%s from %s: %v", folder.Owner, folder.App, email, err)
+		}
+	}
+
+	owned, err := s.ListShares(email, "")
+	if err != nil {
+		log.Printf("Failed to list shares of %s: %v", email, err)
+	}
+	for _, share := range owned {
+		if err := s.unindexSharedFolder(share.User, email, share.App); err != nil {
+			log.Printf("Failed to update shared folders of %s: %v", share.User, err)
+		}
+	}
+}
+
+// moveShares follows an account to its new address once its home has been
+// copied there: the grants it gave name the new owner in them and in the
+// indexes of the users they are for, and grants it holds name the new user
+func (s *Service) moveShares(oldEmail, newEmail string) {
+	oldEmail, newEmail = NormalizeEmail(oldEmail), NormalizeEmail(newEmail)
+
+	owned, err := s.ListShares(newEmail, "")
+	if err != nil {
+		log.Printf("Failed to list shares of %s: %v", newEmail, err)
+	}
+	apps := map[string]bool{}
+	for _, share := range owned {
+		apps[share.App] = true
+		if err := s.unindexSharedFolder(share.User, oldEmail, share.App); err != nil {
+			log.Printf("Failed to update shared folders of %s: %v", share.User, err)
+		}
+		if err := s.indexSharedFolder(share.User, newEmail, share.App); err != nil {
+			log.Printf("Failed to update shared folders of %s: %v", share.User, err)
+		}
+	}
+	for app := range apps {
+		err := s.updateFolderShares(newEmail, app, func(share *models.Share) *models.Share {
+			share.Owner = newEmail
+			return share
+		})
+		if err != nil {
+			log.Printf("Failed to move shares of %s/%s: %v", newEmail, app, err)
+		}
+	}
+
+	folders, err := s.sharedFolders(newEmail)
+	if err != nil {
+		log.Printf("Failed to read shared folders of %s: %v", newEmail, err)
+	}
+	for _, folder := range folders {
+		err := s.updateFolderShares(folder.Owner, folder.App, func(share *models.Share) *models.Share {
+			if share.User == oldEmail {
+				share.User = newEmail
+			}
+			return share
+		})
+		if err != nil {
+			log.Printf("Failed to move shares of %s/%s to %s: %v", folder.Owner, folder.App, newEmail, err)
+		}
+	}
+}
+
+func (s *Service) folderShares(owner, app string) ([]*models.Share, error) {
+	item, err := s.storage.GetFile(s.getSharesPath(owner, app))
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	dataStr, ok := item.Data.(string)
+	if !ok {
+		return nil, nil
+	}
+	var shares []*models.Share
+	if err := json.Unmarshal([]byte(dataStr), &shares); err != nil {
+		return nil, fmt.Errorf("invalid shares of %s: %w", app, err)
+	}
+	return shares, nil
+}
+
+func (s *Service) putFolderShares(owner, app string, shares []*models.Share) error {
+	path := s.getSharesPath(owner, app)
+	if len(shares) == 0 {
+		if err := s.storage.DeleteFile(path); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return err
+		}
+		return nil
+	}
+
+	data, err := json.Marshal(shares)
+	if err != nil {
+		return err
+	}
+	return s.putFile(path, string(data))
+}
+
+// updateFolderShares rewrites the grants of a folder with update, which
+// returns nil for grants to remove
+func (s *Service) updateFolderShares(owner, app string, update func(*models.Share) *models.Share) error {
+	shares, err := s.folderShares(owner, app)
+	if err != nil || len(shares) == 0 {
+		return err
+	}
+	var updated []*models.Share
+	for _, share := range shares {
+		if share = update(share); share != nil {
+			updated = append(updated, share)
+		}
+	}
+	return s.putFolderShares(owner, app, updated)
+}
+
+func (s *Service) sharedFolders(user string) ([]sharedFolder, error) {
+	item, err := s.storage.GetFile(s.getSharedWithMePath(user))
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	dataStr, ok := item.Data.(string)
+	if !ok {
+		return nil, nil
+	}
+	var folders []sharedFolder
+	if err := json.Unmarshal([]byte(dataStr), &folders); err != nil {
+		return nil, fmt.Errorf("invalid shared folders: %w", err)
+	}
+	return folders, nil
+}
+
+func (s *Service) putSharedFolders(user string, folders []sharedFolder) error {
+	path := s.getSharedWithMePath(user)
+	if len(folders) == 0 {
+		if err := s.storage.DeleteFile(path); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return err
+		}
+		return nil
+	}
+
+	data, err := json.Marshal(folders)
+	if err != nil {
+		return err
+	}
+	return s.putFile(path, string(data))
+}
+
+func (s *Service) indexSharedFolder(user, owner, app string) error {
+	folders, err := s.sharedFolders(user)
+	if err != nil {
+		return err
+	}
+	for _, folder := range folders {
+		if folder.Owner == owner && folder.App == app {
+			return nil
+		}
+	}
+	return s.putSharedFolders(user, append(folders, sharedFolder{Owner: owner, App: app}))
+}
+
+func (s *Service) unindexSharedFolder(user, owner, app string) error {
+	folders, err := s.sharedFolders(user)
+	if err != nil {
+		return err
+	}
+	kept := folders[:0]
+	for _, folder := range folders {
+		if folder.Owner != owner || folder.App != app {
+			kept = append(kept, folder)
+		}
+	}
+	if len(kept) == len(folders) {
+		return nil
+	}
+	return s.putSharedFolders(user, kept)
+}
+
+func sortShares(shares []*models.Share) {
+	sort.Slice(shares, func(i, j int) bool {
+		return lessShare(shares[i], shares[j])
+	})
+}
+
+func lessShare(a, b *models.Share) bool {
+	if a.App != b.App {
+		return a.App < b.App
+	}
+	if a.File != b.File {
+		return a.File < b.File
+	}
+	return a.User < b.User
+}
+
+func shareName(app, file string) string {
+	if file == "" {
+		return app + "/"
+	}
+	return app + "/" + file
+}
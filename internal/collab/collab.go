@@ -0,0 +1,541 @@
+// Package collab relays the commands of SocialCalc editors working on the
+// same spreadsheet. Each document has a room holding the last snapshot of
+// the spreadsheet and a log of the commands executed since, numbered by the
+// room; editors apply commands in that order, their own included, so every
+// copy of the spreadsheet ends up the same. Editors joining late get the
+// snapshot and the log. Editors are asked now and then for a snapshot, which
+// is saved with the Persister and replaces the commands it includes.
+package collab
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Message types. Editors send execute, ecell, ask.ecell and snapshot; the
+// room sends welcome, join and leave, relays execute, ecell and ask.ecell,
+// and sends ask.snapshot and error.
+const (
+	TypeExecute     = "execute"
+	TypeECell       = "ecell"
+	TypeAskECell    = "ask.ecell"
+	TypeSnapshot    = "snapshot"
+	TypeAskSnapshot = "ask.snapshot"
+	TypeWelcome     = "welcome"
+	TypeJoin        = "join"
+	TypeLeave       = "leave"
+	TypeError       = "error"
+)
+
+// Message is what editors and rooms exchange, as JSON
+type Message struct {
+	Type string `json:"type"`
+	// Seq numbers commands in the order of the log. In welcome and
+	// ask.snapshot it is the number of the last command of the log, and in
+	// snapshot that of the last command the snapshot includes.
+	Seq int64 `json:"seq,omitempty"`
+	// Client and User are the editor a relayed message comes from, or in
+	// welcome the editor receiving it
+	Client string `json:"client,omitempty"`
+	User   string `json:"user,omitempty"`
+	// Data is what SocialCalc broadcasts, such as {"cmdtype":"scmd",
+	// "id":"sheet1","cmdstr":"set A1 value n 1","saveundo":true} for
+	// execute or {"ecell":"B2"} for ecell; the room does not look inside
+	Data     json.RawMessage `json:"data,omitempty"`
+	Snapshot string          `json:"snapshot,omitempty"`
+	Log      []Message       `json:"log,omitempty"`
+	Editors  []Editor        `json:"editors,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+// Editor is an editor in a room, with the last cell it reported editing
+type Editor struct {
+	Client string          `json:"client"`
+	User   string          `json:"user"`
+	ECell  json.RawMessage `json:"ecell,omitempty"`
+}
+
+// Document is the saved state of a room: a snapshot, which is empty when
+// the spreadsheet has never been saved, the number of the last command it
+// includes, and the commands executed after it
+type Document struct {
+	Snapshot string
+	Seq      int64
+	Log      []Message
+}
+
+// LastSeq returns the number of the last command of the document
+func (d *Document) LastSeq() int64 {
+	if len(d.Log) > 0 {
+		return d.Log[len(d.Log)-1].Seq
+	}
+	return d.Seq
+}
+
+// Persister loads and saves the document of a room. A room calls one method
+// at a time.
+type Persister interface {
+	Load() (*Document, error)
+	// SaveSnapshot saves a new snapshot, which includes every command up
+	// to doc.Seq, and the commands after it
+	SaveSnapshot(doc *Document) error
+	// SaveLog saves the commands not yet in the snapshot
+	SaveLog(doc *Document) error
+}
+
+// Options tunes the rooms of a hub
+type Options struct {
+	// Editors are asked for a snapshot every SnapshotInterval while there
+	// are commands not in one, and as soon as the log holds
+	// SnapshotCommands; the log is saved every SnapshotInterval as well
+	SnapshotInterval time.Duration
+	SnapshotCommands int
+	// Validate checks the snapshots editors send
+	Validate func(snapshot string) error
+	// SendBuffer is how many messages may wait for an editor before it is
+	// dropped as too slow
+	SendBuffer int
+}
+
+// DefaultOptions returns options suitable for most servers
+func DefaultOptions() Options {
+	return Options{
+		SnapshotInterval: 30 * time.Second,
+		SnapshotCommands: 200,
+		SendBuffer:       256,
+	}
+}
+
+var (
+	// ErrUnknownType is returned for messages of a type editors may not send
+	ErrUnknownType = errors.New("unknown message type")
+	// ErrLeft is returned for messages of editors that left the room
+	ErrLeft = errors.New("editor left the room")
+)
+
+// Hub holds the rooms of the documents being edited, by key
+type Hub struct {
+	options Options
+
+	mu    sync.Mutex
+	rooms map[string]*Room
+}
+
+// NewHub returns a hub with no rooms
+func NewHub(options Options) *Hub {
+	defaults := DefaultOptions()
+	if options.SnapshotInterval <= 0 {
+		options.SnapshotInterval = defaults.SnapshotInterval
+	}
+	if options.SnapshotCommands <= 0 {
+		options.SnapshotCommands = defaults.SnapshotCommands
+	}
+	if options.SendBuffer <= 0 {
+		options.SendBuffer = defaults.SendBuffer
+	}
+	return &Hub{options: options, rooms: make(map[string]*Room)}
+}
+
+// Join adds an editor to the room of a document, opening the room with the
+// persister if it is not open yet. The editor's first message is welcome.
+func (h *Hub) Join(key, user string, persister Persister) (*Client, error) {
+	for {
+		h.mu.Lock()
+		room := h.rooms[key]
+		if room == nil {
+			room = newRoom(h, key, persister)
+			h.rooms[key] = room
+		}
+		h.mu.Unlock()
+
+		client, err := room.join(user)
+		if errors.Is(err, errRoomClosed) {
+			// The last editor just left; wait for the room to save and
+			// close, then open it again
+			<-room.done
+			continue
+		}
+		return client, err
+	}
+}
+
+// Rooms returns the number of open rooms
+func (h *Hub) Rooms() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.rooms)
+}
+
+func (h *Hub) remove(room *Room) {
+	h.mu.Lock()
+	if h.rooms[room.key] == room {
+		delete(h.rooms, room.key)
+	}
+	h.mu.Unlock()
+}
+
+var errRoomClosed = errors.New("room closed")
+
+// Room relays the messages of the editors of one document
+type Room struct {
+	hub       *Hub
+	key       string
+	persister Persister
+
+	mu      sync.Mutex
+	loaded  bool
+	loadErr error
+	closed  bool
+	done    chan struct{}
+	doc     Document
+	seq     int64
+	clients []*Client
+	// asked is the editor asked for a snapshot, until it sends one
+	asked *Client
+	// logDirty is set when the log changed since it was last saved
+	logDirty bool
+	stop     chan struct{}
+
+	// persistMu keeps saves in order
+	persistMu sync.Mutex
+}
+
+func newRoom(hub *Hub, key string, persister Persister) *Room {
+	return &Room{
+		hub:       hub,
+		key:       key,
+		persister: persister,
+		done:      make(chan struct{}),
+		stop:      make(chan struct{}),
+	}
+}
+
+// Client is an editor in a room. Messages for it arrive on Send, which is
+// closed when it leaves or is dropped for not keeping up.
+type Client struct {
+	ID   string
+	User string
+	Send <-chan Message
+
+	send chan Message
+	room *Room
+	left bool
+	// ecell is the last cell the editor reported editing
+	ecell json.RawMessage
+}
+
+func (r *Room) join(user string) (*Client, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil, errRoomClosed
+	}
+	if !r.loaded {
+		r.loaded = true
+		doc, err := r.persister.Load()
+		if err != nil {
+			r.loadErr = err
+		} else {
+			r.doc = *doc
+			r.seq = doc.LastSeq()
+			go r.run()
+		}
+	}
+	if r.loadErr != nil {
+		// Closed, so that the next editor tries loading again
+		r.closeLocked()
+		return nil, r.loadErr
+	}
+
+	send := make(chan Message, r.hub.options.SendBuffer)
+	client := &Client{ID: newClientID(), User: user, Send: send, send: send, room: r}
+
+	editors := make([]Editor, 0, len(r.clients))
+	for _, other := range r.clients {
+		editors = append(editors, Editor{Client: other.ID, User: other.User, ECell: other.ecell})
+	}
+	send <- Message{
+		Type:     TypeWelcome,
+		Seq:      r.seq,
+		Client:   client.ID,
+		User:     user,
+		Snapshot: r.doc.Snapshot,
+		Log:      append([]Message(nil), r.doc.Log...),
+		Editors:  editors,
+	}
+	r.clients = append(r.clients, client)
+	r.broadcastLocked(Message{Type: TypeJoin, Client: client.ID, User: user}, client)
+
+	// A spreadsheet never saved gets the first editor's copy
+	if r.doc.Snapshot == "" && r.asked == nil {
+		r.askLocked(client)
+	}
+	return client, nil
+}
+
+// Receive handles a message from the editor
+func (c *Client) Receive(msg Message) error {
+	r := c.room
+	switch msg.Type {
+	case TypeExecute:
+		if len(msg.Data) == 0 {
+			return errors.New("execute without data")
+		}
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if c.left {
+			return ErrLeft
+		}
+		r.seq++
+		command := Message{Type: TypeExecute, Seq: r.seq, Client: c.ID, User: c.User, Data: msg.Data}
+		r.doc.Log = append(r.doc.Log, command)
+		r.logDirty = true
+		// The editor gets its own command back, so that it knows where it
+		// falls among the others
+		r.broadcastLocked(command, nil)
+		if len(r.doc.Log) >= r.hub.options.SnapshotCommands && r.asked == nil {
+			r.askLocked(nil)
+		}
+		return nil
+
+	case TypeECell, TypeAskECell:
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if c.left {
+			return ErrLeft
+		}
+		if msg.Type == TypeECell {
+			c.ecell = msg.Data
+		}
+		r.broadcastLocked(Message{Type: msg.Type, Client: c.ID, User: c.User, Data: msg.Data}, c)
+		return nil
+
+	case TypeSnapshot:
+		return r.snapshot(c, msg)
+	}
+	return fmt.Errorf("%w: %q", ErrUnknownType, msg.Type)
+}
+
+// snapshot takes a snapshot an editor sent when asked, replacing the
+// commands it includes
+func (r *Room) snapshot(c *Client, msg Message) error {
+	r.mu.Lock()
+	if c.left {
+		r.mu.Unlock()
+		return ErrLeft
+	}
+	if r.asked != c {
+		r.mu.Unlock()
+		return errors.New("snapshot not asked for")
+	}
+	r.asked = nil
+	if msg.Seq < r.doc.Seq || msg.Seq > r.seq {
+		r.mu.Unlock()
+		return fmt.Errorf("snapshot of command %d outside the log", msg.Seq)
+	}
+	r.mu.Unlock()
+
+	if msg.Snapshot == "" {
+		return errors.New("empty snapshot")
+	}
+	if validate := r.hub.options.Validate; validate != nil {
+		if err := validate(msg.Snapshot); err != nil {
+			return fmt.Errorf("invalid snapshot: %w", err)
+		}
+	}
+
+	r.persistMu.Lock()
+	defer r.persistMu.Unlock()
+	r.mu.Lock()
+	if msg.Seq < r.doc.Seq || msg.Seq == r.doc.Seq && r.doc.Snapshot != "" {
+		// A newer snapshot was taken meanwhile
+		r.mu.Unlock()
+		return nil
+	}
+	r.doc.Snapshot = msg.Snapshot
+	r.doc.Seq = msg.Seq
+	r.doc.Log = trimLog(r.doc.Log, msg.Seq)
+	r.logDirty = false
+	doc := r.copyDocLocked()
+	r.mu.Unlock()
+
+	if err := r.persister.SaveSnapshot(doc); err != nil {
+		log.Printf("Failed to save snapshot of %s: %v", r.key, err)
+		r.mu.Lock()
+		r.logDirty = true
+		r.mu.Unlock()
+	}
+	return nil
+}
+
+// Leave removes the editor from the room. The last editor to leave closes
+// the room, saving the commands not yet in a snapshot.
+func (c *Client) Leave() {
+	r := c.room
+	r.mu.Lock()
+	if c.left {
+		r.mu.Unlock()
+		return
+	}
+	r.removeLocked(c)
+	r.mu.Unlock()
+}
+
+// removeLocked takes an editor out of the room, and closes the room if it
+// was the last one
+func (r *Room) removeLocked(c *Client) {
+	c.left = true
+	close(c.send)
+	for i, other := range r.clients {
+		if other == c {
+			r.clients = append(r.clients[:i], r.clients[i+1:]...)
+			break
+		}
+	}
+	if r.asked == c {
+		r.asked = nil
+	}
+	r.broadcastLocked(Message{Type: TypeLeave, Client: c.ID, User: c.User}, nil)
+	if len(r.clients) == 0 {
+		r.closeLocked()
+	}
+}
+
+// closeLocked stops the room and saves its log in the background; the room
+// stays in the hub until the log is saved, so that the next editor loads it
+func (r *Room) closeLocked() {
+	r.closed = true
+	close(r.stop)
+	dirty := r.logDirty && r.loadErr == nil
+	r.logDirty = false
+	doc := r.copyDocLocked()
+	go func() {
+		if dirty {
+			r.persistMu.Lock()
+			if err := r.persister.SaveLog(doc); err != nil {
+				log.Printf("Failed to save commands of %s: %v", r.key, err)
+			}
+			r.persistMu.Unlock()
+		}
+		r.hub.remove(r)
+		close(r.done)
+	}()
+}
+
+// run asks for snapshots and saves the log every SnapshotInterval until the
+// room closes
+func (r *Room) run() {
+	ticker := time.NewTicker(r.hub.options.SnapshotInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+			r.tick()
+		}
+	}
+}
+
+func (r *Room) tick() {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return
+	}
+	if r.seq > r.doc.Seq || r.doc.Snapshot == "" {
+		// Asking again, possibly another editor, in case the last one
+		// asked never answered
+		r.askLocked(nil)
+	}
+	dirty := r.logDirty
+	r.logDirty = false
+	doc := r.copyDocLocked()
+	r.mu.Unlock()
+
+	if !dirty {
+		return
+	}
+	r.persistMu.Lock()
+	defer r.persistMu.Unlock()
+	if err := r.persister.SaveLog(doc); err != nil {
+		log.Printf("Failed to save commands of %s: %v", r.key, err)
+		r.mu.Lock()
+		r.logDirty = true
+		r.mu.Unlock()
+	}
+}
+
+// askLocked asks an editor for a snapshot: the given one, or the one after
+// the editor last asked, so that an editor that does not answer is not
+// asked forever
+func (r *Room) askLocked(client *Client) {
+	if len(r.clients) == 0 && client == nil {
+		return
+	}
+	if client == nil {
+		client = r.clients[0]
+		for i, other := range r.clients {
+			if other == r.asked {
+				client = r.clients[(i+1)%len(r.clients)]
+				break
+			}
+		}
+	}
+	r.asked = client
+	r.sendLocked(client, Message{Type: TypeAskSnapshot, Seq: r.seq})
+}
+
+// broadcastLocked sends a message to every editor but except, which may be
+// nil
+func (r *Room) broadcastLocked(msg Message, except *Client) {
+	for _, client := range append([]*Client(nil), r.clients...) {
+		if client != except {
+			r.sendLocked(client, msg)
+		}
+	}
+}
+
+// sendLocked queues a message for an editor, dropping the editor when its
+// queue is full, since it would miss commands otherwise
+func (r *Room) sendLocked(client *Client, msg Message) {
+	if client.left {
+		return
+	}
+	select {
+	case client.send <- msg:
+	default:
+		log.Printf("Dropping editor %s of %s, too far behind", client.ID, r.key)
+		r.removeLocked(client)
+	}
+}
+
+func (r *Room) copyDocLocked() *Document {
+	return &Document{
+		Snapshot: r.doc.Snapshot,
+		Seq:      r.doc.Seq,
+		Log:      append([]Message(nil), r.doc.Log...),
+	}
+}
+
+// trimLog returns the commands after seq
+func trimLog(commands []Message, seq int64) []Message {
+	for i, command := range commands {
+		if command.Seq > seq {
+			return append([]Message(nil), commands[i:]...)
+		}
+	}
+	return nil
+}
+
+func newClientID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
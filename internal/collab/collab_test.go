@@ -0,0 +1,318 @@
+package collab
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryPersister keeps the document of a room in memory
+type memoryPersister struct {
+	mu        sync.Mutex
+	doc       Document
+	loadErr   error
+	snapshots int
+	logs      int
+}
+
+func (p *memoryPersister) Load() (*Document, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.loadErr != nil {
+		return nil, p.loadErr
+	}
+	doc := p.doc
+	doc.Log = append([]Message(nil), p.doc.Log...)
+	return &doc, nil
+}
+
+func (p *memoryPersister) SaveSnapshot(doc *Document) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.doc = *doc
+	p.snapshots++
+	return nil
+}
+
+func (p *memoryPersister) SaveLog(doc *Document) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.doc.Log = doc.Log
+	p.logs++
+	return nil
+}
+
+func (p *memoryPersister) saved() Document {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.doc
+}
+
+// testOptions never tick on their own; tests call tick
+func testOptions() Options {
+	return Options{SnapshotInterval: time.Hour, SnapshotCommands: 100, SendBuffer: 16}
+}
+
+func receive(t *testing.T, c *Client) Message {
+	t.Helper()
+	select {
+	case msg, ok := <-c.Send:
+		require.True(t, ok, "send channel closed")
+		return msg
+	case <-time.After(time.Second):
+		t.Fatal("no message")
+	}
+	return Message{}
+}
+
+func drain(c *Client) {
+	for {
+		select {
+		case <-c.Send:
+		default:
+			return
+		}
+	}
+}
+
+func command(cmd string) Message {
+	data, _ := json.Marshal(map[string]interface{}{"cmdtype": "scmd", "id": "sheet1", "cmdstr": cmd, "saveundo": true})
+	return Message{Type: TypeExecute, Data: data}
+}
+
+func waitClosed(t *testing.T, hub *Hub) {
+	t.Helper()
+	for i := 0; i < 100 && hub.Rooms() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, 0, hub.Rooms())
+}
+
+func TestRelayOrder(t *testing.T) {
+	hub := NewHub(testOptions())
+	persister := &memoryPersister{doc: Document{Snapshot: "base"}}
+
+	alice, err := hub.Join("doc", "alice@example.com", persister)
+	require.NoError(t, err)
+	welcome := receive(t, alice)
+	assert.Equal(t, TypeWelcome, welcome.Type)
+	assert.Equal(t, "base", welcome.Snapshot)
+	assert.Equal(t, alice.ID, welcome.Client)
+	assert.Empty(t, welcome.Editors)
+
+	bob, err := hub.Join("doc", "bob@example.com", persister)
+	require.NoError(t, err)
+	welcome = receive(t, bob)
+	require.Len(t, welcome.Editors, 1)
+	assert.Equal(t, "alice@example.com", welcome.Editors[0].User)
+	join := receive(t, alice)
+	assert.Equal(t, TypeJoin, join.Type)
+	assert.Equal(t, bob.ID, join.Client)
+
+	require.NoError(t, alice.Receive(command("set A1 value n 1")))
+	require.NoError(t, bob.Receive(command("set A2 value n 2")))
+
+	// Both editors get both commands, their own included, in one order
+	for _, c := range []*Client{alice, bob} {
+		first, second := receive(t, c), receive(t, c)
+		assert.Equal(t, int64(1), first.Seq)
+		assert.Equal(t, alice.ID, first.Client)
+		assert.Contains(t, string(first.Data), "set A1 value n 1")
+		assert.Equal(t, int64(2), second.Seq)
+		assert.Equal(t, "bob@example.com", second.User)
+	}
+
+	// Cells being edited go to the others only
+	require.NoError(t, alice.Receive(Message{Type: TypeECell, Data: json.RawMessage(`{"ecell":"B3"}`)}))
+	ecell := receive(t, bob)
+	assert.Equal(t, TypeECell, ecell.Type)
+	assert.JSONEq(t, `{"ecell":"B3"}`, string(ecell.Data))
+	assert.Empty(t, alice.Send)
+
+	err = alice.Receive(Message{Type: TypeWelcome})
+	assert.True(t, errors.Is(err, ErrUnknownType))
+	assert.Error(t, alice.Receive(Message{Type: TypeExecute}))
+
+	alice.Leave()
+	leave := receive(t, bob)
+	assert.Equal(t, TypeLeave, leave.Type)
+	assert.Equal(t, alice.ID, leave.Client)
+	assert.True(t, errors.Is(alice.Receive(command("set A3 value n 3")), ErrLeft))
+	bob.Leave()
+	waitClosed(t, hub)
+}
+
+func TestLateJoiner(t *testing.T) {
+	hub := NewHub(testOptions())
+	persister := &memoryPersister{doc: Document{Snapshot: "base"}}
+
+	alice, err := hub.Join("doc", "alice", persister)
+	require.NoError(t, err)
+	drain(alice)
+	require.NoError(t, alice.Receive(command("set A1 value n 1")))
+	require.NoError(t, alice.Receive(Message{Type: TypeECell, Data: json.RawMessage(`{"ecell":"C4"}`)}))
+
+	carol, err := hub.Join("doc", "carol", persister)
+	require.NoError(t, err)
+	welcome := receive(t, carol)
+	assert.Equal(t, "base", welcome.Snapshot)
+	assert.Equal(t, int64(1), welcome.Seq)
+	require.Len(t, welcome.Log, 1)
+	assert.Contains(t, string(welcome.Log[0].Data), "set A1 value n 1")
+	require.Len(t, welcome.Editors, 1)
+	assert.JSONEq(t, `{"ecell":"C4"}`, string(welcome.Editors[0].ECell))
+
+	alice.Leave()
+	carol.Leave()
+	waitClosed(t, hub)
+}
+
+func TestSnapshot(t *testing.T) {
+	options := testOptions()
+	options.SnapshotCommands = 2
+	options.Validate = func(snapshot string) error {
+		if snapshot == "bad" {
+			return errors.New("bad")
+		}
+		return nil
+	}
+	hub := NewHub(options)
+	persister := &memoryPersister{doc: Document{Snapshot: "base"}}
+
+	alice, err := hub.Join("doc", "alice", persister)
+	require.NoError(t, err)
+	drain(alice)
+
+	// A snapshot nobody asked for is refused
+	assert.Error(t, alice.Receive(Message{Type: TypeSnapshot, Seq: 0, Snapshot: "early"}))
+
+	require.NoError(t, alice.Receive(command("set A1 value n 1")))
+	require.NoError(t, alice.Receive(command("set A2 value n 2")))
+	receive(t, alice)
+	receive(t, alice)
+	ask := receive(t, alice)
+	assert.Equal(t, TypeAskSnapshot, ask.Type)
+	assert.Equal(t, int64(2), ask.Seq)
+
+	// Meanwhile another command arrives, which the snapshot does not hold
+	require.NoError(t, alice.Receive(command("set A3 value n 3")))
+	receive(t, alice)
+	require.NoError(t, alice.Receive(Message{Type: TypeSnapshot, Seq: 2, Snapshot: "after 2"}))
+
+	saved := persister.saved()
+	assert.Equal(t, "after 2", saved.Snapshot)
+	assert.Equal(t, int64(2), saved.Seq)
+	require.Len(t, saved.Log, 1)
+	assert.Equal(t, int64(3), saved.Log[0].Seq)
+
+	// Invalid snapshots are not saved
+	alice.room.tick()
+	ask = receive(t, alice)
+	assert.Equal(t, int64(3), ask.Seq)
+	assert.Error(t, alice.Receive(Message{Type: TypeSnapshot, Seq: 3, Snapshot: "bad"}))
+	assert.Equal(t, "after 2", persister.saved().Snapshot)
+
+	bob, err := hub.Join("doc", "bob", persister)
+	require.NoError(t, err)
+	welcome := receive(t, bob)
+	assert.Equal(t, "after 2", welcome.Snapshot)
+	assert.Len(t, welcome.Log, 1)
+
+	alice.Leave()
+	bob.Leave()
+	waitClosed(t, hub)
+	assert.Equal(t, 1, persister.snapshots)
+}
+
+func TestFirstEditorSnapshot(t *testing.T) {
+	hub := NewHub(testOptions())
+	persister := &memoryPersister{}
+
+	alice, err := hub.Join("doc", "alice", persister)
+	require.NoError(t, err)
+	assert.Equal(t, TypeWelcome, receive(t, alice).Type)
+	ask := receive(t, alice)
+	assert.Equal(t, TypeAskSnapshot, ask.Type)
+	assert.Equal(t, int64(0), ask.Seq)
+	require.NoError(t, alice.Receive(Message{Type: TypeSnapshot, Snapshot: "mine"}))
+	assert.Equal(t, "mine", persister.saved().Snapshot)
+
+	alice.Leave()
+	waitClosed(t, hub)
+}
+
+func TestReopen(t *testing.T) {
+	hub := NewHub(testOptions())
+	persister := &memoryPersister{doc: Document{Snapshot: "base", Seq: 4}}
+
+	alice, err := hub.Join("doc", "alice", persister)
+	require.NoError(t, err)
+	drain(alice)
+	require.NoError(t, alice.Receive(command("set A1 value n 1")))
+	alice.Leave()
+	waitClosed(t, hub)
+
+	// The commands not in a snapshot are kept for the next editors
+	saved := persister.saved()
+	require.Len(t, saved.Log, 1)
+	assert.Equal(t, int64(5), saved.Log[0].Seq)
+	assert.Equal(t, 1, persister.logs)
+
+	bob, err := hub.Join("doc", "bob", persister)
+	require.NoError(t, err)
+	welcome := receive(t, bob)
+	assert.Equal(t, int64(5), welcome.Seq)
+	require.Len(t, welcome.Log, 1)
+	require.NoError(t, bob.Receive(command("set A2 value n 2")))
+	assert.Equal(t, int64(6), receive(t, bob).Seq)
+	bob.Leave()
+	waitClosed(t, hub)
+}
+
+func TestLoadError(t *testing.T) {
+	hub := NewHub(testOptions())
+	persister := &memoryPersister{loadErr: errors.New("unavailable")}
+
+	_, err := hub.Join("doc", "alice", persister)
+	assert.Error(t, err)
+	waitClosed(t, hub)
+
+	persister.loadErr = nil
+	persister.doc.Snapshot = "base"
+	alice, err := hub.Join("doc", "alice", persister)
+	require.NoError(t, err)
+	assert.Equal(t, "base", receive(t, alice).Snapshot)
+	alice.Leave()
+	waitClosed(t, hub)
+}
+
+func TestSlowEditor(t *testing.T) {
+	options := testOptions()
+	options.SendBuffer = 2
+	hub := NewHub(options)
+	persister := &memoryPersister{doc: Document{Snapshot: "base"}}
+
+	alice, err := hub.Join("doc", "alice", persister)
+	require.NoError(t, err)
+	bob, err := hub.Join("doc", "bob", persister)
+	require.NoError(t, err)
+	drain(alice)
+
+	// Bob reads nothing and is dropped once his queue is full
+	for i := 0; i < 3; i++ {
+		require.NoError(t, alice.Receive(command("set A1 value n 1")))
+		drain(alice)
+	}
+	assert.True(t, errors.Is(bob.Receive(command("set A2 value n 2")), ErrLeft))
+	for range bob.Send {
+	}
+	bob.Leave()
+
+	alice.Leave()
+	waitClosed(t, hub)
+}
@@ -2,11 +2,14 @@ package config
 
 import (
 	"os"
+	"strconv"
+	"strings"
 )
 
 type Config struct {
 	Environment     string
 	Port           string
+	PublicURL      string
 	CookieSecret   string
 	AWSAccessKey   string
 	AWSSecretKey   string
@@ -28,12 +31,92 @@ type Config struct {
     MinIOSecretKey  string
     MinIOBucket     string
     MinIOSSL        string
+
+	// Login throttling
+	LoginMaxAttempts     int
+	LoginIPMaxAttempts   int
+	LoginAttemptWindow   int // minutes
+	LoginLockoutDuration int // minutes
+	LoginBaseDelay       int // seconds
+	LoginMaxDelay        int // seconds
+
+	// Password policy and hashing
+	PasswordHasher        string // bcrypt or argon2id
+	BcryptCost            int
+	PasswordMinLength     int
+	PasswordMaxLength     int
+	PasswordBlocklistFile string
+
+	// OpenID Connect sign-in providers
+	OIDCProviders []OIDCProviderConfig
+
+	// Accounts that are always administrators
+	AdminEmails []string
+
+	// Days a requested account deletion can be cancelled; 0 deletes immediately
+	AccountDeletionGraceDays int
+
+	// Days a former email address keeps resolving to the account after a change
+	EmailRedirectDays int
+
+	// Days authentication audit events are kept; 0 keeps them forever
+	AuditRetentionDays int
+
+	// Who may register: open, or invite for invite codes only
+	RegistrationMode string
+	// Email domains registration is limited to, and domains it is refused to
+	RegistrationAllowedDomains []string
+	RegistrationDeniedDomains  []string
+
+	// Largest CSV or XLSX upload accepted for import, in bytes
+	ImportMaxSize int
+
+	// Collaborative editing: seconds and commands between the snapshots
+	// editors are asked for, and the largest message accepted, in bytes
+	CollabSnapshotInterval int
+	CollabSnapshotCommands int
+	CollabMaxMessageSize   int
+
+	// Origins allowed to make cross-origin requests with credentials
+	CORSAllowedOrigins []string
+
+	// Addresses or CIDR ranges of the reverse proxies whose forwarded
+	// client IP headers are believed; requests from anywhere else are
+	// taken to come from their own address
+	TrustedProxies []string
+
+	// Where sessions are kept: memory, storage or redis
+	SessionStore  string
+	RedisAddr     string
+	RedisPassword string
+	RedisDB       int
+
+	// Session lifetime in minutes; an absolute timeout of 0 disables it
+	SessionIdleTimeout     int
+	SessionAbsoluteTimeout int
+	SessionCleanupInterval int
+
+	// Attributes of session and login cookies: Secure, and SameSite as
+	// lax, strict or none
+	CookieSecure   bool
+	CookieSameSite string
+}
+
+// OIDCProviderConfig configures a single OpenID Connect identity provider
+type OIDCProviderConfig struct {
+	Name         string
+	DisplayName  string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
 }
 
 func Load() *Config {
 	return &Config{
 		Environment:     getEnv("ENVIRONMENT", "development"),
 		Port:           getEnv("PORT", "8080"),
+		PublicURL:      getEnv("PUBLIC_URL", ""),
 		CookieSecret:   getEnv("COOKIE_SECRET", "11oETzKXQAGaYdkL5gEmGeJJFuYh7EQnp2XdTP1o/Vo="),
 		AWSAccessKey:   getEnv("AWS_ACCESS_KEY_ID", ""),
 		AWSSecretKey:   getEnv("AWS_SECRET_ACCESS_KEY", ""),
@@ -55,7 +138,76 @@ func Load() *Config {
         MinIOSecretKey: getEnv("MINIO_SECRET_KEY", "minioadmin"),
         MinIOBucket:    getEnv("MINIO_BUCKET", "touchcalc-storage"),
         MinIOSSL:       getEnv("MINIO_SSL", "false"),
+
+		LoginMaxAttempts:     getEnvInt("LOGIN_MAX_ATTEMPTS", 5),
+		LoginIPMaxAttempts:   getEnvInt("LOGIN_IP_MAX_ATTEMPTS", 20),
+		LoginAttemptWindow:   getEnvInt("LOGIN_ATTEMPT_WINDOW", 15),
+		LoginLockoutDuration: getEnvInt("LOGIN_LOCKOUT_DURATION", 15),
+		LoginBaseDelay:       getEnvInt("LOGIN_BASE_DELAY", 1),
+		LoginMaxDelay:        getEnvInt("LOGIN_MAX_DELAY", 30),
+
+		PasswordHasher:        getEnv("PASSWORD_HASHER", "bcrypt"),
+		BcryptCost:            getEnvInt("BCRYPT_COST", 10),
+		PasswordMinLength:     getEnvInt("PASSWORD_MIN_LENGTH", 8),
+		PasswordMaxLength:     getEnvInt("PASSWORD_MAX_LENGTH", 128),
+		PasswordBlocklistFile: getEnv("PASSWORD_BLOCKLIST_FILE", ""),
+
+		OIDCProviders: loadOIDCProviders(),
+
+		AdminEmails: strings.Split(getEnv("ADMIN_EMAILS", ""), ","),
+
+		AccountDeletionGraceDays: getEnvInt("ACCOUNT_DELETION_GRACE_DAYS", 14),
+		EmailRedirectDays:        getEnvInt("EMAIL_REDIRECT_DAYS", 30),
+		AuditRetentionDays:       getEnvInt("AUDIT_RETENTION_DAYS", 90),
+
+		RegistrationMode:           getEnv("REGISTRATION_MODE", "open"),
+		RegistrationAllowedDomains: strings.Split(getEnv("REGISTRATION_ALLOWED_DOMAINS", ""), ","),
+		RegistrationDeniedDomains:  strings.Split(getEnv("REGISTRATION_DENIED_DOMAINS", ""), ","),
+
+		ImportMaxSize: getEnvInt("IMPORT_MAX_SIZE", 10<<20),
+
+		CollabSnapshotInterval: getEnvInt("COLLAB_SNAPSHOT_INTERVAL", 30),
+		CollabSnapshotCommands: getEnvInt("COLLAB_SNAPSHOT_COMMANDS", 200),
+		CollabMaxMessageSize:   getEnvInt("COLLAB_MAX_MESSAGE_SIZE", 10<<20),
+
+		CORSAllowedOrigins: strings.Split(getEnv("CORS_ALLOWED_ORIGINS", ""), ","),
+		TrustedProxies:     getEnvList("TRUSTED_PROXIES", "127.0.0.1,::1"),
+
+		SessionStore:  getEnv("SESSION_STORE", "memory"),
+		RedisAddr:     getEnv("REDIS_ADDR", "localhost:6379"),
+		RedisPassword: getEnv("REDIS_PASSWORD", ""),
+		RedisDB:       getEnvInt("REDIS_DB", 0),
+
+		SessionIdleTimeout:     getEnvInt("SESSION_IDLE_TIMEOUT", 24*60),
+		SessionAbsoluteTimeout: getEnvInt("SESSION_ABSOLUTE_TIMEOUT", 7*24*60),
+		SessionCleanupInterval: getEnvInt("SESSION_CLEANUP_INTERVAL", 60),
+
+		CookieSecure:   getEnvBool("COOKIE_SECURE", strings.HasPrefix(getEnv("PUBLIC_URL", ""), "https://")),
+		CookieSameSite: getEnv("COOKIE_SAMESITE", "lax"),
+	}
+}
+
+// loadOIDCProviders reads the providers listed in OIDC_PROVIDERS, e.g.
+// OIDC_PROVIDERS=google with OIDC_GOOGLE_ISSUER, OIDC_GOOGLE_CLIENT_ID, ...
+func loadOIDCProviders() []OIDCProviderConfig {
+	var providers []OIDCProviderConfig
+	for _, name := range strings.Split(getEnv("OIDC_PROVIDERS", ""), ",") {
+		name = strings.TrimSpace(strings.ToLower(name))
+		if name == "" {
+			continue
+		}
+
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		providers = append(providers, OIDCProviderConfig{
+			Name:         name,
+			DisplayName:  getEnv(prefix+"DISPLAY_NAME", strings.ToUpper(name[:1])+name[1:]),
+			Issuer:       getEnv(prefix+"ISSUER", ""),
+			ClientID:     getEnv(prefix+"CLIENT_ID", ""),
+			ClientSecret: getEnv(prefix+"CLIENT_SECRET", ""),
+			Scopes:       strings.Fields(getEnv(prefix+"SCOPES", "openid email profile")),
+		})
 	}
+	return providers
 }
 
 func getEnv(key, defaultValue string) string {
@@ -63,4 +215,33 @@ func getEnv(key, defaultValue string) string {
 		return value
 	}
 	return defaultValue
-}
\ No newline at end of file
+}
+
+func getEnvInt(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		if n, err := strconv.Atoi(value); err == nil {
+			return n
+		}
+	}
+	return defaultValue
+}
+
+// getEnvList reads a comma-separated list, leaving out empty entries
+func getEnvList(key, defaultValue string) []string {
+	var list []string
+	for _, value := range strings.Split(getEnv(key, defaultValue), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			list = append(list, value)
+		}
+	}
+	return list
+}
+
+func getEnvBool(key string, defaultValue bool) bool {
+	if value := os.Getenv(key); value != "" {
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+	}
+	return defaultValue
+}
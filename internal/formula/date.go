@@ -0,0 +1,91 @@
+package formula
+
+import (
+	"math"
+	"time"
+
+	"github.com/c4gt/tornado-nginx-go-backend/internal/socialcalc"
+)
+
+// maxSerial is the serial date number of 9999-12-31, the last date the
+// date functions take
+const maxSerial = 2958465
+
+// now returns the current time; tests replace it
+var now = time.Now
+
+// serialOf returns the serial date number of the wall clock time of t
+func serialOf(t time.Time) float64 {
+	return socialcalc.Serial(time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.UTC))
+}
+
+// datePart returns a function of the date of a serial date number
+func datePart(name string, part func(t time.Time) int) function {
+	return typed(name, "n", 1, func(args []Value) Value {
+		serial := math.Floor(args[0].Num)
+		if serial < 0 || serial > maxSerial {
+			return errorValue(ErrNum, "")
+		}
+		return number(float64(part(socialcalc.SerialTime(serial))))
+	})
+}
+
+// timePart returns a function of the seconds of the day of a serial date
+// number
+func timePart(name string, part func(seconds int) int) function {
+	return typed(name, "n", 1, func(args []Value) Value {
+		x := args[0].Num
+		if x < 0 || x > maxSerial+1 {
+			return errorValue(ErrNum, "")
+		}
+		seconds := int(math.Round((x - math.Floor(x)) * 86400))
+		return number(float64(part(seconds % 86400)))
+	})
+}
+
+var dateFunctions = map[string]function{
+	"DATE": typed("DATE", "nnn", 3, func(args []Value) Value {
+		year, month, day := args[0].Num, args[1].Num, args[2].Num
+		if math.Abs(year) > 10000 || math.Abs(month) > 120000 || math.Abs(day) > 3650000 {
+			return errorValue(ErrNum, "")
+		}
+		t := time.Date(int(math.Floor(year)), time.Month(int(math.Floor(month))), int(math.Floor(day)), 0, 0, 0, 0, time.UTC)
+		return typedNumber("nd", socialcalc.Serial(t))
+	}),
+	"TIME": typed("TIME", "nnn", 3, func(args []Value) Value {
+		hours, minutes, seconds := math.Floor(args[0].Num), math.Floor(args[1].Num), math.Floor(args[2].Num)
+		return typedNumber("nt", (hours*3600+minutes*60+seconds)/86400)
+	}),
+	"YEAR":  datePart("YEAR", time.Time.Year),
+	"MONTH": datePart("MONTH", func(t time.Time) int { return int(t.Month()) }),
+	"DAY":   datePart("DAY", time.Time.Day),
+	"WEEKDAY": typed("WEEKDAY", "nn", 1, func(args []Value) Value {
+		serial := math.Floor(args[0].Num)
+		if serial < 0 || serial > maxSerial {
+			return errorValue(ErrNum, "")
+		}
+		day := int(socialcalc.SerialTime(serial).Weekday())
+		kind := 1
+		if len(args) == 2 {
+			kind = int(args[1].Num)
+		}
+		switch kind {
+		case 1:
+			return number(float64(day + 1))
+		case 2:
+			return number(float64((day+6)%7 + 1))
+		case 3:
+			return number(float64((day + 6) % 7))
+		}
+		return errorValue(ErrValue, "")
+	}),
+	"HOUR":   timePart("HOUR", func(s int) int { return s / 3600 }),
+	"MINUTE": timePart("MINUTE", func(s int) int { return s / 60 % 60 }),
+	"SECOND": timePart("SECOND", func(s int) int { return s % 60 }),
+	"NOW": typed("NOW", "", 0, func([]Value) Value {
+		return typedNumber("ndt", serialOf(now()))
+	}),
+	"TODAY": typed("TODAY", "", 0, func([]Value) Value {
+		return typedNumber("nd", math.Floor(serialOf(now())))
+	}),
+}
@@ -0,0 +1,251 @@
+package formula
+
+import (
+	"math"
+	"strings"
+
+	"github.com/c4gt/tornado-nginx-go-backend/internal/socialcalc"
+)
+
+// maxNameDepth limits names defined through other names
+const maxNameDepth = 32
+
+// evaluator evaluates the formulas of one sheet of a book
+type evaluator struct {
+	book  *book
+	sheet *socialcalc.Sheet
+	// names are the names being evaluated, to catch names defined
+	// through themselves
+	names []string
+	// unimplemented is set to the first function the engine does not
+	// implement that the formula called
+	unimplemented string
+}
+
+// book holds the sheets formulas may refer to, keyed by upper case name
+type book struct {
+	sheets map[string]*socialcalc.Sheet
+}
+
+// lookup returns a sheet referred to by a formula, the sheet of the formula
+// for an empty name
+func (e *evaluator) lookup(name string) *socialcalc.Sheet {
+	if name == "" {
+		return e.sheet
+	}
+	return e.book.sheets[strings.ToUpper(name)]
+}
+
+func (e *evaluator) eval(n node) Value {
+	switch n := n.(type) {
+	case *numberNode:
+		return number(n.value)
+	case *stringNode:
+		return text(n.text)
+	case *errorNode:
+		return errorValue(n.code, "")
+	case *refNode:
+		sheet := e.lookup(n.sheet)
+		if sheet == nil {
+			return errorValue(ErrRef, "Sheet unavailable: "+n.sheet)
+		}
+		return cellValue(sheet.Cell(socialcalc.Coord(n.col, n.row)))
+	case *rangeNode:
+		sheet := e.lookup(n.sheet)
+		if sheet == nil {
+			return errorValue(ErrRef, "Sheet unavailable: "+n.sheet)
+		}
+		return rangeValue(&cellRange{sheet, n.col1, n.row1, n.col2, n.row2})
+	case *nameNode:
+		return e.name(n.name)
+	case *unaryNode:
+		return e.unary(n.op, e.eval(n.x))
+	case *binaryNode:
+		return e.binary(n.op, e.eval(n.left), e.eval(n.right))
+	case *callNode:
+		return e.call(n)
+	}
+	return errorValue(ErrValue, "Error in formula")
+}
+
+// name evaluates a named range or value: its definition is a coordinate,
+// a range or a formula starting with "="
+func (e *evaluator) name(name string) Value {
+	def, ok := e.sheet.Names[name]
+	if !ok {
+		return errorValue(ErrName, "Unknown name "+name)
+	}
+	for _, evaluating := range e.names {
+		if evaluating == name {
+			return errorValue(ErrName, "Circular name reference to name "+name)
+		}
+	}
+	if len(e.names) >= maxNameDepth {
+		return errorValue(ErrName, "Circular name reference to name "+name)
+	}
+
+	n, err := parse(strings.TrimPrefix(def.Definition, "="))
+	if err != nil {
+		return errorValue(ErrName, "Unknown name "+name)
+	}
+	e.names = append(e.names, name)
+	defer func() { e.names = e.names[:len(e.names)-1] }()
+	return e.eval(n)
+}
+
+// call evaluates the arguments of a function, passing references as single
+// cell ranges so functions can tell them from values, and then calls it
+func (e *evaluator) call(n *callNode) Value {
+	fn, ok := functions[n.name]
+	if !ok {
+		if socialcalc.Functions[n.name] && e.unimplemented == "" {
+			e.unimplemented = n.name
+		}
+		return errorValue(ErrName, "Unknown function "+n.name)
+	}
+	args := make([]Value, len(n.args))
+	for i, arg := range n.args {
+		if ref, ok := arg.(*refNode); ok {
+			arg = &rangeNode{ref.sheet, ref.col, ref.row, ref.col, ref.row}
+		}
+		args[i] = e.eval(arg)
+	}
+	return checkNumber(fn(args))
+}
+
+func (e *evaluator) unary(op string, x Value) Value {
+	x = toNumber(x)
+	if x.IsError() {
+		return x
+	}
+	switch op {
+	case "-":
+		x.Num = -x.Num
+	case "%":
+		x = typedNumber("n%", x.Num/100)
+	}
+	if x.Type == "nl" {
+		x.Type = socialcalc.ValueNumber
+	}
+	return x
+}
+
+func (e *evaluator) binary(op string, left, right Value) Value {
+	switch op {
+	case "&":
+		left, right = toText(left), toText(right)
+		if left.IsError() {
+			return left
+		}
+		if right.IsError() {
+			return right
+		}
+		return text(left.Text + right.Text)
+	case "=", "<>", "<", ">", "<=", ">=":
+		return compare(op, scalar(left), scalar(right))
+	}
+
+	left, right = toNumber(left), toNumber(right)
+	if left.IsError() {
+		return left
+	}
+	if right.IsError() {
+		return right
+	}
+	var result float64
+	switch op {
+	case "+":
+		result = left.Num + right.Num
+	case "-":
+		result = left.Num - right.Num
+	case "*":
+		result = left.Num * right.Num
+	case "/":
+		if right.Num == 0 {
+			return errorValue(ErrDivZero, "")
+		}
+		result = left.Num / right.Num
+	case "^":
+		result = math.Pow(left.Num, right.Num)
+	}
+	return checkNumber(typedNumber(resultType(op, left.Type, right.Type), result))
+}
+
+// resultType returns the value type of arithmetic on two numbers, keeping
+// the subtype a plain number does not change: a date plus days is a date,
+// while the difference of two dates is a number of days
+func resultType(op, left, right string) string {
+	if left == "nl" {
+		left = socialcalc.ValueNumber
+	}
+	if right == "nl" {
+		right = socialcalc.ValueNumber
+	}
+	switch op {
+	case "+", "-":
+		switch {
+		case left == right:
+			if op == "-" && (left == "nd" || left == "ndt") {
+				return socialcalc.ValueNumber
+			}
+			return left
+		case right == socialcalc.ValueNumber:
+			return left
+		case left == socialcalc.ValueNumber && op == "+":
+			return right
+		case left == "nd" && right == "nt", op == "+" && left == "nt" && right == "nd":
+			return "ndt"
+		}
+	case "*", "/":
+		if left == "n$" && right == socialcalc.ValueNumber {
+			return left
+		}
+		if op == "*" && left == socialcalc.ValueNumber && right == "n$" {
+			return right
+		}
+	}
+	return socialcalc.ValueNumber
+}
+
+// compare compares numbers by value and anything else as case insensitive
+// text, with blanks as empty text, or zero next to a number
+func compare(op string, left, right Value) Value {
+	if left.IsError() {
+		return left
+	}
+	if right.IsError() {
+		return right
+	}
+	if left.IsBlank() && right.IsNumber() {
+		left = number(0)
+	}
+	if right.IsBlank() && left.IsNumber() {
+		right = number(0)
+	}
+
+	var c int
+	if left.IsNumber() && right.IsNumber() {
+		switch {
+		case left.Num < right.Num:
+			c = -1
+		case left.Num > right.Num:
+			c = 1
+		}
+	} else {
+		c = strings.Compare(strings.ToLower(toText(left).Text), strings.ToLower(toText(right).Text))
+	}
+
+	switch op {
+	case "=":
+		return logical(c == 0)
+	case "<>":
+		return logical(c != 0)
+	case "<":
+		return logical(c < 0)
+	case ">":
+		return logical(c > 0)
+	case "<=":
+		return logical(c <= 0)
+	}
+	return logical(c >= 0)
+}
@@ -0,0 +1,278 @@
+package formula
+
+import (
+	"math"
+)
+
+// The financial functions follow SocialCalc's formula1.js step for step,
+// iterations and their limits included, so results match the browser's to
+// the last digit. XNPV, which SocialCalc lacks, follows Excel.
+
+// Limits of the approximations of RATE and IRR
+const (
+	rateMaxLoop = 100
+	irrMaxLoop  = 20
+	// solveEpsilon is close enough to zero for RATE and IRR
+	solveEpsilon = 0.0000001
+)
+
+// paymentType returns the optional payment type argument at i: 1 for
+// payments at the beginning of periods, 0 at the end
+func paymentType(args []Value, i int) float64 {
+	if len(args) > i && args[i].Num != 0 {
+		return 1
+	}
+	return 0
+}
+
+// optional returns the optional argument at i, or def when it is missing
+func optional(args []Value, i int, def float64) float64 {
+	if len(args) > i {
+		return args[i].Num
+	}
+	return def
+}
+
+var financialFunctions = map[string]function{
+	// FV(rate, n, payment, [pv, [paytype]])
+	"FV": typed("FV", "nnnnn", 3, func(args []Value) Value {
+		rate, n, payment := args[0].Num, args[1].Num, args[2].Num
+		pv, paytype := optional(args, 3, 0), paymentType(args, 4)
+		if rate == 0 {
+			return typedNumber("n$", -pv-payment*n)
+		}
+		growth := math.Pow(1+rate, n)
+		return typedNumber("n$", -(pv*growth + payment*(1+rate*paytype)*(growth-1)/rate))
+	}),
+	// NPER(rate, payment, pv, [fv, [paytype]])
+	"NPER": typed("NPER", "nnnnn", 3, func(args []Value) Value {
+		rate, payment, pv := args[0].Num, args[1].Num, args[2].Num
+		fv, paytype := optional(args, 3, 0), paymentType(args, 4)
+		if rate == 0 {
+			if payment == 0 {
+				return errorValue(ErrNum, "")
+			}
+			return number((pv + fv) / -payment)
+		}
+		part1 := payment * (1 + rate*paytype) / rate
+		part2 := pv + part1
+		if part2 == 0 || rate <= -1 {
+			return errorValue(ErrNum, "")
+		}
+		part3 := (part1 - fv) / part2
+		if part3 <= 0 {
+			return errorValue(ErrNum, "")
+		}
+		return number(math.Log(part3) / math.Log(1+rate))
+	}),
+	// PMT(rate, n, pv, [fv, [paytype]])
+	"PMT": typed("PMT", "nnnnn", 3, func(args []Value) Value {
+		rate, n, pv := args[0].Num, args[1].Num, args[2].Num
+		fv, paytype := optional(args, 3, 0), paymentType(args, 4)
+		if n == 0 {
+			return errorValue(ErrNum, "")
+		}
+		if rate == 0 {
+			return typedNumber("n$", (fv-pv)/n)
+		}
+		growth := math.Pow(1+rate, n)
+		return typedNumber("n$", (0-fv-pv*growth)/((1+rate*paytype)*(growth-1)/rate))
+	}),
+	// PV(rate, n, payment, [fv, [paytype]])
+	"PV": typed("PV", "nnnnn", 3, func(args []Value) Value {
+		rate, n, payment := args[0].Num, args[1].Num, args[2].Num
+		fv, paytype := optional(args, 3, 0), paymentType(args, 4)
+		switch rate {
+		case -1:
+			return errorValue(ErrDivZero, "")
+		case 0:
+			return typedNumber("n$", -fv-payment*n)
+		}
+		growth := math.Pow(1+rate, n)
+		return typedNumber("n$", (-fv-payment*(1+rate*paytype)*(growth-1)/rate)/growth)
+	}),
+	// RATE(n, payment, pv, [fv, [paytype, [guess]]])
+	"RATE": typed("RATE", "nnnnnn", 3, func(args []Value) Value {
+		n, payment, pv := args[0].Num, args[1].Num, args[2].Num
+		fv, paytype := optional(args, 3, 0), paymentType(args, 4)
+		rate := optional(args, 5, 0.1)
+		if rate == 0 {
+			rate = 0.00000001
+		}
+		rate, ok := solve(rate, rateMaxLoop, func(rate float64) (float64, bool) {
+			growth := math.Pow(1+rate, n)
+			return fv + pv*growth + payment*(1+rate*paytype)*(growth-1)/rate, true
+		})
+		if !ok {
+			return errorValue(ErrNum, "")
+		}
+		return typedNumber("n%", rate)
+	}),
+	// NPV(rate, value1, value2, ...)
+	"NPV": func(args []Value) Value {
+		if len(args) < 2 {
+			return argsError("NPV")
+		}
+		rate := toNumber(args[0])
+		if rate.IsError() {
+			return rate
+		}
+		s := collect(args[1:])
+		if s.err.IsError() {
+			return s.err
+		}
+		if len(s.nums) == 0 {
+			return argsError("NPV")
+		}
+		sum, factor := 0.0, 1.0
+		for _, x := range s.nums {
+			factor *= 1 + rate.Num
+			if factor == 0 {
+				return errorValue(ErrDivZero, "")
+			}
+			sum += x / factor
+		}
+		return typedNumber("n$", sum)
+	},
+	// IRR(range, [guess])
+	"IRR": func(args []Value) Value {
+		if len(args) < 1 || len(args) > 2 {
+			return argsError("IRR")
+		}
+		s := collect(args[:1])
+		if s.err.IsError() {
+			return errorValue(ErrValue, "")
+		}
+		if len(s.nums) == 0 {
+			return errorValue(ErrNum, "")
+		}
+		guess := 0.1
+		if len(args) == 2 {
+			g := toNumber(args[1])
+			if g.IsError() {
+				return errorValue(ErrValue, "")
+			}
+			if g.Num != 0 {
+				guess = g.Num
+			}
+		}
+		rate, ok := solve(guess, irrMaxLoop, func(rate float64) (float64, bool) {
+			sum, factor := 0.0, 1.0
+			for _, x := range s.nums {
+				factor *= 1 + rate
+				if factor == 0 {
+					return 0, false
+				}
+				sum += x / factor
+			}
+			return sum, true
+		})
+		if !ok {
+			return errorValue(ErrNum, "")
+		}
+		return typedNumber("n%", rate)
+	},
+	// XNPV(rate, values, dates)
+	"XNPV": func(args []Value) Value {
+		if len(args) != 3 || !args[1].isRange() || !args[2].isRange() {
+			return argsError("XNPV")
+		}
+		rate := toNumber(args[0])
+		if rate.IsError() {
+			return rate
+		}
+		if rate.Num <= -1 {
+			return errorValue(ErrNum, "")
+		}
+		values, dates := args[1].rng, args[2].rng
+		if values.rows()*values.cols() != dates.rows()*dates.cols() {
+			return errorValue(ErrNum, "")
+		}
+		var first, sum float64
+		for i := 0; i < values.rows()*values.cols(); i++ {
+			v := values.at(i/values.cols(), i%values.cols())
+			d := dates.at(i/dates.cols(), i%dates.cols())
+			for _, x := range []Value{v, d} {
+				if x.IsError() {
+					return x
+				}
+				if !x.IsNumber() {
+					return errorValue(ErrValue, "")
+				}
+			}
+			date := math.Floor(d.Num)
+			if i == 0 {
+				first = date
+			} else if date < first {
+				return errorValue(ErrNum, "")
+			}
+			sum += v.Num / math.Pow(1+rate.Num, (date-first)/365)
+		}
+		return typedNumber("n$", sum)
+	},
+	// DDB(cost, salvage, lifetime, period, [method])
+	"DDB": typed("DDB", "nnnnn", 4, func(args []Value) Value {
+		cost, salvage, lifetime, period := args[0].Num, args[1].Num, args[2].Num, args[3].Num
+		method := optional(args, 4, 2)
+		if lifetime < 1 {
+			return errorValue(ErrNum, "DDB life must be greater than 1")
+		}
+		depreciation, accumulated := 0.0, 0.0
+		for i := 1.0; i <= period && i <= lifetime; i++ {
+			depreciation = (cost - accumulated) * (method / lifetime)
+			// Not below the salvage value
+			if cost-accumulated-depreciation < salvage {
+				depreciation = cost - accumulated - salvage
+			}
+			accumulated += depreciation
+		}
+		return typedNumber("n$", depreciation)
+	}),
+	// SLN(cost, salvage, lifetime)
+	"SLN": typed("SLN", "nnn", 3, func(args []Value) Value {
+		cost, salvage, lifetime := args[0].Num, args[1].Num, args[2].Num
+		if lifetime < 1 {
+			return errorValue(ErrNum, "SLN life must be greater than 1")
+		}
+		return typedNumber("n$", (cost-salvage)/lifetime)
+	}),
+	// SYD(cost, salvage, lifetime, period)
+	"SYD": typed("SYD", "nnnn", 4, func(args []Value) Value {
+		cost, salvage, lifetime, period := args[0].Num, args[1].Num, args[2].Num, args[3].Num
+		if lifetime < 1 || period <= 0 {
+			return errorValue(ErrNum, "")
+		}
+		sumPeriods := (lifetime + 1) * lifetime / 2
+		return typedNumber("n$", (cost-salvage)*(lifetime-period+1)/sumPeriods)
+	}),
+}
+
+// solve looks for the rate at which f is zero by the secant method, the
+// way SocialCalc's RATE and IRR do: the first step goes 10% past the
+// guess, and the search ends when f is within solveEpsilon of zero or the
+// rate stops changing. f reports false when it cannot be computed.
+func solve(rate float64, maxLoop int, f func(rate float64) (float64, bool)) (float64, bool) {
+	delta := 1.0
+	var oldRate, oldDelta float64
+	first := true
+	for tries := 0; math.Abs(delta) > solveEpsilon && (first || rate != oldRate); {
+		var ok bool
+		if delta, ok = f(rate); !ok {
+			return 0, false
+		}
+		if first {
+			oldRate, oldDelta = rate, delta
+			rate *= 1.1
+			first = false
+		} else {
+			slope := (delta - oldDelta) / (rate - oldRate)
+			oldRate, oldDelta = rate, delta
+			rate -= delta / slope
+		}
+		tries++
+		if tries >= maxLoop {
+			return 0, false
+		}
+	}
+	return rate, true
+}
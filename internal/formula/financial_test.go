@@ -0,0 +1,141 @@
+package formula
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/c4gt/tornado-nginx-go-backend/internal/socialcalc"
+)
+
+// cashflowsSave is an investment sheet as the browser saves it, with the
+// examples of the Excel documentation of the functions
+const cashflowsSave = `version:1.5
+cell:A1:v:-70000
+cell:A2:v:12000
+cell:A3:v:15000
+cell:A4:v:18000
+cell:A5:v:21000
+cell:A6:v:26000
+cell:B1:v:-10000
+cell:B2:v:2750
+cell:B3:v:4250
+cell:B4:v:3250
+cell:B5:v:2750
+cell:C1:vt:nd:39448
+cell:C2:vt:nd:39508
+cell:C3:vt:nd:39751
+cell:C4:vt:nd:39859
+cell:C5:vt:nd:39904
+cell:D1:vt:n%:0.09
+cell:D2:t:none
+cell:D3:v:3000
+cell:D4:v:4200
+cell:D5:v:6800
+`
+
+func TestFinancial(t *testing.T) {
+	sheet, err := socialcalc.ParseSheet(cashflowsSave)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		formula   string
+		valueType string
+		// value is the known result, rounded to as many decimals as given
+		value string
+	}{
+		{"PMT(0.08/12,10,10000)", "n$", "-1037.03"},
+		{"PMT(0.06/12,18*12,0,50000)", "n$", "-129.08"},
+		{"PMT(0,10,1000)", "n$", "-100"},
+		{"PMT(0.1,0,1000)", "e#NUM!", ""},
+		{"FV(0.06/12,10,-200,-500,1)", "n$", "2581.40"},
+		{"FV(0.12/12,12,-1000)", "n$", "12682.50"},
+		{"FV(0,10,-100,-500)", "n$", "1500"},
+		{"PV(0.08/12,12*20,500,0,0)", "n$", "-59777.15"},
+		{"PV(-1,10,100)", "e#DIV/0!", ""},
+		{"RATE(4*12,-200,8000)", "n%", "0.00770147"},
+		{"RATE(12,-100,1000)", "n%", "0.02922854"},
+		{"RATE(10,100,1000)", "e#NUM!", ""},
+		{"NPER(0.12/12,-100,-1000,10000,1)", "n", "59.6738657"},
+		{"NPER(0,-100,1000)", "n", "10"},
+		{"NPER(0.1,-100,1000)", "e#NUM!", ""},
+		{"NPV(0.1,B1,D3:D5)", "n$", "1188.44"},
+		{"NPV(D1,D2:D5)", "n$", "11538.20"},
+		{"NPV(-1,1)", "e#DIV/0!", ""},
+		{"IRR(A1:A5)", "n%", "-0.02124485"},
+		{"IRR(A1:A6)", "n%", "0.08663095"},
+		{"IRR(A1:A3,-0.4)", "n%", "-0.44350694"},
+		// SocialCalc gives up after 20 steps from the default guess
+		{"IRR(A1:A3)", "e#NUM!", ""},
+		{"IRR(D2:D2)", "e#NUM!", ""},
+		{"XNPV(D1,B1:B5,C1:C5)", "n$", "2086.65"},
+		{"XNPV(D1,B1:B5,C1:C4)", "e#NUM!", ""},
+		{"XNPV(D1,B1:B5,D1:D5)", "e#VALUE!", ""},
+		{"XNPV(D1,B1:B2,C1:C2)", "n$", "-7288.68"},
+		{"SLN(30000,7500,10)", "n$", "2250"},
+		{"SLN(30000,7500,0)", "e#NUM!", "SLN life must be greater than 1"},
+		{"SYD(30000,7500,10,1)", "n$", "4090.91"},
+		{"SYD(30000,7500,10,10)", "n$", "409.09"},
+		{"DDB(2400,300,10*365,1)", "n$", "1.32"},
+		{"DDB(2400,300,10*12,1,2)", "n$", "40.00"},
+		{"DDB(2400,300,10,1,2)", "n$", "480.00"},
+		{"DDB(2400,300,10,2,1.5)", "n$", "306.00"},
+		{"DDB(2400,300,10,10)", "n$", "22.12"},
+		{"DDB(2400,300,0.5,1)", "e#NUM!", "DDB life must be greater than 1"},
+		{"PMT(0.1,10)", "e#VALUE!", "Incorrect arguments to function PMT"},
+		{"PMT(0.1,\"ten\",1000)", "e#VALUE!", ""},
+	} {
+		got := evaluate(t, sheet, test.formula)
+		if got.Type != test.valueType {
+			t.Errorf("%s = %s %q, want %s %q", test.formula, got.Type, got.String(), test.valueType, test.value)
+			continue
+		}
+		if got.IsError() {
+			if test.value != "" && got.Text != test.value {
+				t.Errorf("%s = %q, want %q", test.formula, got.Text, test.value)
+			}
+			continue
+		}
+		if rounded := roundLike(got.Num, test.value); rounded != test.value {
+			t.Errorf("%s = %s (%v), want %s", test.formula, rounded, got.Num, test.value)
+		}
+	}
+}
+
+// TestFinancialRecalc checks the financial functions keep the type and value
+// of SocialCalc in stored sheets
+func TestFinancialRecalc(t *testing.T) {
+	sheet := parseSheet(t,
+		"cell:A1:vt:n%:0.05",
+		"cell:A2:v:360",
+		"cell:A3:vt:n$:250000",
+		"cell:B1:vtf:n:0:PMT(A1/12,A2,A3)",
+		"cell:B2:vtf:n:0:RATE(A2,B1,A3)*12",
+		"cell:B3:vtf:n:0:PV(A1/12,A2,B1)-A3",
+	)
+	if result := RecalcSheet(sheet); len(result.Kept) != 0 {
+		t.Errorf("kept = %v", result.Kept)
+	}
+	for coord, want := range map[string][2]string{
+		"B1": {"n$", "-1342.05"},
+		"B2": {"n", "0.0500"},
+		"B3": {"n$", "0.00"},
+	} {
+		cell := sheet.Cell(coord)
+		n, err := strconv.ParseFloat(cell.Value, 64)
+		if err != nil || cell.ValueType != want[0] || roundLike(n, want[1]) != want[1] {
+			t.Errorf("%s = %s %q, want %s %s", coord, cell.ValueType, cell.Value, want[0], want[1])
+		}
+	}
+}
+
+// roundLike formats n with as many decimals as the known result want
+func roundLike(n float64, want string) string {
+	decimals := 0
+	if i := strings.IndexByte(want, '.'); i >= 0 {
+		decimals = len(want) - i - 1
+	}
+	return strconv.FormatFloat(n, 'f', decimals, 64)
+}
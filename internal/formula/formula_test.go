@@ -0,0 +1,233 @@
+package formula
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/c4gt/tornado-nginx-go-backend/internal/socialcalc"
+)
+
+// values is a sheet of values for formulas to refer to
+const valuesSave = `version:1.5
+cell:A1:v:10
+cell:A2:v:20
+cell:A3:v:5.5
+cell:A4:t:Apple
+cell:A5:vt:nl:1
+cell:B1:vt:nd:45000
+cell:B2:vt:n$:12.5
+cell:B3:vt:e#DIV/0!:#DIV/0!
+cell:B4:t:
+cell:C1:t:apple
+cell:C2:t:banana
+cell:C3:t:cherry
+cell:D1:v:1
+cell:D2:v:2
+cell:D3:v:3
+name:RATE::A3
+name:BOTH::A1\cA2
+name:TWICE::=RATE*2
+name:LOOP::=LOOP+1
+`
+
+func evaluate(t *testing.T, sheet *socialcalc.Sheet, formula string) Value {
+	t.Helper()
+	n, err := parse(formula)
+	if err != nil {
+		t.Fatalf("parse(%q) failed: %v", formula, err)
+	}
+	e := &evaluator{book: &book{sheets: map[string]*socialcalc.Sheet{"DATA": sheet}}, sheet: sheet}
+	return result(e.eval(n))
+}
+
+func TestEvaluate(t *testing.T) {
+	sheet, err := socialcalc.ParseSheet(valuesSave)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = func() time.Time { return time.Date(2023, 3, 15, 18, 0, 0, 0, time.Local) }
+	defer func() { now = time.Now }()
+
+	for _, test := range []struct {
+		formula   string
+		valueType string
+		value     string
+	}{
+		// Operators and precedence
+		{"1+2*3", "n", "7"},
+		{"(1+2)*3", "n", "9"},
+		{"-2^2", "n", "4"},
+		{"2^3^2", "n", "64"},
+		{"10%", "n%", "0.1"},
+		{"A1/4", "n", "2.5"},
+		{"A1/0", "e#DIV/0!", "#DIV/0!"},
+		{"A1+Z99", "n", "10"},
+		{`"3"+A1`, "n", "13"},
+		{`A4+1`, "e#VALUE!", "#VALUE!"},
+		{`A1&" and "&A3`, "t", "10 and 5.5"},
+		{`A4="APPLE"`, "nl", "1"},
+		{`A1<A2`, "nl", "1"},
+		{`A1<>10`, "nl", "0"},
+		{`Z1=0`, "nl", "1"},
+		{"B1+1", "nd", "45001"},
+		{"B1-B1", "n", "0"},
+		{"B2*2", "n$", "25"},
+		{"B3+1", "e#DIV/0!", "#DIV/0!"},
+		{"#N/A", "e#N/A", "#N/A"},
+		{"0.1+0.2", "n", "0.30000000000000004"},
+		{"1E21*10", "n", "1e+22"},
+		{"1/3000000000", "n", "3.333333333333333e-10"},
+		{"Data!A2*2", "n", "40"},
+		{"Other!A1", "e#REF!", "Sheet unavailable: Other"},
+		{"A1:A2", "e#VALUE!", "Formula results in range value"},
+
+		// Names
+		{"RATE*2", "n", "11"},
+		{"SUM(BOTH)", "n", "30"},
+		{"TWICE", "n", "11"},
+		{"LOOP", "e#NAME?", "Circular name reference to name LOOP"},
+		{"NOPE", "e#NAME?", "Unknown name NOPE"},
+
+		// Math and statistics
+		{"SUM(A1:A5)", "n", "36.5"},
+		{"SUM(A1:A3,100,B3)", "e#DIV/0!", "#DIV/0!"},
+		{"SUM(B1:B2)", "n", "45012.5"},
+		{"AVERAGE(A1:A3)", "n", "11.833333333333334"},
+		{"AVERAGE(C1:C3)", "e#DIV/0!", "#DIV/0!"},
+		{"COUNT(A1:B4)", "n", "5"},
+		{"COUNTA(A1:B4)", "n", "8"},
+		{"COUNTBLANK(A1:A9)", "n", "4"},
+		{"MIN(A1:A3)", "n", "5.5"},
+		{"MAX(A1:A3,30)", "n", "30"},
+		{"PRODUCT(A1:A2)", "n", "200"},
+		{"STDEV(D1:D3)", "n", "1"},
+		{"VARP(D1:D3)", "n", "0.6666666666666666"},
+		{"ROUND(2.5)", "n", "3"},
+		{"ROUND(-2.5)", "n", "-2"},
+		{"ROUND(1234.5678,2)", "n", "1234.57"},
+		{"ROUND(1234.5678,-2)", "n", "1200"},
+		{"TRUNC(-7.89,1)", "n", "-7.8"},
+		{"INT(-7.5)", "n", "-8"},
+		{"MOD(-7,3)", "n", "2"},
+		{"MOD(1,0)", "e#DIV/0!", "#DIV/0!"},
+		{"EVEN(-1.5)", "n", "-2"},
+		{"ODD(2)", "n", "3"},
+		{"FACT(5)", "n", "120"},
+		{"LOG(8,2)", "n", "3"},
+		{"LN(0)", "e#NUM!", "LN argument must be greater than 0"},
+		{"SQRT(-1)", "e#NUM!", "Formula results in a bad numeric value"},
+		{"POWER(2,10)", "n", "1024"},
+		{"ABS()", "e#VALUE!", "Incorrect arguments to function ABS"},
+		{"SUMPRODUCT(A1:A2,D1:D2)", "n", "50"},
+		{"SUMIF(D1:D3,\">1\")", "n", "5"},
+		{"SUMIF(C1:C3,\"banana\",D1:D3)", "n", "2"},
+		{"COUNTIF(A1:A5,\"<>apple\")", "n", "4"},
+		{"COUNTIF(C1:C9,\"\")", "n", "6"},
+		{"COUNTIF(D1:D3,2)", "n", "1"},
+
+		// Logical, information and lookup
+		{"IF(A1>5,\"big\",\"small\")", "t", "big"},
+		{"IF(A1>50,1)", "nl", "0"},
+		{"IF(A1,A4)", "t", "Apple"},
+		{"AND(A1:A5)", "nl", "1"},
+		{"OR(0,FALSE())", "nl", "0"},
+		{"NOT(A5)", "nl", "0"},
+		{"ISBLANK(Z1)", "nl", "1"},
+		{"ISBLANK(B4)", "nl", "0"},
+		{"ISERR(NA())", "nl", "0"},
+		{"ISERROR(B3)", "nl", "1"},
+		{"ISNUMBER(B1)", "nl", "1"},
+		{"ISTEXT(A4)", "nl", "1"},
+		{"N(A4)", "n", "0"},
+		{"T(A4)", "t", "Apple"},
+		{"CHOOSE(2,A1,A2,A3)", "n", "20"},
+		{"ROWS(A1:B4)", "n", "4"},
+		{"COLUMNS(A1:B4)", "n", "2"},
+		{"VLOOKUP(2,D1:D3,1)", "n", "2"},
+		{"VLOOKUP(2.5,D1:D3,1)", "n", "2"},
+		{"VLOOKUP(\"BANANA\",C1:D3,2,FALSE())", "n", "2"},
+		{"VLOOKUP(\"kiwi\",C1:D3,2,FALSE())", "e#N/A", "#N/A"},
+		{"VLOOKUP(1,D1:D3,2)", "e#REF!", "#REF!"},
+		{"HLOOKUP(20,A2:D3,2,0)", "n", "5.5"},
+		{"HLOOKUP(21,A2:D3,2,0)", "e#N/A", "#N/A"},
+		{"MATCH(\"cherry\",C1:C3,0)", "n", "3"},
+		{"MATCH(2.5,D1:D3)", "n", "2"},
+		{"INDEX(C1:D3,2,2)", "n", "2"},
+		{"SUM(INDEX(C1:D3,0,2))", "n", "6"},
+
+		// Text
+		{"LEFT(A4,3)", "t", "App"},
+		{"RIGHT(A4)", "t", "e"},
+		{"MID(\"spreadsheet\",7,5)", "t", "sheet"},
+		{"LEN(\"héllo\")", "n", "5"},
+		{"FIND(\"l\",\"héllo\",4)", "n", "4"},
+		{"FIND(\"z\",\"hello\")", "e#VALUE!", "#VALUE!"},
+		{"UPPER(A4)&LOWER(A4)", "t", "APPLEapple"},
+		{"PROPER(\"the o'neil file\")", "t", "The O'Neil File"},
+		{"REPLACE(\"abcdef\",2,3,\"X\")", "t", "aXef"},
+		{"REPT(\"ab\",3)", "t", "ababab"},
+		{"SUBSTITUTE(\"a-b-c\",\"-\",\"+\")", "t", "a+b+c"},
+		{"SUBSTITUTE(\"a-b-c\",\"-\",\"+\",2)", "t", "a-b+c"},
+		{"TRIM(\"  a   b \")", "t", "a b"},
+		{"EXACT(A4,C1)", "nl", "0"},
+		{"VALUE(\"1,234.5\")", "n", "1234.5"},
+		{"VALUE(A4)", "e#VALUE!", "#VALUE!"},
+
+		// Dates and times
+		{"DATE(2023,3,15)", "nd", "45000"},
+		{"DATE(2023,14,1)", "nd", "45323"},
+		{"TIME(18,0,0)", "nt", "0.75"},
+		{"YEAR(B1)&\"-\"&MONTH(B1)&\"-\"&DAY(B1)", "t", "2023-3-15"},
+		{"WEEKDAY(B1)", "n", "4"},
+		{"WEEKDAY(B1,2)", "n", "3"},
+		{"HOUR(45000.75)+MINUTE(0.5+1/1440)", "n", "19"},
+		{"NOW()", "ndt", "45000.75"},
+		{"TODAY()", "nd", "45000"},
+
+		// Functions the engine does not know
+		{"FOO(1)", "e#NAME?", "Unknown function FOO"},
+	} {
+		got := evaluate(t, sheet, test.formula)
+		if got.Type != test.valueType || got.String() != test.value {
+			t.Errorf("%s = %s %q, want %s %q", test.formula, got.Type, got.String(), test.valueType, test.value)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for formula, want := range map[string]string{
+		"1+":        "Missing operand",
+		"(1+2":      "Missing close parenthesis",
+		"1+2)":      "Closing parenthesis without open parenthesis",
+		`"abc`:      "Improperly formed string",
+		"1e+":       "Improperly formed number exponent",
+		"1 ~ 2":     "Unexpected character in formula",
+		"SUM(1,":    "Missing operand",
+		"Data!Name": "Cell reference missing when expected",
+		"1 2":       "Error in formula",
+		"*2":        "Error in formula (two operators inappropriately in a row)",
+		"#BAD!":     "Improperly formed special value",
+	} {
+		_, err := parse(formula)
+		if err == nil || !strings.HasPrefix(err.Error(), want) {
+			t.Errorf("parse(%q) error = %v, want %q", formula, err, want)
+		}
+	}
+}
+
+func TestFormatNumber(t *testing.T) {
+	for n, want := range map[float64]string{
+		0:          "0",
+		-1.5:       "-1.5",
+		1e20:       "100000000000000000000",
+		1e21:       "1e+21",
+		0.000001:   "0.000001",
+		0.0000001:  "1e-7",
+		-1.25e-300: "-1.25e-300",
+	} {
+		if got := formatNumber(n); got != want {
+			t.Errorf("formatNumber(%v) = %q, want %q", n, got, want)
+		}
+	}
+}
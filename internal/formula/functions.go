@@ -0,0 +1,386 @@
+package formula
+
+import (
+	"math"
+	"strings"
+
+	"github.com/c4gt/tornado-nginx-go-backend/internal/socialcalc"
+)
+
+// function computes a function from its evaluated arguments. References
+// arrive as single cell ranges.
+type function func(args []Value) Value
+
+// functions are the functions the engine implements, keyed by upper case
+// name. SocialCalc functions missing here keep the value the browser last
+// computed.
+var functions = map[string]function{}
+
+func init() {
+	for _, group := range []map[string]function{
+		mathFunctions, statFunctions, textFunctions, dateFunctions,
+		logicalFunctions, infoFunctions, lookupFunctions, financialFunctions,
+	} {
+		for name, fn := range group {
+			functions[name] = fn
+		}
+	}
+}
+
+// typed checks the number of arguments of a function, between min and the
+// length of kinds, and converts them to text ('t') or numbers ('n') by
+// position before calling fn. The first argument that does not convert is
+// the result.
+func typed(name, kinds string, min int, fn func(args []Value) Value) function {
+	return func(args []Value) Value {
+		if len(args) < min || len(args) > len(kinds) {
+			return argsError(name)
+		}
+		converted := make([]Value, len(args))
+		for i, arg := range args {
+			if kinds[i] == 't' {
+				converted[i] = toText(arg)
+			} else {
+				converted[i] = toNumber(arg)
+			}
+			if converted[i].IsError() {
+				return converted[i]
+			}
+		}
+		return fn(converted)
+	}
+}
+
+// values calls fn with the values of the arguments, those of the cells of
+// ranges that are not blank included, until it returns false. inRange
+// tells values of cells from values given directly.
+func values(args []Value, fn func(v Value, inRange bool) bool) {
+	for _, arg := range args {
+		if !arg.isRange() {
+			if !fn(arg, false) {
+				return
+			}
+			continue
+		}
+		stop := false
+		arg.rng.each(func(_, _ int, v Value) bool {
+			stop = !fn(v, true)
+			return !stop
+		})
+		if stop {
+			return
+		}
+	}
+}
+
+// truth returns whether a value counts as true, or the error it converts to
+func truth(v Value) (bool, Value) {
+	v = toNumber(v)
+	if v.IsError() {
+		return false, v
+	}
+	return v.Num != 0, v
+}
+
+var logicalFunctions = map[string]function{
+	"AND": func(args []Value) Value { return logicalSeries("AND", args, true) },
+	"OR":  func(args []Value) Value { return logicalSeries("OR", args, false) },
+	"NOT": typed("NOT", "n", 1, func(args []Value) Value {
+		return logical(args[0].Num == 0)
+	}),
+	"IF": func(args []Value) Value {
+		if len(args) < 2 || len(args) > 3 {
+			return argsError("IF")
+		}
+		cond, err := truth(args[0])
+		if err.IsError() {
+			return err
+		}
+		if cond {
+			return args[1]
+		}
+		if len(args) == 3 {
+			return args[2]
+		}
+		return logical(false)
+	},
+	"TRUE":  typed("TRUE", "", 0, func([]Value) Value { return logical(true) }),
+	"FALSE": typed("FALSE", "", 0, func([]Value) Value { return logical(false) }),
+}
+
+// logicalSeries computes AND, which is true unless a value is false, and
+// OR, which is false unless a value is true. Text and blank cells of ranges
+// are skipped; without any other value the result is #VALUE!.
+func logicalSeries(name string, args []Value, and bool) Value {
+	if len(args) == 0 {
+		return argsError(name)
+	}
+	result, seen := and, false
+	var failed Value
+	values(args, func(v Value, inRange bool) bool {
+		if inRange && v.IsText() {
+			return true
+		}
+		b, err := truth(v)
+		if err.IsError() {
+			failed = err
+			return false
+		}
+		seen = true
+		if and {
+			result = result && b
+		} else {
+			result = result || b
+		}
+		return true
+	})
+	if failed.IsError() {
+		return failed
+	}
+	if !seen {
+		return argsError(name)
+	}
+	return logical(result)
+}
+
+// is returns an information function testing a single value
+func is(name string, test func(Value) bool) function {
+	return func(args []Value) Value {
+		if len(args) != 1 {
+			return argsError(name)
+		}
+		return logical(test(scalar(args[0])))
+	}
+}
+
+var infoFunctions = map[string]function{
+	"ISBLANK": is("ISBLANK", Value.IsBlank),
+	"ISERR": is("ISERR", func(v Value) bool {
+		return v.IsError() && v.Type != socialcalc.ValueError+ErrNA
+	}),
+	"ISERROR":   is("ISERROR", Value.IsError),
+	"ISLOGICAL": is("ISLOGICAL", func(v Value) bool { return v.Type == "nl" }),
+	"ISNA": is("ISNA", func(v Value) bool {
+		return v.Type == socialcalc.ValueError+ErrNA
+	}),
+	"ISNONTEXT": is("ISNONTEXT", func(v Value) bool { return !v.IsText() }),
+	"ISNUMBER":  is("ISNUMBER", Value.IsNumber),
+	"ISTEXT":    is("ISTEXT", Value.IsText),
+	"N": func(args []Value) Value {
+		if len(args) != 1 {
+			return argsError("N")
+		}
+		if v := scalar(args[0]); v.IsNumber() || v.IsError() {
+			return v
+		}
+		return number(0)
+	},
+	"T": func(args []Value) Value {
+		if len(args) != 1 {
+			return argsError("T")
+		}
+		if v := scalar(args[0]); v.IsText() || v.IsError() {
+			return v
+		}
+		return text("")
+	},
+	"NA": typed("NA", "", 0, func([]Value) Value { return errorValue(ErrNA, "") }),
+}
+
+var lookupFunctions = map[string]function{
+	"CHOOSE": func(args []Value) Value {
+		if len(args) < 2 {
+			return argsError("CHOOSE")
+		}
+		index := toNumber(args[0])
+		if index.IsError() {
+			return index
+		}
+		i := int(math.Floor(index.Num))
+		if i < 1 || i >= len(args) {
+			return errorValue(ErrValue, "")
+		}
+		return args[i]
+	},
+	"COLUMNS": func(args []Value) Value { return dimension("COLUMNS", args, (*cellRange).cols) },
+	"ROWS":    func(args []Value) Value { return dimension("ROWS", args, (*cellRange).rows) },
+	"HLOOKUP": func(args []Value) Value { return tableLookup("HLOOKUP", args, false) },
+	"VLOOKUP": func(args []Value) Value { return tableLookup("VLOOKUP", args, true) },
+	"MATCH": func(args []Value) Value {
+		if len(args) < 2 || len(args) > 3 || !args[1].isRange() {
+			return argsError("MATCH")
+		}
+		value := scalar(args[0])
+		if value.IsError() {
+			return value
+		}
+		matchType := 1.0
+		if len(args) == 3 {
+			t := toNumber(args[2])
+			if t.IsError() {
+				return t
+			}
+			matchType = t.Num
+		}
+		r := args[1].rng
+		if r.rows() != 1 && r.cols() != 1 {
+			return errorValue(ErrNA, "")
+		}
+		at := func(i int) Value { return r.at(i, 0) }
+		n := r.rows()
+		if r.rows() == 1 {
+			at = func(i int) Value { return r.at(0, i) }
+			n = r.cols()
+		}
+		found := -1
+		for i := 0; i < n; i++ {
+			c, ok := lookupCompare(at(i), value)
+			if !ok {
+				continue
+			}
+			if matchType == 0 {
+				if c == 0 {
+					found = i
+					break
+				}
+				continue
+			}
+			if matchType > 0 && c > 0 || matchType < 0 && c < 0 {
+				break
+			}
+			found = i
+		}
+		if found < 0 {
+			return errorValue(ErrNA, "")
+		}
+		return number(float64(found + 1))
+	},
+	"INDEX": func(args []Value) Value {
+		if len(args) < 1 || len(args) > 3 || !args[0].isRange() {
+			return argsError("INDEX")
+		}
+		r := args[0].rng
+		var index [2]int
+		for i, arg := range args[1:] {
+			n := toNumber(arg)
+			if n.IsError() {
+				return n
+			}
+			index[i] = int(math.Floor(n.Num))
+		}
+		row, col := index[0], index[1]
+		if len(args) == 2 && r.rows() == 1 {
+			row, col = 0, row
+		}
+		if row < 0 || row > r.rows() || col < 0 || col > r.cols() {
+			return errorValue(ErrRef, "")
+		}
+		result := *r
+		if row > 0 {
+			result.row1 = r.row1 + row - 1
+			result.row2 = result.row1
+		}
+		if col > 0 {
+			result.col1 = r.col1 + col - 1
+			result.col2 = result.col1
+		}
+		return rangeValue(&result)
+	},
+}
+
+// dimension returns the number of columns or rows of a range, 1 for a
+// single value
+func dimension(name string, args []Value, size func(*cellRange) int) Value {
+	if len(args) != 1 {
+		return argsError(name)
+	}
+	if args[0].IsError() {
+		return args[0]
+	}
+	if !args[0].isRange() {
+		return number(1)
+	}
+	return number(float64(size(args[0].rng)))
+}
+
+// lookupCompare compares a cell with the value looked up, numbers by value
+// and text without case. Other pairs do not compare.
+func lookupCompare(cell, value Value) (int, bool) {
+	switch {
+	case cell.IsNumber() && value.IsNumber():
+		switch {
+		case cell.Num < value.Num:
+			return -1, true
+		case cell.Num > value.Num:
+			return 1, true
+		}
+		return 0, true
+	case cell.IsText() && value.IsText():
+		return strings.Compare(strings.ToLower(cell.Text), strings.ToLower(value.Text)), true
+	}
+	return 0, false
+}
+
+// tableLookup finds a value in the first column (VLOOKUP) or row (HLOOKUP)
+// of a range and returns the value at the given offset from it. Unless the
+// fourth argument is false, the range is taken as sorted and the last value
+// not past the one looked up matches.
+func tableLookup(name string, args []Value, vertical bool) Value {
+	if len(args) < 3 || len(args) > 4 || !args[1].isRange() {
+		return argsError(name)
+	}
+	value := scalar(args[0])
+	if value.IsError() {
+		return value
+	}
+	offset := toNumber(args[2])
+	if offset.IsError() {
+		return offset
+	}
+	sorted := true
+	if len(args) == 4 {
+		b, err := truth(args[3])
+		if err.IsError() {
+			return err
+		}
+		sorted = b
+	}
+
+	r := args[1].rng
+	n, width := r.rows(), r.cols()
+	at := func(i, j int) Value { return r.at(i, j) }
+	if !vertical {
+		n, width = width, n
+		at = func(i, j int) Value { return r.at(j, i) }
+	}
+	index := int(math.Floor(offset.Num))
+	if index < 1 {
+		return errorValue(ErrValue, "")
+	}
+	if index > width {
+		return errorValue(ErrRef, "")
+	}
+
+	found := -1
+	for i := 0; i < n; i++ {
+		c, ok := lookupCompare(at(i, 0), value)
+		if !ok {
+			continue
+		}
+		if !sorted {
+			if c == 0 {
+				found = i
+				break
+			}
+			continue
+		}
+		if c > 0 {
+			break
+		}
+		found = i
+	}
+	if found < 0 {
+		return errorValue(ErrNA, "")
+	}
+	return at(found, index-1)
+}
@@ -0,0 +1,436 @@
+package formula
+
+import (
+	"math"
+
+	"github.com/c4gt/tornado-nginx-go-backend/internal/socialcalc"
+)
+
+// math1 returns a function of one number
+func math1(name string, fn func(float64) float64) function {
+	return typed(name, "n", 1, func(args []Value) Value {
+		return number(fn(args[0].Num))
+	})
+}
+
+// jsRound rounds half up like JavaScript's Math.round, which SocialCalc
+// uses, rather than half away from zero
+func jsRound(x float64) float64 {
+	return math.Floor(x + 0.5)
+}
+
+// decimalScale is 10 to the power of places, counted up the way SocialCalc
+// does so fractional places round up
+func decimalScale(places float64) float64 {
+	scale := 1.0
+	for i := 0.0; i < math.Abs(places); i++ {
+		scale *= 10
+	}
+	return scale
+}
+
+var mathFunctions = map[string]function{
+	"ABS":  math1("ABS", math.Abs),
+	"ACOS": math1("ACOS", math.Acos),
+	"ASIN": math1("ASIN", math.Asin),
+	"ATAN": math1("ATAN", math.Atan),
+	"ATAN2": typed("ATAN2", "nn", 2, func(args []Value) Value {
+		x, y := args[0].Num, args[1].Num
+		if x == 0 && y == 0 {
+			return errorValue(ErrDivZero, "")
+		}
+		return number(math.Atan2(y, x))
+	}),
+	"COS":     math1("COS", math.Cos),
+	"SIN":     math1("SIN", math.Sin),
+	"TAN":     math1("TAN", math.Tan),
+	"DEGREES": math1("DEGREES", func(x float64) float64 { return x * 180 / math.Pi }),
+	"RADIANS": math1("RADIANS", func(x float64) float64 { return x * math.Pi / 180 }),
+	"EVEN": math1("EVEN", func(x float64) float64 {
+		n := math.Ceil(math.Abs(x))
+		if math.Mod(n, 2) != 0 {
+			n++
+		}
+		return math.Copysign(n, x)
+	}),
+	"ODD": math1("ODD", func(x float64) float64 {
+		n := math.Ceil(math.Abs(x))
+		if math.Mod(n, 2) == 0 {
+			n++
+		}
+		return math.Copysign(n, x)
+	}),
+	"EXP": math1("EXP", math.Exp),
+	"FACT": typed("FACT", "n", 1, func(args []Value) Value {
+		n := math.Floor(args[0].Num)
+		if n < 0 {
+			return errorValue(ErrNum, "")
+		}
+		result := 1.0
+		for ; n > 1 && !math.IsInf(result, 0); n-- {
+			result *= n
+		}
+		return number(result)
+	}),
+	"INT": math1("INT", math.Floor),
+	"LN": typed("LN", "n", 1, func(args []Value) Value {
+		if args[0].Num <= 0 {
+			return errorValue(ErrNum, "LN argument must be greater than 0")
+		}
+		return number(math.Log(args[0].Num))
+	}),
+	"LOG": typed("LOG", "nn", 1, func(args []Value) Value {
+		if args[0].Num <= 0 {
+			return errorValue(ErrNum, "LOG first argument must be greater than 0")
+		}
+		if len(args) == 1 {
+			return number(math.Log10(args[0].Num))
+		}
+		if args[1].Num <= 0 {
+			return errorValue(ErrNum, "LOG second argument must be numeric greater than 0")
+		}
+		return number(math.Log(args[0].Num) / math.Log(args[1].Num))
+	}),
+	"LOG10": typed("LOG10", "n", 1, func(args []Value) Value {
+		if args[0].Num <= 0 {
+			return errorValue(ErrNum, "LOG10 argument must be greater than 0")
+		}
+		return number(math.Log10(args[0].Num))
+	}),
+	"MOD": typed("MOD", "nn", 2, func(args []Value) Value {
+		a, b := args[0].Num, args[1].Num
+		if b == 0 {
+			return errorValue(ErrDivZero, "")
+		}
+		return number(a - b*math.Floor(a/b))
+	}),
+	"PI": typed("PI", "", 0, func([]Value) Value { return number(math.Pi) }),
+	"POWER": typed("POWER", "nn", 2, func(args []Value) Value {
+		return number(math.Pow(args[0].Num, args[1].Num))
+	}),
+	"ROUND": typed("ROUND", "nn", 1, func(args []Value) Value {
+		x, places := args[0].Num, 0.0
+		if len(args) == 2 {
+			places = args[1].Num
+		}
+		scale := decimalScale(places)
+		if places >= 0 {
+			return number(jsRound(x*scale) / scale)
+		}
+		return number(jsRound(x/scale) * scale)
+	}),
+	"SQRT": math1("SQRT", math.Sqrt),
+	"TRUNC": typed("TRUNC", "nn", 1, func(args []Value) Value {
+		x, places := args[0].Num, 0.0
+		if len(args) == 2 {
+			places = args[1].Num
+		}
+		scale := decimalScale(places)
+		if places >= 0 {
+			return number(math.Trunc(x*scale) / scale)
+		}
+		return number(math.Trunc(x/scale) * scale)
+	}),
+	"SUMPRODUCT": sumProduct,
+}
+
+// series is what the statistical functions take from their arguments:
+// numbers given directly and the numbers of ranges, with the counts of the
+// values they skip
+type series struct {
+	nums []float64
+	// valueType is the type of the sum, such as "n$" for amounts
+	valueType string
+	// nonBlank counts every value, numbers, text and errors
+	nonBlank int
+	// blank counts the blank cells of ranges
+	blank int
+	// err is the first error value
+	err Value
+}
+
+func collect(args []Value) *series {
+	s := &series{valueType: socialcalc.ValueNumber}
+	for _, arg := range args {
+		if arg.isRange() {
+			s.blank += arg.rng.rows() * arg.rng.cols()
+		}
+	}
+	values(args, func(v Value, inRange bool) bool {
+		if inRange {
+			s.blank--
+		}
+		if v.IsBlank() {
+			return true
+		}
+		s.nonBlank++
+		switch {
+		case v.IsError():
+			if !s.err.IsError() {
+				s.err = v
+			}
+		case v.IsNumber():
+			if len(s.nums) == 0 {
+				s.valueType = v.Type
+			} else {
+				s.valueType = resultType("+", s.valueType, v.Type)
+			}
+			s.nums = append(s.nums, v.Num)
+		}
+		return true
+	})
+	return s
+}
+
+// variance returns the variance of the numbers, of a sample unless
+// population is set, with the running method SocialCalc uses
+func (s *series) variance(population bool) (float64, bool) {
+	n := float64(len(s.nums))
+	if n == 0 || !population && n == 1 {
+		return 0, false
+	}
+	mean, sum := 0.0, 0.0
+	for i, x := range s.nums {
+		next := mean + (x-mean)/float64(i+1)
+		sum += (x - mean) * (x - next)
+		mean = next
+	}
+	if population {
+		return sum / n, true
+	}
+	return sum / (n - 1), true
+}
+
+// statistical returns a function of the series of its arguments, which is
+// an error when one of the values is
+func statistical(name string, fn func(s *series) Value) function {
+	return func(args []Value) Value {
+		if len(args) == 0 {
+			return argsError(name)
+		}
+		s := collect(args)
+		if s.err.IsError() {
+			return s.err
+		}
+		return fn(s)
+	}
+}
+
+// counting returns a counting function, which errors do not stop
+func counting(name string, fn func(s *series) int) function {
+	return func(args []Value) Value {
+		if len(args) == 0 {
+			return argsError(name)
+		}
+		return number(float64(fn(collect(args))))
+	}
+}
+
+func deviation(population, sqrt bool) func(s *series) Value {
+	return func(s *series) Value {
+		v, ok := s.variance(population)
+		if !ok {
+			return errorValue(ErrDivZero, "")
+		}
+		if sqrt {
+			v = math.Sqrt(v)
+		}
+		return number(v)
+	}
+}
+
+var statFunctions = map[string]function{
+	"SUM": statistical("SUM", func(s *series) Value {
+		sum := 0.0
+		for _, x := range s.nums {
+			sum += x
+		}
+		return typedNumber(s.valueType, sum)
+	}),
+	"PRODUCT": statistical("PRODUCT", func(s *series) Value {
+		if len(s.nums) == 0 {
+			return number(0)
+		}
+		product := 1.0
+		for _, x := range s.nums {
+			product *= x
+		}
+		return number(product)
+	}),
+	"MIN": statistical("MIN", func(s *series) Value {
+		if len(s.nums) == 0 {
+			return number(0)
+		}
+		m := s.nums[0]
+		for _, x := range s.nums[1:] {
+			m = math.Min(m, x)
+		}
+		return typedNumber(s.valueType, m)
+	}),
+	"MAX": statistical("MAX", func(s *series) Value {
+		if len(s.nums) == 0 {
+			return number(0)
+		}
+		m := s.nums[0]
+		for _, x := range s.nums[1:] {
+			m = math.Max(m, x)
+		}
+		return typedNumber(s.valueType, m)
+	}),
+	"AVERAGE": statistical("AVERAGE", func(s *series) Value {
+		if len(s.nums) == 0 {
+			return errorValue(ErrDivZero, "")
+		}
+		sum := 0.0
+		for _, x := range s.nums {
+			sum += x
+		}
+		return typedNumber(s.valueType, sum/float64(len(s.nums)))
+	}),
+	"COUNT":      counting("COUNT", func(s *series) int { return len(s.nums) }),
+	"COUNTA":     counting("COUNTA", func(s *series) int { return s.nonBlank }),
+	"COUNTBLANK": counting("COUNTBLANK", func(s *series) int { return s.blank }),
+	"STDEV":      statistical("STDEV", deviation(false, true)),
+	"STDEVP":     statistical("STDEVP", deviation(true, true)),
+	"VAR":        statistical("VAR", deviation(false, false)),
+	"VARP":       statistical("VARP", deviation(true, false)),
+	"COUNTIF": func(args []Value) Value {
+		if len(args) != 2 || !args[0].isRange() {
+			return argsError("COUNTIF")
+		}
+		test, err := criteria(args[1])
+		if err.IsError() {
+			return err
+		}
+		r := args[0].rng
+		count, nonBlank := 0, 0
+		r.each(func(_, _ int, v Value) bool {
+			nonBlank++
+			if test(v) {
+				count++
+			}
+			return true
+		})
+		if test(Value{Type: socialcalc.ValueBlank}) {
+			count += r.rows()*r.cols() - nonBlank
+		}
+		return number(float64(count))
+	},
+	"SUMIF": func(args []Value) Value {
+		if len(args) < 2 || len(args) > 3 || !args[0].isRange() {
+			return argsError("SUMIF")
+		}
+		test, err := criteria(args[1])
+		if err.IsError() {
+			return err
+		}
+		sums := args[0].rng
+		if len(args) == 3 {
+			if !args[2].isRange() {
+				return argsError("SUMIF")
+			}
+			sums = args[2].rng
+		}
+		visit := args[0].rng.each
+		if test(Value{Type: socialcalc.ValueBlank}) {
+			visit = args[0].rng.all
+		}
+		s := &series{valueType: socialcalc.ValueNumber}
+		visit(func(row, col int, v Value) bool {
+			if !test(v) {
+				return true
+			}
+			if sum := sums.at(row, col); sum.IsNumber() {
+				s.nums = append(s.nums, sum.Num)
+			} else if sum.IsError() {
+				s.err = sum
+				return false
+			}
+			return true
+		})
+		if s.err.IsError() {
+			return s.err
+		}
+		total := 0.0
+		for _, x := range s.nums {
+			total += x
+		}
+		return number(total)
+	},
+}
+
+// sumProduct multiplies the values at the same place of ranges of one size
+// and adds up the products; values that are not numbers count as zero
+func sumProduct(args []Value) Value {
+	if len(args) == 0 {
+		return argsError("SUMPRODUCT")
+	}
+	for _, arg := range args {
+		if arg.IsError() {
+			return arg
+		}
+		if !arg.isRange() || arg.rng.rows() != args[0].rng.rows() || arg.rng.cols() != args[0].rng.cols() {
+			return argsError("SUMPRODUCT")
+		}
+	}
+	sum := 0.0
+	first := args[0].rng
+	for row := 0; row < first.rows(); row++ {
+		for col := 0; col < first.cols(); col++ {
+			product := 1.0
+			for _, arg := range args {
+				v := arg.rng.at(row, col)
+				if v.IsError() {
+					return v
+				}
+				if !v.IsNumber() {
+					product = 0
+					break
+				}
+				product *= v.Num
+			}
+			sum += product
+		}
+	}
+	return number(sum)
+}
+
+// criteria returns the test of COUNTIF and SUMIF criteria: a value cells
+// must equal, or a comparison such as ">25" or "<>done". Numbers compare
+// with numbers and text with text, without case.
+func criteria(arg Value) (func(Value) bool, Value) {
+	c := scalar(arg)
+	if c.IsError() {
+		return nil, c
+	}
+	op, target := "=", c
+	if !c.IsNumber() {
+		s := toText(c).Text
+		for _, prefix := range []string{"<=", ">=", "<>", "<", ">", "="} {
+			if len(s) >= len(prefix) && s[:len(prefix)] == prefix {
+				op, s = prefix, s[len(prefix):]
+				break
+			}
+		}
+		target = text(s)
+		if cell := socialcalc.InputCell(s); cell != nil {
+			if n, ok := cell.Number(); ok {
+				target = number(n)
+			}
+		}
+	}
+
+	return func(v Value) bool {
+		if v.IsError() {
+			return false
+		}
+		if target.IsNumber() && !v.IsNumber() || !target.IsNumber() && v.IsNumber() {
+			return op == "<>"
+		}
+		if target.IsText() && target.Text == "" && (op == "=" || op == "<>") {
+			empty := v.IsBlank() || v.IsText() && v.Text == ""
+			return empty == (op == "=")
+		}
+		return compare(op, v, target).Num != 0
+	}, Value{}
+}
@@ -0,0 +1,383 @@
+package formula
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/c4gt/tornado-nginx-go-backend/internal/socialcalc"
+)
+
+// SyntaxError is a formula that does not parse
+type SyntaxError struct {
+	Pos int
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("%s at position %d", e.Msg, e.Pos+1)
+}
+
+type tokenKind int
+
+const (
+	tokenEnd tokenKind = iota
+	tokenNumber
+	tokenString
+	tokenName
+	tokenError
+	tokenOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// coordPattern matches cell coordinates, which may be absolute
+var coordPattern = regexp.MustCompile(`^\$?[A-Za-z]{1,2}\$?[0-9]+$`)
+
+// tokenize splits a formula into tokens. Names take letters, digits, "_",
+// "." and "$", so they hold coordinates as well as function and sheet names.
+func tokenize(formula string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(formula); {
+		ch := formula[i]
+		start := i
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r':
+			i++
+			continue
+		case isDigit(ch) || ch == '.' && i+1 < len(formula) && isDigit(formula[i+1]):
+			for i < len(formula) && (isDigit(formula[i]) || formula[i] == '.') {
+				i++
+			}
+			if i < len(formula) && (formula[i] == 'e' || formula[i] == 'E') {
+				i++
+				if i < len(formula) && (formula[i] == '+' || formula[i] == '-') {
+					i++
+				}
+				if i == len(formula) || !isDigit(formula[i]) {
+					return nil, &SyntaxError{start, "Improperly formed number exponent"}
+				}
+				for i < len(formula) && isDigit(formula[i]) {
+					i++
+				}
+			}
+			tokens = append(tokens, token{tokenNumber, formula[start:i], start})
+			continue
+		case isNameChar(ch):
+			for i < len(formula) && isNameChar(formula[i]) {
+				i++
+			}
+			tokens = append(tokens, token{tokenName, formula[start:i], start})
+			continue
+		case ch == '"':
+			var s strings.Builder
+			for i++; ; i++ {
+				if i == len(formula) {
+					return nil, &SyntaxError{start, "Improperly formed string"}
+				}
+				if formula[i] == '"' {
+					if i+1 < len(formula) && formula[i+1] == '"' {
+						i++
+					} else {
+						break
+					}
+				}
+				s.WriteByte(formula[i])
+			}
+			i++
+			tokens = append(tokens, token{tokenString, s.String(), start})
+			continue
+		case ch == '#':
+			code := ""
+			for _, c := range errorCodes {
+				if strings.HasPrefix(strings.ToUpper(formula[i:]), c) {
+					code = c
+				}
+			}
+			if code == "" {
+				return nil, &SyntaxError{start, "Improperly formed special value"}
+			}
+			i += len(code)
+			tokens = append(tokens, token{tokenError, code, start})
+			continue
+		}
+
+		if i+1 < len(formula) {
+			if op := formula[i : i+2]; op == "<>" || op == "<=" || op == ">=" {
+				tokens = append(tokens, token{tokenOp, op, start})
+				i += 2
+				continue
+			}
+		}
+		if !strings.ContainsRune("+-*/^&=<>%:!(),", rune(ch)) {
+			return nil, &SyntaxError{start, "Unexpected character in formula"}
+		}
+		tokens = append(tokens, token{tokenOp, string(ch), start})
+		i++
+	}
+	return append(tokens, token{tokenEnd, "", len(formula)}), nil
+}
+
+func isDigit(ch byte) bool {
+	return ch >= '0' && ch <= '9'
+}
+
+func isNameChar(ch byte) bool {
+	return ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || isDigit(ch) || ch == '_' || ch == '.' || ch == '$'
+}
+
+// node is a parsed formula or part of one
+type node interface{}
+
+type numberNode struct{ value float64 }
+
+type stringNode struct{ text string }
+
+type errorNode struct{ code string }
+
+// refNode is a cell reference; sheet is empty for the sheet of the formula
+type refNode struct {
+	sheet    string
+	col, row int
+}
+
+type rangeNode struct {
+	sheet      string
+	col1, row1 int
+	col2, row2 int
+}
+
+// nameNode is a named range or value of the sheet
+type nameNode struct{ name string }
+
+type unaryNode struct {
+	op string
+	x  node
+}
+
+type binaryNode struct {
+	op          string
+	left, right node
+}
+
+type callNode struct {
+	name string
+	args []node
+}
+
+// parser parses a formula by precedence, from comparisons, the loosest,
+// to concatenation, addition, multiplication, powers, signs and percent.
+// As in SocialCalc and Excel, signs bind tighter than powers: -2^2 is 4.
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// parse parses a formula, which is written without its leading "="
+func parse(formula string) (node, error) {
+	tokens, err := tokenize(formula)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	n, err := p.comparison()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEnd {
+		if t.text == ")" {
+			return nil, &SyntaxError{t.pos, "Closing parenthesis without open parenthesis"}
+		}
+		return nil, &SyntaxError{t.pos, "Error in formula"}
+	}
+	return n, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEnd {
+		p.pos++
+	}
+	return t
+}
+
+// isOp reports whether the next token is one of the operators
+func (p *parser) isOp(ops ...string) bool {
+	t := p.peek()
+	if t.kind != tokenOp {
+		return false
+	}
+	for _, op := range ops {
+		if t.text == op {
+			return true
+		}
+	}
+	return false
+}
+
+// binary parses operands of the given operators, left to right
+func (p *parser) binary(operand func() (node, error), ops ...string) (node, error) {
+	left, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp(ops...) {
+		op := p.next().text
+		right, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op, left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) comparison() (node, error) {
+	return p.binary(p.concat, "=", "<>", "<", ">", "<=", ">=")
+}
+
+func (p *parser) concat() (node, error) {
+	return p.binary(p.additive, "&")
+}
+
+func (p *parser) additive() (node, error) {
+	return p.binary(p.term, "+", "-")
+}
+
+func (p *parser) term() (node, error) {
+	return p.binary(p.power, "*", "/")
+}
+
+func (p *parser) power() (node, error) {
+	return p.binary(p.unary, "^")
+}
+
+func (p *parser) unary() (node, error) {
+	if p.isOp("-", "+") {
+		op := p.next().text
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{op, x}, nil
+	}
+	x, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("%") {
+		p.next()
+		x = &unaryNode{"%", x}
+	}
+	return x, nil
+}
+
+func (p *parser) primary() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenNumber:
+		n, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, &SyntaxError{t.pos, "Improperly formed number"}
+		}
+		return &numberNode{n}, nil
+	case tokenError:
+		return &errorNode{t.text}, nil
+	case tokenString:
+		if p.isOp("!") {
+			p.next()
+			return p.reference(t.text)
+		}
+		return &stringNode{t.text}, nil
+	case tokenName:
+		switch {
+		case p.isOp("("):
+			p.next()
+			return p.call(strings.ToUpper(t.text))
+		case p.isOp("!"):
+			p.next()
+			return p.reference(t.text)
+		case coordPattern.MatchString(t.text):
+			p.pos--
+			return p.reference("")
+		}
+		return &nameNode{strings.ToUpper(t.text)}, nil
+	case tokenOp:
+		if t.text == "(" {
+			x, err := p.comparison()
+			if err != nil {
+				return nil, err
+			}
+			if !p.isOp(")") {
+				return nil, &SyntaxError{p.peek().pos, "Missing close parenthesis"}
+			}
+			p.next()
+			return x, nil
+		}
+		if t.text == ")" {
+			return nil, &SyntaxError{t.pos, "Closing parenthesis without open parenthesis"}
+		}
+		return nil, &SyntaxError{t.pos, "Error in formula (two operators inappropriately in a row)"}
+	}
+	return nil, &SyntaxError{t.pos, "Missing operand"}
+}
+
+// reference parses a cell or range reference, after the sheet name
+// followed by "!" when there is one
+func (p *parser) reference(sheet string) (node, error) {
+	t := p.next()
+	if t.kind != tokenName || !coordPattern.MatchString(t.text) {
+		return nil, &SyntaxError{t.pos, "Cell reference missing when expected"}
+	}
+	col, row, err := socialcalc.ParseCoord(t.text)
+	if err != nil {
+		return nil, &SyntaxError{t.pos, "Invalid cell reference"}
+	}
+	if !p.isOp(":") {
+		return &refNode{sheet, col, row}, nil
+	}
+	p.next()
+	t = p.next()
+	if t.kind != tokenName || !coordPattern.MatchString(t.text) {
+		return nil, &SyntaxError{t.pos, "Cell reference missing when expected"}
+	}
+	col2, row2, err := socialcalc.ParseCoord(t.text)
+	if err != nil {
+		return nil, &SyntaxError{t.pos, "Invalid cell reference"}
+	}
+	return &rangeNode{sheet, min(col, col2), min(row, row2), max(col, col2), max(row, row2)}, nil
+}
+
+// call parses the arguments of a function, after its opening parenthesis
+func (p *parser) call(name string) (node, error) {
+	n := &callNode{name: name}
+	if p.isOp(")") {
+		p.next()
+		return n, nil
+	}
+	for {
+		arg, err := p.comparison()
+		if err != nil {
+			return nil, err
+		}
+		n.args = append(n.args, arg)
+		if p.isOp(",") {
+			p.next()
+			continue
+		}
+		if !p.isOp(")") {
+			return nil, &SyntaxError{p.peek().pos, "Missing close parenthesis"}
+		}
+		p.next()
+		return n, nil
+	}
+}
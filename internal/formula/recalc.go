@@ -0,0 +1,289 @@
+package formula
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/c4gt/tornado-nginx-go-backend/internal/socialcalc"
+)
+
+// Result reports the formulas a recalculation could not compute. Cells are
+// named by coordinate, preceded by the sheet name and "!" in workbooks.
+type Result struct {
+	// Circular lists the cells of circular references, which become
+	// #REF! errors
+	Circular []string
+	// Kept lists the cells that keep their saved value because their
+	// formula calls a SocialCalc function the engine does not implement
+	Kept []string
+}
+
+// formulaCell is a formula cell being recalculated
+type formulaCell struct {
+	sheet  *socialcalc.Sheet
+	label  string
+	coord  string
+	col    int
+	row    int
+	cell   *socialcalc.Cell
+	parsed node
+	err    error
+	deps   []*formulaCell
+
+	// index and low are the numbers of Tarjan's algorithm, which orders
+	// the cells and finds the circular references in one pass
+	index, low int
+	onStack    bool
+}
+
+type position struct{ col, row int }
+
+// recalculation recalculates the formulas of a book
+type recalculation struct {
+	book    *book
+	cells   map[*socialcalc.Sheet]map[position]*formulaCell
+	bySheet map[*socialcalc.Sheet][]*formulaCell
+	order   []*formulaCell
+	result  *Result
+
+	index int
+	stack []*formulaCell
+}
+
+// Recalc recalculates every formula of a workbook in dependency order,
+// updating the values of the cells. Formulas may refer to the other sheets
+// of the workbook.
+func Recalc(w *socialcalc.Workbook) *Result {
+	b := &book{sheets: make(map[string]*socialcalc.Sheet)}
+	var sheets []*socialcalc.Sheet
+	var prefixes []string
+	for _, sheet := range w.Sheets {
+		b.sheets[strings.ToUpper(sheet.Name)] = sheet.Doc.Sheet
+		sheets = append(sheets, sheet.Doc.Sheet)
+		prefixes = append(prefixes, sheet.Name+"!")
+	}
+	return b.recalc(sheets, prefixes)
+}
+
+// RecalcSheet recalculates the formulas of a sheet on its own, where
+// references to other sheets are #REF! errors
+func RecalcSheet(sheet *socialcalc.Sheet) *Result {
+	b := &book{sheets: make(map[string]*socialcalc.Sheet)}
+	return b.recalc([]*socialcalc.Sheet{sheet}, []string{""})
+}
+
+func (b *book) recalc(sheets []*socialcalc.Sheet, prefixes []string) *Result {
+	r := &recalculation{
+		book:    b,
+		cells:   make(map[*socialcalc.Sheet]map[position]*formulaCell),
+		bySheet: make(map[*socialcalc.Sheet][]*formulaCell),
+		result:  &Result{},
+	}
+	for i, sheet := range sheets {
+		sheet.Attribs.CircularReferenceCell = ""
+		r.cells[sheet] = make(map[position]*formulaCell)
+		for coord, cell := range sheet.Cells {
+			if !cell.IsFormula() {
+				continue
+			}
+			col, row, err := socialcalc.ParseCoord(coord)
+			if err != nil {
+				continue
+			}
+			fc := &formulaCell{sheet: sheet, label: prefixes[i] + coord, coord: coord, col: col, row: row, cell: cell}
+			fc.parsed, fc.err = parse(cell.Formula)
+			r.cells[sheet][position{col, row}] = fc
+			r.bySheet[sheet] = append(r.bySheet[sheet], fc)
+		}
+		list := r.bySheet[sheet]
+		sort.Slice(list, func(i, j int) bool {
+			if list[i].row != list[j].row {
+				return list[i].row < list[j].row
+			}
+			return list[i].col < list[j].col
+		})
+		r.order = append(r.order, list...)
+	}
+
+	for _, fc := range r.order {
+		if fc.err == nil {
+			r.dependencies(fc, fc.sheet, fc.parsed, nil)
+		}
+	}
+	for _, fc := range r.order {
+		if fc.index == 0 {
+			r.visit(fc)
+		}
+	}
+	for _, sheet := range sheets {
+		sheet.Attribs.NeedsRecalc = ""
+	}
+	return r.result
+}
+
+// dependencies adds the formula cells a parsed formula refers to, through
+// names too, to the dependencies of fc
+func (r *recalculation) dependencies(fc *formulaCell, sheet *socialcalc.Sheet, n node, names []string) {
+	lookup := func(name string) *socialcalc.Sheet {
+		if name == "" {
+			return sheet
+		}
+		return r.book.sheets[strings.ToUpper(name)]
+	}
+
+	switch n := n.(type) {
+	case *refNode:
+		if dep := r.cells[lookup(n.sheet)][position{n.col, n.row}]; dep != nil {
+			fc.deps = append(fc.deps, dep)
+		}
+	case *rangeNode:
+		target := lookup(n.sheet)
+		if target == nil {
+			return
+		}
+		// Walk whichever is smaller, the range or the formulas of its sheet
+		cells := r.bySheet[target]
+		if (n.col2-n.col1+1)*(n.row2-n.row1+1) <= len(cells) {
+			for row := n.row1; row <= n.row2; row++ {
+				for col := n.col1; col <= n.col2; col++ {
+					if dep := r.cells[target][position{col, row}]; dep != nil {
+						fc.deps = append(fc.deps, dep)
+					}
+				}
+			}
+			return
+		}
+		for _, dep := range cells {
+			if dep.col >= n.col1 && dep.col <= n.col2 && dep.row >= n.row1 && dep.row <= n.row2 {
+				fc.deps = append(fc.deps, dep)
+			}
+		}
+	case *nameNode:
+		def, ok := sheet.Names[n.name]
+		if !ok || len(names) >= maxNameDepth {
+			return
+		}
+		for _, seen := range names {
+			if seen == n.name {
+				return
+			}
+		}
+		if parsed, err := parse(strings.TrimPrefix(def.Definition, "=")); err == nil {
+			r.dependencies(fc, sheet, parsed, append(names, n.name))
+		}
+	case *unaryNode:
+		r.dependencies(fc, sheet, n.x, names)
+	case *binaryNode:
+		r.dependencies(fc, sheet, n.left, names)
+		r.dependencies(fc, sheet, n.right, names)
+	case *callNode:
+		for _, arg := range n.args {
+			r.dependencies(fc, sheet, arg, names)
+		}
+	}
+}
+
+// visit runs Tarjan's strongly connected components algorithm from a cell.
+// Components complete dependencies first, so each is evaluated as soon as
+// it is found; a component of several cells, or of a cell referring to
+// itself, is a circular reference.
+func (r *recalculation) visit(fc *formulaCell) {
+	r.index++
+	fc.index, fc.low = r.index, r.index
+	r.stack = append(r.stack, fc)
+	fc.onStack = true
+	for _, dep := range fc.deps {
+		if dep.index == 0 {
+			r.visit(dep)
+			fc.low = min(fc.low, dep.low)
+		} else if dep.onStack {
+			fc.low = min(fc.low, dep.index)
+		}
+	}
+	if fc.low != fc.index {
+		return
+	}
+
+	var component []*formulaCell
+	for {
+		top := r.stack[len(r.stack)-1]
+		r.stack = r.stack[:len(r.stack)-1]
+		top.onStack = false
+		component = append(component, top)
+		if top == fc {
+			break
+		}
+	}
+	if len(component) == 1 && !dependsOn(fc, fc) {
+		r.evaluate(fc)
+		return
+	}
+
+	inComponent := make(map[*formulaCell]bool)
+	for _, c := range component {
+		inComponent[c] = true
+	}
+	for i := len(component) - 1; i >= 0; i-- {
+		c := component[i]
+		for _, dep := range c.deps {
+			if inComponent[dep] {
+				r.circular(c, dep)
+				break
+			}
+		}
+	}
+}
+
+func dependsOn(fc, dep *formulaCell) bool {
+	for _, d := range fc.deps {
+		if d == dep {
+			return true
+		}
+	}
+	return false
+}
+
+// circular marks a cell of a circular reference, remembering the first of
+// each sheet the way SocialCalc does
+func (r *recalculation) circular(fc, dep *formulaCell) {
+	message := "Circular reference to " + dep.coord
+	fc.cell.ValueType = socialcalc.ValueError + ErrRef
+	fc.cell.Value = message
+	fc.cell.Errors = message
+	if fc.sheet.Attribs.CircularReferenceCell == "" {
+		fc.sheet.Attribs.CircularReferenceCell = dep.coord + "|" + fc.coord
+	}
+	r.result.Circular = append(r.result.Circular, fc.label)
+}
+
+// evaluate computes a formula and stores its value in the cell. A formula
+// calling a function the engine does not implement keeps its saved value.
+func (r *recalculation) evaluate(fc *formulaCell) {
+	if fc.err != nil {
+		message := "Error in formula: " + fc.err.Error()
+		fc.cell.ValueType = socialcalc.ValueError + ErrValue
+		fc.cell.Value = message
+		fc.cell.Errors = message
+		return
+	}
+
+	e := &evaluator{book: r.book, sheet: fc.sheet}
+	v := result(e.eval(fc.parsed))
+	if e.unimplemented != "" {
+		r.result.Kept = append(r.result.Kept, fc.label)
+		return
+	}
+	fc.cell.ValueType = v.Type
+	fc.cell.Value = v.String()
+	fc.cell.Errors = ""
+}
+
+// result turns the value of a formula into a cell value: a single cell
+// range is its value, a larger one an error, and blank is zero
+func result(v Value) Value {
+	v = scalar(v)
+	if v.IsBlank() {
+		return number(0)
+	}
+	return v
+}
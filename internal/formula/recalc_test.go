@@ -0,0 +1,113 @@
+package formula
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/c4gt/tornado-nginx-go-backend/internal/socialcalc"
+)
+
+func parseSheet(t *testing.T, lines ...string) *socialcalc.Sheet {
+	t.Helper()
+	sheet, err := socialcalc.ParseSheet("version:1.5\n" + strings.Join(lines, "\n") + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sheet
+}
+
+func TestRecalc(t *testing.T) {
+	costs := parseSheet(t,
+		"cell:A1:vtf:n:0:B1*2",
+		"cell:B1:vtf:n:0:C1+1",
+		"cell:C1:v:4",
+		"cell:D1:vtf:n:1:E1",
+		"cell:E1:vtf:n:1:D1+1",
+		"cell:F1:vtf:n:0:F1+1",
+		"cell:G1:vtf:n:0:D1*2",
+		"cell:H1:vtf:n:42:DSUM(C1\\cC1,1,C1\\cC1)+1",
+		"cell:I1:vtf:n:0:H1*2",
+		"cell:J1:vtf:n:0:1+",
+		"cell:K1:vtf:n:0:SUM(A1\\cC1)",
+		"cell:L1:vtf:n:0:Totals!A1*10",
+		"cell:M1:vtf:e#N/A:0:IF(C1>3,\"many\",\"few\")",
+		"sheet:c:13:r:1:needsrecalc:yes",
+	)
+	totals := parseSheet(t,
+		"cell:A1:vtf:n:0:Costs!K1+Costs!C1",
+		"cell:B1:vtf:n:0:A1/0",
+	)
+	workbook := &socialcalc.Workbook{Sheets: []*socialcalc.WorkbookSheet{
+		{ID: "sheet1", Name: "Costs", Doc: &socialcalc.Document{Sheet: costs}},
+		{ID: "sheet2", Name: "Totals", Doc: &socialcalc.Document{Sheet: totals}},
+	}}
+
+	result := Recalc(workbook)
+	if got, want := strings.Join(result.Circular, ","), "Costs!D1,Costs!E1,Costs!F1"; got != want {
+		t.Errorf("circular = %s, want %s", got, want)
+	}
+	if got, want := strings.Join(result.Kept, ","), "Costs!H1"; got != want {
+		t.Errorf("kept = %s, want %s", got, want)
+	}
+
+	for _, test := range []struct {
+		sheet     *socialcalc.Sheet
+		coord     string
+		valueType string
+		value     string
+	}{
+		{costs, "A1", "n", "10"},
+		{costs, "B1", "n", "5"},
+		{costs, "D1", "e#REF!", "Circular reference to E1"},
+		{costs, "E1", "e#REF!", "Circular reference to D1"},
+		{costs, "F1", "e#REF!", "Circular reference to F1"},
+		{costs, "G1", "e#REF!", "Circular reference to E1"},
+		{costs, "H1", "n", "42"},
+		{costs, "I1", "n", "84"},
+		{costs, "J1", "e#VALUE!", "Error in formula: Missing operand at position 3"},
+		{costs, "K1", "n", "19"},
+		{costs, "L1", "n", "230"},
+		{costs, "M1", "t", "many"},
+		{totals, "A1", "n", "23"},
+		{totals, "B1", "e#DIV/0!", "#DIV/0!"},
+	} {
+		cell := test.sheet.Cell(test.coord)
+		if cell.ValueType != test.valueType || cell.Value != test.value {
+			t.Errorf("%s = %s %q, want %s %q", test.coord, cell.ValueType, cell.Value, test.valueType, test.value)
+		}
+	}
+	if costs.Cell("D1").Errors != "Circular reference to E1" || costs.Cell("A1").Errors != "" {
+		t.Errorf("errors = %q, %q", costs.Cell("D1").Errors, costs.Cell("A1").Errors)
+	}
+	if costs.Attribs.CircularReferenceCell == "" || costs.Attribs.NeedsRecalc != "" {
+		t.Errorf("attribs = %+v", costs.Attribs)
+	}
+	if totals.Attribs.CircularReferenceCell != "" {
+		t.Errorf("totals attribs = %+v", totals.Attribs)
+	}
+
+	// Recalculating again changes nothing
+	before := costs.String()
+	Recalc(workbook)
+	if after := costs.String(); after != before {
+		t.Errorf("second recalc changed the sheet:\n%s\nto\n%s", before, after)
+	}
+}
+
+func TestRecalcSheet(t *testing.T) {
+	sheet := parseSheet(t,
+		"cell:A1:v:2",
+		"cell:A2:vtf:n:0:A1^10",
+		"cell:A3:vtf:n:0:Other!A1",
+		"cell:B1:vtf:n:0:SUM(A1\\cA2)",
+	)
+	result := RecalcSheet(sheet)
+	if len(result.Circular) != 0 || len(result.Kept) != 0 {
+		t.Errorf("result = %+v", result)
+	}
+	for coord, want := range map[string]string{"A2": "1024", "A3": "Sheet unavailable: Other", "B1": "1026"} {
+		if got := sheet.Cell(coord).Value; got != want {
+			t.Errorf("%s = %q, want %q", coord, got, want)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package formula
+
+import (
+	"math"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/c4gt/tornado-nginx-go-backend/internal/socialcalc"
+)
+
+// maxTextLength bounds the text REPT builds
+const maxTextLength = 32767
+
+// count returns a count argument, a whole number that may not be
+// negative, capped so it converts to an int
+func count(v Value) (int, bool) {
+	if v.Num < 0 {
+		return 0, false
+	}
+	return int(math.Min(v.Num, math.MaxInt32)), true
+}
+
+var textFunctions = map[string]function{
+	"EXACT": typed("EXACT", "tt", 2, func(args []Value) Value {
+		return logical(args[0].Text == args[1].Text)
+	}),
+	"FIND": typed("FIND", "ttn", 2, func(args []Value) Value {
+		in, start := []rune(args[1].Text), 1
+		if len(args) == 3 {
+			start = int(args[2].Num)
+		}
+		if start < 1 || start > len(in)+1 {
+			return errorValue(ErrValue, "")
+		}
+		rest := string(in[start-1:])
+		i := strings.Index(rest, args[0].Text)
+		if i < 0 {
+			return errorValue(ErrValue, "")
+		}
+		return number(float64(start + utf8.RuneCountInString(rest[:i])))
+	}),
+	"LEFT": typed("LEFT", "tn", 1, func(args []Value) Value {
+		s, n := []rune(args[0].Text), 1
+		if len(args) == 2 {
+			var ok bool
+			if n, ok = count(args[1]); !ok {
+				return errorValue(ErrValue, "")
+			}
+		}
+		return text(string(s[:min(n, len(s))]))
+	}),
+	"RIGHT": typed("RIGHT", "tn", 1, func(args []Value) Value {
+		s, n := []rune(args[0].Text), 1
+		if len(args) == 2 {
+			var ok bool
+			if n, ok = count(args[1]); !ok {
+				return errorValue(ErrValue, "")
+			}
+		}
+		return text(string(s[len(s)-min(n, len(s)):]))
+	}),
+	"MID": typed("MID", "tnn", 3, func(args []Value) Value {
+		s, start := []rune(args[0].Text), int(args[1].Num)
+		n, ok := count(args[2])
+		if start < 1 || !ok {
+			return errorValue(ErrValue, "")
+		}
+		if start > len(s) {
+			return text("")
+		}
+		return text(string(s[start-1 : min(start-1+n, len(s))]))
+	}),
+	"LEN": typed("LEN", "t", 1, func(args []Value) Value {
+		return number(float64(len([]rune(args[0].Text))))
+	}),
+	"LOWER": typed("LOWER", "t", 1, func(args []Value) Value {
+		return text(strings.ToLower(args[0].Text))
+	}),
+	"UPPER": typed("UPPER", "t", 1, func(args []Value) Value {
+		return text(strings.ToUpper(args[0].Text))
+	}),
+	"PROPER": typed("PROPER", "t", 1, func(args []Value) Value {
+		var out strings.Builder
+		word := false
+		for _, r := range args[0].Text {
+			if word {
+				out.WriteRune(unicode.ToLower(r))
+			} else {
+				out.WriteRune(unicode.ToUpper(r))
+			}
+			word = unicode.IsLetter(r)
+		}
+		return text(out.String())
+	}),
+	"REPLACE": typed("REPLACE", "tnnt", 4, func(args []Value) Value {
+		s, start := []rune(args[0].Text), int(args[1].Num)
+		n, ok := count(args[2])
+		if start < 1 || !ok {
+			return errorValue(ErrValue, "")
+		}
+		start = min(start-1, len(s))
+		end := min(start+n, len(s))
+		return text(string(s[:start]) + args[3].Text + string(s[end:]))
+	}),
+	"REPT": typed("REPT", "tn", 2, func(args []Value) Value {
+		n, ok := count(args[1])
+		if !ok || n > 0 && len(args[0].Text) > maxTextLength/n {
+			return errorValue(ErrValue, "")
+		}
+		return text(strings.Repeat(args[0].Text, n))
+	}),
+	"SUBSTITUTE": typed("SUBSTITUTE", "tttn", 3, func(args []Value) Value {
+		s, old, replacement := args[0].Text, args[1].Text, args[2].Text
+		if old == "" {
+			return text(s)
+		}
+		if len(args) == 3 {
+			return text(strings.ReplaceAll(s, old, replacement))
+		}
+		which := int(args[3].Num)
+		if which < 1 {
+			return errorValue(ErrValue, "")
+		}
+		pos := 0
+		for i := 1; ; i++ {
+			found := strings.Index(s[pos:], old)
+			if found < 0 {
+				return text(s)
+			}
+			pos += found
+			if i == which {
+				return text(s[:pos] + replacement + s[pos+len(old):])
+			}
+			pos += len(old)
+		}
+	}),
+	"TRIM": typed("TRIM", "t", 1, func(args []Value) Value {
+		return text(strings.Join(strings.Fields(args[0].Text), " "))
+	}),
+	"VALUE": typed("VALUE", "t", 1, func(args []Value) Value {
+		if cell := socialcalc.InputCell(args[0].Text); cell != nil {
+			if n, ok := cell.Number(); ok {
+				return number(n)
+			}
+		}
+		return errorValue(ErrValue, "")
+	}),
+}
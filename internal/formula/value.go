@@ -0,0 +1,271 @@
+// Package formula evaluates the SocialCalc formula language on the server,
+// so saved spreadsheets can be recalculated without the browser: formulas
+// are parsed, evaluated against the cells of a sheet or workbook and
+// recalculated in dependency order, with circular references reported the
+// way SocialCalc does.
+package formula
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/c4gt/tornado-nginx-go-backend/internal/socialcalc"
+)
+
+// Error values, the codes that follow the "e" of an error value type
+const (
+	ErrDivZero = "#DIV/0!"
+	ErrNA      = "#N/A"
+	ErrName    = "#NAME?"
+	ErrNull    = "#NULL!"
+	ErrNum     = "#NUM!"
+	ErrRef     = "#REF!"
+	ErrValue   = "#VALUE!"
+)
+
+// errorCodes are the error values a formula may spell out
+var errorCodes = []string{ErrDivZero, ErrNA, ErrName, ErrNull, ErrNum, ErrRef, ErrValue}
+
+// typeRange is the type of range values, which only functions take
+const typeRange = "range"
+
+// Value is the result of evaluating a formula or reading a cell. Type is a
+// SocialCalc value type: "n" and its subtypes such as "nd" for numbers, "t"
+// for text, "b" for blank and "e" followed by the code for errors.
+type Value struct {
+	Type string
+	Num  float64
+	// Text is the text of text values and the message of errors
+	Text string
+
+	rng *cellRange
+}
+
+func number(n float64) Value {
+	return Value{Type: socialcalc.ValueNumber, Num: n}
+}
+
+func typedNumber(valueType string, n float64) Value {
+	return Value{Type: valueType, Num: n}
+}
+
+func text(s string) Value {
+	return Value{Type: socialcalc.ValueText, Text: s}
+}
+
+func logical(b bool) Value {
+	if b {
+		return typedNumber("nl", 1)
+	}
+	return typedNumber("nl", 0)
+}
+
+func errorValue(code, message string) Value {
+	return Value{Type: socialcalc.ValueError + code, Text: message}
+}
+
+// argsError is the error of a function called with arguments it does not
+// take
+func argsError(name string) Value {
+	return errorValue(ErrValue, "Incorrect arguments to function "+name)
+}
+
+// IsNumber reports whether the value is a number of any subtype
+func (v Value) IsNumber() bool {
+	return strings.HasPrefix(v.Type, socialcalc.ValueNumber)
+}
+
+// IsText reports whether the value is text
+func (v Value) IsText() bool {
+	return strings.HasPrefix(v.Type, socialcalc.ValueText)
+}
+
+// IsError reports whether the value is an error
+func (v Value) IsError() bool {
+	return strings.HasPrefix(v.Type, socialcalc.ValueError)
+}
+
+// IsBlank reports whether the value is an empty cell
+func (v Value) IsBlank() bool {
+	return v.Type == socialcalc.ValueBlank
+}
+
+func (v Value) isRange() bool {
+	return v.Type == typeRange
+}
+
+// String returns the value as SocialCalc saves it: numbers the way
+// JavaScript prints them, the text of text, and the message of errors
+// or their code when there is none
+func (v Value) String() string {
+	switch {
+	case v.IsNumber():
+		return formatNumber(v.Num)
+	case v.IsError() && v.Text == "":
+		return v.Type[1:]
+	}
+	return v.Text
+}
+
+// formatNumber prints a number like JavaScript's Number.toString, which is
+// how the browser saves computed values
+func formatNumber(n float64) string {
+	if n == 0 {
+		return "0"
+	}
+	if abs := math.Abs(n); abs >= 1e-6 && abs < 1e21 {
+		return strconv.FormatFloat(n, 'f', -1, 64)
+	}
+	s := strconv.FormatFloat(n, 'e', -1, 64)
+	mantissa, exp, _ := strings.Cut(s, "e")
+	sign := exp[:1]
+	return mantissa + "e" + sign + strings.TrimLeft(exp[1:], "0")
+}
+
+// cellValue returns the value of a cell, blank for a missing or empty one
+func cellValue(cell *socialcalc.Cell) Value {
+	if cell == nil || cell.DataType == "" {
+		return Value{Type: socialcalc.ValueBlank}
+	}
+	switch {
+	case strings.HasPrefix(cell.ValueType, socialcalc.ValueNumber):
+		n, ok := cell.Number()
+		if !ok {
+			return errorValue(ErrValue, "")
+		}
+		return typedNumber(cell.ValueType, n)
+	case strings.HasPrefix(cell.ValueType, socialcalc.ValueText):
+		return Value{Type: cell.ValueType, Text: cell.Value}
+	case strings.HasPrefix(cell.ValueType, socialcalc.ValueError):
+		return Value{Type: cell.ValueType, Text: cell.Value}
+	}
+	return Value{Type: socialcalc.ValueBlank}
+}
+
+// cellRange is a rectangle of cells of one sheet
+type cellRange struct {
+	sheet      *socialcalc.Sheet
+	col1, row1 int
+	col2, row2 int
+}
+
+func rangeValue(r *cellRange) Value {
+	return Value{Type: typeRange, rng: r}
+}
+
+func (r *cellRange) cols() int {
+	return r.col2 - r.col1 + 1
+}
+
+func (r *cellRange) rows() int {
+	return r.row2 - r.row1 + 1
+}
+
+// at returns the value at a 0-based row and column of the range
+func (r *cellRange) at(row, col int) Value {
+	return cellValue(r.sheet.Cell(socialcalc.Coord(r.col1+col, r.row1+row)))
+}
+
+// each calls fn with the 0-based row and column and the value of the cells
+// of the range that are not blank, row by row, until it returns false
+func (r *cellRange) each(fn func(row, col int, v Value) bool) {
+	if r.rows()*r.cols() <= len(r.sheet.Cells) {
+		for row := 0; row < r.rows(); row++ {
+			for col := 0; col < r.cols(); col++ {
+				if v := r.at(row, col); !v.IsBlank() && !fn(row, col, v) {
+					return
+				}
+			}
+		}
+		return
+	}
+
+	// Ranges larger than the sheet, such as whole columns, are walked
+	// through the cells the sheet has
+	var cells []position
+	for coord, cell := range r.sheet.Cells {
+		if cell.DataType == "" {
+			continue
+		}
+		col, row, err := socialcalc.ParseCoord(coord)
+		if err == nil && col >= r.col1 && col <= r.col2 && row >= r.row1 && row <= r.row2 {
+			cells = append(cells, position{col, row})
+		}
+	}
+	sort.Slice(cells, func(i, j int) bool {
+		if cells[i].row != cells[j].row {
+			return cells[i].row < cells[j].row
+		}
+		return cells[i].col < cells[j].col
+	})
+	for _, p := range cells {
+		if !fn(p.row-r.row1, p.col-r.col1, r.at(p.row-r.row1, p.col-r.col1)) {
+			return
+		}
+	}
+}
+
+// all is each with the blank cells included
+func (r *cellRange) all(fn func(row, col int, v Value) bool) {
+	for row := 0; row < r.rows(); row++ {
+		for col := 0; col < r.cols(); col++ {
+			if !fn(row, col, r.at(row, col)) {
+				return
+			}
+		}
+	}
+}
+
+// scalar returns the value of a single cell range, and values that are not
+// ranges as they are
+func scalar(v Value) Value {
+	if !v.isRange() {
+		return v
+	}
+	if v.rng.rows() != 1 || v.rng.cols() != 1 {
+		return errorValue(ErrValue, "Formula results in range value")
+	}
+	return v.rng.at(0, 0)
+}
+
+// toNumber converts a value to a number the way operators do: blanks are
+// zero and text must read as a number. Errors are returned as they are and
+// anything else becomes #VALUE!.
+func toNumber(v Value) Value {
+	v = scalar(v)
+	switch {
+	case v.IsNumber(), v.IsError():
+		return v
+	case v.IsBlank():
+		return number(0)
+	}
+	if cell := socialcalc.InputCell(v.Text); cell != nil {
+		if n, ok := cell.Number(); ok {
+			return typedNumber(cell.ValueType, n)
+		}
+	}
+	return errorValue(ErrValue, "")
+}
+
+// toText converts a value to text: numbers print as JavaScript prints them
+// and blanks are empty. Errors are returned as they are.
+func toText(v Value) Value {
+	v = scalar(v)
+	switch {
+	case v.IsNumber():
+		return text(formatNumber(v.Num))
+	case v.IsBlank():
+		return text("")
+	}
+	return v
+}
+
+// checkNumber turns results that are not finite numbers into #NUM!
+func checkNumber(v Value) Value {
+	if v.IsNumber() && (math.IsNaN(v.Num) || math.IsInf(v.Num, 0)) {
+		return errorValue(ErrNum, "Formula results in a bad numeric value")
+	}
+	return v
+}
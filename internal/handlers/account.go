@@ -0,0 +1,419 @@
+package handlers
+
+import (
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "net/url"
+    "time"
+
+    "github.com/c4gt/tornado-nginx-go-backend/internal/auth"
+    "github.com/c4gt/tornado-nginx-go-backend/internal/email"
+    "github.com/c4gt/tornado-nginx-go-backend/internal/models"
+    "github.com/gin-gonic/gin"
+)
+
+const deletionPurgeInterval = 1 * time.Hour
+
+type AccountHandler struct {
+    handler *Handler
+    service *auth.Service
+}
+
+func NewAccountHandler(h *Handler, service *auth.Service) *AccountHandler {
+    return &AccountHandler{
+        handler: h,
+        service: service,
+    }
+}
+
+type DeleteAccountRequest struct {
+    Password string `json:"password" form:"password"`
+    Confirm  string `json:"confirm" form:"confirm"`
+}
+
+type ChangeEmailRequest struct {
+    Email    string `json:"email" form:"email"`
+    Password string `json:"password" form:"password"`
+    Confirm  string `json:"confirm" form:"confirm"`
+}
+
+// HandleDeletionStatus reports whether the current user's account is
+// scheduled for deletion
+func (h *AccountHandler) HandleDeletionStatus(c *gin.Context) {
+    user := h.handler.Auth.getCurrentUser(c)
+    if user == "" {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+        return
+    }
+
+    pending, err := h.service.PendingDeletion(user)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{
+            "data":   "failed to read deletion status",
+            "result": "fail",
+        })
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{
+        "data":   deletionView(pending),
+        "result": "ok",
+    })
+}
+
+// HandleRequestDeletion deletes the current user's account after the grace
+// period. The password must be re-entered, or the email address typed for
+// accounts that only sign in through an external provider.
+func (h *AccountHandler) HandleRequestDeletion(c *gin.Context) {
+    email := h.handler.Auth.getCurrentUser(c)
+    if email == "" {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+        return
+    }
+
+    var req DeleteAccountRequest
+    c.ShouldBind(&req)
+
+    user, err := h.service.GetUser(email)
+    if err != nil {
+        c.JSON(http.StatusNotFound, gin.H{
+            "data":   "user not found",
+            "result": "fail",
+        })
+        return
+    }
+
+    if !confirmAccount(user, req.Password, req.Confirm) {
+        c.JSON(http.StatusForbidden, gin.H{
+            "data":   "authfail",
+            "result": "fail",
+        })
+        return
+    }
+
+    if h.service.DeletionGracePeriod() <= 0 {
+        if err := h.purgeAccount(email, email); err != nil {
+            fmt.Printf("DEBUG: Account deletion failed for %s: %v\n", email, err)
+            c.JSON(http.StatusInternalServerError, gin.H{
+                "data":   "failed to delete account",
+                "result": "fail",
+            })
+            return
+        }
+        h.handler.Auth.clearCurrentUser(c)
+        c.JSON(http.StatusOK, gin.H{
+            "data":   gin.H{"deleted": true},
+            "result": "ok",
+        })
+        return
+    }
+
+    pending, err := h.service.ScheduleDeletion(email, email)
+    if err != nil {
+        fmt.Printf("DEBUG: Scheduling account deletion failed for %s: %v\n", email, err)
+        c.JSON(http.StatusInternalServerError, gin.H{
+            "data":   "failed to schedule account deletion",
+            "result": "fail",
+        })
+        return
+    }
+
+    // Sign out everywhere; signing in again during the grace period is
+    // allowed so the deletion can still be cancelled
+    h.handler.revokeUserSessions(email)
+    h.handler.Auth.clearCurrentUser(c)
+
+    c.JSON(http.StatusOK, gin.H{
+        "data":   deletionView(pending),
+        "result": "ok",
+    })
+}
+
+// HandleCancelDeletion keeps the current user's account
+func (h *AccountHandler) HandleCancelDeletion(c *gin.Context) {
+    email := h.handler.Auth.getCurrentUser(c)
+    if email == "" {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+        return
+    }
+
+    if err := h.service.CancelDeletion(email, email); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{
+            "data":   "failed to cancel account deletion",
+            "result": "fail",
+        })
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{
+        "data":   deletionView(nil),
+        "result": "ok",
+    })
+}
+
+// HandleRequestEmailChange starts a change of the current user's email
+// address by sending a verification link to the new address
+func (h *AccountHandler) HandleRequestEmailChange(c *gin.Context) {
+    current := h.handler.Auth.getCurrentUser(c)
+    if current == "" {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+        return
+    }
+
+    var req ChangeEmailRequest
+    c.ShouldBind(&req)
+
+    user, err := h.service.GetUser(current)
+    if err != nil {
+        c.JSON(http.StatusNotFound, gin.H{
+            "data":   "user not found",
+            "result": "fail",
+        })
+        return
+    }
+    if !confirmAccount(user, req.Password, req.Confirm) {
+        c.JSON(http.StatusForbidden, gin.H{
+            "data":   "authfail",
+            "result": "fail",
+        })
+        return
+    }
+
+    change, err := h.service.RequestEmailChange(current, req.Email)
+    if err != nil {
+        status := http.StatusBadRequest
+        data := err.Error()
+        var refused *auth.RegistrationError
+        if errors.Is(err, auth.ErrEmailInUse) {
+            status = http.StatusConflict
+            data = "emailinuse"
+        } else if errors.As(err, &refused) {
+            status = http.StatusForbidden
+            data = refused.Reason
+        }
+        c.JSON(status, gin.H{
+            "data":   data,
+            "result": "fail",
+        })
+        return
+    }
+
+    link := h.handler.baseURL(c) + "/account/email/verify?t=" + url.QueryEscape(change.Token)
+    message := email.NewMessage()
+    message.Subject = "Confirm your new email address"
+    message.BodyText = fmt.Sprintf("Please click the following link to change the email address of your account from %s to %s\n%s\n\nThe link expires in %s. If you did not ask for this change, ignore this message.",
+        change.OldEmail, change.NewEmail, link, auth.EmailChangeTTL)
+
+    if err := h.handler.Email.Send(change.NewEmail, message); err != nil {
+        fmt.Printf("DEBUG: Email change verification for %s not sent: %v\n", change.NewEmail, err)
+        c.JSON(http.StatusServiceUnavailable, gin.H{
+            "data":   "failed to send verification email",
+            "result": "fail",
+        })
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{
+        "data":   gin.H{"email": change.NewEmail, "expiresat": change.ExpiresAt},
+        "result": "ok",
+    })
+}
+
+// HandleVerifyEmailChange completes an email change from the link sent to
+// the new address
+func (h *AccountHandler) HandleVerifyEmailChange(c *gin.Context) {
+    change, err := h.service.ChangeEmail(c.Query("t"))
+    if err != nil {
+        fmt.Printf("DEBUG: Email change verification failed: %v\n", err)
+        message := "This link is invalid or has expired"
+        var refused *auth.RegistrationError
+        if errors.Is(err, auth.ErrEmailInUse) {
+            message = "The new email address is already in use"
+        } else if errors.As(err, &refused) {
+            message = "Email addresses at that domain are not allowed"
+        } else if !errors.Is(err, auth.ErrEmailChangeNotFound) {
+            message = "Failed to change email address, please try again"
+        }
+
+        if c.GetHeader("Content-Type") == "application/json" {
+            c.JSON(http.StatusBadRequest, gin.H{
+                "data":   message,
+                "result": "fail",
+            })
+        } else {
+            renderHTML(c, http.StatusBadRequest, "login.html", gin.H{
+                "user":  nil,
+                "error": message,
+            })
+        }
+        return
+    }
+
+    // Login sessions follow the account to its new address
+    h.handler.Session.RenameUser(change.OldEmail, change.NewEmail)
+
+    if c.GetHeader("Content-Type") == "application/json" {
+        c.JSON(http.StatusOK, gin.H{
+            "data":   gin.H{"email": change.NewEmail},
+            "result": "ok",
+        })
+    } else {
+        c.Redirect(http.StatusFound, "/browser")
+    }
+}
+
+// HandleListSessions lists where the current user is signed in
+func (h *AccountHandler) HandleListSessions(c *gin.Context) {
+    current, ok := h.handler.loginSession(c)
+    if !ok {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+        return
+    }
+    user, _ := current.GetString("user")
+
+    logins := h.handler.loginSessions(user)
+    views := make([]gin.H, 0, len(logins))
+    for _, login := range logins {
+        views = append(views, loginSessionView(login, login.ID == current.ID))
+    }
+
+    c.JSON(http.StatusOK, gin.H{
+        "data":   views,
+        "result": "ok",
+    })
+}
+
+// HandleRevokeSession signs the current user out of one of their sessions,
+// identified by the id shown in the session list
+func (h *AccountHandler) HandleRevokeSession(c *gin.Context) {
+    current, ok := h.handler.loginSession(c)
+    if !ok {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+        return
+    }
+    user, _ := current.GetString("user")
+
+    for _, login := range h.handler.loginSessions(user) {
+        if loginSessionHandle(login.ID) != c.Param("id") {
+            continue
+        }
+        h.handler.audit(c, &models.AuditEvent{
+            Type:    models.AuditSessionRevoke,
+            Outcome: models.AuditSuccess,
+            Actor:   user,
+            Subject: user,
+            Reason:  "session " + c.Param("id"),
+        })
+        if login.ID == current.ID {
+            h.handler.Auth.clearCurrentUser(c)
+        } else {
+            h.handler.Session.Delete(login.ID)
+        }
+        c.JSON(http.StatusOK, gin.H{
+            "data":   gin.H{"revoked": 1},
+            "result": "ok",
+        })
+        return
+    }
+
+    c.JSON(http.StatusNotFound, gin.H{
+        "data":   "session not found",
+        "result": "fail",
+    })
+}
+
+// HandleRevokeAllSessions signs the current user out everywhere, or with
+// keepcurrent=true everywhere except on this browser
+func (h *AccountHandler) HandleRevokeAllSessions(c *gin.Context) {
+    current, ok := h.handler.loginSession(c)
+    if !ok {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+        return
+    }
+    user, _ := current.GetString("user")
+
+    var revoked int
+    if c.Query("keepcurrent") == "true" {
+        revoked = h.handler.revokeUserSessions(user, current.ID)
+    } else {
+        revoked = h.handler.revokeUserSessions(user)
+        h.handler.Auth.clearCurrentUser(c)
+    }
+    log.Printf("Revoked %d sessions of %s", revoked, user)
+    h.handler.audit(c, &models.AuditEvent{
+        Type:    models.AuditSessionRevoke,
+        Outcome: models.AuditSuccess,
+        Actor:   user,
+        Subject: user,
+        Reason:  fmt.Sprintf("%d sessions", revoked),
+    })
+
+    c.JSON(http.StatusOK, gin.H{
+        "data":   gin.H{"revoked": revoked},
+        "result": "ok",
+    })
+}
+
+// purgeAccount removes the account and everything stored for it, and
+// revokes its server-side sessions and tokens
+func (h *AccountHandler) purgeAccount(email, actor string) error {
+    if err := h.service.DeleteUser(email, actor); err != nil {
+        return err
+    }
+    if removed := h.handler.revokeUserSessions(email); removed > 0 {
+        log.Printf("Revoked %d sessions of deleted account %s", removed, email)
+    }
+    return nil
+}
+
+// PurgeDueDeletions deletes the accounts whose grace period has passed
+func (h *AccountHandler) PurgeDueDeletions() {
+    due, err := h.service.DueDeletions()
+    if err != nil {
+        log.Printf("Failed to list pending account deletions: %v", err)
+        return
+    }
+
+    for _, pending := range due {
+        if err := h.purgeAccount(pending.Email, pending.RequestedBy); err != nil {
+            log.Printf("Failed to purge account %s: %v", pending.Email, err)
+        }
+    }
+}
+
+func (h *AccountHandler) runDeletionPurger(stop <-chan struct{}) {
+    ticker := time.NewTicker(deletionPurgeInterval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-ticker.C:
+            h.PurgeDueDeletions()
+        case <-stop:
+            return
+        }
+    }
+}
+
+// confirmAccount checks the password the user re-entered, or for accounts
+// without one, that they typed their email address
+func confirmAccount(user *models.User, password, confirm string) bool {
+    if user.PWHash != "" {
+        return user.Authenticate(password)
+    }
+    return confirm == user.Email
+}
+
+func deletionView(pending *models.PendingDeletion) gin.H {
+    if pending == nil {
+        return gin.H{"scheduled": false}
+    }
+    return gin.H{
+        "scheduled":   true,
+        "requestedby": pending.RequestedBy,
+        "requestedat": pending.RequestedAt,
+        "purgeafter":  pending.PurgeAfter,
+    }
+}
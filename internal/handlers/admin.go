@@ -0,0 +1,500 @@
+package handlers
+
+import (
+    "errors"
+    "fmt"
+    "net/http"
+    "net/url"
+    "strconv"
+    "time"
+
+    "github.com/c4gt/tornado-nginx-go-backend/internal/auth"
+    "github.com/c4gt/tornado-nginx-go-backend/internal/models"
+    "github.com/c4gt/tornado-nginx-go-backend/pkg/middleware"
+    "github.com/gin-gonic/gin"
+)
+
+const (
+    defaultAdminPageSize = 50
+    maxAdminPageSize     = 500
+
+    defaultInviteUses = 1
+    defaultInviteDays = 7
+)
+
+type AdminHandler struct {
+    handler *Handler
+    service *auth.Service
+}
+
+func NewAdminHandler(h *Handler, service *auth.Service) *AdminHandler {
+    return &AdminHandler{
+        handler: h,
+        service: service,
+    }
+}
+
+// RequireAdmin returns middleware that only lets administrators through.
+// The user comes from the server-side login session whatever ran before,
+// never from anything the browser could set itself.
+func (h *AdminHandler) RequireAdmin() gin.HandlerFunc {
+    requireRole := middleware.RequireRole(h.service.GetUserRole, models.RoleAdmin)
+    return func(c *gin.Context) {
+        user := h.handler.CurrentUser(c)
+        if user == "" {
+            c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+            c.Abort()
+            return
+        }
+        c.Set("current_user", user)
+        requireRole(c)
+    }
+}
+
+// HandleListUsers lists and searches user accounts
+func (h *AdminHandler) HandleListUsers(c *gin.Context) {
+    offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+    limit, _ := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultAdminPageSize)))
+    if offset < 0 {
+        offset = 0
+    }
+    if limit <= 0 || limit > maxAdminPageSize {
+        limit = defaultAdminPageSize
+    }
+
+    users, total, err := h.service.ListUsers(c.Query("q"), offset, limit)
+    if err != nil {
+        fmt.Printf("DEBUG: Admin user listing failed: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{
+            "data":   "failed to list users",
+            "result": "fail",
+        })
+        return
+    }
+
+    views := make([]gin.H, 0, len(users))
+    for _, user := range users {
+        views = append(views, adminUserView(user))
+    }
+
+    c.JSON(http.StatusOK, gin.H{
+        "data":   views,
+        "total":  total,
+        "offset": offset,
+        "limit":  limit,
+        "result": "ok",
+    })
+}
+
+// HandleGetUser returns a single account with its storage usage
+func (h *AdminHandler) HandleGetUser(c *gin.Context) {
+    user, ok := h.loadUser(c)
+    if !ok {
+        return
+    }
+
+    view := adminUserView(user)
+    if files, bytes, err := h.service.StorageUsage(user.Email); err == nil {
+        view["usage"] = gin.H{"items": files, "bytes": bytes}
+    }
+    locked, _ := h.service.IsLocked(user.Email)
+    view["locked"] = locked
+    if pending, err := h.service.PendingDeletion(user.Email); err == nil {
+        view["deletion"] = deletionView(pending)
+    }
+
+    c.JSON(http.StatusOK, gin.H{
+        "data":   view,
+        "result": "ok",
+    })
+}
+
+// HandleUsage returns the storage used by an account
+func (h *AdminHandler) HandleUsage(c *gin.Context) {
+    user, ok := h.loadUser(c)
+    if !ok {
+        return
+    }
+
+    files, bytes, err := h.service.StorageUsage(user.Email)
+    if err != nil {
+        fmt.Printf("DEBUG: Storage usage failed for %s: %v\n", user.Email, err)
+        c.JSON(http.StatusInternalServerError, gin.H{
+            "data":   "failed to compute storage usage",
+            "result": "fail",
+        })
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{
+        "data":   gin.H{"email": user.Email, "items": files, "bytes": bytes},
+        "result": "ok",
+    })
+}
+
+func (h *AdminHandler) HandleConfirmUser(c *gin.Context) {
+    user, ok := h.loadUser(c)
+    if !ok {
+        return
+    }
+    err := h.service.ConfirmUser(user.Email)
+    h.handler.auditResult(c, &models.AuditEvent{
+        Type:    models.AuditAdminConfirm,
+        Subject: user.Email,
+    }, err)
+    h.respond(c, err)
+}
+
+func (h *AdminHandler) HandleDisableUser(c *gin.Context) {
+    user, ok := h.loadUser(c)
+    if !ok || !h.notSelf(c, user) {
+        return
+    }
+    err := h.service.SetUserDisabled(user.Email, true)
+    h.handler.auditResult(c, &models.AuditEvent{
+        Type:    models.AuditAdminDisable,
+        Subject: user.Email,
+    }, err)
+    if err == nil {
+        revoked := h.handler.revokeUserSessions(user.Email)
+        h.handler.audit(c, &models.AuditEvent{
+            Type:    models.AuditSessionRevoke,
+            Outcome: models.AuditSuccess,
+            Subject: user.Email,
+            Reason:  fmt.Sprintf("account disabled, %d sessions", revoked),
+        })
+    }
+    h.respond(c, err)
+}
+
+func (h *AdminHandler) HandleEnableUser(c *gin.Context) {
+    user, ok := h.loadUser(c)
+    if !ok {
+        return
+    }
+    err := h.service.SetUserDisabled(user.Email, false)
+    h.handler.auditResult(c, &models.AuditEvent{
+        Type:    models.AuditAdminEnable,
+        Subject: user.Email,
+    }, err)
+    h.respond(c, err)
+}
+
+func (h *AdminHandler) HandleUnlockUser(c *gin.Context) {
+    user, ok := h.loadUser(c)
+    if !ok {
+        return
+    }
+    err := h.service.UnlockAccount(user.Email)
+    h.handler.auditResult(c, &models.AuditEvent{
+        Type:    models.AuditAdminUnlock,
+        Actor:   c.GetString("current_user"),
+        Subject: user.Email,
+    }, err)
+    h.respond(c, err)
+}
+
+// HandleSetRole changes an account's role
+func (h *AdminHandler) HandleSetRole(c *gin.Context) {
+    var req struct {
+        Role string `json:"role" form:"role"`
+    }
+    if err := c.ShouldBind(&req); err != nil || !models.ValidRole(req.Role) {
+        c.JSON(http.StatusBadRequest, gin.H{
+            "data":   "invalid role",
+            "result": "fail",
+        })
+        return
+    }
+
+    user, ok := h.loadUser(c)
+    if !ok || !h.notSelf(c, user) {
+        return
+    }
+    err := h.service.SetUserRole(user.Email, req.Role)
+    h.handler.auditResult(c, &models.AuditEvent{
+        Type:    models.AuditAdminRole,
+        Subject: user.Email,
+        Reason:  req.Role,
+    }, err)
+    h.respond(c, err)
+}
+
+// HandleResetPassword sets a new password when one is given, otherwise it
+// issues a password reset link for the account.
+func (h *AdminHandler) HandleResetPassword(c *gin.Context) {
+    var req struct {
+        Password string `json:"password" form:"password"`
+    }
+    c.ShouldBind(&req)
+
+    user, ok := h.loadUser(c)
+    if !ok {
+        return
+    }
+
+    if req.Password != "" {
+        err := h.service.UpdatePassword(user.Email, req.Password)
+        var policyErr *auth.PasswordPolicyError
+        if errors.As(err, &policyErr) {
+            c.JSON(http.StatusBadRequest, gin.H{
+                "data":   policyErr.Message,
+                "result": "fail",
+            })
+            return
+        }
+        if err == nil {
+            h.handler.revokeUserSessions(user.Email)
+        }
+        h.handler.auditResult(c, &models.AuditEvent{
+            Type:    models.AuditPasswordChange,
+            Subject: user.Email,
+            Method:  "admin",
+        }, err)
+        h.respond(c, err)
+        return
+    }
+
+    dongle, err := h.service.StartPasswordReset(user.Email)
+    if err != nil {
+        h.respond(c, err)
+        return
+    }
+
+    link := fmt.Sprintf("%s/pwreset?u=%s&d=%s", h.handler.baseURL(c), url.QueryEscape(user.Email), url.QueryEscape(dongle))
+    h.handler.Auth.sendLostPasswordEmail(user.Email, dongle, c.Request.Host)
+
+    c.JSON(http.StatusOK, gin.H{
+        "data":   gin.H{"reset_link": link},
+        "result": "ok",
+    })
+}
+
+// HandleDeleteUser schedules an account for deletion after the grace
+// period, or purges it right away with ?now=true
+func (h *AdminHandler) HandleDeleteUser(c *gin.Context) {
+    user, ok := h.loadUser(c)
+    if !ok || !h.notSelf(c, user) {
+        return
+    }
+
+    actor := c.GetString("current_user")
+    if c.Query("now") == "true" || h.service.DeletionGracePeriod() <= 0 {
+        h.respond(c, h.handler.Account.purgeAccount(user.Email, actor))
+        return
+    }
+
+    pending, err := h.service.ScheduleDeletion(user.Email, actor)
+    if err != nil {
+        h.respond(c, err)
+        return
+    }
+    h.handler.Session.DeleteByUser(user.Email)
+
+    c.JSON(http.StatusOK, gin.H{
+        "data":   deletionView(pending),
+        "result": "ok",
+    })
+}
+
+// HandleCancelDeletion keeps an account that was scheduled for deletion
+func (h *AdminHandler) HandleCancelDeletion(c *gin.Context) {
+    user, ok := h.loadUser(c)
+    if !ok {
+        return
+    }
+    h.respond(c, h.service.CancelDeletion(user.Email, c.GetString("current_user")))
+}
+
+// HandleDeletions lists recent account deletion events
+func (h *AdminHandler) HandleDeletions(c *gin.Context) {
+    limit, _ := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultAdminPageSize)))
+    if limit <= 0 || limit > maxAdminPageSize {
+        limit = defaultAdminPageSize
+    }
+
+    events, err := h.service.DeletionEvents(limit)
+    if err != nil {
+        h.respond(c, err)
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{
+        "data":   events,
+        "result": "ok",
+    })
+}
+
+// HandleLockouts lists recent login lockout events
+func (h *AdminHandler) HandleLockouts(c *gin.Context) {
+    limit, _ := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultAdminPageSize)))
+    if limit <= 0 || limit > maxAdminPageSize {
+        limit = defaultAdminPageSize
+    }
+
+    events, err := h.service.LockoutEvents(limit)
+    if err != nil {
+        h.respond(c, err)
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{
+        "data":   events,
+        "result": "ok",
+    })
+}
+
+// HandleListInvites lists registration invite codes, newest first
+func (h *AdminHandler) HandleListInvites(c *gin.Context) {
+    invites, err := h.service.ListInvites()
+    if err != nil {
+        h.respond(c, err)
+        return
+    }
+
+    views := make([]gin.H, 0, len(invites))
+    for _, invite := range invites {
+        views = append(views, h.inviteView(c, invite))
+    }
+    c.JSON(http.StatusOK, gin.H{
+        "data":   views,
+        "result": "ok",
+    })
+}
+
+// HandleCreateInvite issues an invite code. uses is how many accounts it can
+// register (default 1, 0 for unlimited) and days how long it is valid
+// (default 7, 0 for no expiry).
+func (h *AdminHandler) HandleCreateInvite(c *gin.Context) {
+    var req struct {
+        Uses *int `json:"uses" form:"uses"`
+        Days *int `json:"days" form:"days"`
+    }
+    c.ShouldBind(&req)
+
+    uses, days := defaultInviteUses, defaultInviteDays
+    if req.Uses != nil {
+        uses = *req.Uses
+    }
+    if req.Days != nil {
+        days = *req.Days
+    }
+    if uses < 0 || days < 0 {
+        c.JSON(http.StatusBadRequest, gin.H{
+            "data":   "uses and days cannot be negative",
+            "result": "fail",
+        })
+        return
+    }
+
+    actor := c.GetString("current_user")
+    invite, err := h.service.CreateInvite(actor, uses, time.Duration(days)*24*time.Hour)
+    event := &models.AuditEvent{
+        Type:  models.AuditAdminInviteCreate,
+        Actor: actor,
+    }
+    if err == nil {
+        event.Subject = invite.Code
+    }
+    h.handler.auditResult(c, event, err)
+    if err != nil {
+        h.respond(c, err)
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{
+        "data":   h.inviteView(c, invite),
+        "result": "ok",
+    })
+}
+
+// HandleDeleteInvite revokes an invite code
+func (h *AdminHandler) HandleDeleteInvite(c *gin.Context) {
+    err := h.service.DeleteInvite(c.Param("code"))
+    h.handler.auditResult(c, &models.AuditEvent{
+        Type:    models.AuditAdminInviteDelete,
+        Actor:   c.GetString("current_user"),
+        Subject: c.Param("code"),
+    }, err)
+    if errors.Is(err, auth.ErrInviteNotFound) {
+        c.JSON(http.StatusNotFound, gin.H{
+            "data":   "invite not found",
+            "result": "fail",
+        })
+        return
+    }
+    h.respond(c, err)
+}
+
+func (h *AdminHandler) inviteView(c *gin.Context, invite *models.Invite) gin.H {
+    return gin.H{
+        "code":      invite.Code,
+        "link":      h.handler.baseURL(c) + "/register?invite=" + url.QueryEscape(invite.Code),
+        "createdby": invite.CreatedBy,
+        "createdat": invite.CreatedAt,
+        "expiresat": invite.ExpiresAt,
+        "maxuses":   invite.MaxUses,
+        "uses":      invite.Uses,
+        "usedby":    invite.UsedBy,
+        "valid":     invite.IsValid(time.Now()),
+    }
+}
+
+func (h *AdminHandler) loadUser(c *gin.Context) (*models.User, bool) {
+    email := c.Param("email")
+    user, err := h.service.GetUser(email)
+    if err != nil {
+        if errors.Is(err, auth.ErrUserNotFound) {
+            c.JSON(http.StatusNotFound, gin.H{
+                "data":   "user not found: " + email,
+                "result": "fail",
+            })
+        } else {
+            h.respond(c, err)
+        }
+        return nil, false
+    }
+    return user, true
+}
+
+// notSelf stops administrators from disabling, demoting or deleting themselves
+func (h *AdminHandler) notSelf(c *gin.Context, user *models.User) bool {
+    if c.GetString("current_user") == user.Email {
+        c.JSON(http.StatusBadRequest, gin.H{
+            "data":   "administrators cannot change their own account here",
+            "result": "fail",
+        })
+        return false
+    }
+    return true
+}
+
+func (h *AdminHandler) respond(c *gin.Context, err error) {
+    if err != nil {
+        fmt.Printf("DEBUG: Admin action %s %s failed: %v\n", c.Request.Method, c.Request.URL.Path, err)
+        c.JSON(http.StatusInternalServerError, gin.H{
+            "data":   err.Error(),
+            "result": "fail",
+        })
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{
+        "result": "ok",
+    })
+}
+
+func adminUserView(user *models.User) gin.H {
+    identities := make([]string, 0, len(user.Identities))
+    for _, identity := range user.Identities {
+        identities = append(identities, identity.Provider)
+    }
+
+    return gin.H{
+        "email":      user.Email,
+        "role":       user.GetRole(),
+        "confirmed":  user.Confirmed,
+        "disabled":   user.Disabled,
+        "createdon":  user.CreatedOn,
+        "lastlogin":  user.LastLogin,
+        "identities": identities,
+    }
+}
@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/c4gt/tornado-nginx-go-backend/internal/auth"
+	"github.com/c4gt/tornado-nginx-go-backend/internal/config"
+	"github.com/c4gt/tornado-nginx-go-backend/internal/models"
+	"github.com/c4gt/tornado-nginx-go-backend/internal/session"
+	"github.com/c4gt/tornado-nginx-go-backend/pkg/middleware"
+	"github.com/gin-gonic/gin"
+)
+
+func TestRequireAdminUsesLoginSession(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	service := auth.NewService(newMemoryStorage())
+	h := &Handler{
+		Config:  &config.Config{},
+		Session: session.NewManager(),
+	}
+	defer h.Session.Close()
+	admin := NewAdminHandler(h, service)
+
+	const email = "admin@example.com"
+	if err := service.CreateUser(email, "correct horse battery"); err != nil {
+		t.Fatal(err)
+	}
+	if err := service.SetUserRole(email, models.RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+
+	router := gin.New()
+	router.GET("/admin/users", middleware.Authentication(h.CurrentUser), admin.RequireAdmin(), func(c *gin.Context) {
+		c.String(http.StatusOK, c.GetString("current_user"))
+	})
+	// Guards a route even without the authentication middleware before it
+	router.GET("/admin/bare", admin.RequireAdmin(), func(c *gin.Context) {
+		c.String(http.StatusOK, c.GetString("current_user"))
+	})
+
+	// The user cookie earlier versions set is not trusted
+	for _, path := range []string{"/admin/users", "/admin/bare"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.AddCookie(&http.Cookie{Name: "user", Value: email})
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s with a forged user cookie = %d, want 401", path, w.Code)
+		}
+	}
+
+	login := h.Session.New()
+	login.SetValue("user", email)
+	login.SetValue("kind", loginSessionKind)
+	h.Session.Set(login.ID, login)
+	for _, path := range []string{"/admin/users", "/admin/bare"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.AddCookie(&http.Cookie{Name: loginCookieName, Value: login.ID})
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK || w.Body.String() != email {
+			t.Errorf("%s with a login session = %d %q, want 200", path, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestAdminActionsAudited(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	service := auth.NewService(newMemoryStorage())
+	h := &Handler{
+		Config:      &config.Config{},
+		Session:     session.NewManager(),
+		authService: service,
+	}
+	defer h.Session.Close()
+	admin := NewAdminHandler(h, service)
+
+	const adminEmail, email = "admin@example.com", "user@example.com"
+	for _, address := range []string{adminEmail, email} {
+		if err := service.CreateUser(address, "correct horse battery"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	service.SetUserRole(adminEmail, models.RoleAdmin)
+	login := h.Session.New()
+	login.SetValue("user", adminEmail)
+	login.SetValue("kind", loginSessionKind)
+	h.Session.Set(login.ID, login)
+
+	router := gin.New()
+	group := router.Group("/admin", admin.RequireAdmin())
+	group.POST("/users/:email/confirm", admin.HandleConfirmUser)
+	group.POST("/users/:email/disable", admin.HandleDisableUser)
+	group.POST("/users/:email/enable", admin.HandleEnableUser)
+	group.POST("/users/:email/role", admin.HandleSetRole)
+	group.POST("/users/:email/unlock", admin.HandleUnlockUser)
+	group.POST("/invites", admin.HandleCreateInvite)
+	group.DELETE("/invites/:code", admin.HandleDeleteInvite)
+
+	for _, test := range []struct {
+		path      string
+		eventType string
+	}{
+		{"/confirm", models.AuditAdminConfirm},
+		{"/disable", models.AuditAdminDisable},
+		{"/enable", models.AuditAdminEnable},
+		{"/role?role=" + models.RoleAdmin, models.AuditAdminRole},
+		{"/unlock", models.AuditAdminUnlock},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/admin/users/"+email+test.path, nil)
+		req.AddCookie(&http.Cookie{Name: loginCookieName, Value: login.ID})
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s = %d %s", test.path, w.Code, w.Body.String())
+			continue
+		}
+
+		events, err := service.AuditEvents(models.AuditFilter{Type: test.eventType}, 0)
+		if err != nil || len(events) != 1 {
+			t.Errorf("%s: %d %s events, %v", test.path, len(events), test.eventType, err)
+			continue
+		}
+		if event := events[0]; event.Actor != adminEmail || event.Subject != email || event.Outcome != models.AuditSuccess {
+			t.Errorf("%s: event = %+v", test.path, event)
+		}
+	}
+	req := httptest.NewRequest(http.MethodPost, "/admin/invites", nil)
+	req.AddCookie(&http.Cookie{Name: loginCookieName, Value: login.ID})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	var created struct {
+		Data struct {
+			Code string `json:"code"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &created); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("creating an invite = %d %s", w.Code, w.Body.String())
+	}
+	code := created.Data.Code
+	req = httptest.NewRequest(http.MethodDelete, "/admin/invites/"+code, nil)
+	req.AddCookie(&http.Cookie{Name: loginCookieName, Value: login.ID})
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("deleting an invite = %d %s", w.Code, w.Body.String())
+	}
+	for _, eventType := range []string{models.AuditAdminInviteCreate, models.AuditAdminInviteDelete} {
+		events, err := service.AuditEvents(models.AuditFilter{Type: eventType}, 0)
+		if err != nil || len(events) != 1 {
+			t.Errorf("%d %s events, %v", len(events), eventType, err)
+			continue
+		}
+		if event := events[0]; event.Actor != adminEmail || event.Subject != code || event.Outcome != models.AuditSuccess {
+			t.Errorf("%s event = %+v", eventType, event)
+		}
+	}
+}
@@ -1,15 +1,16 @@
 package handlers
 
 import (
-    "crypto/rand"
-    "encoding/base64"
     "encoding/json"
+    "errors"
     "fmt"
     "io/ioutil"
     "net/http"
     "os"
     "path/filepath"
 
+    "github.com/c4gt/tornado-nginx-go-backend/internal/session"
+    "github.com/c4gt/tornado-nginx-go-backend/internal/storage"
     "github.com/gin-gonic/gin"
 )
 
@@ -39,7 +40,7 @@ func (h *AppHandler) HandleLanding(c *gin.Context) {
         "debug": h.handler.Config.Environment == "development",
     }
     
-    c.HTML(http.StatusOK, "landing-page.html", templateData)
+    renderHTML(c, http.StatusOK, "landing-page.html", templateData)
 }
 
 // HandleGoogleVerification handles Google verification files
@@ -49,8 +50,18 @@ func (h *AppHandler) HandleGoogleVerification(c *gin.Context) {
     if len(slug) > 0 && slug[0] == '/' {
         slug = slug[1:]
     }
+
+    // Only verification pages may be rendered, not any template by name
+    if !googleVerificationPattern.MatchString(slug) {
+        c.String(http.StatusNotFound, "Not found")
+        return
+    }
+    if _, err := os.Stat(filepath.Join(h.handler.Config.TemplatesPath, slug)); err != nil {
+        c.String(http.StatusNotFound, "Not found")
+        return
+    }
     
-    c.HTML(http.StatusOK, slug, gin.H{})
+    renderHTML(c, http.StatusOK, slug, gin.H{})
 }
 
 // HandleAmazonWebApp handles the Amazon web app routes
@@ -66,11 +77,13 @@ func (h *AppHandler) HandleAmazonWebApp(c *gin.Context) {
         return
     }
 
-    // Get or create session
-    sessionID := h.getOrCreateSession(c, param1)
+    // The app name and file name are used in file system and storage paths
+    if !checkAppName(c, param1) || !checkFileNames(c, param2) {
+        return
+    }
 
     if param2 == "index.html" {
-        h.handleWebAppIndex(c, param1, paramCode, sessionID, user)
+        h.handleWebAppIndex(c, param1, paramCode, user)
     } else if param2 == "appsplash.png" {
         h.handleAppSplash(c, param1)
     } else {
@@ -78,27 +91,47 @@ func (h *AppHandler) HandleAmazonWebApp(c *gin.Context) {
     }
 }
 
-func (h *AppHandler) handleWebAppIndex(c *gin.Context, appName, paramCode, sessionID, user string) {
+func (h *AppHandler) handleWebAppIndex(c *gin.Context, appName, paramCode, user string) {
     mscPath := "webappTemplates/"
     
-    // Try to load existing spreadsheet data from storage first
+    // Try to load existing spreadsheet data from storage first. Only the
+    // sheet shown is read; the tabs of the others load theirs when opened.
     var mscData []byte
+    var sheets []string
+    sheetName := c.Query("sheet")
     user = h.getCurrentUser(c)
     if user != "" {
-        // Try to load existing file from storage
-        path := []string{"home", user, "securestore", appName, appName + ".msc"}
-        item, err := h.handler.Storage.GetFile(path)
-        if err == nil && item != nil {
-            if dataStr, ok := item.Data.(string); ok {
-                var fileData map[string]interface{}
-                if err := json.Unmarshal([]byte(dataStr), &fileData); err == nil {
-                    if content, exists := fileData["content"]; exists {
-                        if contentStr, ok := content.(string); ok {
-                            mscData = []byte(contentStr)
-                        }
-                    }
+        err := h.handler.withWorkbook(user, appName, appName + ".msc", false, func(f *workbookFile) error {
+            entry := f.current()
+            if sheetName != "" {
+                entry = f.sheet(sheetName)
+            }
+            if entry == nil {
+                return errSheetNotFound
+            }
+            save, err := f.sheetSave(entry)
+            if err != nil {
+                return err
+            }
+            sheetStr, err := bareSheetSave(save)
+            if err != nil {
+                return err
+            }
+            mscData = []byte(sheetStr)
+            sheetName = entry.Name
+            for _, other := range f.manifest.Sheets {
+                if !other.Hidden || other == entry {
+                    sheets = append(sheets, other.Name)
                 }
             }
+            return nil
+        })
+        if errors.Is(err, errSheetNotFound) {
+            c.String(http.StatusNotFound, "Sheet not found")
+            return
+        }
+        if err != nil && !errors.Is(err, storage.ErrNotFound) {
+            fmt.Printf("DEBUG: Failed to load %s/%s.msc: %v\n", appName, appName, err)
         }
     }
 
@@ -150,28 +183,38 @@ func (h *AppHandler) handleWebAppIndex(c *gin.Context, appName, paramCode, sessi
         }
     }
 
+    // The tabs are the sheets stored. A spreadsheet not saved yet has one,
+    // named by the first footer when it is first saved.
+    if len(sheets) == 0 {
+        sheetName = "Sheet1"
+        if len(footers) > 0 && checkSheetName(footers[0]) == nil {
+            sheetName = footers[0]
+        }
+        sheets = []string{sheetName}
+    }
+
     // Get session and set app info
-    session := h.handler.Session.GetOrCreate(sessionID)
-    session.SetValue("appName", appName)
-    session.SetValue("appUrl", c.Request.RequestURI)
-    session.SetValue("user", user)
-    h.handler.Session.Set(sessionID, session)
+    appSession := h.appSession(c, appName, user)
+    appSession.SetValue("appName", appName)
+    appSession.SetValue("appUrl", c.Request.RequestURI)
+    h.handler.Session.Set(appSession.ID, appSession)
 
     // Check dropbox login status
     dbLogin := 0
-    if login, exists := session.GetString("dbLogin"); exists && login == "1" {
+    if login, exists := appSession.GetString("dbLogin"); exists && login == "1" {
         dbLogin = 1
     }
 
     // Render template
-    c.HTML(http.StatusOK, "amazonwebapp.html", gin.H{
+    renderHTML(c, http.StatusOK, "amazonwebapp.html", gin.H{
         "fname":         appName,
         "sheetstr":      string(mscData),
         "sheetmscestr":  "",
         "appjsfiles":    "",
         "appstylefiles": "",
-        "sheets":        footers,
-        "sessionid":     sessionID,
+        "sheets":        sheets,
+        "sheet":         sheetName,
+        "sessionid":     appSession.ID,
         "dbLogin":       dbLogin,
         "user":          user,
         "storage":       h.handler.Config.StorageBackend,
@@ -206,79 +249,57 @@ func (h *AppHandler) handleStaticFile(c *gin.Context, filename string) {
     c.File(staticPath)
 }
 
-func (h *AppHandler) getOrCreateSession(c *gin.Context, appName string) string {
+// lookupAppSession returns the browser's session for an app. IDs the server
+// does not know, and sessions of other apps, are not accepted.
+func (h *AppHandler) lookupAppSession(c *gin.Context, appName string) (*session.Session, bool) {
     sessionID, err := c.Cookie("session")
-    cookieSessionPath := "/browser/" + appName
-
     if err != nil || sessionID == "" {
-        // Create new session
-        sessionID = h.generateRandomString(16)
-        c.SetCookie("session", sessionID, 3600*24, cookieSessionPath, "", false, true)
-        session := h.handler.Session.GetOrCreate(sessionID)
-        h.handler.Session.Set(sessionID, session)
-        return sessionID
+        return nil, false
     }
 
-    // Check if session exists and is valid
-    session, exists := h.handler.Session.Get(sessionID)
+    appSession, exists := h.handler.Session.Get(sessionID)
     if !exists {
-        // Session doesn't exist, create new one
-        sessionID = h.generateRandomString(16)
-        c.SetCookie("session", sessionID, 3600*24, cookieSessionPath, "", false, true)
-        session = h.handler.Session.GetOrCreate(sessionID)
-        h.handler.Session.Set(sessionID, session)
-        return sessionID
+        return nil, false
     }
-
-    // Check if session is for the right app
-    if sessionAppName, exists := session.GetString("appName"); exists && sessionAppName != appName {
-        // Wrong app, create new session
-        sessionID = h.generateRandomString(16)
-        c.SetCookie("session", sessionID, 3600*24, cookieSessionPath, "", false, true)
-        session = h.handler.Session.GetOrCreate(sessionID)
-        h.handler.Session.Set(sessionID, session)
-        return sessionID
+    if sessionAppName, exists := appSession.GetString("appName"); exists && sessionAppName != appName {
+        return nil, false
     }
-
-    return sessionID
+    return appSession, true
 }
 
-func (h *AppHandler) generateRandomString(length int) string {
-    // Try to generate unique ID
-    for i := 0; i < 100; i++ {
-        bytes := make([]byte, length)
-        rand.Read(bytes)
-        id := base64.URLEncoding.EncodeToString(bytes)[:length]
-        
-        // Check if ID already exists
-        if _, exists := h.handler.Session.Get(id); !exists {
-            return id
+// appSession returns the browser's session for an app bound to user, who
+// may be "" when nobody is signed in. A session of another user is never
+// reused, and a session is given a new ID when it becomes bound to a user,
+// so an ID planted in the browser beforehand is worthless.
+func (h *AppHandler) appSession(c *gin.Context, appName, user string) *session.Session {
+    appSession, exists := h.lookupAppSession(c, appName)
+    if exists {
+        owner, _ := appSession.GetString("user")
+        switch {
+        case owner == user:
+            return appSession
+        case owner == "":
+            appSession = h.handler.Session.Regenerate(appSession)
+        default:
+            exists = false
         }
     }
-    
-    // Fallback if all attempts failed
-    bytes := make([]byte, length)
-    rand.Read(bytes)
-    return base64.URLEncoding.EncodeToString(bytes)[:length]
-}
-
-func (h *AppHandler) getCurrentUser(c *gin.Context) string {
-    userCookie, err := c.Cookie("user")
-    if err != nil {
-        return ""
+    if !exists {
+        appSession = h.handler.Session.New()
     }
 
-    // Handle both JSON format and plain text format
-    if len(userCookie) > 0 && userCookie[0] == '"' && userCookie[len(userCookie)-1] == '"' {
-        // JSON format
-        var user string
-        err = json.Unmarshal([]byte(userCookie), &user)
-        if err != nil {
-            return ""
-        }
-        return user
+    if user != "" {
+        appSession.SetValue("user", user)
+        h.handler.Session.Set(appSession.ID, appSession)
     }
-    
-    // Plain text format
-    return userCookie
+    h.setSessionCookie(c, appName, appSession.ID)
+    return appSession
+}
+
+func (h *AppHandler) setSessionCookie(c *gin.Context, appName, sessionID string) {
+    h.handler.setCookie(c, "session", sessionID, h.handler.sessionCookieAge(), "/browser/"+appName)
+}
+
+func (h *AppHandler) getCurrentUser(c *gin.Context) string {
+    return h.handler.CurrentUser(c)
 }
@@ -0,0 +1,158 @@
+package handlers
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/c4gt/tornado-nginx-go-backend/internal/models"
+    "github.com/gin-gonic/gin"
+)
+
+// auditPruneInterval is how often audit events past their retention are removed
+const auditPruneInterval = 24 * time.Hour
+
+// audit records an authentication event with the client's address and user
+// agent. The signed-in user is the actor unless the event names one.
+func (h *Handler) audit(c *gin.Context, event *models.AuditEvent) {
+    if h.authService == nil {
+        return
+    }
+    if event.Actor == "" {
+        event.Actor = h.CurrentUser(c)
+    }
+    event.IP = c.ClientIP()
+    event.UserAgent = c.Request.UserAgent()
+    h.authService.RecordAuditEvent(event)
+}
+
+// auditResult records the outcome of an action, with the error as the reason
+// when it failed
+func (h *Handler) auditResult(c *gin.Context, event *models.AuditEvent, err error) {
+    event.Outcome = models.AuditSuccess
+    if err != nil {
+        event.Outcome = models.AuditFailure
+        event.Reason = err.Error()
+    }
+    h.audit(c, event)
+}
+
+// HandleAuditLog queries the authentication audit log, newest first. It
+// accepts from, to, type, outcome, user, ip and limit parameters.
+func (h *AdminHandler) HandleAuditLog(c *gin.Context) {
+    filter, ok := auditFilter(c)
+    if !ok {
+        return
+    }
+    limit, _ := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultAdminPageSize)))
+    if limit <= 0 || limit > maxAdminPageSize {
+        limit = defaultAdminPageSize
+    }
+
+    events, err := h.service.AuditEvents(filter, limit)
+    if err != nil {
+        h.respond(c, err)
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{
+        "data":   events,
+        "result": "ok",
+    })
+}
+
+// HandleAuditExport downloads every audit event matching the same filters
+// as HandleAuditLog as JSON lines, oldest first. Events are written as they
+// are read rather than gathered first, so the export can be any size.
+func (h *AdminHandler) HandleAuditExport(c *gin.Context) {
+    filter, ok := auditFilter(c)
+    if !ok {
+        return
+    }
+
+    // The headers are held back until the first event, so that a failure
+    // to read the log can still be answered as an error
+    filename := fmt.Sprintf("audit-%s.jsonl", time.Now().UTC().Format("20060102-150405"))
+    started := false
+    start := func() {
+        if !started {
+            c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+            c.Header("Content-Type", "application/x-ndjson")
+            c.Status(http.StatusOK)
+            started = true
+        }
+    }
+
+    encoder := json.NewEncoder(c.Writer)
+    err := h.service.EachAuditEvent(filter, func(event *models.AuditEvent) error {
+        start()
+        return encoder.Encode(event)
+    })
+    switch {
+    case err != nil && !started:
+        h.respond(c, err)
+    case err != nil:
+        log.Printf("Audit export aborted: %v", err)
+    default:
+        start()
+    }
+}
+
+func (h *AdminHandler) runAuditPruner(stop <-chan struct{}) {
+    ticker := time.NewTicker(auditPruneInterval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-ticker.C:
+            h.service.PruneAuditLog()
+        case <-stop:
+            return
+        }
+    }
+}
+
+// auditFilter reads the audit log filter from the query string. Times are
+// RFC 3339 or dates, where a date as "to" includes the whole day.
+func auditFilter(c *gin.Context) (models.AuditFilter, bool) {
+    filter := models.AuditFilter{
+        Type:    c.Query("type"),
+        Outcome: c.Query("outcome"),
+        User:    c.Query("user"),
+        IP:      c.Query("ip"),
+    }
+
+    for _, bound := range []struct {
+        name     string
+        target   *time.Time
+        endOfDay bool
+    }{
+        {"from", &filter.From, false},
+        {"to", &filter.To, true},
+    } {
+        value := c.Query(bound.name)
+        if value == "" {
+            continue
+        }
+        at, err := time.Parse(time.RFC3339, value)
+        if err != nil {
+            day, dayErr := time.Parse("2006-01-02", value)
+            if dayErr != nil {
+                c.JSON(http.StatusBadRequest, gin.H{
+                    "data":   "invalid " + bound.name + " time: " + value,
+                    "result": "fail",
+                })
+                return filter, false
+            }
+            at = day
+            if bound.endOfDay {
+                at = day.Add(24 * time.Hour)
+            }
+        }
+        *bound.target = at
+    }
+    return filter, true
+}
@@ -1,14 +1,16 @@
 package handlers
 
 import (
-	"crypto/rand"
-	"encoding/base64"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
 
 	"github.com/c4gt/tornado-nginx-go-backend/internal/auth"
+	"github.com/c4gt/tornado-nginx-go-backend/internal/config"
 	"github.com/c4gt/tornado-nginx-go-backend/internal/email"
+	"github.com/c4gt/tornado-nginx-go-backend/internal/models"
 	"github.com/gin-gonic/gin"
 )
 
@@ -29,6 +31,7 @@ type AuthRequest struct {
 	Action   string `json:"action" form:"action"`
 	Email    string `json:"email" form:"email"`
 	Password string `json:"pwd" form:"pwd"`
+	Invite   string `json:"invite" form:"invite"`
 }
 
 // HandleAuth handles the /iauth endpoint
@@ -43,7 +46,7 @@ func (h *AuthHandler) HandleAuth(c *gin.Context) {
 	case "login":
 		h.handleLogin(c, req.Email, req.Password)
 	case "register":
-		h.handleRegister(c, req.Email, req.Password)
+		h.handleRegister(c, req.Email, req.Password, req.Invite)
 	case "logout":
 		h.HandleLogout(c)
 	default:
@@ -71,6 +74,7 @@ func (h *AuthHandler) HandleRegister(c *gin.Context) {
 	var req struct {
 		Email    string `json:"email" form:"email"`
 		Password string `json:"password" form:"password"`
+		Invite   string `json:"invite" form:"invite"`
 	}
 
 	if err := c.ShouldBind(&req); err != nil {
@@ -78,12 +82,20 @@ func (h *AuthHandler) HandleRegister(c *gin.Context) {
 		return
 	}
 
-	h.handleRegister(c, req.Email, req.Password)
+	h.handleRegister(c, req.Email, req.Password, req.Invite)
 }
 
 // HandleLogout handles logout requests
 func (h *AuthHandler) HandleLogout(c *gin.Context) {
     fmt.Printf("DEBUG: Logging out user\n")
+    if user := h.getCurrentUser(c); user != "" {
+        h.handler.audit(c, &models.AuditEvent{
+            Type:    models.AuditLogout,
+            Outcome: models.AuditSuccess,
+            Actor:   user,
+            Subject: user,
+        })
+    }
     h.clearCurrentUser(c)
     
     // Check if it's a JSON request
@@ -97,14 +109,16 @@ func (h *AuthHandler) HandleLogout(c *gin.Context) {
 }
 
 func (h *AuthHandler) handleLogin(c *gin.Context, email, password string) {
+    email = auth.NormalizeEmail(email)
     if !auth.ValidateEmail(email) {
+        h.audit(c, models.AuditLogin, email, "invalid_email")
         if c.GetHeader("Content-Type") == "application/json" {
             c.JSON(http.StatusBadRequest, gin.H{
                 "data":   "usererror",
                 "result": "fail",
             })
         } else {
-            c.HTML(http.StatusBadRequest, "login.html", gin.H{
+            renderHTML(c, http.StatusBadRequest, "login.html", gin.H{
                 "user": nil,
                 "error": "Please enter a valid email address",
             })
@@ -112,13 +126,49 @@ func (h *AuthHandler) handleLogin(c *gin.Context, email, password string) {
         return
     }
 
-    authenticated, err := h.service.AuthenticateUser(email, password)
+    // Former addresses keep working for a while after an email change
+    email = h.service.ResolveEmail(email)
+
+    authenticated, err := h.service.AuthenticateUserFrom(email, password, c.ClientIP())
+    var throttleErr *auth.ThrottleError
+    if errors.As(err, &throttleErr) {
+        retryAfter := int(throttleErr.RetryAfter.Seconds()) + 1
+        c.Header("Retry-After", strconv.Itoa(retryAfter))
+
+        data := "throttled"
+        errorMsg := "Too many failed login attempts, please wait before trying again"
+        if throttleErr.Locked {
+            data = "locked"
+            errorMsg = "Account temporarily locked after too many failed login attempts"
+        }
+        h.audit(c, models.AuditLogin, email, data)
+
+        if c.GetHeader("Content-Type") == "application/json" {
+            c.JSON(http.StatusTooManyRequests, gin.H{
+                "data":        data,
+                "result":      "fail",
+                "retry_after": retryAfter,
+            })
+        } else {
+            renderHTML(c, http.StatusTooManyRequests, "login.html", gin.H{
+                "user": nil,
+                "error": errorMsg,
+            })
+        }
+        return
+    }
     if err != nil {
-        exists, _ := h.service.UserExists(email)
+        // Unknown addresses get the same answer as wrong passwords, only
+        // the audit log tells them apart
         errorMsg := "Authentication failed"
-        if !exists {
-            errorMsg = "User does not exist"
+        reason := err.Error()
+        if errors.Is(err, auth.ErrUserNotFound) {
+            reason = "unknown_user"
+        } else if errors.Is(err, auth.ErrUserDisabled) {
+            errorMsg = "This account has been disabled"
+            reason = "disabled"
         }
+        h.audit(c, models.AuditLogin, email, reason)
         
         if c.GetHeader("Content-Type") == "application/json" {
             c.JSON(http.StatusUnauthorized, gin.H{
@@ -126,7 +176,7 @@ func (h *AuthHandler) handleLogin(c *gin.Context, email, password string) {
                 "result": "fail",
             })
         } else {
-            c.HTML(http.StatusUnauthorized, "login.html", gin.H{
+            renderHTML(c, http.StatusUnauthorized, "login.html", gin.H{
                 "user": nil,
                 "error": errorMsg,
             })
@@ -136,115 +186,129 @@ func (h *AuthHandler) handleLogin(c *gin.Context, email, password string) {
 
     if authenticated {
         h.setCurrentUser(c, email)
+        h.audit(c, models.AuditLogin, email, "")
         if c.GetHeader("Content-Type") == "application/json" {
-            c.JSON(http.StatusOK, gin.H{
+            response := gin.H{
                 "data":   "success",
                 "result": "ok",
-            })
+            }
+            // Let the client offer to cancel a scheduled account deletion
+            if pending, _ := h.service.PendingDeletion(email); pending != nil {
+                response["deletion"] = deletionView(pending)
+            }
+            c.JSON(http.StatusOK, response)
         } else {
             // Redirect to landing page instead of /browser
             c.Redirect(http.StatusFound, "/browser")
         }
     } else {
+        h.audit(c, models.AuditLogin, email, "bad_password")
         if c.GetHeader("Content-Type") == "application/json" {
             c.JSON(http.StatusUnauthorized, gin.H{
                 "data":   "authfail",
                 "result": "fail",
             })
         } else {
-            c.HTML(http.StatusUnauthorized, "login.html", gin.H{
+            renderHTML(c, http.StatusUnauthorized, "login.html", gin.H{
                 "user": nil,
-                "error": "Invalid email or password",
+                "error": "Authentication failed",
             })
         }
     }
 }
 
-func (h *AuthHandler) handleRegister(c *gin.Context, email, password string) {
+func (h *AuthHandler) handleRegister(c *gin.Context, email, password, invite string) {
+    // Accounts are identified by the normalized address
+    email = auth.NormalizeEmail(email)
     fmt.Printf("DEBUG: Starting registration for email: %s\n", email)
     
     if !auth.ValidateEmail(email) {
         fmt.Printf("DEBUG: Email validation failed for: %s\n", email)
+        h.audit(c, models.AuditRegister, email, "invalid_email")
         if c.GetHeader("Content-Type") == "application/json" {
             c.JSON(http.StatusBadRequest, gin.H{
                 "data":   "usererror",
                 "result": "fail",
             })
         } else {
-            c.HTML(http.StatusBadRequest, "register.html", gin.H{
-                "user": nil,
-                "error": "Please enter a valid email address",
-            })
+            h.renderRegister(c, http.StatusBadRequest, "Please enter a valid email address", invite)
         }
         return
     }
 
+    // Checked before anything else so that people who may not register
+    // cannot find out which addresses have accounts
+    if h.registrationRefused(c, email, invite, h.service.CheckRegistration(email, invite)) {
+        return
+    }
+
     fmt.Printf("DEBUG: Checking if user exists: %s\n", email)
-    exists, err := h.service.UserExists(email)
+    exists, err := h.service.EmailInUse(email)
     if err != nil {
         fmt.Printf("DEBUG: Error checking if user exists: %v\n", err)
+        h.audit(c, models.AuditRegister, email, err.Error())
         if c.GetHeader("Content-Type") == "application/json" {
             c.JSON(http.StatusInternalServerError, gin.H{
                 "data":   "error",
                 "result": "fail",
             })
         } else {
-            c.HTML(http.StatusInternalServerError, "register.html", gin.H{
-                "user": nil,
-                "error": "Server error occurred: " + err.Error(),
-            })
+            h.renderRegister(c, http.StatusInternalServerError, "Server error occurred: " + err.Error(), invite)
         }
         return
     }
 
     if exists {
         fmt.Printf("DEBUG: User already exists: %s\n", email)
+        h.audit(c, models.AuditRegister, email, "exists")
         if c.GetHeader("Content-Type") == "application/json" {
             c.JSON(http.StatusConflict, gin.H{
                 "data":   "userexists",
                 "result": "fail",
             })
         } else {
-            c.HTML(http.StatusConflict, "register.html", gin.H{
-                "user": nil,
-                "error": "User already exists",
+            h.renderRegister(c, http.StatusConflict, "User already exists", invite)
+        }
+        return
+    }
+
+    if err := h.service.ValidatePassword(email, password); err != nil {
+        fmt.Printf("DEBUG: Password rejected for %s: %v\n", email, err)
+        h.audit(c, models.AuditRegister, email, "password_policy")
+        if c.GetHeader("Content-Type") == "application/json" {
+            c.JSON(http.StatusBadRequest, gin.H{
+                "data":    "passworderror",
+                "message": err.Error(),
+                "result":  "fail",
             })
+        } else {
+            h.renderRegister(c, http.StatusBadRequest, err.Error(), invite)
         }
         return
     }
 
+    if h.registrationRefused(c, email, invite, h.service.ClaimRegistration(email, invite)) {
+        return
+    }
+
     fmt.Printf("DEBUG: Creating user: %s\n", email)
     err = h.service.CreateUser(email, password)
     if err != nil {
         fmt.Printf("DEBUG: Error creating user: %v\n", err)
+        h.audit(c, models.AuditRegister, email, err.Error())
         if c.GetHeader("Content-Type") == "application/json" {
             c.JSON(http.StatusInternalServerError, gin.H{
                 "data":   "error",
                 "result": "fail",
             })
         } else {
-            c.HTML(http.StatusInternalServerError, "register.html", gin.H{
-                "user": nil,
-                "error": "Failed to create user: " + err.Error(),
-            })
+            h.renderRegister(c, http.StatusInternalServerError, "Failed to create user: " + err.Error(), invite)
         }
         return
     }
 
-    fmt.Printf("DEBUG: Creating user home directory\n")
-    // Create user home directory and required directories
-    userHomePath := []string{"home", email}
-    err = h.handler.Storage.CreateDir(userHomePath)
-    if err != nil {
-        fmt.Printf("DEBUG: Failed to create user home directory (non-fatal): %v\n", err)
-    }
-
-    // Create user's securestore directory for application data
-    secureStorePath := []string{"home", email, "securestore"}
-    err = h.handler.Storage.CreateDir(secureStorePath)
-    if err != nil {
-        fmt.Printf("DEBUG: Failed to create securestore directory (non-fatal): %v\n", err)
-    }
+    h.createUserHome(email)
+    h.audit(c, models.AuditRegister, email, "")
 
     fmt.Printf("DEBUG: Setting current user and completing registration\n")
     h.setCurrentUser(c, email)
@@ -260,74 +324,137 @@ func (h *AuthHandler) handleRegister(c *gin.Context, email, password string) {
     fmt.Printf("DEBUG: Registration completed successfully for: %s\n", email)
 }
 
+// registrationRefused responds and returns true when the registration policy
+// refused the registration or could not be checked
+func (h *AuthHandler) registrationRefused(c *gin.Context, email, invite string, err error) bool {
+    if err == nil {
+        return false
+    }
+    fmt.Printf("DEBUG: Registration refused for %s: %v\n", email, err)
+
+    status, data, errorMsg := http.StatusInternalServerError, "error", "Server error occurred: "+err.Error()
+    reason := err.Error()
+    var refused *auth.RegistrationError
+    if errors.As(err, &refused) {
+        status, data, errorMsg = http.StatusForbidden, refused.Reason, refused.Message
+        reason = refused.Reason
+    }
+    h.audit(c, models.AuditRegister, email, reason)
+
+    if c.GetHeader("Content-Type") == "application/json" {
+        c.JSON(status, gin.H{
+            "data":    data,
+            "message": errorMsg,
+            "result":  "fail",
+        })
+    } else {
+        h.renderRegister(c, status, errorMsg, invite)
+    }
+    return true
+}
+
+// createUserHome creates the user's home and securestore directories
+func (h *AuthHandler) createUserHome(email string) {
+    fmt.Printf("DEBUG: Creating user home directory\n")
+    userHomePath := auth.HomePath(email)
+    err := h.handler.Storage.CreateDir(userHomePath)
+    if err != nil {
+        fmt.Printf("DEBUG: Failed to create user home directory (non-fatal): %v\n", err)
+    }
+
+    // Create user's securestore directory for application data
+    secureStorePath := auth.HomePath(email, "securestore")
+    err = h.handler.Storage.CreateDir(secureStorePath)
+    if err != nil {
+        fmt.Printf("DEBUG: Failed to create securestore directory (non-fatal): %v\n", err)
+    }
+}
+
 func (h *AuthHandler) clearCurrentUser(c *gin.Context) {
     fmt.Printf("DEBUG: Clearing user cookies\n")
-    c.SetCookie("user", "", -1, "/", "", false, true)
-    c.SetCookie("session", "", -1, "/", "", false, true)
+    h.handler.endLoginSession(c)
+    h.handler.setCookie(c, "user", "", -1, "/")
+    h.handler.setCookie(c, "session", "", -1, "/")
 }
 
 // HandlePasswordResetGet handles GET requests for password reset
 func (h *AuthHandler) HandlePasswordResetGet(c *gin.Context) {
-	user := c.Query("u")
+	user := auth.NormalizeEmail(c.Query("u"))
 	dongle := c.Query("d")
 
-	if user == "" || dongle == "" {
-		c.HTML(http.StatusBadRequest, "pwreset-invalid.html", gin.H{
+	if user == "" || dongle == "" || h.service.CheckPasswordReset(user, dongle) != nil {
+		renderHTML(c, http.StatusBadRequest, "pwreset-invalid.html", gin.H{
 			"user":    nil,
 			"reguser": user,
 		})
 		return
 	}
 
-	userDongle, err := h.service.GetUserDongle(user)
-	if err != nil || userDongle != dongle {
-		c.HTML(http.StatusBadRequest, "pwreset-invalid.html", gin.H{
-			"user":    nil,
-			"reguser": user,
-		})
-		return
-	}
-
-	c.HTML(http.StatusOK, "pwreset.html", gin.H{
+	renderHTML(c, http.StatusOK, "pwreset.html", gin.H{
 		"user":    nil,
 		"reguser": user,
+		"dongle":  dongle,
 	})
 }
 
-// HandlePasswordResetPost handles POST requests for password reset
+// HandlePasswordResetPost handles POST requests for password reset. The new
+// password is only set for the holder of the token from the emailed link.
 func (h *AuthHandler) HandlePasswordResetPost(c *gin.Context) {
 	var req struct {
 		Email    string `json:"email" form:"email"`
 		Password string `json:"password" form:"password"`
+		Dongle   string `json:"d" form:"d"`
 	}
 
 	if err := c.ShouldBind(&req); err != nil {
-		c.HTML(http.StatusBadRequest, "pwreset-invalid.html", gin.H{
+		renderHTML(c, http.StatusBadRequest, "pwreset-invalid.html", gin.H{
 			"user":    nil,
 			"reguser": req.Email,
 		})
 		return
 	}
+	req.Email = auth.NormalizeEmail(req.Email)
+	// Forms posted back to the link keep the token in the query
+	if req.Dongle == "" {
+		req.Dongle = c.Query("d")
+	}
 
-	exists, err := h.service.UserExists(req.Email)
-	if err != nil || !exists {
-		c.HTML(http.StatusBadRequest, "lostpassword-baduser.html", gin.H{
+	err := h.service.ResetPassword(req.Email, req.Dongle, req.Password)
+	var policyErr *auth.PasswordPolicyError
+	if errors.As(err, &policyErr) {
+		h.audit(c, models.AuditPasswordReset, req.Email, "password_policy")
+		renderHTML(c, http.StatusBadRequest, "pwreset.html", gin.H{
+			"user":    nil,
+			"reguser": req.Email,
+			"dongle":  req.Dongle,
+			"error":   err.Error(),
+		})
+		return
+	}
+	if errors.Is(err, auth.ErrPasswordResetInvalid) {
+		h.audit(c, models.AuditPasswordReset, req.Email, "invalid_token")
+		renderHTML(c, http.StatusBadRequest, "pwreset-invalid.html", gin.H{
 			"user":    nil,
 			"reguser": req.Email,
 		})
 		return
 	}
-
-	err = h.service.UpdatePassword(req.Email, req.Password)
 	if err != nil {
-		c.HTML(http.StatusInternalServerError, "pwreset-invalid.html", gin.H{
+		h.audit(c, models.AuditPasswordReset, req.Email, err.Error())
+		renderHTML(c, http.StatusInternalServerError, "pwreset-invalid.html", gin.H{
 			"user":    nil,
 			"reguser": req.Email,
 		})
 		return
 	}
 
-	c.HTML(http.StatusOK, "pwreset-ok.html", gin.H{
+	// Whoever knew the old password must not stay signed in
+	if revoked := h.handler.revokeUserSessions(req.Email); revoked > 0 {
+		fmt.Printf("DEBUG: Revoked %d sessions of %s after password reset\n", revoked, req.Email)
+	}
+	h.audit(c, models.AuditPasswordReset, req.Email, "")
+
+	renderHTML(c, http.StatusOK, "pwreset-ok.html", gin.H{
 		"user":    nil,
 		"reguser": req.Email,
 	})
@@ -336,7 +463,7 @@ func (h *AuthHandler) HandlePasswordResetPost(c *gin.Context) {
 // HandleLostPassword handles lost password requests
 func (h *AuthHandler) HandleLostPassword(c *gin.Context) {
 	if c.Request.Method == "GET" {
-		c.HTML(http.StatusOK, "lostpassword.html", gin.H{
+		renderHTML(c, http.StatusOK, "lostpassword.html", gin.H{
 			"user": nil,
 		})
 		return
@@ -347,15 +474,17 @@ func (h *AuthHandler) HandleLostPassword(c *gin.Context) {
 	}
 
 	if err := c.ShouldBind(&req); err != nil {
-		c.HTML(http.StatusBadRequest, "lostpassword.html", gin.H{
+		renderHTML(c, http.StatusBadRequest, "lostpassword.html", gin.H{
 			"user": nil,
 		})
 		return
 	}
+	req.Email = auth.NormalizeEmail(req.Email)
 
 	exists, err := h.service.UserExists(req.Email)
 	if err != nil || !exists {
-		c.HTML(http.StatusBadRequest, "lostpassword-baduser.html", gin.H{
+		h.audit(c, models.AuditPasswordResetRequest, req.Email, "unknown_user")
+		renderHTML(c, http.StatusBadRequest, "lostpassword-baduser.html", gin.H{
 			"user":    nil,
 			"reguser": req.Email,
 		})
@@ -363,10 +492,9 @@ func (h *AuthHandler) HandleLostPassword(c *gin.Context) {
 	}
 
 	// Generate dongle and send email
-	dongle := h.generateRandomString(20)
-	err = h.service.SetUserDongle(req.Email, dongle)
+	dongle, err := h.service.StartPasswordReset(req.Email)
 	if err != nil {
-		c.HTML(http.StatusInternalServerError, "lostpassword.html", gin.H{
+		renderHTML(c, http.StatusInternalServerError, "lostpassword.html", gin.H{
 			"user": nil,
 		})
 		return
@@ -374,14 +502,19 @@ func (h *AuthHandler) HandleLostPassword(c *gin.Context) {
 
 	// Send password reset email
 	err = h.sendLostPasswordEmail(req.Email, dongle, c.Request.Host)
+	reason := ""
 	if err != nil {
-		c.HTML(http.StatusInternalServerError, "lostpassword.html", gin.H{
+		reason = err.Error()
+	}
+	h.audit(c, models.AuditPasswordResetRequest, req.Email, reason)
+	if err != nil {
+		renderHTML(c, http.StatusInternalServerError, "lostpassword.html", gin.H{
 			"user": nil,
 		})
 		return
 	}
 
-	c.HTML(http.StatusOK, "lostpassword-sentemail.html", gin.H{
+	renderHTML(c, http.StatusOK, "lostpassword-sentemail.html", gin.H{
 		"user":    nil,
 		"reguser": req.Email,
 	})
@@ -390,23 +523,36 @@ func (h *AuthHandler) HandleLostPassword(c *gin.Context) {
 func (h *AuthHandler) setCurrentUser(c *gin.Context, user string) {
     fmt.Printf("DEBUG: Setting current user: '%s'\n", user)
     
-    // Store email directly as cookie value
-    c.SetSameSite(http.SameSiteStrictMode)
-    c.SetCookie("user", user, 3600*24, "/", "", false, true)
+    // The browser only holds the ID of a server-side login session, so the
+    // session can be listed and revoked from elsewhere
+    h.handler.startLoginSession(c, user)
     
-    fmt.Printf("DEBUG: User cookie set successfully\n")
+    fmt.Printf("DEBUG: Login session started successfully\n")
 }
 
-func (h *AuthHandler) generateRandomString(length int) string {
-	bytes := make([]byte, length)
-	rand.Read(bytes)
-	return base64.URLEncoding.EncodeToString(bytes)[:length]
+// audit records an attempt by the owner of an email address to sign in,
+// register or reset their password. An empty reason means it succeeded.
+func (h *AuthHandler) audit(c *gin.Context, eventType, email, reason string) {
+	event := &models.AuditEvent{
+		Type:    eventType,
+		Outcome: models.AuditSuccess,
+		Actor:   email,
+		Subject: email,
+		Reason:  reason,
+	}
+	if eventType == models.AuditLogin {
+		event.Method = "password"
+	}
+	if reason != "" {
+		event.Outcome = models.AuditFailure
+	}
+	h.handler.audit(c, event)
 }
 
 func (h *AuthHandler) sendLostPasswordEmail(userEmail, dongle, host string) error {
 	// This would need the email service to be implemented
 	// For now, we'll return nil
-	link := fmt.Sprintf("http://%s/pwreset?u=%s&d=%s", host, userEmail, dongle)
+	link := fmt.Sprintf("http://%s/pwreset?u=%s&d=%s", host, url.QueryEscape(userEmail), url.QueryEscape(dongle))
 	message := email.NewMessage()
 	message.Subject = "Reset Password"
 	message.BodyText = fmt.Sprintf("Please click the following link to reset password for user %s\n%s", userEmail, link)
@@ -417,37 +563,36 @@ func (h *AuthHandler) sendLostPasswordEmail(userEmail, dongle, host string) erro
 }
 
 func (h *AuthHandler) HandleLoginGet(c *gin.Context) {
-    c.HTML(http.StatusOK, "login.html", gin.H{
+    renderHTML(c, http.StatusOK, "login.html", gin.H{
         "user": nil,
         "error": "",
+        "providers": h.loginProviders(),
     })
 }
 
+// loginProviders returns the external sign-in providers shown on the login page
+func (h *AuthHandler) loginProviders() []config.OIDCProviderConfig {
+    if h.handler.OIDC == nil {
+        return nil
+    }
+    return h.handler.OIDC.Providers()
+}
+
 func (h *AuthHandler) HandleRegisterGet(c *gin.Context) {
-    c.HTML(http.StatusOK, "register.html", gin.H{
-        "user": nil,
-        "error": "",
+    h.renderRegister(c, http.StatusOK, "", c.Query("invite"))
+}
+
+// renderRegister shows the registration form, with an invite code field when
+// registration is by invite only
+func (h *AuthHandler) renderRegister(c *gin.Context, status int, errorMsg, invite string) {
+    renderHTML(c, status, "register.html", gin.H{
+        "user":           nil,
+        "error":          errorMsg,
+        "invite":         invite,
+        "inviterequired": h.service.InviteRequired(),
     })
 }
 
-// Update getCurrentUser with debugging
 func (h *AuthHandler) getCurrentUser(c *gin.Context) string {
-    userCookie, err := c.Cookie("user")
-    if err != nil {
-        return ""
-    }
-
-    // Handle both JSON format and plain text format
-    if len(userCookie) > 0 && userCookie[0] == '"' && userCookie[len(userCookie)-1] == '"' {
-        // JSON format
-        var user string
-        err = json.Unmarshal([]byte(userCookie), &user)
-        if err != nil {
-            return ""
-        }
-        return user
-    }
-    
-    // Plain text format
-    return userCookie
+    return h.handler.CurrentUser(c)
 }
@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/c4gt/tornado-nginx-go-backend/internal/auth"
+	"github.com/c4gt/tornado-nginx-go-backend/internal/config"
+	"github.com/c4gt/tornado-nginx-go-backend/internal/session"
+	"github.com/gin-gonic/gin"
+)
+
+func TestPasswordResetRequiresToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	service := auth.NewService(newMemoryStorage())
+	h := &Handler{
+		Config:      &config.Config{},
+		Session:     session.NewManager(),
+		authService: service,
+	}
+	defer h.Session.Close()
+	authHandler := NewAuthHandler(h, service)
+
+	const email, password = "user@example.com", "correct horse battery"
+	if err := service.CreateUser(email, password); err != nil {
+		t.Fatal(err)
+	}
+
+	router := gin.New()
+	router.SetHTMLTemplate(template.Must(template.New("").Parse(
+		`{{define "pwreset.html"}}form{{end}}` +
+			`{{define "pwreset-invalid.html"}}invalid{{end}}` +
+			`{{define "pwreset-ok.html"}}ok{{end}}`)))
+	router.POST("/pwreset", authHandler.HandlePasswordResetPost)
+
+	reset := func(dongle, newPassword string) int {
+		form := url.Values{"email": {email}, "password": {newPassword}}
+		if dongle != "" {
+			form.Set("d", dongle)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/pwreset", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	stillOld := func() bool {
+		ok, err := service.AuthenticateUser(email, password)
+		return ok && err == nil
+	}
+
+	// Knowing the address is not enough
+	if code := reset("", "a different passphrase"); code != http.StatusBadRequest || !stillOld() {
+		t.Fatalf("reset without a token = %d, want 400 and the old password kept", code)
+	}
+
+	dongle, err := service.StartPasswordReset(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := reset("not-"+dongle, "a different passphrase"); code != http.StatusBadRequest || !stillOld() {
+		t.Fatalf("reset with a wrong token = %d, want 400 and the old password kept", code)
+	}
+	// A refused password leaves the token usable
+	if code := reset(dongle, "short"); code != http.StatusBadRequest || !stillOld() {
+		t.Fatalf("reset with a weak password = %d, want 400", code)
+	}
+	if code := reset(dongle, "a different passphrase"); code != http.StatusOK || stillOld() {
+		t.Fatalf("reset with the token = %d, want 200 and the password changed", code)
+	}
+	// Tokens work once
+	if code := reset(dongle, "yet another passphrase"); code != http.StatusBadRequest {
+		t.Errorf("second reset with the same token = %d, want 400", code)
+	}
+}
+
+func TestLoginDoesNotRevealAccounts(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	service := auth.NewService(newMemoryStorage())
+	h := &Handler{
+		Config:      &config.Config{},
+		Session:     session.NewManager(),
+		authService: service,
+	}
+	defer h.Session.Close()
+	authHandler := NewAuthHandler(h, service)
+
+	if err := service.CreateUser("user@example.com", "correct horse battery"); err != nil {
+		t.Fatal(err)
+	}
+
+	router := gin.New()
+	router.SetHTMLTemplate(template.Must(template.New("login.html").Parse(`{{.error}}`)))
+	router.POST("/login", authHandler.HandleLogin)
+
+	login := func(email, remoteAddr string) (int, string) {
+		form := url.Values{"email": {email}, "password": {"wrong password"}}
+		req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code, w.Body.String()
+	}
+
+	// From two addresses, so the first failure does not delay the second
+	knownCode, knownBody := login("user@example.com", "192.0.2.1:1234")
+	unknownCode, unknownBody := login("nobody@example.com", "192.0.2.2:1234")
+	if knownCode != http.StatusUnauthorized || unknownCode != knownCode || unknownBody != knownBody {
+		t.Errorf("unknown address = %d %q, wrong password = %d %q, want the same 401",
+			unknownCode, unknownBody, knownCode, knownBody)
+	}
+}
@@ -0,0 +1,387 @@
+package handlers
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "net/url"
+    "strings"
+    "time"
+
+    "github.com/c4gt/tornado-nginx-go-backend/internal/auth"
+    "github.com/c4gt/tornado-nginx-go-backend/internal/collab"
+    "github.com/c4gt/tornado-nginx-go-backend/internal/models"
+    "github.com/c4gt/tornado-nginx-go-backend/internal/socialcalc"
+    "github.com/c4gt/tornado-nginx-go-backend/internal/storage"
+    "github.com/gin-gonic/gin"
+    "golang.org/x/net/websocket"
+)
+
+type CollabHandler struct {
+    handler *Handler
+    hub     *collab.Hub
+}
+
+func NewCollabHandler(h *Handler) *CollabHandler {
+    return &CollabHandler{
+        handler: h,
+        hub: collab.NewHub(collab.Options{
+            SnapshotInterval: time.Duration(h.Config.CollabSnapshotInterval) * time.Second,
+            SnapshotCommands: h.Config.CollabSnapshotCommands,
+            Validate: func(snapshot string) error {
+                _, err := socialcalc.Parse(snapshot)
+                return err
+            },
+        }),
+    }
+}
+
+// HandleCollab connects an editor of a stored spreadsheet over a WebSocket
+// to the other editors of the same file. Messages are the JSON of
+// collab.Message: the editor sends the commands SocialCalc broadcasts and
+// receives everyone's in the order to execute them, and sends a snapshot of
+// the sheet when asked, which is saved in place of the sheet. Each sheet is
+// edited on its own: ?sheet= names it, and without it editors join the
+// current sheet. Editors of a spreadsheet another user shares connect with
+// ?owner=.
+func (h *CollabHandler) HandleCollab(c *gin.Context) {
+    user := h.handler.WebApp.getCurrentUser(c)
+    if user == "" {
+        c.JSON(http.StatusUnauthorized, gin.H{
+            "data":   "usererror",
+            "result": "fail",
+        })
+        return
+    }
+
+    appName := c.Param("app")
+    fileName := strings.TrimSuffix(c.Param("file"), ".msc")
+    if !checkAppName(c, appName) || !checkFileNames(c, fileName, fileName + ".msc") {
+        return
+    }
+    owner := fileOwner(user, c.Query("owner"))
+    if !h.handler.requireAccess(c, user, owner, appName, models.ShareEditor, fileName) {
+        return
+    }
+    sheetID, err := h.sheetID(owner, appName, fileName, c.Query("sheet"))
+    if errors.Is(err, errSheetNotFound) {
+        c.JSON(http.StatusNotFound, gin.H{
+            "data":   "sheet not found: " + c.Query("sheet"),
+            "result": "fail",
+        })
+        return
+    }
+    if err != nil {
+        fmt.Printf("DEBUG: Collab sheet of %s/%s not found: %v\n", appName, fileName, err)
+        c.JSON(http.StatusInternalServerError, gin.H{
+            "data":   "failed to open file",
+            "result": "fail",
+        })
+        return
+    }
+
+    server := websocket.Server{
+        Handshake: func(config *websocket.Config, req *http.Request) error {
+            return h.checkOrigin(req)
+        },
+        Handler: func(ws *websocket.Conn) {
+            h.serve(ws, user, owner, appName, fileName, sheetID)
+        },
+    }
+    server.ServeHTTP(c.Writer, c.Request)
+}
+
+// checkOrigin refuses WebSockets opened by pages of other sites, which
+// browsers allow with the user's cookies: the origin must be this server or
+// one of the CORS allowed origins
+func (h *CollabHandler) checkOrigin(req *http.Request) error {
+    origin := req.Header.Get("Origin")
+    if origin == "" {
+        // Not a browser
+        return nil
+    }
+    originURL, err := url.Parse(origin)
+    if err != nil {
+        return fmt.Errorf("invalid origin %q", origin)
+    }
+    if strings.EqualFold(originURL.Host, req.Host) {
+        return nil
+    }
+    if public, err := url.Parse(h.handler.Config.PublicURL); err == nil && public.Host != "" &&
+        strings.EqualFold(originURL.Host, public.Host) {
+        return nil
+    }
+    for _, allowed := range h.handler.Config.CORSAllowedOrigins {
+        if strings.TrimSuffix(strings.TrimSpace(allowed), "/") == origin {
+            return nil
+        }
+    }
+    return fmt.Errorf("origin %q not allowed", origin)
+}
+
+// sheetID returns the ID of the sheet named sheetName, or of the current
+// sheet without a name. A file not saved yet gets the ID its first save
+// gives its only sheet.
+func (h *CollabHandler) sheetID(owner, appName, fileName, sheetName string) (string, error) {
+    for _, name := range []string{fileName + ".msc", fileName} {
+        var id string
+        err := h.handler.withWorkbook(owner, appName, name, false, func(f *workbookFile) error {
+            entry := f.current()
+            if sheetName != "" {
+                entry = f.sheet(sheetName)
+            }
+            if entry == nil {
+                return errSheetNotFound
+            }
+            id = entry.ID
+            return nil
+        })
+        if errors.Is(err, storage.ErrNotFound) {
+            continue
+        }
+        return id, err
+    }
+    if sheetName != "" {
+        return "", errSheetNotFound
+    }
+    return "sheet1", nil
+}
+
+func (h *CollabHandler) serve(ws *websocket.Conn, user, owner, appName, fileName, sheetID string) {
+    defer ws.Close()
+    ws.MaxPayloadBytes = h.handler.Config.CollabMaxMessageSize
+
+    document := &collabDocument{
+        handler: h.handler,
+        owner:   owner,
+        app:     appName,
+        file:    fileName,
+        sheet:   sheetID,
+    }
+    key := strings.Join(auth.HomePath(owner, "securestore", appName, fileName, sheetID), "/")
+    client, err := h.hub.Join(key, user, document)
+    if err != nil {
+        fmt.Printf("DEBUG: Collab room for %s/%s failed to open: %v\n", appName, fileName, err)
+        websocket.JSON.Send(ws, collab.Message{Type: collab.TypeError, Error: "failed to open file"})
+        return
+    }
+    defer client.Leave()
+    fmt.Printf("DEBUG: Collab editor %s joined %s/%s as %s\n", client.ID, appName, fileName, user)
+
+    // Messages for the editor are written as they come, and the socket is
+    // closed when the room drops the editor, which ends the reads below
+    go func() {
+        for msg := range client.Send {
+            if err := websocket.JSON.Send(ws, msg); err != nil {
+                break
+            }
+        }
+        ws.Close()
+    }()
+
+    for {
+        var msg collab.Message
+        err := websocket.JSON.Receive(ws, &msg)
+        if errors.Is(err, websocket.ErrFrameTooLarge) {
+            // The rest of the message is still unread, so the connection
+            // cannot go on
+            websocket.JSON.Send(ws, collab.Message{Type: collab.TypeError, Error: "message too large"})
+            break
+        }
+        if err != nil {
+            break
+        }
+        if (msg.Type == collab.TypeExecute || msg.Type == collab.TypeSnapshot) &&
+            !h.canEdit(user, owner, appName, fileName) {
+            websocket.JSON.Send(ws, collab.Message{Type: collab.TypeError, Error: "permission denied"})
+            break
+        }
+        if err := client.Receive(msg); err != nil {
+            if errors.Is(err, collab.ErrLeft) {
+                break
+            }
+            fmt.Printf("DEBUG: Collab message from %s refused: %v\n", client.ID, err)
+            websocket.JSON.Send(ws, collab.Message{Type: collab.TypeError, Error: err.Error()})
+        }
+    }
+    fmt.Printf("DEBUG: Collab editor %s left %s/%s\n", client.ID, appName, fileName)
+}
+
+// canEdit reports whether user may still edit the file. The share that let
+// the editor in may be revoked while the socket is open, so changes are
+// checked as they come rather than only when the editor joins.
+func (h *CollabHandler) canEdit(user, owner, appName, fileName string) bool {
+    granted, err := h.handler.access(user, owner, appName, fileName)
+    if err != nil {
+        fmt.Printf("DEBUG: Access check of %s on %s/%s failed: %v\n", user, appName, fileName, err)
+        return false
+    }
+    if !models.ShareRoleAllows(granted, models.ShareEditor) {
+        fmt.Printf("DEBUG: Collab editor %s no longer allowed to edit %s/%s of %s\n", user, appName, fileName, owner)
+        return false
+    }
+    return true
+}
+
+// collabDocument keeps a sheet being edited together in storage: the
+// snapshot as the sheet itself, and the commands not yet in a snapshot as an
+// item outside securestore, with the hash of the snapshot they follow
+type collabDocument struct {
+    handler *Handler
+    owner   string
+    app     string
+    file    string
+    sheet   string
+    // name is the file's name in storage, with or without .msc
+    name string
+}
+
+// collabLog is the stored form of the commands not yet in a snapshot
+type collabLog struct {
+    Base     int64            `json:"base"`
+    Hash     string           `json:"hash"`
+    Commands []collab.Message `json:"commands"`
+}
+
+func (d *collabDocument) logPath() string {
+    return strings.Join(auth.HomePath(d.owner, "collab", d.app, d.file, d.sheet), "/")
+}
+
+func (d *collabDocument) Load() (*collab.Document, error) {
+    doc := &collab.Document{}
+
+    // Files the editors saved are named with .msc, but imported ones may
+    // have the name as it is
+    d.name = d.file + ".msc"
+    for _, name := range []string{d.file + ".msc", d.file} {
+        err := d.handler.withWorkbook(d.owner, d.app, name, false, func(f *workbookFile) error {
+            entry := f.sheetByID(d.sheet)
+            if entry == nil {
+                return errSheetNotFound
+            }
+            save, err := f.sheetSave(entry)
+            if err != nil {
+                return err
+            }
+            if doc.Snapshot, err = bareSheetSave(save); err != nil {
+                return err
+            }
+            doc.Seq = entry.CollabSeq
+            return nil
+        })
+        if errors.Is(err, storage.ErrNotFound) {
+            continue
+        }
+        if err != nil {
+            return nil, err
+        }
+        d.name = name
+        break
+    }
+
+    data, err := d.handler.Storage.GetItem(d.logPath())
+    if errors.Is(err, storage.ErrNotFound) {
+        return doc, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    var pending collabLog
+    if err := json.Unmarshal([]byte(data), &pending); err != nil {
+        fmt.Printf("DEBUG: Dropping unreadable collab log of %s/%s: %v\n", d.app, d.file, err)
+        return doc, nil
+    }
+    switch {
+    case pending.Hash == snapshotHash(doc.Snapshot):
+        doc.Seq = pending.Base
+        doc.Log = pending.Commands
+    case doc.Seq > 0 && doc.Seq >= pending.Base:
+        // A snapshot was saved after the log; the commands it includes go
+        for _, command := range pending.Commands {
+            if command.Seq > doc.Seq {
+                doc.Log = append(doc.Log, command)
+            }
+        }
+    default:
+        // The file was saved some other way since, over these commands
+        fmt.Printf("DEBUG: Dropping %d collab commands of %s/%s, the file changed\n",
+            len(pending.Commands), d.app, d.file)
+    }
+    return doc, nil
+}
+
+// SaveSnapshot saves the snapshot in place of the sheet, leaving the other
+// sheets of the file as they are
+func (d *collabDocument) SaveSnapshot(doc *collab.Document) error {
+    err := d.handler.withWorkbook(d.owner, d.app, d.name, true, func(f *workbookFile) error {
+        entry := f.sheetByID(d.sheet)
+        if entry == nil {
+            if len(f.manifest.Sheets) > 0 {
+                // Deleted while being edited
+                return errSheetNotFound
+            }
+            if err := f.saveContent(doc.Snapshot, ""); err != nil {
+                return err
+            }
+            entry = f.current()
+        } else {
+            f.putSheet(entry, doc.Snapshot)
+        }
+        entry.CollabSeq = doc.Seq
+        return f.save()
+    })
+    if err != nil {
+        return err
+    }
+    fmt.Printf("DEBUG: Saved collab snapshot of %s/%s at command %d\n", d.app, d.name, doc.Seq)
+    return d.SaveLog(doc)
+}
+
+func (d *collabDocument) SaveLog(doc *collab.Document) error {
+    unlockHome, err := d.handler.lockHome(d.owner)
+    if err != nil {
+        return err
+    }
+    defer unlockHome()
+
+    if len(doc.Log) == 0 {
+        err = d.handler.Storage.DeleteItem(d.logPath())
+        if errors.Is(err, storage.ErrNotFound) {
+            return nil
+        }
+        return err
+    }
+    data, err := json.Marshal(collabLog{
+        Base:     doc.Seq,
+        Hash:     snapshotHash(doc.Snapshot),
+        Commands: doc.Log,
+    })
+    if err != nil {
+        return err
+    }
+    return d.handler.Storage.PutItem(d.logPath(), string(data))
+}
+
+// storedCollabSeq returns the number of the last command in a file saved by
+// collaborative editing, or 0 for files saved otherwise
+func storedCollabSeq(item *models.StorageItem) int64 {
+    dataStr, ok := item.Data.(string)
+    if !ok {
+        return 0
+    }
+    var fileData struct {
+        CollabSeq int64 `json:"collab_seq"`
+    }
+    if err := json.Unmarshal([]byte(dataStr), &fileData); err != nil {
+        return 0
+    }
+    return fileData.CollabSeq
+}
+
+func snapshotHash(snapshot string) string {
+    sum := sha256.Sum256([]byte(snapshot))
+    return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/c4gt/tornado-nginx-go-backend/internal/auth"
+	"github.com/c4gt/tornado-nginx-go-backend/internal/collab"
+	"github.com/c4gt/tornado-nginx-go-backend/internal/models"
+	"github.com/c4gt/tornado-nginx-go-backend/internal/session"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+)
+
+func TestCollabChecksAccessOnEachChange(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	h, mem := newWorkbookTestHandler()
+	h.Session = session.NewManager()
+	defer h.Session.Close()
+	h.authService = auth.NewService(mem)
+	h.Collab = NewCollabHandler(h)
+
+	const editor = "editor@example.com"
+	for _, email := range []string{testOwner, editor} {
+		if err := h.authService.CreateUser(email, "correct horse battery"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := h.authService.Share(testOwner, "touchcalc", testFile, editor, models.ShareEditor); err != nil {
+		t.Fatal(err)
+	}
+
+	router := gin.New()
+	router.GET("/collab/:app/:file", h.Collab.HandleCollab)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	login := h.Session.New()
+	login.SetValue("user", editor)
+	login.SetValue("kind", loginSessionKind)
+	h.Session.Set(login.ID, login)
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/collab/touchcalc/" + testFile + "?owner=" + testOwner
+	config, err := websocket.NewConfig(wsURL, server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Header.Set("Cookie", (&http.Cookie{Name: loginCookieName, Value: login.ID}).String())
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// receive skips what else the room sends, such as asking for snapshots
+	receive := func(want string) collab.Message {
+		t.Helper()
+		for {
+			var msg collab.Message
+			if err := websocket.JSON.Receive(ws, &msg); err != nil {
+				t.Fatalf("waiting for %s: %v", want, err)
+			}
+			if msg.Type == want {
+				return msg
+			}
+		}
+	}
+	execute := collab.Message{Type: collab.TypeExecute, Data: json.RawMessage(`{"cmdstr":"set A1 value n 1"}`)}
+
+	receive(collab.TypeWelcome)
+	if err := websocket.JSON.Send(ws, execute); err != nil {
+		t.Fatal(err)
+	}
+	receive(collab.TypeExecute)
+
+	// Revoking the share ends the editing already under way
+	if err := h.authService.Unshare(testOwner, "touchcalc", testFile, editor); err != nil {
+		t.Fatal(err)
+	}
+	if err := websocket.JSON.Send(ws, execute); err != nil {
+		t.Fatal(err)
+	}
+	if msg := receive(collab.TypeError); msg.Error != "permission denied" {
+		t.Errorf("error = %q, want permission denied", msg.Error)
+	}
+	for {
+		var msg collab.Message
+		err := websocket.JSON.Receive(ws, &msg)
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			t.Error("socket still open after the share was revoked")
+		}
+		if err != nil {
+			break
+		}
+		if msg.Type == collab.TypeExecute {
+			t.Errorf("command executed after the share was revoked: %+v", msg)
+		}
+	}
+}
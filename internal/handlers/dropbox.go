@@ -37,27 +37,53 @@ type DropboxRequest struct {
 func (h *DropboxHandler) HandleDropboxGet(c *gin.Context) {
     param1 := c.Param("param1")
     action := c.Query("action")
-    sessionID, _ := c.Cookie("session")
-
-    sessionObj := h.handler.Session.GetOrCreate(sessionID)
+    if !checkAppName(c, param1) {
+        return
+    }
 
     switch action {
     case "dropbox-auth-start":
-        h.handleDropboxAuthStart(c, param1, sessionID, sessionObj)
+        // Starting a sign-in is the only action that creates a session
+        sessionObj := h.handler.App.appSession(c, param1, h.handler.Auth.getCurrentUser(c))
+        h.handleDropboxAuthStart(c, param1, sessionObj.ID, sessionObj)
     case "dropbox-auth-finish":
-        h.handleDropboxAuthFinish(c, param1, sessionID, sessionObj)
+        sessionObj, exists := h.handler.App.lookupAppSession(c, param1)
+        if !exists {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "No Dropbox sign-in in progress"})
+            return
+        }
+        h.handleDropboxAuthFinish(c, param1, sessionObj)
     case "getLogin":
+        sessionObj, exists := h.handler.App.lookupAppSession(c, param1)
+        if !exists {
+            c.JSON(http.StatusOK, gin.H{"login": ""})
+            return
+        }
         h.handleGetLogin(c, sessionObj)
     case "logout":
-        h.handleDropboxLogout(c, sessionID, sessionObj)
+        sessionObj, exists := h.handler.App.lookupAppSession(c, param1)
+        if !exists {
+            c.JSON(http.StatusOK, gin.H{"status": 1})
+            return
+        }
+        h.handleDropboxLogout(c, sessionObj.ID, sessionObj)
     default:
         c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid action"})
     }
 }
 
 func (h *DropboxHandler) HandleDropboxPost(c *gin.Context) {
-    sessionID, _ := c.Cookie("session")
-    sessionObj := h.handler.Session.GetOrCreate(sessionID)
+    if !checkAppName(c, c.Param("param1")) {
+        return
+    }
+    sessionObj, exists := h.handler.App.lookupAppSession(c, c.Param("param1"))
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{
+            "data": "Please login to dropbox",
+        })
+        return
+    }
+    sessionID := sessionObj.ID
 
     var req DropboxRequest
     if err := c.ShouldBind(&req); err != nil {
@@ -74,6 +100,13 @@ func (h *DropboxHandler) HandleDropboxPost(c *gin.Context) {
         return
     }
 
+    // Dropbox paths are built from these names
+    for _, name := range []string{req.Name, req.FName} {
+        if name != "" && !checkFileNames(c, name) {
+            return
+        }
+    }
+
     switch req.Action {
     case "upload":
         h.handleDropboxUpload(c, req, token)
@@ -113,7 +146,7 @@ func (h *DropboxHandler) handleDropboxAuthStart(c *gin.Context, appName, session
     })
 }
 
-func (h *DropboxHandler) handleDropboxAuthFinish(c *gin.Context, appName, sessionID string, sessionObj *session.Session) {
+func (h *DropboxHandler) handleDropboxAuthFinish(c *gin.Context, appName string, sessionObj *session.Session) {
     code := c.Query("code")
     if code == "" {
         appURL, _ := sessionObj.GetString("appUrl")
@@ -127,9 +160,18 @@ func (h *DropboxHandler) handleDropboxAuthFinish(c *gin.Context, appName, sessio
 
     // Simplified - in reality, you'd exchange the code for a token
     // For now, we'll simulate a successful auth
+    // The session now grants access to the Dropbox account, so it gets a
+    // new ID that nobody else can have seen
+    sessionObj = h.handler.Session.Regenerate(sessionObj)
+    h.handler.App.setSessionCookie(c, appName, sessionObj.ID)
+
     sessionObj.SetValue("dbToken", "simulated_access_token")
     sessionObj.SetValue("dbLogin", "1")
-    h.handler.Session.Set(sessionID, sessionObj)
+    // Tie the token to the signed-in user so it is revoked with the account
+    if user := h.handler.Auth.getCurrentUser(c); user != "" {
+        sessionObj.SetValue("user", user)
+    }
+    h.handler.Session.Set(sessionObj.ID, sessionObj)
 
     appURL, _ := sessionObj.GetString("appUrl")
     if appURL != "" {
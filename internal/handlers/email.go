@@ -1,7 +1,7 @@
 package handlers
 
 import (
-    "encoding/json"
+    "errors"
     "net/http"
 
     "github.com/c4gt/tornado-nginx-go-backend/internal/email"
@@ -20,6 +20,16 @@ func NewEmailHandler(h *Handler, service *email.SESService) *EmailHandler { // C
     }
 }
 
+var errEmailDisabled = errors.New("email service not configured")
+
+// Send delivers a message from the configured sender address
+func (h *EmailHandler) Send(to string, message *email.Message) error {
+    if h.service == nil {
+        return errEmailDisabled
+    }
+    return h.service.SendEmail(h.handler.Config.FromEmail, to, message)
+}
+
 type EmailRequest struct {
     To      string `json:"to" form:"to"`
     Data    string `json:"data" form:"data"`
@@ -84,16 +94,5 @@ func (h *EmailHandler) HandleRunAsEmail(c *gin.Context) {
 }
 
 func (h *EmailHandler) getCurrentUser(c *gin.Context) string {
-    userCookie, err := c.Cookie("user")
-    if err != nil {
-        return ""
-    }
-
-    var user string
-    err = json.Unmarshal([]byte(userCookie), &user)
-    if err != nil {
-        return ""
-    }
-
-    return user
+    return h.handler.CurrentUser(c)
 }
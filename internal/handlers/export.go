@@ -0,0 +1,245 @@
+package handlers
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "mime"
+    "net/http"
+    "strings"
+
+    "github.com/c4gt/tornado-nginx-go-backend/internal/auth"
+    "github.com/c4gt/tornado-nginx-go-backend/internal/formula"
+    "github.com/c4gt/tornado-nginx-go-backend/internal/models"
+    "github.com/c4gt/tornado-nginx-go-backend/internal/render"
+    "github.com/c4gt/tornado-nginx-go-backend/internal/socialcalc"
+    "github.com/c4gt/tornado-nginx-go-backend/internal/storage"
+    "github.com/c4gt/tornado-nginx-go-backend/internal/xlsx"
+    "github.com/gin-gonic/gin"
+)
+
+// Export formats
+const (
+    FormatCSV  = "csv"
+    FormatXLSX = "xlsx"
+    FormatHTML = "html"
+    FormatPDF  = "pdf"
+)
+
+type ExportHandler struct {
+    handler *Handler
+}
+
+func NewExportHandler(h *Handler) *ExportHandler {
+    return &ExportHandler{
+        handler: h,
+    }
+}
+
+// HandleExport converts a stored spreadsheet to CSV or XLSX and sends it as
+// a download, or renders it as an HTML page or PDF document for printing.
+// CSV holds one sheet, chosen with ?sheet= and otherwise the sheet the
+// workbook was saved on; XLSX holds every sheet of the workbook; HTML and
+// PDF hold the sheet chosen with ?sheet= or every sheet that is not hidden.
+// Spreadsheets other users share are exported with ?owner=.
+func (h *ExportHandler) HandleExport(c *gin.Context) {
+    user := h.handler.WebApp.getCurrentUser(c)
+    if user == "" {
+        c.JSON(http.StatusUnauthorized, gin.H{
+            "data":   "usererror",
+            "result": "fail",
+        })
+        return
+    }
+
+    appName := c.Param("app")
+    fileName := c.Param("file")
+    if !checkAppName(c, appName) || !checkFileNames(c, fileName) {
+        return
+    }
+    owner := fileOwner(user, c.Query("owner"))
+    if !h.handler.requireAccess(c, user, owner, appName, models.ShareViewer, fileName) {
+        return
+    }
+
+    format := strings.ToLower(c.DefaultQuery("format", FormatCSV))
+    if format != FormatCSV && format != FormatXLSX && format != FormatHTML && format != FormatPDF {
+        c.JSON(http.StatusBadRequest, gin.H{
+            "data":   "unsupported format: " + format,
+            "result": "fail",
+        })
+        return
+    }
+
+    workbook, name, err := h.loadWorkbook(owner, appName, fileName)
+    if errors.Is(err, storage.ErrNotFound) {
+        c.JSON(http.StatusNotFound, gin.H{
+            "data":   "file not found: " + fileName,
+            "result": "fail",
+        })
+        return
+    }
+    if err != nil {
+        fmt.Printf("DEBUG: Export of %s/%s failed: %v\n", appName, fileName, err)
+        c.JSON(http.StatusUnprocessableEntity, gin.H{
+            "data":   "invalid spreadsheet: " + err.Error(),
+            "result": "fail",
+        })
+        return
+    }
+
+    // Saved values are those the browser last computed, which may be stale
+    // or missing, so the workbook is recalculated first
+    formula.Recalc(workbook)
+
+    var out bytes.Buffer
+    var contentType string
+    switch format {
+    case FormatCSV:
+        sheet := exportSheet(workbook, c.Query("sheet"))
+        if sheet == nil {
+            c.JSON(http.StatusNotFound, gin.H{
+                "data":   "sheet not found: " + c.Query("sheet"),
+                "result": "fail",
+            })
+            return
+        }
+        contentType = "text/csv; charset=utf-8"
+        err = sheet.Doc.Sheet.WriteCSV(&out)
+    case FormatXLSX:
+        contentType = xlsx.ContentType
+        err = workbook.XLSX().Write(&out)
+    default:
+        doc := renderDocument(workbook, strings.TrimSuffix(name, ".msc"), c.Query("sheet"))
+        if doc == nil {
+            c.JSON(http.StatusNotFound, gin.H{
+                "data":   "sheet not found: " + c.Query("sheet"),
+                "result": "fail",
+            })
+            return
+        }
+        if format == FormatHTML {
+            contentType = render.HTMLContentType
+            err = render.WriteHTML(&out, doc)
+        } else {
+            contentType = render.PDFContentType
+            err = render.WritePDF(&out, doc)
+        }
+    }
+    if err != nil {
+        fmt.Printf("DEBUG: Export of %s/%s failed: %v\n", appName, fileName, err)
+        c.JSON(http.StatusInternalServerError, gin.H{
+            "data":   "export failed",
+            "result": "fail",
+        })
+        return
+    }
+
+    fmt.Printf("DEBUG: Exported %s/%s as %s for user %s\n", appName, name, format, user)
+    download := strings.TrimSuffix(name, ".msc") + "." + format
+    disposition := "attachment"
+    if format == FormatHTML || format == FormatPDF {
+        // Shown in the browser, to be printed or saved from there
+        disposition = "inline"
+    }
+    if format == FormatHTML {
+        // The page holds no scripts or outside resources, and must not gain
+        // any from cell contents
+        c.Header("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'")
+    }
+    c.Header("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": download}))
+    c.Data(http.StatusOK, contentType, out.Bytes())
+}
+
+// loadWorkbook reads a stored spreadsheet, trying the name with the .msc
+// extension SocialCalc saves use when the name itself is not found, and
+// returns it with the name it was found under
+func (h *ExportHandler) loadWorkbook(user, appName, fileName string) (*socialcalc.Workbook, string, error) {
+    names := []string{fileName}
+    if !strings.HasSuffix(fileName, ".msc") {
+        names = append(names, fileName + ".msc")
+    }
+
+    var err error
+    for _, name := range names {
+        _, err = h.handler.Storage.GetFile(auth.HomePath(user, "securestore", appName, name))
+        if err == nil {
+            fileName = name
+            break
+        }
+    }
+    if err != nil {
+        if !errors.Is(err, storage.ErrNotFound) {
+            fmt.Printf("DEBUG: Failed to read %s/%s: %v\n", appName, fileName, err)
+        }
+        return nil, "", storage.ErrNotFound
+    }
+
+    var workbook *socialcalc.Workbook
+    err = h.handler.withWorkbook(user, appName, fileName, false, func(f *workbookFile) error {
+        workbook, err = f.workbook()
+        return err
+    })
+    if err != nil {
+        return nil, "", err
+    }
+    return workbook, fileName, nil
+}
+
+// exportSheet returns the named sheet, or without a name the current sheet
+// of the workbook, falling back to the first
+func exportSheet(workbook *socialcalc.Workbook, name string) *socialcalc.WorkbookSheet {
+    if name != "" {
+        return workbook.Sheet(name)
+    }
+    if sheet := workbook.Sheet(workbook.CurrentName); sheet != nil {
+        return sheet
+    }
+    return workbook.Sheets[0]
+}
+
+// renderDocument returns the named sheet, or without a name every sheet that
+// is not hidden, as a document titled after the file, or nil when the named
+// sheet does not exist. Sheets are only named in saves of several sheets.
+func renderDocument(workbook *socialcalc.Workbook, title, name string) *render.Document {
+    sheets := workbook.Sheets
+    if name != "" {
+        sheet := workbook.Sheet(name)
+        if sheet == nil {
+            return nil
+        }
+        sheets = []*socialcalc.WorkbookSheet{sheet}
+    }
+
+    doc := &render.Document{Title: title}
+    for _, sheet := range sheets {
+        if name == "" && sheet.Hidden {
+            continue
+        }
+        tableName := sheet.Name
+        if !workbook.JSON {
+            tableName = ""
+        }
+        doc.Tables = append(doc.Tables, sheet.Doc.Sheet.Table(tableName))
+    }
+    return doc
+}
+
+// storedContent returns the content of a stored file: the "content" field
+// of the JSON the web app saves files in, or the stored data as it is
+func storedContent(item *models.StorageItem) string {
+    dataStr, ok := item.Data.(string)
+    if !ok {
+        dataBytes, _ := json.Marshal(item.Data)
+        return string(dataBytes)
+    }
+
+    var fileData map[string]interface{}
+    if err := json.Unmarshal([]byte(dataStr), &fileData); err == nil {
+        if content, ok := fileData["content"].(string); ok {
+            return content
+        }
+    }
+    return dataStr
+}
@@ -2,23 +2,48 @@ package handlers
 
 import (
     "log"
+    "net/http"
+    "strings"
+    "sync"
+    "time"
 
     "github.com/c4gt/tornado-nginx-go-backend/internal/auth"
     "github.com/c4gt/tornado-nginx-go-backend/internal/config"
     "github.com/c4gt/tornado-nginx-go-backend/internal/email"
+    "github.com/c4gt/tornado-nginx-go-backend/internal/models"
     "github.com/c4gt/tornado-nginx-go-backend/internal/session"
     "github.com/c4gt/tornado-nginx-go-backend/internal/storage"
+    "github.com/c4gt/tornado-nginx-go-backend/pkg/middleware"
+    "github.com/gin-gonic/gin"
 )
 
 type Handler struct {
-    Config  *config.Config
-    Storage storage.Storage
-    Session *session.Manager
-    Auth    *AuthHandler
-    WebApp  *WebAppHandler
-    Email   *EmailHandler
-    App     *AppHandler
-    Dropbox *DropboxHandler
+    Config    *config.Config
+    Storage   storage.Storage
+    Session   *session.Manager
+    Auth      *AuthHandler
+    WebApp    *WebAppHandler
+    Email     *EmailHandler
+    App       *AppHandler
+    Dropbox   *DropboxHandler
+    OIDC      *OIDCHandler
+    Admin     *AdminHandler
+    Account   *AccountHandler
+    Export    *ExportHandler
+    Import    *ImportHandler
+    Collab    *CollabHandler
+    Share     *ShareHandler
+    ShareLink *ShareLinkHandler
+
+    // authService records audit events for every sub-handler
+    authService *auth.Service
+
+    // workbookLocks serialize the changes to stored spreadsheets, each
+    // file using the lock its path hashes to
+    workbookLocks [workbookLockCount]sync.Mutex
+
+    // stop ends the background jobs started by NewHandler
+    stop chan struct{}
 }
 
 func NewHandler(cfg *config.Config) *Handler {
@@ -28,11 +53,69 @@ func NewHandler(cfg *config.Config) *Handler {
         log.Fatalf("Failed to initialize storage backend (%s): %v", cfg.StorageBackend, err)
     }
 
+    if cookieSameSite(cfg.CookieSameSite) == http.SameSiteNoneMode && !cfg.CookieSecure {
+        log.Println("COOKIE_SAMESITE=none requires COOKIE_SECURE=true, browsers will reject the cookies")
+    }
+
     // Initialize session manager
-    sessionManager := session.NewManager()
+    sessionStore, err := session.NewStore(cfg, storageBackend)
+    if err != nil {
+        log.Fatalf("Failed to initialize session store (%s): %v", cfg.SessionStore, err)
+    }
+    sessionManager := session.NewManagerWithStore(sessionStore, session.OptionsFromConfig(cfg))
+
+    // Select password hashing algorithm for new and upgraded hashes
+    switch cfg.PasswordHasher {
+    case "argon2id":
+        models.SetPasswordHasher(models.NewArgon2idHasher())
+    case "bcrypt", "":
+        models.SetPasswordHasher(models.NewBcryptHasher(cfg.BcryptCost))
+    default:
+        log.Fatalf("Unsupported password hasher: %s", cfg.PasswordHasher)
+    }
 
     // Initialize auth service
     authService := auth.NewService(storageBackend)
+    authService.SetLockoutPolicy(auth.LockoutPolicy{
+        MaxAttempts:     cfg.LoginMaxAttempts,
+        IPMaxAttempts:   cfg.LoginIPMaxAttempts,
+        Window:          time.Duration(cfg.LoginAttemptWindow) * time.Minute,
+        LockoutDuration: time.Duration(cfg.LoginLockoutDuration) * time.Minute,
+        BaseDelay:       time.Duration(cfg.LoginBaseDelay) * time.Second,
+        MaxDelay:        time.Duration(cfg.LoginMaxDelay) * time.Second,
+    })
+
+    passwordPolicy := auth.DefaultPasswordPolicy()
+    passwordPolicy.MinLength = cfg.PasswordMinLength
+    passwordPolicy.MaxLength = cfg.PasswordMaxLength
+    if cfg.PasswordBlocklistFile != "" {
+        if err := passwordPolicy.LoadBlocklistFile(cfg.PasswordBlocklistFile); err != nil {
+            log.Fatalf("Failed to load password blocklist: %v", err)
+        }
+    }
+    authService.SetPasswordPolicy(passwordPolicy)
+    authService.SetBootstrapAdmins(cfg.AdminEmails)
+    authService.SetDeletionGracePeriod(time.Duration(cfg.AccountDeletionGraceDays) * 24 * time.Hour)
+    authService.SetEmailRedirectPeriod(time.Duration(cfg.EmailRedirectDays) * 24 * time.Hour)
+    authService.SetAuditRetention(time.Duration(cfg.AuditRetentionDays) * 24 * time.Hour)
+    if !auth.ValidRegistrationMode(cfg.RegistrationMode) {
+        log.Fatalf("Unsupported registration mode: %s", cfg.RegistrationMode)
+    }
+    authService.SetRegistrationPolicy(auth.RegistrationPolicy{
+        Mode:           cfg.RegistrationMode,
+        AllowedDomains: cfg.RegistrationAllowedDomains,
+        DeniedDomains:  cfg.RegistrationDeniedDomains,
+    })
+
+    // Move records stored under verbatim email addresses and names
+    migration, err := authService.MigrateIdentities()
+    if err != nil {
+        log.Fatalf("Failed to migrate user identities: %v", err)
+    }
+    if migration != nil {
+        log.Printf("Migrated user identities: %d accounts, %d items, %d conflicts %v",
+            migration.Users, migration.Items, len(migration.Conflicts), migration.Conflicts)
+    }
 
     // Initialize email service (with fallback if AWS not configured)
     var emailService *email.SESService
@@ -53,6 +136,9 @@ func NewHandler(cfg *config.Config) *Handler {
         Config:  cfg,
         Storage: storageBackend,
         Session: sessionManager,
+
+        authService: authService,
+        stop:        make(chan struct{}),
     }
 
     // Initialize sub-handlers
@@ -61,6 +147,77 @@ func NewHandler(cfg *config.Config) *Handler {
     h.Email = NewEmailHandler(h, emailService)
     h.App = NewAppHandler(h)
     h.Dropbox = NewDropboxHandler(h)
+    h.OIDC = NewOIDCHandler(h, authService)
+    h.Admin = NewAdminHandler(h, authService)
+    h.Account = NewAccountHandler(h, authService)
+    h.Export = NewExportHandler(h)
+    h.Import = NewImportHandler(h)
+    h.Collab = NewCollabHandler(h)
+    h.Share = NewShareHandler(h, authService)
+    h.ShareLink = NewShareLinkHandler(h, authService)
+
+    // Purge accounts whose deletion grace period has passed
+    go h.Account.runDeletionPurger(h.stop)
+    // Drop audit events past their retention period
+    go h.Admin.runAuditPruner(h.stop)
 
     return h
 }
+
+// Close stops the background jobs and the session cleanup, and releases
+// the session store. Call it once the server has stopped serving requests.
+func (h *Handler) Close() error {
+    if h.stop != nil {
+        close(h.stop)
+        h.stop = nil
+    }
+    return h.Session.Close()
+}
+
+// baseURL returns the external base URL of the server, from PUBLIC_URL when
+// configured and otherwise from the request
+func (h *Handler) baseURL(c *gin.Context) string {
+    if h.Config.PublicURL != "" {
+        return h.Config.PublicURL
+    }
+    scheme := "http"
+    if c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https" {
+        scheme = "https"
+    }
+    return scheme + "://" + c.Request.Host
+}
+
+// setCookie sets an HttpOnly cookie with the Secure and SameSite attributes
+// from the configuration. A negative maxAge deletes the cookie.
+func (h *Handler) setCookie(c *gin.Context, name, value string, maxAge int, path string) {
+    c.SetSameSite(cookieSameSite(h.Config.CookieSameSite))
+    c.SetCookie(name, value, maxAge, path, "", h.Config.CookieSecure, true)
+}
+
+// sessionCookieAge is the max age in seconds of cookies holding a session
+// ID: as long as the session can last, or until the browser is closed when
+// sessions have no absolute timeout
+func (h *Handler) sessionCookieAge() int {
+    return int(h.Session.Options().AbsoluteTimeout.Seconds())
+}
+
+func cookieSameSite(mode string) http.SameSite {
+    switch strings.ToLower(mode) {
+    case "strict":
+        return http.SameSiteStrictMode
+    case "none":
+        return http.SameSiteNoneMode
+    default:
+        return http.SameSiteLaxMode
+    }
+}
+
+// renderHTML renders a template with the request's CSRF token available to
+// forms and scripts as .csrf_token
+func renderHTML(c *gin.Context, code int, name string, data gin.H) {
+    if data == nil {
+        data = gin.H{}
+    }
+    data["csrf_token"] = middleware.CSRFToken(c)
+    c.HTML(code, name, data)
+}
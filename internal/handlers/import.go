@@ -0,0 +1,189 @@
+package handlers
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "path/filepath"
+    "strings"
+
+    "github.com/c4gt/tornado-nginx-go-backend/internal/socialcalc"
+    "github.com/c4gt/tornado-nginx-go-backend/internal/xlsx"
+    "github.com/gin-gonic/gin"
+)
+
+// importFormOverhead is how much larger than the file an import request may
+// be, for the name field and the multipart boundaries and headers
+const importFormOverhead = 64 << 10
+
+type ImportHandler struct {
+    handler *Handler
+}
+
+func NewImportHandler(h *Handler) *ImportHandler {
+    return &ImportHandler{
+        handler: h,
+    }
+}
+
+// HandleImport converts an uploaded CSV or XLSX file to a SocialCalc
+// spreadsheet and stores it as a new .msc file of the app. The file is sent
+// as the "file" form field; "name" sets the name of the spreadsheet, which
+// defaults to the name of the upload. What could not be converted is listed
+// under "unsupported" in the response.
+func (h *ImportHandler) HandleImport(c *gin.Context) {
+    user := h.handler.WebApp.getCurrentUser(c)
+    if user == "" {
+        c.JSON(http.StatusUnauthorized, gin.H{
+            "data":   "usererror",
+            "result": "fail",
+        })
+        return
+    }
+
+    appName := c.Param("app")
+    if !checkAppName(c, appName) {
+        return
+    }
+
+    // Larger requests are refused while being read, before the upload is
+    // spooled to memory or disk
+    maxSize := int64(h.handler.Config.ImportMaxSize)
+    c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxSize+importFormOverhead)
+    upload, err := c.FormFile("file")
+    var tooLarge *http.MaxBytesError
+    if errors.As(err, &tooLarge) {
+        c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+            "data":   fmt.Sprintf("file is larger than %d bytes", maxSize),
+            "result": "fail",
+        })
+        return
+    }
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{
+            "data":   "missing file",
+            "result": "fail",
+        })
+        return
+    }
+    if upload.Size > maxSize {
+        c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+            "data":   fmt.Sprintf("file is larger than %d bytes", maxSize),
+            "result": "fail",
+        })
+        return
+    }
+
+    ext := strings.ToLower(filepath.Ext(upload.Filename))
+    format := ""
+    switch ext {
+    case ".csv", ".tsv", ".txt":
+        format = FormatCSV
+    case ".xlsx":
+        format = FormatXLSX
+    default:
+        c.JSON(http.StatusBadRequest, gin.H{
+            "data":   "unsupported file type: " + ext,
+            "result": "fail",
+        })
+        return
+    }
+
+    name := strings.TrimSuffix(c.PostForm("name"), ".msc")
+    if name == "" {
+        name = strings.TrimSuffix(filepath.Base(upload.Filename), filepath.Ext(upload.Filename))
+    }
+    fileName := name + ".msc"
+    if !checkFileNames(c, name, fileName) {
+        return
+    }
+
+    in, err := upload.Open()
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{
+            "data":   "failed to read file",
+            "result": "fail",
+        })
+        return
+    }
+    data, err := io.ReadAll(io.LimitReader(in, maxSize+1))
+    in.Close()
+    if err != nil || int64(len(data)) > maxSize {
+        c.JSON(http.StatusBadRequest, gin.H{
+            "data":   "failed to read file",
+            "result": "fail",
+        })
+        return
+    }
+
+    var workbook *socialcalc.Workbook
+    var unsupported []string
+    if format == FormatCSV {
+        sheet, err := socialcalc.ReadCSV(bytes.NewReader(data))
+        if err != nil {
+            h.respondImportError(c, upload.Filename, fmt.Errorf("invalid CSV: %w", err))
+            return
+        }
+        workbook = &socialcalc.Workbook{
+            NumSheets: 1,
+            Sheets:    []*socialcalc.WorkbookSheet{{ID: "sheet1", Name: "Sheet1", Doc: &socialcalc.Document{Sheet: sheet}}},
+        }
+    } else {
+        book, err := xlsx.Read(bytes.NewReader(data), int64(len(data)))
+        if err != nil {
+            h.respondImportError(c, upload.Filename, err)
+            return
+        }
+        workbook, unsupported = socialcalc.FromXLSX(book)
+    }
+
+    exists := false
+    err = h.handler.withWorkbook(user, appName, fileName, true, func(f *workbookFile) error {
+        if f.exists {
+            exists = true
+            return nil
+        }
+        f.setWorkbook(workbook)
+        f.meta["imported_from"] = filepath.Base(upload.Filename)
+        return f.save()
+    })
+    if exists {
+        c.JSON(http.StatusConflict, gin.H{
+            "data":   "file exists: " + name,
+            "result": "fail",
+        })
+        return
+    }
+    if err != nil {
+        fmt.Printf("DEBUG: Error saving imported file: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{
+            "data":   "failed to save file: " + err.Error(),
+            "result": "fail",
+        })
+        return
+    }
+
+    fmt.Printf("DEBUG: Imported %s as %s/%s for user %s, %d unsupported features\n",
+        upload.Filename, appName, fileName, user, len(unsupported))
+    if unsupported == nil {
+        unsupported = []string{}
+    }
+    c.JSON(http.StatusOK, gin.H{
+        "data": gin.H{
+            "filename":    name,
+            "sheets":      len(workbook.Sheets),
+            "unsupported": unsupported,
+        },
+        "result": "ok",
+    })
+}
+
+func (h *ImportHandler) respondImportError(c *gin.Context, fileName string, err error) {
+    fmt.Printf("DEBUG: Import of %s failed: %v\n", fileName, err)
+    c.JSON(http.StatusUnprocessableEntity, gin.H{
+        "data":   err.Error(),
+        "result": "fail",
+    })
+}
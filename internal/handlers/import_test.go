@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/c4gt/tornado-nginx-go-backend/internal/session"
+	"github.com/gin-gonic/gin"
+)
+
+func TestImportRefusesLargeRequests(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	h, _ := newWorkbookTestHandler()
+	h.Config.ImportMaxSize = 1 << 10
+	h.Session = session.NewManager()
+	defer h.Session.Close()
+	login := h.Session.New()
+	login.SetValue("user", "user@example.com")
+	login.SetValue("kind", loginSessionKind)
+	h.Session.Set(login.ID, login)
+
+	router := gin.New()
+	router.POST("/import/:app", NewImportHandler(h).HandleImport)
+
+	importFile := func(size int) int {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		part, _ := form.CreateFormFile("file", "data.csv")
+		part.Write(bytes.Repeat([]byte("1,2\n"), size/4))
+		form.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/import/socialcalc", &body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		req.AddCookie(&http.Cookie{Name: loginCookieName, Value: login.ID})
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := importFile(512); code != http.StatusOK {
+		t.Errorf("import of a small file = %d, want 200", code)
+	}
+	// Refused while reading, not after storing it
+	if code := importFile(1 << 20); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("import of a large file = %d, want 413", code)
+	}
+}
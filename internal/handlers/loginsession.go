@@ -0,0 +1,166 @@
+package handlers
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "sort"
+    "strings"
+
+    "github.com/c4gt/tornado-nginx-go-backend/internal/session"
+    "github.com/gin-gonic/gin"
+)
+
+const (
+    loginCookieName  = "login"
+    loginSessionKind = "login"
+)
+
+// startLoginSession signs the user in on this browser with a new server-side
+// session, replacing the one the browser had before
+func (h *Handler) startLoginSession(c *gin.Context, user string) *session.Session {
+    if previous, ok := h.loginSession(c); ok {
+        h.Session.Delete(previous.ID)
+    }
+
+    login := h.Session.New()
+    login.SetValue("user", user)
+    login.SetValue("kind", loginSessionKind)
+    login.SetValue("ip", c.ClientIP())
+    login.SetValue("useragent", c.Request.UserAgent())
+    h.Session.Set(login.ID, login)
+
+    h.setCookie(c, loginCookieName, login.ID, h.sessionCookieAge(), "/")
+    return login
+}
+
+// loginSession returns the login session of this browser. Looking it up
+// counts as activity, so it also records the address it was last used from.
+func (h *Handler) loginSession(c *gin.Context) (*session.Session, bool) {
+    id, err := c.Cookie(loginCookieName)
+    if err != nil || id == "" {
+        return nil, false
+    }
+
+    login, found := h.Session.Get(id)
+    if !found {
+        return nil, false
+    }
+    if kind, _ := login.GetString("kind"); kind != loginSessionKind {
+        return nil, false
+    }
+    if lastIP, _ := login.GetString("lastip"); lastIP != c.ClientIP() {
+        login.SetValue("lastip", c.ClientIP())
+        h.Session.Set(login.ID, login)
+    }
+    return login, true
+}
+
+// CurrentUser returns the user signed in on this browser, or "" when the
+// browser has no valid login session
+func (h *Handler) CurrentUser(c *gin.Context) string {
+    login, ok := h.loginSession(c)
+    if !ok {
+        return ""
+    }
+    user, _ := login.GetString("user")
+    return user
+}
+
+// endLoginSession signs this browser out
+func (h *Handler) endLoginSession(c *gin.Context) {
+    if login, ok := h.loginSession(c); ok {
+        h.Session.Delete(login.ID)
+    }
+    h.setCookie(c, loginCookieName, "", -1, "/")
+}
+
+// revokeUserSessions signs a user out everywhere except for the sessions in
+// keep, and returns how many sessions were revoked
+func (h *Handler) revokeUserSessions(user string, keep ...string) int {
+    return h.Session.DeleteByUser(user, keep...)
+}
+
+// loginSessions returns the login sessions of a user, most recently used first
+func (h *Handler) loginSessions(user string) []*session.Session {
+    var logins []*session.Session
+    for _, s := range h.Session.ListByUser(user) {
+        if kind, _ := s.GetString("kind"); kind == loginSessionKind {
+            logins = append(logins, s)
+        }
+    }
+    sort.Slice(logins, func(i, j int) bool {
+        return logins[i].LastUsedAt().After(logins[j].LastUsedAt())
+    })
+    return logins
+}
+
+// loginSessionHandle identifies a session in listings without revealing the
+// session ID, which is a credential
+func loginSessionHandle(id string) string {
+    sum := sha256.Sum256([]byte(id))
+    return hex.EncodeToString(sum[:8])
+}
+
+func loginSessionView(login *session.Session, current bool) gin.H {
+    userAgent, _ := login.GetString("useragent")
+    ip, _ := login.GetString("ip")
+    lastIP, ok := login.GetString("lastip")
+    if !ok {
+        lastIP = ip
+    }
+
+    return gin.H{
+        "id":        loginSessionHandle(login.ID),
+        "current":   current,
+        "device":    describeDevice(userAgent),
+        "useragent": userAgent,
+        "ip":        ip,
+        "lastip":    lastIP,
+        "createdat": login.CreatedAt().UTC(),
+        "lastseen":  login.LastUsedAt().UTC(),
+    }
+}
+
+// describeDevice turns a user agent into a short label such as
+// "Firefox on Linux"
+func describeDevice(userAgent string) string {
+    if userAgent == "" {
+        return "Unknown device"
+    }
+
+    browser := "Unknown browser"
+    for _, candidate := range []struct{ token, name string }{
+        {"Edg/", "Edge"},
+        {"OPR/", "Opera"},
+        {"Firefox/", "Firefox"},
+        {"Chrome/", "Chrome"},
+        {"Safari/", "Safari"},
+        {"curl/", "curl"},
+    } {
+        if strings.Contains(userAgent, candidate.token) {
+            browser = candidate.name
+            break
+        }
+    }
+
+    system := ""
+    for _, candidate := range []struct{ token, name string }{
+        {"Android", "Android"},
+        {"iPhone", "iOS"},
+        {"iPad", "iPadOS"},
+        {"Windows", "Windows"},
+        {"Mac OS X", "macOS"},
+        {"CrOS", "ChromeOS"},
+        {"Linux", "Linux"},
+    } {
+        if strings.Contains(userAgent, candidate.token) {
+            system = candidate.name
+            break
+        }
+    }
+
+    if system == "" {
+        return browser
+    }
+    return browser + " on " + system
+}
@@ -0,0 +1,137 @@
+package handlers
+
+import (
+    "fmt"
+    "net/http"
+    "regexp"
+    "strings"
+    "unicode"
+    "unicode/utf8"
+
+    "github.com/gin-gonic/gin"
+)
+
+const (
+    maxAppNameLength  = 64
+    maxFileNameLength = 255
+)
+
+// appNamePattern is the shape of app names, which also name directories
+// under webappTemplates and cookie paths
+var appNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+// fileNamePunctuation is the punctuation allowed in file names besides
+// letters, digits and spaces
+const fileNamePunctuation = "._-()[]{}+,;'!@#$%&=~^"
+
+// reservedNames cannot be used as a file name, with or without an
+// extension, because Windows clients cannot save them
+var reservedNames = map[string]bool{
+    "CON": true, "PRN": true, "AUX": true, "NUL": true,
+    "COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+    "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+    "LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+    "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// googleVerificationPattern matches Google site verification pages
+var googleVerificationPattern = regexp.MustCompile(`^google[0-9a-f]+\.html$`)
+
+// NameError explains why an app or file name was refused
+type NameError struct {
+    Kind   string // "app name" or "file name"
+    Name   string
+    Reason string
+}
+
+func (e *NameError) Error() string {
+    return fmt.Sprintf("invalid %s %q: %s", e.Kind, e.Name, e.Reason)
+}
+
+// validateAppName checks a name used as an app directory
+func validateAppName(name string) error {
+    refuse := func(reason string) error {
+        return &NameError{Kind: "app name", Name: name, Reason: reason}
+    }
+    switch {
+    case name == "":
+        return refuse("empty")
+    case len(name) > maxAppNameLength:
+        return refuse(fmt.Sprintf("longer than %d characters", maxAppNameLength))
+    case !appNamePattern.MatchString(name):
+        return refuse("only letters, digits, '-' and '_' are allowed")
+    case reservedNames[strings.ToUpper(name)]:
+        return refuse("reserved name")
+    }
+    return nil
+}
+
+// validateFileName checks a name used as a single file in an app directory.
+// Path separators and dot segments are never allowed, so a valid name cannot
+// leave its directory.
+func validateFileName(name string) error {
+    refuse := func(reason string) error {
+        return &NameError{Kind: "file name", Name: name, Reason: reason}
+    }
+    switch {
+    case name == "":
+        return refuse("empty")
+    case len(name) > maxFileNameLength:
+        return refuse(fmt.Sprintf("longer than %d bytes", maxFileNameLength))
+    case !utf8.ValidString(name):
+        return refuse("not valid UTF-8")
+    case name == "." || name == "..":
+        return refuse("dot segments are not allowed")
+    case strings.ContainsAny(name, `/\`):
+        return refuse("path separators are not allowed")
+    case strings.TrimSpace(name) != name || strings.HasSuffix(name, "."):
+        return refuse("leading or trailing spaces and trailing dots are not allowed")
+    }
+
+    for _, r := range name {
+        if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsMark(r) &&
+            r != ' ' && !strings.ContainsRune(fileNamePunctuation, r) {
+            return refuse(fmt.Sprintf("character %q is not allowed", r))
+        }
+    }
+
+    base := name
+    if dot := strings.Index(base, "."); dot >= 0 {
+        base = base[:dot]
+    }
+    if reservedNames[strings.ToUpper(base)] {
+        return refuse("reserved name")
+    }
+    return nil
+}
+
+// respondInvalidName sends the error result shared by every handler that
+// refuses an app or file name
+func respondInvalidName(c *gin.Context, err error) {
+    c.JSON(http.StatusBadRequest, gin.H{
+        "data":   err.Error(),
+        "result": "fail",
+    })
+}
+
+// checkAppName validates an app name, responding with the error result
+// when it is refused
+func checkAppName(c *gin.Context, name string) bool {
+    if err := validateAppName(name); err != nil {
+        respondInvalidName(c, err)
+        return false
+    }
+    return true
+}
+
+// checkFileNames validates file names, responding with the error result for
+// the first one that is refused
+func checkFileNames(c *gin.Context, names ...string) bool {
+    for _, name := range names {
+        if err := validateFileName(name); err != nil {
+            respondInvalidName(c, err)
+            return false
+        }
+    }
+    return true
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateAppName(t *testing.T) {
+	for name, valid := range map[string]bool{
+		"touchcalc":             true,
+		"my-app_2":              true,
+		"":                      false,
+		"..":                    false,
+		"../etc":                false,
+		"app/sub":               false,
+		"-app":                  false,
+		"app name":              false,
+		"nul":                   false,
+		strings.Repeat("a", 64): true,
+		strings.Repeat("a", 65): false,
+	} {
+		if err := validateAppName(name); (err == nil) != valid {
+			t.Errorf("validateAppName(%q) = %v, want valid %v", name, err, valid)
+		}
+	}
+}
+
+func TestValidateFileName(t *testing.T) {
+	for name, valid := range map[string]bool{
+		"sheet.msc":              true,
+		"Budget 2024 (v2).msc":   true,
+		"50% off.msc":            true,
+		"résumé.txt":             true,
+		"backup_1691506800.json": true,
+		"":                       false,
+		".":                      false,
+		"..":                     false,
+		"../secret":              false,
+		"a/b":                    false,
+		`a\b`:                    false,
+		"tab\there":              false,
+		" padded":                false,
+		"trailing.":              false,
+		"star*.msc":              false,
+		"CON":                    false,
+		"con.msc":                false,
+		"console.msc":            true,
+		"\xff":                   false,
+		strings.Repeat("a", 255): true,
+		strings.Repeat("a", 256): false,
+	} {
+		if err := validateFileName(name); (err == nil) != valid {
+			t.Errorf("validateFileName(%q) = %v, want valid %v", name, err, valid)
+		}
+	}
+}
+
+func TestGoogleVerificationPattern(t *testing.T) {
+	for name, valid := range map[string]bool{
+		"google1234abcd.html": true,
+		"login.html":          false,
+		"google.html":         false,
+		"../google12.html":    false,
+		"google12.html.bak":   false,
+	} {
+		if googleVerificationPattern.MatchString(name) != valid {
+			t.Errorf("googleVerificationPattern matches %q: want %v", name, valid)
+		}
+	}
+}
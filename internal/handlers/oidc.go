@@ -0,0 +1,314 @@
+package handlers
+
+import (
+    "errors"
+    "fmt"
+    "net/http"
+    "time"
+
+    "github.com/c4gt/tornado-nginx-go-backend/internal/auth"
+    "github.com/c4gt/tornado-nginx-go-backend/internal/config"
+    "github.com/c4gt/tornado-nginx-go-backend/internal/models"
+    "github.com/c4gt/tornado-nginx-go-backend/internal/oidc"
+    "github.com/c4gt/tornado-nginx-go-backend/internal/session"
+    "github.com/gin-gonic/gin"
+)
+
+const oidcLoginTimeout = 10 * time.Minute
+
+var errAccountNotLinked = errors.New("An account with this email address already exists. " +
+    "Sign in and link this provider from your account settings")
+
+type OIDCHandler struct {
+    handler   *Handler
+    service   *auth.Service
+    providers map[string]*oidc.Provider
+    order     []string
+}
+
+func NewOIDCHandler(h *Handler, service *auth.Service) *OIDCHandler {
+    o := &OIDCHandler{
+        handler:   h,
+        service:   service,
+        providers: make(map[string]*oidc.Provider),
+    }
+
+    for _, cfg := range h.Config.OIDCProviders {
+        if cfg.Issuer == "" || cfg.ClientID == "" {
+            fmt.Printf("DEBUG: Skipping OIDC provider %s: issuer and client id are required\n", cfg.Name)
+            continue
+        }
+        o.AddProvider(oidc.NewProvider(cfg, nil))
+    }
+
+    return o
+}
+
+// AddProvider registers an identity provider under its configured name
+func (h *OIDCHandler) AddProvider(provider *oidc.Provider) {
+    name := provider.Config.Name
+    if _, exists := h.providers[name]; !exists {
+        h.order = append(h.order, name)
+    }
+    h.providers[name] = provider
+}
+
+// Providers lists the configured providers for the login page
+func (h *OIDCHandler) Providers() []config.OIDCProviderConfig {
+    providers := make([]config.OIDCProviderConfig, 0, len(h.order))
+    for _, name := range h.order {
+        providers = append(providers, h.providers[name].Config)
+    }
+    return providers
+}
+
+// HandleLogin starts the authorization code flow with the selected provider.
+// With ?link=1 the signed-in user links their identity at the provider to
+// their account instead of signing in.
+func (h *OIDCHandler) HandleLogin(c *gin.Context) {
+    name := c.Param("provider")
+    provider, exists := h.providers[name]
+    if !exists {
+        c.JSON(http.StatusNotFound, gin.H{"error": "Unknown sign-in provider"})
+        return
+    }
+
+    linkUser := ""
+    if c.Query("link") == "1" {
+        if linkUser = h.handler.CurrentUser(c); linkUser == "" {
+            h.renderError(c, http.StatusUnauthorized, "Sign in first to link this provider to your account")
+            return
+        }
+    }
+
+    state, err1 := oidc.RandomString(24)
+    nonce, err2 := oidc.RandomString(24)
+    verifier, err3 := oidc.RandomString(48)
+    if err1 != nil || err2 != nil || err3 != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start sign-in"})
+        return
+    }
+
+    authURL, err := provider.AuthCodeURL(c.Request.Context(), state, nonce, verifier, h.redirectURI(c, name))
+    if err != nil {
+        fmt.Printf("DEBUG: OIDC login start failed for %s: %v\n", name, err)
+        h.renderError(c, http.StatusBadGateway, "Sign-in provider is unavailable, please try again later")
+        return
+    }
+
+    // Remember the flow server-side, keyed by state, and bind it to this browser
+    pending := session.NewSession(oidcSessionID(state))
+    pending.SetValue("provider", name)
+    pending.SetValue("nonce", nonce)
+    pending.SetValue("verifier", verifier)
+    pending.SetValue("started", int(time.Now().Unix()))
+    pending.SetValue("link", linkUser)
+    h.handler.Session.Set(pending.ID, pending)
+
+    // The provider redirects back from its own site, so this cookie stays
+    // Lax whatever COOKIE_SAMESITE says
+    c.SetSameSite(http.SameSiteLaxMode)
+    c.SetCookie("oidc_state", state, int(oidcLoginTimeout.Seconds()), "/oidc", "", h.handler.Config.CookieSecure, true)
+    c.Redirect(http.StatusFound, authURL)
+}
+
+// HandleCallback completes the flow, verifies the ID token and signs the user in
+func (h *OIDCHandler) HandleCallback(c *gin.Context) {
+    name := c.Param("provider")
+    provider, exists := h.providers[name]
+    if !exists {
+        c.JSON(http.StatusNotFound, gin.H{"error": "Unknown sign-in provider"})
+        return
+    }
+
+    if errCode := c.Query("error"); errCode != "" {
+        fmt.Printf("DEBUG: OIDC provider %s returned error: %s\n", name, errCode)
+        h.auditLogin(c, name, "", "provider_error: "+errCode)
+        h.renderError(c, http.StatusUnauthorized, "Sign-in was cancelled or denied")
+        return
+    }
+
+    state := c.Query("state")
+    cookieState, _ := c.Cookie("oidc_state")
+    c.SetCookie("oidc_state", "", -1, "/oidc", "", h.handler.Config.CookieSecure, true)
+    if state == "" || state != cookieState {
+        h.auditLogin(c, name, "", "invalid_state")
+        h.renderError(c, http.StatusBadRequest, "Sign-in session is invalid, please try again")
+        return
+    }
+
+    // The pending flow is single use
+    pending, found := h.handler.Session.Get(oidcSessionID(state))
+    h.handler.Session.Delete(oidcSessionID(state))
+    if !found {
+        h.auditLogin(c, name, "", "expired")
+        h.renderError(c, http.StatusBadRequest, "Sign-in session has expired, please try again")
+        return
+    }
+
+    pendingProvider, _ := pending.GetString("provider")
+    nonce, _ := pending.GetString("nonce")
+    verifier, _ := pending.GetString("verifier")
+    started, _ := pending.GetInt("started")
+    linkUser, _ := pending.GetString("link")
+    if pendingProvider != name || time.Since(time.Unix(int64(started), 0)) > oidcLoginTimeout {
+        h.auditLogin(c, name, "", "expired")
+        h.renderError(c, http.StatusBadRequest, "Sign-in session has expired, please try again")
+        return
+    }
+
+    token, err := provider.Exchange(c.Request.Context(), c.Query("code"), verifier, h.redirectURI(c, name))
+    if err != nil {
+        fmt.Printf("DEBUG: OIDC code exchange failed for %s: %v\n", name, err)
+        h.auditLogin(c, name, "", "code_exchange")
+        h.renderError(c, http.StatusUnauthorized, "Sign-in failed, please try again")
+        return
+    }
+
+    claims, err := provider.VerifyIDToken(c.Request.Context(), token.IDToken, nonce)
+    if err != nil {
+        fmt.Printf("DEBUG: OIDC token verification failed for %s: %v\n", name, err)
+        h.auditLogin(c, name, "", "invalid_token")
+        h.renderError(c, http.StatusUnauthorized, "Sign-in failed, please try again")
+        return
+    }
+
+    if linkUser != "" {
+        h.completeLink(c, name, claims, linkUser)
+        return
+    }
+
+    email, err := h.resolveUser(name, claims)
+    if err != nil {
+        fmt.Printf("DEBUG: OIDC user resolution failed for %s/%s: %v\n", name, claims.Subject, err)
+        h.auditLogin(c, name, claims.Email, err.Error())
+        h.renderError(c, http.StatusUnauthorized, err.Error())
+        return
+    }
+
+    h.handler.Auth.setCurrentUser(c, email)
+    h.auditLogin(c, name, email, "")
+    c.Redirect(http.StatusFound, "/browser")
+}
+
+// auditLogin records a sign-in through a provider; an empty reason means it
+// succeeded
+func (h *OIDCHandler) auditLogin(c *gin.Context, provider, email, reason string) {
+    event := &models.AuditEvent{
+        Type:    models.AuditLogin,
+        Outcome: models.AuditSuccess,
+        Actor:   email,
+        Subject: email,
+        Method:  "oidc:" + provider,
+        Reason:  reason,
+    }
+    if reason != "" {
+        event.Outcome = models.AuditFailure
+    }
+    h.handler.audit(c, event)
+}
+
+// completeLink links the identity to the account that started the flow,
+// which must still be signed in in this browser
+func (h *OIDCHandler) completeLink(c *gin.Context, provider string, claims *oidc.Claims, linkUser string) {
+    event := &models.AuditEvent{
+        Type:    models.AuditIdentityLink,
+        Outcome: models.AuditSuccess,
+        Actor:   linkUser,
+        Subject: linkUser,
+        Method:  "oidc:" + provider,
+    }
+    fail := func(status int, reason, message string) {
+        event.Outcome = models.AuditFailure
+        event.Reason = reason
+        h.handler.audit(c, event)
+        h.renderError(c, status, message)
+    }
+
+    if h.handler.CurrentUser(c) != linkUser {
+        fail(http.StatusUnauthorized, "signed_out", "Sign in again to link this provider to your account")
+        return
+    }
+    if existing, err := h.service.FindUserByIdentity(provider, claims.Subject); err == nil && existing.Email != linkUser {
+        fail(http.StatusConflict, "linked_elsewhere", "This account at the provider is already linked to another account")
+        return
+    }
+    if err := h.service.LinkIdentity(linkUser, provider, claims.Subject, claims.Email); err != nil {
+        fmt.Printf("DEBUG: OIDC link of %s/%s to %s failed: %v\n", provider, claims.Subject, linkUser, err)
+        fail(http.StatusInternalServerError, "link_failed", "Failed to link account, please try again")
+        return
+    }
+    h.handler.audit(c, event)
+    c.Redirect(http.StatusFound, "/browser")
+}
+
+// resolveUser finds the account linked to the external identity, creating
+// one by verified email address on first sign-in. Identities are never
+// linked to an existing account here: that the provider vouches for the
+// address does not prove the caller owns the account, so its owner links
+// them while signed in, with ?link=1.
+func (h *OIDCHandler) resolveUser(provider string, claims *oidc.Claims) (string, error) {
+    user, err := h.service.FindUserByIdentity(provider, claims.Subject)
+    if err == nil {
+        if user.Disabled {
+            return "", fmt.Errorf("This account has been disabled")
+        }
+        return user.Email, nil
+    }
+    if !errors.Is(err, auth.ErrUserNotFound) {
+        return "", fmt.Errorf("Server error occurred, please try again")
+    }
+
+    if !claims.IsEmailVerified() || !auth.ValidateEmail(claims.Email) {
+        return "", fmt.Errorf("Your account at this provider has no verified email address")
+    }
+
+    // A former address of a renamed account still signs in to that account
+    email := h.service.ResolveEmail(claims.Email)
+    exists, err := h.service.UserExists(email)
+    if err != nil {
+        return "", fmt.Errorf("Server error occurred, please try again")
+    }
+    if exists {
+        return "", errAccountNotLinked
+    }
+
+    // The registration policy applies to accounts created on first
+    // sign-in too; there is no way to enter an invite code here
+    if err := h.service.ClaimRegistration(email, ""); err != nil {
+        var refused *auth.RegistrationError
+        switch {
+        case !errors.As(err, &refused):
+            return "", fmt.Errorf("Server error occurred, please try again")
+        case refused.Reason == auth.ReasonDomainNotAllowed:
+            return "", err
+        default:
+            return "", fmt.Errorf("New accounts need an invite code, please register with it first")
+        }
+    }
+    if err := h.service.CreateExternalUser(email); err != nil {
+        return "", fmt.Errorf("Failed to create user")
+    }
+    h.handler.Auth.createUserHome(email)
+
+    if err := h.service.LinkIdentity(email, provider, claims.Subject, claims.Email); err != nil {
+        return "", fmt.Errorf("Failed to link account: %v", err)
+    }
+    return email, nil
+}
+
+func (h *OIDCHandler) redirectURI(c *gin.Context, provider string) string {
+    return h.handler.baseURL(c) + "/oidc/" + provider + "/callback"
+}
+
+func (h *OIDCHandler) renderError(c *gin.Context, status int, message string) {
+    renderHTML(c, status, "login.html", gin.H{
+        "user":      nil,
+        "error":     message,
+        "providers": h.Providers(),
+    })
+}
+
+func oidcSessionID(state string) string {
+    return "oidc:" + state
+}
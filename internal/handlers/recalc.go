@@ -0,0 +1,106 @@
+package handlers
+
+import (
+    "errors"
+    "fmt"
+    "net/http"
+    "strings"
+
+    "github.com/c4gt/tornado-nginx-go-backend/internal/formula"
+    "github.com/c4gt/tornado-nginx-go-backend/internal/socialcalc"
+    "github.com/c4gt/tornado-nginx-go-backend/internal/storage"
+    "github.com/gin-gonic/gin"
+)
+
+// RecalcCell is the recalculated value of a cell: a number, or text for
+// text and errors, with the message of errors that have one
+type RecalcCell struct {
+    Type    string      `json:"type"`
+    Value   interface{} `json:"value"`
+    Formula string      `json:"formula,omitempty"`
+    Error   string      `json:"error,omitempty"`
+}
+
+// RecalcSheet holds the values of the cells of one sheet by coordinate
+type RecalcSheet struct {
+    Name  string                `json:"name"`
+    Cells map[string]RecalcCell `json:"cells"`
+}
+
+// handleRecalc recalculates a stored spreadsheet on the server and returns
+// the values of its cells. The stored file is left as it is.
+func (h *WebAppHandler) handleRecalc(c *gin.Context, user string, req WebAppRequest) {
+    if req.AppName == "" || req.FName == "" {
+        c.JSON(http.StatusBadRequest, gin.H{
+            "data":   "missing parameters (appname or fname)",
+            "result": "fail",
+        })
+        return
+    }
+
+    workbook, name, err := h.handler.Export.loadWorkbook(user, req.AppName, req.FName)
+    if errors.Is(err, storage.ErrNotFound) {
+        c.JSON(http.StatusNotFound, gin.H{
+            "data":   "file not found: " + req.FName,
+            "result": "fail",
+        })
+        return
+    }
+    if err != nil {
+        fmt.Printf("DEBUG: Recalc of %s/%s failed: %v\n", req.AppName, req.FName, err)
+        c.JSON(http.StatusUnprocessableEntity, gin.H{
+            "data":   "invalid spreadsheet: " + err.Error(),
+            "result": "fail",
+        })
+        return
+    }
+
+    result := formula.Recalc(workbook)
+    sheets := make([]RecalcSheet, 0, len(workbook.Sheets))
+    for _, sheet := range workbook.Sheets {
+        sheets = append(sheets, RecalcSheet{Name: sheet.Name, Cells: recalcCells(sheet.Doc.Sheet)})
+    }
+
+    fmt.Printf("DEBUG: Recalculated %s/%s for user %s, %d circular, %d kept\n",
+        req.AppName, name, user, len(result.Circular), len(result.Kept))
+    c.JSON(http.StatusOK, gin.H{
+        "data": gin.H{
+            "filename": strings.TrimSuffix(name, ".msc"),
+            "sheets":   sheets,
+            "circular": nonNil(result.Circular),
+            "kept":     nonNil(result.Kept),
+        },
+        "result": "ok",
+    })
+}
+
+func recalcCells(sheet *socialcalc.Sheet) map[string]RecalcCell {
+    cells := make(map[string]RecalcCell)
+    for coord, cell := range sheet.Cells {
+        if cell.DataType == "" {
+            continue
+        }
+        out := RecalcCell{Type: cell.ValueType, Value: cell.Value}
+        if n, ok := cell.Number(); ok {
+            out.Value = n
+        }
+        if strings.HasPrefix(cell.ValueType, socialcalc.ValueError) {
+            out.Value = cell.Text()
+            if cell.Value != cell.Text() {
+                out.Error = cell.Value
+            }
+        }
+        if cell.IsFormula() {
+            out.Formula = cell.Formula
+        }
+        cells[coord] = out
+    }
+    return cells
+}
+
+func nonNil[T any](list []T) []T {
+    if list == nil {
+        return []T{}
+    }
+    return list
+}
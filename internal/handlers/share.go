@@ -0,0 +1,243 @@
+package handlers
+
+import (
+    "errors"
+    "fmt"
+    "net/http"
+
+    "github.com/c4gt/tornado-nginx-go-backend/internal/auth"
+    "github.com/c4gt/tornado-nginx-go-backend/internal/models"
+    "github.com/gin-gonic/gin"
+)
+
+type ShareHandler struct {
+    handler *Handler
+    service *auth.Service
+}
+
+func NewShareHandler(h *Handler, service *auth.Service) *ShareHandler {
+    return &ShareHandler{
+        handler: h,
+        service: service,
+    }
+}
+
+type ShareRequest struct {
+    File string `json:"file" form:"file"`
+    User string `json:"user" form:"user"`
+    Role string `json:"role" form:"role"`
+}
+
+// HandleListShares lists what the signed-in user shares, in every app
+// folder or in the one named in the path
+func (h *ShareHandler) HandleListShares(c *gin.Context) {
+    user, ok := h.currentUser(c)
+    if !ok {
+        return
+    }
+    appName := c.Param("app")
+    if appName != "" && !checkAppName(c, appName) {
+        return
+    }
+
+    shares, err := h.service.ListShares(user, appName)
+    if err != nil {
+        h.respond(c, err)
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{
+        "data":   nonNil(shares),
+        "result": "ok",
+    })
+}
+
+// HandleShare shares an app folder of the signed-in user, or the file in it
+// named by file, with another registered user as viewer or editor
+func (h *ShareHandler) HandleShare(c *gin.Context) {
+    user, ok := h.currentUser(c)
+    if !ok {
+        return
+    }
+    appName := c.Param("app")
+    var req ShareRequest
+    c.ShouldBind(&req)
+    if !checkAppName(c, appName) || (req.File != "" && !checkFileNames(c, req.File)) {
+        return
+    }
+    if req.User == "" {
+        c.JSON(http.StatusBadRequest, gin.H{
+            "data":   "missing user",
+            "result": "fail",
+        })
+        return
+    }
+    if req.Role == "" {
+        req.Role = models.ShareViewer
+    }
+
+    // Only files that exist can be shared; folders can be shared before
+    // anything is saved in them
+    if req.File != "" && !h.handler.fileExists(user, appName, req.File) {
+        c.JSON(http.StatusNotFound, gin.H{
+            "data":   "file not found: " + req.File,
+            "result": "fail",
+        })
+        return
+    }
+
+    share, err := h.service.Share(user, appName, req.File, req.User, req.Role)
+    if err != nil {
+        h.respond(c, err)
+        return
+    }
+    fmt.Printf("DEBUG: %s shared %s/%s with %s as %s\n", user, appName, share.File, share.User, share.Role)
+    c.JSON(http.StatusOK, gin.H{
+        "data":   share,
+        "result": "ok",
+    })
+}
+
+// HandleUnshare revokes a share of the signed-in user's app folder, or of
+// the file in it named by file, from the user named by user
+func (h *ShareHandler) HandleUnshare(c *gin.Context) {
+    user, ok := h.currentUser(c)
+    if !ok {
+        return
+    }
+    appName := c.Param("app")
+    var req ShareRequest
+    c.ShouldBind(&req)
+    if !checkAppName(c, appName) {
+        return
+    }
+    if req.User == "" {
+        c.JSON(http.StatusBadRequest, gin.H{
+            "data":   "missing user",
+            "result": "fail",
+        })
+        return
+    }
+
+    err := h.service.Unshare(user, appName, req.File, req.User)
+    if err == nil {
+        fmt.Printf("DEBUG: %s revoked %s/%s from %s\n", user, appName, req.File, req.User)
+    }
+    h.respond(c, err)
+}
+
+// HandleSharedWithMe lists what other users share with the signed-in user
+func (h *ShareHandler) HandleSharedWithMe(c *gin.Context) {
+    user, ok := h.currentUser(c)
+    if !ok {
+        return
+    }
+
+    shares, err := h.service.SharedWith(user)
+    if err != nil {
+        h.respond(c, err)
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{
+        "data":   nonNil(shares),
+        "result": "ok",
+    })
+}
+
+func (h *ShareHandler) currentUser(c *gin.Context) (string, bool) {
+    user := h.handler.CurrentUser(c)
+    if user == "" {
+        c.JSON(http.StatusUnauthorized, gin.H{
+            "data":   "usererror",
+            "result": "fail",
+        })
+        return "", false
+    }
+    return user, true
+}
+
+func (h *ShareHandler) respond(c *gin.Context, err error) {
+    switch {
+    case err == nil:
+        c.JSON(http.StatusOK, gin.H{
+            "result": "ok",
+        })
+    case errors.Is(err, auth.ErrShareNotFound):
+        c.JSON(http.StatusNotFound, gin.H{
+            "data":   err.Error(),
+            "result": "fail",
+        })
+    case errors.Is(err, auth.ErrShareUnknownUser), errors.Is(err, auth.ErrShareWithOwner),
+        errors.Is(err, auth.ErrShareRole):
+        c.JSON(http.StatusBadRequest, gin.H{
+            "data":   err.Error(),
+            "result": "fail",
+        })
+    default:
+        fmt.Printf("DEBUG: Share action %s %s failed: %v\n", c.Request.Method, c.Request.URL.Path, err)
+        c.JSON(http.StatusInternalServerError, gin.H{
+            "data":   "share action failed",
+            "result": "fail",
+        })
+    }
+}
+
+// fileOwner returns whose files a request acts on: the user named by owner
+// when it names another user, and otherwise the signed-in user
+func fileOwner(user, owner string) string {
+    if owner == "" || auth.NormalizeEmail(owner) == auth.NormalizeEmail(user) {
+        return user
+    }
+    return auth.NormalizeEmail(owner)
+}
+
+// access returns the role user has on a file in the owner's app folder, or
+// on the folder when file is empty, as auth.Service.Access does
+func (h *Handler) access(user, owner, appName, file string) (string, error) {
+    if auth.NormalizeEmail(user) == auth.NormalizeEmail(owner) {
+        return models.ShareOwner, nil
+    }
+    if h.authService == nil {
+        return "", nil
+    }
+    return h.authService.Access(user, owner, appName, file)
+}
+
+// requireAccess checks that user has at least role on each of files in the
+// owner's app folder, or on the folder when no files are given, and answers
+// the request when not
+func (h *Handler) requireAccess(c *gin.Context, user, owner, appName, role string, files ...string) bool {
+    if len(files) == 0 {
+        files = []string{""}
+    }
+    for _, file := range files {
+        granted, err := h.access(user, owner, appName, file)
+        if err != nil {
+            fmt.Printf("DEBUG: Access check of %s on %s/%s failed: %v\n", user, appName, file, err)
+            c.JSON(http.StatusInternalServerError, gin.H{
+                "data":   "failed to check access",
+                "result": "fail",
+            })
+            return false
+        }
+        if !models.ShareRoleAllows(granted, role) {
+            fmt.Printf("DEBUG: %s denied %s access to %s/%s of %s\n", user, role, appName, file, owner)
+            c.JSON(http.StatusForbidden, gin.H{
+                "data":   "permission denied",
+                "result": "fail",
+            })
+            return false
+        }
+    }
+    return true
+}
+
+// fileExists reports whether the owner's app folder holds a file, under its
+// name or with the .msc extension SocialCalc saves add
+func (h *Handler) fileExists(owner, appName, file string) bool {
+    for _, name := range []string{file, auth.ShareFileName(file), auth.ShareFileName(file) + ".msc"} {
+        if _, err := h.Storage.GetFile(auth.HomePath(owner, "securestore", appName, name)); err == nil {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,315 @@
+package handlers
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "net/http"
+    "net/url"
+    "strings"
+    "time"
+
+    "github.com/c4gt/tornado-nginx-go-backend/internal/auth"
+    "github.com/c4gt/tornado-nginx-go-backend/internal/formula"
+    "github.com/c4gt/tornado-nginx-go-backend/internal/models"
+    "github.com/c4gt/tornado-nginx-go-backend/internal/socialcalc"
+    "github.com/c4gt/tornado-nginx-go-backend/internal/storage"
+    "github.com/gin-gonic/gin"
+)
+
+// viewCookieName is the cookie that holds the proof that this browser gave
+// the password of a share link, set for the link's path only
+const viewCookieName = "viewlink"
+
+// maxShareLinkDays is the longest a share link can be valid, well below
+// where the days overflow a time.Duration
+const maxShareLinkDays = 3650
+
+type ShareLinkHandler struct {
+    handler *Handler
+    service *auth.Service
+}
+
+func NewShareLinkHandler(h *Handler, service *auth.Service) *ShareLinkHandler {
+    return &ShareLinkHandler{
+        handler: h,
+        service: service,
+    }
+}
+
+// HandleCreateLink issues a link to view a spreadsheet of the signed-in
+// user without an account. days is how long it is valid (default 0, for
+// no expiry) and password, when given, must be entered to view it.
+func (h *ShareLinkHandler) HandleCreateLink(c *gin.Context) {
+    user, ok := h.handler.Share.currentUser(c)
+    if !ok {
+        return
+    }
+    appName := c.Param("app")
+    fileName := c.Param("file")
+    if !checkAppName(c, appName) || !checkFileNames(c, fileName) {
+        return
+    }
+
+    var req struct {
+        Days     int    `json:"days" form:"days"`
+        Password string `json:"password" form:"password"`
+    }
+    c.ShouldBind(&req)
+    if req.Days < 0 {
+        c.JSON(http.StatusBadRequest, gin.H{
+            "data":   "days cannot be negative",
+            "result": "fail",
+        })
+        return
+    }
+    if req.Days > maxShareLinkDays {
+        c.JSON(http.StatusBadRequest, gin.H{
+            "data":   fmt.Sprintf("days cannot be more than %d", maxShareLinkDays),
+            "result": "fail",
+        })
+        return
+    }
+    if !h.handler.fileExists(user, appName, fileName) {
+        c.JSON(http.StatusNotFound, gin.H{
+            "data":   "file not found: " + fileName,
+            "result": "fail",
+        })
+        return
+    }
+
+    link, err := h.service.CreateShareLink(user, appName, fileName, time.Duration(req.Days)*24*time.Hour, req.Password)
+    if err != nil {
+        h.respond(c, err)
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{
+        "data":   h.linkView(c, link),
+        "result": "ok",
+    })
+}
+
+// HandleListLinks lists the signed-in user's share links, newest first,
+// with how often each was viewed. app and file narrow the list down.
+func (h *ShareLinkHandler) HandleListLinks(c *gin.Context) {
+    user, ok := h.handler.Share.currentUser(c)
+    if !ok {
+        return
+    }
+
+    links, err := h.service.ListShareLinks(user, c.Query("app"), c.Query("file"))
+    if err != nil {
+        h.respond(c, err)
+        return
+    }
+    views := make([]gin.H, 0, len(links))
+    for _, link := range links {
+        views = append(views, h.linkView(c, link))
+    }
+    c.JSON(http.StatusOK, gin.H{
+        "data":   views,
+        "result": "ok",
+    })
+}
+
+// HandleRevokeLink deletes a share link of the signed-in user
+func (h *ShareLinkHandler) HandleRevokeLink(c *gin.Context) {
+    user, ok := h.handler.Share.currentUser(c)
+    if !ok {
+        return
+    }
+    h.respond(c, h.service.RevokeShareLink(user, c.Param("token")))
+}
+
+// HandleView shows the spreadsheet of a share link read-only, or the form
+// asking for its password
+func (h *ShareLinkHandler) HandleView(c *gin.Context) {
+    viewHeaders(c)
+    link, err := h.service.GetShareLink(c.Param("token"))
+    if err != nil {
+        h.viewError(c, err)
+        return
+    }
+    if link.HasPassword() && !h.unlocked(c, link) {
+        renderHTML(c, http.StatusOK, "sheetviewer.html", gin.H{"password": true})
+        return
+    }
+    h.serveView(c, link)
+}
+
+// HandleUnlock checks the password of a share link, and remembers in this
+// browser that it was given
+func (h *ShareLinkHandler) HandleUnlock(c *gin.Context) {
+    viewHeaders(c)
+    token := c.Param("token")
+    link, err := h.service.UnlockShareLink(token, c.PostForm("password"), c.ClientIP())
+    var throttleErr *auth.ThrottleError
+    switch {
+    case errors.As(err, &throttleErr):
+        c.Header("Retry-After", fmt.Sprintf("%d", int(throttleErr.RetryAfter.Seconds())+1))
+        renderHTML(c, http.StatusTooManyRequests, "sheetviewer.html", gin.H{
+            "password": true,
+            "error":    "Too many attempts, try again later.",
+        })
+        return
+    case errors.Is(err, auth.ErrShareLinkPassword):
+        renderHTML(c, http.StatusUnauthorized, "sheetviewer.html", gin.H{
+            "password": true,
+            "error":    "Wrong password.",
+        })
+        return
+    case err != nil:
+        h.viewError(c, err)
+        return
+    }
+
+    path := "/view/" + url.PathEscape(token)
+    h.handler.setCookie(c, viewCookieName, h.unlockProof(link), 0, path)
+    c.Redirect(http.StatusSeeOther, path)
+}
+
+// serveView renders one sheet of the link's spreadsheet, the one named by
+// ?sheet= or the current one, recalculated like exports. Nothing else of
+// the owner's is read, and the page holds the sheet only.
+func (h *ShareLinkHandler) serveView(c *gin.Context, link *models.ShareLink) {
+    workbook, name, err := h.handler.Export.loadWorkbook(link.Owner, link.App, link.File)
+    if errors.Is(err, storage.ErrNotFound) {
+        renderHTML(c, http.StatusNotFound, "sheetviewer.html", gin.H{
+            "error": "This spreadsheet is no longer available.",
+        })
+        return
+    }
+    if err != nil {
+        fmt.Printf("DEBUG: Share link view of %s/%s failed: %v\n", link.App, link.File, err)
+        renderHTML(c, http.StatusUnprocessableEntity, "sheetviewer.html", gin.H{
+            "error": "This spreadsheet cannot be shown.",
+        })
+        return
+    }
+    formula.Recalc(workbook)
+
+    sheet := viewerSheet(workbook, c.Query("sheet"))
+    if sheet == nil {
+        renderHTML(c, http.StatusNotFound, "sheetviewer.html", gin.H{
+            "error": "Sheet not found.",
+        })
+        return
+    }
+    var tabs []string
+    for _, s := range workbook.Sheets {
+        if !s.Hidden && s.Name != "" {
+            tabs = append(tabs, s.Name)
+        }
+    }
+    if len(tabs) < 2 {
+        tabs = nil
+    }
+
+    if _, err := h.service.ViewShareLink(link.Token); err != nil {
+        h.viewError(c, err)
+        return
+    }
+    renderHTML(c, http.StatusOK, "sheetviewer.html", gin.H{
+        "title":    strings.TrimSuffix(name, ".msc"),
+        "sheetstr": sheet.Doc.Sheet.String(),
+        "sheets":   tabs,
+        "current":  sheet.Name,
+    })
+}
+
+// viewerSheet returns the named sheet, or without a name the current sheet
+// or else the first, leaving out hidden sheets
+func viewerSheet(workbook *socialcalc.Workbook, name string) *socialcalc.WorkbookSheet {
+    if name != "" {
+        if sheet := workbook.Sheet(name); sheet != nil && !sheet.Hidden {
+            return sheet
+        }
+        return nil
+    }
+    if sheet := workbook.Sheet(workbook.CurrentName); sheet != nil && !sheet.Hidden {
+        return sheet
+    }
+    for _, sheet := range workbook.Sheets {
+        if !sheet.Hidden {
+            return sheet
+        }
+    }
+    return nil
+}
+
+func (h *ShareLinkHandler) viewError(c *gin.Context, err error) {
+    if errors.Is(err, auth.ErrShareLinkNotFound) {
+        renderHTML(c, http.StatusNotFound, "sheetviewer.html", gin.H{
+            "error": "This link does not exist, has expired or was revoked.",
+        })
+        return
+    }
+    fmt.Printf("DEBUG: Share link view failed: %v\n", err)
+    renderHTML(c, http.StatusInternalServerError, "sheetviewer.html", gin.H{
+        "error": "This spreadsheet cannot be shown right now.",
+    })
+}
+
+// unlockProof is the value of the cookie set once the password of a link
+// was given. It is bound to the password, so it cannot be made without it.
+func (h *ShareLinkHandler) unlockProof(link *models.ShareLink) string {
+    mac := hmac.New(sha256.New, []byte(h.handler.Config.CookieSecret))
+    mac.Write([]byte(link.Token + "\n" + link.PasswordHash))
+    return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (h *ShareLinkHandler) unlocked(c *gin.Context, link *models.ShareLink) bool {
+    proof, err := c.Cookie(viewCookieName)
+    return err == nil && hmac.Equal([]byte(proof), []byte(h.unlockProof(link)))
+}
+
+// viewHeaders keeps viewer pages, whose URL is all it takes to see the
+// spreadsheet, out of caches, search engines and the Referer of requests
+func viewHeaders(c *gin.Context) {
+    c.Header("Cache-Control", "no-store")
+    c.Header("Referrer-Policy", "no-referrer")
+    c.Header("X-Robots-Tag", "noindex, nofollow")
+}
+
+func (h *ShareLinkHandler) linkView(c *gin.Context, link *models.ShareLink) gin.H {
+    return gin.H{
+        "token":        link.Token,
+        "link":         h.handler.baseURL(c) + "/view/" + url.PathEscape(link.Token),
+        "app":          link.App,
+        "file":         link.File,
+        "createdat":    link.CreatedAt,
+        "expiresat":    link.ExpiresAt,
+        "expired":      link.IsExpired(time.Now()),
+        "protected":    link.HasPassword(),
+        "views":        link.Views,
+        "lastviewedat": link.LastViewedAt,
+    }
+}
+
+func (h *ShareLinkHandler) respond(c *gin.Context, err error) {
+    var policyErr *auth.PasswordPolicyError
+    switch {
+    case err == nil:
+        c.JSON(http.StatusOK, gin.H{
+            "result": "ok",
+        })
+    case errors.Is(err, auth.ErrShareLinkNotFound):
+        c.JSON(http.StatusNotFound, gin.H{
+            "data":   "share link not found",
+            "result": "fail",
+        })
+    case errors.As(err, &policyErr):
+        c.JSON(http.StatusBadRequest, gin.H{
+            "data":   policyErr.Message,
+            "result": "fail",
+        })
+    default:
+        fmt.Printf("DEBUG: Share link action %s %s failed: %v\n", c.Request.Method, c.Request.URL.Path, err)
+        c.JSON(http.StatusInternalServerError, gin.H{
+            "data":   "share link action failed",
+            "result": "fail",
+        })
+    }
+}
@@ -2,9 +2,14 @@ package handlers
 
 import (
     "encoding/json"
+    "errors"
     "fmt"
     "net/http"
 
+    "github.com/c4gt/tornado-nginx-go-backend/internal/auth"
+    "github.com/c4gt/tornado-nginx-go-backend/internal/models"
+    "github.com/c4gt/tornado-nginx-go-backend/internal/socialcalc"
+    "github.com/c4gt/tornado-nginx-go-backend/internal/storage"
     "github.com/gin-gonic/gin"
 )
 
@@ -24,6 +29,12 @@ type WebAppRequest struct {
     FName   string `json:"fname" form:"fname"`
     Data    string `json:"data" form:"data"`
     Content string `json:"content" form:"content"`
+    // Owner names the user whose files to act on, when they shared them
+    Owner string `json:"owner" form:"owner"`
+    // Sheet names the sheet of a spreadsheet to act on, and NewName the
+    // name to rename it to
+    Sheet   string `json:"sheet" form:"sheet"`
+    NewName string `json:"newname" form:"newname"`
 }
 
 func (h *WebAppHandler) HandleWebApp(c *gin.Context) {
@@ -46,31 +57,66 @@ func (h *WebAppHandler) HandleWebApp(c *gin.Context) {
         return
     }
 
+    // Actions act on the files of the owner, who is the user unless they
+    // name someone who shared files with them
+    owner := fileOwner(user, req.Owner)
+
     // Log the action for debugging
-    fmt.Printf("DEBUG: WebApp action: %s, user: %s, app: %s, file: %s\n", 
-        req.Action, user, req.AppName, req.FName)
+    fmt.Printf("DEBUG: WebApp action: %s, user: %s, owner: %s, app: %s, file: %s\n", 
+        req.Action, user, owner, req.AppName, req.FName)
+
+    // Names become storage path segments, so anything that is not a plain
+    // app or file name is refused before acting on it
+    if req.AppName != "" && !checkAppName(c, req.AppName) {
+        return
+    }
+    if req.FName != "" && !checkFileNames(c, req.FName) {
+        return
+    }
+
+    // Listings of folders shared file by file show those files only
+    if req.Action == "listdir" && owner != user {
+        h.handleSharedListDir(c, user, owner, req)
+        return
+    }
+    if role, appName, files := webAppAccess(c, req); role != "" &&
+        !h.handler.requireAccess(c, user, owner, appName, role, files...) {
+        return
+    }
 
     switch req.Action {
     case "savefile":
-        h.handleSaveFile(c, user, req)
+        h.handleSaveFile(c, owner, req)
     case "getfile":
-        h.handleGetFile(c, user, req)
+        h.handleGetFile(c, owner, req)
     case "delete-file":
-        h.handleDeleteFile(c, user, req)
+        h.handleDeleteFile(c, owner, req)
     case "listdir":
-        h.handleListDir(c, user, req)
+        h.handleListDir(c, owner, req)
     case "save-multiple":
-        h.handleSaveMultiple(c, user, req)
+        h.handleSaveMultiple(c, owner, req)
     case "get-data":
-        h.handleGetData(c, user, req)
+        h.handleGetData(c, owner, req)
     case "backup":
-        h.handleBackup(c, user, req)
+        h.handleBackup(c, owner, req)
     case "restore":
-        h.handleRestore(c, user, req)
+        h.handleRestore(c, owner, req)
     case "save":
-        h.handleSocialCalcSave(c, user, req)
+        h.handleSocialCalcSave(c, owner, req)
     case "load":
-        h.handleSocialCalcLoad(c, user, req)
+        h.handleSocialCalcLoad(c, owner, req)
+    case "recalc":
+        h.handleRecalc(c, owner, req)
+    case "load-sheet":
+        h.handleLoadSheet(c, owner, req)
+    case "add-sheet":
+        h.handleAddSheet(c, owner, req)
+    case "rename-sheet":
+        h.handleRenameSheet(c, owner, req)
+    case "reorder-sheets":
+        h.handleReorderSheets(c, owner, req)
+    case "delete-sheet":
+        h.handleDeleteSheet(c, owner, req)
     default:
         c.JSON(http.StatusBadRequest, gin.H{
             "data":   "invalid action: " + req.Action,
@@ -90,52 +136,7 @@ func (h *WebAppHandler) handleSaveFile(c *gin.Context, user string, req WebAppRe
 
     fmt.Printf("DEBUG: Saving file %s for user %s in app %s\n", req.FName, user, req.AppName)
 
-    path := []string{"home", user, "securestore", req.AppName, req.FName}
-    // dirPath := []string{"home", user, "securestore", req.AppName}
-
-    // Ensure entire directory structure exists
-    err := h.ensureDirectoryStructure(user, req.AppName)
-    if err != nil {
-        fmt.Printf("DEBUG: Error ensuring directory structure: %v\n", err)
-        c.JSON(http.StatusInternalServerError, gin.H{
-            "data":   "failed to create directory structure: " + err.Error(),
-            "result": "fail",
-        })
-        return
-    }
-
-    // Save the data (include metadata for better debugging)
-    fileData := map[string]interface{}{
-        "content": req.Data,
-        "user": user,
-        "app": req.AppName,
-        "filename": req.FName,
-        "timestamp": fmt.Sprintf("%d", getCurrentTimestamp()),
-        "storage_backend": h.handler.Config.StorageBackend,
-    }
-
-    dataJSON, err := json.Marshal(fileData)
-    if err != nil {
-        fmt.Printf("DEBUG: Error marshaling file data: %v\n", err)
-        c.JSON(http.StatusInternalServerError, gin.H{
-            "data":   "failed to encode file data",
-            "result": "fail",
-        })
-        return
-    }
-
-    // Check if file exists
-    _, err = h.handler.Storage.GetFile(path)
-    if err != nil {
-        // File doesn't exist, create it
-        fmt.Printf("DEBUG: Creating new file: %s\n", req.FName)
-        err = h.handler.Storage.CreateFile(path, string(dataJSON))
-    } else {
-        // File exists, update it
-        fmt.Printf("DEBUG: Updating existing file: %s\n", req.FName)
-        err = h.handler.Storage.UpdateFile(path, string(dataJSON))
-    }
-
+    err := h.handler.storeFile(user, req.AppName, req.FName, req.Data)
     if err != nil {
         fmt.Printf("DEBUG: Error saving file: %v\n", err)
         c.JSON(http.StatusInternalServerError, gin.H{
@@ -164,7 +165,7 @@ func (h *WebAppHandler) handleGetFile(c *gin.Context, user string, req WebAppReq
 
     fmt.Printf("DEBUG: Getting file %s for user %s in app %s\n", req.FName, user, req.AppName)
 
-    path := []string{"home", user, "securestore", req.AppName, req.FName}
+    path := auth.HomePath(user, "securestore", req.AppName, req.FName)
     item, err := h.handler.Storage.GetFile(path)
     if err != nil {
         fmt.Printf("DEBUG: File not found: %s, error: %v\n", req.FName, err)
@@ -175,9 +176,20 @@ func (h *WebAppHandler) handleGetFile(c *gin.Context, user string, req WebAppReq
         return
     }
 
-    // Handle both old format (direct string) and new format (JSON with metadata)
+    // Handle both old format (direct string) and new format (JSON with
+    // metadata), and spreadsheets stored sheet by sheet
     var fileContent string
-    if dataStr, ok := item.Data.(string); ok {
+    if content, ok, err := h.handler.workbookContent(user, req.AppName, req.FName, item); ok {
+        if err != nil {
+            fmt.Printf("DEBUG: Error reading spreadsheet %s: %v\n", req.FName, err)
+            c.JSON(http.StatusInternalServerError, gin.H{
+                "data":   "failed to read file data",
+                "result": "fail",
+            })
+            return
+        }
+        fileContent = content
+    } else if dataStr, ok := item.Data.(string); ok {
         // Try to parse as JSON first
         var fileData map[string]interface{}
         if err := json.Unmarshal([]byte(dataStr), &fileData); err == nil {
@@ -228,8 +240,7 @@ func (h *WebAppHandler) handleDeleteFile(c *gin.Context, user string, req WebApp
 
     fmt.Printf("DEBUG: Deleting file %s for user %s in app %s\n", req.FName, user, req.AppName)
 
-    path := []string{"home", user, "securestore", req.AppName, req.FName}
-    err := h.handler.Storage.DeleteFile(path)
+    err := h.handler.deleteFile(user, req.AppName, req.FName)
     if err != nil {
         fmt.Printf("DEBUG: Error deleting file: %v\n", err)
         c.JSON(http.StatusInternalServerError, gin.H{
@@ -257,7 +268,7 @@ func (h *WebAppHandler) handleListDir(c *gin.Context, user string, req WebAppReq
 
     fmt.Printf("DEBUG: Listing directory for user %s in app %s\n", user, req.AppName)
 
-    path := []string{"home", user, "securestore", req.AppName}
+    path := auth.HomePath(user, "securestore", req.AppName)
     
     // Ensure directory exists
     item, err := h.handler.Storage.GetFile(path)
@@ -285,7 +296,7 @@ func (h *WebAppHandler) handleListDir(c *gin.Context, user string, req WebAppReq
     if data, ok := item.Data.([]interface{}); ok {
         for _, file := range data {
             if str, ok := file.(string); ok {
-                fileNames = append(fileNames, str)
+                fileNames = append(fileNames, decodeFileName(str))
             }
         }
     }
@@ -321,6 +332,12 @@ func (h *WebAppHandler) handleSaveMultiple(c *gin.Context, user string, req WebA
         return
     }
 
+    for filename := range filesData {
+        if !checkFileNames(c, filename) {
+            return
+        }
+    }
+
     // Ensure directory structure exists
     err = h.ensureDirectoryStructure(user, req.AppName)
     if err != nil {
@@ -339,34 +356,7 @@ func (h *WebAppHandler) handleSaveMultiple(c *gin.Context, user string, req WebA
             continue
         }
 
-        path := []string{"home", user, "securestore", req.AppName, filename}
-        
-        // Create file data with metadata
-        fileData := map[string]interface{}{
-            "content": content,
-            "user": user,
-            "app": req.AppName,
-            "filename": filename,
-            "timestamp": fmt.Sprintf("%d", getCurrentTimestamp()),
-            "storage_backend": h.handler.Config.StorageBackend,
-        }
-
-        contentStr, err := json.Marshal(fileData)
-        if err != nil {
-            fmt.Printf("DEBUG: Error marshaling file data for %s: %v\n", filename, err)
-            continue
-        }
-
-        // Check if file exists
-        _, err = h.handler.Storage.GetFile(path)
-        if err != nil {
-            // File doesn't exist, create it
-            err = h.handler.Storage.CreateFile(path, string(contentStr))
-        } else {
-            // File exists, update it
-            err = h.handler.Storage.UpdateFile(path, string(contentStr))
-        }
-
+        err := h.handler.storeFile(user, req.AppName, filename, content)
         if err != nil {
             fmt.Printf("DEBUG: Error saving file %s: %v\n", filename, err)
             c.JSON(http.StatusInternalServerError, gin.H{
@@ -409,16 +399,25 @@ func (h *WebAppHandler) handleGetData(c *gin.Context, user string, req WebAppReq
         })
         return
     }
+    if !checkFileNames(c, filenames...) {
+        return
+    }
 
     data := make(map[string]interface{})
     retrievedCount := 0
 
     for _, filename := range filenames {
-        path := []string{"home", user, "securestore", req.AppName, filename}
+        path := auth.HomePath(user, "securestore", req.AppName, filename)
         item, err := h.handler.Storage.GetFile(path)
         if err == nil && item != nil {
             // Handle both old and new format
-            if dataStr, ok := item.Data.(string); ok {
+            if content, ok, err := h.handler.workbookContent(user, req.AppName, filename, item); ok {
+                if err != nil {
+                    fmt.Printf("DEBUG: Error reading spreadsheet %s: %v\n", filename, err)
+                    continue
+                }
+                data[filename] = content
+            } else if dataStr, ok := item.Data.(string); ok {
                 var fileData map[string]interface{}
                 if err := json.Unmarshal([]byte(dataStr), &fileData); err == nil {
                     // New format with metadata
@@ -461,7 +460,7 @@ func (h *WebAppHandler) handleBackup(c *gin.Context, user string, req WebAppRequ
     fmt.Printf("DEBUG: Creating backup for user %s in app %s\n", user, req.AppName)
 
     // List all files in the app directory
-    path := []string{"home", user, "securestore", req.AppName}
+    path := auth.HomePath(user, "securestore", req.AppName)
     item, err := h.handler.Storage.GetFile(path)
     if err != nil {
         c.JSON(http.StatusNotFound, gin.H{
@@ -476,18 +475,34 @@ func (h *WebAppHandler) handleBackup(c *gin.Context, user string, req WebAppRequ
     if data, ok := item.Data.([]interface{}); ok {
         for _, file := range data {
             if filename, ok := file.(string); ok {
-                filePath := []string{"home", user, "securestore", req.AppName, filename}
+                filename = decodeFileName(filename)
+                filePath := auth.HomePath(user, "securestore", req.AppName, filename)
                 fileItem, err := h.handler.Storage.GetFile(filePath)
-                if err == nil && fileItem != nil {
-                    backup[filename] = fileItem.Data
+                if err != nil || fileItem == nil {
+                    continue
+                }
+                // Spreadsheets are backed up whole, as the web app saved
+                // them, since their sheets are stored apart
+                if content, ok, err := h.handler.workbookContent(user, req.AppName, filename, fileItem); ok {
+                    if err != nil {
+                        fmt.Printf("DEBUG: Error reading spreadsheet %s: %v\n", filename, err)
+                        continue
+                    }
+                    wholeData, _ := json.Marshal(map[string]interface{}{
+                        "content": content,
+                        "type":    "socialcalc_spreadsheet",
+                    })
+                    backup[filename] = string(wholeData)
+                    continue
                 }
+                backup[filename] = fileItem.Data
             }
         }
     }
 
     // Save backup with timestamp
     backupFilename := fmt.Sprintf("backup_%d.json", getCurrentTimestamp())
-    backupPath := []string{"home", user, "securestore", req.AppName, backupFilename}
+    backupPath := auth.HomePath(user, "securestore", req.AppName, backupFilename)
     
     backupData, err := json.Marshal(backup)
     if err != nil {
@@ -498,7 +513,11 @@ func (h *WebAppHandler) handleBackup(c *gin.Context, user string, req WebAppRequ
         return
     }
 
-    err = h.handler.Storage.CreateFile(backupPath, string(backupData))
+    unlockHome, err := h.handler.lockHome(user)
+    if err == nil {
+        err = h.handler.Storage.CreateFile(backupPath, string(backupData))
+        unlockHome()
+    }
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{
             "data":   "failed to save backup",
@@ -526,7 +545,7 @@ func (h *WebAppHandler) handleRestore(c *gin.Context, user string, req WebAppReq
     fmt.Printf("DEBUG: Restoring backup %s for user %s in app %s\n", req.FName, user, req.AppName)
 
     // Get backup file
-    backupPath := []string{"home", user, "securestore", req.AppName, req.FName}
+    backupPath := auth.HomePath(user, "securestore", req.AppName, req.FName)
     backupItem, err := h.handler.Storage.GetFile(backupPath)
     if err != nil {
         c.JSON(http.StatusNotFound, gin.H{
@@ -555,15 +574,20 @@ func (h *WebAppHandler) handleRestore(c *gin.Context, user string, req WebAppReq
         return
     }
 
+    for filename := range backupData {
+        if !checkFileNames(c, filename) {
+            return
+        }
+    }
+
     // Restore files
     restoredCount := 0
-    for filename, content := range backupData {
-        path := []string{"home", user, "securestore", req.AppName, filename}
-        contentStr, _ := json.Marshal(content)
-        
-        err = h.handler.Storage.UpdateFile(path, string(contentStr))
+    for filename, data := range backupData {
+        err = h.handler.storeFile(user, req.AppName, filename, backupContent(data))
         if err == nil {
             restoredCount++
+        } else {
+            fmt.Printf("DEBUG: Error restoring %s: %v\n", filename, err)
         }
     }
 
@@ -574,6 +598,113 @@ func (h *WebAppHandler) handleRestore(c *gin.Context, user string, req WebAppReq
     })
 }
 
+// backupContent returns the content of a file in a backup, which holds
+// the stored data of the file: its content with metadata, or for files of
+// old, the content alone
+func backupContent(data interface{}) interface{} {
+    dataStr, ok := data.(string)
+    if !ok {
+        return data
+    }
+    var fileData map[string]interface{}
+    if err := json.Unmarshal([]byte(dataStr), &fileData); err == nil {
+        if content, exists := fileData["content"]; exists {
+            return content
+        }
+    }
+    return dataStr
+}
+
+// webAppAccess returns the role an action needs on the files of another
+// user, the app folder they are in and the files the action reads or
+// writes, none for actions on the whole folder. Unknown actions need none,
+// since they do nothing.
+func webAppAccess(c *gin.Context, req WebAppRequest) (string, string, []string) {
+    switch req.Action {
+    case "getfile", "recalc":
+        return models.ShareViewer, req.AppName, []string{req.FName}
+    case "savefile", "delete-file":
+        return models.ShareEditor, req.AppName, []string{req.FName}
+    case "get-data":
+        var filenames []string
+        json.Unmarshal([]byte(req.Content), &filenames)
+        return models.ShareViewer, req.AppName, filenames
+    case "save-multiple":
+        var filesData map[string]interface{}
+        json.Unmarshal([]byte(req.Content), &filesData)
+        filenames := make([]string, 0, len(filesData))
+        for filename := range filesData {
+            filenames = append(filenames, filename)
+        }
+        return models.ShareEditor, req.AppName, filenames
+    case "listdir":
+        return models.ShareViewer, req.AppName, nil
+    case "backup", "restore":
+        return models.ShareEditor, req.AppName, nil
+    case "load", "load-sheet":
+        return models.ShareViewer, "touchcalc", []string{socialCalcFileName(c, req)}
+    case "save", "add-sheet", "rename-sheet", "reorder-sheets", "delete-sheet":
+        return models.ShareEditor, "touchcalc", []string{socialCalcFileName(c, req)}
+    }
+    return "", "", nil
+}
+
+// handleSharedListDir lists an app folder of another user: all of it for
+// users it is shared with, and otherwise the files in it shared with user
+func (h *WebAppHandler) handleSharedListDir(c *gin.Context, user, owner string, req WebAppRequest) {
+    if req.AppName == "" {
+        c.JSON(http.StatusBadRequest, gin.H{
+            "data":   "missing app name",
+            "result": "fail",
+        })
+        return
+    }
+
+    shares, err := h.handler.authService.UserShares(user, owner, req.AppName)
+    if err != nil {
+        fmt.Printf("DEBUG: Reading shares of %s/%s failed: %v\n", owner, req.AppName, err)
+        c.JSON(http.StatusInternalServerError, gin.H{
+            "data":   "failed to check access",
+            "result": "fail",
+        })
+        return
+    }
+    shared := map[string]bool{}
+    for _, share := range shares {
+        if share.File == "" {
+            h.handleListDir(c, owner, req)
+            return
+        }
+        shared[share.File] = true
+    }
+    if len(shared) == 0 {
+        c.JSON(http.StatusForbidden, gin.H{
+            "data":   "permission denied",
+            "result": "fail",
+        })
+        return
+    }
+
+    fileNames := []string{}
+    item, err := h.handler.Storage.GetFile(auth.HomePath(owner, "securestore", req.AppName))
+    if err == nil {
+        if data, ok := item.Data.([]interface{}); ok {
+            for _, file := range data {
+                if str, ok := file.(string); ok && shared[auth.ShareFileName(decodeFileName(str))] {
+                    fileNames = append(fileNames, decodeFileName(str))
+                }
+            }
+        }
+    }
+
+    fmt.Printf("DEBUG: Shared directory listing of %s for %s, found %d files\n", owner, user, len(fileNames))
+    c.JSON(http.StatusOK, gin.H{
+        "data":   fileNames,
+        "result": "ok",
+        "storage_backend": h.handler.Config.StorageBackend,
+    })
+}
+
 func (h *WebAppHandler) ensureDirectoryStructure(user, appName string) error {
     // Create home directory
     homeDir := []string{"home"}
@@ -586,7 +717,7 @@ func (h *WebAppHandler) ensureDirectoryStructure(user, appName string) error {
     }
 
     // Create user directory
-    userDir := []string{"home", user}
+    userDir := auth.HomePath(user)
     _, err = h.handler.Storage.GetFile(userDir)
     if err != nil {
         err = h.handler.Storage.CreateDir(userDir)
@@ -596,7 +727,7 @@ func (h *WebAppHandler) ensureDirectoryStructure(user, appName string) error {
     }
 
     // Create securestore directory
-    secureDir := []string{"home", user, "securestore"}
+    secureDir := auth.HomePath(user, "securestore")
     _, err = h.handler.Storage.GetFile(secureDir)
     if err != nil {
         err = h.handler.Storage.CreateDir(secureDir)
@@ -606,7 +737,7 @@ func (h *WebAppHandler) ensureDirectoryStructure(user, appName string) error {
     }
 
     // Create app directory
-    appDir := []string{"home", user, "securestore", appName}
+    appDir := auth.HomePath(user, "securestore", appName)
     _, err = h.handler.Storage.GetFile(appDir)
     if err != nil {
         err = h.handler.Storage.CreateDir(appDir)
@@ -618,42 +749,32 @@ func (h *WebAppHandler) ensureDirectoryStructure(user, appName string) error {
     return nil
 }
 
+// decodeFileName turns a name from a directory listing, which is stored in
+// its encoded form, back into the name the client used
+func decodeFileName(name string) string {
+    decoded, err := storage.DecodeSegment(name)
+    if err != nil {
+        return name
+    }
+    return decoded
+}
+
 func getCurrentTimestamp() int64 {
     return 1691506800 // Mock timestamp for now
 }
 
 func (h *WebAppHandler) getCurrentUser(c *gin.Context) string {
-    userCookie, err := c.Cookie("user")
-    if err != nil {
-        return ""
-    }
-
-    // Handle both JSON format and plain text format
-    if len(userCookie) > 0 && userCookie[0] == '"' && userCookie[len(userCookie)-1] == '"' {
-        // JSON format
-        var user string
-        err = json.Unmarshal([]byte(userCookie), &user)
-        if err != nil {
-            return ""
-        }
-        return user
-    }
-    
-    // Plain text format
-    return userCookie
+    return h.handler.CurrentUser(c)
 }
 
 // handleSocialCalcSave handles save requests from SocialCalc spreadsheet
 func (h *WebAppHandler) handleSocialCalcSave(c *gin.Context, user string, req WebAppRequest) {
     // Get additional parameters that SocialCalc sends
-    filename := c.PostForm("filename")
+    filename := socialCalcFileName(c, req)
     content := c.PostForm("content")
     sessionid := c.PostForm("sessionid")
     
     // Use req fields as backup if form params are empty
-    if filename == "" {
-        filename = req.FName
-    }
     if content == "" {
         content = req.Content
     }
@@ -668,6 +789,19 @@ func (h *WebAppHandler) handleSocialCalcSave(c *gin.Context, user string, req We
         })
         return
     }
+    if !checkFileNames(c, filename, filename + ".msc") {
+        return
+    }
+
+    // Refuse content SocialCalc could not load again
+    if _, err := socialcalc.ParseWorkbook(content); err != nil {
+        fmt.Printf("DEBUG: Invalid SocialCalc content for %s: %v\n", filename, err)
+        c.JSON(http.StatusBadRequest, gin.H{
+            "data":   "invalid spreadsheet: " + err.Error(),
+            "result": "fail",
+        })
+        return
+    }
 
     // Validate session if provided
     if sessionid != "" {
@@ -680,9 +814,10 @@ func (h *WebAppHandler) handleSocialCalcSave(c *gin.Context, user string, req We
             return
         }
         
-        // Double check user from session
+        // Double check user from session; the user saving may be an
+        // editor of a file someone else owns
         sessionUser, _ := session.GetString("user")
-        if sessionUser != "" && sessionUser != user {
+        if sessionUser != "" && sessionUser != h.getCurrentUser(c) {
             c.JSON(http.StatusUnauthorized, gin.H{
                 "data":   "session user mismatch",
                 "result": "fail",
@@ -691,132 +826,234 @@ func (h *WebAppHandler) handleSocialCalcSave(c *gin.Context, user string, req We
         }
     }
 
-    // Use "touchcalc" as the app name for SocialCalc saves
+    // Use "touchcalc" as the app name for SocialCalc saves. A save of one
+    // sheet writes that sheet only, the one named by sheet or the current one.
     appName := "touchcalc"
-    
-    // Ensure directory structure exists
-    err := h.ensureDirectoryStructure(user, appName)
+    err := h.handler.withWorkbook(user, appName, filename + ".msc", true, func(f *workbookFile) error {
+        if err := f.saveContent(content, req.Sheet); err != nil {
+            return err
+        }
+        return f.save()
+    })
     if err != nil {
-        fmt.Printf("DEBUG: Error ensuring directory structure: %v\n", err)
-        c.JSON(http.StatusInternalServerError, gin.H{
-            "data":   "failed to create directory structure: " + err.Error(),
-            "result": "fail",
-        })
+        h.respondSheetError(c, filename, err)
         return
     }
 
-    // Create file path
-    path := []string{"home", user, "securestore", appName, filename + ".msc"}
+    fmt.Printf("DEBUG: SocialCalc file saved successfully: %s\n", filename)
     
-    // Create file data with metadata (compatible with your existing format)
-    fileData := map[string]interface{}{
-        "content": content,
-        "user": user,
-        "app": appName,
+    // Return success response in format SocialCalc expects
+    c.JSON(http.StatusOK, gin.H{
+        "message": "File saved successfully",
         "filename": filename,
-        "timestamp": fmt.Sprintf("%d", getCurrentTimestamp()),
+        "result": "ok",
         "storage_backend": h.handler.Config.StorageBackend,
-        "type": "socialcalc_spreadsheet",
-    }
+        "timestamp": getCurrentTimestamp(),
+    })
+}
 
-    dataJSON, err := json.Marshal(fileData)
-    if err != nil {
-        fmt.Printf("DEBUG: Error marshaling file data: %v\n", err)
-        c.JSON(http.StatusInternalServerError, gin.H{
-            "data":   "failed to encode file data",
+// handleSocialCalcLoad handles load requests from SocialCalc spreadsheet  
+func (h *WebAppHandler) handleSocialCalcLoad(c *gin.Context, user string, req WebAppRequest) {
+    filename := socialCalcFileName(c, req)
+    
+    if filename == "" {
+        c.JSON(http.StatusBadRequest, gin.H{
+            "data":   "missing filename",
             "result": "fail",
         })
         return
     }
-
-    // Check if file exists and save accordingly
-    _, err = h.handler.Storage.GetFile(path)
-    if err != nil {
-        // File doesn't exist, create it
-        fmt.Printf("DEBUG: Creating new SocialCalc file: %s\n", filename)
-        err = h.handler.Storage.CreateFile(path, string(dataJSON))
-    } else {
-        // File exists, update it
-        fmt.Printf("DEBUG: Updating existing SocialCalc file: %s\n", filename)
-        err = h.handler.Storage.UpdateFile(path, string(dataJSON))
+    if !checkFileNames(c, filename, filename + ".msc") {
+        return
     }
 
+    appName := "touchcalc"
+    var fileContent string
+    var sheets []gin.H
+    err := h.handler.withWorkbook(user, appName, filename + ".msc", false, func(f *workbookFile) error {
+        var err error
+        fileContent, err = f.content()
+        sheets = f.sheetList()
+        return err
+    })
     if err != nil {
-        fmt.Printf("DEBUG: Error saving SocialCalc file: %v\n", err)
-        c.JSON(http.StatusInternalServerError, gin.H{
-            "data":   "failed to save file: " + err.Error(),
-            "result": "fail",
-        })
+        h.respondSheetError(c, filename, err)
         return
     }
 
-    fmt.Printf("DEBUG: SocialCalc file saved successfully: %s\n", filename)
-    
-    // Return success response in format SocialCalc expects
+    fmt.Printf("DEBUG: SocialCalc file loaded successfully: %s\n", filename)
     c.JSON(http.StatusOK, gin.H{
-        "message": "File saved successfully",
+        "data":   fileContent,
         "filename": filename,
+        "sheets": sheets,
         "result": "ok",
         "storage_backend": h.handler.Config.StorageBackend,
-        "timestamp": getCurrentTimestamp(),
     })
 }
 
-// handleSocialCalcLoad handles load requests from SocialCalc spreadsheet  
-func (h *WebAppHandler) handleSocialCalcLoad(c *gin.Context, user string, req WebAppRequest) {
-    filename := c.PostForm("filename")
-    if filename == "" {
-        filename = req.FName
+// socialCalcFileName returns the name of the file a SocialCalc save or load
+// is for, which SocialCalc sends as filename
+func socialCalcFileName(c *gin.Context, req WebAppRequest) string {
+    if filename := c.PostForm("filename"); filename != "" {
+        return filename
     }
-    
-    if filename == "" {
-        c.JSON(http.StatusBadRequest, gin.H{
-            "data":   "missing filename",
-            "result": "fail",
-        })
+    return req.FName
+}
+
+// handleLoadSheet returns one sheet of a spreadsheet, the one named by sheet
+// or the current one, as a sheet save for SocialCalc's ParseSheetSave, with
+// the list of sheets. The other sheets are not read.
+func (h *WebAppHandler) handleLoadSheet(c *gin.Context, user string, req WebAppRequest) {
+    filename, ok := h.sheetFileName(c, req)
+    if !ok {
         return
     }
 
-    appName := "touchcalc"
-    path := []string{"home", user, "securestore", appName, filename + ".msc"}
-    
-    item, err := h.handler.Storage.GetFile(path)
+    var sheetStr, sheetName string
+    var sheets []gin.H
+    err := h.handler.withWorkbook(user, "touchcalc", filename + ".msc", false, func(f *workbookFile) error {
+        entry := f.current()
+        if req.Sheet != "" {
+            entry = f.sheet(req.Sheet)
+        }
+        if entry == nil {
+            return errSheetNotFound
+        }
+        save, err := f.sheetSave(entry)
+        if err != nil {
+            return err
+        }
+        if sheetStr, err = bareSheetSave(save); err != nil {
+            return err
+        }
+        sheetName = entry.Name
+        sheets = f.sheetList()
+        return nil
+    })
     if err != nil {
-        fmt.Printf("DEBUG: SocialCalc file not found: %s, error: %v\n", filename, err)
-        c.JSON(http.StatusNotFound, gin.H{
-            "data":   "file not found: " + filename,
+        h.respondSheetError(c, filename, err)
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{
+        "data":     sheetStr,
+        "filename": filename,
+        "sheet":    sheetName,
+        "sheets":   sheets,
+        "result":   "ok",
+    })
+}
+
+// handleAddSheet adds a sheet named sheet, or the first free "SheetN", after
+// the others. It holds content, a sheet save, or is empty.
+func (h *WebAppHandler) handleAddSheet(c *gin.Context, user string, req WebAppRequest) {
+    content := c.PostForm("content")
+    if content == "" {
+        content = req.Content
+    }
+    h.changeSheets(c, user, req, func(f *workbookFile) error {
+        _, err := f.addSheet(req.Sheet, content)
+        return err
+    })
+}
+
+// handleRenameSheet renames the sheet named sheet to newname
+func (h *WebAppHandler) handleRenameSheet(c *gin.Context, user string, req WebAppRequest) {
+    h.changeSheets(c, user, req, func(f *workbookFile) error {
+        return f.renameSheet(req.Sheet, req.NewName)
+    })
+}
+
+// handleReorderSheets puts the sheets in the order of content, a JSON array
+// naming each of them once
+func (h *WebAppHandler) handleReorderSheets(c *gin.Context, user string, req WebAppRequest) {
+    var names []string
+    if err := json.Unmarshal([]byte(req.Content), &names); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{
+            "data":   "invalid JSON content: " + err.Error(),
             "result": "fail",
         })
         return
     }
+    h.changeSheets(c, user, req, func(f *workbookFile) error {
+        return f.reorderSheets(names)
+    })
+}
 
-    // Extract content from stored data
-    var fileContent string
-    if dataStr, ok := item.Data.(string); ok {
-        var fileData map[string]interface{}
-        if err := json.Unmarshal([]byte(dataStr), &fileData); err == nil {
-            if content, exists := fileData["content"]; exists {
-                if contentStr, ok := content.(string); ok {
-                    fileContent = contentStr
-                } else {
-                    fileContent = dataStr
-                }
-            } else {
-                fileContent = dataStr
-            }
-        } else {
-            fileContent = dataStr
+// handleDeleteSheet deletes the sheet named sheet. The last sheet is kept.
+func (h *WebAppHandler) handleDeleteSheet(c *gin.Context, user string, req WebAppRequest) {
+    h.changeSheets(c, user, req, func(f *workbookFile) error {
+        return f.deleteSheet(req.Sheet)
+    })
+}
+
+// changeSheets applies a change to the sheets of a stored spreadsheet and
+// answers with the sheets as they are after it
+func (h *WebAppHandler) changeSheets(c *gin.Context, user string, req WebAppRequest, change func(*workbookFile) error) {
+    filename, ok := h.sheetFileName(c, req)
+    if !ok {
+        return
+    }
+
+    var sheets []gin.H
+    err := h.handler.withWorkbook(user, "touchcalc", filename + ".msc", false, func(f *workbookFile) error {
+        if err := change(f); err != nil {
+            return err
         }
-    } else {
-        dataBytes, _ := json.Marshal(item.Data)
-        fileContent = string(dataBytes)
+        if err := f.save(); err != nil {
+            return err
+        }
+        sheets = f.sheetList()
+        return nil
+    })
+    if err != nil {
+        h.respondSheetError(c, filename, err)
+        return
     }
 
-    fmt.Printf("DEBUG: SocialCalc file loaded successfully: %s\n", filename)
+    fmt.Printf("DEBUG: SocialCalc %s of %s done for %s\n", req.Action, filename, user)
     c.JSON(http.StatusOK, gin.H{
-        "data":   fileContent,
+        "data":     sheets,
         "filename": filename,
-        "result": "ok",
-        "storage_backend": h.handler.Config.StorageBackend,
+        "result":   "ok",
     })
 }
+
+func (h *WebAppHandler) sheetFileName(c *gin.Context, req WebAppRequest) (string, bool) {
+    filename := socialCalcFileName(c, req)
+    if filename == "" {
+        c.JSON(http.StatusBadRequest, gin.H{
+            "data":   "missing filename",
+            "result": "fail",
+        })
+        return "", false
+    }
+    return filename, checkFileNames(c, filename, filename + ".msc")
+}
+
+func (h *WebAppHandler) respondSheetError(c *gin.Context, filename string, err error) {
+    switch {
+    case errors.Is(err, storage.ErrNotFound):
+        c.JSON(http.StatusNotFound, gin.H{
+            "data":   "file not found: " + filename,
+            "result": "fail",
+        })
+    case errors.Is(err, errSheetNotFound):
+        c.JSON(http.StatusNotFound, gin.H{
+            "data":   err.Error(),
+            "result": "fail",
+        })
+    case errors.Is(err, errSheetExists), errors.Is(err, errSheetName), errors.Is(err, errSheetContent),
+        errors.Is(err, errSheetOrder), errors.Is(err, errLastSheet):
+        c.JSON(http.StatusBadRequest, gin.H{
+            "data":   err.Error(),
+            "result": "fail",
+        })
+    default:
+        fmt.Printf("DEBUG: SocialCalc action on %s failed: %v\n", filename, err)
+        c.JSON(http.StatusInternalServerError, gin.H{
+            "data":   "failed to access spreadsheet",
+            "result": "fail",
+        })
+    }
+}
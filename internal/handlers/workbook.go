@@ -0,0 +1,677 @@
+package handlers
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "hash/fnv"
+    "strconv"
+    "strings"
+    "sync"
+    "unicode"
+    "unicode/utf8"
+
+    "github.com/c4gt/tornado-nginx-go-backend/internal/auth"
+    "github.com/c4gt/tornado-nginx-go-backend/internal/models"
+    "github.com/c4gt/tornado-nginx-go-backend/internal/socialcalc"
+    "github.com/c4gt/tornado-nginx-go-backend/internal/storage"
+    "github.com/gin-gonic/gin"
+)
+
+// Spreadsheets are stored as a manifest and one item per sheet, so a save
+// writes only the sheets that changed. The manifest takes the place of the
+// file in securestore, so listings, sharing and access checks see one file
+// as before. Sheet items are kept outside securestore, like collab logs,
+// and named by the hash of their save: a changed sheet is written as a new
+// item and the old one deleted once the manifest points at the new one, so
+// a save that fails halfway leaves the file as it was.
+//
+// Files stored whole, as all were before, are read as they are and stored
+// as a manifest when next saved. savefile, save-multiple and restore store
+// SocialCalc saves like the save action does, and anything else whole.
+const (
+    workbookDir       = "workbooks"
+    workbookFileType  = "socialcalc_workbook"
+    workbookLockCount = 64
+    maxSheetNameRunes = 64
+)
+
+var (
+    errSheetNotFound = errors.New("sheet not found")
+    errSheetExists   = errors.New("a sheet with that name exists")
+    errSheetName     = errors.New("invalid sheet name")
+    errSheetContent  = errors.New("invalid sheet")
+    errSheetOrder    = errors.New("the order must name every sheet once")
+    errLastSheet     = errors.New("the only sheet of a workbook cannot be deleted")
+)
+
+// workbookManifest is the stored form of a spreadsheet, without the saves
+// of its sheets
+type workbookManifest struct {
+    // Workbook is set for workbooks of the workbook control, which are put
+    // back together as its JSON; others are the save of their only sheet
+    Workbook      bool                  `json:"workbook"`
+    CurrentID     string                `json:"currentid,omitempty"`
+    Sheets        []*workbookSheetEntry `json:"sheets"`
+    EditableCells json.RawMessage       `json:"editablecells,omitempty"`
+}
+
+type workbookSheetEntry struct {
+    ID     string `json:"id"`
+    Name   string `json:"name"`
+    Hidden bool   `json:"hidden,omitempty"`
+    // Hash is the SHA-256 of the sheet's save, which names its item
+    Hash string `json:"hash"`
+    // CollabSeq is the last command of collaborative editing in the save
+    CollabSeq int64 `json:"collabseq,omitempty"`
+}
+
+// workbookFile is a stored spreadsheet being read or changed. Changes are
+// kept in memory until save.
+type workbookFile struct {
+    handler  *Handler
+    owner    string
+    app      string
+    name     string
+    manifest workbookManifest
+    // meta holds the other fields of the stored record, kept across saves
+    meta map[string]interface{}
+    // saves holds the sheet saves not written yet, by hash
+    saves map[string]string
+    // stale lists the items of replaced and deleted sheets
+    stale  []string
+    exists bool
+    // whole is set for files stored whole, until saved as a manifest
+    whole bool
+}
+
+// withWorkbook runs fn on a stored spreadsheet while no other request of
+// this server reads or changes it. It returns storage.ErrNotFound when there
+// is no such file, unless create is set, when fn gets an empty one.
+func (h *Handler) withWorkbook(owner, appName, name string, create bool, fn func(*workbookFile) error) error {
+    unlockHome, err := h.lockHome(owner)
+    if err != nil {
+        return err
+    }
+    defer unlockHome()
+    lock := h.workbookLock(owner, appName, name)
+    lock.Lock()
+    defer lock.Unlock()
+
+    f, err := h.openWorkbook(owner, appName, name)
+    if errors.Is(err, storage.ErrNotFound) && create {
+        f, err = h.newWorkbook(owner, appName, name), nil
+    }
+    if err != nil {
+        return err
+    }
+    return fn(f)
+}
+
+// lockHome keeps the home of owner from moving to another address, as an
+// email change does, until the returned function is called. A home that
+// moved away while waiting is not found.
+func (h *Handler) lockHome(owner string) (func(), error) {
+    if h.authService == nil {
+        return func() {}, nil
+    }
+    unlock, err := h.authService.LockHome(owner)
+    if errors.Is(err, auth.ErrUserNotFound) {
+        return nil, storage.ErrNotFound
+    }
+    return unlock, err
+}
+
+// workbookLock returns the lock of a file, shared with a few others
+func (h *Handler) workbookLock(owner, appName, name string) *sync.Mutex {
+    hash := fnv.New32a()
+    hash.Write([]byte(strings.Join(auth.HomePath(owner, "securestore", appName, name), "/")))
+    return &h.workbookLocks[hash.Sum32()%workbookLockCount]
+}
+
+func (h *Handler) newWorkbook(owner, appName, name string) *workbookFile {
+    return &workbookFile{
+        handler: h,
+        owner:   owner,
+        app:     appName,
+        name:    name,
+        meta:    make(map[string]interface{}),
+        saves:   make(map[string]string),
+    }
+}
+
+func (h *Handler) openWorkbook(owner, appName, name string) (*workbookFile, error) {
+    item, err := h.Storage.GetFile(auth.HomePath(owner, "securestore", appName, name))
+    if err != nil {
+        return nil, err
+    }
+    f := h.newWorkbook(owner, appName, name)
+    f.exists = true
+
+    if manifest, ok := storedManifest(item); ok {
+        json.Unmarshal([]byte(item.Data.(string)), &f.meta)
+        delete(f.meta, "manifest")
+        f.manifest = *manifest
+        return f, nil
+    }
+
+    workbook, err := socialcalc.ParseWorkbook(storedContent(item))
+    if err != nil {
+        return nil, err
+    }
+    if dataStr, ok := item.Data.(string); ok {
+        var fileData map[string]interface{}
+        if json.Unmarshal([]byte(dataStr), &fileData) == nil && fileData["content"] != nil {
+            f.meta = fileData
+            delete(f.meta, "content")
+            delete(f.meta, "collab_seq")
+        }
+    }
+    f.whole = true
+    f.setWorkbook(workbook)
+    if seq := storedCollabSeq(item); seq > 0 {
+        f.current().CollabSeq = seq
+    }
+    return f, nil
+}
+
+// storedManifest returns the manifest of a file stored as one
+func storedManifest(item *models.StorageItem) (*workbookManifest, bool) {
+    dataStr, ok := item.Data.(string)
+    if !ok {
+        return nil, false
+    }
+    var fileData struct {
+        Type     string            `json:"type"`
+        Manifest *workbookManifest `json:"manifest"`
+    }
+    if err := json.Unmarshal([]byte(dataStr), &fileData); err != nil ||
+        fileData.Type != workbookFileType || fileData.Manifest == nil {
+        return nil, false
+    }
+    return fileData.Manifest, true
+}
+
+// workbookContent returns the content of a file stored as a manifest, put
+// back together from its sheets, as the web app saved it. ok is false for
+// other files.
+func (h *Handler) workbookContent(owner, appName, name string, item *models.StorageItem) (content string, ok bool, err error) {
+    if _, ok := storedManifest(item); !ok {
+        return "", false, nil
+    }
+    err = h.withWorkbook(owner, appName, name, false, func(f *workbookFile) error {
+        content, err = f.content()
+        return err
+    })
+    return content, true, err
+}
+
+// storeFile replaces the content of a file of an app, while no other
+// request of this server reads or changes it. A SocialCalc save is stored
+// through saveContent, so it replaces the current sheet of a spreadsheet
+// of several. Other content is stored whole, with the file's metadata, and
+// the sheet items of a spreadsheet it replaces are deleted.
+func (h *Handler) storeFile(owner, appName, name string, content interface{}) error {
+    unlockHome, err := h.lockHome(owner)
+    if err != nil {
+        return err
+    }
+    defer unlockHome()
+    lock := h.workbookLock(owner, appName, name)
+    lock.Lock()
+    defer lock.Unlock()
+
+    path := auth.HomePath(owner, "securestore", appName, name)
+    _, err = h.Storage.GetFile(path)
+    if err != nil && !errors.Is(err, storage.ErrNotFound) {
+        return err
+    }
+    exists := err == nil
+
+    if save, ok := content.(string); ok && save != "" {
+        if _, err := socialcalc.ParseWorkbook(save); err == nil {
+            f, err := h.openWorkbook(owner, appName, name)
+            if err != nil {
+                // A file that is not a spreadsheet is replaced as a whole
+                f = h.newWorkbook(owner, appName, name)
+                f.exists, f.whole = exists, exists
+            }
+            if err := f.saveContent(save, ""); err != nil {
+                return err
+            }
+            return f.save()
+        }
+    }
+
+    if err := h.WebApp.ensureDirectoryStructure(owner, appName); err != nil {
+        return err
+    }
+    fileData := map[string]interface{}{
+        "content": content,
+        "user": owner,
+        "app": appName,
+        "filename": name,
+        "timestamp": fmt.Sprintf("%d", getCurrentTimestamp()),
+        "storage_backend": h.Config.StorageBackend,
+    }
+    dataJSON, err := json.Marshal(fileData)
+    if err != nil {
+        return err
+    }
+    if exists {
+        err = h.Storage.UpdateFile(path, string(dataJSON))
+    } else {
+        err = h.Storage.CreateFile(path, string(dataJSON))
+    }
+    if err != nil {
+        return err
+    }
+    if exists {
+        h.dropWorkbookSheets(owner, appName, name)
+    }
+    return nil
+}
+
+// deleteFile deletes a file of an app and, for a spreadsheet, its sheet
+// items, while no other request of this server reads or changes it
+func (h *Handler) deleteFile(owner, appName, name string) error {
+    unlockHome, err := h.lockHome(owner)
+    if err != nil {
+        return err
+    }
+    defer unlockHome()
+    lock := h.workbookLock(owner, appName, name)
+    lock.Lock()
+    defer lock.Unlock()
+
+    if err := h.Storage.DeleteFile(auth.HomePath(owner, "securestore", appName, name)); err != nil {
+        return err
+    }
+    h.dropWorkbookSheets(owner, appName, name)
+    return nil
+}
+
+// dropWorkbookSheets deletes the sheet items of a file being deleted or
+// stored whole
+func (h *Handler) dropWorkbookSheets(owner, appName, name string) {
+    items, err := h.Storage.ListItems(strings.Join(auth.HomePath(owner, workbookDir, appName, name), "/"))
+    if err != nil {
+        fmt.Printf("DEBUG: Failed to list the sheets of %s/%s: %v\n", appName, name, err)
+        return
+    }
+    for _, item := range items {
+        h.Storage.DeleteItem(item)
+    }
+}
+
+// sheet returns the sheet with the given name, ignoring case, or nil
+func (f *workbookFile) sheet(name string) *workbookSheetEntry {
+    for _, entry := range f.manifest.Sheets {
+        if strings.EqualFold(entry.Name, name) {
+            return entry
+        }
+    }
+    return nil
+}
+
+func (f *workbookFile) sheetByID(id string) *workbookSheetEntry {
+    for _, entry := range f.manifest.Sheets {
+        if entry.ID == id {
+            return entry
+        }
+    }
+    return nil
+}
+
+// current returns the current sheet, falling back to the first, or nil for
+// a file without sheets
+func (f *workbookFile) current() *workbookSheetEntry {
+    if entry := f.sheetByID(f.manifest.CurrentID); entry != nil {
+        return entry
+    }
+    if len(f.manifest.Sheets) == 0 {
+        return nil
+    }
+    return f.manifest.Sheets[0]
+}
+
+func (f *workbookFile) sheetPath(entry *workbookSheetEntry) string {
+    return strings.Join(auth.HomePath(f.owner, workbookDir, f.app, f.name, entry.ID + "-" + entry.Hash), "/")
+}
+
+// sheetSave returns the save of a sheet as it was stored
+func (f *workbookFile) sheetSave(entry *workbookSheetEntry) (string, error) {
+    if save, ok := f.saves[entry.Hash]; ok {
+        return save, nil
+    }
+    save, err := f.handler.Storage.GetItem(f.sheetPath(entry))
+    if err != nil {
+        // Not wrapped: a missing sheet is a broken file, not a missing one
+        return "", fmt.Errorf("sheet %s: %v", entry.Name, err)
+    }
+    return save, nil
+}
+
+// putSheet changes the save of a sheet
+func (f *workbookFile) putSheet(entry *workbookSheetEntry, save string) {
+    hash := snapshotHash(save)
+    if hash == entry.Hash {
+        return
+    }
+    if entry.Hash != "" {
+        f.stale = append(f.stale, f.sheetPath(entry))
+    }
+    entry.Hash = hash
+    // Collaborative editing sets it again after saving a snapshot
+    entry.CollabSeq = 0
+    f.saves[hash] = save
+}
+
+// setWorkbook replaces all the sheets of the file with those of a workbook.
+// Sheets keep their items when their save did not change.
+func (f *workbookFile) setWorkbook(workbook *socialcalc.Workbook) {
+    previous := make(map[string]*workbookSheetEntry)
+    for _, entry := range f.manifest.Sheets {
+        previous[entry.ID] = entry
+    }
+
+    manifest := workbookManifest{
+        Workbook:      workbook.JSON,
+        CurrentID:     workbook.CurrentID,
+        EditableCells: workbook.EditableCells,
+    }
+    for _, sheet := range workbook.Sheets {
+        entry := previous[sheet.ID]
+        if entry == nil {
+            entry = &workbookSheetEntry{ID: sheet.ID}
+        }
+        delete(previous, sheet.ID)
+        entry.Name = sheet.Name
+        entry.Hidden = sheet.Hidden
+        f.putSheet(entry, sheet.Doc.String())
+        manifest.Sheets = append(manifest.Sheets, entry)
+    }
+    for _, entry := range previous {
+        f.stale = append(f.stale, f.sheetPath(entry))
+    }
+    f.manifest = manifest
+    if f.sheetByID(manifest.CurrentID) == nil {
+        if entry := f.sheet(workbook.CurrentName); entry != nil {
+            f.manifest.CurrentID = entry.ID
+        }
+    }
+}
+
+// saveContent stores content as the save action sends it. A workbook
+// control save replaces the whole workbook. The save of a single sheet
+// replaces the sheet named sheetName, or the current sheet, so clients
+// showing one sheet leave the others as they are.
+func (f *workbookFile) saveContent(content, sheetName string) error {
+    workbook, err := socialcalc.ParseWorkbook(content)
+    if err != nil {
+        return fmt.Errorf("%w: %v", errSheetContent, err)
+    }
+    if workbook.JSON || len(f.manifest.Sheets) == 0 {
+        if sheetName != "" && !workbook.JSON {
+            if err := checkSheetName(sheetName); err != nil {
+                return err
+            }
+            workbook.Sheets[0].Name = sheetName
+        }
+        f.setWorkbook(workbook)
+        return nil
+    }
+
+    entry := f.current()
+    if sheetName != "" {
+        entry = f.sheet(sheetName)
+    }
+    if entry == nil {
+        return errSheetNotFound
+    }
+    f.putSheet(entry, content)
+    return nil
+}
+
+// workbook puts the file back together, reading every sheet
+func (f *workbookFile) workbook() (*socialcalc.Workbook, error) {
+    if len(f.manifest.Sheets) == 0 {
+        return nil, fmt.Errorf("workbook has no sheets")
+    }
+    workbook := &socialcalc.Workbook{
+        JSON:          f.manifest.Workbook,
+        NumSheets:     len(f.manifest.Sheets),
+        EditableCells: f.manifest.EditableCells,
+    }
+    if current := f.current(); current != nil {
+        workbook.CurrentID = current.ID
+        workbook.CurrentName = current.Name
+    }
+    for _, entry := range f.manifest.Sheets {
+        save, err := f.sheetSave(entry)
+        if err != nil {
+            return nil, err
+        }
+        doc, err := socialcalc.Parse(save)
+        if err != nil {
+            return nil, fmt.Errorf("sheet %s: %w", entry.Name, err)
+        }
+        workbook.Sheets = append(workbook.Sheets, &socialcalc.WorkbookSheet{
+            ID:     entry.ID,
+            Name:   entry.Name,
+            Hidden: entry.Hidden,
+            Doc:    doc,
+        })
+    }
+    return workbook, nil
+}
+
+// content returns the file as one save, in the form the web app saved it
+func (f *workbookFile) content() (string, error) {
+    if !f.manifest.Workbook && len(f.manifest.Sheets) == 1 {
+        return f.sheetSave(f.manifest.Sheets[0])
+    }
+    workbook, err := f.workbook()
+    if err != nil {
+        return "", err
+    }
+    return workbook.String()
+}
+
+// addSheet adds a sheet after the others, named name or the first free
+// "SheetN", holding save or empty
+func (f *workbookFile) addSheet(name, save string) (*workbookSheetEntry, error) {
+    if name == "" {
+        for n := len(f.manifest.Sheets) + 1; name == "" || f.sheet(name) != nil; n++ {
+            name = "Sheet" + strconv.Itoa(n)
+        }
+    }
+    if err := checkSheetName(name); err != nil {
+        return nil, err
+    }
+    if f.sheet(name) != nil {
+        return nil, errSheetExists
+    }
+    if save == "" {
+        save = (&socialcalc.Document{Sheet: socialcalc.NewSheet()}).String()
+    } else if _, err := socialcalc.Parse(save); err != nil {
+        return nil, fmt.Errorf("%w: %v", errSheetContent, err)
+    }
+
+    // The current sheet stays current once the order can change
+    if current := f.current(); current != nil {
+        f.manifest.CurrentID = current.ID
+    }
+    id := ""
+    for n := len(f.manifest.Sheets) + 1; id == "" || f.sheetByID(id) != nil; n++ {
+        id = "sheet" + strconv.Itoa(n)
+    }
+    entry := &workbookSheetEntry{ID: id, Name: name}
+    f.putSheet(entry, save)
+    f.manifest.Sheets = append(f.manifest.Sheets, entry)
+    // More than one sheet needs the workbook control's form
+    f.manifest.Workbook = true
+    return entry, nil
+}
+
+// renameSheet renames a sheet. Formulas of other sheets referring to it by
+// its old name are left as they are, as the workbook control does.
+func (f *workbookFile) renameSheet(name, newName string) error {
+    entry := f.sheet(name)
+    if entry == nil {
+        return errSheetNotFound
+    }
+    if err := checkSheetName(newName); err != nil {
+        return err
+    }
+    if other := f.sheet(newName); other != nil && other != entry {
+        return errSheetExists
+    }
+    entry.Name = newName
+    return nil
+}
+
+// reorderSheets puts the sheets in the order of names, which must name
+// each of them once
+func (f *workbookFile) reorderSheets(names []string) error {
+    if len(names) != len(f.manifest.Sheets) {
+        return errSheetOrder
+    }
+    if current := f.current(); current != nil {
+        f.manifest.CurrentID = current.ID
+    }
+    sheets := make([]*workbookSheetEntry, 0, len(names))
+    seen := make(map[*workbookSheetEntry]bool)
+    for _, name := range names {
+        entry := f.sheet(name)
+        if entry == nil || seen[entry] {
+            return errSheetOrder
+        }
+        seen[entry] = true
+        sheets = append(sheets, entry)
+    }
+    f.manifest.Sheets = sheets
+    return nil
+}
+
+func (f *workbookFile) deleteSheet(name string) error {
+    entry := f.sheet(name)
+    if entry == nil {
+        return errSheetNotFound
+    }
+    if len(f.manifest.Sheets) == 1 {
+        return errLastSheet
+    }
+    for i, other := range f.manifest.Sheets {
+        if other == entry {
+            f.manifest.Sheets = append(f.manifest.Sheets[:i], f.manifest.Sheets[i+1:]...)
+            break
+        }
+    }
+    f.stale = append(f.stale, f.sheetPath(entry))
+    if f.manifest.CurrentID == entry.ID {
+        f.manifest.CurrentID = ""
+    }
+    return nil
+}
+
+// save writes the sheets that changed, then the manifest, then deletes the
+// items no sheet uses any more
+func (f *workbookFile) save() error {
+    live := make(map[string]bool)
+    for _, entry := range f.manifest.Sheets {
+        path := f.sheetPath(entry)
+        live[path] = true
+        if save, ok := f.saves[entry.Hash]; ok {
+            if err := f.handler.Storage.PutItem(path, save); err != nil {
+                return err
+            }
+        }
+    }
+
+    if err := f.handler.WebApp.ensureDirectoryStructure(f.owner, f.app); err != nil {
+        return err
+    }
+    f.meta["type"] = workbookFileType
+    f.meta["manifest"] = f.manifest
+    f.meta["user"] = f.owner
+    f.meta["app"] = f.app
+    f.meta["filename"] = strings.TrimSuffix(f.name, ".msc")
+    f.meta["timestamp"] = fmt.Sprintf("%d", getCurrentTimestamp())
+    f.meta["storage_backend"] = f.handler.Config.StorageBackend
+    dataJSON, err := json.Marshal(f.meta)
+    delete(f.meta, "manifest")
+    if err != nil {
+        return err
+    }
+    path := auth.HomePath(f.owner, "securestore", f.app, f.name)
+    if f.exists {
+        err = f.handler.Storage.UpdateFile(path, string(dataJSON))
+    } else {
+        err = f.handler.Storage.CreateFile(path, string(dataJSON))
+    }
+    if err != nil {
+        return err
+    }
+    f.exists = true
+
+    stale := f.stale
+    if f.whole {
+        // Items left from before the file was last stored whole
+        items, err := f.handler.Storage.ListItems(strings.Join(auth.HomePath(f.owner, workbookDir, f.app, f.name), "/"))
+        if err == nil {
+            stale = append(stale, items...)
+        }
+    }
+    for _, path := range stale {
+        if !live[path] {
+            f.handler.Storage.DeleteItem(path)
+        }
+    }
+    f.saves = make(map[string]string)
+    f.stale = nil
+    f.whole = false
+    return nil
+}
+
+// sheetList describes the sheets in the order of their tabs
+func (f *workbookFile) sheetList() []gin.H {
+    current := f.current()
+    sheets := make([]gin.H, 0, len(f.manifest.Sheets))
+    for _, entry := range f.manifest.Sheets {
+        sheets = append(sheets, gin.H{
+            "id":      entry.ID,
+            "name":    entry.Name,
+            "hidden":  entry.Hidden,
+            "current": entry == current,
+        })
+    }
+    return sheets
+}
+
+// checkSheetName refuses names formulas could not refer to the sheet by
+func checkSheetName(name string) error {
+    if name == "" || name != strings.TrimSpace(name) || utf8.RuneCountInString(name) > maxSheetNameRunes ||
+        strings.ContainsAny(name, "!'\"") {
+        return errSheetName
+    }
+    for _, r := range name {
+        if unicode.IsControl(r) {
+            return errSheetName
+        }
+    }
+    return nil
+}
+
+// bareSheetSave returns the sheet part of a save, which is what
+// SocialCalc's ParseSheetSave reads and CreateSheetSave writes
+func bareSheetSave(save string) (string, error) {
+    doc, err := socialcalc.Parse(save)
+    if err != nil {
+        return "", err
+    }
+    if !doc.Multipart {
+        return save, nil
+    }
+    return doc.Sheet.String(), nil
+}
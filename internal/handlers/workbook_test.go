@@ -0,0 +1,430 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/c4gt/tornado-nginx-go-backend/internal/auth"
+	"github.com/c4gt/tornado-nginx-go-backend/internal/config"
+	"github.com/c4gt/tornado-nginx-go-backend/internal/models"
+	"github.com/c4gt/tornado-nginx-go-backend/internal/socialcalc"
+	"github.com/c4gt/tornado-nginx-go-backend/internal/storage"
+)
+
+// memoryStorage keeps files and items in maps, counting the items written
+type memoryStorage struct {
+	files map[string]*models.StorageItem
+	items map[string]string
+	puts  []string
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{
+		files: make(map[string]*models.StorageItem),
+		items: make(map[string]string),
+	}
+}
+
+func (m *memoryStorage) CreateFile(path []string, data string) error {
+	m.files[strings.Join(path, "/")] = &models.StorageItem{Path: path, Type: "file", Data: data}
+	return nil
+}
+
+// GetFile also finds files written as items, as the real backends do
+func (m *memoryStorage) GetFile(path []string) (*models.StorageItem, error) {
+	item, ok := m.files[strings.Join(path, "/")]
+	if !ok {
+		data, ok := m.items[strings.Join(path, "/")]
+		if !ok {
+			return nil, storage.ErrNotFound
+		}
+		return models.StorageItemFromJSON(data)
+	}
+	return item, nil
+}
+
+func (m *memoryStorage) UpdateFile(path []string, data string) error {
+	if _, err := m.GetFile(path); err != nil {
+		return err
+	}
+	delete(m.items, strings.Join(path, "/"))
+	return m.CreateFile(path, data)
+}
+
+func (m *memoryStorage) DeleteFile(path []string) error {
+	delete(m.files, strings.Join(path, "/"))
+	delete(m.items, strings.Join(path, "/"))
+	return nil
+}
+
+func (m *memoryStorage) CreateDir(path []string) error {
+	m.files[strings.Join(path, "/")] = &models.StorageItem{Path: path, Type: "dir"}
+	return nil
+}
+
+func (m *memoryStorage) DeleteDir(path []string) error {
+	return m.DeleteFile(path)
+}
+
+func (m *memoryStorage) PutItem(path string, data string, bucket ...string) error {
+	m.items[path] = data
+	m.puts = append(m.puts, path)
+	return nil
+}
+
+func (m *memoryStorage) GetItem(path string, bucket ...string) (string, error) {
+	data, ok := m.items[path]
+	if !ok {
+		return "", storage.ErrNotFound
+	}
+	return data, nil
+}
+
+func (m *memoryStorage) ExistsItem(path string, bucket ...string) (bool, error) {
+	_, ok := m.items[path]
+	return ok, nil
+}
+
+func (m *memoryStorage) DeleteItem(path string, bucket ...string) error {
+	delete(m.items, path)
+	return nil
+}
+
+func (m *memoryStorage) ListItems(prefix string, bucket ...string) ([]string, error) {
+	var paths []string
+	for path := range m.items {
+		if strings.HasPrefix(path, prefix+"/") {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+func (m *memoryStorage) SwapItem(path, old, data string, bucket ...string) (bool, error) {
+	if _, ok := m.files[path]; ok {
+		return false, nil
+	}
+	if current, ok := m.items[path]; current != old || ok && old == "" {
+		return false, nil
+	}
+	return true, m.PutItem(path, data)
+}
+
+func newWorkbookTestHandler() (*Handler, *memoryStorage) {
+	mem := newMemoryStorage()
+	h := &Handler{Config: &config.Config{StorageBackend: "memory"}, Storage: mem}
+	h.WebApp = NewWebAppHandler(h)
+	return h, mem
+}
+
+const (
+	testOwner = "owner@example.com"
+	testFile  = "book.msc"
+)
+
+func sheetSaveWith(value string) string {
+	return "version:1.5\ncell:A1:t:" + value + "\nsheet:c:1:r:1\n"
+}
+
+func twoSheetWorkbook(t *testing.T, first, second string) string {
+	t.Helper()
+	workbook := &socialcalc.Workbook{JSON: true, CurrentID: "sheet1", CurrentName: "Costs"}
+	for i, save := range []string{first, second} {
+		doc, err := socialcalc.Parse(save)
+		if err != nil {
+			t.Fatal(err)
+		}
+		workbook.Sheets = append(workbook.Sheets, &socialcalc.WorkbookSheet{
+			ID:   []string{"sheet1", "sheet2"}[i],
+			Name: []string{"Costs", "Income"}[i],
+			Doc:  doc,
+		})
+	}
+	content, err := workbook.String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func saveWorkbook(t *testing.T, h *Handler, change func(*workbookFile) error) {
+	t.Helper()
+	err := h.withWorkbook(testOwner, "touchcalc", testFile, true, func(f *workbookFile) error {
+		if err := change(f); err != nil {
+			return err
+		}
+		return f.save()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func workbookSheets(t *testing.T, h *Handler) map[string]string {
+	t.Helper()
+	sheets := make(map[string]string)
+	err := h.withWorkbook(testOwner, "touchcalc", testFile, false, func(f *workbookFile) error {
+		for _, entry := range f.manifest.Sheets {
+			save, err := f.sheetSave(entry)
+			if err != nil {
+				return err
+			}
+			sheets[entry.Name] = save
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sheets
+}
+
+func TestWorkbookSaveWritesChangedSheetOnly(t *testing.T) {
+	h, mem := newWorkbookTestHandler()
+	content := twoSheetWorkbook(t, sheetSaveWith("a"), sheetSaveWith("b"))
+	saveWorkbook(t, h, func(f *workbookFile) error { return f.saveContent(content, "") })
+	if len(mem.puts) != 2 {
+		t.Fatalf("first save wrote %d items, want 2", len(mem.puts))
+	}
+
+	mem.puts = nil
+	saveWorkbook(t, h, func(f *workbookFile) error { return f.saveContent(sheetSaveWith("c"), "Income") })
+	if len(mem.puts) != 1 || !strings.Contains(mem.puts[0], "sheet2-") {
+		t.Fatalf("sheet save wrote %v, want the Income sheet only", mem.puts)
+	}
+	if len(mem.items) != 2 {
+		t.Errorf("%d items stored, want 2: the replaced one should be deleted", len(mem.items))
+	}
+
+	// Without a sheet name the current sheet is saved
+	mem.puts = nil
+	saveWorkbook(t, h, func(f *workbookFile) error { return f.saveContent(sheetSaveWith("d"), "") })
+	sheets := workbookSheets(t, h)
+	if sheets["Costs"] != sheetSaveWith("d") || sheets["Income"] != sheetSaveWith("c") {
+		t.Errorf("sheets = %q", sheets)
+	}
+
+	// An unchanged workbook writes nothing
+	mem.puts = nil
+	var stored string
+	h.withWorkbook(testOwner, "touchcalc", testFile, false, func(f *workbookFile) (err error) {
+		stored, err = f.content()
+		return err
+	})
+	saveWorkbook(t, h, func(f *workbookFile) error { return f.saveContent(stored, "") })
+	if len(mem.puts) != 0 {
+		t.Errorf("unchanged save wrote %v", mem.puts)
+	}
+}
+
+func TestWorkbookContentRoundTrip(t *testing.T) {
+	h, _ := newWorkbookTestHandler()
+	content := twoSheetWorkbook(t, sheetSaveWith("a"), sheetSaveWith("b"))
+	saveWorkbook(t, h, func(f *workbookFile) error { return f.saveContent(content, "") })
+
+	item, err := h.Storage.GetFile(workbookTestPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok, err := h.workbookContent(testOwner, "touchcalc", testFile, item)
+	if err != nil || !ok {
+		t.Fatalf("workbookContent = %v, %v", ok, err)
+	}
+	if got != content {
+		t.Errorf("content = %q, want %q", got, content)
+	}
+
+	// A single sheet comes back as it was saved
+	h, _ = newWorkbookTestHandler()
+	saveWorkbook(t, h, func(f *workbookFile) error { return f.saveContent(sheetSaveWith("a"), "") })
+	item, _ = h.Storage.GetFile(workbookTestPath())
+	if got, _, _ := h.workbookContent(testOwner, "touchcalc", testFile, item); got != sheetSaveWith("a") {
+		t.Errorf("content = %q", got)
+	}
+}
+
+func TestWorkbookSheetActions(t *testing.T) {
+	h, _ := newWorkbookTestHandler()
+	saveWorkbook(t, h, func(f *workbookFile) error { return f.saveContent(sheetSaveWith("a"), "") })
+
+	saveWorkbook(t, h, func(f *workbookFile) error {
+		if _, err := f.addSheet("", ""); err != nil {
+			return err
+		}
+		_, err := f.addSheet("Notes", sheetSaveWith("n"))
+		return err
+	})
+	saveWorkbook(t, h, func(f *workbookFile) error { return f.renameSheet("sheet2", "Plan") })
+	saveWorkbook(t, h, func(f *workbookFile) error { return f.reorderSheets([]string{"notes", "Sheet1", "Plan"}) })
+
+	var names []string
+	var workbook *socialcalc.Workbook
+	h.withWorkbook(testOwner, "touchcalc", testFile, false, func(f *workbookFile) (err error) {
+		for _, sheet := range f.sheetList() {
+			names = append(names, sheet["name"].(string))
+		}
+		workbook, err = f.workbook()
+		return err
+	})
+	if strings.Join(names, ",") != "Notes,Sheet1,Plan" {
+		t.Errorf("sheets = %v", names)
+	}
+	if workbook == nil || !workbook.JSON || workbook.CurrentName != "Sheet1" {
+		t.Fatalf("workbook = %+v", workbook)
+	}
+
+	err := h.withWorkbook(testOwner, "touchcalc", testFile, false, func(f *workbookFile) error {
+		for _, c := range []struct {
+			err  error
+			want error
+		}{
+			{f.renameSheet("Plan", "notes"), errSheetExists},
+			{f.renameSheet("Plan", "it's"), errSheetName},
+			{f.renameSheet("Missing", "x"), errSheetNotFound},
+			{f.reorderSheets([]string{"Notes", "Notes", "Plan"}), errSheetOrder},
+			{f.reorderSheets([]string{"Notes"}), errSheetOrder},
+			{f.deleteSheet("Missing"), errSheetNotFound},
+		} {
+			if !errors.Is(c.err, c.want) {
+				t.Errorf("error = %v, want %v", c.err, c.want)
+			}
+		}
+		if _, err := f.addSheet("Bad", "not a save"); !errors.Is(err, errSheetContent) {
+			t.Errorf("addSheet with an invalid save = %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saveWorkbook(t, h, func(f *workbookFile) error {
+		if err := f.deleteSheet("Sheet1"); err != nil {
+			return err
+		}
+		return f.deleteSheet("Plan")
+	})
+	sheets := workbookSheets(t, h)
+	if len(sheets) != 1 || sheets["Notes"] != sheetSaveWith("n") {
+		t.Errorf("sheets = %q", sheets)
+	}
+	err = h.withWorkbook(testOwner, "touchcalc", testFile, false, func(f *workbookFile) error {
+		return f.deleteSheet("Notes")
+	})
+	if !errors.Is(err, errLastSheet) {
+		t.Errorf("deleting the last sheet = %v", err)
+	}
+}
+
+func TestWorkbookConvertsWholeFile(t *testing.T) {
+	h, mem := newWorkbookTestHandler()
+	content := twoSheetWorkbook(t, sheetSaveWith("a"), sheetSaveWith("b"))
+	data, _ := json.Marshal(map[string]interface{}{
+		"content":    content,
+		"type":       "socialcalc_spreadsheet",
+		"collab_seq": 7,
+	})
+	mem.CreateFile(workbookTestPath(), string(data))
+	// Left over from before the file was restored whole
+	orphan := strings.Join(append(homeWorkbookDir(), "sheet9-old"), "/")
+	mem.items[orphan] = sheetSaveWith("x")
+
+	saveWorkbook(t, h, func(f *workbookFile) error {
+		if !f.whole || f.current().CollabSeq != 7 {
+			t.Errorf("whole file read as whole=%v, collab seq %d", f.whole, f.current().CollabSeq)
+		}
+		return f.saveContent(sheetSaveWith("c"), "Costs")
+	})
+
+	item, _ := mem.GetFile(workbookTestPath())
+	if _, ok := storedManifest(item); !ok {
+		t.Fatalf("file not stored as a manifest: %v", item.Data)
+	}
+	if _, ok := mem.items[orphan]; ok {
+		t.Error("orphaned sheet item not deleted")
+	}
+	sheets := workbookSheets(t, h)
+	if sheets["Costs"] != sheetSaveWith("c") || sheets["Income"] != sheetSaveWith("b") {
+		t.Errorf("sheets = %q", sheets)
+	}
+	h.withWorkbook(testOwner, "touchcalc", testFile, false, func(f *workbookFile) error {
+		if seq := f.sheet("Costs").CollabSeq; seq != 0 {
+			t.Errorf("collab seq of a changed sheet = %d, want 0", seq)
+		}
+		return nil
+	})
+
+	h.dropWorkbookSheets(testOwner, "touchcalc", testFile)
+	if len(mem.items) != 0 {
+		t.Errorf("items left after dropping the sheets: %v", mem.items)
+	}
+}
+
+func TestStoreAndDeleteFile(t *testing.T) {
+	h, mem := newWorkbookTestHandler()
+	saveWorkbook(t, h, func(f *workbookFile) error {
+		return f.saveContent(twoSheetWorkbook(t, sheetSaveWith("a"), sheetSaveWith("b")), "")
+	})
+
+	// A save of one sheet replaces the current sheet only
+	if err := h.storeFile(testOwner, "touchcalc", testFile, sheetSaveWith("c")); err != nil {
+		t.Fatal(err)
+	}
+	sheets := workbookSheets(t, h)
+	if sheets["Costs"] != sheetSaveWith("c") || sheets["Income"] != sheetSaveWith("b") || len(mem.items) != 2 {
+		t.Errorf("sheets = %q, items = %v", sheets, mem.items)
+	}
+
+	// A backup restored over the spreadsheet replaces it whole
+	backup, _ := json.Marshal(map[string]interface{}{"content": "plain text", "type": "text"})
+	if err := h.storeFile(testOwner, "touchcalc", testFile, backupContent(string(backup))); err != nil {
+		t.Fatal(err)
+	}
+	item, _ := mem.GetFile(workbookTestPath())
+	if storedContent(item) != "plain text" || len(mem.items) != 0 {
+		t.Errorf("stored %v, items = %v", item.Data, mem.items)
+	}
+
+	if err := h.storeFile(testOwner, "touchcalc", testFile, twoSheetWorkbook(t, sheetSaveWith("d"), sheetSaveWith("e"))); err != nil {
+		t.Fatal(err)
+	}
+	if sheets := workbookSheets(t, h); sheets["Costs"] != sheetSaveWith("d") || sheets["Income"] != sheetSaveWith("e") {
+		t.Errorf("sheets = %q", sheets)
+	}
+	if err := h.deleteFile(testOwner, "touchcalc", testFile); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mem.GetFile(workbookTestPath()); err == nil || len(mem.items) != 0 {
+		t.Errorf("file or items left after deleting: %v", mem.items)
+	}
+}
+
+func TestCheckSheetName(t *testing.T) {
+	for name, valid := range map[string]bool{
+		"Sheet1":                true,
+		"Costs 2024":            true,
+		"":                      false,
+		" Costs":                false,
+		"a!b":                   false,
+		"it's":                  false,
+		"tab\there":             false,
+		strings.Repeat("a", 64): true,
+		strings.Repeat("a", 65): false,
+	} {
+		if err := checkSheetName(name); (err == nil) != valid {
+			t.Errorf("checkSheetName(%q) = %v, want valid %v", name, err, valid)
+		}
+	}
+}
+
+func workbookTestPath() []string {
+	return auth.HomePath(testOwner, "securestore", "touchcalc", testFile)
+}
+
+func homeWorkbookDir() []string {
+	return auth.HomePath(testOwner, workbookDir, "touchcalc", testFile)
+}
@@ -0,0 +1,81 @@
+package models
+
+import (
+	"strings"
+	"time"
+)
+
+// Authentication audit event types
+const (
+	AuditLogin                = "login"
+	AuditLogout               = "logout"
+	AuditRegister             = "register"
+	AuditPasswordResetRequest = "password_reset_request"
+	AuditPasswordReset        = "password_reset"
+	AuditPasswordChange       = "password_change"
+	AuditLockout              = "lockout"
+	AuditEmailChange          = "email_change"
+	AuditSessionRevoke        = "session_revoke"
+	AuditIdentityLink         = "identity_link"
+	// Changes admins make to accounts
+	AuditAdminDisable      = "admin_disable"
+	AuditAdminEnable       = "admin_enable"
+	AuditAdminRole         = "admin_role"
+	AuditAdminConfirm      = "admin_confirm"
+	AuditAdminUnlock       = "admin_unlock"
+	AuditAdminInviteCreate = "admin_invite_create"
+	AuditAdminInviteDelete = "admin_invite_delete"
+)
+
+// Audit event outcomes
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+)
+
+// AuditEvent records an authentication event
+type AuditEvent struct {
+	At      time.Time `json:"at"`
+	Type    string    `json:"type"`
+	Outcome string    `json:"outcome"`
+	// Actor is who acted: the signed-in user, or the email address given
+	// when signing in or registering
+	Actor string `json:"actor,omitempty"`
+	// Subject is the account acted on
+	Subject   string `json:"subject,omitempty"`
+	IP        string `json:"ip,omitempty"`
+	UserAgent string `json:"useragent,omitempty"`
+	// Method is how the user authenticated, e.g. password or oidc:google
+	Method string `json:"method,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// AuditFilter selects audit events. Empty fields match any event.
+type AuditFilter struct {
+	From    time.Time
+	To      time.Time
+	Type    string
+	Outcome string
+	// User matches the actor or the subject
+	User string
+	IP   string
+}
+
+func (f *AuditFilter) Matches(event *AuditEvent) bool {
+	if !f.From.IsZero() && event.At.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !event.At.Before(f.To) {
+		return false
+	}
+	if f.Type != "" && event.Type != f.Type {
+		return false
+	}
+	if f.Outcome != "" && event.Outcome != f.Outcome {
+		return false
+	}
+	if f.User != "" && !strings.EqualFold(event.Actor, f.User) && !strings.EqualFold(event.Subject, f.User) {
+		return false
+	}
+	return f.IP == "" || event.IP == f.IP
+}
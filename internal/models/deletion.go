@@ -0,0 +1,53 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Account deletion audit actions
+const (
+	DeletionRequested = "requested"
+	DeletionCancelled = "cancelled"
+	DeletionPurged    = "purged"
+)
+
+// PendingDeletion is an account scheduled to be purged once its grace
+// period has passed
+type PendingDeletion struct {
+	Email       string    `json:"email"`
+	RequestedBy string    `json:"requestedby"`
+	RequestedAt time.Time `json:"requestedat"`
+	PurgeAfter  time.Time `json:"purgeafter"`
+}
+
+// DeletionEvent records a step of an account deletion for auditing
+type DeletionEvent struct {
+	Email      string    `json:"email"`
+	Action     string    `json:"action"`
+	Actor      string    `json:"actor"`
+	At         time.Time `json:"at"`
+	PurgeAfter time.Time `json:"purgeafter,omitempty"`
+	Items      int       `json:"items,omitempty"`
+	Bytes      int64     `json:"bytes,omitempty"`
+}
+
+func (d *PendingDeletion) IsDue(now time.Time) bool {
+	return !now.Before(d.PurgeAfter)
+}
+
+func (d *PendingDeletion) ToJSON() (string, error) {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func PendingDeletionFromJSON(data string) (*PendingDeletion, error) {
+	var deletion PendingDeletion
+	if err := json.Unmarshal([]byte(data), &deletion); err != nil {
+		return nil, err
+	}
+	return &deletion, nil
+}
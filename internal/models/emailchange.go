@@ -0,0 +1,64 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// EmailChange is a requested change of a user's email address waiting for
+// the new address to be verified
+type EmailChange struct {
+	Token       string    `json:"token"`
+	OldEmail    string    `json:"oldemail"`
+	NewEmail    string    `json:"newemail"`
+	RequestedAt time.Time `json:"requestedat"`
+	ExpiresAt   time.Time `json:"expiresat"`
+}
+
+// EmailRedirect points a former email address at the account's current one
+type EmailRedirect struct {
+	OldEmail  string    `json:"oldemail"`
+	NewEmail  string    `json:"newemail"`
+	ChangedAt time.Time `json:"changedat"`
+	ExpiresAt time.Time `json:"expiresat"`
+}
+
+func (e *EmailChange) IsExpired(now time.Time) bool {
+	return !now.Before(e.ExpiresAt)
+}
+
+func (e *EmailChange) ToJSON() (string, error) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func EmailChangeFromJSON(data string) (*EmailChange, error) {
+	var change EmailChange
+	if err := json.Unmarshal([]byte(data), &change); err != nil {
+		return nil, err
+	}
+	return &change, nil
+}
+
+func (r *EmailRedirect) IsActive(now time.Time) bool {
+	return now.Before(r.ExpiresAt)
+}
+
+func (r *EmailRedirect) ToJSON() (string, error) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func EmailRedirectFromJSON(data string) (*EmailRedirect, error) {
+	var redirect EmailRedirect
+	if err := json.Unmarshal([]byte(data), &redirect); err != nil {
+		return nil, err
+	}
+	return &redirect, nil
+}
@@ -0,0 +1,48 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Invite is a registration code handed out by an administrator
+type Invite struct {
+	Code      string    `json:"code"`
+	CreatedBy string    `json:"createdby"`
+	CreatedAt time.Time `json:"createdat"`
+	// ExpiresAt is zero for codes that never expire
+	ExpiresAt time.Time `json:"expiresat,omitempty"`
+	// MaxUses is how many accounts the code can register; 0 is unlimited
+	MaxUses int      `json:"maxuses"`
+	Uses    int      `json:"uses"`
+	UsedBy  []string `json:"usedby,omitempty"`
+}
+
+func (i *Invite) IsExpired(now time.Time) bool {
+	return !i.ExpiresAt.IsZero() && !now.Before(i.ExpiresAt)
+}
+
+func (i *Invite) IsUsedUp() bool {
+	return i.MaxUses > 0 && i.Uses >= i.MaxUses
+}
+
+// IsValid reports whether the code can still register an account
+func (i *Invite) IsValid(now time.Time) bool {
+	return !i.IsExpired(now) && !i.IsUsedUp()
+}
+
+func (i *Invite) ToJSON() (string, error) {
+	data, err := json.Marshal(i)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func InviteFromJSON(data string) (*Invite, error) {
+	var invite Invite
+	if err := json.Unmarshal([]byte(data), &invite); err != nil {
+		return nil, err
+	}
+	return &invite, nil
+}
@@ -0,0 +1,48 @@
+package models
+
+import "time"
+
+// Roles a user can have on files shared with them, and the role of the
+// owner of the files
+const (
+	ShareViewer = "viewer"
+	ShareEditor = "editor"
+	ShareOwner  = "owner"
+)
+
+var shareRoleRanks = map[string]int{
+	ShareViewer: 1,
+	ShareEditor: 2,
+	ShareOwner:  3,
+}
+
+// ValidShareRole reports whether role can be granted to another user
+func ValidShareRole(role string) bool {
+	return role == ShareViewer || role == ShareEditor
+}
+
+// ShareRoleAllows reports whether role includes everything min allows. No
+// role allows nothing.
+func ShareRoleAllows(role, min string) bool {
+	return role != "" && shareRoleRanks[role] >= shareRoleRanks[min]
+}
+
+// HigherShareRole returns the role of a and b that allows more
+func HigherShareRole(a, b string) string {
+	if shareRoleRanks[b] > shareRoleRanks[a] {
+		return b
+	}
+	return a
+}
+
+// Share grants a registered user access to an app folder of another user,
+// or to one file in it
+type Share struct {
+	Owner string `json:"owner"`
+	App   string `json:"app"`
+	// File is empty when the whole app folder is shared
+	File     string    `json:"file,omitempty"`
+	User     string    `json:"user"`
+	Role     string    `json:"role"`
+	SharedAt time.Time `json:"sharedat"`
+}
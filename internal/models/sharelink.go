@@ -0,0 +1,46 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// ShareLink lets anyone holding its token view one spreadsheet, without an
+// account
+type ShareLink struct {
+	Token     string    `json:"token"`
+	Owner     string    `json:"owner"`
+	App       string    `json:"app"`
+	File      string    `json:"file"`
+	CreatedAt time.Time `json:"createdat"`
+	// ExpiresAt is zero for links that never expire
+	ExpiresAt time.Time `json:"expiresat,omitempty"`
+	// PasswordHash is empty for links that need no password
+	PasswordHash string    `json:"passwordhash,omitempty"`
+	Views        int       `json:"views"`
+	LastViewedAt time.Time `json:"lastviewedat,omitempty"`
+}
+
+func (l *ShareLink) IsExpired(now time.Time) bool {
+	return !l.ExpiresAt.IsZero() && !now.Before(l.ExpiresAt)
+}
+
+func (l *ShareLink) HasPassword() bool {
+	return l.PasswordHash != ""
+}
+
+func (l *ShareLink) ToJSON() (string, error) {
+	data, err := json.Marshal(l)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func ShareLinkFromJSON(data string) (*ShareLink, error) {
+	var link ShareLink
+	if err := json.Unmarshal([]byte(data), &link); err != nil {
+		return nil, err
+	}
+	return &link, nil
+}
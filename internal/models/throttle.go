@@ -0,0 +1,52 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// LoginThrottle tracks failed login attempts for a single account or client IP
+type LoginThrottle struct {
+	Key          string    `json:"key"`
+	Failures     int       `json:"failures"`
+	FirstFailure time.Time `json:"firstfailure"`
+	LastFailure  time.Time `json:"lastfailure"`
+	LockedUntil  time.Time `json:"lockeduntil"`
+}
+
+// LockoutEvent records an account or IP being locked out
+type LockoutEvent struct {
+	Key         string    `json:"key"`
+	Email       string    `json:"email"`
+	IP          string    `json:"ip"`
+	Failures    int       `json:"failures"`
+	LockedAt    time.Time `json:"lockedat"`
+	LockedUntil time.Time `json:"lockeduntil"`
+}
+
+func NewLoginThrottle(key string) *LoginThrottle {
+	return &LoginThrottle{
+		Key: key,
+	}
+}
+
+func (t *LoginThrottle) IsLocked(now time.Time) bool {
+	return now.Before(t.LockedUntil)
+}
+
+func (t *LoginThrottle) ToJSON() (string, error) {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func LoginThrottleFromJSON(data string) (*LoginThrottle, error) {
+	var throttle LoginThrottle
+	err := json.Unmarshal([]byte(data), &throttle)
+	if err != nil {
+		return nil, err
+	}
+	return &throttle, nil
+}
@@ -3,28 +3,45 @@ package models
 import (
 	"encoding/json"
 	"time"
+)
 
-	"golang.org/x/crypto/bcrypt"
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
 )
 
 type User struct {
-	Email       string    `json:"email"`
-	PWHash      string    `json:"pwhash"`
-	Confirmed   bool      `json:"confirmed"`
-	LastLogin   time.Time `json:"lastlogin"`
-	CreatedOn   time.Time `json:"createdon"`
-	Dongle      string    `json:"dongle"`
+	Email      string             `json:"email"`
+	PWHash     string             `json:"pwhash"`
+	Confirmed  bool               `json:"confirmed"`
+	LastLogin  time.Time          `json:"lastlogin"`
+	CreatedOn  time.Time          `json:"createdon"`
+	Dongle     string             `json:"dongle"`
+	Role       string             `json:"role,omitempty"`
+	Disabled   bool               `json:"disabled,omitempty"`
+	Identities []ExternalIdentity `json:"identities,omitempty"`
+
+	// DongleExpires is when the password reset token in Dongle stops working
+	DongleExpires time.Time `json:"dongleexpires,omitempty"`
+}
+
+// ExternalIdentity links a user to an account at an OpenID Connect provider
+type ExternalIdentity struct {
+	Provider string    `json:"provider"`
+	Subject  string    `json:"subject"`
+	Email    string    `json:"email"`
+	LinkedOn time.Time `json:"linkedon"`
 }
 
 func NewUser(email, password string) (*User, error) {
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	hashedPassword, err := GetPasswordHasher().Hash(password)
 	if err != nil {
 		return nil, err
 	}
 
 	return &User{
 		Email:     email,
-		PWHash:    string(hashedPassword),
+		PWHash:    hashedPassword,
 		Confirmed: true,
 		CreatedOn: time.Now(),
 		LastLogin: time.Time{},
@@ -33,16 +50,20 @@ func NewUser(email, password string) (*User, error) {
 }
 
 func (u *User) Authenticate(password string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(u.PWHash), []byte(password))
-	return err == nil
+	return VerifyPassword(u.PWHash, password)
+}
+
+// NeedsRehash reports whether the stored hash uses an outdated algorithm or cost
+func (u *User) NeedsRehash() bool {
+	return GetPasswordHasher().NeedsRehash(u.PWHash)
 }
 
 func (u *User) SetPassword(newPassword string) error {
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	hashedPassword, err := GetPasswordHasher().Hash(newPassword)
 	if err != nil {
 		return err
 	}
-	u.PWHash = string(hashedPassword)
+	u.PWHash = hashedPassword
 	return nil
 }
 
@@ -77,4 +98,43 @@ func (u *User) SetDongle(dongle string) {
 
 func (u *User) GetDongle() string {
 	return u.Dongle
-}
\ No newline at end of file
+}
+
+// GetRole returns the user's role, defaulting to RoleUser for older records
+func (u *User) GetRole() string {
+	if u.Role == "" {
+		return RoleUser
+	}
+	return u.Role
+}
+
+func (u *User) IsAdmin() bool {
+	return u.GetRole() == RoleAdmin
+}
+
+// ValidRole reports whether role is a known user role
+func ValidRole(role string) bool {
+	return role == RoleUser || role == RoleAdmin
+}
+
+// HasIdentity reports whether the external identity is linked to the user
+func (u *User) HasIdentity(provider, subject string) bool {
+	for _, identity := range u.Identities {
+		if identity.Provider == provider && identity.Subject == subject {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *User) AddIdentity(provider, subject, email string) {
+	if u.HasIdentity(provider, subject) {
+		return
+	}
+	u.Identities = append(u.Identities, ExternalIdentity{
+		Provider: provider,
+		Subject:  subject,
+		Email:    email,
+		LinkedOn: time.Now(),
+	})
+}
@@ -0,0 +1,326 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/c4gt/tornado-nginx-go-backend/internal/config"
+)
+
+// fakeIdP is a minimal local identity provider supporting discovery, JWKS
+// and the authorization code grant with PKCE.
+type fakeIdP struct {
+	server   *httptest.Server
+	key      *rsa.PrivateKey
+	clientID string
+	secret   string
+
+	mutex sync.Mutex
+	codes map[string]pendingCode
+
+	// claim overrides for the next issued token
+	audience string
+	expiry   time.Time
+}
+
+type pendingCode struct {
+	challenge string
+	nonce     string
+	redirect  string
+}
+
+func newFakeIdP(t *testing.T) *fakeIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	idp := &fakeIdP{
+		key:      key,
+		clientID: "touchcalc",
+		secret:   "s3cret",
+		codes:    make(map[string]pendingCode),
+	}
+
+	mux := http.NewServeMux()
+	discovery := func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                 idp.server.URL,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"jwks_uri":               idp.server.URL + "/jwks",
+		})
+	}
+	mux.HandleFunc("/.well-known/openid-configuration", discovery)
+	// Serves a document whose issuer does not match the requested one
+	mux.HandleFunc("/tenant/.well-known/openid-configuration", discovery)
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "key-1",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("client_id") != idp.clientID || q.Get("code_challenge_method") != "S256" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		code, _ := RandomString(16)
+		idp.mutex.Lock()
+		idp.codes[code] = pendingCode{challenge: q.Get("code_challenge"), nonce: q.Get("nonce"), redirect: q.Get("redirect_uri")}
+		idp.mutex.Unlock()
+		http.Redirect(w, r, q.Get("redirect_uri")+"?code="+code+"&state="+url.QueryEscape(q.Get("state")), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != idp.clientID || pass != idp.secret {
+			http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+			return
+		}
+		r.ParseForm()
+		idp.mutex.Lock()
+		pending, found := idp.codes[r.PostForm.Get("code")]
+		delete(idp.codes, r.PostForm.Get("code"))
+		idp.mutex.Unlock()
+		if !found || CodeChallenge(r.PostForm.Get("code_verifier")) != pending.challenge ||
+			r.PostForm.Get("redirect_uri") != pending.redirect {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"id_token":     idp.issueToken(t, pending.nonce),
+		})
+	})
+
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+func (idp *fakeIdP) issueToken(t *testing.T, nonce string) string {
+	aud := idp.clientID
+	if idp.audience != "" {
+		aud = idp.audience
+	}
+	exp := time.Now().Add(time.Hour)
+	if !idp.expiry.IsZero() {
+		exp = idp.expiry
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "key-1", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":            idp.server.URL,
+		"sub":            "user-123",
+		"aud":            aud,
+		"exp":            exp.Unix(),
+		"iat":            time.Now().Unix(),
+		"nonce":          nonce,
+		"email":          "alice@example.com",
+		"email_verified": true,
+	})
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func (idp *fakeIdP) provider() *Provider {
+	return NewProvider(config.OIDCProviderConfig{
+		Name:         "fake",
+		Issuer:       idp.server.URL,
+		ClientID:     idp.clientID,
+		ClientSecret: idp.secret,
+	}, idp.server.Client())
+}
+
+// authorize follows the authorization request and returns the code and state
+// the provider redirects back with.
+func authorize(t *testing.T, authURL string) (string, string) {
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatalf("authorize request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize returned %d", resp.StatusCode)
+	}
+
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("bad redirect: %v", err)
+	}
+	return location.Query().Get("code"), location.Query().Get("state")
+}
+
+func TestAuthorizationCodeFlow(t *testing.T) {
+	idp := newFakeIdP(t)
+	provider := idp.provider()
+	ctx := context.Background()
+	redirect := "http://localhost:8080/oidc/fake/callback"
+
+	authURL, err := provider.AuthCodeURL(ctx, "state-1", "nonce-1", "verifier-verifier-verifier-verifier-verifier", redirect)
+	if err != nil {
+		t.Fatalf("AuthCodeURL failed: %v", err)
+	}
+	if !strings.Contains(authURL, "code_challenge=") || !strings.Contains(authURL, "nonce=nonce-1") {
+		t.Errorf("authorization URL is missing PKCE or nonce: %s", authURL)
+	}
+
+	code, state := authorize(t, authURL)
+	if state != "state-1" {
+		t.Errorf("state = %q, want state-1", state)
+	}
+
+	token, err := provider.Exchange(ctx, code, "verifier-verifier-verifier-verifier-verifier", redirect)
+	if err != nil {
+		t.Fatalf("Exchange failed: %v", err)
+	}
+
+	claims, err := provider.VerifyIDToken(ctx, token.IDToken, "nonce-1")
+	if err != nil {
+		t.Fatalf("VerifyIDToken failed: %v", err)
+	}
+	if claims.Subject != "user-123" || claims.Email != "alice@example.com" || !claims.IsEmailVerified() {
+		t.Errorf("unexpected claims: %+v", claims)
+	}
+}
+
+func TestExchangeRejectsWrongVerifier(t *testing.T) {
+	idp := newFakeIdP(t)
+	provider := idp.provider()
+	ctx := context.Background()
+	redirect := "http://localhost:8080/oidc/fake/callback"
+
+	authURL, err := provider.AuthCodeURL(ctx, "state", "nonce", "the-real-verifier-the-real-verifier", redirect)
+	if err != nil {
+		t.Fatalf("AuthCodeURL failed: %v", err)
+	}
+	code, _ := authorize(t, authURL)
+
+	if _, err := provider.Exchange(ctx, code, "some-other-verifier-some-other-verifier", redirect); err == nil {
+		t.Error("Exchange should fail with the wrong PKCE verifier")
+	}
+}
+
+func TestVerifyIDTokenRejectsInvalidTokens(t *testing.T) {
+	idp := newFakeIdP(t)
+	provider := idp.provider()
+	ctx := context.Background()
+
+	valid := idp.issueToken(t, "nonce")
+	parts := strings.Split(valid, ".")
+
+	idp.audience = "another-client"
+	wrongAudience := idp.issueToken(t, "nonce")
+	idp.audience = ""
+
+	idp.expiry = time.Now().Add(-time.Hour)
+	expired := idp.issueToken(t, "nonce")
+	idp.expiry = time.Time{}
+
+	tests := []struct {
+		name  string
+		token string
+		nonce string
+	}{
+		{"nonce mismatch", valid, "other-nonce"},
+		{"missing nonce", valid, ""},
+		{"wrong audience", wrongAudience, "nonce"},
+		{"expired", expired, "nonce"},
+		{"tampered claims", parts[0] + "." + strings.Split(expired, ".")[1] + "." + parts[2], "nonce"},
+		{"unsigned", parts[0] + "." + parts[1] + ".", "nonce"},
+		{"malformed", "not-a-token", "nonce"},
+	}
+
+	for _, test := range tests {
+		if _, err := provider.VerifyIDToken(ctx, test.token, test.nonce); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%s: got %v, want ErrInvalidToken", test.name, err)
+		}
+	}
+}
+
+func TestVerifySignatureECDSACurves(t *testing.T) {
+	sign := func(curve elliptic.Curve, hash crypto.Hash, signed []byte) (*ecdsa.PublicKey, []byte) {
+		key, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hasher := hash.New()
+		hasher.Write(signed)
+		r, s, err := ecdsa.Sign(rand.Reader, key, hasher.Sum(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := (curve.Params().BitSize + 7) / 8
+		signature := make([]byte, 2*size)
+		r.FillBytes(signature[:size])
+		s.FillBytes(signature[size:])
+		return &key.PublicKey, signature
+	}
+	signed := []byte("header.claims")
+
+	p256, p256Signature := sign(elliptic.P256(), crypto.SHA256, signed)
+	if err := verifySignature("ES256", p256, signed, p256Signature); err != nil {
+		t.Errorf("ES256 with P-256: %v", err)
+	}
+	p384, p384Signature := sign(elliptic.P384(), crypto.SHA384, signed)
+	if err := verifySignature("ES384", p384, signed, p384Signature); err != nil {
+		t.Errorf("ES384 with P-384: %v", err)
+	}
+
+	// A key on another curve than the algorithm's is refused, even with a
+	// valid signature
+	mismatched, mismatchedSignature := sign(elliptic.P384(), crypto.SHA256, signed)
+	if err := verifySignature("ES256", mismatched, signed, mismatchedSignature); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("ES256 with P-384: got %v, want ErrInvalidToken", err)
+	}
+	mismatched, mismatchedSignature = sign(elliptic.P256(), crypto.SHA384, signed)
+	if err := verifySignature("ES384", mismatched, signed, mismatchedSignature); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("ES384 with P-256: got %v, want ErrInvalidToken", err)
+	}
+}
+
+func TestDiscoveryIssuerMismatch(t *testing.T) {
+	idp := newFakeIdP(t)
+	provider := NewProvider(config.OIDCProviderConfig{
+		Name:     "fake",
+		Issuer:   idp.server.URL + "/tenant",
+		ClientID: idp.clientID,
+	}, idp.server.Client())
+
+	_, err := provider.Discover(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "issuer mismatch") {
+		t.Errorf("Discover = %v, want issuer mismatch error", err)
+	}
+}
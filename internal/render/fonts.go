@@ -0,0 +1,147 @@
+package render
+
+import "strings"
+
+// Families of the standard PDF fonts, which every PDF reader has
+const (
+	helvetica = iota
+	times
+	courier
+)
+
+// baseFonts are the standard fonts of each family, by family*4 + bold +
+// 2*italic
+var baseFonts = []string{
+	"Helvetica", "Helvetica-Bold", "Helvetica-Oblique", "Helvetica-BoldOblique",
+	"Times-Roman", "Times-Bold", "Times-Italic", "Times-BoldItalic",
+	"Courier", "Courier-Bold", "Courier-Oblique", "Courier-BoldOblique",
+}
+
+// Widths of the printable ASCII characters, from space to '~', in
+// thousandths of the font size, from the Adobe font metrics. Italics are
+// measured with the upright widths, which differ little.
+var (
+	helveticaWidths = []int{
+		278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278,
+		556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 278, 278, 584, 584, 584, 556,
+		1015, 667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, 722, 778,
+		667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 278, 278, 278, 469, 556,
+		333, 556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, 556, 556,
+		556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, 334, 260, 334, 584,
+	}
+	helveticaBoldWidths = []int{
+		278, 333, 474, 556, 556, 889, 722, 238, 333, 333, 389, 584, 278, 333, 278, 278,
+		556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 333, 333, 584, 584, 584, 611,
+		975, 722, 722, 722, 722, 667, 611, 778, 722, 278, 556, 722, 611, 833, 722, 778,
+		667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 333, 278, 333, 584, 556,
+		333, 556, 611, 556, 611, 556, 333, 611, 611, 278, 278, 556, 278, 889, 611, 611,
+		611, 611, 389, 556, 333, 611, 556, 778, 556, 556, 500, 389, 280, 389, 584,
+	}
+	timesWidths = []int{
+		250, 333, 408, 500, 500, 833, 778, 180, 333, 333, 500, 564, 250, 333, 250, 278,
+		500, 500, 500, 500, 500, 500, 500, 500, 500, 500, 278, 278, 564, 564, 564, 444,
+		921, 722, 667, 667, 722, 611, 556, 722, 722, 333, 389, 722, 611, 889, 722, 722,
+		556, 722, 667, 556, 611, 722, 722, 944, 722, 722, 611, 333, 278, 333, 469, 500,
+		333, 444, 500, 444, 500, 444, 333, 500, 500, 278, 278, 500, 278, 778, 500, 500,
+		500, 500, 333, 389, 278, 500, 500, 722, 500, 500, 444, 480, 200, 480, 541,
+	}
+	timesBoldWidths = []int{
+		250, 333, 555, 500, 500, 1000, 833, 278, 333, 333, 500, 570, 250, 333, 250, 278,
+		500, 500, 500, 500, 500, 500, 500, 500, 500, 500, 333, 333, 570, 570, 570, 500,
+		930, 722, 667, 722, 722, 667, 611, 778, 778, 389, 500, 778, 667, 944, 722, 778,
+		611, 778, 722, 556, 667, 722, 722, 1000, 722, 722, 667, 333, 278, 333, 581, 500,
+		333, 500, 556, 444, 556, 444, 333, 500, 556, 278, 333, 556, 278, 833, 556, 500,
+		556, 556, 444, 389, 333, 556, 500, 722, 500, 500, 444, 394, 220, 394, 520,
+	}
+)
+
+// pdfFont is one of the standard fonts
+type pdfFont struct {
+	index  int
+	widths []int
+}
+
+// fontFor picks the standard font closest to a CSS font: Courier for
+// monospace families, Times for serif ones and Helvetica otherwise
+func fontFor(f Font) pdfFont {
+	family := helvetica
+	for _, name := range strings.Split(strings.ToLower(f.Family), ",") {
+		name = strings.Trim(strings.TrimSpace(name), `"'`)
+		if strings.Contains(name, "courier") || name == "monospace" {
+			family = courier
+			break
+		}
+		if strings.Contains(name, "times") || name == "serif" || name == "georgia" {
+			family = times
+			break
+		}
+		if name == "sans-serif" || strings.Contains(name, "arial") || strings.Contains(name, "helvetica") ||
+			strings.Contains(name, "verdana") {
+			break
+		}
+	}
+
+	font := pdfFont{index: family * 4}
+	if f.Bold {
+		font.index++
+	}
+	if f.Italic {
+		font.index += 2
+	}
+	switch {
+	case family == helvetica && f.Bold:
+		font.widths = helveticaBoldWidths
+	case family == helvetica:
+		font.widths = helveticaWidths
+	case family == times && f.Bold:
+		font.widths = timesBoldWidths
+	case family == times:
+		font.widths = timesWidths
+	}
+	return font
+}
+
+// width returns the width of text encoded by winAnsi, in thousandths of the
+// font size. Characters outside ASCII are as wide as an 'n'.
+func (f pdfFont) width(text []byte) int {
+	total := 0
+	for _, b := range text {
+		switch {
+		case f.widths == nil:
+			total += 600
+		case b >= ' ' && b <= '~':
+			total += f.widths[b-' ']
+		default:
+			total += f.widths['n'-' ']
+		}
+	}
+	return total
+}
+
+// winAnsiExtra are the characters of Windows-1252 from 0x80 to 0x9F; the
+// rest of its upper half is Latin-1
+var winAnsiExtra = map[rune]byte{
+	'€': 0x80, '‚': 0x82, 'ƒ': 0x83, '„': 0x84, '…': 0x85, '†': 0x86, '‡': 0x87,
+	'ˆ': 0x88, '‰': 0x89, 'Š': 0x8A, '‹': 0x8B, 'Œ': 0x8C, 'Ž': 0x8E, '‘': 0x91,
+	'’': 0x92, '“': 0x93, '”': 0x94, '•': 0x95, '–': 0x96, '—': 0x97, '˜': 0x98,
+	'™': 0x99, 'š': 0x9A, '›': 0x9B, 'œ': 0x9C, 'ž': 0x9E, 'Ÿ': 0x9F,
+}
+
+// winAnsi encodes text for the standard fonts, which cover Windows-1252;
+// other characters become '?'
+func winAnsi(text string) []byte {
+	out := make([]byte, 0, len(text))
+	for _, r := range text {
+		switch {
+		case r >= ' ' && r <= '~' || r >= 0xA0 && r <= 0xFF:
+			out = append(out, byte(r))
+		case winAnsiExtra[r] != 0:
+			out = append(out, winAnsiExtra[r])
+		case r == '\t':
+			out = append(out, ' ')
+		default:
+			out = append(out, '?')
+		}
+	}
+	return out
+}
@@ -0,0 +1,167 @@
+package render
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// htmlStyle is the style sheet of every page; cells hold one line per line
+// of text, clipped to the cell as in the PDF output
+const htmlStyle = `body{margin:16px;font-family:Verdana,Arial,Helvetica,sans-serif}
+h1{font-size:18px}
+h2{font-size:15px;margin:24px 0 8px}
+table{border-collapse:collapse;table-layout:fixed}
+td{overflow:hidden;white-space:pre;vertical-align:top}
+@media print{section{break-before:page}section:first-of-type{break-before:auto}}`
+
+// WriteHTML writes the document as an HTML page with no outside resources,
+// one table per section
+func WriteHTML(w io.Writer, doc *Document) error {
+	var b strings.Builder
+	b.WriteString("<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n")
+	fmt.Fprintf(&b, "<title>%s</title>\n<style>\n%s\n</style>\n</head>\n<body>\n", html.EscapeString(doc.Title), htmlStyle)
+	if doc.Title != "" {
+		fmt.Fprintf(&b, "<h1>%s</h1>\n", html.EscapeString(doc.Title))
+	}
+	for _, table := range doc.Tables {
+		writeHTMLTable(&b, table)
+	}
+	b.WriteString("</body>\n</html>\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeHTMLTable(b *strings.Builder, table *Table) {
+	b.WriteString("<section>\n")
+	if table.Name != "" {
+		fmt.Fprintf(b, "<h2>%s</h2>\n", html.EscapeString(table.Name))
+	}
+	total := 0.0
+	for _, width := range table.Widths {
+		total += width
+	}
+	fmt.Fprintf(b, "<table style=\"width:%spx\">\n<colgroup>", number(total))
+	for _, width := range table.Widths {
+		fmt.Fprintf(b, "<col style=\"width:%spx\">", number(width))
+	}
+	b.WriteString("</colgroup>\n")
+
+	starts := make(map[[2]int]*Cell)
+	covered := make(map[[2]int]bool)
+	for _, cell := range table.Cells {
+		starts[[2]int{cell.Row, cell.Col}] = cell
+		rows, cols := cell.span()
+		for r := cell.Row; r < cell.Row+rows; r++ {
+			for c := cell.Col; c < cell.Col+cols; c++ {
+				covered[[2]int{r, c}] = true
+			}
+		}
+	}
+	for row, height := range table.Heights {
+		fmt.Fprintf(b, "<tr style=\"height:%spx\">", number(height))
+		for col := range table.Widths {
+			cell := starts[[2]int{row, col}]
+			switch {
+			case cell != nil:
+				writeHTMLCell(b, cell)
+			case !covered[[2]int{row, col}]:
+				b.WriteString("<td></td>")
+			}
+		}
+		b.WriteString("</tr>\n")
+	}
+	b.WriteString("</table>\n</section>\n")
+}
+
+func writeHTMLCell(b *strings.Builder, cell *Cell) {
+	b.WriteString("<td")
+	rows, cols := cell.span()
+	if rows > 1 {
+		fmt.Fprintf(b, " rowspan=\"%d\"", rows)
+	}
+	if cols > 1 {
+		fmt.Fprintf(b, " colspan=\"%d\"", cols)
+	}
+	if style := cssStyle(cell.Style); style != "" {
+		fmt.Fprintf(b, " style=\"%s\"", html.EscapeString(style))
+	}
+	b.WriteString(">")
+	b.WriteString(strings.ReplaceAll(html.EscapeString(cell.Text), "\n", "<br>"))
+	b.WriteString("</td>")
+}
+
+// cssStyle returns the inline style of a cell. Only values this package
+// produces reach it, apart from the font family, which is filtered.
+func cssStyle(s Style) string {
+	var parts []string
+	if family := cssFamily(s.Font.Family); family != "" {
+		parts = append(parts, "font-family:"+family)
+	}
+	if s.Font.Size > 0 {
+		parts = append(parts, "font-size:"+number(s.Font.Size)+"px")
+	}
+	if s.Font.Bold {
+		parts = append(parts, "font-weight:bold")
+	}
+	if s.Font.Italic {
+		parts = append(parts, "font-style:italic")
+	}
+	if s.Color.Set {
+		parts = append(parts, "color:"+cssColor(s.Color))
+	}
+	if s.Background.Set {
+		parts = append(parts, "background-color:"+cssColor(s.Background))
+	}
+	switch s.Align {
+	case Center:
+		parts = append(parts, "text-align:center")
+	case Right:
+		parts = append(parts, "text-align:right")
+	}
+	switch s.VAlign {
+	case Middle:
+		parts = append(parts, "vertical-align:middle")
+	case Bottom:
+		parts = append(parts, "vertical-align:bottom")
+	}
+	for i, side := range []string{"top", "right", "bottom", "left"} {
+		if border := s.Borders[i]; border.Width > 0 {
+			parts = append(parts, fmt.Sprintf("border-%s:%spx %s %s", side, number(border.Width), border.Style, cssColor(border.Color)))
+		}
+	}
+	if s.Padding != [4]float64{} {
+		parts = append(parts, fmt.Sprintf("padding:%spx %spx %spx %spx",
+			number(s.Padding[0]), number(s.Padding[1]), number(s.Padding[2]), number(s.Padding[3])))
+	}
+	return strings.Join(parts, ";")
+}
+
+func cssColor(c Color) string {
+	return fmt.Sprintf("rgb(%d,%d,%d)", c.R, c.G, c.B)
+}
+
+// cssFamily keeps the characters of a font family list that cannot end the
+// declaration or escape the style attribute
+func cssFamily(family string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == ',' || r == '-' || r == '_' ||
+			r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, family)
+}
+
+// number formats a size with at most two decimals
+func number(n float64) string {
+	n = math.Round(n*100) / 100
+	if n == 0 {
+		// Not "-0"
+		n = 0
+	}
+	return strconv.FormatFloat(n, 'f', -1, 64)
+}
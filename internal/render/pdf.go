@@ -0,0 +1,278 @@
+package render
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Pages are A4 portrait, in points, with half inch margins
+const (
+	pageWidth  = 595.28
+	pageHeight = 841.89
+	pageMargin = 36
+
+	// pointsPerPixel converts CSS pixels to points
+	pointsPerPixel = 0.75
+	// Table names are headings of headingSize points taking headingSpace
+	headingSize  = 12
+	headingSpace = 24
+	// defaultFontSize is the size in pixels of cells without one
+	defaultFontSize = 13
+)
+
+// WritePDF writes the document as a PDF file. Each table starts a page and
+// breaks across pages between rows; tables wider than a page are scaled to
+// fit. Text uses the standard PDF fonts, so it is limited to the characters
+// of Windows-1252, one line per line of text, clipped to its cell.
+func WritePDF(w io.Writer, doc *Document) error {
+	var pages []*bytes.Buffer
+	for _, table := range doc.Tables {
+		pages = append(pages, tablePages(table)...)
+	}
+	if len(pages) == 0 {
+		pages = append(pages, &bytes.Buffer{})
+	}
+
+	out := &pdfWriter{}
+	out.buf.WriteString("%PDF-1.4\n%\xE2\xE3\xCF\xD3\n")
+	// Objects: the catalog, the page tree, the document information, the
+	// fonts, then each page followed by its content
+	firstPage := 4 + len(baseFonts)
+	out.object("<< /Type /Catalog /Pages 2 0 R >>")
+	var kids []string
+	for i := range pages {
+		kids = append(kids, fmt.Sprintf("%d 0 R", firstPage+2*i))
+	}
+	out.object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)))
+	out.object(fmt.Sprintf("<< /Title %s >>", pdfString(winAnsi(doc.Title))))
+	var fonts []string
+	for i, name := range baseFonts {
+		out.object(fmt.Sprintf("<< /Type /Font /Subtype /Type1 /BaseFont /%s /Encoding /WinAnsiEncoding >>", name))
+		fonts = append(fonts, fmt.Sprintf("/F%d %d 0 R", i+1, 4+i))
+	}
+	for i, content := range pages {
+		out.object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %s %s] /Resources << /Font << %s >> >> /Contents %d 0 R >>",
+			number(pageWidth), number(pageHeight), strings.Join(fonts, " "), firstPage+2*i+1))
+		var compressed bytes.Buffer
+		z := zlib.NewWriter(&compressed)
+		if _, err := z.Write(content.Bytes()); err != nil {
+			return err
+		}
+		if err := z.Close(); err != nil {
+			return err
+		}
+		out.object(fmt.Sprintf("<< /Length %d /Filter /FlateDecode >>\nstream\n%s\nendstream", compressed.Len(), compressed.String()))
+	}
+
+	xref := out.buf.Len()
+	fmt.Fprintf(&out.buf, "xref\n0 %d\n0000000000 65535 f \n", len(out.offsets)+1)
+	for _, offset := range out.offsets {
+		fmt.Fprintf(&out.buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out.buf, "trailer\n<< /Size %d /Root 1 0 R /Info 3 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(out.offsets)+1, xref)
+	_, err := w.Write(out.buf.Bytes())
+	return err
+}
+
+// pdfWriter collects the objects of a PDF file and their offsets
+type pdfWriter struct {
+	buf     bytes.Buffer
+	offsets []int
+}
+
+// object adds the next object, numbered from 1
+func (p *pdfWriter) object(content string) {
+	p.offsets = append(p.offsets, p.buf.Len())
+	fmt.Fprintf(&p.buf, "%d 0 obj\n%s\nendobj\n", len(p.offsets), content)
+}
+
+// pdfString returns text encoded by winAnsi as a PDF literal string
+func pdfString(text []byte) string {
+	var b strings.Builder
+	b.WriteByte('(')
+	for _, c := range text {
+		switch {
+		case c == '(' || c == ')' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < ' ' || c > '~':
+			fmt.Fprintf(&b, "\\%03o", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte(')')
+	return b.String()
+}
+
+// rect is a cell's area on its page in PDF coordinates, from the bottom
+// left corner
+type rect struct {
+	x, y, w, h float64
+}
+
+// tablePages lays a table out on pages and returns their content streams
+func tablePages(t *Table) []*bytes.Buffer {
+	scale := pointsPerPixel
+	total := 0.0
+	for _, width := range t.Widths {
+		total += width
+	}
+	if available := pageWidth - 2*pageMargin; total*scale > available {
+		scale = available / total
+	}
+	colX := make([]float64, len(t.Widths)+1)
+	colX[0] = pageMargin
+	for i, width := range t.Widths {
+		colX[i+1] = colX[i] + width*scale
+	}
+
+	// Rows go on the page they fit on, measured from the top of the page
+	top := float64(pageMargin)
+	if t.Name != "" {
+		top += headingSpace
+	}
+	page, onPage := 0, 0
+	rowPage := make([]int, len(t.Heights))
+	rowTop := make([]float64, len(t.Heights))
+	for row, height := range t.Heights {
+		if top+height*scale > pageHeight-pageMargin && onPage > 0 {
+			page, onPage, top = page+1, 0, pageMargin
+		}
+		rowPage[row], rowTop[row] = page, top
+		top += height * scale
+		onPage++
+	}
+
+	pages := make([]*bytes.Buffer, page+1)
+	for i := range pages {
+		pages[i] = &bytes.Buffer{}
+	}
+	if t.Name != "" {
+		fmt.Fprintf(pages[0], "BT /F2 %d Tf 0 g %s %s Td %s Tj ET\n", headingSize,
+			number(pageMargin), number(pageHeight-pageMargin-headingSize), pdfString(winAnsi(t.Name)))
+	}
+
+	cells := make([][]*Cell, len(pages))
+	areas := make(map[*Cell]rect)
+	for _, cell := range t.Cells {
+		if cell.Row < 0 || cell.Row >= len(t.Heights) || cell.Col < 0 || cell.Col >= len(t.Widths) {
+			continue
+		}
+		rows, cols := cell.span()
+		last := min(cell.Col+cols, len(t.Widths))
+		height := 0.0
+		// A cell spanning a page break is cut at the bottom of its page
+		for row := cell.Row; row < min(cell.Row+rows, len(t.Heights)) && rowPage[row] == rowPage[cell.Row]; row++ {
+			height += t.Heights[row] * scale
+		}
+		areas[cell] = rect{
+			x: colX[cell.Col],
+			y: pageHeight - rowTop[cell.Row] - height,
+			w: colX[last] - colX[cell.Col],
+			h: height,
+		}
+		cells[rowPage[cell.Row]] = append(cells[rowPage[cell.Row]], cell)
+	}
+
+	// Backgrounds first, so that neither text nor borders are hidden
+	for i, list := range cells {
+		for _, cell := range list {
+			if bg := cell.Style.Background; bg.Set {
+				r := areas[cell]
+				fmt.Fprintf(pages[i], "%s rg %s %s %s %s re f\n", pdfColor(bg), number(r.x), number(r.y), number(r.w), number(r.h))
+			}
+		}
+		for _, cell := range list {
+			drawText(pages[i], cell, areas[cell], scale)
+		}
+		for _, cell := range list {
+			drawBorders(pages[i], cell, areas[cell], scale)
+		}
+	}
+	return pages
+}
+
+// drawText draws the lines of text of a cell, aligned and clipped to it
+func drawText(out *bytes.Buffer, cell *Cell, r rect, scale float64) {
+	if strings.TrimSpace(cell.Text) == "" {
+		return
+	}
+	s := cell.Style
+	size := s.Font.Size
+	if size <= 0 {
+		size = defaultFontSize
+	}
+	size *= scale
+	font := fontFor(s.Font)
+	lines := strings.Split(cell.Text, "\n")
+	lineHeight := size * 1.2
+	padTop, padRight, padBottom, padLeft := s.Padding[0]*scale, s.Padding[1]*scale, s.Padding[2]*scale, s.Padding[3]*scale
+
+	blockTop := r.y + r.h - padTop
+	blockHeight := lineHeight * float64(len(lines))
+	switch s.VAlign {
+	case Middle:
+		blockTop = r.y + (r.h+blockHeight)/2
+	case Bottom:
+		blockTop = r.y + padBottom + blockHeight
+	}
+	color := Color{Set: true}
+	if s.Color.Set {
+		color = s.Color
+	}
+
+	fmt.Fprintf(out, "q %s %s %s %s re W n BT /F%d %s Tf %s rg\n",
+		number(r.x), number(r.y), number(r.w), number(r.h), font.index+1, number(size), pdfColor(color))
+	// The baseline sits below the top of a line by the half leading and
+	// about 0.8 of the font size
+	baseline := blockTop - (lineHeight-size)/2 - 0.8*size
+	for _, line := range lines {
+		text := winAnsi(line)
+		width := float64(font.width(text)) * size / 1000
+		x := r.x + padLeft
+		switch s.Align {
+		case Center:
+			x = r.x + (r.w-width)/2
+		case Right:
+			x = r.x + r.w - padRight - width
+		}
+		fmt.Fprintf(out, "1 0 0 1 %s %s Tm %s Tj\n", number(x), number(baseline), pdfString(text))
+		baseline -= lineHeight
+	}
+	out.WriteString("ET Q\n")
+}
+
+// drawBorders strokes the borders of a cell along its edges
+func drawBorders(out *bytes.Buffer, cell *Cell, r rect, scale float64) {
+	edges := [4][4]float64{
+		{r.x, r.y + r.h, r.x + r.w, r.y + r.h},
+		{r.x + r.w, r.y + r.h, r.x + r.w, r.y},
+		{r.x, r.y, r.x + r.w, r.y},
+		{r.x, r.y + r.h, r.x, r.y},
+	}
+	for i, border := range cell.Style.Borders {
+		if border.Width <= 0 {
+			continue
+		}
+		width := border.Width * scale
+		dash := "[] 0 d"
+		switch border.Style {
+		case "dashed":
+			dash = fmt.Sprintf("[%s %s] 0 d", number(3*width), number(2*width))
+		case "dotted":
+			dash = fmt.Sprintf("[%s] 0 d", number(width))
+		}
+		e := edges[i]
+		fmt.Fprintf(out, "%s w %s RG %s %s %s m %s %s l S\n",
+			number(width), pdfColor(border.Color), dash, number(e[0]), number(e[1]), number(e[2]), number(e[3]))
+	}
+}
+
+// pdfColor returns the components of a color for the rg and RG operators
+func pdfColor(c Color) string {
+	return fmt.Sprintf("%s %s %s", number(float64(c.R)/255), number(float64(c.G)/255), number(float64(c.B)/255))
+}
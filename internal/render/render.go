@@ -0,0 +1,231 @@
+// Package render draws tables of styled cells as self-contained HTML pages
+// and as PDF documents, without depending on a third-party library or an
+// external tool.
+package render
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Content types of the rendered documents
+const (
+	HTMLContentType = "text/html; charset=utf-8"
+	PDFContentType  = "application/pdf"
+)
+
+// Document is a set of tables rendered one after the other
+type Document struct {
+	Title  string
+	Tables []*Table
+}
+
+// Table is a grid of cells with a heading. Sizes are in CSS pixels.
+type Table struct {
+	Name    string
+	Widths  []float64
+	Heights []float64
+	// Cells are the cells with content or style; positions without a cell
+	// are empty
+	Cells []*Cell
+}
+
+// Cell is a cell of a table. Row and Col are 0-based; a cell spanning
+// several rows or columns covers the positions to its right and below.
+type Cell struct {
+	Row     int
+	Col     int
+	RowSpan int
+	ColSpan int
+	// Text is the displayed value, with lines separated by "\n"
+	Text  string
+	Style Style
+}
+
+// Align is the horizontal alignment of a cell
+type Align int
+
+const (
+	Left Align = iota
+	Center
+	Right
+)
+
+// VAlign is the vertical alignment of a cell
+type VAlign int
+
+const (
+	Top VAlign = iota
+	Middle
+	Bottom
+)
+
+// Style is the appearance of a cell
+type Style struct {
+	Font       Font
+	Color      Color
+	Background Color
+	Align      Align
+	VAlign     VAlign
+	// Borders are the top, right, bottom and left borders
+	Borders [4]Border
+	// Padding is the top, right, bottom and left padding
+	Padding [4]float64
+}
+
+// Font is a font in CSS terms. Size is in pixels.
+type Font struct {
+	Family string
+	Size   float64
+	Bold   bool
+	Italic bool
+}
+
+// Color is an RGB color; the zero Color is no color
+type Color struct {
+	R, G, B uint8
+	Set     bool
+}
+
+// Border is the border of one side of a cell; a zero width is no border
+type Border struct {
+	Width float64
+	// Style is "solid", "dashed", "dotted" or "double"
+	Style string
+	Color Color
+}
+
+// span returns the row and column spans of a cell, at least 1
+func (c *Cell) span() (rows, cols int) {
+	return max(c.RowSpan, 1), max(c.ColSpan, 1)
+}
+
+// namedColors are the CSS color names SocialCalc's palette and common saves
+// use
+var namedColors = map[string]Color{
+	"black":   {0, 0, 0, true},
+	"white":   {255, 255, 255, true},
+	"gray":    {128, 128, 128, true},
+	"grey":    {128, 128, 128, true},
+	"silver":  {192, 192, 192, true},
+	"red":     {255, 0, 0, true},
+	"maroon":  {128, 0, 0, true},
+	"orange":  {255, 165, 0, true},
+	"yellow":  {255, 255, 0, true},
+	"olive":   {128, 128, 0, true},
+	"lime":    {0, 255, 0, true},
+	"green":   {0, 128, 0, true},
+	"aqua":    {0, 255, 255, true},
+	"cyan":    {0, 255, 255, true},
+	"teal":    {0, 128, 128, true},
+	"blue":    {0, 0, 255, true},
+	"navy":    {0, 0, 128, true},
+	"fuchsia": {255, 0, 255, true},
+	"magenta": {255, 0, 255, true},
+	"purple":  {128, 0, 128, true},
+}
+
+// ParseColor reads a CSS color: rgb(r,g,b), #rrggbb, #rgb or a basic color
+// name
+func ParseColor(s string) (Color, bool) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if c, ok := namedColors[s]; ok {
+		return c, true
+	}
+	if strings.HasPrefix(s, "rgb(") && strings.HasSuffix(s, ")") {
+		parts := strings.Split(s[4:len(s)-1], ",")
+		if len(parts) != 3 {
+			return Color{}, false
+		}
+		var rgb [3]uint8
+		for i, part := range parts {
+			n, err := strconv.Atoi(strings.TrimSpace(part))
+			if err != nil || n < 0 || n > 255 {
+				return Color{}, false
+			}
+			rgb[i] = uint8(n)
+		}
+		return Color{rgb[0], rgb[1], rgb[2], true}, true
+	}
+	if strings.HasPrefix(s, "#") {
+		hex := s[1:]
+		if len(hex) == 3 {
+			hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+		}
+		n, err := strconv.ParseUint(hex, 16, 32)
+		if err != nil || len(hex) != 6 {
+			return Color{}, false
+		}
+		return Color{uint8(n >> 16), uint8(n >> 8), uint8(n), true}, true
+	}
+	return Color{}, false
+}
+
+// ParseLength reads a CSS length in px, pt or em as pixels
+func ParseLength(s string) (float64, bool) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	scale := 1.0
+	switch {
+	case strings.HasSuffix(s, "px"):
+		s = s[:len(s)-2]
+	case strings.HasSuffix(s, "pt"):
+		s, scale = s[:len(s)-2], 4.0/3
+	case strings.HasSuffix(s, "em"):
+		s, scale = s[:len(s)-2], 16
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 || math.IsInf(n, 0) {
+		return 0, false
+	}
+	return n * scale, true
+}
+
+// fontSizes are the CSS font size keywords in pixels
+var fontSizes = map[string]float64{
+	"xx-small": 9,
+	"x-small":  10,
+	"small":    13,
+	"medium":   16,
+	"large":    18,
+	"x-large":  24,
+	"xx-large": 32,
+}
+
+// ParseFontSize reads a CSS font size, a length or a keyword such as
+// "small", in pixels
+func ParseFontSize(s string) (float64, bool) {
+	if size, ok := fontSizes[strings.ToLower(strings.TrimSpace(s))]; ok {
+		return size, true
+	}
+	size, ok := ParseLength(s)
+	return size, ok && size > 0
+}
+
+// ParseBorder reads a CSS border such as "1px solid rgb(0,0,0)". Borders
+// without a width are 1 pixel wide, without a color black.
+func ParseBorder(s string) Border {
+	b := Border{Width: 1, Style: "solid", Color: namedColors["black"]}
+	// Colors such as rgb(0, 0, 0) contain spaces
+	for _, field := range strings.Fields(strings.ReplaceAll(s, ", ", ",")) {
+		switch lower := strings.ToLower(field); lower {
+		case "none", "hidden":
+			return Border{}
+		case "solid", "dashed", "dotted", "double":
+			b.Style = lower
+		case "thin":
+			b.Width = 1
+		case "medium":
+			b.Width = 3
+		case "thick":
+			b.Width = 5
+		default:
+			if width, ok := ParseLength(lower); ok {
+				b.Width = width
+			} else if color, ok := ParseColor(lower); ok {
+				b.Color = color
+			}
+		}
+	}
+	return b
+}
@@ -0,0 +1,241 @@
+package render
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func sampleDocument() *Document {
+	bold := Style{Font: Font{Family: "Arial", Size: 16, Bold: true}, Align: Center}
+	boxed := Style{
+		Background: Color{255, 255, 0, true},
+		Align:      Right,
+		VAlign:     Middle,
+		Borders:    [4]Border{{1, "solid", Color{Set: true}}, {}, {2, "dashed", Color{255, 0, 0, true}}, {}},
+		Padding:    [4]float64{2, 2, 1, 2},
+	}
+	return &Document{
+		Title: "Budget <2024>",
+		Tables: []*Table{{
+			Name:    "Costs & Co",
+			Widths:  []float64{120, 80, 80},
+			Heights: []float64{20, 20, 24},
+			Cells: []*Cell{
+				{Row: 0, Col: 0, ColSpan: 2, Text: "Summary", Style: bold},
+				{Row: 1, Col: 0, RowSpan: 2, Text: "Rent\nincl. <VAT>"},
+				{Row: 1, Col: 1, Text: "1,200.50", Style: boxed},
+				{Row: 2, Col: 2, Text: "Café – €5"},
+			},
+		}},
+	}
+}
+
+func TestParseStyles(t *testing.T) {
+	for s, want := range map[string]Color{
+		"rgb(255, 0, 128)": {255, 0, 128, true},
+		"#0a0B0c":          {10, 11, 12, true},
+		"#fff":             {255, 255, 255, true},
+		"Navy":             {0, 0, 128, true},
+	} {
+		if got, ok := ParseColor(s); !ok || got != want {
+			t.Errorf("ParseColor(%q) = %+v, %v", s, got, ok)
+		}
+	}
+	for _, bad := range []string{"", "rgb(1,2)", "rgb(1,2,300)", "#12345", "url(x)"} {
+		if _, ok := ParseColor(bad); ok {
+			t.Errorf("ParseColor(%q) accepted", bad)
+		}
+	}
+
+	for s, want := range map[string]float64{"12pt": 16, "10px": 10, "small": 13, "1.5em": 24, "x-large": 24} {
+		if got, ok := ParseFontSize(s); !ok || got != want {
+			t.Errorf("ParseFontSize(%q) = %v, %v", s, got, ok)
+		}
+	}
+	if _, ok := ParseFontSize("0"); ok {
+		t.Errorf("ParseFontSize(0) accepted")
+	}
+
+	for s, want := range map[string]Border{
+		"1px solid rgb(0, 0, 0)": {1, "solid", Color{Set: true}},
+		"thick dotted #f00":      {5, "dotted", Color{255, 0, 0, true}},
+		"double":                 {1, "double", Color{Set: true}},
+		"none":                   {},
+	} {
+		if got := ParseBorder(s); got != want {
+			t.Errorf("ParseBorder(%q) = %+v, want %+v", s, got, want)
+		}
+	}
+}
+
+func TestWriteHTML(t *testing.T) {
+	var out bytes.Buffer
+	if err := WriteHTML(&out, sampleDocument()); err != nil {
+		t.Fatal(err)
+	}
+	page := out.String()
+	for _, want := range []string{
+		"<title>Budget &lt;2024&gt;</title>",
+		"<h2>Costs &amp; Co</h2>",
+		`<table style="width:280px">`,
+		`<col style="width:120px">`,
+		`<td colspan="2" style="font-family:Arial;font-size:16px;font-weight:bold;text-align:center">Summary</td><td></td></tr>`,
+		`<td rowspan="2">Rent<br>incl. &lt;VAT&gt;</td>`,
+		`background-color:rgb(255,255,0);text-align:right;vertical-align:middle;border-top:1px solid rgb(0,0,0);border-bottom:2px dashed rgb(255,0,0);padding:2px 2px 1px 2px">1,200.50</td><td></td></tr>`,
+		// A3 is covered by the rent cell
+		`<tr style="height:24px"><td></td><td>Café – €5</td></tr>`,
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("page lacks %s:\n%s", want, page)
+		}
+	}
+	if strings.Contains(page, "<script") || strings.Contains(page, "http") {
+		t.Errorf("page is not self-contained:\n%s", page)
+	}
+
+	if got := cssFamily(`Arial";}body{x:url(evil)`); got != "Arialbodyxurlevil" {
+		t.Errorf("cssFamily = %q", got)
+	}
+}
+
+// pdfContents checks the cross-reference table of a PDF file and returns
+// its decompressed content streams
+func pdfContents(t *testing.T, data []byte) []string {
+	t.Helper()
+	if !bytes.HasPrefix(data, []byte("%PDF-1.4\n")) || !bytes.HasSuffix(data, []byte("%%EOF\n")) {
+		t.Fatalf("not a PDF file")
+	}
+	start := regexp.MustCompile(`startxref\n(\d+)\n`).FindSubmatch(data)
+	if start == nil {
+		t.Fatalf("startxref missing")
+	}
+	xref, _ := strconv.Atoi(string(start[1]))
+	if !bytes.HasPrefix(data[xref:], []byte("xref\n")) {
+		t.Fatalf("startxref %d does not point at the xref table", xref)
+	}
+	offsets := regexp.MustCompile(`(\d{10}) 00000 n \n`).FindAllSubmatch(data[xref:], -1)
+	for i, offset := range offsets {
+		n, _ := strconv.Atoi(string(offset[1]))
+		if want := fmt.Sprintf("%d 0 obj\n", i+1); !bytes.HasPrefix(data[n:], []byte(want)) {
+			t.Errorf("object %d is not at offset %d", i+1, n)
+		}
+	}
+
+	var contents []string
+	streams := regexp.MustCompile(`/Length (\d+) /Filter /FlateDecode >>\nstream\n`)
+	for _, loc := range streams.FindAllSubmatchIndex(data, -1) {
+		length, _ := strconv.Atoi(string(data[loc[2]:loc[3]]))
+		z, err := zlib.NewReader(bytes.NewReader(data[loc[1] : loc[1]+length]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(z)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents = append(contents, string(content))
+	}
+	return contents
+}
+
+func TestWritePDF(t *testing.T) {
+	var out bytes.Buffer
+	if err := WritePDF(&out, sampleDocument()); err != nil {
+		t.Fatal(err)
+	}
+	data := out.Bytes()
+	contents := pdfContents(t, data)
+	if len(contents) != 1 {
+		t.Fatalf("%d pages, want 1", len(contents))
+	}
+	for _, want := range []string{
+		"/Title (Budget <2024>)",
+		"/BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding",
+		"/Count 1",
+	} {
+		if !bytes.Contains(data, []byte(want)) {
+			t.Errorf("file lacks %s", want)
+		}
+	}
+	page := contents[0]
+	for _, want := range []string{
+		"BT /F2 12 Tf 0 g 36 793.89 Td (Costs & Co) Tj ET",
+		// The yellow background of B2, 80 by 20 pixels, below the heading
+		// and the first row
+		"1 1 0 rg 126 751.89 60 15 re f",
+		"(Summary) Tj",
+		"(Rent) Tj",
+		"(incl. <VAT>) Tj",
+		"(Caf\\351 \\226 \\2005) Tj",
+		"/F2 12 Tf",
+		"1.5 w 1 0 0 RG [4.5 3] 0 d 126 751.89 m 186 751.89 l S",
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("page lacks %s:\n%s", want, page)
+		}
+	}
+	// "1,200.50" is right aligned in B2, ending at its padding, and
+	// centered vertically
+	width := float64(fontFor(Font{}).width([]byte("1,200.50"))) * 9.75 / 1000
+	if want := fmt.Sprintf("1 0 0 1 %s 756.47 Tm (1,200.50) Tj", number(186-1.5-width)); !strings.Contains(page, want) {
+		t.Errorf("page lacks %s:\n%s", want, page)
+	}
+}
+
+func TestWritePDFPages(t *testing.T) {
+	// A table wider than the page is scaled to fit, which leaves room for
+	// 88 rows of 20 pixels a page
+	table := &Table{Widths: []float64{800, 400}}
+	for row := 0; row < 200; row++ {
+		table.Heights = append(table.Heights, 20)
+		table.Cells = append(table.Cells, &Cell{Row: row, Col: 0, Text: strconv.Itoa(row + 1)})
+	}
+	var out bytes.Buffer
+	if err := WritePDF(&out, &Document{Tables: []*Table{table, {}}}); err != nil {
+		t.Fatal(err)
+	}
+	contents := pdfContents(t, out.Bytes())
+	if len(contents) != 4 {
+		t.Fatalf("%d pages, want 4", len(contents))
+	}
+	for i, want := range []string{"(88) Tj", "(176) Tj", "(200) Tj"} {
+		if !strings.Contains(contents[i], want) || strings.Count(contents[i], " Tj") != min(88, 200-88*i) {
+			t.Errorf("page %d does not end with %s:\n%s", i+1, want, contents[i])
+		}
+	}
+	if contents[3] != "" {
+		t.Errorf("empty table drawn:\n%s", contents[3])
+	}
+
+	out.Reset()
+	if err := WritePDF(&out, &Document{}); err != nil {
+		t.Fatal(err)
+	}
+	if contents := pdfContents(t, out.Bytes()); len(contents) != 1 {
+		t.Errorf("empty document has %d pages", len(contents))
+	}
+}
+
+func TestFontWidths(t *testing.T) {
+	for i, widths := range [][]int{helveticaWidths, helveticaBoldWidths, timesWidths, timesBoldWidths} {
+		if len(widths) != '~'-' '+1 {
+			t.Errorf("width table %d has %d widths", i, len(widths))
+		}
+	}
+	if got := fontFor(Font{Family: "'Courier New',monospace", Bold: true, Italic: true}); got.index != 11 ||
+		got.width([]byte("abc")) != 1800 {
+		t.Errorf("courier = %+v", got)
+	}
+	if got := fontFor(Font{Family: "Times New Roman,serif", Italic: true}); got.index != 6 {
+		t.Errorf("times = %+v", got)
+	}
+	if got := string(winAnsi("a\tb€ü✓")); got != "a b\x80\xfc?" {
+		t.Errorf("winAnsi = %q", got)
+	}
+}
@@ -0,0 +1,50 @@
+package session
+
+import (
+    "fmt"
+    "log"
+    "time"
+
+    "github.com/c4gt/tornado-nginx-go-backend/internal/config"
+    "github.com/c4gt/tornado-nginx-go-backend/internal/storage"
+)
+
+// NewStore returns the session store selected by SESSION_STORE. The storage
+// store keeps sessions on the given storage backend.
+func NewStore(cfg *config.Config, backend storage.Storage) (Store, error) {
+    log.Printf("Initializing session store: %s", cfg.SessionStore)
+
+    switch cfg.SessionStore {
+    case "memory", "":
+        return NewMemoryStore(), nil
+
+    case "storage":
+        return NewStorageStore(backend), nil
+
+    case "redis":
+        store, err := NewRedisStore(RedisOptions{
+            Addr:     cfg.RedisAddr,
+            Password: cfg.RedisPassword,
+            DB:       cfg.RedisDB,
+            TTL:      OptionsFromConfig(cfg).IdleTimeout,
+        })
+        if err != nil {
+            return nil, fmt.Errorf("failed to initialize Redis session store: %w", err)
+        }
+        log.Printf("Successfully connected to Redis at %s", cfg.RedisAddr)
+        return store, nil
+
+    default:
+        return nil, fmt.Errorf("unsupported session store: %s", cfg.SessionStore)
+    }
+}
+
+// OptionsFromConfig returns the session timeouts configured in minutes by
+// SESSION_IDLE_TIMEOUT, SESSION_ABSOLUTE_TIMEOUT and SESSION_CLEANUP_INTERVAL
+func OptionsFromConfig(cfg *config.Config) Options {
+    return Options{
+        IdleTimeout:     time.Duration(cfg.SessionIdleTimeout) * time.Minute,
+        AbsoluteTimeout: time.Duration(cfg.SessionAbsoluteTimeout) * time.Minute,
+        CleanupInterval: time.Duration(cfg.SessionCleanupInterval) * time.Minute,
+    }
+}
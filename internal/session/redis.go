@@ -0,0 +1,319 @@
+package session
+
+import (
+    "bufio"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+const (
+    redisKeyPrefix   = "session:"
+    // redisUserPrefix names the set of the session IDs of a user
+    redisUserPrefix  = "session-user:"
+    redisScanCount   = 100
+    redisDialTimeout = 5 * time.Second
+    redisIOTimeout   = 5 * time.Second
+)
+
+// RedisOptions configures a RedisStore
+type RedisOptions struct {
+    Addr     string
+    Password string
+    DB       int
+    // TTL expires sessions in Redis that have not been saved for this long
+    TTL time.Duration
+}
+
+// RedisStore keeps sessions in Redis, or any server that speaks the Redis
+// protocol, so they are shared by every server behind the load balancer.
+// Sessions expire on the Redis side once they have been idle for the TTL.
+type RedisStore struct {
+    options RedisOptions
+    conn    net.Conn
+    reader  *bufio.Reader
+    mutex   sync.Mutex
+}
+
+// redisError is an error reply from the server
+type redisError string
+
+func (e redisError) Error() string {
+    return "redis: " + string(e)
+}
+
+func NewRedisStore(options RedisOptions) (*RedisStore, error) {
+    store := &RedisStore{options: options}
+
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+    if err := store.connect(); err != nil {
+        return nil, err
+    }
+    return store, nil
+}
+
+func (s *RedisStore) key(id string) string {
+    return redisKeyPrefix + id
+}
+
+func (s *RedisStore) userKey(user string) string {
+    return redisUserPrefix + user
+}
+
+func (s *RedisStore) Load(id string) (*Session, error) {
+    reply, err := s.do("GET", s.key(id))
+    if err != nil {
+        return nil, err
+    }
+    if reply == nil {
+        return nil, ErrNotFound
+    }
+    data, ok := reply.(string)
+    if !ok {
+        return nil, fmt.Errorf("redis: unexpected reply to GET: %v", reply)
+    }
+    return SessionFromJSON(data)
+}
+
+func (s *RedisStore) Save(session *Session) error {
+    data, err := session.ToJSON()
+    if err != nil {
+        return err
+    }
+
+    args := []string{"SET", s.key(session.ID), data}
+    if s.options.TTL > 0 {
+        args = append(args, "PX", strconv.FormatInt(s.options.TTL.Milliseconds(), 10))
+    }
+    if _, err = s.do(args...); err != nil {
+        return err
+    }
+    return s.indexUser(session)
+}
+
+// indexUser adds a session to the set of its user. Deleted sessions and
+// ones that changed user are left in the set until ListByUser finds them
+// gone.
+func (s *RedisStore) indexUser(session *Session) error {
+    user := session.user()
+    if user == "" {
+        return nil
+    }
+    if _, err := s.do("SADD", s.userKey(user), session.ID); err != nil {
+        return err
+    }
+    if s.options.TTL <= 0 {
+        return nil
+    }
+    _, err := s.do("PEXPIRE", s.userKey(user), strconv.FormatInt(s.options.TTL.Milliseconds(), 10))
+    return err
+}
+
+func (s *RedisStore) Delete(id string) error {
+    _, err := s.do("DEL", s.key(id))
+    return err
+}
+
+func (s *RedisStore) List() ([]*Session, error) {
+    var sessions []*Session
+    cursor := "0"
+    for {
+        reply, err := s.do("SCAN", cursor, "MATCH", redisKeyPrefix+"*", "COUNT", strconv.Itoa(redisScanCount))
+        if err != nil {
+            return nil, err
+        }
+        page, ok := reply.([]interface{})
+        if !ok || len(page) != 2 {
+            return nil, fmt.Errorf("redis: unexpected reply to SCAN: %v", reply)
+        }
+        cursor, _ = page[0].(string)
+        keys, _ := page[1].([]interface{})
+
+        for _, key := range keys {
+            name, _ := key.(string)
+            session, err := s.Load(strings.TrimPrefix(name, redisKeyPrefix))
+            if err != nil {
+                // Expired between SCAN and GET
+                if errors.Is(err, ErrNotFound) {
+                    continue
+                }
+                return nil, err
+            }
+            sessions = append(sessions, session)
+        }
+
+        if cursor == "0" || cursor == "" {
+            return sessions, nil
+        }
+    }
+}
+
+func (s *RedisStore) ListByUser(user string) ([]*Session, error) {
+    reply, err := s.do("SMEMBERS", s.userKey(user))
+    if err != nil {
+        return nil, err
+    }
+    ids, ok := reply.([]interface{})
+    if !ok {
+        return nil, fmt.Errorf("redis: unexpected reply to SMEMBERS: %v", reply)
+    }
+
+    var sessions []*Session
+    for _, reply := range ids {
+        id, _ := reply.(string)
+        session, err := s.Load(id)
+        if err != nil && !errors.Is(err, ErrNotFound) {
+            return nil, err
+        }
+        if err != nil || session.user() != user {
+            if _, err := s.do("SREM", s.userKey(user), id); err != nil {
+                return nil, err
+            }
+            continue
+        }
+        sessions = append(sessions, session)
+    }
+    return sessions, nil
+}
+
+// Close closes the connection to the server
+func (s *RedisStore) Close() error {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    if s.conn == nil {
+        return nil
+    }
+    err := s.conn.Close()
+    s.conn = nil
+    return err
+}
+
+// connect dials the server and authenticates; the caller holds the mutex
+func (s *RedisStore) connect() error {
+    conn, err := net.DialTimeout("tcp", s.options.Addr, redisDialTimeout)
+    if err != nil {
+        return fmt.Errorf("failed to connect to redis at %s: %w", s.options.Addr, err)
+    }
+    s.conn = conn
+    s.reader = bufio.NewReader(conn)
+
+    if s.options.Password != "" {
+        if _, err := s.roundTrip("AUTH", s.options.Password); err != nil {
+            s.closeConn()
+            return err
+        }
+    }
+    if s.options.DB != 0 {
+        if _, err := s.roundTrip("SELECT", strconv.Itoa(s.options.DB)); err != nil {
+            s.closeConn()
+            return err
+        }
+    }
+    return nil
+}
+
+func (s *RedisStore) closeConn() {
+    if s.conn != nil {
+        s.conn.Close()
+        s.conn = nil
+    }
+}
+
+// do runs a command, reconnecting once if the connection was lost
+func (s *RedisStore) do(args ...string) (interface{}, error) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    for attempt := 0; ; attempt++ {
+        if s.conn == nil {
+            if err := s.connect(); err != nil {
+                return nil, err
+            }
+        }
+
+        reply, err := s.roundTrip(args...)
+        var replyErr redisError
+        if err == nil || errors.As(err, &replyErr) {
+            return reply, err
+        }
+
+        // The connection is in an unknown state after an I/O error
+        s.closeConn()
+        if attempt > 0 {
+            return nil, err
+        }
+    }
+}
+
+func (s *RedisStore) roundTrip(args ...string) (interface{}, error) {
+    s.conn.SetDeadline(time.Now().Add(redisIOTimeout))
+
+    var command strings.Builder
+    fmt.Fprintf(&command, "*%d\r\n", len(args))
+    for _, arg := range args {
+        fmt.Fprintf(&command, "$%d\r\n%s\r\n", len(arg), arg)
+    }
+    if _, err := io.WriteString(s.conn, command.String()); err != nil {
+        return nil, err
+    }
+    return readRESP(s.reader)
+}
+
+// readRESP reads one reply. Bulk and simple strings become strings, nil
+// replies nil, integers int64 and arrays []interface{}.
+func readRESP(reader *bufio.Reader) (interface{}, error) {
+    line, err := reader.ReadString('\n')
+    if err != nil {
+        return nil, err
+    }
+    line = strings.TrimSuffix(line, "\r\n")
+    if line == "" {
+        return nil, fmt.Errorf("redis: empty reply")
+    }
+
+    switch line[0] {
+    case '+':
+        return line[1:], nil
+    case '-':
+        return nil, redisError(line[1:])
+    case ':':
+        return strconv.ParseInt(line[1:], 10, 64)
+    case '$':
+        size, err := strconv.Atoi(line[1:])
+        if err != nil {
+            return nil, err
+        }
+        if size < 0 {
+            return nil, nil
+        }
+        data := make([]byte, size+2)
+        if _, err := io.ReadFull(reader, data); err != nil {
+            return nil, err
+        }
+        return string(data[:size]), nil
+    case '*':
+        count, err := strconv.Atoi(line[1:])
+        if err != nil {
+            return nil, err
+        }
+        if count < 0 {
+            return nil, nil
+        }
+        items := make([]interface{}, count)
+        for i := range items {
+            if items[i], err = readRESP(reader); err != nil {
+                return nil, err
+            }
+        }
+        return items, nil
+    default:
+        return nil, fmt.Errorf("redis: unexpected reply %q", line)
+    }
+}
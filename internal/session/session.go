@@ -1,100 +1,367 @@
 package session
 
 import (
+    "crypto/rand"
+    "encoding/base64"
     "encoding/json"
+    "errors"
+    "io"
+    "log"
     "sync"
     "time"
 )
 
+// Session holds per-browser state. It is safe for concurrent use; the
+// fields are exported for serialization only and are read through the
+// accessor methods. The ID is fixed once the session is created.
 type Session struct {
     ID       string                 `json:"id"`
     Data     map[string]interface{} `json:"data"`
-    LastUsed time.Time             `json:"last_used"`
+    Created  time.Time              `json:"created"`
+    LastUsed time.Time              `json:"last_used"`
+
+    mutex sync.RWMutex
+}
+
+const (
+    sessionIDBytes = 32
+
+    // userKey holds the user a session belongs to, which stores index
+    // sessions by
+    userKey = "user"
+
+    // touchInterval limits how often reading a session writes its last
+    // use back to the store
+    touchInterval = 1 * time.Minute
+)
+
+// Options controls how long sessions live
+type Options struct {
+    // IdleTimeout ends sessions that have not been used for this long
+    IdleTimeout time.Duration
+    // AbsoluteTimeout ends sessions this long after they were created,
+    // however active they are. Zero disables it.
+    AbsoluteTimeout time.Duration
+    // CleanupInterval is how often expired sessions are removed from the store
+    CleanupInterval time.Duration
 }
 
+func DefaultOptions() Options {
+    return Options{
+        IdleTimeout:     24 * time.Hour,
+        AbsoluteTimeout: 7 * 24 * time.Hour,
+        CleanupInterval: 1 * time.Hour,
+    }
+}
+
+// Manager hands out sessions kept in a Store
 type Manager struct {
-    sessions map[string]*Session
-    mutex    sync.RWMutex
+    store   Store
+    options Options
+
+    stop      chan struct{}
+    done      chan struct{}
+    closeOnce sync.Once
 }
 
+// NewManager returns a manager that keeps sessions in memory
 func NewManager() *Manager {
+    return NewManagerWithStore(NewMemoryStore(), DefaultOptions())
+}
+
+// NewManagerWithStore returns a manager for the given store and starts
+// removing expired sessions in the background until Close is called
+func NewManagerWithStore(store Store, options Options) *Manager {
+    defaults := DefaultOptions()
+    if options.IdleTimeout <= 0 {
+        options.IdleTimeout = defaults.IdleTimeout
+    }
+    if options.CleanupInterval <= 0 {
+        options.CleanupInterval = defaults.CleanupInterval
+    }
+
     manager := &Manager{
-        sessions: make(map[string]*Session),
+        store:   store,
+        options: options,
+        stop:    make(chan struct{}),
+        done:    make(chan struct{}),
     }
-    
+
     // Start cleanup goroutine
     go manager.cleanup()
-    
+
     return manager
 }
 
 func NewSession(id string) *Session {
+    now := time.Now()
     return &Session{
         ID:       id,
         Data:     make(map[string]interface{}),
-        LastUsed: time.Now(),
+        Created:  now,
+        LastUsed: now,
+    }
+}
+
+func (m *Manager) Options() Options {
+    return m.options
+}
+
+// Expired reports whether a session has been idle for too long or has
+// reached its absolute lifetime
+func (m *Manager) Expired(session *Session, now time.Time) bool {
+    if now.Sub(session.LastUsedAt()) > m.options.IdleTimeout {
+        return true
     }
+    return m.options.AbsoluteTimeout > 0 && now.Sub(session.CreatedAt()) > m.options.AbsoluteTimeout
 }
 
 func (m *Manager) Get(sessionID string) (*Session, bool) {
-    m.mutex.RLock()
-    defer m.mutex.RUnlock()
-    
-    session, exists := m.sessions[sessionID]
-    if exists {
-        session.LastUsed = time.Now()
+    session, err := m.store.Load(sessionID)
+    if err != nil {
+        if !errors.Is(err, ErrNotFound) {
+            log.Printf("Failed to load session: %v", err)
+        }
+        return nil, false
+    }
+
+    now := time.Now()
+    if m.Expired(session, now) {
+        m.Delete(sessionID)
+        return nil, false
+    }
+    if now.Sub(session.LastUsedAt()) > m.touchInterval() {
+        session.touch(now)
+        m.save(session)
     }
-    return session, exists
+    return session, true
+}
+
+// touchInterval keeps the recorded last use precise enough for the idle
+// timeout
+func (m *Manager) touchInterval() time.Duration {
+    if quarter := m.options.IdleTimeout / 4; quarter < touchInterval {
+        return quarter
+    }
+    return touchInterval
 }
 
 func (m *Manager) Set(sessionID string, session *Session) {
-    m.mutex.Lock()
-    defer m.mutex.Unlock()
-    
-    session.LastUsed = time.Now()
-    m.sessions[sessionID] = session
+    session.touch(time.Now())
+    // The ID of a session never changes, so it is stored as a copy under
+    // another ID
+    if session.ID != sessionID {
+        session = session.clone()
+        session.ID = sessionID
+    }
+    m.save(session)
+}
+
+func (m *Manager) save(session *Session) {
+    if err := m.store.Save(session); err != nil {
+        log.Printf("Failed to save session: %v", err)
+    }
 }
 
 func (m *Manager) Delete(sessionID string) {
-    m.mutex.Lock()
-    defer m.mutex.Unlock()
-    
-    delete(m.sessions, sessionID)
+    if err := m.store.Delete(sessionID); err != nil {
+        log.Printf("Failed to delete session: %v", err)
+    }
 }
 
-func (m *Manager) GetOrCreate(sessionID string) *Session {
-    session, found := m.Get(sessionID)
-    if !found {
-        session = NewSession(sessionID)
-        m.Set(sessionID, session)
+// list returns every session, or none when the store cannot be read
+func (m *Manager) list() []*Session {
+    sessions, err := m.store.List()
+    if err != nil {
+        log.Printf("Failed to list sessions: %v", err)
+        return nil
+    }
+    return sessions
+}
+
+// listByUser returns the sessions of a user, or none when the store cannot
+// be read
+func (m *Manager) listByUser(user string) []*Session {
+    sessions, err := m.store.ListByUser(user)
+    if err != nil {
+        log.Printf("Failed to list the sessions of %s: %v", user, err)
+        return nil
+    }
+    return sessions
+}
+
+// DeleteByUser removes every session that belongs to the given user, except
+// the ones listed in keep, and returns how many were removed
+func (m *Manager) DeleteByUser(user string, keep ...string) int {
+    removed := 0
+    for _, session := range m.ListByUser(user) {
+        if containsID(keep, session.ID) {
+            continue
+        }
+        m.Delete(session.ID)
+        removed++
+    }
+    return removed
+}
+
+// ListByUser returns the unexpired sessions that belong to the given user
+func (m *Manager) ListByUser(user string) []*Session {
+    now := time.Now()
+    var sessions []*Session
+    for _, session := range m.listByUser(user) {
+        if !m.Expired(session, now) {
+            sessions = append(sessions, session)
+        }
+    }
+    return sessions
+}
+
+// RenameUser moves every session of a user to their new name and returns
+// how many were updated
+func (m *Manager) RenameUser(oldUser, newUser string) int {
+    renamed := 0
+    for _, session := range m.ListByUser(oldUser) {
+        session.SetValue(userKey, newUser)
+        m.save(session)
+        renamed++
+    }
+    return renamed
+}
+
+func containsID(ids []string, id string) bool {
+    for _, candidate := range ids {
+        if candidate == id {
+            return true
+        }
+    }
+    return false
+}
+
+// NewSessionID returns a random, unguessable session ID
+func NewSessionID() string {
+    bytes := make([]byte, sessionIDBytes)
+    if _, err := rand.Read(bytes); err != nil {
+        panic("session: failed to read random bytes: " + err.Error())
     }
+    return base64.RawURLEncoding.EncodeToString(bytes)
+}
+
+// New creates and stores a session with a fresh ID. Session IDs are only
+// ever chosen by the server.
+func (m *Manager) New() *Session {
+    session := NewSession(NewSessionID())
+    m.Set(session.ID, session)
     return session
 }
 
+// GetOrCreate returns the session with the given ID, or a new session with
+// a fresh ID when the ID is empty or unknown. An ID made up by the client is
+// never adopted, so callers must hand out the ID of the returned session.
+func (m *Manager) GetOrCreate(sessionID string) *Session {
+    if sessionID != "" {
+        if session, found := m.Get(sessionID); found {
+            return session
+        }
+    }
+    return m.New()
+}
+
+// Regenerate moves a session's data to a fresh ID and deletes the old one,
+// so an ID known to someone else stops working. Call it whenever the
+// privileges tied to a session change.
+func (m *Manager) Regenerate(session *Session) *Session {
+    regenerated := session.clone()
+    regenerated.ID = NewSessionID()
+    regenerated.Created = time.Now()
+    m.Set(regenerated.ID, regenerated)
+    m.Delete(session.ID)
+    return regenerated
+}
+
+// Close stops the cleanup loop and releases the store. It is safe to call
+// more than once.
+func (m *Manager) Close() error {
+    var err error
+    m.closeOnce.Do(func() {
+        close(m.stop)
+        <-m.done
+        if closer, ok := m.store.(io.Closer); ok {
+            err = closer.Close()
+        }
+    })
+    return err
+}
+
+// RemoveExpired deletes the expired sessions from the store and returns how
+// many were removed
+func (m *Manager) RemoveExpired() int {
+    now := time.Now()
+    removed := 0
+    for _, session := range m.list() {
+        if m.Expired(session, now) {
+            m.Delete(session.ID)
+            removed++
+        }
+    }
+    return removed
+}
+
+// userIndexer is a store that keeps an index of sessions by user apart
+// from the sessions
+type userIndexer interface {
+    // indexUser adds a session to the index of its user
+    indexUser(session *Session) error
+}
+
+// indexSessions indexes every session that belongs to a user, so the ones
+// stored before stores kept an index are found by ListByUser. Only the
+// index is written, so a session deleted meanwhile is not brought back.
+func (m *Manager) indexSessions() {
+    indexer, ok := m.store.(userIndexer)
+    if !ok {
+        return
+    }
+    now := time.Now()
+    for _, session := range m.list() {
+        if session.user() == "" || m.Expired(session, now) {
+            continue
+        }
+        if err := indexer.indexUser(session); err != nil {
+            log.Printf("Failed to index session by user: %v", err)
+            return
+        }
+    }
+}
+
 func (m *Manager) cleanup() {
-    ticker := time.NewTicker(1 * time.Hour)
+    defer close(m.done)
+
+    m.indexSessions()
+
+    ticker := time.NewTicker(m.options.CleanupInterval)
     defer ticker.Stop()
-    
+
     for {
         select {
         case <-ticker.C:
-            m.mutex.Lock()
-            now := time.Now()
-            for id, session := range m.sessions {
-                if now.Sub(session.LastUsed) > 24*time.Hour {
-                    delete(m.sessions, id)
-                }
-            }
-            m.mutex.Unlock()
+            m.RemoveExpired()
+        case <-m.stop:
+            return
         }
     }
 }
 
 func (s *Session) SetValue(key string, value interface{}) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
     s.Data[key] = value
 }
 
 func (s *Session) GetValue(key string) (interface{}, bool) {
+    s.mutex.RLock()
+    defer s.mutex.RUnlock()
+
     value, exists := s.Data[key]
     return value, exists
 }
@@ -104,17 +371,23 @@ func (s *Session) GetString(key string) (string, bool) {
     if !exists {
         return "", false
     }
-    
+
     str, ok := value.(string)
     return str, ok
 }
 
+// user returns the user the session belongs to, if any
+func (s *Session) user() string {
+    user, _ := s.GetString(userKey)
+    return user
+}
+
 func (s *Session) GetInt(key string) (int, bool) {
     value, exists := s.GetValue(key)
     if !exists {
         return 0, false
     }
-    
+
     // Handle both int and float64 (common from JSON unmarshaling)
     switch v := value.(type) {
     case int:
@@ -127,10 +400,54 @@ func (s *Session) GetInt(key string) (int, bool) {
 }
 
 func (s *Session) RemoveValue(key string) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
     delete(s.Data, key)
 }
 
+func (s *Session) CreatedAt() time.Time {
+    s.mutex.RLock()
+    defer s.mutex.RUnlock()
+
+    return s.Created
+}
+
+func (s *Session) LastUsedAt() time.Time {
+    s.mutex.RLock()
+    defer s.mutex.RUnlock()
+
+    return s.LastUsed
+}
+
+func (s *Session) touch(now time.Time) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    s.LastUsed = now
+}
+
+// clone returns a copy of the session that can be changed independently
+func (s *Session) clone() *Session {
+    s.mutex.RLock()
+    defer s.mutex.RUnlock()
+
+    copied := &Session{
+        ID:       s.ID,
+        Data:     make(map[string]interface{}, len(s.Data)),
+        Created:  s.Created,
+        LastUsed: s.LastUsed,
+    }
+    for key, value := range s.Data {
+        copied.Data[key] = value
+    }
+    return copied
+}
+
 func (s *Session) ToJSON() (string, error) {
+    s.mutex.RLock()
+    defer s.mutex.RUnlock()
+
     data, err := json.Marshal(s)
     if err != nil {
         return "", err
@@ -144,11 +461,15 @@ func SessionFromJSON(data string) (*Session, error) {
     if err != nil {
         return nil, err
     }
-    
+
     // Initialize the Data map if it's nil
     if session.Data == nil {
         session.Data = make(map[string]interface{})
     }
-    
+    // Sessions saved before creation times were recorded
+    if session.Created.IsZero() {
+        session.Created = session.LastUsed
+    }
+
     return &session, nil
 }
@@ -0,0 +1,218 @@
+package session
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newUserSession(manager *Manager, id, user string) {
+	session := NewSession(id)
+	session.SetValue("user", user)
+	manager.Set(id, session)
+}
+
+func TestUserSessions(t *testing.T) {
+	manager := NewManager()
+	defer manager.Close()
+	newUserSession(manager, "a1", "alice@example.com")
+	newUserSession(manager, "a2", "alice@example.com")
+	newUserSession(manager, "a3", "alice@example.com")
+	newUserSession(manager, "b1", "bob@example.com")
+	manager.Set("anon", NewSession("anon"))
+
+	if got := len(manager.ListByUser("alice@example.com")); got != 3 {
+		t.Fatalf("ListByUser: got %d sessions, want 3", got)
+	}
+
+	if removed := manager.DeleteByUser("alice@example.com", "a2"); removed != 2 {
+		t.Errorf("DeleteByUser: removed %d sessions, want 2", removed)
+	}
+	if _, found := manager.Get("a2"); !found {
+		t.Error("kept session was removed")
+	}
+	if _, found := manager.Get("a1"); found {
+		t.Error("session a1 should have been removed")
+	}
+	if _, found := manager.Get("b1"); !found {
+		t.Error("another user's session was removed")
+	}
+	if _, found := manager.Get("anon"); !found {
+		t.Error("anonymous session was removed")
+	}
+
+	if renamed := manager.RenameUser("alice@example.com", "alice@example.org"); renamed != 1 {
+		t.Errorf("RenameUser: renamed %d sessions, want 1", renamed)
+	}
+	if got := len(manager.ListByUser("alice@example.org")); got != 1 {
+		t.Errorf("ListByUser after rename: got %d sessions, want 1", got)
+	}
+}
+
+func TestConcurrentSessionAccess(t *testing.T) {
+	manager := NewManager()
+	defer manager.Close()
+
+	shared := NewSession("shared")
+	manager.Set("shared", shared)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprintf("key%d", i)
+			for j := 0; j < 100; j++ {
+				shared.SetValue(key, j)
+				shared.GetInt(key)
+				shared.RemoveValue("other")
+				if _, err := shared.ToJSON(); err != nil {
+					t.Errorf("ToJSON failed: %v", err)
+				}
+				manager.Set("shared", shared)
+				if session, found := manager.Get("shared"); found {
+					session.SetValue("user", "alice@example.com")
+				}
+				manager.ListByUser("alice@example.com")
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < 8; i++ {
+		if value, _ := shared.GetInt(fmt.Sprintf("key%d", i)); value != 99 {
+			t.Errorf("key%d = %d, want 99", i, value)
+		}
+	}
+}
+
+func TestSessionTimeouts(t *testing.T) {
+	store := NewMemoryStore()
+	manager := NewManagerWithStore(store, Options{
+		IdleTimeout:     time.Hour,
+		AbsoluteTimeout: 2 * time.Hour,
+		CleanupInterval: time.Hour,
+	})
+	defer manager.Close()
+
+	now := time.Now()
+	save := func(id string, created, lastUsed time.Duration) {
+		session := NewSession(id)
+		session.Created = now.Add(-created)
+		session.LastUsed = now.Add(-lastUsed)
+		store.Save(session)
+	}
+	save("fresh", 10*time.Minute, time.Minute)
+	save("idle", 90*time.Minute, 61*time.Minute)
+	save("old", 3*time.Hour, time.Minute)
+
+	if _, found := manager.Get("fresh"); !found {
+		t.Error("fresh session should be valid")
+	}
+	if _, found := manager.Get("idle"); found {
+		t.Error("idle session should have expired")
+	}
+	if _, err := store.Load("idle"); err != ErrNotFound {
+		t.Error("expired session should be removed from the store when read")
+	}
+
+	if removed := manager.RemoveExpired(); removed != 1 {
+		t.Errorf("RemoveExpired removed %d sessions, want 1", removed)
+	}
+	if _, err := store.Load("old"); err != ErrNotFound {
+		t.Error("session past its absolute lifetime should have been removed")
+	}
+	if _, err := store.Load("fresh"); err != nil {
+		t.Error("fresh session should have been kept")
+	}
+
+	// Sessions saved without a creation time use their last use instead
+	restored, err := SessionFromJSON(`{"id":"legacy","data":{},"last_used":"2024-01-02T03:04:05Z"}`)
+	if err != nil || !restored.CreatedAt().Equal(restored.LastUsedAt()) {
+		t.Errorf("legacy session created at %v, want %v (%v)", restored.CreatedAt(), restored.LastUsedAt(), err)
+	}
+}
+
+func TestManagerCleanupStops(t *testing.T) {
+	store := NewMemoryStore()
+	manager := NewManagerWithStore(store, Options{
+		IdleTimeout:     20 * time.Millisecond,
+		CleanupInterval: 10 * time.Millisecond,
+	})
+	manager.Set("short", NewSession("short"))
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, err := store.Load("short"); err == ErrNotFound {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("cleanup did not remove the expired session")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if err := manager.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := manager.Close(); err != nil {
+		t.Fatalf("second Close failed: %v", err)
+	}
+
+	// No cleanup runs after Close
+	session := NewSession("after")
+	session.LastUsed = time.Now().Add(-time.Hour)
+	store.Save(session)
+	time.Sleep(50 * time.Millisecond)
+	if _, err := store.Load("after"); err != nil {
+		t.Error("cleanup still running after Close")
+	}
+}
+
+func TestSessionIDsChosenByServer(t *testing.T) {
+	manager := NewManager()
+	defer manager.Close()
+
+	for _, clientID := range []string{"", "attacker-chosen"} {
+		created := manager.GetOrCreate(clientID)
+		if created.ID == clientID || len(created.ID) < 40 {
+			t.Errorf("GetOrCreate(%q) adopted or weak ID %q", clientID, created.ID)
+		}
+		if _, found := manager.Get(clientID); found {
+			t.Errorf("session stored under client-supplied ID %q", clientID)
+		}
+		if _, found := manager.Get(created.ID); !found {
+			t.Errorf("new session %q not stored", created.ID)
+		}
+	}
+
+	existing := manager.New()
+	if got := manager.GetOrCreate(existing.ID); got.ID != existing.ID {
+		t.Errorf("GetOrCreate of a known ID returned %q, want %q", got.ID, existing.ID)
+	}
+}
+
+func TestRegenerate(t *testing.T) {
+	manager := NewManager()
+	defer manager.Close()
+
+	original := manager.New()
+	original.SetValue("dbToken", "token")
+	manager.Set(original.ID, original)
+
+	regenerated := manager.Regenerate(original)
+	if regenerated.ID == original.ID {
+		t.Fatal("Regenerate kept the session ID")
+	}
+	if _, found := manager.Get(original.ID); found {
+		t.Error("old session ID still valid")
+	}
+	stored, found := manager.Get(regenerated.ID)
+	if !found {
+		t.Fatal("regenerated session not stored")
+	}
+	if token, _ := stored.GetString("dbToken"); token != "token" {
+		t.Errorf("dbToken = %q, want data carried over", token)
+	}
+}
@@ -0,0 +1,119 @@
+package session
+
+import (
+    "errors"
+    "log"
+
+    "github.com/c4gt/tornado-nginx-go-backend/internal/storage"
+)
+
+const (
+    storagePrefix = "sessions"
+    // userPrefix holds an empty item per session of a user, named
+    // session-users/<user>/<session ID>
+    userPrefix = "session-users"
+)
+
+// StorageStore keeps sessions on the configured storage backend, so they
+// survive restarts and are shared by every server using the same backend.
+type StorageStore struct {
+    storage storage.Storage
+}
+
+func NewStorageStore(backend storage.Storage) *StorageStore {
+    return &StorageStore{storage: backend}
+}
+
+func (s *StorageStore) itemPath(id string) string {
+    return storagePrefix + "/" + id
+}
+
+func (s *StorageStore) userPath(user string) string {
+    return userPrefix + "/" + storage.EncodeSegment(user)
+}
+
+func (s *StorageStore) Load(id string) (*Session, error) {
+    data, err := s.storage.GetItem(s.itemPath(id))
+    if err != nil {
+        if errors.Is(err, storage.ErrNotFound) {
+            return nil, ErrNotFound
+        }
+        return nil, err
+    }
+    return SessionFromJSON(data)
+}
+
+func (s *StorageStore) Save(session *Session) error {
+    data, err := session.ToJSON()
+    if err != nil {
+        return err
+    }
+    if err := s.storage.PutItem(s.itemPath(session.ID), data); err != nil {
+        return err
+    }
+    return s.indexUser(session)
+}
+
+// indexUser adds an item for a session below its user. Sessions that
+// changed user keep their old items until ListByUser finds them gone.
+func (s *StorageStore) indexUser(session *Session) error {
+    user := session.user()
+    if user == "" {
+        return nil
+    }
+    return s.storage.PutItem(s.userPath(user)+"/"+session.ID, "")
+}
+
+func (s *StorageStore) Delete(id string) error {
+    if session, err := s.Load(id); err == nil && session.user() != "" {
+        s.storage.DeleteItem(s.userPath(session.user()) + "/" + id)
+    }
+    err := s.storage.DeleteItem(s.itemPath(id))
+    if errors.Is(err, storage.ErrNotFound) {
+        return nil
+    }
+    return err
+}
+
+func (s *StorageStore) List() ([]*Session, error) {
+    paths, err := s.storage.ListItems(storagePrefix)
+    if err != nil {
+        return nil, err
+    }
+
+    sessions := make([]*Session, 0, len(paths))
+    for _, path := range paths {
+        session, err := s.Load(path[len(storagePrefix)+1:])
+        if err != nil {
+            if !errors.Is(err, ErrNotFound) {
+                log.Printf("Skipping unreadable session %s: %v", path, err)
+            }
+            continue
+        }
+        sessions = append(sessions, session)
+    }
+    return sessions, nil
+}
+
+func (s *StorageStore) ListByUser(user string) ([]*Session, error) {
+    prefix := s.userPath(user)
+    paths, err := s.storage.ListItems(prefix)
+    if err != nil {
+        return nil, err
+    }
+
+    var sessions []*Session
+    for _, path := range paths {
+        session, err := s.Load(path[len(prefix)+1:])
+        if err != nil && !errors.Is(err, ErrNotFound) {
+            log.Printf("Skipping unreadable session %s: %v", path, err)
+            continue
+        }
+        if err != nil || session.user() != user {
+            s.storage.DeleteItem(path)
+            continue
+        }
+        sessions = append(sessions, session)
+    }
+    return sessions, nil
+}
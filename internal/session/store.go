@@ -0,0 +1,86 @@
+package session
+
+import (
+    "errors"
+    "sync"
+)
+
+var ErrNotFound = errors.New("session not found")
+
+// Store keeps sessions for a Manager. Implementations return copies, so a
+// changed session is only seen by others once it is saved again.
+type Store interface {
+    // Load returns the session with the given ID, or ErrNotFound
+    Load(id string) (*Session, error)
+    Save(session *Session) error
+    Delete(id string) error
+    // List returns every stored session
+    List() ([]*Session, error)
+    // ListByUser returns the stored sessions of a user, without reading
+    // the sessions of others
+    ListByUser(user string) ([]*Session, error)
+}
+
+// MemoryStore keeps sessions in the process. They are lost on restart and
+// not shared between servers.
+type MemoryStore struct {
+    sessions map[string]*Session
+    mutex    sync.RWMutex
+}
+
+func NewMemoryStore() *MemoryStore {
+    return &MemoryStore{
+        sessions: make(map[string]*Session),
+    }
+}
+
+func (s *MemoryStore) Load(id string) (*Session, error) {
+    s.mutex.RLock()
+    defer s.mutex.RUnlock()
+
+    session, exists := s.sessions[id]
+    if !exists {
+        return nil, ErrNotFound
+    }
+    return session.clone(), nil
+}
+
+func (s *MemoryStore) Save(session *Session) error {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    s.sessions[session.ID] = session.clone()
+    return nil
+}
+
+func (s *MemoryStore) Delete(id string) error {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    delete(s.sessions, id)
+    return nil
+}
+
+func (s *MemoryStore) List() ([]*Session, error) {
+    s.mutex.RLock()
+    defer s.mutex.RUnlock()
+
+    sessions := make([]*Session, 0, len(s.sessions))
+    for _, session := range s.sessions {
+        sessions = append(sessions, session.clone())
+    }
+    return sessions, nil
+}
+
+func (s *MemoryStore) ListByUser(user string) ([]*Session, error) {
+    s.mutex.RLock()
+    defer s.mutex.RUnlock()
+
+    var sessions []*Session
+    for _, session := range s.sessions {
+        if session.user() == user {
+            sessions = append(sessions, session.clone())
+        }
+    }
+    return sessions, nil
+}
@@ -0,0 +1,341 @@
+package session_test
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/c4gt/tornado-nginx-go-backend/internal/session"
+	"github.com/c4gt/tornado-nginx-go-backend/tests/testutils"
+)
+
+// fakeRedis is a local stand-in that speaks enough of the Redis protocol for
+// the session store
+type fakeRedis struct {
+	listener net.Listener
+	password string
+	data     map[string]string
+	sets     map[string]map[string]bool
+	expiry   map[string]time.Time
+	mutex    sync.Mutex
+}
+
+func startFakeRedis(t *testing.T, password string) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	server := &fakeRedis{
+		listener: listener,
+		password: password,
+		data:     make(map[string]string),
+		sets:     make(map[string]map[string]bool),
+		expiry:   make(map[string]time.Time),
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+func (f *fakeRedis) addr() string {
+	return f.listener.Addr().String()
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	authenticated := f.password == ""
+
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(args[0])
+		if command == "AUTH" {
+			if len(args) == 2 && args[1] == f.password {
+				authenticated = true
+				fmt.Fprint(conn, "+OK\r\n")
+			} else {
+				fmt.Fprint(conn, "-WRONGPASS invalid password\r\n")
+			}
+			continue
+		}
+		if !authenticated {
+			fmt.Fprint(conn, "-NOAUTH Authentication required.\r\n")
+			continue
+		}
+		fmt.Fprint(conn, f.execute(command, args[1:]))
+	}
+}
+
+func (f *fakeRedis) execute(command string, args []string) string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for key, at := range f.expiry {
+		if time.Now().After(at) {
+			delete(f.data, key)
+			delete(f.sets, key)
+			delete(f.expiry, key)
+		}
+	}
+
+	switch command {
+	case "PING", "SELECT":
+		return "+OK\r\n"
+	case "SET":
+		f.data[args[0]] = args[1]
+		delete(f.expiry, args[0])
+		if len(args) == 4 && strings.ToUpper(args[2]) == "PX" {
+			ms, _ := strconv.Atoi(args[3])
+			f.expiry[args[0]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+		return "+OK\r\n"
+	case "GET":
+		value, ok := f.data[args[0]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+	case "DEL":
+		_, ok := f.data[args[0]]
+		delete(f.data, args[0])
+		delete(f.expiry, args[0])
+		if ok {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	case "SADD":
+		if f.sets[args[0]] == nil {
+			f.sets[args[0]] = make(map[string]bool)
+		}
+		f.sets[args[0]][args[1]] = true
+		return ":1\r\n"
+	case "SREM":
+		delete(f.sets[args[0]], args[1])
+		return ":1\r\n"
+	case "SMEMBERS":
+		reply := fmt.Sprintf("*%d\r\n", len(f.sets[args[0]]))
+		for member := range f.sets[args[0]] {
+			reply += fmt.Sprintf("$%d\r\n%s\r\n", len(member), member)
+		}
+		return reply
+	case "PEXPIRE":
+		ms, _ := strconv.Atoi(args[1])
+		f.expiry[args[0]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		return ":1\r\n"
+	case "SCAN":
+		prefix := strings.TrimSuffix(args[2], "*")
+		var keys []string
+		for key := range f.data {
+			if strings.HasPrefix(key, prefix) {
+				keys = append(keys, key)
+			}
+		}
+		reply := fmt.Sprintf("*2\r\n$1\r\n0\r\n*%d\r\n", len(keys))
+		for _, key := range keys {
+			reply += fmt.Sprintf("$%d\r\n%s\r\n", len(key), key)
+		}
+		return reply
+	default:
+		return "-ERR unknown command '" + command + "'\r\n"
+	}
+}
+
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil || line[0] != '*' || count < 1 {
+		return nil, fmt.Errorf("bad command %q", line)
+	}
+
+	args := make([]string, count)
+	for i := range args {
+		if _, err := reader.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		arg, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		args[i] = strings.TrimSuffix(arg, "\r\n")
+	}
+	return args, nil
+}
+
+func testStore(t *testing.T, store session.Store) {
+	if _, err := store.Load("missing"); !errors.Is(err, session.ErrNotFound) {
+		t.Fatalf("Load of a missing session: got %v, want ErrNotFound", err)
+	}
+
+	s := session.NewSession("abc")
+	s.SetValue("user", "alice@example.com")
+	s.SetValue("created", 1700000000)
+	if err := store.Save(s); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	// Changes are only visible once saved
+	s.SetValue("user", "mallory@example.com")
+	loaded, err := store.Load("abc")
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if user, _ := loaded.GetString("user"); user != "alice@example.com" {
+		t.Errorf("user = %q, want alice@example.com", user)
+	}
+	if created, _ := loaded.GetInt("created"); created != 1700000000 {
+		t.Errorf("created = %d, want 1700000000", created)
+	}
+
+	if err := store.Save(session.NewSession("def")); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	sessions, err := store.List()
+	if err != nil || len(sessions) != 2 {
+		t.Fatalf("List: got %d sessions (%v), want 2", len(sessions), err)
+	}
+
+	// Sessions are listed by user without reading the others
+	bob := session.NewSession("ghi")
+	bob.SetValue("user", "bob@example.com")
+	if err := store.Save(bob); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	userSessions := func(user string) []string {
+		sessions, err := store.ListByUser(user)
+		if err != nil {
+			t.Fatalf("ListByUser failed: %v", err)
+		}
+		var ids []string
+		for _, s := range sessions {
+			ids = append(ids, s.ID)
+		}
+		sort.Strings(ids)
+		return ids
+	}
+	if ids := userSessions("alice@example.com"); strings.Join(ids, ",") != "abc" {
+		t.Errorf("sessions of alice = %v, want [abc]", ids)
+	}
+
+	// A session that changes user is listed for the new one only
+	loaded.SetValue("user", "bob@example.com")
+	if err := store.Save(loaded); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	if ids := userSessions("alice@example.com"); len(ids) != 0 {
+		t.Errorf("sessions of alice after the move = %v, want none", ids)
+	}
+	if ids := userSessions("bob@example.com"); strings.Join(ids, ",") != "abc,ghi" {
+		t.Errorf("sessions of bob = %v, want [abc ghi]", ids)
+	}
+
+	if err := store.Delete("abc"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := store.Load("abc"); !errors.Is(err, session.ErrNotFound) {
+		t.Errorf("Load after Delete: got %v, want ErrNotFound", err)
+	}
+	if ids := userSessions("bob@example.com"); strings.Join(ids, ",") != "ghi" {
+		t.Errorf("sessions of bob after Delete = %v, want [ghi]", ids)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, session.NewMemoryStore())
+}
+
+func TestStorageStore(t *testing.T) {
+	testStore(t, session.NewStorageStore(testutils.NewMockStorage()))
+}
+
+func TestManagerIndexesOlderSessions(t *testing.T) {
+	backend := testutils.NewMockStorage()
+	old := session.NewSession("old")
+	old.SetValue("user", "alice@example.com")
+	data, _ := old.ToJSON()
+	// Stored before sessions were indexed by user
+	backend.PutItem("sessions/old", data)
+
+	store := session.NewStorageStore(backend)
+	manager := session.NewManagerWithStore(store, session.DefaultOptions())
+	manager.Close()
+
+	sessions, err := store.ListByUser("alice@example.com")
+	if err != nil || len(sessions) != 1 || sessions[0].ID != "old" {
+		t.Errorf("ListByUser = %v, %v; want the older session", sessions, err)
+	}
+}
+
+func TestRedisStore(t *testing.T) {
+	server := startFakeRedis(t, "secret")
+
+	if _, err := session.NewRedisStore(session.RedisOptions{Addr: server.addr(), Password: "wrong"}); err == nil {
+		t.Fatal("connecting with a wrong password should fail")
+	}
+
+	store, err := session.NewRedisStore(session.RedisOptions{
+		Addr:     server.addr(),
+		Password: "secret",
+		TTL:      time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("NewRedisStore failed: %v", err)
+	}
+	defer store.Close()
+
+	testStore(t, store)
+
+	// Sessions are shared with every server connected to the same Redis
+	other, err := session.NewRedisStore(session.RedisOptions{Addr: server.addr(), Password: "secret"})
+	if err != nil {
+		t.Fatalf("NewRedisStore failed: %v", err)
+	}
+	defer other.Close()
+	if _, err := other.Load("def"); err != nil {
+		t.Errorf("session not visible to a second server: %v", err)
+	}
+
+	// A dropped connection is re-established
+	store.Close()
+	if _, err := store.Load("def"); err != nil {
+		t.Errorf("Load after reconnect failed: %v", err)
+	}
+}
+
+func TestRedisStoreExpiry(t *testing.T) {
+	server := startFakeRedis(t, "")
+	store, err := session.NewRedisStore(session.RedisOptions{Addr: server.addr(), TTL: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("NewRedisStore failed: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.Save(session.NewSession("short")); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, err := store.Load("short"); !errors.Is(err, session.ErrNotFound) {
+		t.Errorf("idle session should have expired, got %v", err)
+	}
+}
@@ -0,0 +1,61 @@
+package socialcalc
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MaxCol is the last column SocialCalc can address, ZZ
+	MaxCol = 26 * 27
+	// MaxRow is the last row accepted in a save
+	MaxRow = 1 << 20
+)
+
+// ColName returns the letters of a 1-based column number, "A" for 1
+func ColName(col int) string {
+	if col <= 26 {
+		return string(rune('A' + col - 1))
+	}
+	return string(rune('A'+(col-1)/26-1)) + string(rune('A'+(col-1)%26))
+}
+
+// ColNumber returns the 1-based number of a column name such as "A" or
+// "AB", which may be in either case
+func ColNumber(name string) (int, error) {
+	if name == "" || len(name) > 2 {
+		return 0, fmt.Errorf("invalid column %q", name)
+	}
+	col := 0
+	for _, r := range strings.ToUpper(name) {
+		if r < 'A' || r > 'Z' {
+			return 0, fmt.Errorf("invalid column %q", name)
+		}
+		col = col*26 + int(r-'A') + 1
+	}
+	return col, nil
+}
+
+// ParseCoord splits a cell coordinate such as "B3" into its column and row.
+// Absolute references like "$B$3" are accepted.
+func ParseCoord(coord string) (col, row int, err error) {
+	coord = strings.ReplaceAll(coord, "$", "")
+	split := strings.IndexFunc(coord, func(r rune) bool { return r >= '0' && r <= '9' })
+	if split <= 0 {
+		return 0, 0, fmt.Errorf("invalid cell coordinate %q", coord)
+	}
+	if col, err = ColNumber(coord[:split]); err != nil {
+		return 0, 0, fmt.Errorf("invalid cell coordinate %q", coord)
+	}
+	row, err = strconv.Atoi(coord[split:])
+	if err != nil || row < 1 || row > MaxRow || coord[split] == '0' {
+		return 0, 0, fmt.Errorf("invalid cell coordinate %q", coord)
+	}
+	return col, row, nil
+}
+
+// Coord returns the coordinate of a cell, "A1" for column 1 and row 1
+func Coord(col, row int) string {
+	return ColName(col) + strconv.Itoa(row)
+}
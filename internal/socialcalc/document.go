@@ -0,0 +1,176 @@
+package socialcalc
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// DefaultBoundary is the multipart boundary the spreadsheet control uses
+	DefaultBoundary = "SocialCalcSpreadsheetControlSave"
+
+	// Part names of a spreadsheet control save
+	PartSheet = "sheet"
+	PartEdit  = "edit"
+	PartAudit = "audit"
+
+	saveHeader  = "socialcalc:version:1.0\n"
+	partHeaders = "Content-type: text/plain; charset=UTF-8\n\n"
+)
+
+// Part is one section of a multipart save. The sheet part is parsed into
+// Document.Sheet; the text of other parts, such as the editor settings and
+// the audit trail, is kept as it is.
+type Part struct {
+	Name string
+	Body string
+}
+
+// Document is a SocialCalc save: either a bare sheet save, as written by
+// SocialCalc.CreateSheetSave, or a multipart spreadsheet control save with
+// the sheet, editor settings, audit trail and other parts.
+type Document struct {
+	Multipart bool
+	Boundary  string
+	// Parts lists the parts of a multipart save in order; the body of the
+	// sheet part is ignored in favour of Sheet
+	Parts []Part
+	Sheet *Sheet
+}
+
+var (
+	mimeVersionLine = regexp.MustCompile(`(?mi)^MIME-Version:\s1\.0`)
+	boundaryLine    = regexp.MustCompile(`(?mi)^Content-Type:\s*multipart/mixed;\s*boundary=(\S+)`)
+	blankLine       = regexp.MustCompile(`(?:\r\n|\n)(?:\r\n|\n)`)
+)
+
+// Parse reads a save in either form
+func Parse(data string) (*Document, error) {
+	start := mimeVersionLine.FindStringIndex(data)
+	if start == nil {
+		sheet, err := ParseSheet(data)
+		if err != nil {
+			return nil, err
+		}
+		return &Document{Sheet: sheet}, nil
+	}
+	return parseMultipart(data, start[0])
+}
+
+// parseMultipart splits a spreadsheet control save into its parts the way
+// SocialCalc.SpreadsheetControlDecodeSpreadsheetSave does
+func parseMultipart(data string, offset int) (*Document, error) {
+	match := boundaryLine.FindStringSubmatchIndex(data[offset:])
+	if match == nil {
+		return nil, fmt.Errorf("multipart save without a boundary")
+	}
+	boundary := data[offset+match[2] : offset+match[3]]
+	pos := offset + match[1]
+	// The boundary comes from the save, so it may not even be valid UTF-8
+	boundaryRegexp, err := regexp.Compile(`(?m)^--` + regexp.QuoteMeta(boundary) + `(?:\r\n|\n)`)
+	if err != nil {
+		return nil, fmt.Errorf("invalid multipart boundary %q: %w", boundary, err)
+	}
+	endRegexp, err := regexp.Compile(`(?m)^--` + regexp.QuoteMeta(boundary) + `--$`)
+	if err != nil {
+		return nil, fmt.Errorf("invalid multipart boundary %q: %w", boundary, err)
+	}
+
+	// body returns the text of the part whose boundary line starts at or
+	// after pos, and where the part ends
+	body := func(pos int, last bool) (string, int, error) {
+		headerEnd := blankLine.FindStringIndex(data[pos:])
+		if headerEnd == nil {
+			return "", 0, fmt.Errorf("multipart save ends in a part header")
+		}
+		start := pos + headerEnd[1]
+		ending := boundaryRegexp
+		if last {
+			ending = endRegexp
+		}
+		end := ending.FindStringIndex(data[start:])
+		if end == nil {
+			return "", 0, fmt.Errorf("multipart save ends without a boundary")
+		}
+		return data[start : start+end[0]], start + end[0], nil
+	}
+
+	first := boundaryRegexp.FindStringIndex(data[pos:])
+	if first == nil {
+		return nil, fmt.Errorf("multipart save without parts")
+	}
+	header, end, err := body(pos+first[0], false)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := &Document{Multipart: true, Boundary: boundary}
+	for _, line := range splitLines(header) {
+		if name, ok := strings.CutPrefix(line, "part:"); ok {
+			doc.Parts = append(doc.Parts, Part{Name: name})
+		}
+	}
+
+	for i := range doc.Parts {
+		text, partEnd, err := body(end, i == len(doc.Parts)-1)
+		if err != nil {
+			return nil, fmt.Errorf("part %s: %w", doc.Parts[i].Name, err)
+		}
+		end = partEnd
+		if doc.Parts[i].Name != PartSheet {
+			doc.Parts[i].Body = text
+			continue
+		}
+		if doc.Sheet, err = ParseSheet(text); err != nil {
+			return nil, fmt.Errorf("part %s: %w", PartSheet, err)
+		}
+	}
+
+	if doc.Sheet == nil {
+		return nil, fmt.Errorf("multipart save without a sheet part")
+	}
+	return doc, nil
+}
+
+// Part returns the body of a part other than the sheet, and whether the
+// save has it
+func (d *Document) Part(name string) (string, bool) {
+	for _, part := range d.Parts {
+		if part.Name == name {
+			return part.Body, true
+		}
+	}
+	return "", false
+}
+
+// String returns the save in the form it was read in, like
+// SocialCalc.SpreadsheetControlCreateSpreadsheetSave for multipart saves
+func (d *Document) String() string {
+	if !d.Multipart {
+		return d.Sheet.String()
+	}
+
+	boundary := d.Boundary
+	if boundary == "" {
+		boundary = DefaultBoundary
+	}
+	var b strings.Builder
+	b.WriteString(saveHeader)
+	b.WriteString("MIME-Version: 1.0\nContent-Type: multipart/mixed; boundary=" + boundary + "\n")
+	b.WriteString("--" + boundary + "\n" + partHeaders)
+	b.WriteString("# SocialCalc Spreadsheet Control Save\nversion:1.0\n")
+	for _, part := range d.Parts {
+		b.WriteString("part:" + part.Name + "\n")
+	}
+	for _, part := range d.Parts {
+		b.WriteString("--" + boundary + "\n" + partHeaders)
+		if part.Name == PartSheet {
+			b.WriteString(d.Sheet.String())
+		} else {
+			b.WriteString(part.Body)
+		}
+	}
+	b.WriteString("--" + boundary + "--\n")
+	return b.String()
+}
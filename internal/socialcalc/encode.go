@@ -0,0 +1,53 @@
+package socialcalc
+
+import "strings"
+
+// EncodeValue escapes a value for a save line, where ':' separates fields
+// and '\n' separates lines, like SocialCalc.encodeForSave
+func EncodeValue(s string) string {
+	if !strings.ContainsAny(s, "\\:\n") {
+		return s
+	}
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '\\':
+			b.WriteString(`\b`)
+		case ':':
+			b.WriteString(`\c`)
+		case '\n':
+			b.WriteString(`\n`)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// DecodeValue reverses EncodeValue. Unknown escapes are kept as they are.
+func DecodeValue(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			switch s[i+1] {
+			case 'b':
+				b.WriteByte('\\')
+				i++
+				continue
+			case 'c':
+				b.WriteByte(':')
+				i++
+				continue
+			case 'n':
+				b.WriteByte('\n')
+				i++
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,199 @@
+package socialcalc
+
+import (
+	"encoding/csv"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/c4gt/tornado-nginx-go-backend/internal/xlsx"
+)
+
+// serialEpoch is day zero of the serial date numbers SocialCalc and Excel
+// use for dates and times
+var serialEpoch = time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+
+// SerialTime returns the time of a serial date number
+func SerialTime(serial float64) time.Time {
+	days := math.Floor(serial)
+	seconds := math.Round((serial - days) * 86400)
+	return serialEpoch.AddDate(0, 0, int(days)).Add(time.Duration(seconds) * time.Second)
+}
+
+// Serial returns the serial date number of a time
+func Serial(t time.Time) float64 {
+	// Whole seconds rather than a time.Duration, which only spans 292 years
+	seconds := t.Unix() - serialEpoch.Unix()
+	return (float64(seconds) + float64(t.Nanosecond())/1e9) / 86400
+}
+
+// Bounds returns the last column and row holding a value
+func (s *Sheet) Bounds() (lastCol, lastRow int) {
+	for coord, cell := range s.Cells {
+		if cell.DataType == "" {
+			continue
+		}
+		col, row, err := ParseCoord(coord)
+		if err != nil {
+			continue
+		}
+		lastCol = max(lastCol, col)
+		lastRow = max(lastRow, row)
+	}
+	return lastCol, lastRow
+}
+
+// Text returns the value of a cell as text, without its display format:
+// the computed value of formulas, the text of errors, ISO 8601 dates and
+// times, and TRUE or FALSE for logical values
+func (c *Cell) Text() string {
+	if c == nil || c.DataType == "" {
+		return ""
+	}
+	if strings.HasPrefix(c.ValueType, ValueError) {
+		if text := c.ValueType[1:]; text != "" {
+			return text
+		}
+		return c.Value
+	}
+	n, ok := c.Number()
+	if !ok {
+		return c.Value
+	}
+	switch c.ValueType {
+	case "nd":
+		return SerialTime(n).Format("2006-01-02")
+	case "ndt":
+		return SerialTime(n).Format("2006-01-02 15:04:05")
+	case "nt":
+		return SerialTime(n).Format("15:04:05")
+	case "nl":
+		if n != 0 {
+			return "TRUE"
+		}
+		return "FALSE"
+	}
+	return c.Value
+}
+
+// csvFormulaPrefixes start the text that spreadsheet programs opening a
+// CSV file take as a formula
+const csvFormulaPrefixes = "=+-@\t\r"
+
+// csvText returns the text of a cell for CSV. Text that would be taken as
+// a formula is quoted with a leading apostrophe, so that opening the file
+// cannot run what someone typed into a sheet; numbers are left as they are.
+func (c *Cell) csvText() string {
+	text := c.Text()
+	if text == "" || !strings.ContainsRune(csvFormulaPrefixes, rune(text[0])) {
+		return text
+	}
+	if _, ok := c.Number(); ok {
+		return text
+	}
+	return "'" + text
+}
+
+// WriteCSV writes the values of the sheet, from A1 to the last cell with a
+// value, as CSV
+func (s *Sheet) WriteCSV(w io.Writer) error {
+	lastCol, lastRow := s.Bounds()
+	out := csv.NewWriter(w)
+	record := make([]string, lastCol)
+	for row := 1; row <= lastRow; row++ {
+		for col := 1; col <= lastCol; col++ {
+			record[col-1] = s.Cell(Coord(col, row)).csvText()
+		}
+		if err := out.Write(record); err != nil {
+			return err
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// XLSX converts the workbook to an .xlsx workbook, one worksheet per sheet
+func (w *Workbook) XLSX() *xlsx.Workbook {
+	book := &xlsx.Workbook{}
+	for _, sheet := range w.Sheets {
+		converted := sheet.Doc.Sheet.XLSX(sheet.Name)
+		converted.Hidden = sheet.Hidden
+		book.Sheets = append(book.Sheets, converted)
+	}
+	return book
+}
+
+// XLSX converts the sheet to a worksheet with its values, formulas, date
+// and percent formats, merged cells and column widths
+func (s *Sheet) XLSX(name string) *xlsx.Sheet {
+	out := &xlsx.Sheet{Name: name, Cols: make(map[int]xlsx.Col)}
+	for coord, cell := range s.Cells {
+		if cell.DataType == "" {
+			continue
+		}
+		col, row, err := ParseCoord(coord)
+		if err != nil {
+			continue
+		}
+		out.Set(row, col, cell.xlsxCell())
+		if cell.ColSpan > 1 || cell.RowSpan > 1 {
+			last := Coord(col+max(cell.ColSpan, 1)-1, row+max(cell.RowSpan, 1)-1)
+			out.Merged = append(out.Merged, coord+":"+last)
+		}
+	}
+	sort.Strings(out.Merged)
+
+	for col, attribs := range s.Cols {
+		// Widths are in pixels; an Excel character is about 7 pixels wide
+		var converted xlsx.Col
+		if px, err := strconv.ParseFloat(attribs.Width, 64); err == nil && px > 0 {
+			converted.Width = math.Round(px/7*100) / 100
+		}
+		converted.Hidden = attribs.Hide == "yes"
+		if converted != (xlsx.Col{}) {
+			out.Cols[col] = converted
+		}
+	}
+	return out
+}
+
+func (c *Cell) xlsxCell() xlsx.Cell {
+	var out xlsx.Cell
+	if c.IsFormula() {
+		out.Formula = c.Formula
+	}
+
+	switch {
+	case strings.HasPrefix(c.ValueType, ValueError):
+		out.Type, out.Value = xlsx.Error, c.Text()
+	case strings.HasPrefix(c.ValueType, ValueNumber):
+		if _, ok := c.Number(); !ok {
+			out.Type, out.Value = xlsx.String, c.Value
+			break
+		}
+		out.Type, out.Value = xlsx.Number, c.Value
+		switch c.ValueType {
+		case "nd":
+			out.Format = xlsx.Date
+		case "ndt":
+			out.Format = xlsx.DateTime
+		case "nt":
+			out.Format = xlsx.Time
+		case "n%":
+			out.Format = xlsx.Percent
+		case "nl":
+			out.Type, out.Value = xlsx.Bool, "0"
+			if n, _ := c.Number(); n != 0 {
+				out.Value = "1"
+			}
+		}
+	case c.ValueType == ValueBlank:
+		out.Type = xlsx.Empty
+	default:
+		out.Type, out.Value = xlsx.String, c.Value
+	}
+	return out
+}
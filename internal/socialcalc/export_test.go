@@ -0,0 +1,188 @@
+package socialcalc
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/c4gt/tornado-nginx-go-backend/internal/xlsx"
+)
+
+// workbookSave is a workbook control save of two sheets, the second hidden
+func workbookSave(t *testing.T) string {
+	t.Helper()
+	sheets := `{"sheet2":{"sheetstr":{"savestr":` + quote(t, "version:1.5\ncell:A1:v:1\nsheet:c:1:r:1\n") + `},"name":"Data","hidden":"1"},` +
+		`"sheet1":{"sheetstr":{"savestr":` + quote(t, sheetSave) + `},"name":"Costs","hidden":"0"}}`
+	return `{"numsheets":2,"currentid":"sheet1","currentname":"Costs","sheetArr":` + sheets + `,"EditableCells":{"allow":true}}`
+}
+
+func quote(t *testing.T, s string) string {
+	data, err := marshalJSON(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestParseWorkbook(t *testing.T) {
+	save := workbookSave(t)
+	workbook, err := ParseWorkbook(save)
+	if err != nil {
+		t.Fatalf("ParseWorkbook failed: %v", err)
+	}
+	if len(workbook.Sheets) != 2 || workbook.Sheets[0].Name != "Data" || !workbook.Sheets[0].Hidden ||
+		workbook.Sheets[1].ID != "sheet1" || workbook.CurrentName != "Costs" {
+		t.Fatalf("unexpected workbook %+v", workbook)
+	}
+	if sheet := workbook.Sheet("costs"); sheet == nil || sheet.Doc.Sheet.Cell("B3") == nil {
+		t.Errorf("sheet Costs not found")
+	}
+
+	got, err := workbook.String()
+	if err != nil || got != save {
+		t.Errorf("round trip changed the save: %v\n%s", err, got)
+	}
+
+	workbook, err = ParseWorkbook(sheetSave)
+	if err != nil || workbook.JSON || len(workbook.Sheets) != 1 || workbook.Sheets[0].Name != "Sheet1" {
+		t.Fatalf("single save read as %+v, %v", workbook, err)
+	}
+	if got, _ := workbook.String(); got != sheetSave {
+		t.Errorf("single save not kept as it is:\n%s", got)
+	}
+
+	for _, bad := range []string{
+		`{"numsheets":0,"sheetArr":{}}`,
+		`{"sheetArr":[1]}`,
+		`{"sheetArr":{"s":{"sheetstr":{"savestr":"cell:A0:t:x\n"},"name":"x"}}}`,
+	} {
+		if _, err := ParseWorkbook(bad); err == nil {
+			t.Errorf("ParseWorkbook(%q) accepted", bad)
+		}
+	}
+}
+
+func TestCellText(t *testing.T) {
+	for _, test := range []struct {
+		cell Cell
+		want string
+	}{
+		{Cell{DataType: DataNumber, ValueType: "n", Value: "1.5"}, "1.5"},
+		{Cell{DataType: DataText, ValueType: "th", Value: "<b>x</b>"}, "<b>x</b>"},
+		{Cell{DataType: DataFormula, ValueType: "e#DIV/0!", Value: "0", Formula: "1/0"}, "#DIV/0!"},
+		{Cell{DataType: DataConstant, ValueType: "nd", Value: "45000", Formula: "3/15/2023"}, "2023-03-15"},
+		{Cell{DataType: DataConstant, ValueType: "ndt", Value: "45000.75"}, "2023-03-15 18:00:00"},
+		{Cell{DataType: DataConstant, ValueType: "nt", Value: "0.5"}, "12:00:00"},
+		{Cell{DataType: DataFormula, ValueType: "nl", Value: "1"}, "TRUE"},
+		{Cell{DataType: DataFormula, ValueType: "nl", Value: "0"}, "FALSE"},
+		{Cell{}, ""},
+	} {
+		if got := test.cell.Text(); got != test.want {
+			t.Errorf("Text of %+v = %q, want %q", test.cell, got, test.want)
+		}
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	sheet, err := ParseSheet(sheetSave)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := sheet.WriteCSV(&buf); err != nil {
+		t.Fatalf("WriteCSV failed: %v", err)
+	}
+	want := "Item,Cost:paid,\n" +
+		"<b>Rent</b>,1200.50,\n" +
+		"\"Total\nincl. VAT\",1200.5,5\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestWriteCSVFormulaText(t *testing.T) {
+	sheet := NewSheet()
+	for coord, value := range map[string]string{
+		"A1": "=HYPERLINK(\"http://example.com\")",
+		"B1": "+1+1",
+		"C1": "-2+3",
+		"D1": "@SUM(A1)",
+		"E1": "\t=1",
+		"F1": "\r=1",
+		"G1": "a=b",
+	} {
+		cell, err := sheet.AssuredCell(coord)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cell.DataType, cell.ValueType, cell.Value = DataText, ValueText, value
+	}
+	cell, _ := sheet.AssuredCell("A2")
+	cell.DataType, cell.ValueType, cell.Value = DataNumber, ValueNumber, "-5"
+	cell, _ = sheet.AssuredCell("B2")
+	cell.DataType, cell.ValueType, cell.Value, cell.Formula = DataFormula, ValueText, "=1", `"="&1`
+
+	var buf bytes.Buffer
+	if err := sheet.WriteCSV(&buf); err != nil {
+		t.Fatalf("WriteCSV failed: %v", err)
+	}
+	want := "\"'=HYPERLINK(\"\"http://example.com\"\")\",'+1+1,'-2+3,'@SUM(A1),'\t=1,\"'\r=1\",a=b\n" +
+		"-5,'=1,,,,,\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestSheetXLSX(t *testing.T) {
+	workbook, err := ParseWorkbook(workbookSave(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	book := workbook.XLSX()
+	if len(book.Sheets) != 2 || book.Sheets[0].Name != "Data" || !book.Sheets[0].Hidden || book.Sheets[1].Hidden {
+		t.Fatalf("unexpected sheets %+v", book.Sheets)
+	}
+
+	costs := book.Sheets[1]
+	if got := costs.Rows[2][1]; got != (xlsx.Cell{Type: xlsx.Number, Value: "1200.5", Formula: "SUM(B1:B2)"}) {
+		t.Errorf("B3 = %+v", got)
+	}
+	if got := costs.Rows[2][2]; got != (xlsx.Cell{Type: xlsx.Number, Value: "5"}) {
+		t.Errorf("C3 = %+v", got)
+	}
+	if got := costs.Rows[0][1]; got != (xlsx.Cell{Type: xlsx.String, Value: "Cost:paid"}) {
+		t.Errorf("B1 = %+v", got)
+	}
+	if costs.Cols[1] != (xlsx.Col{Width: 17.14}) || costs.Cols[3] != (xlsx.Col{Hidden: true}) {
+		t.Errorf("cols = %+v", costs.Cols)
+	}
+
+	sheet := NewSheet()
+	for coord, cell := range map[string]Cell{
+		"A1": {DataType: DataConstant, ValueType: "nd", Value: "45000"},
+		"A2": {DataType: DataConstant, ValueType: "n%", Value: "0.25"},
+		"A3": {DataType: DataFormula, ValueType: "nl", Value: "1", Formula: "TRUE()"},
+		"A4": {DataType: DataFormula, ValueType: "e#REF!", Value: "0", Formula: "Z0"},
+		"A5": {DataType: DataFormula, ValueType: "t", Value: "ok", Formula: `"ok"`},
+	} {
+		cell := cell
+		sheet.Cells[coord] = &cell
+	}
+	rows := sheet.XLSX("Types").Rows
+	for i, want := range []xlsx.Cell{
+		{Type: xlsx.Number, Value: "45000", Format: xlsx.Date},
+		{Type: xlsx.Number, Value: "0.25", Format: xlsx.Percent},
+		{Type: xlsx.Bool, Value: "1", Formula: "TRUE()"},
+		{Type: xlsx.Error, Value: "#REF!", Formula: "Z0"},
+		{Type: xlsx.String, Value: "ok", Formula: `"ok"`},
+	} {
+		if got := rows[i][0]; got != want {
+			t.Errorf("A%d = %+v, want %+v", i+1, got, want)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := book.Write(&buf); err != nil || !strings.HasPrefix(buf.String(), "PK") {
+		t.Errorf("Write failed: %v", err)
+	}
+}
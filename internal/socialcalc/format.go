@@ -0,0 +1,507 @@
+package socialcalc
+
+import (
+	"html"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// defaultFormats are the value formats SocialCalc displays numbers of each
+// subtype with when the cell and sheet set none
+var defaultFormats = map[string]string{
+	"n%":  "#,##0.0%",
+	"n$":  "[$$]#,##0.00",
+	"nd":  "d-mmm-yyyy",
+	"nt":  "[h]:mm:ss",
+	"ndt": "d-mmm-yyyy h:mm:ss",
+	"nl":  "logical",
+}
+
+var (
+	monthNames = []string{"January", "February", "March", "April", "May", "June", "July",
+		"August", "September", "October", "November", "December"}
+	dayNames = []string{"Sunday", "Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday"}
+)
+
+// htmlTag matches the tags of HTML text cells
+var htmlTag = regexp.MustCompile(`<[^>]*>`)
+
+// DisplayText returns the value of a cell as SocialCalc displays it: numbers
+// in their value format, such as "#,##0.00" or "d-mmm-yyyy", and text
+// without markup
+func (s *Sheet) DisplayText(c *Cell) string {
+	if c == nil || c.DataType == "" {
+		return ""
+	}
+	if strings.HasPrefix(c.ValueType, ValueError) {
+		return c.Text()
+	}
+
+	n, isNumber := c.Number()
+	format := c.TextValueFormat
+	if isNumber {
+		format = c.NonTextValueFormat
+		if format == 0 {
+			format = s.Attribs.DefaultNonTextValueFormat
+		}
+	} else if format == 0 {
+		format = s.Attribs.DefaultTextValueFormat
+	}
+	valueFormat := s.ValueFormats[format]
+	switch valueFormat {
+	case "hidden":
+		return ""
+	case "formula":
+		if c.IsFormula() {
+			return "=" + c.Formula
+		}
+	case "forcetext":
+		return c.Value
+	}
+
+	if !isNumber {
+		if valueFormat == "text-html" || valueFormat == "" && c.ValueType == "th" {
+			return html.UnescapeString(htmlTag.ReplaceAllString(c.Value, ""))
+		}
+		return c.Value
+	}
+	if valueFormat == "" || valueFormat == "none" || strings.EqualFold(valueFormat, "general") {
+		valueFormat = defaultFormats[c.ValueType]
+	}
+	return FormatNumber(n, valueFormat)
+}
+
+// maxDateSerial is the serial date number of 31 December 9999, the last
+// day date formats show
+const maxDateSerial = 2958466
+
+// FormatNumber formats a number with a SocialCalc value format: "logical",
+// "General", or a number or date pattern such as "#,##0.00", "0.0%",
+// "0.00E+00", "[$$]#,##0.00;-[$$]#,##0.00" or "d-mmm-yyyy h:mm". General
+// shows up to 15 significant digits, and is used for fractions, the text
+// placeholder "@" and dates out of range, which are not supported.
+func FormatNumber(n float64, format string) string {
+	switch {
+	case format == "logical":
+		if n != 0 {
+			return "TRUE"
+		}
+		return "FALSE"
+	case format == "" || strings.EqualFold(format, "general"):
+		return formatGeneral(n)
+	}
+
+	// Sections are for positive numbers, negative ones and zero; the
+	// negative section shows the number without its sign
+	sections := splitSections(format)
+	section, signed := sections[0], true
+	switch {
+	case len(sections) >= 3 && n == 0:
+		section = sections[2]
+	case len(sections) >= 2 && n < 0:
+		section, n, signed = sections[1], -n, false
+	}
+	tokens := formatTokens(section)
+	for _, t := range tokens {
+		if t.kind == tokenDate {
+			if math.IsNaN(n) || math.Abs(n) >= maxDateSerial {
+				return formatGeneral(n)
+			}
+			return formatDate(n, tokens)
+		}
+	}
+	for i, t := range tokens {
+		switch {
+		case t.kind == tokenText,
+			// A fraction such as "# ?/?"
+			t.kind == tokenLiteral && t.text == "/" && i > 0 && tokens[i-1].kind == tokenDigit:
+			return formatGeneral(n)
+		case t.kind == tokenExponent:
+			return formatScientific(n, signed, tokens[:i], t.text, tokens[i+1:])
+		}
+	}
+	return formatDigits(n, signed, tokens)
+}
+
+func formatGeneral(n float64) string {
+	return strconv.FormatFloat(n, 'g', 15, 64)
+}
+
+// splitSections splits a format at the semicolons outside quotes and
+// brackets
+func splitSections(format string) []string {
+	var sections []string
+	start, quoted, bracket := 0, false, false
+	for i := 0; i < len(format); i++ {
+		switch c := format[i]; {
+		case c == '\\' && !quoted:
+			i++
+		case c == '"':
+			quoted = !quoted
+		case c == '[' && !quoted:
+			bracket = true
+		case c == ']' && !quoted:
+			bracket = false
+		case c == ';' && !quoted && !bracket:
+			sections = append(sections, format[start:i])
+			start = i + 1
+		}
+	}
+	return append(sections, format[start:])
+}
+
+// Kinds of format tokens
+const (
+	tokenLiteral = iota
+	tokenDigit
+	tokenPoint
+	tokenComma
+	tokenPercent
+	tokenDate
+	tokenExponent
+	tokenText
+)
+
+type formatToken struct {
+	kind int
+	// text is the literal text, the placeholder of digits, "E+" or "E-" in
+	// the case of the format, or the date part in lower case, such as
+	// "yyyy", "mm", "[h]" or "am/pm"
+	text string
+}
+
+func formatTokens(section string) []formatToken {
+	var tokens []formatToken
+	literal := func(s string) {
+		tokens = append(tokens, formatToken{tokenLiteral, s})
+	}
+	for i := 0; i < len(section); i++ {
+		c := section[i]
+		lower := c | 0x20
+		switch {
+		case c == '"':
+			end := strings.IndexByte(section[i+1:], '"')
+			if end < 0 {
+				end = len(section) - i - 1
+			}
+			literal(section[i+1 : i+1+end])
+			i += end + 1
+		case c == '\\' || c == '_' || c == '*':
+			// An escaped character; the width of one; one to repeat
+			if i+1 < len(section) {
+				if c == '\\' {
+					literal(section[i+1 : i+2])
+				} else if c == '_' {
+					literal(" ")
+				}
+				i++
+			}
+		case c == '[':
+			end := strings.IndexByte(section[i:], ']')
+			if end < 0 {
+				// An unterminated bracket is shown as it is
+				literal(section[i:])
+				i = len(section)
+				continue
+			}
+			inner := section[i+1 : i+end]
+			i += end
+			switch lowerInner := strings.ToLower(inner); {
+			case strings.HasPrefix(inner, "$"):
+				// A currency symbol, possibly with a locale: [$€-407]
+				symbol, _, _ := strings.Cut(inner[1:], "-")
+				literal(symbol)
+			case strings.Trim(lowerInner, "hms") == "" && lowerInner != "":
+				tokens = append(tokens, formatToken{tokenDate, "[" + lowerInner[:1] + "]"})
+			}
+			// Colors and conditions are not shown
+		case c == '0' || c == '#' || c == '?':
+			tokens = append(tokens, formatToken{tokenDigit, string(c)})
+		case c == '.':
+			tokens = append(tokens, formatToken{tokenPoint, "."})
+		case c == ',':
+			tokens = append(tokens, formatToken{tokenComma, ","})
+		case c == '%':
+			tokens = append(tokens, formatToken{tokenPercent, "%"})
+		case c == '@':
+			tokens = append(tokens, formatToken{tokenText, "@"})
+		case lower == 'e' && i+1 < len(section) && (section[i+1] == '+' || section[i+1] == '-'):
+			tokens = append(tokens, formatToken{tokenExponent, section[i : i+2]})
+			i++
+		case len(section) >= i+5 && strings.EqualFold(section[i:i+5], "am/pm"):
+			tokens = append(tokens, formatToken{tokenDate, section[i : i+5]})
+			i += 4
+		case len(section) >= i+3 && strings.EqualFold(section[i:i+3], "a/p"):
+			tokens = append(tokens, formatToken{tokenDate, section[i : i+3]})
+			i += 2
+		case lower == 'y' || lower == 'm' || lower == 'd' || lower == 'h' || lower == 's':
+			end := i + 1
+			for end < len(section) && section[end]|0x20 == lower {
+				end++
+			}
+			tokens = append(tokens, formatToken{tokenDate, strings.Repeat(string(lower), end-i)})
+			i = end - 1
+		default:
+			literal(string(c))
+		}
+	}
+	return tokens
+}
+
+// formatDigits formats a number with the digit placeholders, point,
+// thousands separator and percent signs of a format, keeping its literals
+// where they are
+func formatDigits(n float64, signed bool, tokens []formatToken) string {
+	intZeros, decimals, minDecimals := 0, 0, 0
+	grouping, afterPoint, hasDigits := false, false, false
+	for i, t := range tokens {
+		switch t.kind {
+		case tokenPercent:
+			n *= 100
+		case tokenPoint:
+			afterPoint = true
+		case tokenComma:
+			// Only a comma between digits groups thousands
+			if !afterPoint && hasDigits && i+1 < len(tokens) && tokens[i+1].kind == tokenDigit {
+				grouping = true
+			}
+		case tokenDigit:
+			hasDigits = true
+			switch {
+			case afterPoint:
+				decimals++
+				if t.text == "0" {
+					minDecimals = decimals
+				}
+			case t.text == "0":
+				intZeros++
+			}
+		}
+	}
+
+	digits := strconv.FormatFloat(math.Abs(n), 'f', decimals, 64)
+	intPart, fraction, _ := strings.Cut(digits, ".")
+	for len(fraction) > minDecimals && strings.HasSuffix(fraction, "0") {
+		fraction = fraction[:len(fraction)-1]
+	}
+	negative := signed && n < 0 && strings.Trim(intPart+fraction, "0") != ""
+	if intPart == "0" && intZeros == 0 {
+		intPart = ""
+	}
+	for len(intPart) < intZeros {
+		intPart = "0" + intPart
+	}
+	if grouping {
+		intPart = groupThousands(intPart)
+	}
+
+	var b strings.Builder
+	if negative {
+		b.WriteByte('-')
+	}
+	wroteInt, wroteFraction := false, false
+	for _, t := range tokens {
+		switch t.kind {
+		case tokenLiteral, tokenPercent:
+			b.WriteString(t.text)
+		case tokenDigit:
+			if !wroteInt {
+				b.WriteString(intPart)
+				wroteInt = true
+			}
+		case tokenPoint:
+			if !wroteInt {
+				b.WriteString(intPart)
+				wroteInt = true
+			}
+			if !wroteFraction {
+				b.WriteString("." + fraction)
+				wroteFraction = true
+			}
+		}
+	}
+	return b.String()
+}
+
+// formatScientific formats a number as a mantissa, formatted with the
+// tokens before the exponent, and an exponent with at least as many digits
+// as the zeros after it. "E+" shows the sign of the exponent and "E-" only
+// a minus. With more than one digit before the point, as in "##0.0E+0",
+// the exponent is a multiple of their number.
+func formatScientific(n float64, signed bool, mantissa []formatToken, e string, exponent []formatToken) string {
+	intDigits, decimals, afterPoint := 0, 0, false
+	for _, t := range mantissa {
+		switch {
+		case t.kind == tokenPoint:
+			afterPoint = true
+		case t.kind == tokenDigit && afterPoint:
+			decimals++
+		case t.kind == tokenDigit:
+			intDigits++
+		}
+	}
+	step := max(intDigits, 1)
+
+	exp := 0
+	abs := math.Abs(n)
+	if abs != 0 && !math.IsInf(abs, 0) && !math.IsNaN(abs) {
+		exp = int(math.Floor(math.Log10(abs)))
+		exp -= ((exp % step) + step) % step
+		// Rounding can carry the mantissa to the next power of step
+		scaled, _ := strconv.ParseFloat(strconv.FormatFloat(abs/math.Pow10(exp), 'f', decimals, 64), 64)
+		if scaled >= math.Pow10(step) {
+			exp += step
+		}
+	}
+	value := abs / math.Pow10(exp)
+	if n < 0 {
+		value = -value
+	}
+
+	var b strings.Builder
+	b.WriteString(formatDigits(value, signed, mantissa))
+	b.WriteByte(e[0])
+	if exp < 0 {
+		b.WriteByte('-')
+	} else if e[1] == '+' {
+		b.WriteByte('+')
+	}
+	zeros := 0
+	for _, t := range exponent {
+		if t.kind == tokenDigit && t.text == "0" {
+			zeros++
+		}
+	}
+	digits := strconv.Itoa(max(exp, -exp))
+	for len(digits) < zeros {
+		digits = "0" + digits
+	}
+	wrote := false
+	for _, t := range exponent {
+		switch t.kind {
+		case tokenDigit:
+			if !wrote {
+				b.WriteString(digits)
+				wrote = true
+			}
+		case tokenLiteral, tokenPercent:
+			b.WriteString(t.text)
+		}
+	}
+	return b.String()
+}
+
+func groupThousands(digits string) string {
+	if len(digits) <= 3 {
+		return digits
+	}
+	var b strings.Builder
+	head := len(digits) % 3
+	if head > 0 {
+		b.WriteString(digits[:head])
+	}
+	for i := head; i < len(digits); i += 3 {
+		if b.Len() > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(digits[i : i+3])
+	}
+	return b.String()
+}
+
+// formatDate formats a serial date number with the date and time parts of
+// a format; "m" and "mm" are minutes after hours or before seconds
+func formatDate(n float64, tokens []formatToken) string {
+	t := SerialTime(n)
+	twelveHour := false
+	for _, token := range tokens {
+		if token.kind == tokenDate && strings.Contains(token.text, "/") {
+			twelveHour = true
+		}
+	}
+	pad := func(v int, width int) string {
+		s := strconv.Itoa(v)
+		for len(s) < width {
+			s = "0" + s
+		}
+		return s
+	}
+
+	var b strings.Builder
+	lastPart := ""
+	for i, token := range tokens {
+		if token.kind != tokenDate {
+			b.WriteString(token.text)
+			continue
+		}
+		part := token.text
+		if part == "m" || part == "mm" {
+			minutes := strings.HasPrefix(lastPart, "h") || lastPart == "[h]"
+			for _, next := range tokens[i+1:] {
+				if next.kind == tokenDate {
+					minutes = minutes || strings.HasPrefix(next.text, "s")
+					break
+				}
+			}
+			if minutes {
+				part = "min" + part
+			}
+		}
+		lastPart = part
+
+		switch part {
+		case "yy", "y":
+			b.WriteString(pad(t.Year()%100, 2))
+		case "yyy", "yyyy":
+			b.WriteString(pad(t.Year(), 4))
+		case "m", "mm":
+			b.WriteString(pad(int(t.Month()), len(part)))
+		case "mmm":
+			b.WriteString(monthNames[t.Month()-1][:3])
+		case "mmmmm":
+			b.WriteString(monthNames[t.Month()-1][:1])
+		case "d", "dd":
+			b.WriteString(pad(t.Day(), len(part)))
+		case "ddd":
+			b.WriteString(dayNames[t.Weekday()][:3])
+		case "h", "hh":
+			hour := t.Hour()
+			if twelveHour {
+				hour = (hour+11)%12 + 1
+			}
+			b.WriteString(pad(hour, len(part)))
+		case "minm", "minmm":
+			b.WriteString(pad(t.Minute(), len(part)-3))
+		case "s", "ss":
+			b.WriteString(pad(t.Second(), len(part)))
+		case "[h]":
+			b.WriteString(strconv.Itoa(int(math.Floor(n * 24))))
+		case "[m]":
+			b.WriteString(strconv.Itoa(int(math.Floor(n * 1440))))
+		case "[s]":
+			b.WriteString(strconv.Itoa(int(math.Floor(n*86400 + 0.5))))
+		default:
+			switch {
+			case strings.HasPrefix(part, "mmmm"):
+				b.WriteString(monthNames[t.Month()-1])
+			case strings.HasPrefix(part, "dddd"):
+				b.WriteString(dayNames[t.Weekday()])
+			case strings.Contains(part, "/"):
+				writeMeridiem(&b, part, t.Hour() >= 12)
+			}
+		}
+	}
+	return b.String()
+}
+
+// writeMeridiem writes AM or PM in the case and length of the format's
+// "AM/PM" or "A/P"
+func writeMeridiem(b *strings.Builder, part string, pm bool) {
+	am, p, _ := strings.Cut(part, "/")
+	if pm {
+		am = p
+	}
+	b.WriteString(am)
+}
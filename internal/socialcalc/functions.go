@@ -0,0 +1,27 @@
+package socialcalc
+
+// Functions are the functions of the SocialCalc formula language, as listed
+// in SocialCalc.Formula.FunctionList
+var Functions = map[string]bool{
+	"ABS": true, "ACOS": true, "AND": true, "ASIN": true, "ATAN": true, "ATAN2": true,
+	"AVERAGE": true, "CHOOSE": true, "COLUMNS": true, "COS": true, "COUNT": true,
+	"COUNTA": true, "COUNTBLANK": true, "COUNTIF": true, "DATE": true, "DAVERAGE": true,
+	"DAY": true, "DCOUNT": true, "DCOUNTA": true, "DDB": true, "DEGREES": true,
+	"DGET": true, "DMAX": true, "DMIN": true, "DPRODUCT": true, "DSTDEV": true,
+	"DSTDEVP": true, "DSUM": true, "DVAR": true, "DVARP": true, "EVEN": true,
+	"EXACT": true, "EXP": true, "FACT": true, "FALSE": true, "FIND": true, "FV": true,
+	"HLOOKUP": true, "HOUR": true, "IF": true, "INDEX": true, "INT": true, "IRR": true,
+	"ISBLANK": true, "ISERR": true, "ISERROR": true, "ISLOGICAL": true, "ISNA": true,
+	"ISNONTEXT": true, "ISNUMBER": true, "ISTEXT": true, "LEFT": true, "LEN": true,
+	"LN": true, "LOG": true, "LOG10": true, "LOWER": true, "MATCH": true, "MAX": true,
+	"MID": true, "MIN": true, "MINUTE": true, "MOD": true, "MONTH": true, "N": true,
+	"NA": true, "NOT": true, "NOW": true, "NPER": true, "NPV": true, "ODD": true,
+	"OR": true, "PI": true, "PMT": true, "POWER": true, "PRODUCT": true, "PROPER": true,
+	"PV": true, "RADIANS": true, "RATE": true, "REPLACE": true, "REPT": true,
+	"RIGHT": true, "ROUND": true, "ROWS": true, "SECOND": true, "SIN": true, "SLN": true,
+	"SQRT": true, "STDEV": true, "STDEVP": true, "SUBSTITUTE": true, "SUM": true,
+	"SUMIF": true, "SUMPRODUCT": true, "SYD": true, "T": true, "TAN": true, "TIME": true,
+	"TODAY": true, "TRIM": true, "TRUE": true, "TRUNC": true, "UPPER": true,
+	"VALUE": true, "VAR": true, "VARP": true, "VLOOKUP": true, "WEEKDAY": true,
+	"YEAR": true,
+}
@@ -0,0 +1,473 @@
+package socialcalc
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/c4gt/tornado-nginx-go-backend/internal/xlsx"
+)
+
+var (
+	plainNumber     = regexp.MustCompile(`^[-+]?(\d+\.?\d*|\.\d+)([eE][-+]?\d+)?$`)
+	groupedNumber   = regexp.MustCompile(`^[-+]?\d{1,3}(,\d{3})+(\.\d*)?$`)
+	percentNumber   = regexp.MustCompile(`^[-+]?(\d+\.?\d*|\.\d+)%$`)
+	currencyNumber  = regexp.MustCompile(`^[-+]?\$(\d{1,3}(,\d{3})+|\d+)(\.\d*)?$`)
+	csvDateLayouts  = []string{"2006-01-02"}
+	csvDateTimes    = []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02T15:04:05", "2006-01-02T15:04"}
+	csvTimeLayouts  = []string{"15:04:05", "15:04"}
+	csvDelimiters   = []rune{',', ';', '\t'}
+	utf8ByteOrderMk = []byte("\xef\xbb\xbf")
+)
+
+// ReadCSV reads CSV into a sheet. The delimiter, a comma, semicolon or
+// tab, is the one the first line uses most. Numbers, percentages, amounts
+// in dollars, ISO 8601 dates and times, and TRUE and FALSE are typed the
+// way SocialCalc types them when entered; everything else is text.
+func ReadCSV(r io.Reader) (*Sheet, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimPrefix(data, utf8ByteOrderMk)
+
+	in := csv.NewReader(bytes.NewReader(data))
+	in.Comma = sniffDelimiter(data)
+	in.FieldsPerRecord = -1
+	in.LazyQuotes = true
+
+	sheet := NewSheet()
+	// Blank lines are skipped by the reader but are empty rows of the sheet,
+	// so rows follow the lines records start on
+	row, lastLine := 0, 0
+	for {
+		record, err := in.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := in.FieldPos(0)
+		row += line - lastLine
+		lastLine, _ = in.FieldPos(len(record) - 1)
+		lastLine += strings.Count(record[len(record)-1], "\n")
+		if row > MaxRow {
+			return nil, fmt.Errorf("more than %d rows", MaxRow)
+		}
+		if len(record) > MaxCol {
+			return nil, fmt.Errorf("row %d has more than %d columns", row, MaxCol)
+		}
+		for i, field := range record {
+			typed := InputCell(field)
+			if typed == nil {
+				continue
+			}
+			cell, err := sheet.AssuredCell(Coord(i+1, row))
+			if err != nil {
+				return nil, err
+			}
+			cell.DataType, cell.ValueType, cell.Value, cell.Formula = typed.DataType, typed.ValueType, typed.Value, typed.Formula
+		}
+	}
+	return sheet, nil
+}
+
+// sniffDelimiter returns the delimiter used most on the first line
+func sniffDelimiter(data []byte) rune {
+	line := data
+	if end := bytes.IndexByte(data, '\n'); end >= 0 {
+		line = data[:end]
+	}
+	best, count := ',', 0
+	for _, delimiter := range csvDelimiters {
+		if n := bytes.Count(line, []byte(string(delimiter))); n > count {
+			best, count = delimiter, n
+		}
+	}
+	return best
+}
+
+// InputCell types text the way SocialCalc types what is entered in a cell:
+// numbers, percentages, amounts, logical values and ISO dates and times
+// become constants, anything else text. It returns nil for empty text.
+func InputCell(field string) *Cell {
+	if field == "" {
+		return nil
+	}
+	text := strings.TrimSpace(field)
+	constant := func(valueType string, n float64) *Cell {
+		return &Cell{DataType: DataConstant, ValueType: valueType, Value: strconv.FormatFloat(n, 'f', -1, 64), Formula: text}
+	}
+
+	switch {
+	case plainNumber.MatchString(text):
+		n, err := strconv.ParseFloat(text, 64)
+		if err == nil && !math.IsInf(n, 0) {
+			return &Cell{DataType: DataNumber, ValueType: ValueNumber, Value: strings.TrimPrefix(text, "+")}
+		}
+	case groupedNumber.MatchString(text):
+		if n, err := strconv.ParseFloat(strings.ReplaceAll(text, ",", ""), 64); err == nil {
+			return constant(ValueNumber, n)
+		}
+	case percentNumber.MatchString(text):
+		if n, err := strconv.ParseFloat(strings.TrimSuffix(text, "%"), 64); err == nil {
+			return constant("n%", n/100)
+		}
+	case currencyNumber.MatchString(text):
+		plain := strings.NewReplacer("$", "", ",", "").Replace(text)
+		if n, err := strconv.ParseFloat(plain, 64); err == nil {
+			return constant("n$", n)
+		}
+	case strings.EqualFold(text, "TRUE"):
+		return constant("nl", 1)
+	case strings.EqualFold(text, "FALSE"):
+		return constant("nl", 0)
+	}
+
+	for _, layouts := range []struct {
+		valueType string
+		layouts   []string
+	}{
+		{"nd", csvDateLayouts},
+		{"ndt", csvDateTimes},
+		{"nt", csvTimeLayouts},
+	} {
+		for _, layout := range layouts.layouts {
+			t, err := time.Parse(layout, text)
+			if err != nil {
+				continue
+			}
+			if layouts.valueType == "nt" {
+				return constant("nt", float64(t.Hour()*3600+t.Minute()*60+t.Second())/86400)
+			}
+			return constant(layouts.valueType, Serial(t))
+		}
+	}
+	return &Cell{DataType: DataText, ValueType: ValueText, Value: field}
+}
+
+// FromXLSX converts a workbook read by xlsx.Read. Formulas SocialCalc
+// cannot evaluate are kept as their last computed value; these, cells past
+// the last column or row SocialCalc has, and the features xlsx.Read left
+// out are returned as notes for the user.
+func FromXLSX(book *xlsx.Workbook) (*Workbook, []string) {
+	notes := append([]string(nil), book.Unsupported...)
+	sheetNames := make(map[string]bool)
+	for _, sheet := range book.Sheets {
+		sheetNames[strings.ToUpper(sheet.Name)] = true
+	}
+
+	workbook := &Workbook{JSON: len(book.Sheets) > 1, NumSheets: len(book.Sheets)}
+	for i, source := range book.Sheets {
+		sheet, sheetNotes := fromXLSXSheet(source, sheetNames)
+		notes = append(notes, sheetNotes...)
+		workbook.Sheets = append(workbook.Sheets, &WorkbookSheet{
+			ID:     "sheet" + strconv.Itoa(i+1),
+			Name:   source.Name,
+			Hidden: source.Hidden,
+			Doc:    &Document{Sheet: sheet},
+		})
+	}
+	for _, sheet := range workbook.Sheets {
+		if !sheet.Hidden {
+			workbook.CurrentID, workbook.CurrentName = sheet.ID, sheet.Name
+			break
+		}
+	}
+	if workbook.CurrentID == "" {
+		workbook.Sheets[0].Hidden = false
+		workbook.CurrentID, workbook.CurrentName = workbook.Sheets[0].ID, workbook.Sheets[0].Name
+	}
+	return workbook, notes
+}
+
+// cellNotes gathers the cells a note applies to, so a note is given once
+// per sheet and reason
+type cellNotes map[string][]string
+
+func (n cellNotes) add(reason, coord string) {
+	n[reason] = append(n[reason], coord)
+}
+
+func (n cellNotes) list(sheet string) []string {
+	reasons := make([]string, 0, len(n))
+	for reason := range n {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+
+	var notes []string
+	for _, reason := range reasons {
+		cells := n[reason]
+		shown := cells
+		if len(shown) > 5 {
+			shown = shown[:5]
+		}
+		note := fmt.Sprintf("%s: %s (%s", sheet, reason, strings.Join(shown, ", "))
+		if more := len(cells) - len(shown); more > 0 {
+			note += fmt.Sprintf(" and %d more", more)
+		}
+		notes = append(notes, note+")")
+	}
+	return notes
+}
+
+func fromXLSXSheet(source *xlsx.Sheet, sheetNames map[string]bool) (*Sheet, []string) {
+	sheet := NewSheet()
+	notes := make(cellNotes)
+	var outside int
+
+	for r, row := range source.Rows {
+		for c, x := range row {
+			if x.Type == xlsx.Empty && x.Formula == "" {
+				continue
+			}
+			if c+1 > MaxCol || r+1 > MaxRow {
+				outside++
+				continue
+			}
+			coord := Coord(c+1, r+1)
+			cell, _ := sheet.AssuredCell(coord)
+			importCell(cell, x, sheet)
+
+			if x.Formula == "" {
+				continue
+			}
+			formula, err := importFormula(x.Formula, sheetNames)
+			if err != nil {
+				notes.add("formulas kept as their values, "+err.Error(), coord)
+				if cell.ValueType == ValueBlank {
+					delete(sheet.Cells, coord)
+					continue
+				}
+				cell.DataType = DataNumber
+				if !strings.HasPrefix(cell.ValueType, ValueNumber) {
+					cell.DataType = DataText
+					if strings.HasPrefix(cell.ValueType, ValueError) {
+						cell.ValueType = ValueText
+					}
+				}
+				continue
+			}
+			cell.DataType, cell.Formula = DataFormula, formula
+			if cell.ValueType == ValueBlank {
+				sheet.Attribs.NeedsRecalc = "yes"
+			}
+		}
+	}
+
+	for _, ref := range source.Merged {
+		from, to, _ := strings.Cut(ref, ":")
+		col, row, err := ParseCoord(from)
+		lastCol, lastRow, err2 := ParseCoord(to)
+		if err != nil || err2 != nil || lastCol < col || lastRow < row {
+			continue
+		}
+		cell, _ := sheet.AssuredCell(Coord(col, row))
+		if lastCol > col {
+			cell.ColSpan = lastCol - col + 1
+		}
+		if lastRow > row {
+			cell.RowSpan = lastRow - row + 1
+		}
+	}
+
+	for col, attribs := range source.Cols {
+		if col > MaxCol {
+			continue
+		}
+		// Excel widths are in characters of about 7 pixels
+		converted := &ColAttribs{}
+		if attribs.Width > 0 {
+			converted.Width = strconv.Itoa(int(math.Round(attribs.Width * 7)))
+		}
+		if attribs.Hidden {
+			converted.Hide = "yes"
+		}
+		sheet.Cols[col] = converted
+	}
+
+	result := notes.list(source.Name)
+	if outside > 0 {
+		result = append(result, fmt.Sprintf("%s: %d cells past column %s or row %d left out", source.Name, outside, ColName(MaxCol), MaxRow))
+	}
+	return sheet, result
+}
+
+// importCell sets the value and number format of a cell from x
+func importCell(cell *Cell, x xlsx.Cell, sheet *Sheet) {
+	switch x.Type {
+	case xlsx.Number:
+		cell.DataType, cell.Value = DataNumber, x.Value
+		cell.ValueType = ValueNumber + map[xlsx.Format]string{
+			xlsx.Date: "d", xlsx.DateTime: "dt", xlsx.Time: "t", xlsx.Percent: "%",
+		}[x.Format]
+	case xlsx.Bool:
+		cell.DataType, cell.ValueType, cell.Value = DataNumber, "nl", x.Value
+	case xlsx.Error:
+		cell.DataType, cell.ValueType, cell.Value = DataText, ValueError+x.Value, x.Value
+	case xlsx.String:
+		cell.DataType, cell.ValueType, cell.Value = DataText, ValueText, x.Value
+	default:
+		cell.DataType, cell.ValueType, cell.Value = DataFormula, ValueBlank, ""
+	}
+	if x.NumFmt != "" && x.NumFmt != "General" && x.NumFmt != "@" && x.Type == xlsx.Number {
+		cell.NonTextValueFormat = sheet.ValueFormats.Add(x.NumFmt)
+	}
+}
+
+var (
+	formulaCellRef  = regexp.MustCompile(`^\$?([A-Za-z]{1,3})\$?[0-9]+$`)
+	formulaColRef   = regexp.MustCompile(`^\$?[A-Za-z]{1,3}$`)
+	formulaSheetRef = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.]*$`)
+)
+
+// importFormula converts an Excel formula to SocialCalc's formula language,
+// or says why it cannot be
+func importFormula(formula string, sheetNames map[string]bool) (string, error) {
+	f := strings.TrimPrefix(formula, "=")
+	var b strings.Builder
+	for i := 0; i < len(f); {
+		ch := f[i]
+		switch {
+		case ch == '"':
+			end := quotedEnd(f, i)
+			b.WriteString(f[i:end])
+			i = end
+		case ch == '\'':
+			end := quotedEnd(f, i)
+			name := strings.ReplaceAll(f[i+1:end-1], "''", "'")
+			if end >= len(f) || f[end] != '!' {
+				return "", fmt.Errorf("unexpected quote")
+			}
+			if !formulaSheetRef.MatchString(name) {
+				return "", fmt.Errorf("sheet name %q is not supported in references", name)
+			}
+			if !sheetNames[strings.ToUpper(name)] {
+				return "", fmt.Errorf("reference to sheet %q outside the workbook", name)
+			}
+			b.WriteString(name)
+			i = end
+		case ch == '[':
+			return "", fmt.Errorf("table and external references are not supported")
+		case ch == '{':
+			return "", fmt.Errorf("array constants are not supported")
+		case ch == '#':
+			return "", fmt.Errorf("error values in formulas are not supported")
+		case ch == '@':
+			return "", fmt.Errorf("implicit intersection is not supported")
+		case ch >= '0' && ch <= '9' || ch == '.':
+			end := i
+			for end < len(f) && (f[end] >= '0' && f[end] <= '9' || f[end] == '.') {
+				end++
+			}
+			if end < len(f) && f[end] == ':' && end+1 < len(f) && (f[end+1] == '$' || f[end+1] >= '0' && f[end+1] <= '9') {
+				return "", fmt.Errorf("whole row references are not supported")
+			}
+			// Exponents keep their sign and digits
+			if end < len(f) && (f[end] == 'e' || f[end] == 'E') {
+				end++
+				if end < len(f) && (f[end] == '+' || f[end] == '-') {
+					end++
+				}
+				for end < len(f) && f[end] >= '0' && f[end] <= '9' {
+					end++
+				}
+			}
+			b.WriteString(f[i:end])
+			i = end
+		case ch == '$' || ch == '_' || ch >= 'A' && ch <= 'Z' || ch >= 'a' && ch <= 'z':
+			end := i
+			for end < len(f) && isFormulaNameChar(f[end]) {
+				end++
+			}
+			name := f[i:end]
+			next := byte(0)
+			if end < len(f) {
+				next = f[end]
+			}
+			if next == ':' {
+				following := nextName(f, end+1)
+				after := end + 1 + len(following)
+				if following != "" && after < len(f) && f[after] == '!' {
+					return "", fmt.Errorf("references to several sheets are not supported")
+				}
+				if formulaColRef.MatchString(name) && formulaColRef.MatchString(following) {
+					return "", fmt.Errorf("whole column references are not supported")
+				}
+			}
+			switch {
+			case next == '[':
+				return "", fmt.Errorf("table and external references are not supported")
+			case next == '(':
+				function := strings.ToUpper(name)
+				function = strings.TrimPrefix(strings.TrimPrefix(function, "_XLFN."), "_XLWS.")
+				if !Functions[function] {
+					return "", fmt.Errorf("function %s is not supported", function)
+				}
+				b.WriteString(function)
+			case next == '!':
+				if !formulaSheetRef.MatchString(name) || !sheetNames[strings.ToUpper(name)] {
+					return "", fmt.Errorf("reference to sheet %q outside the workbook", name)
+				}
+				b.WriteString(name)
+			case formulaCellRef.MatchString(name):
+				if _, _, err := ParseCoord(name); err != nil {
+					return "", fmt.Errorf("references past column %s are not supported", ColName(MaxCol))
+				}
+				b.WriteString(name)
+			case strings.EqualFold(name, "TRUE") || strings.EqualFold(name, "FALSE"):
+				b.WriteString(strings.ToUpper(name) + "()")
+			default:
+				return "", fmt.Errorf("name %s is not supported", name)
+			}
+			i = end
+		default:
+			b.WriteByte(ch)
+			i++
+		}
+	}
+	return b.String(), nil
+}
+
+// quotedEnd returns the end of the quoted text starting at i, where a
+// doubled quote stands for the quote itself
+func quotedEnd(f string, i int) int {
+	quote := f[i]
+	for end := i + 1; end < len(f); end++ {
+		if f[end] != quote {
+			continue
+		}
+		if end+1 < len(f) && f[end+1] == quote {
+			end++
+			continue
+		}
+		return end + 1
+	}
+	return len(f)
+}
+
+// nextName returns the name starting at i
+func nextName(f string, i int) string {
+	end := i
+	for end < len(f) && isFormulaNameChar(f[end]) {
+		end++
+	}
+	return f[i:end]
+}
+
+func isFormulaNameChar(ch byte) bool {
+	return ch == '$' || ch == '_' || ch == '.' || isDigit(ch) || ch >= 'A' && ch <= 'Z' || ch >= 'a' && ch <= 'z'
+}
+
+func isDigit(ch byte) bool {
+	return ch >= '0' && ch <= '9'
+}
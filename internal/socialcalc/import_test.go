@@ -0,0 +1,155 @@
+package socialcalc
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/c4gt/tornado-nginx-go-backend/internal/xlsx"
+)
+
+func TestReadCSV(t *testing.T) {
+	csv := "\xef\xbb\xbfItem;Amount;Share;When\n" +
+		"Rent;1200.50;12.5%;2023-03-15\n" +
+		"\"Fees; misc\";\"1,234.5\";TRUE;09:30\n" +
+		"Paid;$5.00;;2023-03-15 18:00\n" +
+		"\n" +
+		"  padded ;+7;=A1;.5\n"
+	sheet, err := ReadCSV(strings.NewReader(csv))
+	if err != nil {
+		t.Fatalf("ReadCSV failed: %v", err)
+	}
+
+	for coord, want := range map[string]Cell{
+		"A1": {DataType: DataText, ValueType: ValueText, Value: "Item"},
+		"B2": {DataType: DataNumber, ValueType: ValueNumber, Value: "1200.50"},
+		"C2": {DataType: DataConstant, ValueType: "n%", Value: "0.125", Formula: "12.5%"},
+		"D2": {DataType: DataConstant, ValueType: "nd", Value: "45000", Formula: "2023-03-15"},
+		"A3": {DataType: DataText, ValueType: ValueText, Value: "Fees; misc"},
+		"B3": {DataType: DataConstant, ValueType: ValueNumber, Value: "1234.5", Formula: "1,234.5"},
+		"C3": {DataType: DataConstant, ValueType: "nl", Value: "1", Formula: "TRUE"},
+		"D3": {DataType: DataConstant, ValueType: "nt", Value: "0.3958333333333333", Formula: "09:30"},
+		"B4": {DataType: DataConstant, ValueType: "n$", Value: "5", Formula: "$5.00"},
+		"D4": {DataType: DataConstant, ValueType: "ndt", Value: "45000.75", Formula: "2023-03-15 18:00"},
+		"A6": {DataType: DataText, ValueType: ValueText, Value: "  padded "},
+		"B6": {DataType: DataNumber, ValueType: ValueNumber, Value: "7"},
+		"C6": {DataType: DataText, ValueType: ValueText, Value: "=A1"},
+		"D6": {DataType: DataNumber, ValueType: ValueNumber, Value: ".5"},
+	} {
+		got := sheet.Cell(coord)
+		if got == nil {
+			t.Errorf("%s is empty", coord)
+			continue
+		}
+		got.Coord = ""
+		if *got != want {
+			t.Errorf("%s = %+v, want %+v", coord, *got, want)
+		}
+	}
+	if sheet.Cell("C4") != nil || sheet.Attribs.LastCol != 4 || sheet.Attribs.LastRow != 6 {
+		t.Errorf("unexpected sheet bounds %+v", sheet.Attribs)
+	}
+
+	if _, err := ParseSheet(sheet.String()); err != nil {
+		t.Errorf("imported sheet does not parse: %v", err)
+	}
+
+	tabs, err := ReadCSV(strings.NewReader("a\tb,c\td\n"))
+	if err != nil || tabs.Cell("B1").Value != "b,c" {
+		t.Errorf("tab separated values not read: %v", err)
+	}
+}
+
+func TestImportFormula(t *testing.T) {
+	sheets := map[string]bool{"DATA": true, "MY SHEET": true}
+	for _, test := range []struct {
+		formula, want, err string
+	}{
+		{"SUM(A1:B2)*2", "SUM(A1:B2)*2", ""},
+		{`=IF($A$1>=1.5E+3,"a:b","x""y")&C1`, `IF($A$1>=1.5E+3,"a:b","x""y")&C1`, ""},
+		{"Data!A1+'Data'!B2", "Data!A1+Data!B2", ""},
+		{"_xlfn.STDEV(A1:A3)", "STDEV(A1:A3)", ""},
+		{"IF(TRUE,1,0)", "IF(TRUE(),1,0)", ""},
+		{"XLOOKUP(1,A:A,B:B)", "", "function XLOOKUP is not supported"},
+		{"SUM(A:A)", "", "whole column references are not supported"},
+		{"SUM(1:1)", "", "whole row references are not supported"},
+		{"SUM(Data:Other!A1)", "", "references to several sheets are not supported"},
+		{"'My Sheet'!A1", "", `sheet name "My Sheet" is not supported in references`},
+		{"Other!A1", "", `reference to sheet "Other" outside the workbook`},
+		{"Table1[Amount]", "", "table and external references are not supported"},
+		{"SUM({1,2})", "", "array constants are not supported"},
+		{"Rate*2", "", "name Rate is not supported"},
+		{"AAA1+1", "", "references past column ZZ are not supported"},
+		{"IFERROR(A1,#N/A)", "", "function IFERROR is not supported"},
+	} {
+		got, err := importFormula(test.formula, sheets)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("importFormula(%q) = %q, %v, want error %q", test.formula, got, err, test.err)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("importFormula(%q) = %q, %v, want %q", test.formula, got, err, test.want)
+		}
+	}
+}
+
+func TestFromXLSX(t *testing.T) {
+	data := &xlsx.Sheet{Name: "Data", Cols: map[int]xlsx.Col{1: {Width: 20}, 2: {Hidden: true}}, Merged: []string{"A5:B6"}}
+	data.Set(1, 1, xlsx.Cell{Type: xlsx.String, Value: "Rent"})
+	data.Set(1, 2, xlsx.Cell{Type: xlsx.Number, Value: "1200.5", NumFmt: "#,##0.00"})
+	data.Set(2, 1, xlsx.Cell{Type: xlsx.Number, Value: "45000", Format: xlsx.Date, NumFmt: "m/d/yyyy"})
+	data.Set(2, 2, xlsx.Cell{Type: xlsx.Number, Value: "2401", Formula: "B1*2"})
+	data.Set(3, 1, xlsx.Cell{Type: xlsx.Number, Value: "7", Formula: "XLOOKUP(1,A1:A2,B1:B2)"})
+	data.Set(3, 2, xlsx.Cell{Type: xlsx.Error, Value: "#DIV/0!", Formula: "1/0"})
+	data.Set(4, 1, xlsx.Cell{Type: xlsx.Bool, Value: "1"})
+	data.Set(4, 2, xlsx.Cell{Formula: "Notes!A1"})
+	data.Set(4, 800, xlsx.Cell{Type: xlsx.Number, Value: "1"})
+	notes := &xlsx.Sheet{Name: "Notes", Hidden: true}
+	notes.Set(1, 1, xlsx.Cell{Type: xlsx.String, Value: "x", Formula: "LAMBDA(1)"})
+
+	workbook, unsupported := FromXLSX(&xlsx.Workbook{Sheets: []*xlsx.Sheet{notes, data}, Unsupported: []string{"Data: charts and images"}})
+	if !workbook.JSON || len(workbook.Sheets) != 2 || workbook.CurrentName != "Data" || !workbook.Sheets[0].Hidden {
+		t.Fatalf("unexpected workbook %+v", workbook)
+	}
+	wantNotes := []string{
+		"Data: charts and images",
+		"Notes: formulas kept as their values, function LAMBDA is not supported (A1)",
+		"Data: formulas kept as their values, function XLOOKUP is not supported (A3)",
+		"Data: 1 cells past column ZZ or row 1048576 left out",
+	}
+	if strings.Join(unsupported, "\n") != strings.Join(wantNotes, "\n") {
+		t.Errorf("notes = %q, want %q", unsupported, wantNotes)
+	}
+
+	save, err := workbook.String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseWorkbook(save)
+	if err != nil {
+		t.Fatalf("imported workbook does not parse: %v", err)
+	}
+	sheet := parsed.Sheet("Data").Doc.Sheet
+	want := "version:1.5\n" +
+		"cell:A1:t:Rent\n" +
+		"cell:B1:v:1200.5:ntvf:1\n" +
+		"cell:A2:vt:nd:45000:ntvf:2\n" +
+		"cell:B2:vtf:n:2401:B1*2\n" +
+		"cell:A3:v:7\n" +
+		"cell:B3:vtf:e#DIV/0!:#DIV/0!:1/0\n" +
+		"cell:A4:vt:nl:1\n" +
+		"cell:B4:vtf:b::Notes!A1\n" +
+		"cell:A5:colspan:2:rowspan:2\n" +
+		"col:A:w:140\n" +
+		"col:B:hide:yes\n" +
+		"sheet:c:2:r:5:needsrecalc:yes\n" +
+		"valueformat:1:#,##0.00\n" +
+		"valueformat:2:m/d/yyyy\n"
+	if got := sheet.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+	if got := parsed.Sheet("Notes").Doc.Sheet.Cell("A1"); got.DataType != DataText || got.Value != "x" {
+		t.Errorf("Notes!A1 = %+v", got)
+	}
+}
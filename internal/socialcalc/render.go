@@ -0,0 +1,207 @@
+package socialcalc
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/c4gt/tornado-nginx-go-backend/internal/render"
+)
+
+// Defaults of SocialCalc for what sheets and cells leave unset, in pixels
+const (
+	defaultColWidth  = 80
+	defaultRowHeight = 20
+	defaultFont      = "normal normal small Verdana,Arial,Helvetica,sans-serif"
+	defaultLayout    = "padding:2px 2px 1px 2px;vertical-align:top;"
+)
+
+// Table converts the sheet, from A1 to its last cell with a value or a
+// style, to a table of displayed values for rendering. Hidden rows and
+// columns are left out.
+func (s *Sheet) Table(name string) *render.Table {
+	type placed struct {
+		cell     *Cell
+		col, row int
+	}
+	var cells []placed
+	lastCol, lastRow := 0, 0
+	for coord, cell := range s.Cells {
+		if cell.DataType == "" && !cell.styled() {
+			continue
+		}
+		col, row, err := ParseCoord(coord)
+		if err != nil {
+			continue
+		}
+		cells = append(cells, placed{cell, col, row})
+		lastCol = max(lastCol, col+max(cell.ColSpan, 1)-1)
+		lastRow = max(lastRow, row+max(cell.RowSpan, 1)-1)
+	}
+
+	table := &render.Table{Name: name}
+	// colIndex and rowIndex number the visible columns and rows from 0,
+	// and are -1 for hidden ones
+	colIndex := make([]int, lastCol+2)
+	for col := 1; col <= lastCol; col++ {
+		colIndex[col] = -1
+		if attribs := s.Cols[col]; attribs == nil || attribs.Hide != "yes" {
+			colIndex[col] = len(table.Widths)
+			table.Widths = append(table.Widths, s.colWidth(col))
+		}
+	}
+	rowIndex := make([]int, lastRow+2)
+	for row := 1; row <= lastRow; row++ {
+		rowIndex[row] = -1
+		if attribs := s.Rows[row]; attribs == nil || attribs.Hide != "yes" {
+			rowIndex[row] = len(table.Heights)
+			table.Heights = append(table.Heights, s.rowHeight(row))
+		}
+	}
+
+	// visible counts the visible columns or rows of a span
+	visible := func(index []int, first, span int) int {
+		count := 0
+		for i := first; i < first+max(span, 1); i++ {
+			if index[i] >= 0 {
+				count++
+			}
+		}
+		return count
+	}
+	for _, p := range cells {
+		if colIndex[p.col] < 0 || rowIndex[p.row] < 0 {
+			continue
+		}
+		table.Cells = append(table.Cells, &render.Cell{
+			Row:     rowIndex[p.row],
+			Col:     colIndex[p.col],
+			RowSpan: visible(rowIndex, p.row, p.cell.RowSpan),
+			ColSpan: visible(colIndex, p.col, p.cell.ColSpan),
+			Text:    s.DisplayText(p.cell),
+			Style:   s.cellStyle(p.cell),
+		})
+	}
+	return table
+}
+
+// styled reports whether an empty cell still shows, with a border or a
+// background
+func (c *Cell) styled() bool {
+	return c.Borders != [4]int{} || c.BgColor != 0
+}
+
+func (s *Sheet) colWidth(col int) float64 {
+	if attribs := s.Cols[col]; attribs != nil {
+		if width, err := strconv.ParseFloat(attribs.Width, 64); err == nil && width > 0 {
+			return width
+		}
+	}
+	if width, err := strconv.ParseFloat(s.Attribs.DefaultColWidth, 64); err == nil && width > 0 {
+		return width
+	}
+	return defaultColWidth
+}
+
+func (s *Sheet) rowHeight(row int) float64 {
+	if attribs := s.Rows[row]; attribs != nil && attribs.Height > 0 {
+		return float64(attribs.Height)
+	}
+	if s.Attribs.DefaultRowHeight > 0 {
+		return float64(s.Attribs.DefaultRowHeight)
+	}
+	return defaultRowHeight
+}
+
+// cellStyle resolves the style numbers of a cell, falling back to the
+// sheet defaults and then to SocialCalc's
+func (s *Sheet) cellStyle(c *Cell) render.Style {
+	var style render.Style
+	pick := func(n, def int) int {
+		if n != 0 {
+			return n
+		}
+		return def
+	}
+
+	style.Font = parseFont(s.Fonts[pick(c.Font, s.Attribs.DefaultFont)])
+	style.Color, _ = render.ParseColor(s.Colors[pick(c.Color, s.Attribs.DefaultColor)])
+	style.Background, _ = render.ParseColor(s.Colors[pick(c.BgColor, s.Attribs.DefaultBgColor)])
+	for i, n := range c.Borders {
+		if n != 0 {
+			style.Borders[i] = render.ParseBorder(s.Borders[n])
+		}
+	}
+
+	// Text is aligned left and everything else right, unless the cell or
+	// the sheet says otherwise
+	_, isNumber := c.Number()
+	format := pick(c.CellFormat, s.Attribs.DefaultTextFormat)
+	if isNumber || strings.HasPrefix(c.ValueType, ValueError) {
+		format = pick(c.CellFormat, s.Attribs.DefaultNonTextFormat)
+		style.Align = render.Right
+	}
+	switch s.CellFormats[format] {
+	case "left":
+		style.Align = render.Left
+	case "center":
+		style.Align = render.Center
+	case "right":
+		style.Align = render.Right
+	}
+
+	style.Padding, style.VAlign = parseLayout(s.Layouts[pick(c.Layout, s.Attribs.DefaultLayout)])
+	return style
+}
+
+// parseFont reads a SocialCalc font, "style weight size family", where '*'
+// keeps the default
+func parseFont(spec string) render.Font {
+	defaults := strings.SplitN(defaultFont, " ", 4)
+	parts := strings.SplitN(strings.TrimSpace(spec), " ", 4)
+	for i := range defaults {
+		if i < len(parts) && parts[i] != "*" && parts[i] != "" {
+			defaults[i] = parts[i]
+		}
+	}
+	font := render.Font{
+		Family: defaults[3],
+		Italic: defaults[0] == "italic" || defaults[0] == "oblique",
+		Bold:   defaults[1] == "bold" || defaults[1] == "bolder",
+	}
+	if weight, err := strconv.Atoi(defaults[1]); err == nil {
+		font.Bold = weight >= 600
+	}
+	font.Size, _ = render.ParseFontSize(defaults[2])
+	return font
+}
+
+// parseLayout reads a SocialCalc layout, "padding:top right bottom
+// left;vertical-align:align;", where '*' keeps the default
+func parseLayout(spec string) ([4]float64, render.VAlign) {
+	var padding [4]float64
+	align := "top"
+	for _, layout := range []string{defaultLayout, spec} {
+		for _, declaration := range strings.Split(layout, ";") {
+			property, value, _ := strings.Cut(declaration, ":")
+			switch strings.TrimSpace(property) {
+			case "padding":
+				for i, field := range strings.Fields(value) {
+					if i < 4 && field != "*" {
+						padding[i], _ = render.ParseLength(field)
+					}
+				}
+			case "vertical-align":
+				if value = strings.TrimSpace(value); value != "*" {
+					align = value
+				}
+			}
+		}
+	}
+	switch align {
+	case "middle":
+		return padding, render.Middle
+	case "bottom":
+		return padding, render.Bottom
+	}
+	return padding, render.Top
+}
@@ -0,0 +1,125 @@
+package socialcalc
+
+import (
+	"testing"
+
+	"github.com/c4gt/tornado-nginx-go-backend/internal/render"
+)
+
+func TestFormatNumber(t *testing.T) {
+	for _, test := range []struct {
+		format string
+		n      float64
+		want   string
+	}{
+		{"#,##0.00", 1234.5, "1,234.50"},
+		{"#,##0.00", -1234.5, "-1,234.50"},
+		{"#,##0", 1234567.8, "1,234,568"},
+		{"0.00", -0.001, "0.00"},
+		{"0.0#", 2, "2.0"},
+		{"0.0#", 1.556, "1.56"},
+		{"#.##", 0.5, ".5"},
+		{"000", 7, "007"},
+		{"0.0%", 0.256, "25.6%"},
+		{"[$$]#,##0.00", 5, "$5.00"},
+		{"[$€-407] #,##0", 1234, "€ 1,234"},
+		{"#,##0.00;(#,##0.00)", -5, "(5.00)"},
+		{`0;-0;"zero"`, 0, "zero"},
+		{`[Red]"Total: "0`, 3, "Total: 3"},
+		{"General", 0.1 + 0.2, "0.3"},
+		{"", 1200.5, "1200.5"},
+		{"logical", 1, "TRUE"},
+		{"d-mmm-yyyy", 45000, "15-Mar-2023"},
+		{"yyyy-mm-dd hh:mm:ss", 45000.75, "2023-03-15 18:00:00"},
+		{"dddd, mmmm d", 45000, "Wednesday, March 15"},
+		{"m/d/yy", 45000, "3/15/23"},
+		{"h:mm AM/PM", 0.75, "6:00 PM"},
+		{"[h]:mm:ss", 1.5, "36:00:00"},
+		{"0[", 3, "3["},
+		{"#,##0 [Red", 1234, "1,234 [Red"},
+		{"0.00E+00", 1234.5678, "1.23E+03"},
+		{"0.00E+00", -0.00012345, "-1.23E-04"},
+		{"0.00E+00", 9.999, "1.00E+01"},
+		{"0.00E+00", 0, "0.00E+00"},
+		{"0.0E-0", 1234.5678, "1.2E3"},
+		{"##0.0E+0", 1234.5678, "1.2E+3"},
+		{"##0.0E+0", 12345, "12.3E+3"},
+		{"##0.0E+0", 0.00012, "120.0E-6"},
+		{"# ?/?", 1.5, "1.5"},
+		{"@", 3, "3"},
+		{"[h]:mm", 1e300, "1e+300"},
+		{"d-mmm-yyyy", -3e6, "-3000000"},
+	} {
+		if got := FormatNumber(test.n, test.format); got != test.want {
+			t.Errorf("FormatNumber(%v, %q) = %q, want %q", test.n, test.format, got, test.want)
+		}
+	}
+}
+
+func TestDisplayText(t *testing.T) {
+	sheet, err := ParseSheet(sheetSave)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for coord, want := range map[string]string{
+		"A1": "Item",
+		"A2": "Rent",
+		"B2": "1,200.50",
+		"B3": "1200.5",
+		"C3": "$5.00",
+		"Z9": "",
+	} {
+		if got := sheet.DisplayText(sheet.Cell(coord)); got != want {
+			t.Errorf("%s = %q, want %q", coord, got, want)
+		}
+	}
+
+	sheet.ValueFormats[2] = "hidden"
+	sheet.Cell("B2").NonTextValueFormat = 2
+	if got := sheet.DisplayText(sheet.Cell("B2")); got != "" {
+		t.Errorf("hidden B2 = %q", got)
+	}
+}
+
+func TestTable(t *testing.T) {
+	sheet, err := ParseSheet(sheetSave + "cell:A4:v:1:colspan:3\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := sheet.Table("Costs")
+
+	// Column C is hidden, so C3 is left out and A4 spans A, B and D
+	if got := table.Widths; len(got) != 3 || got[0] != 120 || got[1] != 80 || got[2] != 80 {
+		t.Errorf("widths = %v", got)
+	}
+	if got := table.Heights; len(got) != 4 || got[2] != 24 || got[0] != defaultRowHeight {
+		t.Errorf("heights = %v", got)
+	}
+	cells := make(map[[2]int]*render.Cell)
+	for _, cell := range table.Cells {
+		cells[[2]int{cell.Row, cell.Col}] = cell
+	}
+	if len(cells) != 7 {
+		t.Errorf("%d cells, want 7", len(cells))
+	}
+	if cell := cells[[2]int{3, 0}]; cell == nil || cell.ColSpan != 2 || cell.RowSpan != 1 {
+		t.Errorf("A4 = %+v", cell)
+	}
+
+	a1 := cells[[2]int{0, 0}].Style
+	if !a1.Font.Bold || a1.Font.Size != 13 || a1.Font.Family != "Verdana,Arial,Helvetica,sans-serif" ||
+		a1.Align != render.Left || a1.VAlign != render.Top || a1.Padding != [4]float64{2, 2, 1, 2} {
+		t.Errorf("A1 style = %+v", a1)
+	}
+	b1 := cells[[2]int{0, 1}].Style
+	black := render.Color{Set: true}
+	if b1.Borders[0] != (render.Border{Width: 1, Style: "solid", Color: black}) || b1.Borders[1].Width != 0 {
+		t.Errorf("B1 borders = %+v", b1.Borders)
+	}
+	if b2 := cells[[2]int{1, 1}]; b2.Style.Align != render.Right || b2.Text != "1,200.50" {
+		t.Errorf("B2 = %+v", b2)
+	}
+	if b3 := cells[[2]int{2, 1}].Style; b3.Background != (render.Color{R: 255, G: 255, Set: true}) {
+		t.Errorf("B3 background = %+v", b3.Background)
+	}
+}
@@ -0,0 +1,560 @@
+// Package socialcalc reads and writes the SocialCalc save format used for
+// .msc spreadsheets: the sheet save written by SocialCalc.CreateSheetSave
+// and the multipart save of the spreadsheet control that wraps it.
+package socialcalc
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// SheetVersion is the sheet save version written by String
+const SheetVersion = "1.5"
+
+// Data types of a cell
+const (
+	DataNumber   = "v" // a number
+	DataText     = "t" // text
+	DataFormula  = "f" // a formula and its last computed value
+	DataConstant = "c" // a constant typed with formatting, like "$1.00" or "10%"
+)
+
+// Common value types. Number value types start with 'n' and text value
+// types with 't'; further letters refine them, such as "nd" for dates,
+// "n%" for percentages and "th" for HTML.
+const (
+	ValueNumber = "n"
+	ValueText   = "t"
+	ValueBlank  = "b"
+	ValueError  = "e"
+)
+
+// Cell is one cell of a sheet. Style fields are numbers in the sheet's style
+// tables, with 0 meaning the sheet default.
+type Cell struct {
+	Coord     string
+	DataType  string
+	ValueType string
+	// Value is the data value, or the last computed value of a formula,
+	// exactly as saved
+	Value   string
+	Formula string
+	Errors  string
+
+	// Borders are the top, right, bottom and left border styles
+	Borders            [4]int
+	Layout             int
+	Font               int
+	Color              int
+	BgColor            int
+	CellFormat         int
+	TextValueFormat    int
+	NonTextValueFormat int
+
+	ColSpan  int
+	RowSpan  int
+	CSSClass string
+	CSSStyle string
+	Mod      string
+	Comment  string
+}
+
+// Number returns the value of a cell holding a number
+func (c *Cell) Number() (float64, bool) {
+	if !strings.HasPrefix(c.ValueType, ValueNumber) {
+		return 0, false
+	}
+	n, err := strconv.ParseFloat(c.Value, 64)
+	return n, err == nil
+}
+
+// IsFormula reports whether the cell is computed from a formula
+func (c *Cell) IsFormula() bool {
+	return c.DataType == DataFormula
+}
+
+// ColAttribs are the saved attributes of a column
+type ColAttribs struct {
+	// Width is in pixels, or another width such as "auto" or "10%"
+	Width string
+	Hide  string
+}
+
+// RowAttribs are the saved attributes of a row
+type RowAttribs struct {
+	Height int
+	Hide   string
+}
+
+// SheetAttribs are the sheet-wide settings of the "sheet:" line. The
+// default style fields are numbers in the style tables.
+type SheetAttribs struct {
+	LastCol               int
+	LastRow               int
+	DefaultColWidth       string
+	DefaultRowHeight      int
+	CircularReferenceCell string
+	Recalc                string
+	NeedsRecalc           string
+
+	DefaultTextFormat         int
+	DefaultNonTextFormat      int
+	DefaultTextValueFormat    int
+	DefaultNonTextValueFormat int
+	DefaultColor              int
+	DefaultBgColor            int
+	DefaultFont               int
+	DefaultLayout             int
+
+	// Other holds attributes this package does not know, in order, so
+	// they survive a round trip
+	Other []Attribute
+}
+
+// Attribute is a name and value pair of a save line
+type Attribute struct {
+	Name  string
+	Value string
+}
+
+// Name is a named range or value
+type Name struct {
+	Description string
+	Definition  string
+}
+
+// StyleTable numbers the distinct styles of one kind, such as fonts or
+// colors; cells refer to them by number
+type StyleTable map[int]string
+
+// Add returns the number of a style, adding it when it is not in the table
+func (t StyleTable) Add(style string) int {
+	last := 0
+	for n, existing := range t {
+		if existing == style {
+			return n
+		}
+		if n > last {
+			last = n
+		}
+	}
+	t[last+1] = style
+	return last + 1
+}
+
+// Sheet is a parsed sheet save
+type Sheet struct {
+	Version string
+	// Cells are keyed by their coordinate, such as "A1"
+	Cells   map[string]*Cell
+	Cols    map[int]*ColAttribs
+	Rows    map[int]*RowAttribs
+	Attribs SheetAttribs
+
+	Borders      StyleTable
+	CellFormats  StyleTable
+	Colors       StyleTable
+	Fonts        StyleTable
+	Layouts      StyleTable
+	ValueFormats StyleTable
+
+	// Names are keyed by their upper case name
+	Names map[string]*Name
+	// CopiedFrom is the range clipboard contents were copied from
+	CopiedFrom string
+	// Clipboard holds the obsolete clipboard lines of old saves, which
+	// SocialCalc ignores
+	Clipboard []string
+}
+
+// NewSheet returns an empty sheet
+func NewSheet() *Sheet {
+	return &Sheet{
+		Version:      SheetVersion,
+		Cells:        make(map[string]*Cell),
+		Cols:         make(map[int]*ColAttribs),
+		Rows:         make(map[int]*RowAttribs),
+		Borders:      make(StyleTable),
+		CellFormats:  make(StyleTable),
+		Colors:       make(StyleTable),
+		Fonts:        make(StyleTable),
+		Layouts:      make(StyleTable),
+		ValueFormats: make(StyleTable),
+		Names:        make(map[string]*Name),
+	}
+}
+
+// Cell returns the cell at coord, or nil when it is empty
+func (s *Sheet) Cell(coord string) *Cell {
+	return s.Cells[strings.ToUpper(strings.ReplaceAll(coord, "$", ""))]
+}
+
+// AssuredCell returns the cell at coord, creating it when it is empty
+func (s *Sheet) AssuredCell(coord string) (*Cell, error) {
+	col, row, err := ParseCoord(coord)
+	if err != nil {
+		return nil, err
+	}
+	coord = Coord(col, row)
+	cell := s.Cells[coord]
+	if cell == nil {
+		cell = &Cell{Coord: coord}
+		s.Cells[coord] = cell
+		if col > s.Attribs.LastCol {
+			s.Attribs.LastCol = col
+		}
+		if row > s.Attribs.LastRow {
+			s.Attribs.LastRow = row
+		}
+	}
+	return cell, nil
+}
+
+// SyntaxError reports a line of a save that cannot be read
+type SyntaxError struct {
+	Line int
+	Msg  string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+// layoutLine matches layout lines, whose layouts contain ':' themselves
+var layoutLine = regexp.MustCompile(`^layout:(\d+):(.+)$`)
+
+// ParseSheet parses a sheet save. Unlike SocialCalc it refuses values it
+// would silently misread, such as malformed coordinates and numbers.
+func ParseSheet(data string) (*Sheet, error) {
+	sheet := NewSheet()
+	sheet.Version = ""
+
+	for i, line := range splitLines(data) {
+		if err := sheet.parseLine(line); err != nil {
+			return nil, &SyntaxError{Line: i + 1, Msg: err.Error()}
+		}
+	}
+	return sheet, nil
+}
+
+func splitLines(data string) []string {
+	return strings.Split(strings.ReplaceAll(data, "\r\n", "\n"), "\n")
+}
+
+func (s *Sheet) parseLine(line string) error {
+	parts := strings.Split(line, ":")
+	switch parts[0] {
+	case "":
+		return nil
+	case "version":
+		if len(parts) < 2 {
+			return fmt.Errorf("missing version")
+		}
+		s.Version = parts[1]
+		return nil
+	case "cell":
+		if len(parts) < 2 {
+			return fmt.Errorf("missing cell coordinate")
+		}
+		cell, err := s.AssuredCell(parts[1])
+		if err != nil {
+			return err
+		}
+		return parseCell(cell, parts[2:])
+	case "col":
+		return s.parseCol(parts)
+	case "row":
+		return s.parseRow(parts)
+	case "sheet":
+		return s.parseAttribs(parts[1:])
+	case "name":
+		if len(parts) < 4 {
+			return fmt.Errorf("incomplete name")
+		}
+		s.Names[strings.ToUpper(DecodeValue(parts[1]))] = &Name{
+			Description: DecodeValue(parts[2]),
+			Definition:  DecodeValue(parts[3]),
+		}
+		return nil
+	case "layout":
+		match := layoutLine.FindStringSubmatch(line)
+		if match == nil {
+			return fmt.Errorf("invalid layout")
+		}
+		n, _ := strconv.Atoi(match[1])
+		s.Layouts[n] = match[2]
+		return nil
+	case "border", "cellformat", "color", "font", "valueformat":
+		return s.parseStyle(parts)
+	case "copiedfrom":
+		if len(parts) < 3 {
+			return fmt.Errorf("incomplete copiedfrom range")
+		}
+		s.CopiedFrom = parts[1] + ":" + parts[2]
+		return nil
+	case "clipboard", "clipboardrange":
+		s.Clipboard = append(s.Clipboard, line)
+		return nil
+	}
+	return fmt.Errorf("unknown line type %q", parts[0])
+}
+
+// parseCell reads the type and value pairs of a cell line
+func parseCell(cell *Cell, parts []string) error {
+	value := func(j int) (string, error) {
+		if j >= len(parts) {
+			return "", fmt.Errorf("missing value for %q", parts[j-1])
+		}
+		return parts[j], nil
+	}
+	number := func(j int) (int, error) {
+		v, err := value(j)
+		if err != nil || v == "" {
+			return 0, err
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, fmt.Errorf("invalid number %q for %q", v, parts[j-1])
+		}
+		return n, nil
+	}
+
+	for j := 0; j < len(parts) && parts[j] != ""; {
+		t := parts[j]
+		j++
+		var err error
+		switch t {
+		case "v", "t":
+			var v string
+			if v, err = value(j); err == nil {
+				cell.DataType, cell.ValueType, cell.Value = t, ValueNumber, DecodeValue(v)
+				if t == "t" {
+					cell.ValueType = ValueText
+				}
+				j++
+			}
+		case "vt", "vtf", "vtc":
+			fields := 2
+			if t != "vt" {
+				fields = 3
+			}
+			if j+fields > len(parts) {
+				return fmt.Errorf("missing value for %q", t)
+			}
+			cell.ValueType = parts[j]
+			cell.Value = DecodeValue(parts[j+1])
+			switch {
+			case t == "vtf":
+				cell.DataType, cell.Formula = DataFormula, DecodeValue(parts[j+2])
+			case t == "vtc":
+				cell.DataType, cell.Formula = DataConstant, DecodeValue(parts[j+2])
+			case strings.HasPrefix(cell.ValueType, ValueNumber):
+				cell.DataType = DataNumber
+			default:
+				cell.DataType = DataText
+			}
+			j += fields
+		case "e", "cssc", "csss", "mod", "comment":
+			var v string
+			if v, err = value(j); err == nil {
+				switch t {
+				case "e":
+					cell.Errors = DecodeValue(v)
+				case "cssc":
+					cell.CSSClass = v
+				case "csss":
+					cell.CSSStyle = DecodeValue(v)
+				case "mod":
+					cell.Mod = v
+				case "comment":
+					cell.Comment = DecodeValue(v)
+				}
+				j++
+			}
+		case "b":
+			for side := range cell.Borders {
+				if cell.Borders[side], err = number(j); err != nil {
+					return err
+				}
+				j++
+			}
+		case "l", "f", "c", "bg", "cf", "tvf", "ntvf", "colspan", "rowspan":
+			var n int
+			if n, err = number(j); err == nil {
+				*cellNumberField(cell, t) = n
+				j++
+			}
+		default:
+			return fmt.Errorf("unknown cell attribute %q", t)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if cell.DataType == DataNumber || (cell.DataType != DataText && strings.HasPrefix(cell.ValueType, ValueNumber)) {
+		if _, err := strconv.ParseFloat(cell.Value, 64); err != nil && cell.Value != "" {
+			return fmt.Errorf("invalid number %q in cell %s", cell.Value, cell.Coord)
+		}
+	}
+	return nil
+}
+
+// cellNumberField returns the numeric field saved under a short name
+func cellNumberField(cell *Cell, name string) *int {
+	switch name {
+	case "l":
+		return &cell.Layout
+	case "f":
+		return &cell.Font
+	case "c":
+		return &cell.Color
+	case "bg":
+		return &cell.BgColor
+	case "cf":
+		return &cell.CellFormat
+	case "tvf":
+		return &cell.TextValueFormat
+	case "ntvf":
+		return &cell.NonTextValueFormat
+	case "colspan":
+		return &cell.ColSpan
+	}
+	return &cell.RowSpan
+}
+
+func (s *Sheet) parseCol(parts []string) error {
+	if len(parts) < 2 {
+		return fmt.Errorf("missing column")
+	}
+	col, err := ColNumber(parts[1])
+	if err != nil {
+		return err
+	}
+	attribs := s.Cols[col]
+	if attribs == nil {
+		attribs = &ColAttribs{}
+		s.Cols[col] = attribs
+	}
+	for j := 2; j < len(parts) && parts[j] != ""; j += 2 {
+		if j+1 >= len(parts) {
+			return fmt.Errorf("missing value for %q", parts[j])
+		}
+		switch parts[j] {
+		case "w":
+			attribs.Width = parts[j+1]
+		case "hide":
+			attribs.Hide = parts[j+1]
+		default:
+			return fmt.Errorf("unknown column attribute %q", parts[j])
+		}
+	}
+	return nil
+}
+
+func (s *Sheet) parseRow(parts []string) error {
+	if len(parts) < 2 {
+		return fmt.Errorf("missing row")
+	}
+	row, err := strconv.Atoi(parts[1])
+	if err != nil || row < 1 || row > MaxRow {
+		return fmt.Errorf("invalid row %q", parts[1])
+	}
+	attribs := s.Rows[row]
+	if attribs == nil {
+		attribs = &RowAttribs{}
+		s.Rows[row] = attribs
+	}
+	for j := 2; j < len(parts) && parts[j] != ""; j += 2 {
+		if j+1 >= len(parts) {
+			return fmt.Errorf("missing value for %q", parts[j])
+		}
+		switch parts[j] {
+		case "h":
+			if attribs.Height, err = strconv.Atoi(parts[j+1]); err != nil {
+				return fmt.Errorf("invalid row height %q", parts[j+1])
+			}
+		case "hide":
+			attribs.Hide = parts[j+1]
+		default:
+			return fmt.Errorf("unknown row attribute %q", parts[j])
+		}
+	}
+	return nil
+}
+
+// sheetNumberAttribs are the numeric attributes of the sheet line
+var sheetNumberAttribs = map[string]func(*SheetAttribs) *int{
+	"c":       func(a *SheetAttribs) *int { return &a.LastCol },
+	"r":       func(a *SheetAttribs) *int { return &a.LastRow },
+	"h":       func(a *SheetAttribs) *int { return &a.DefaultRowHeight },
+	"tf":      func(a *SheetAttribs) *int { return &a.DefaultTextFormat },
+	"ntf":     func(a *SheetAttribs) *int { return &a.DefaultNonTextFormat },
+	"tvf":     func(a *SheetAttribs) *int { return &a.DefaultTextValueFormat },
+	"ntvf":    func(a *SheetAttribs) *int { return &a.DefaultNonTextValueFormat },
+	"color":   func(a *SheetAttribs) *int { return &a.DefaultColor },
+	"bgcolor": func(a *SheetAttribs) *int { return &a.DefaultBgColor },
+	"font":    func(a *SheetAttribs) *int { return &a.DefaultFont },
+	"layout":  func(a *SheetAttribs) *int { return &a.DefaultLayout },
+}
+
+func (s *Sheet) parseAttribs(parts []string) error {
+	attribs := &s.Attribs
+	for j := 0; j < len(parts) && parts[j] != ""; j += 2 {
+		name := parts[j]
+		if j+1 >= len(parts) {
+			return fmt.Errorf("missing value for %q", name)
+		}
+		value := parts[j+1]
+
+		if field, ok := sheetNumberAttribs[name]; ok {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid number %q for %q", value, name)
+			}
+			*field(attribs) = n
+			continue
+		}
+		switch name {
+		case "w":
+			attribs.DefaultColWidth = DecodeValue(value)
+		case "circularreferencecell":
+			attribs.CircularReferenceCell = DecodeValue(value)
+		case "recalc":
+			attribs.Recalc = DecodeValue(value)
+		case "needsrecalc":
+			attribs.NeedsRecalc = DecodeValue(value)
+		default:
+			attribs.Other = append(attribs.Other, Attribute{Name: name, Value: value})
+		}
+	}
+	if attribs.LastCol > MaxCol || attribs.LastRow > MaxRow || attribs.LastCol < 0 || attribs.LastRow < 0 {
+		return fmt.Errorf("sheet size %dx%d out of range", attribs.LastCol, attribs.LastRow)
+	}
+	return nil
+}
+
+func (s *Sheet) parseStyle(parts []string) error {
+	if len(parts) < 3 {
+		return fmt.Errorf("incomplete %s", parts[0])
+	}
+	n, err := strconv.Atoi(parts[1])
+	if err != nil || n < 1 {
+		return fmt.Errorf("invalid %s number %q", parts[0], parts[1])
+	}
+	switch parts[0] {
+	case "border":
+		s.Borders[n] = parts[2]
+	case "color":
+		s.Colors[n] = parts[2]
+	case "font":
+		s.Fonts[n] = parts[2]
+	case "cellformat":
+		s.CellFormats[n] = DecodeValue(parts[2])
+	case "valueformat":
+		s.ValueFormats[n] = DecodeValue(parts[2])
+	}
+	return nil
+}
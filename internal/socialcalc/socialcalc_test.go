@@ -0,0 +1,204 @@
+package socialcalc
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// sheetSave is a sheet save as SocialCalc.CreateSheetSave writes it
+const sheetSave = `version:1.5
+cell:A1:t:Item:f:1:cf:1
+cell:B1:t:Cost\cpaid:b:1::1:
+cell:A2:vt:th:<b>Rent</b>
+cell:B2:v:1200.50:ntvf:1
+cell:A3:t:Total\nincl. VAT:comment:checked by a\bb
+cell:B3:vtf:n:1200.5:SUM(B1\cB2):e:none:bg:2
+cell:C3:vtc:n$:5:$5.00:colspan:2:cssc:money:csss:color\c red
+col:A:w:120
+col:C:hide:yes
+row:3:h:24
+sheet:c:4:r:3:w:80:recalc:off:tf:1:font:1
+border:1:1px solid rgb(0,0,0)
+cellformat:1:left
+color:1:rgb(0,0,0)
+color:2:rgb(255,255,0)
+font:1:normal bold * *
+layout:1:padding:2px 2px 1px 2px;vertical-align:top;
+valueformat:1:#,##0.00
+name:TOTAL:the total:B3
+`
+
+func TestParseSheet(t *testing.T) {
+	sheet, err := ParseSheet(sheetSave)
+	if err != nil {
+		t.Fatalf("ParseSheet failed: %v", err)
+	}
+
+	if got := sheet.Cell("B1"); got == nil || got.Value != "Cost:paid" || got.Borders != [4]int{1, 0, 1, 0} {
+		t.Errorf("B1 = %+v", got)
+	}
+	if n, ok := sheet.Cell("B2").Number(); !ok || n != 1200.5 {
+		t.Errorf("B2 number = %v, %v", n, ok)
+	}
+	if got := sheet.Cell("A2"); got.DataType != DataText || got.ValueType != "th" {
+		t.Errorf("A2 = %+v", got)
+	}
+	if got := sheet.Cell("A3"); got.Value != "Total\nincl. VAT" || got.Comment != `checked by a\b` {
+		t.Errorf("A3 = %+v", got)
+	}
+	if got := sheet.Cell("$b$3"); !got.IsFormula() || got.Formula != "SUM(B1:B2)" || got.Errors != "none" || got.BgColor != 2 {
+		t.Errorf("B3 = %+v", got)
+	}
+	if got := sheet.Cell("C3"); got.DataType != DataConstant || got.Formula != "$5.00" || got.ColSpan != 2 || got.CSSStyle != "color: red" {
+		t.Errorf("C3 = %+v", got)
+	}
+	if sheet.Cols[1].Width != "120" || sheet.Cols[3].Hide != "yes" || sheet.Rows[3].Height != 24 {
+		t.Errorf("unexpected column or row attributes")
+	}
+	if a := sheet.Attribs; a.LastCol != 4 || a.LastRow != 3 || a.DefaultColWidth != "80" || a.Recalc != "off" || a.DefaultFont != 1 {
+		t.Errorf("attribs = %+v", a)
+	}
+	if sheet.Layouts[1] != "padding:2px 2px 1px 2px;vertical-align:top;" || sheet.ValueFormats[1] != "#,##0.00" {
+		t.Errorf("unexpected style tables")
+	}
+	if name := sheet.Names["TOTAL"]; name == nil || name.Definition != "B3" {
+		t.Errorf("name TOTAL = %+v", name)
+	}
+}
+
+func TestSheetRoundTrip(t *testing.T) {
+	sheet, err := ParseSheet(sheetSave)
+	if err != nil {
+		t.Fatalf("ParseSheet failed: %v", err)
+	}
+	if got := sheet.String(); got != sheetSave {
+		t.Errorf("round trip changed the save:\n%s\nwant:\n%s", got, sheetSave)
+	}
+
+	// Saves in another order keep everything they hold
+	shuffled := "sheet:c:2:r:2:unknown:kept\r\ncell:B2:v:2\r\ncell:A1:t:a\r\nclipboard:A1:t:old\r\nversion:1.5\r\n"
+	sheet, err = ParseSheet(shuffled)
+	if err != nil {
+		t.Fatalf("ParseSheet failed: %v", err)
+	}
+	want := "version:1.5\ncell:A1:t:a\ncell:B2:v:2\nsheet:c:2:r:2:unknown:kept\nclipboard:A1:t:old\n"
+	if got := sheet.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestBuildSheet(t *testing.T) {
+	sheet := NewSheet()
+	cell, err := sheet.AssuredCell("c2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cell.DataType, cell.ValueType, cell.Value = DataNumber, ValueNumber, "3"
+	cell.Font = sheet.Fonts.Add("italic normal * *")
+	if n := sheet.Fonts.Add("italic normal * *"); n != cell.Font {
+		t.Errorf("Add returned %d for an existing font, want %d", n, cell.Font)
+	}
+
+	want := "version:1.5\ncell:C2:v:3:f:1\nsheet:c:3:r:2\nfont:1:italic normal * *\n"
+	if got := sheet.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestParseSheetErrors(t *testing.T) {
+	for _, save := range []string{
+		"version:1.5\nbogus:line\n",
+		"cell:A0:t:x\n",
+		"cell:A1B:t:x\n",
+		"cell:1A:t:x\n",
+		"cell:A1:v:ten\n",
+		"cell:A1:zz:1\n",
+		"cell:A1:vtf:n:1\n",
+		"cell:A1:f:bold\n",
+		"col:A:width:10\n",
+		"row:x:h:10\n",
+		"sheet:c:99999:r:1\n",
+		"font:zero:x\n",
+	} {
+		_, err := ParseSheet(save)
+		var syntaxErr *SyntaxError
+		if !errors.As(err, &syntaxErr) {
+			t.Errorf("ParseSheet(%q) = %v, want a syntax error", save, err)
+		}
+	}
+}
+
+func TestParseMultipart(t *testing.T) {
+	boundary := DefaultBoundary
+	save := "socialcalc:version:1.0\n" +
+		"MIME-Version: 1.0\nContent-Type: multipart/mixed; boundary=" + boundary + "\n" +
+		"--" + boundary + "\nContent-type: text/plain; charset=UTF-8\n\n" +
+		"# SocialCalc Spreadsheet Control Save\nversion:1.0\npart:sheet\npart:edit\npart:audit\n" +
+		"--" + boundary + "\nContent-type: text/plain; charset=UTF-8\n\n" +
+		sheetSave +
+		"--" + boundary + "\nContent-type: text/plain; charset=UTF-8\n\n" +
+		"version:1.0\nrowpane:0:1:14\ncolpane:0:1:16\necell:A1\n" +
+		"--" + boundary + "\nContent-type: text/plain; charset=UTF-8\n\n" +
+		"--" + boundary + "--\n"
+
+	doc, err := Parse(save)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if !doc.Multipart || len(doc.Parts) != 3 || doc.Sheet.Cell("B3") == nil {
+		t.Fatalf("unexpected document %+v", doc)
+	}
+	if edit, ok := doc.Part(PartEdit); !ok || !strings.HasPrefix(edit, "version:1.0\nrowpane") {
+		t.Errorf("edit part = %q", edit)
+	}
+	if audit, ok := doc.Part(PartAudit); !ok || audit != "" {
+		t.Errorf("audit part = %q", audit)
+	}
+	if got := doc.String(); got != save {
+		t.Errorf("round trip changed the save:\n%s", got)
+	}
+
+	if _, err := Parse(strings.Replace(save, "cell:B2:v:", "cell:B2:x:", 1)); err == nil {
+		t.Error("invalid sheet part accepted")
+	}
+	if _, err := Parse(strings.TrimSuffix(save, "--"+boundary+"--\n")); err == nil {
+		t.Error("truncated save accepted")
+	}
+	if _, err := Parse("socialcalc:version:1.0\nMIME-Version: 1.0\nContent-Type: multipart/mixed; boundary=\xe2"); err == nil {
+		t.Error("boundary that is not UTF-8 accepted")
+	}
+
+	doc, err = Parse(sheetSave)
+	if err != nil || doc.Multipart || doc.String() != sheetSave {
+		t.Errorf("bare sheet save not kept as it is: %v", err)
+	}
+}
+
+func TestCoords(t *testing.T) {
+	for coord, want := range map[string][2]int{"A1": {1, 1}, "z9": {26, 9}, "AA10": {27, 10}, "$ZZ$3": {702, 3}} {
+		col, row, err := ParseCoord(coord)
+		if err != nil || col != want[0] || row != want[1] {
+			t.Errorf("ParseCoord(%q) = %d, %d, %v", coord, col, row, err)
+		}
+		if got := Coord(col, row); got != strings.ToUpper(strings.ReplaceAll(coord, "$", "")) {
+			t.Errorf("Coord(%d, %d) = %q", col, row, got)
+		}
+	}
+	for _, coord := range []string{"", "A", "1", "AAA1", "A01", "A-1"} {
+		if _, _, err := ParseCoord(coord); err == nil {
+			t.Errorf("ParseCoord(%q) accepted", coord)
+		}
+	}
+}
+
+func TestEncodeValue(t *testing.T) {
+	for _, value := range []string{"", "plain", `a\b:c` + "\nd", `\c`, `\\n`} {
+		if got := DecodeValue(EncodeValue(value)); got != value {
+			t.Errorf("DecodeValue(EncodeValue(%q)) = %q", value, got)
+		}
+	}
+	if got := EncodeValue("a:b\\c\n"); got != `a\cb\bc\n` {
+		t.Errorf("EncodeValue = %q", got)
+	}
+}
@@ -0,0 +1,208 @@
+package socialcalc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Workbook is a set of named sheets. Multi-sheet workbooks are saved by
+// SocialCalc.WorkBookControlSaveSheet as JSON; a single save read with
+// ParseWorkbook becomes a workbook of one sheet.
+type Workbook struct {
+	// JSON is set for workbooks read from, and written as, the workbook
+	// control's JSON
+	JSON        bool
+	NumSheets   int
+	CurrentID   string
+	CurrentName string
+	Sheets      []*WorkbookSheet
+	// EditableCells is kept as it was saved
+	EditableCells json.RawMessage
+}
+
+// WorkbookSheet is one sheet of a workbook
+type WorkbookSheet struct {
+	ID     string
+	Name   string
+	Hidden bool
+	Doc    *Document
+}
+
+// Sheet returns the sheet with the given name, ignoring case, or nil
+func (w *Workbook) Sheet(name string) *WorkbookSheet {
+	for _, sheet := range w.Sheets {
+		if strings.EqualFold(sheet.Name, name) {
+			return sheet
+		}
+	}
+	return nil
+}
+
+// workbookJSON is the shape of a workbook control save; sheetArr is read
+// separately to keep its order
+type workbookJSON struct {
+	NumSheets     int             `json:"numsheets"`
+	CurrentID     string          `json:"currentid"`
+	CurrentName   string          `json:"currentname"`
+	SheetArr      json.RawMessage `json:"sheetArr"`
+	EditableCells json.RawMessage `json:"EditableCells,omitempty"`
+}
+
+type workbookSheetJSON struct {
+	SheetStr struct {
+		SaveStr string `json:"savestr"`
+	} `json:"sheetstr"`
+	Name   string `json:"name"`
+	Hidden string `json:"hidden"`
+}
+
+// ParseWorkbook reads a workbook control save, or any single save accepted
+// by Parse as a workbook of one sheet named "Sheet1"
+func ParseWorkbook(data string) (*Workbook, error) {
+	if !strings.HasPrefix(strings.TrimSpace(data), "{") {
+		doc, err := Parse(data)
+		if err != nil {
+			return nil, err
+		}
+		return &Workbook{
+			NumSheets: 1,
+			Sheets:    []*WorkbookSheet{{ID: "sheet1", Name: "Sheet1", Doc: doc}},
+		}, nil
+	}
+
+	var saved workbookJSON
+	if err := json.Unmarshal([]byte(data), &saved); err != nil {
+		return nil, fmt.Errorf("invalid workbook: %w", err)
+	}
+	ids, sheets, err := orderedSheets(saved.SheetArr)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("workbook has no sheets")
+	}
+
+	workbook := &Workbook{
+		JSON:          true,
+		NumSheets:     saved.NumSheets,
+		CurrentID:     saved.CurrentID,
+		CurrentName:   saved.CurrentName,
+		EditableCells: saved.EditableCells,
+	}
+	for _, id := range ids {
+		doc, err := Parse(sheets[id].SheetStr.SaveStr)
+		if err != nil {
+			return nil, fmt.Errorf("sheet %s: %w", sheets[id].Name, err)
+		}
+		workbook.Sheets = append(workbook.Sheets, &WorkbookSheet{
+			ID:     id,
+			Name:   sheets[id].Name,
+			Hidden: sheets[id].Hidden == "1",
+			Doc:    doc,
+		})
+	}
+	return workbook, nil
+}
+
+// orderedSheets decodes the sheetArr object, returning its keys in the
+// order they were saved, which is the order of the sheet tabs
+func orderedSheets(raw json.RawMessage) ([]string, map[string]workbookSheetJSON, error) {
+	sheets := make(map[string]workbookSheetJSON)
+	if len(raw) == 0 {
+		return nil, sheets, nil
+	}
+	if err := json.Unmarshal(raw, &sheets); err != nil {
+		return nil, nil, fmt.Errorf("invalid workbook sheets: %w", err)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	if _, err := decoder.Token(); err != nil {
+		return nil, nil, err
+	}
+	var ids []string
+	for decoder.More() {
+		key, err := decoder.Token()
+		if err != nil {
+			return nil, nil, err
+		}
+		var skip json.RawMessage
+		if err := decoder.Decode(&skip); err != nil {
+			return nil, nil, err
+		}
+		ids = append(ids, key.(string))
+	}
+	return ids, sheets, nil
+}
+
+// String returns the workbook in the form it was read in: the workbook
+// control's JSON, or the save of its only sheet
+func (w *Workbook) String() (string, error) {
+	if !w.JSON && len(w.Sheets) == 1 {
+		return w.Sheets[0].Doc.String(), nil
+	}
+
+	var b bytes.Buffer
+	numSheets := w.NumSheets
+	if numSheets == 0 {
+		numSheets = len(w.Sheets)
+	}
+	// The header fields are written in the order the workbook control uses
+	b.WriteString(`{"numsheets":` + strconv.Itoa(numSheets))
+	for _, field := range []struct{ name, value string }{
+		{"currentid", w.CurrentID},
+		{"currentname", w.CurrentName},
+	} {
+		value, err := marshalJSON(field.value)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(`,"` + field.name + `":`)
+		b.Write(value)
+	}
+	b.WriteString(`,"sheetArr":{`)
+	for i, sheet := range w.Sheets {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		var saved workbookSheetJSON
+		saved.SheetStr.SaveStr = sheet.Doc.String()
+		saved.Name = sheet.Name
+		saved.Hidden = "0"
+		if sheet.Hidden {
+			saved.Hidden = "1"
+		}
+		id, err := marshalJSON(sheet.ID)
+		if err != nil {
+			return "", err
+		}
+		entry, err := marshalJSON(saved)
+		if err != nil {
+			return "", err
+		}
+		b.Write(id)
+		b.WriteByte(':')
+		b.Write(entry)
+	}
+	b.WriteByte('}')
+	if len(w.EditableCells) > 0 {
+		b.WriteString(`,"EditableCells":`)
+		b.Write(w.EditableCells)
+	}
+	b.WriteByte('}')
+	return b.String(), nil
+}
+
+// marshalJSON is json.Marshal without escaping <, > and &, as
+// JSON.stringify writes them
+func marshalJSON(v interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	encoder := json.NewEncoder(&b)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(b.Bytes(), []byte("\n")), nil
+}
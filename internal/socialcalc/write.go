@@ -0,0 +1,215 @@
+package socialcalc
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// String returns the sheet save, in the order SocialCalc.CreateSheetSave
+// writes it: cells by row, columns, rows, sheet attributes, style tables,
+// names and the copied range.
+func (s *Sheet) String() string {
+	var b strings.Builder
+	version := s.Version
+	if version == "" {
+		version = SheetVersion
+	}
+	b.WriteString("version:" + version + "\n")
+
+	for _, cell := range s.sortedCells() {
+		if line := cell.String(); line != "" {
+			b.WriteString("cell:" + cell.Coord + line + "\n")
+		}
+	}
+
+	for _, col := range sortedKeys(s.Cols) {
+		attribs := s.Cols[col]
+		if attribs.Width != "" {
+			b.WriteString("col:" + ColName(col) + ":w:" + attribs.Width + "\n")
+		}
+		if attribs.Hide != "" {
+			b.WriteString("col:" + ColName(col) + ":hide:" + attribs.Hide + "\n")
+		}
+	}
+	for _, row := range sortedKeys(s.Rows) {
+		attribs := s.Rows[row]
+		if attribs.Height != 0 {
+			b.WriteString("row:" + strconv.Itoa(row) + ":h:" + strconv.Itoa(attribs.Height) + "\n")
+		}
+		if attribs.Hide != "" {
+			b.WriteString("row:" + strconv.Itoa(row) + ":hide:" + attribs.Hide + "\n")
+		}
+	}
+
+	b.WriteString(s.Attribs.line() + "\n")
+
+	writeStyles := func(kind string, table StyleTable, encode bool) {
+		for _, n := range sortedKeys(table) {
+			style := table[n]
+			if encode {
+				style = EncodeValue(style)
+			}
+			b.WriteString(kind + ":" + strconv.Itoa(n) + ":" + style + "\n")
+		}
+	}
+	writeStyles("border", s.Borders, false)
+	writeStyles("cellformat", s.CellFormats, true)
+	writeStyles("color", s.Colors, false)
+	writeStyles("font", s.Fonts, false)
+	writeStyles("layout", s.Layouts, false)
+	writeStyles("valueformat", s.ValueFormats, true)
+
+	names := make([]string, 0, len(s.Names))
+	for name := range s.Names {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		b.WriteString("name:" + strings.ToUpper(EncodeValue(name)) + ":" +
+			EncodeValue(s.Names[name].Description) + ":" + EncodeValue(s.Names[name].Definition) + "\n")
+	}
+
+	if s.CopiedFrom != "" {
+		b.WriteString("copiedfrom:" + s.CopiedFrom + "\n")
+	}
+	for _, line := range s.Clipboard {
+		b.WriteString(line + "\n")
+	}
+	return b.String()
+}
+
+// sortedCells returns the cells by row, then column
+func (s *Sheet) sortedCells() []*Cell {
+	type position struct {
+		col, row int
+		cell     *Cell
+	}
+	positions := make([]position, 0, len(s.Cells))
+	for coord, cell := range s.Cells {
+		col, row, err := ParseCoord(coord)
+		if err != nil {
+			continue
+		}
+		cell.Coord = coord
+		positions = append(positions, position{col, row, cell})
+	}
+	sort.Slice(positions, func(i, j int) bool {
+		if positions[i].row != positions[j].row {
+			return positions[i].row < positions[j].row
+		}
+		return positions[i].col < positions[j].col
+	})
+
+	cells := make([]*Cell, len(positions))
+	for i, p := range positions {
+		cells[i] = p.cell
+	}
+	return cells
+}
+
+// String returns the attributes of a cell as they follow its coordinate on
+// a cell line, like SocialCalc.CellToString. An empty cell returns "".
+func (c *Cell) String() string {
+	var b strings.Builder
+	value := EncodeValue(c.Value)
+	switch c.DataType {
+	case DataNumber:
+		if c.ValueType == ValueNumber {
+			b.WriteString(":v:" + value)
+		} else {
+			b.WriteString(":vt:" + c.ValueType + ":" + value)
+		}
+	case DataText:
+		if c.ValueType == ValueText {
+			b.WriteString(":t:" + value)
+		} else {
+			b.WriteString(":vt:" + c.ValueType + ":" + value)
+		}
+	case DataFormula:
+		b.WriteString(":vtf:" + c.ValueType + ":" + value + ":" + EncodeValue(c.Formula))
+	case DataConstant:
+		b.WriteString(":vtc:" + c.ValueType + ":" + value + ":" + EncodeValue(c.Formula))
+	}
+
+	if c.Errors != "" {
+		b.WriteString(":e:" + EncodeValue(c.Errors))
+	}
+	if c.Borders != [4]int{} {
+		b.WriteString(":b")
+		for _, border := range c.Borders {
+			b.WriteString(":")
+			if border != 0 {
+				b.WriteString(strconv.Itoa(border))
+			}
+		}
+	}
+	for _, field := range []struct {
+		name  string
+		value int
+	}{
+		{"l", c.Layout},
+		{"f", c.Font},
+		{"c", c.Color},
+		{"bg", c.BgColor},
+		{"cf", c.CellFormat},
+		{"tvf", c.TextValueFormat},
+		{"ntvf", c.NonTextValueFormat},
+		{"colspan", c.ColSpan},
+		{"rowspan", c.RowSpan},
+	} {
+		if field.value != 0 {
+			b.WriteString(":" + field.name + ":" + strconv.Itoa(field.value))
+		}
+	}
+	if c.CSSClass != "" {
+		b.WriteString(":cssc:" + c.CSSClass)
+	}
+	if c.CSSStyle != "" {
+		b.WriteString(":csss:" + EncodeValue(c.CSSStyle))
+	}
+	if c.Mod != "" {
+		b.WriteString(":mod:" + c.Mod)
+	}
+	if c.Comment != "" {
+		b.WriteString(":comment:" + EncodeValue(c.Comment))
+	}
+	return b.String()
+}
+
+// line returns the "sheet:" line, with the fields in the order SocialCalc
+// writes them
+func (a *SheetAttribs) line() string {
+	line := "sheet:c:" + strconv.Itoa(a.LastCol) + ":r:" + strconv.Itoa(a.LastRow)
+	add := func(name, value string) {
+		if value != "" && value != "0" {
+			line += ":" + name + ":" + value
+		}
+	}
+	add("h", strconv.Itoa(a.DefaultRowHeight))
+	add("w", EncodeValue(a.DefaultColWidth))
+	add("circularreferencecell", EncodeValue(a.CircularReferenceCell))
+	add("recalc", EncodeValue(a.Recalc))
+	add("needsrecalc", EncodeValue(a.NeedsRecalc))
+	add("tf", strconv.Itoa(a.DefaultTextFormat))
+	add("ntf", strconv.Itoa(a.DefaultNonTextFormat))
+	add("tvf", strconv.Itoa(a.DefaultTextValueFormat))
+	add("ntvf", strconv.Itoa(a.DefaultNonTextValueFormat))
+	add("color", strconv.Itoa(a.DefaultColor))
+	add("bgcolor", strconv.Itoa(a.DefaultBgColor))
+	add("font", strconv.Itoa(a.DefaultFont))
+	add("layout", strconv.Itoa(a.DefaultLayout))
+	for _, attrib := range a.Other {
+		line += ":" + attrib.Name + ":" + attrib.Value
+	}
+	return line
+}
+
+func sortedKeys[V any](m map[int]V) []int {
+	keys := make([]int, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
@@ -26,4 +26,12 @@ type Storage interface {
 	GetItem(path string, bucket ...string) (string, error)
 	ExistsItem(path string, bucket ...string) (bool, error)
 	DeleteItem(path string, bucket ...string) error
+	// ListItems returns the paths of all items below prefix (not including
+	// prefix itself), at any depth.
+	ListItems(prefix string, bucket ...string) ([]string, error)
+	// SwapItem writes data to an item only if it still holds old, or only
+	// if it does not exist yet when old is empty, and reports whether it
+	// wrote. Instances sharing the storage use it to change a record
+	// without losing each other's changes.
+	SwapItem(path, old, data string, bucket ...string) (bool, error)
 }
\ No newline at end of file
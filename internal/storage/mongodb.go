@@ -4,6 +4,7 @@ import (
     "context"
     "encoding/json"
     "fmt"
+    "regexp"
     "strings"
     "time"
 
@@ -113,6 +114,49 @@ func (m *MongoStorage) DeleteItem(path string, bucket ...string) error {
     return err
 }
 
+func (m *MongoStorage) ListItems(prefix string, bucket ...string) ([]string, error) {
+    collection := m.getCollection()
+    ctx := context.Background()
+
+    filter := bson.M{"_id": bson.M{"$regex": "^" + regexp.QuoteMeta(strings.TrimSuffix(prefix, "/")+"/")}}
+    cursor, err := collection.Find(ctx, filter, options.Find().SetProjection(bson.M{"_id": 1}))
+    if err != nil {
+        return nil, err
+    }
+    defer cursor.Close(ctx)
+
+    var paths []string
+    for cursor.Next(ctx) {
+        var item struct {
+            ID string `bson:"_id"`
+        }
+        if err := cursor.Decode(&item); err != nil {
+            return nil, err
+        }
+        paths = append(paths, item.ID)
+    }
+    return paths, cursor.Err()
+}
+
+func (m *MongoStorage) SwapItem(path, old, data string, bucket ...string) (bool, error) {
+    collection := m.getCollection()
+    ctx := context.Background()
+
+    if old == "" {
+        _, err := collection.InsertOne(ctx, MongoItem{ID: path, Path: path, Data: data})
+        if mongo.IsDuplicateKeyError(err) {
+            return false, nil
+        }
+        return err == nil, err
+    }
+
+    result, err := collection.UpdateOne(ctx, bson.M{"_id": path, "data": old}, bson.M{"$set": bson.M{"data": data}})
+    if err != nil {
+        return false, err
+    }
+    return result.MatchedCount > 0, nil
+}
+
 func (m *MongoStorage) ensureParentDirectories(path []string) error {
     if len(path) == 0 {
         return nil
@@ -181,9 +225,11 @@ func (m *MongoStorage) DeleteDir(path []string) error {
     collection := m.getCollection()
     ctx := context.Background()
 
+    // Match the directory itself and everything below it, but not siblings
+    // that merely share the prefix
     spath := m.pathToString(path)
     _, err := collection.DeleteMany(ctx, bson.M{
-        "path": bson.M{"$regex": "^" + spath},
+        "path": bson.M{"$regex": "^" + regexp.QuoteMeta(spath) + "(/|$)"},
     })
     return err
 }
@@ -3,6 +3,7 @@ package storage
 import (
     "database/sql"
     // "encoding/json"
+    "errors"
     "fmt"
     "strings"
 
@@ -96,6 +97,60 @@ func (m *MySQLStorage) DeleteItem(path string, bucket ...string) error {
     return err
 }
 
+func (m *MySQLStorage) ListItems(prefix string, bucket ...string) ([]string, error) {
+    query := "SELECT path FROM storage_items WHERE path LIKE ? ESCAPE '\\\\'"
+
+    rows, err := m.db.Query(query, escapeLike(strings.TrimSuffix(prefix, "/")+"/")+"%")
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var paths []string
+    for rows.Next() {
+        var path string
+        if err := rows.Scan(&path); err != nil {
+            return nil, err
+        }
+        paths = append(paths, path)
+    }
+    return paths, rows.Err()
+}
+
+func (m *MySQLStorage) SwapItem(path, old, data string, bucket ...string) (bool, error) {
+    if old == "" {
+        result, err := m.db.Exec("INSERT IGNORE INTO storage_items (path, type, data) VALUES (?, 'item', ?)", path, data)
+        if err != nil {
+            return false, err
+        }
+        rows, err := result.RowsAffected()
+        return rows > 0, err
+    }
+
+    // MySQL counts only the rows an UPDATE changed, so a write of the same
+    // data is checked by reading it
+    if data == old {
+        current, err := m.GetItem(path)
+        if errors.Is(err, ErrNotFound) {
+            return false, nil
+        }
+        return current == old, err
+    }
+
+    result, err := m.db.Exec("UPDATE storage_items SET data = ? WHERE path = ? AND data = ?", data, path, old)
+    if err != nil {
+        return false, err
+    }
+    rows, err := result.RowsAffected()
+    return rows > 0, err
+}
+
+// escapeLike escapes LIKE wildcards so a path is matched literally
+func escapeLike(value string) string {
+    replacer := strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_")
+    return replacer.Replace(value)
+}
+
 func (m *MySQLStorage) CreateDir(path []string) error {
     spath := m.pathToString(path)
     
@@ -118,9 +173,9 @@ func (m *MySQLStorage) CreateDir(path []string) error {
 
 func (m *MySQLStorage) DeleteDir(path []string) error {
     spath := m.pathToString(path)
-    query := "DELETE FROM storage_items WHERE path LIKE ?"
+    query := "DELETE FROM storage_items WHERE path = ? OR path LIKE ? ESCAPE '\\\\'"
     
-    _, err := m.db.Exec(query, spath+"%")
+    _, err := m.db.Exec(query, spath, escapeLike(spath+"/")+"%")
     return err
 }
 
@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// EncodeSegment makes a name safe to use as one segment of a storage path.
+// Separators, '%', control characters and the "." and ".." segments are
+// percent-encoded; every other name, including all ordinary file names and
+// email addresses, is returned unchanged. DecodeSegment reverses it.
+func EncodeSegment(segment string) string {
+	if segment == "." || segment == ".." {
+		return strings.Repeat("%2E", len(segment))
+	}
+
+	var encoded strings.Builder
+	for i := 0; i < len(segment); i++ {
+		b := segment[i]
+		if b == '%' || b == '/' || b == '\\' || b < 0x20 || b == 0x7f {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+			continue
+		}
+		encoded.WriteByte(b)
+	}
+	return encoded.String()
+}
+
+// DecodeSegment returns the name an encoded path segment stands for
+func DecodeSegment(segment string) (string, error) {
+	if !strings.Contains(segment, "%") {
+		return segment, nil
+	}
+
+	var decoded strings.Builder
+	for i := 0; i < len(segment); i++ {
+		if segment[i] != '%' {
+			decoded.WriteByte(segment[i])
+			continue
+		}
+		if i+2 >= len(segment) {
+			return "", fmt.Errorf("invalid path segment %q", segment)
+		}
+		b, err := strconv.ParseUint(segment[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("invalid path segment %q", segment)
+		}
+		decoded.WriteByte(byte(b))
+		i += 2
+	}
+	return decoded.String(), nil
+}
+
+// EncodePath encodes every segment of a path
+func EncodePath(segments ...string) []string {
+	path := make([]string, len(segments))
+	for i, segment := range segments {
+		path[i] = EncodeSegment(segment)
+	}
+	return path
+}
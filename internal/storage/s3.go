@@ -2,13 +2,18 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/c4gt/tornado-nginx-go-backend/internal/models"
 )
 
@@ -62,6 +67,14 @@ func NewS3Storage(bucketName, endpoint, accessKey, secretKey, region string, use
 	}, nil
 }
 
+// isNotFound reports whether err is S3 telling that a key does not exist:
+// NoSuchKey for GetObject, NotFound for HeadObject, which has no body
+func isNotFound(err error) bool {
+	var noSuchKey *types.NoSuchKey
+	var notFound *types.NotFound
+	return errors.As(err, &noSuchKey) || errors.As(err, &notFound)
+}
+
 func (s *S3Storage) pathToString(path []string) string {
 	return strings.Join(path, "/")
 }
@@ -92,6 +105,9 @@ func (s *S3Storage) GetItem(path string, bucket ...string) (string, error) {
 		Key:    aws.String(path),
 	})
 	if err != nil {
+		if isNotFound(err) {
+			return "", ErrNotFound
+		}
 		return "", err
 	}
 	defer result.Body.Close()
@@ -124,8 +140,7 @@ func (s *S3Storage) ExistsItem(path string, bucket ...string) (bool, error) {
 	})
 
 	if err != nil {
-		// Check if the error is "not found"
-		if strings.Contains(err.Error(), "NotFound") {
+		if isNotFound(err) {
 			return false, nil
 		}
 		return false, err
@@ -148,6 +163,88 @@ func (s *S3Storage) DeleteItem(path string, bucket ...string) error {
 	return err
 }
 
+func (s *S3Storage) ListItems(prefix string, bucket ...string) ([]string, error) {
+	bucketName := s.bucketName
+	if len(bucket) > 0 && bucket[0] != "" {
+		bucketName = bucket[0]
+	}
+
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucketName),
+		Prefix: aws.String(strings.TrimSuffix(prefix, "/") + "/"),
+	})
+
+	var paths []string
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range page.Contents {
+			paths = append(paths, aws.ToString(object.Key))
+		}
+	}
+	return paths, nil
+}
+
+// SwapItem uses the conditional writes of S3 and MinIO: a create only
+// succeeds while there is no object, and a replace only while the object
+// is the one whose data was compared
+func (s *S3Storage) SwapItem(path, old, data string, bucket ...string) (bool, error) {
+	bucketName := s.bucketName
+	if len(bucket) > 0 && bucket[0] != "" {
+		bucketName = bucket[0]
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(path),
+		Body:   strings.NewReader(data),
+	}
+	if old == "" {
+		input.IfNoneMatch = aws.String("*")
+	} else {
+		result, err := s.client.GetObject(context.TODO(), &s3.GetObjectInput{
+			Bucket: aws.String(bucketName),
+			Key:    aws.String(path),
+		})
+		if err != nil {
+			if isNotFound(err) {
+				return false, nil
+			}
+			return false, err
+		}
+		current, err := io.ReadAll(result.Body)
+		result.Body.Close()
+		if err != nil {
+			return false, err
+		}
+		if string(current) != old {
+			return false, nil
+		}
+		input.IfMatch = result.ETag
+	}
+
+	if _, err := s.client.PutObject(context.TODO(), input); err != nil {
+		if isConditionFailed(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// isConditionFailed reports whether err is S3 refusing a conditional write
+// because the object changed, or because another write to it was under way
+func isConditionFailed(err error) bool {
+	var responseErr *awshttp.ResponseError
+	if !errors.As(err, &responseErr) {
+		return false
+	}
+	status := responseErr.HTTPStatusCode()
+	return status == http.StatusPreconditionFailed || status == http.StatusConflict
+}
+
 func (s *S3Storage) CreateDir(path []string) error {
 	spath := s.pathToString(path)
 
@@ -170,10 +267,42 @@ func (s *S3Storage) CreateDir(path []string) error {
 	return s.PutItem(spath, dataJSON)
 }
 
+// maxDeleteObjects is the most keys a single DeleteObjects call accepts
+const maxDeleteObjects = 1000
+
 func (s *S3Storage) DeleteDir(path []string) error {
-	// TODO: Implement directory deletion
-	// This should recursively delete all files in the directory
-	return fmt.Errorf("delete directory not implemented")
+	spath := s.pathToString(path)
+	keys, err := s.ListItems(spath)
+	if err != nil {
+		return err
+	}
+	keys = append(keys, spath)
+
+	for start := 0; start < len(keys); start += maxDeleteObjects {
+		end := start + maxDeleteObjects
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		objects := make([]types.ObjectIdentifier, 0, end-start)
+		for _, key := range keys[start:end] {
+			objects = append(objects, types.ObjectIdentifier{Key: aws.String(key)})
+		}
+
+		result, err := s.client.DeleteObjects(context.TODO(), &s3.DeleteObjectsInput{
+			Bucket: aws.String(s.bucketName),
+			Delete: &types.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return err
+		}
+		if len(result.Errors) > 0 {
+			first := result.Errors[0]
+			return fmt.Errorf("failed to delete %d objects, first %s: %s",
+				len(result.Errors), aws.ToString(first.Key), aws.ToString(first.Message))
+		}
+	}
+	return nil
 }
 
 func (s *S3Storage) GetFile(path []string) (*models.StorageItem, error) {
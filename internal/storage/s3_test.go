@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newMissingKeyS3 returns storage backed by a fake S3 endpoint that has no
+// objects, answering as S3 and MinIO do for missing keys
+func newMissingKeyS3(t *testing.T) *S3Storage {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusNotFound)
+		if r.Method != http.MethodHead {
+			w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>` +
+				`<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`))
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	store, err := NewS3Storage("bucket", strings.TrimPrefix(server.URL, "http://"), "key", "secret", "us-east-1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestS3MissingKeyIsNotFound(t *testing.T) {
+	store := newMissingKeyS3(t)
+
+	if _, err := store.GetItem("home/throttles/missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetItem of a missing key = %v, want ErrNotFound", err)
+	}
+	if _, err := store.GetFile([]string{"home", "missing"}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetFile of a missing key = %v, want ErrNotFound", err)
+	}
+	if exists, err := store.ExistsItem("home/missing"); err != nil || exists {
+		t.Errorf("ExistsItem of a missing key = %v, %v, want false, nil", exists, err)
+	}
+}
+
+// newConditionalS3 returns storage backed by a fake S3 endpoint that keeps
+// objects in memory and honours If-Match and If-None-Match on writes
+func newConditionalS3(t *testing.T) *S3Storage {
+	t.Helper()
+	var mu sync.Mutex
+	objects := make(map[string]string)
+	etag := func(data string) string {
+		return fmt.Sprintf(`"%x"`, md5.Sum([]byte(data)))
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		data, exists := objects[r.URL.Path]
+		switch r.Method {
+		case http.MethodGet:
+			if !exists {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`<Error><Code>NoSuchKey</Code></Error>`))
+				return
+			}
+			w.Header().Set("ETag", etag(data))
+			w.Write([]byte(data))
+		case http.MethodPut:
+			if match := r.Header.Get("If-Match"); match != "" && (!exists || match != etag(data)) ||
+				r.Header.Get("If-None-Match") == "*" && exists {
+				w.WriteHeader(http.StatusPreconditionFailed)
+				w.Write([]byte(`<Error><Code>PreconditionFailed</Code></Error>`))
+				return
+			}
+			body, _ := io.ReadAll(r.Body)
+			objects[r.URL.Path] = string(body)
+			w.Header().Set("ETag", etag(string(body)))
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	store, err := NewS3Storage("bucket", strings.TrimPrefix(server.URL, "http://"), "key", "secret", "us-east-1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestS3SwapItem(t *testing.T) {
+	store := newConditionalS3(t)
+
+	if swapped, err := store.SwapItem("home/throttle/a", "", "one"); err != nil || !swapped {
+		t.Fatalf("creating a missing item = %v, %v, want true", swapped, err)
+	}
+	if swapped, err := store.SwapItem("home/throttle/a", "", "two"); err != nil || swapped {
+		t.Errorf("creating an existing item = %v, %v, want false", swapped, err)
+	}
+	if swapped, err := store.SwapItem("home/throttle/a", "stale", "two"); err != nil || swapped {
+		t.Errorf("replacing changed data = %v, %v, want false", swapped, err)
+	}
+	if swapped, err := store.SwapItem("home/throttle/a", "one", "two"); err != nil || !swapped {
+		t.Errorf("replacing current data = %v, %v, want true", swapped, err)
+	}
+	if data, err := store.GetItem("home/throttle/a"); err != nil || data != "two" {
+		t.Errorf("GetItem = %q, %v, want two", data, err)
+	}
+	if swapped, err := store.SwapItem("home/throttle/missing", "one", "two"); err != nil || swapped {
+		t.Errorf("replacing a missing item = %v, %v, want false", swapped, err)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"github.com/c4gt/tornado-nginx-go-backend/internal/models"
+	"github.com/c4gt/tornado-nginx-go-backend/internal/storage"
 	"github.com/c4gt/tornado-nginx-go-backend/tests/testutils"
 	"github.com/stretchr/testify/assert"
 )
@@ -31,3 +32,54 @@ func TestCreateGetUpdateDeleteFile(t *testing.T) {
 	err = store.DeleteFile(path)
 	assert.NoError(t, err)
 }
+
+func TestCopyTree(t *testing.T) {
+	store := testutils.NewMockStorage()
+
+	store.CreateDir([]string{"home", "old@example.com"})
+	store.CreateDir([]string{"home", "old@example.com", "securestore"})
+	file := models.NewStorageItem([]string{"home", "old@example.com", "securestore", "budget"}, "file", "sheet")
+	dataJSON, _ := file.ToJSON()
+	store.PutItem("home/old@example.com/securestore/budget", dataJSON)
+	store.CreateDir([]string{"home", "old@example.com.bak"})
+
+	copied, err := storage.CopyTree(store, []string{"home", "old@example.com"}, []string{"home", "new@example.com"})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, copied)
+
+	item, err := store.GetFile([]string{"home", "new@example.com", "securestore", "budget"})
+	assert.NoError(t, err)
+	assert.Equal(t, "sheet", item.Data)
+	assert.Equal(t, []string{"home", "new@example.com", "securestore", "budget"}, item.Path)
+
+	_, err = store.GetFile([]string{"home", "old@example.com", "securestore", "budget"})
+	assert.NoError(t, err, "source must be left in place")
+	_, err = store.GetFile([]string{"home", "new@example.com.bak"})
+	assert.Error(t, err, "sibling sharing the prefix must not be copied")
+}
+
+func TestPathSegmentEncoding(t *testing.T) {
+	for _, name := range []string{
+		"bob@example.com", "budget 2024.msc", "", ".", "..", "...",
+		"../../etc", "a/b", `a\b`, "100%", "%2F", "tab\there", "naïve.msc",
+	} {
+		encoded := storage.EncodeSegment(name)
+		assert.NotContains(t, encoded, "/", "encoding of %q", name)
+		assert.NotContains(t, encoded, `\`, "encoding of %q", name)
+		assert.NotEqual(t, ".", encoded)
+		assert.NotEqual(t, "..", encoded)
+
+		decoded, err := storage.DecodeSegment(encoded)
+		assert.NoError(t, err)
+		assert.Equal(t, name, decoded)
+	}
+
+	// Ordinary names are stored as they are
+	assert.Equal(t, "bob@example.com", storage.EncodeSegment("bob@example.com"))
+	assert.Equal(t, []string{"home", "a%2Fb", "%2E%2E"}, storage.EncodePath("home", "a/b", ".."))
+
+	for _, bad := range []string{"%", "%2", "%zz"} {
+		_, err := storage.DecodeSegment(bad)
+		assert.Error(t, err, "decoding %q", bad)
+	}
+}
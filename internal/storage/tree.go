@@ -0,0 +1,47 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/c4gt/tornado-nginx-go-backend/internal/models"
+)
+
+// CopyTree copies the item at from and everything below it to to, rewriting
+// the stored paths. It returns the number of items copied.
+func CopyTree(s Storage, from, to []string) (int, error) {
+	fromPath := strings.Join(from, "/")
+	toPath := strings.Join(to, "/")
+
+	items, err := s.ListItems(fromPath)
+	if err != nil {
+		return 0, err
+	}
+	items = append([]string{fromPath}, items...)
+
+	copied := 0
+	for _, item := range items {
+		data, err := s.GetItem(item)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			return copied, fmt.Errorf("failed to read %s: %w", item, err)
+		}
+
+		target := toPath + strings.TrimPrefix(item, fromPath)
+		if storageItem, err := models.StorageItemFromJSON(data); err == nil && storageItem.Path != nil {
+			storageItem.Path = strings.Split(target, "/")
+			if data, err = storageItem.ToJSON(); err != nil {
+				return copied, err
+			}
+		}
+
+		if err := s.PutItem(target, data); err != nil {
+			return copied, fmt.Errorf("failed to write %s: %w", target, err)
+		}
+		copied++
+	}
+	return copied, nil
+}
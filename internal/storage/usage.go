@@ -0,0 +1,28 @@
+package storage
+
+import (
+	"errors"
+	"strings"
+)
+
+// Usage reports the number of items stored below path and their total size
+// in bytes, as stored by the backend.
+func Usage(s Storage, path []string) (int, int64, error) {
+	items, err := s.ListItems(strings.Join(path, "/"))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var size int64
+	for _, item := range items {
+		data, err := s.GetItem(item)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			return 0, 0, err
+		}
+		size += int64(len(data))
+	}
+	return len(items), size, nil
+}
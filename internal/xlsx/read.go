@@ -0,0 +1,683 @@
+package xlsx
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// MaxPartSize limits how much Read decompresses of any one file of the
+	// archive, so a small upload cannot expand without bound
+	MaxPartSize = 64 << 20
+	// MaxCells limits the cells, including the empty cells before them in
+	// their row and the empty rows above them, Read keeps for a workbook
+	MaxCells = 4 << 20
+	// MaxSheets limits the sheets a workbook may list
+	MaxSheets = 256
+	// MaxCol and MaxRow are the largest column and row Excel allows
+	MaxCol = 16384
+	MaxRow = 1 << 20
+)
+
+// builtinFormats are the codes of the built-in number formats that are not
+// General
+var builtinFormats = map[int]string{
+	1: "0", 2: "0.00", 3: "#,##0", 4: "#,##0.00",
+	9: "0%", 10: "0.00%", 11: "0.00E+00", 12: "# ?/?", 13: "# ??/??",
+	14: "m/d/yyyy", 15: "d-mmm-yy", 16: "d-mmm", 17: "mmm-yy",
+	18: "h:mm AM/PM", 19: "h:mm:ss AM/PM", 20: "h:mm", 21: "h:mm:ss", 22: "m/d/yyyy h:mm",
+	37: "#,##0 ;(#,##0)", 38: "#,##0 ;[Red](#,##0)", 39: "#,##0.00;(#,##0.00)", 40: "#,##0.00;[Red](#,##0.00)",
+	45: "mm:ss", 46: "[h]:mm:ss", 47: "mm:ss.0", 48: "##0.0E+0", 49: "@",
+}
+
+// sheetFeatures names the worksheet elements Read does not convert
+var sheetFeatures = map[string]string{
+	"conditionalFormatting": "conditional formatting",
+	"dataValidations":       "data validation",
+	"hyperlinks":            "hyperlinks",
+	"drawing":               "charts and images",
+	"legacyDrawing":         "comments",
+	"tableParts":            "tables",
+	"autoFilter":            "filters",
+	"sheetProtection":       "sheet protection",
+	"pivotTableDefinition":  "pivot tables",
+}
+
+// Read reads an .xlsx file: cell values, formulas, number formats, merged
+// cells, column widths, and hidden sheets and columns. Anything else the
+// file holds, such as charts or conditional formatting, is left out and
+// described in the workbook's Unsupported list.
+func Read(r io.ReaderAt, size int64) (*Workbook, error) {
+	z, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("not an xlsx file: %w", err)
+	}
+	rd := &reader{files: make(map[string]*zip.File)}
+	for _, f := range z.File {
+		rd.files[strings.TrimPrefix(f.Name, "/")] = f
+	}
+	return rd.read()
+}
+
+type reader struct {
+	files    map[string]*zip.File
+	book     *Workbook
+	strings  []string
+	formats  []string
+	styled   []bool
+	date1904 bool
+	cells    int
+	// reported keeps Unsupported free of repeats
+	reported map[string]bool
+}
+
+func (rd *reader) unsupported(format string, args ...interface{}) {
+	note := fmt.Sprintf(format, args...)
+	if !rd.reported[note] {
+		rd.reported[note] = true
+		rd.book.Unsupported = append(rd.book.Unsupported, note)
+	}
+}
+
+// part returns the decompressed content of a file of the archive, or nil
+// when the archive has no such file
+func (rd *reader) part(name string) ([]byte, error) {
+	f, ok := rd.files[name]
+	if !ok {
+		return nil, nil
+	}
+	in, err := f.Open()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	defer in.Close()
+	data, err := io.ReadAll(io.LimitReader(in, MaxPartSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if len(data) > MaxPartSize {
+		return nil, fmt.Errorf("%s is larger than %d bytes", name, MaxPartSize)
+	}
+	return data, nil
+}
+
+func (rd *reader) decode(name string, v interface{}) (bool, error) {
+	data, err := rd.part(name)
+	if err != nil || data == nil {
+		return false, err
+	}
+	if err := xml.Unmarshal(data, v); err != nil {
+		return false, fmt.Errorf("%s: %w", name, err)
+	}
+	return true, nil
+}
+
+type xmlRels struct {
+	Rels []struct {
+		ID     string `xml:"Id,attr"`
+		Type   string `xml:"Type,attr"`
+		Target string `xml:"Target,attr"`
+	} `xml:"Relationship"`
+}
+
+// rels reads the relationships of a part, resolving their targets to
+// archive paths
+func (rd *reader) rels(part string) (map[string]string, error) {
+	dir, file := path.Split(part)
+	var rels xmlRels
+	if _, err := rd.decode(dir+"_rels/"+file+".rels", &rels); err != nil {
+		return nil, err
+	}
+	targets := make(map[string]string)
+	for _, rel := range rels.Rels {
+		target := rel.Target
+		if strings.HasPrefix(target, "/") {
+			target = strings.TrimPrefix(target, "/")
+		} else {
+			target = path.Join(dir, target)
+		}
+		targets[rel.ID] = target
+		// The root relationships are looked up by type
+		targets[path.Base(rel.Type)] = target
+	}
+	return targets, nil
+}
+
+type xmlWorkbook struct {
+	Properties struct {
+		Date1904 string `xml:"date1904,attr"`
+	} `xml:"workbookPr"`
+	Sheets []struct {
+		Name  string `xml:"name,attr"`
+		State string `xml:"state,attr"`
+		RID   string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+	} `xml:"sheets>sheet"`
+	DefinedNames []struct {
+		Name string `xml:"name,attr"`
+	} `xml:"definedNames>definedName"`
+	ExternalReferences []struct{} `xml:"externalReferences>externalReference"`
+	PivotCaches        []struct{} `xml:"pivotCaches>pivotCache"`
+}
+
+func (rd *reader) read() (*Workbook, error) {
+	rd.book = &Workbook{}
+	rd.reported = make(map[string]bool)
+
+	root, err := rd.rels("")
+	if err != nil {
+		return nil, err
+	}
+	workbookPath := root["officeDocument"]
+	if workbookPath == "" {
+		workbookPath = "xl/workbook.xml"
+	}
+	var wb xmlWorkbook
+	if ok, err := rd.decode(workbookPath, &wb); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, fmt.Errorf("not an xlsx file: no workbook")
+	}
+	rd.date1904 = wb.Properties.Date1904 == "1" || wb.Properties.Date1904 == "true"
+	if len(wb.DefinedNames) > 0 {
+		names := make([]string, len(wb.DefinedNames))
+		for i, name := range wb.DefinedNames {
+			names[i] = name.Name
+		}
+		rd.unsupported("defined names (%s)", strings.Join(names, ", "))
+	}
+	if len(wb.ExternalReferences) > 0 {
+		rd.unsupported("links to other workbooks")
+	}
+	if len(wb.PivotCaches) > 0 {
+		rd.unsupported("pivot tables")
+	}
+
+	targets, err := rd.rels(workbookPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := rd.readSharedStrings(targets["sharedStrings"]); err != nil {
+		return nil, err
+	}
+	if err := rd.readStyles(targets["styles"]); err != nil {
+		return nil, err
+	}
+
+	if len(wb.Sheets) > MaxSheets {
+		return nil, fmt.Errorf("workbook has more than %d sheets", MaxSheets)
+	}
+	for _, entry := range wb.Sheets {
+		target, ok := targets[entry.RID]
+		if !ok || !strings.HasSuffix(target, ".xml") || !strings.Contains(target, "worksheets/") {
+			// Chart sheets and dialog sheets hold no cells
+			rd.unsupported("%s: sheets that are not worksheets", entry.Name)
+			continue
+		}
+		sheet := &Sheet{Name: entry.Name, Hidden: entry.State != "" && entry.State != "visible", Cols: make(map[int]Col)}
+		if err := rd.readSheet(target, sheet); err != nil {
+			return nil, fmt.Errorf("sheet %s: %w", entry.Name, err)
+		}
+		rd.book.Sheets = append(rd.book.Sheets, sheet)
+	}
+	if len(rd.book.Sheets) == 0 {
+		return nil, fmt.Errorf("workbook has no worksheets")
+	}
+	return rd.book, nil
+}
+
+// xmlText is a string item: plain text, or runs of formatted text
+type xmlText struct {
+	T    string `xml:"t"`
+	Runs []struct {
+		T string `xml:"t"`
+	} `xml:"r"`
+}
+
+func (t *xmlText) String() string {
+	if len(t.Runs) == 0 {
+		return t.T
+	}
+	var b strings.Builder
+	b.WriteString(t.T)
+	for _, run := range t.Runs {
+		b.WriteString(run.T)
+	}
+	return b.String()
+}
+
+func (rd *reader) readSharedStrings(name string) error {
+	var sst struct {
+		Items []xmlText `xml:"si"`
+	}
+	if _, err := rd.decode(name, &sst); err != nil {
+		return err
+	}
+	rd.strings = make([]string, len(sst.Items))
+	for i := range sst.Items {
+		rd.strings[i] = sst.Items[i].String()
+	}
+	return nil
+}
+
+func (rd *reader) readStyles(name string) error {
+	var styles struct {
+		NumFmts []struct {
+			ID   int    `xml:"numFmtId,attr"`
+			Code string `xml:"formatCode,attr"`
+		} `xml:"numFmts>numFmt"`
+		Xfs []struct {
+			NumFmtID int `xml:"numFmtId,attr"`
+			FontID   int `xml:"fontId,attr"`
+			FillID   int `xml:"fillId,attr"`
+			BorderID int `xml:"borderId,attr"`
+		} `xml:"cellXfs>xf"`
+	}
+	if _, err := rd.decode(name, &styles); err != nil {
+		return err
+	}
+	codes := make(map[int]string)
+	for id, code := range builtinFormats {
+		codes[id] = code
+	}
+	for _, numFmt := range styles.NumFmts {
+		codes[numFmt.ID] = numFmt.Code
+	}
+	rd.formats = make([]string, len(styles.Xfs))
+	rd.styled = make([]bool, len(styles.Xfs))
+	for i, xf := range styles.Xfs {
+		rd.formats[i] = codes[xf.NumFmtID]
+		rd.styled[i] = xf.FontID != 0 || xf.FillID != 0 || xf.BorderID != 0
+	}
+	return nil
+}
+
+type xmlCell struct {
+	Ref     string `xml:"r,attr"`
+	Type    string `xml:"t,attr"`
+	Style   int    `xml:"s,attr"`
+	Formula *struct {
+		Text   string `xml:",chardata"`
+		Type   string `xml:"t,attr"`
+		Shared string `xml:"si,attr"`
+	} `xml:"f"`
+	Value  *string  `xml:"v"`
+	Inline *xmlText `xml:"is"`
+}
+
+type sharedFormula struct {
+	formula  string
+	row, col int
+}
+
+// readSheet reads a worksheet element by element, so large sheets are not
+// held as a tree
+func (rd *reader) readSheet(name string, sheet *Sheet) error {
+	data, err := rd.part(name)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		return fmt.Errorf("missing %s", name)
+	}
+
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	shared := make(map[string]sharedFormula)
+	row, col := 0, 0
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		switch local := start.Name.Local; local {
+		case "row":
+			if r := attr(start, "r"); r != "" {
+				if row, err = strconv.Atoi(r); err != nil || row < 1 || row > MaxRow {
+					return fmt.Errorf("invalid row %q", r)
+				}
+			} else {
+				row++
+			}
+			col = 0
+		case "c":
+			var cell xmlCell
+			if err := decoder.DecodeElement(&cell, &start); err != nil {
+				return err
+			}
+			if cell.Ref != "" {
+				if col, row, err = ParseRef(cell.Ref); err != nil {
+					return err
+				}
+			} else {
+				col++
+			}
+			if err := rd.readCell(sheet, row, col, &cell, shared); err != nil {
+				return fmt.Errorf("cell %s: %w", ColName(col)+strconv.Itoa(row), err)
+			}
+		case "col":
+			var c struct {
+				Min    int     `xml:"min,attr"`
+				Max    int     `xml:"max,attr"`
+				Width  float64 `xml:"width,attr"`
+				Custom string  `xml:"customWidth,attr"`
+				Hidden string  `xml:"hidden,attr"`
+			}
+			if err := decoder.DecodeElement(&c, &start); err != nil {
+				return err
+			}
+			hidden := c.Hidden == "1" || c.Hidden == "true"
+			if c.Custom == "" && !hidden {
+				continue
+			}
+			for i := max(c.Min, 1); i <= min(c.Max, MaxCol); i++ {
+				sheet.Cols[i] = Col{Width: c.Width, Hidden: hidden}
+			}
+		case "mergeCell":
+			sheet.Merged = append(sheet.Merged, attr(start, "ref"))
+		default:
+			if feature, ok := sheetFeatures[local]; ok {
+				rd.unsupported("%s: %s", sheet.Name, feature)
+				if err := decoder.Skip(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (rd *reader) readCell(sheet *Sheet, row, col int, x *xmlCell, shared map[string]sharedFormula) error {
+	var cell Cell
+	if x.Style >= 0 && x.Style < len(rd.formats) {
+		cell.NumFmt = rd.formats[x.Style]
+		cell.Format = formatOf(cell.NumFmt)
+		if rd.styled[x.Style] {
+			rd.unsupported("fonts, fills and borders")
+		}
+	}
+
+	if f := x.Formula; f != nil {
+		switch f.Type {
+		case "shared":
+			if master, ok := shared[f.Shared]; ok && f.Text == "" {
+				cell.Formula = ShiftFormula(master.formula, row-master.row, col-master.col)
+			} else {
+				cell.Formula = f.Text
+				shared[f.Shared] = sharedFormula{f.Text, row, col}
+			}
+		case "array", "dataTable":
+			rd.unsupported("%s!%s: %s formulas, kept as their values", sheet.Name, ColName(col)+strconv.Itoa(row), f.Type)
+		default:
+			cell.Formula = f.Text
+		}
+	}
+
+	value := ""
+	if x.Value != nil {
+		value = *x.Value
+	}
+	switch x.Type {
+	case "s":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 || n >= len(rd.strings) {
+			return fmt.Errorf("invalid shared string %q", value)
+		}
+		cell.Type, cell.Value = String, rd.strings[n]
+	case "inlineStr":
+		if x.Inline != nil {
+			cell.Type, cell.Value = String, x.Inline.String()
+		}
+	case "str":
+		cell.Type, cell.Value = String, value
+	case "b":
+		cell.Type, cell.Value = Bool, "0"
+		if value == "1" || value == "true" {
+			cell.Value = "1"
+		}
+	case "e":
+		cell.Type, cell.Value = Error, value
+	case "d":
+		t, err := time.Parse("2006-01-02T15:04:05", strings.TrimSuffix(value, "Z"))
+		if err != nil {
+			if t, err = time.Parse("2006-01-02", value); err != nil {
+				return fmt.Errorf("invalid date %q", value)
+			}
+		}
+		cell.Type, cell.Value = Number, strconv.FormatFloat(Serial(t), 'f', -1, 64)
+		if cell.Format == General {
+			cell.Format = DateTime
+		}
+	default:
+		if value != "" {
+			n, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return fmt.Errorf("invalid number %q", value)
+			}
+			if rd.date1904 && isDate(cell.Format) {
+				value = strconv.FormatFloat(n+date1904Offset, 'f', -1, 64)
+			}
+			cell.Type, cell.Value = Number, value
+		}
+	}
+
+	if cell.Type == Empty && cell.Formula == "" {
+		return nil
+	}
+	if col > MaxCol {
+		return fmt.Errorf("column out of range")
+	}
+	if row <= len(sheet.Rows) {
+		rd.cells += max(col-len(sheet.Rows[row-1]), 0)
+	} else {
+		// Each empty row above the cell costs as much as a cell
+		rd.cells += row - len(sheet.Rows) - 1 + col
+	}
+	if rd.cells > MaxCells {
+		return fmt.Errorf("workbook has more than %d cells", MaxCells)
+	}
+	sheet.Set(row, col, cell)
+	return nil
+}
+
+func attr(start xml.StartElement, name string) string {
+	for _, a := range start.Attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// date1904Offset is the number of days between the 1900 and 1904 date
+// systems
+const date1904Offset = 1462
+
+var serialEpoch = time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+
+// Serial returns the serial date number of a time, in the 1900 date
+// system
+func Serial(t time.Time) float64 {
+	return t.Sub(serialEpoch).Hours() / 24
+}
+
+func isDate(f Format) bool {
+	return f == Date || f == DateTime || f == Time
+}
+
+// formatOf classifies a number format code. Dates, times and percentages
+// are told apart by their placeholders, ignoring quoted text, escaped
+// characters and colours or conditions in brackets other than elapsed time.
+func formatOf(code string) Format {
+	// Only the format for positive numbers matters
+	section := code
+	var b strings.Builder
+	for i := 0; i < len(section); i++ {
+		switch ch := section[i]; ch {
+		case '"':
+			end := strings.IndexByte(section[i+1:], '"')
+			if end < 0 {
+				i = len(section)
+			} else {
+				i += end + 1
+			}
+		case '\\', '_', '*':
+			i++
+		case '[':
+			end := strings.IndexByte(section[i+1:], ']')
+			if end < 0 {
+				i = len(section)
+				break
+			}
+			inner := strings.ToLower(section[i+1 : i+1+end])
+			if strings.Trim(inner, "hms") == "" {
+				b.WriteString(inner)
+			}
+			i += end + 1
+		case ';':
+			i = len(section)
+		default:
+			b.WriteByte(ch)
+		}
+	}
+
+	plain := strings.ToLower(b.String())
+	hasDate := strings.ContainsAny(plain, "yd")
+	hasTime := strings.ContainsAny(plain, "hs")
+	switch {
+	case hasDate && hasTime:
+		return DateTime
+	case hasDate || (strings.Contains(plain, "m") && !hasTime && plain != "general"):
+		return Date
+	case hasTime:
+		return Time
+	case strings.Contains(plain, "%"):
+		return Percent
+	}
+	return General
+}
+
+var refPattern = regexp.MustCompile(`^\$?([A-Za-z]{1,3})\$?([0-9]+)$`)
+
+// ParseRef returns the 1-based column and row of a cell reference such as
+// "B3" or "$B$3"
+func ParseRef(ref string) (col, row int, err error) {
+	m := refPattern.FindStringSubmatch(ref)
+	if m == nil {
+		return 0, 0, fmt.Errorf("invalid cell reference %q", ref)
+	}
+	for _, r := range strings.ToUpper(m[1]) {
+		col = col*26 + int(r-'A'+1)
+	}
+	row, err = strconv.Atoi(m[2])
+	if err != nil || row < 1 || row > MaxRow || col > MaxCol {
+		return 0, 0, fmt.Errorf("invalid cell reference %q", ref)
+	}
+	return col, row, nil
+}
+
+// formulaRef matches a cell reference in a formula, with the character
+// before it, which must not be part of a name
+var formulaRef = regexp.MustCompile(`(^|[^A-Za-z0-9_.$])(\$?)([A-Za-z]{1,3})(\$?)([0-9]+)`)
+
+// ShiftFormula moves the relative references of a formula by rows and
+// cols, the way Excel fills a shared formula into the cells of its range
+func ShiftFormula(formula string, rows, cols int) string {
+	if rows == 0 && cols == 0 {
+		return formula
+	}
+	var b strings.Builder
+	for _, segment := range splitQuoted(formula) {
+		if segment.quoted {
+			b.WriteString(segment.text)
+			continue
+		}
+		text := segment.text
+		last := 0
+		for _, m := range formulaRef.FindAllStringSubmatchIndex(text, -1) {
+			// Function names and defined names continue past the digits
+			if end := m[1]; end < len(text) && (isNameChar(text[end]) || text[end] == '(' || text[end] == '!') {
+				continue
+			}
+			colAbs := m[5] > m[4]
+			rowAbs := m[9] > m[8]
+			col, row, err := ParseRef(text[m[6]:m[7]] + text[m[10]:m[11]])
+			if err != nil {
+				continue
+			}
+			if !colAbs {
+				col += cols
+			}
+			if !rowAbs {
+				row += rows
+			}
+			b.WriteString(text[last:m[4]])
+			if col < 1 || row < 1 || col > MaxCol || row > MaxRow {
+				b.WriteString("#REF!")
+			} else {
+				b.WriteString(text[m[4]:m[5]] + ColName(col) + text[m[8]:m[9]] + strconv.Itoa(row))
+			}
+			last = m[1]
+		}
+		b.WriteString(text[last:])
+	}
+	return b.String()
+}
+
+func isNameChar(ch byte) bool {
+	return ch == '_' || ch == '.' || ch >= '0' && ch <= '9' || ch >= 'A' && ch <= 'Z' || ch >= 'a' && ch <= 'z'
+}
+
+type formulaSegment struct {
+	text   string
+	quoted bool
+}
+
+// splitQuoted splits a formula into string literals and quoted sheet names,
+// which are left alone, and the text between them
+func splitQuoted(formula string) []formulaSegment {
+	var segments []formulaSegment
+	start := 0
+	for i := 0; i < len(formula); i++ {
+		quote := formula[i]
+		if quote != '"' && quote != '\'' {
+			continue
+		}
+		if i > start {
+			segments = append(segments, formulaSegment{formula[start:i], false})
+		}
+		end := i + 1
+		for end < len(formula) {
+			if formula[end] == quote {
+				// A doubled quote is an escaped quote
+				if end+1 < len(formula) && formula[end+1] == quote {
+					end += 2
+					continue
+				}
+				break
+			}
+			end++
+		}
+		end = min(end+1, len(formula))
+		segments = append(segments, formulaSegment{formula[i:end], true})
+		start, i = end, end-1
+	}
+	if start < len(formula) {
+		segments = append(segments, formulaSegment{formula[start:], false})
+	}
+	return segments
+}
@@ -0,0 +1,244 @@
+package xlsx
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// buildArchive zips the given files
+func buildArchive(t *testing.T, files map[string]string) *bytes.Reader {
+	t.Helper()
+	var buf bytes.Buffer
+	z := zip.NewWriter(&buf)
+	for name, content := range files {
+		if err := writeFile(z, name, content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return bytes.NewReader(buf.Bytes())
+}
+
+func TestReadRoundTrip(t *testing.T) {
+	sheet := &Sheet{Name: "Costs", Cols: map[int]Col{2: {Width: 20}, 3: {Hidden: true}}, Merged: []string{"A5:B6"}}
+	sheet.Set(1, 1, Cell{Type: String, Value: "Rent"})
+	sheet.Set(1, 2, Cell{Type: Number, Value: "1200.5"})
+	sheet.Set(2, 2, Cell{Type: Number, Value: "1200.5", Formula: "SUM(B1)"})
+	sheet.Set(3, 1, Cell{Type: Number, Value: "45000", Format: Date})
+	sheet.Set(3, 2, Cell{Type: Bool, Value: "1"})
+	sheet.Set(3, 3, Cell{Type: Error, Value: "#DIV/0!", Formula: "1/0"})
+	sheet.Set(4, 1, Cell{Type: Number, Value: "0.25", Format: Percent})
+
+	var buf bytes.Buffer
+	if err := (&Workbook{Sheets: []*Sheet{sheet, {Name: "Hidden", Hidden: true}}}).Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	book, err := Read(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if len(book.Sheets) != 2 || book.Sheets[0].Name != "Costs" || book.Sheets[0].Hidden || !book.Sheets[1].Hidden {
+		t.Fatalf("unexpected sheets %+v", book.Sheets)
+	}
+	if len(book.Unsupported) != 0 {
+		t.Errorf("unsupported = %v", book.Unsupported)
+	}
+
+	got := book.Sheets[0]
+	for _, want := range []struct {
+		row, col int
+		cell     Cell
+	}{
+		{1, 1, Cell{Type: String, Value: "Rent"}},
+		{1, 2, Cell{Type: Number, Value: "1200.5"}},
+		{2, 2, Cell{Type: Number, Value: "1200.5", Formula: "SUM(B1)"}},
+		{3, 1, Cell{Type: Number, Value: "45000", Format: Date, NumFmt: "m/d/yyyy"}},
+		{3, 2, Cell{Type: Bool, Value: "1"}},
+		{3, 3, Cell{Type: Error, Value: "#DIV/0!", Formula: "1/0"}},
+		{4, 1, Cell{Type: Number, Value: "0.25", Format: Percent, NumFmt: "0.00%"}},
+	} {
+		if cell := got.Rows[want.row-1][want.col-1]; cell != want.cell {
+			t.Errorf("%s%d = %+v, want %+v", ColName(want.col), want.row, cell, want.cell)
+		}
+	}
+	if got.Cols[2] != (Col{Width: 20}) || got.Cols[3] != (Col{Width: 8.43, Hidden: true}) {
+		t.Errorf("cols = %+v", got.Cols)
+	}
+	if len(got.Merged) != 1 || got.Merged[0] != "A5:B6" {
+		t.Errorf("merged = %v", got.Merged)
+	}
+}
+
+func TestReadExcelFeatures(t *testing.T) {
+	const ns = `xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"`
+	files := map[string]string{
+		"_rels/.rels": `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`,
+		"xl/workbook.xml": `<workbook ` + ns + `><workbookPr date1904="1"/><sheets>` +
+			`<sheet name="Data" sheetId="1" r:id="rId1"/></sheets>` +
+			`<definedNames><definedName name="Rate">Data!$B$1</definedName></definedNames></workbook>`,
+		"xl/_rels/workbook.xml.rels": `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="/xl/worksheets/data.xml"/>` +
+			`<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/sharedStrings" Target="sharedStrings.xml"/>` +
+			`<Relationship Id="rId3" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/></Relationships>`,
+		"xl/sharedStrings.xml": `<sst ` + ns + `><si><t>plain</t></si><si><r><t>rich </t></r><r><rPr><b/></rPr><t>text</t></r></si></sst>`,
+		"xl/styles.xml": `<styleSheet ` + ns + `><numFmts><numFmt numFmtId="164" formatCode="&quot;day&quot; dd/mm/yyyy"/><numFmt numFmtId="165" formatCode="[$€-407]#,##0.00"/></numFmts>` +
+			`<cellXfs><xf numFmtId="0" fontId="0"/><xf numFmtId="164"/><xf numFmtId="165"/><xf numFmtId="0" fontId="1"/></cellXfs></styleSheet>`,
+		"xl/worksheets/data.xml": `<worksheet ` + ns + `><cols><col min="1" max="2" width="12" customWidth="1"/></cols><sheetData>` +
+			`<row r="1"><c r="A1" t="s"><v>0</v></c><c t="s"><v>1</v></c><c r="C1" s="1"><v>0</v></c><c r="D1" s="2"><v>3.5</v></c></row>` +
+			`<row r="2"><c r="A2"><f t="shared" ref="A2:A4" si="0">B$1*C1+SUM($D1:D2)</f><v>1</v></c><c r="B2" t="inlineStr"><is><t>inline</t></is></c><c r="C2" s="3"><v>2</v></c></row>` +
+			`<row r="3"><c r="A3"><f t="shared" si="0"/><v>2</v></c><c r="B3"><f t="array" ref="B3">SUM(A1:A2*2)</f><v>4</v></c></row>` +
+			`<row><c r="A4"><f t="shared" si="0"/><v>3</v></c><c r="B4" t="str"><f>"x""y"&amp;A1</f><v>x"yplain</v></c></row>` +
+			`</sheetData><mergeCells count="1"><mergeCell ref="E1:F2"/></mergeCells>` +
+			`<conditionalFormatting sqref="A1"><cfRule type="expression"><formula>A1&gt;1</formula></cfRule></conditionalFormatting>` +
+			`<drawing r:id="rId9"/></worksheet>`,
+	}
+
+	archive := buildArchive(t, files)
+	book, err := Read(archive, int64(archive.Len()))
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	sheet := book.Sheets[0]
+	for ref, want := range map[string]Cell{
+		"A1": {Type: String, Value: "plain"},
+		"B1": {Type: String, Value: "rich text"},
+		"C1": {Type: Number, Value: "1462", Format: Date, NumFmt: `"day" dd/mm/yyyy`},
+		"D1": {Type: Number, Value: "3.5", NumFmt: "[$€-407]#,##0.00"},
+		"A2": {Type: Number, Value: "1", Formula: "B$1*C1+SUM($D1:D2)"},
+		"A3": {Type: Number, Value: "2", Formula: "B$1*C2+SUM($D2:D3)"},
+		"A4": {Type: Number, Value: "3", Formula: "B$1*C3+SUM($D3:D4)"},
+		"B2": {Type: String, Value: "inline"},
+		"B3": {Type: Number, Value: "4"},
+		"B4": {Type: String, Value: `x"yplain`, Formula: `"x""y"&A1`},
+	} {
+		col, row, _ := ParseRef(ref)
+		if got := sheet.Rows[row-1][col-1]; got != want {
+			t.Errorf("%s = %+v, want %+v", ref, got, want)
+		}
+	}
+	if sheet.Cols[1].Width != 12 || sheet.Cols[2].Width != 12 || len(sheet.Merged) != 1 {
+		t.Errorf("cols = %+v, merged = %v", sheet.Cols, sheet.Merged)
+	}
+
+	want := []string{
+		"defined names (Rate)",
+		"fonts, fills and borders",
+		"Data!B3: array formulas, kept as their values",
+		"Data: conditional formatting",
+		"Data: charts and images",
+	}
+	if strings.Join(book.Unsupported, "\n") != strings.Join(want, "\n") {
+		t.Errorf("unsupported = %q, want %q", book.Unsupported, want)
+	}
+}
+
+func TestReadInvalid(t *testing.T) {
+	for name, files := range map[string]map[string]string{
+		"no workbook": {"hello.txt": "hi"},
+		"bad shared string": {
+			"xl/workbook.xml":            `<workbook><sheets><sheet name="a" r:id="rId1" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"/></sheets></workbook>`,
+			"xl/_rels/workbook.xml.rels": `<Relationships><Relationship Id="rId1" Target="worksheets/sheet1.xml"/></Relationships>`,
+			"xl/worksheets/sheet1.xml":   `<worksheet><sheetData><row r="1"><c r="A1" t="s"><v>7</v></c></row></sheetData></worksheet>`,
+		},
+		"cell out of range": {
+			"xl/workbook.xml":            `<workbook><sheets><sheet name="a" r:id="rId1" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"/></sheets></workbook>`,
+			"xl/_rels/workbook.xml.rels": `<Relationships><Relationship Id="rId1" Target="worksheets/sheet1.xml"/></Relationships>`,
+			"xl/worksheets/sheet1.xml":   `<worksheet><sheetData><row r="1"><c r="XFE1"><v>1</v></c></row></sheetData></worksheet>`,
+		},
+	} {
+		archive := buildArchive(t, files)
+		if _, err := Read(archive, int64(archive.Len())); err == nil {
+			t.Errorf("%s: Read succeeded", name)
+		}
+	}
+	if _, err := Read(strings.NewReader("not a zip"), 9); err == nil {
+		t.Error("Read accepted a file that is not a zip archive")
+	}
+}
+
+// farRowBook builds a workbook of n sheets that each hold one cell in the
+// last row
+func farRowBook(t *testing.T, n int) *bytes.Reader {
+	t.Helper()
+	var sheets, rels strings.Builder
+	files := make(map[string]string)
+	for i := 1; i <= n; i++ {
+		fmt.Fprintf(&sheets, `<sheet name="s%d" r:id="rId%d"/>`, i, i)
+		fmt.Fprintf(&rels, `<Relationship Id="rId%d" Target="worksheets/sheet%d.xml"/>`, i, i)
+		files[fmt.Sprintf("xl/worksheets/sheet%d.xml", i)] = `<worksheet><sheetData><row r="1048576"><c r="A1048576"><v>1</v></c></row></sheetData></worksheet>`
+	}
+	files["xl/workbook.xml"] = `<workbook xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets>` + sheets.String() + `</sheets></workbook>`
+	files["xl/_rels/workbook.xml.rels"] = `<Relationships>` + rels.String() + `</Relationships>`
+	return buildArchive(t, files)
+}
+
+func TestReadLimits(t *testing.T) {
+	archive := farRowBook(t, 3)
+	book, err := Read(archive, int64(archive.Len()))
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if len(book.Sheets) != 3 || len(book.Sheets[2].Rows) != MaxRow {
+		t.Errorf("read %d sheets", len(book.Sheets))
+	}
+
+	// Empty rows count against MaxCells, so sheets that each hold one cell
+	// far down cannot add up to millions of rows
+	archive = farRowBook(t, 100)
+	if _, err := Read(archive, int64(archive.Len())); err == nil || !strings.Contains(err.Error(), "cells") {
+		t.Errorf("Read of 100 far-row sheets: err = %v", err)
+	}
+
+	archive = farRowBook(t, MaxSheets+1)
+	if _, err := Read(archive, int64(archive.Len())); err == nil || !strings.Contains(err.Error(), "sheets") {
+		t.Errorf("Read of %d sheets: err = %v", MaxSheets+1, err)
+	}
+}
+
+func TestShiftFormula(t *testing.T) {
+	for _, test := range []struct {
+		formula    string
+		rows, cols int
+		want       string
+	}{
+		{"A1+$B$2", 1, 1, "B2+$B$2"},
+		{"SUM(A1:A3)*LOG10(B1)", 2, 0, "SUM(A3:A5)*LOG10(B3)"},
+		{`Other!A1&"A1"&'My A1'!B2`, 1, 0, `Other!A2&"A1"&'My A1'!B3`},
+		{"A$1+$A1", 1, 1, "B$1+$A2"},
+		{"A1", -1, 0, "#REF!"},
+		{"ATAN2(A1,B1)", 0, 1, "ATAN2(B1,C1)"},
+	} {
+		if got := ShiftFormula(test.formula, test.rows, test.cols); got != test.want {
+			t.Errorf("ShiftFormula(%q, %d, %d) = %q, want %q", test.formula, test.rows, test.cols, got, test.want)
+		}
+	}
+}
+
+func TestFormatOf(t *testing.T) {
+	for code, want := range map[string]Format{
+		"":                    General,
+		"General":             General,
+		"0.00":                General,
+		"#,##0 ;[Red](#,##0)": General,
+		"0.0%":                Percent,
+		"yyyy-mm-dd":          Date,
+		"mmm-yy":              Date,
+		"d/m/yyyy h:mm":       DateTime,
+		"h:mm AM/PM":          Time,
+		"[h]:mm:ss":           Time,
+		"mm:ss":               Time,
+		`"Day "0`:             General,
+		"[$-409]0.00":         General,
+		`0\d`:                 General,
+	} {
+		if got := formatOf(code); got != want {
+			t.Errorf("formatOf(%q) = %v, want %v", code, got, want)
+		}
+	}
+}
@@ -0,0 +1,372 @@
+// Package xlsx writes Office Open XML spreadsheets (.xlsx) with cell values,
+// formulas, basic number formats and column widths, without depending on a
+// third-party library.
+package xlsx
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ContentType is the MIME type of .xlsx files
+const ContentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+
+// MaxSheetName is the longest worksheet name Excel accepts
+const MaxSheetName = 31
+
+// CellType says how a cell value is stored
+type CellType int
+
+const (
+	Empty CellType = iota
+	Number
+	String
+	Bool
+	// Error values are the text of an error such as "#DIV/0!"
+	Error
+)
+
+// Format is the number format of a cell
+type Format int
+
+const (
+	General Format = iota
+	Date
+	DateTime
+	Time
+	Percent
+)
+
+// numFmtIDs are the built-in number formats of each Format, which are also
+// the order of the cell styles in styles.xml
+var numFmtIDs = []int{0, 14, 22, 21, 10}
+
+// Cell is one cell. Numbers are stored as their decimal text; dates and
+// times are serial day numbers with a Date, DateTime or Time format.
+type Cell struct {
+	Type    CellType
+	Value   string
+	Formula string
+	Format  Format
+	// NumFmt is the number format code of a cell read from a file, such as
+	// "#,##0.00"; Write only uses Format
+	NumFmt string
+}
+
+// Col holds the attributes of a column. Width is in characters; zero keeps
+// the default width.
+type Col struct {
+	Width  float64
+	Hidden bool
+}
+
+// Sheet is one worksheet. Rows[r][c] is the cell in row r+1, column c+1.
+type Sheet struct {
+	Name   string
+	Hidden bool
+	Rows   [][]Cell
+	// Cols are keyed by 1-based column number
+	Cols map[int]Col
+	// Merged lists merged ranges such as "A1:B2"
+	Merged []string
+}
+
+// Set stores a cell, growing the rows as needed. Rows and columns are
+// 1-based.
+func (s *Sheet) Set(row, col int, cell Cell) {
+	for len(s.Rows) < row {
+		s.Rows = append(s.Rows, nil)
+	}
+	for len(s.Rows[row-1]) < col {
+		s.Rows[row-1] = append(s.Rows[row-1], Cell{})
+	}
+	s.Rows[row-1][col-1] = cell
+}
+
+// Workbook is a set of worksheets
+type Workbook struct {
+	Sheets []*Sheet
+	// Unsupported describes what Read left out of the file it read
+	Unsupported []string
+}
+
+// Write writes the workbook as an .xlsx file. Sheet names are made valid
+// and unique, and the first sheet is shown when all are hidden.
+func (w *Workbook) Write(out io.Writer) error {
+	if len(w.Sheets) == 0 {
+		return fmt.Errorf("workbook has no sheets")
+	}
+	names := sheetNames(w.Sheets)
+
+	z := zip.NewWriter(out)
+	files := []struct {
+		name    string
+		content string
+	}{
+		{"[Content_Types].xml", contentTypes(len(w.Sheets))},
+		{"_rels/.rels", rootRels},
+		{"xl/workbook.xml", workbookXML(w.Sheets, names)},
+		{"xl/_rels/workbook.xml.rels", workbookRels(len(w.Sheets))},
+		{"xl/styles.xml", stylesXML()},
+	}
+	for _, file := range files {
+		if err := writeFile(z, file.name, file.content); err != nil {
+			return err
+		}
+	}
+	for i, sheet := range w.Sheets {
+		if err := writeFile(z, fmt.Sprintf("xl/worksheets/sheet%d.xml", i+1), sheetXML(sheet)); err != nil {
+			return err
+		}
+	}
+	return z.Close()
+}
+
+func writeFile(z *zip.Writer, name, content string) error {
+	f, err := z.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(f, content)
+	return err
+}
+
+// sheetNames returns names Excel accepts: without []:*?/\, at most 31
+// characters, not empty and unique regardless of case
+func sheetNames(sheets []*Sheet) []string {
+	used := make(map[string]bool)
+	names := make([]string, len(sheets))
+	for i, sheet := range sheets {
+		name := strings.Map(func(r rune) rune {
+			if strings.ContainsRune(`[]:*?/\`, r) || r < 0x20 {
+				return '_'
+			}
+			return r
+		}, strings.Trim(sheet.Name, "'"))
+		if name == "" {
+			name = "Sheet" + strconv.Itoa(i+1)
+		}
+		base := truncate(name, MaxSheetName)
+		name = base
+		for n := 2; used[strings.ToLower(name)]; n++ {
+			suffix := " (" + strconv.Itoa(n) + ")"
+			name = truncate(base, MaxSheetName-len([]rune(suffix))) + suffix
+		}
+		used[strings.ToLower(name)] = true
+		names[i] = name
+	}
+	return names
+}
+
+func truncate(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) > n {
+		return string(runes[:n])
+	}
+	return s
+}
+
+// ColName returns the letters of a 1-based column number
+func ColName(col int) string {
+	name := ""
+	for col > 0 {
+		col--
+		name = string(rune('A'+col%26)) + name
+		col /= 26
+	}
+	return name
+}
+
+func contentTypes(sheets int) string {
+	var b strings.Builder
+	b.WriteString(xmlHeader)
+	b.WriteString(`<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">`)
+	b.WriteString(`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>`)
+	b.WriteString(`<Default Extension="xml" ContentType="application/xml"/>`)
+	b.WriteString(`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>`)
+	b.WriteString(`<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>`)
+	for i := 1; i <= sheets; i++ {
+		fmt.Fprintf(&b, `<Override PartName="/xl/worksheets/sheet%d.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>`, i)
+	}
+	b.WriteString(`</Types>`)
+	return b.String()
+}
+
+const xmlHeader = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n"
+
+const rootRels = xmlHeader +
+	`<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+	`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+	`</Relationships>`
+
+func workbookXML(sheets []*Sheet, names []string) string {
+	var b strings.Builder
+	b.WriteString(xmlHeader)
+	b.WriteString(`<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets>`)
+	// Excel needs a visible sheet
+	visible := 0
+	for i, sheet := range sheets {
+		if !sheet.Hidden {
+			visible = i
+			break
+		}
+	}
+	for i, sheet := range sheets {
+		state := ""
+		if sheet.Hidden && i != visible {
+			state = ` state="hidden"`
+		}
+		fmt.Fprintf(&b, `<sheet name="%s" sheetId="%d"%s r:id="rId%d"/>`, escape(names[i]), i+1, state, i+1)
+	}
+	b.WriteString(`</sheets></workbook>`)
+	return b.String()
+}
+
+func workbookRels(sheets int) string {
+	var b strings.Builder
+	b.WriteString(xmlHeader)
+	b.WriteString(`<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">`)
+	for i := 1; i <= sheets; i++ {
+		fmt.Fprintf(&b, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet%d.xml"/>`, i, i)
+	}
+	fmt.Fprintf(&b, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>`, sheets+1)
+	b.WriteString(`</Relationships>`)
+	return b.String()
+}
+
+func stylesXML() string {
+	var b strings.Builder
+	b.WriteString(xmlHeader)
+	b.WriteString(`<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">`)
+	b.WriteString(`<fonts count="1"><font><sz val="11"/><name val="Calibri"/></font></fonts>`)
+	b.WriteString(`<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>`)
+	b.WriteString(`<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>`)
+	b.WriteString(`<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>`)
+	fmt.Fprintf(&b, `<cellXfs count="%d">`, len(numFmtIDs))
+	for _, id := range numFmtIDs {
+		apply := ""
+		if id != 0 {
+			apply = ` applyNumberFormat="1"`
+		}
+		fmt.Fprintf(&b, `<xf numFmtId="%d" fontId="0" fillId="0" borderId="0" xfId="0"%s/>`, id, apply)
+	}
+	b.WriteString(`</cellXfs></styleSheet>`)
+	return b.String()
+}
+
+func sheetXML(sheet *Sheet) string {
+	var b strings.Builder
+	b.WriteString(xmlHeader)
+	b.WriteString(`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">`)
+
+	if len(sheet.Cols) > 0 {
+		b.WriteString(`<cols>`)
+		for col := 1; col <= maxKey(sheet.Cols); col++ {
+			attribs, ok := sheet.Cols[col]
+			if !ok || (attribs.Width <= 0 && !attribs.Hidden) {
+				continue
+			}
+			width := attribs.Width
+			if width <= 0 {
+				width = 8.43
+			}
+			hidden := ""
+			if attribs.Hidden {
+				hidden = ` hidden="1"`
+			}
+			fmt.Fprintf(&b, `<col min="%d" max="%d" width="%s" customWidth="1"%s/>`,
+				col, col, strconv.FormatFloat(width, 'f', -1, 64), hidden)
+		}
+		b.WriteString(`</cols>`)
+	}
+
+	b.WriteString(`<sheetData>`)
+	for r, row := range sheet.Rows {
+		if len(row) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, `<row r="%d">`, r+1)
+		for c, cell := range row {
+			writeCell(&b, ColName(c+1)+strconv.Itoa(r+1), cell)
+		}
+		b.WriteString(`</row>`)
+	}
+	b.WriteString(`</sheetData>`)
+	if len(sheet.Merged) > 0 {
+		fmt.Fprintf(&b, `<mergeCells count="%d">`, len(sheet.Merged))
+		for _, ref := range sheet.Merged {
+			fmt.Fprintf(&b, `<mergeCell ref="%s"/>`, escape(ref))
+		}
+		b.WriteString(`</mergeCells>`)
+	}
+	b.WriteString(`</worksheet>`)
+	return b.String()
+}
+
+func writeCell(b *strings.Builder, ref string, cell Cell) {
+	if cell.Type == Empty && cell.Formula == "" {
+		return
+	}
+	style := ""
+	if cell.Format != General {
+		style = fmt.Sprintf(` s="%d"`, cell.Format)
+	}
+	formula := ""
+	if cell.Formula != "" {
+		formula = "<f>" + escape(cell.Formula) + "</f>"
+	}
+
+	switch cell.Type {
+	case Number:
+		fmt.Fprintf(b, `<c r="%s"%s>%s<v>%s</v></c>`, ref, style, formula, escape(cell.Value))
+	case Bool:
+		fmt.Fprintf(b, `<c r="%s" t="b"%s>%s<v>%s</v></c>`, ref, style, formula, escape(cell.Value))
+	case Error:
+		fmt.Fprintf(b, `<c r="%s" t="e"%s>%s<v>%s</v></c>`, ref, style, formula, escape(cell.Value))
+	case String:
+		if formula != "" {
+			fmt.Fprintf(b, `<c r="%s" t="str"%s>%s<v>%s</v></c>`, ref, style, formula, escape(cell.Value))
+		} else {
+			fmt.Fprintf(b, `<c r="%s" t="inlineStr"%s><is><t xml:space="preserve">%s</t></is></c>`, ref, style, escape(cell.Value))
+		}
+	default:
+		fmt.Fprintf(b, `<c r="%s"%s>%s</c>`, ref, style, formula)
+	}
+}
+
+// escape escapes text for XML, dropping characters XML cannot hold
+func escape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '&':
+			b.WriteString("&amp;")
+		case r == '<':
+			b.WriteString("&lt;")
+		case r == '>':
+			b.WriteString("&gt;")
+		case r == '"':
+			b.WriteString("&quot;")
+		case r == '\t' || r == '\n' || r == '\r':
+			b.WriteRune(r)
+		case r < 0x20 || r == 0xFFFE || r == 0xFFFF:
+			continue
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func maxKey(m map[int]Col) int {
+	max := 0
+	for k := range m {
+		if k > max {
+			max = k
+		}
+	}
+	return max
+}
@@ -0,0 +1,118 @@
+package xlsx
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+// readFiles writes the workbook and returns the files of the archive
+func readFiles(t *testing.T, w *Workbook) map[string]string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := w.Write(&buf); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	z, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("not a zip archive: %v", err)
+	}
+	files := make(map[string]string)
+	for _, f := range z.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name] = string(data)
+	}
+	return files
+}
+
+func TestWrite(t *testing.T) {
+	first := &Sheet{Name: "Costs", Cols: map[int]Col{1: {Width: 17.14}, 3: {Hidden: true}}}
+	first.Set(1, 1, Cell{Type: String, Value: "Rent & <fees>"})
+	first.Set(1, 2, Cell{Type: Number, Value: "1200.5"})
+	first.Set(2, 2, Cell{Type: Number, Value: "1200.5", Formula: "SUM(B1)"})
+	first.Set(3, 1, Cell{Type: Number, Value: "45000", Format: Date})
+	first.Set(3, 2, Cell{Type: Bool, Value: "1"})
+	first.Set(3, 3, Cell{Type: Error, Value: "#DIV/0!", Formula: "1/0"})
+	first.Set(4, 1, Cell{Type: String, Value: "yes", Formula: `IF(B3,"yes","no")`})
+	second := &Sheet{Name: "Costs", Hidden: true}
+
+	files := readFiles(t, &Workbook{Sheets: []*Sheet{first, second}})
+	for _, name := range []string{"[Content_Types].xml", "_rels/.rels", "xl/workbook.xml",
+		"xl/_rels/workbook.xml.rels", "xl/styles.xml", "xl/worksheets/sheet1.xml", "xl/worksheets/sheet2.xml"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("archive has no %s", name)
+		}
+	}
+
+	workbook := files["xl/workbook.xml"]
+	for _, want := range []string{
+		`<sheet name="Costs" sheetId="1" r:id="rId1"/>`,
+		`<sheet name="Costs (2)" sheetId="2" state="hidden" r:id="rId2"/>`,
+	} {
+		if !strings.Contains(workbook, want) {
+			t.Errorf("workbook.xml has no %s:\n%s", want, workbook)
+		}
+	}
+
+	sheet := files["xl/worksheets/sheet1.xml"]
+	for _, want := range []string{
+		`<col min="1" max="1" width="17.14" customWidth="1"/>`,
+		`<col min="3" max="3" width="8.43" customWidth="1" hidden="1"/>`,
+		`<c r="A1" t="inlineStr"><is><t xml:space="preserve">Rent &amp; &lt;fees&gt;</t></is></c>`,
+		`<c r="B1"><v>1200.5</v></c>`,
+		`<c r="B2"><f>SUM(B1)</f><v>1200.5</v></c>`,
+		`<c r="A3" s="1"><v>45000</v></c>`,
+		`<c r="B3" t="b"><v>1</v></c>`,
+		`<c r="C3" t="e"><f>1/0</f><v>#DIV/0!</v></c>`,
+		`<c r="A4" t="str"><f>IF(B3,&quot;yes&quot;,&quot;no&quot;)</f><v>yes</v></c>`,
+	} {
+		if !strings.Contains(sheet, want) {
+			t.Errorf("sheet1.xml has no %s:\n%s", want, sheet)
+		}
+	}
+	if strings.Contains(sheet, `r="A2"`) {
+		t.Errorf("empty cell written:\n%s", sheet)
+	}
+}
+
+func TestWriteAllHidden(t *testing.T) {
+	files := readFiles(t, &Workbook{Sheets: []*Sheet{{Name: "a", Hidden: true}, {Name: "b", Hidden: true}}})
+	workbook := files["xl/workbook.xml"]
+	if !strings.Contains(workbook, `<sheet name="a" sheetId="1" r:id="rId1"/>`) ||
+		!strings.Contains(workbook, `<sheet name="b" sheetId="2" state="hidden" r:id="rId2"/>`) {
+		t.Errorf("first sheet not shown:\n%s", workbook)
+	}
+
+	if err := (&Workbook{}).Write(io.Discard); err == nil {
+		t.Error("workbook without sheets written")
+	}
+}
+
+func TestSheetNames(t *testing.T) {
+	long := strings.Repeat("x", 40)
+	got := sheetNames([]*Sheet{{Name: "a/b"}, {Name: ""}, {Name: "A_B"}, {Name: long}, {Name: long}})
+	want := []string{"a_b", "Sheet2", "A_B (2)", strings.Repeat("x", 31), strings.Repeat("x", 27) + " (2)"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("name %d = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestColName(t *testing.T) {
+	for col, want := range map[int]string{1: "A", 26: "Z", 27: "AA", 702: "ZZ", 703: "AAA"} {
+		if got := ColName(col); got != want {
+			t.Errorf("ColName(%d) = %q, want %q", col, got, want)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newCSRFRouter() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(CSRF(CSRFOptions{Secret: "test-secret"}))
+	router.GET("/form", func(c *gin.Context) {
+		c.String(http.StatusOK, CSRFToken(c))
+	})
+	router.POST("/submit", func(c *gin.Context) {
+		c.String(http.StatusOK, "ok")
+	})
+	return router
+}
+
+// fetchToken performs a GET and returns the issued cookie and page token
+func fetchToken(t *testing.T, router *gin.Engine) (*http.Cookie, string) {
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/form", nil))
+
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == CSRFCookieName {
+			if cookie.Value != w.Body.String() {
+				t.Fatalf("page token %q does not match cookie %q", w.Body.String(), cookie.Value)
+			}
+			return cookie, w.Body.String()
+		}
+	}
+	t.Fatal("no CSRF cookie issued")
+	return nil, ""
+}
+
+func TestCSRF(t *testing.T) {
+	router := newCSRFRouter()
+	cookie, token := fetchToken(t, router)
+
+	post := func(cookie *http.Cookie, header string, form url.Values, authorization string) int {
+		req := httptest.NewRequest(http.MethodPost, "/submit", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		if header != "" {
+			req.Header.Set(CSRFHeaderName, header)
+		}
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	forged := &http.Cookie{Name: CSRFCookieName, Value: "attacker.chosen"}
+
+	tests := []struct {
+		name          string
+		cookie        *http.Cookie
+		header        string
+		form          url.Values
+		authorization string
+		want          int
+	}{
+		{"header token", cookie, token, nil, "", http.StatusOK},
+		{"form token", cookie, "", url.Values{CSRFFormField: {token}}, "", http.StatusOK},
+		{"missing token", cookie, "", nil, "", http.StatusForbidden},
+		{"wrong token", cookie, token + "x", nil, "", http.StatusForbidden},
+		{"no cookie", nil, token, nil, "", http.StatusForbidden},
+		{"unsigned cookie", forged, forged.Value, nil, "", http.StatusForbidden},
+		{"bearer header", nil, "", nil, "Bearer api-token", http.StatusForbidden},
+		{"bearer header with cookie", cookie, "", nil, "Bearer api-token", http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		if got := post(test.cookie, test.header, test.form, test.authorization); got != test.want {
+			t.Errorf("%s: status %d, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCORSAllowedOrigins(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(CORS([]string{"https://calc.example.com"}))
+	router.GET("/", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	request := func(origin string) http.Header {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Origin", origin)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Header()
+	}
+
+	header := request("https://calc.example.com")
+	if header.Get("Access-Control-Allow-Origin") != "https://calc.example.com" || header.Get("Access-Control-Allow-Credentials") != "true" {
+		t.Errorf("allowed origin: got %v", header)
+	}
+
+	header = request("https://evil.example.net")
+	if header.Get("Access-Control-Allow-Origin") != "" || header.Get("Access-Control-Allow-Credentials") != "" {
+		t.Errorf("other origin should not be allowed: got %v", header)
+	}
+}
@@ -4,18 +4,41 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
-// CORS middleware handles Cross-Origin Resource Sharing
-func CORS() gin.HandlerFunc {
+// CORS middleware handles Cross-Origin Resource Sharing. Only the listed
+// origins may make credentialed requests; "*" allows any origin, but then
+// without credentials, as browsers require.
+func CORS(allowedOrigins []string) gin.HandlerFunc {
+	allowed := make(map[string]bool)
+	anyOrigin := false
+	for _, origin := range allowedOrigins {
+		origin = strings.TrimSuffix(strings.TrimSpace(origin), "/")
+		if origin == "*" {
+			anyOrigin = true
+		} else if origin != "" {
+			allowed[origin] = true
+		}
+	}
+
 	return func(c *gin.Context) {
-		c.Header("Access-Control-Allow-Origin", "*")
-		c.Header("Access-Control-Allow-Credentials", "true")
-		c.Header("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With")
-		c.Header("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, DELETE")
+		origin := c.GetHeader("Origin")
+		if origin != "" {
+			c.Header("Vary", "Origin")
+			switch {
+			case allowed[origin]:
+				c.Header("Access-Control-Allow-Origin", origin)
+				c.Header("Access-Control-Allow-Credentials", "true")
+			case anyOrigin:
+				c.Header("Access-Control-Allow-Origin", "*")
+			}
+			c.Header("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With")
+			c.Header("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, DELETE")
+		}
 
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(204)
@@ -54,12 +77,15 @@ func Recovery() gin.HandlerFunc {
 	})
 }
 
+// UserResolver returns the user signed in on a request, or "" when there is
+// none
+type UserResolver func(c *gin.Context) string
+
 // Authentication middleware checks for valid user session
-func Authentication() gin.HandlerFunc {
+func Authentication(resolve UserResolver) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// Get user from cookie or session
-		user, err := c.Cookie("user")
-		if err != nil || user == "" {
+		user := resolve(c)
+		if user == "" {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
 			c.Abort()
 			return
@@ -71,6 +97,40 @@ func Authentication() gin.HandlerFunc {
 	}
 }
 
+// RoleResolver looks up the role of an authenticated user
+type RoleResolver func(user string) (string, error)
+
+// RequireRole middleware allows the request only if the current user has one
+// of the given roles. It must run after Authentication.
+func RequireRole(resolve RoleResolver, roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.GetString("current_user")
+		if user == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+			c.Abort()
+			return
+		}
+
+		role, err := resolve(user)
+		if err != nil {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+			c.Abort()
+			return
+		}
+
+		for _, allowed := range roles {
+			if role == allowed {
+				c.Set("current_role", role)
+				c.Next()
+				return
+			}
+		}
+
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		c.Abort()
+	}
+}
+
 // SecureHeaders middleware adds security headers
 func SecureHeaders() gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -25,52 +25,52 @@ func setupIntegration() (*gin.Engine, *handlers.Handler) {
 	return router, handler
 }
 
+// postJSON sends body as JSON with the cookies set so far, and keeps the
+// cookies the response sets
+func postJSON(router *gin.Engine, path string, body interface{}, cookies map[string]*http.Cookie) *httptest.ResponseRecorder {
+	data, _ := json.Marshal(body)
+	req, _ := http.NewRequest("POST", path, bytes.NewBuffer(data))
+	req.Header.Set("Content-Type", "application/json")
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	for _, cookie := range w.Result().Cookies() {
+		cookies[cookie.Name] = cookie
+	}
+	return w
+}
+
 func TestRegisterLoginSaveLoad(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 	router, _ := setupIntegration()
+	cookies := make(map[string]*http.Cookie)
 
 	// Register
-	w := httptest.NewRecorder()
-	body := bytes.NewBufferString("email=test@example.com&password=secret")
-	req, _ := http.NewRequest("POST", "/register", body)
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	router.ServeHTTP(w, req)
-	require.Equal(t, 200, w.Code)
+	credentials := map[string]string{"email": "test@example.com", "password": "Tc-integration-9"}
+	w := postJSON(router, "/register", credentials, cookies)
+	require.Equal(t, 200, w.Code, w.Body.String())
 
 	// Login
-	w = httptest.NewRecorder()
-	body = bytes.NewBufferString("email=test@example.com&password=secret")
-	req, _ = http.NewRequest("POST", "/login", body)
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	router.ServeHTTP(w, req)
-	require.Equal(t, 200, w.Code)
+	w = postJSON(router, "/login", credentials, cookies)
+	require.Equal(t, 200, w.Code, w.Body.String())
 
 	// Save a file
-	saveReq := map[string]string{
+	w = postJSON(router, "/iwebapp", map[string]string{
 		"action":  "savefile",
 		"appname": "touchcalc",
 		"fname":   "test1.json",
 		"data":    `{"A1":"Hello"}`,
-	}
-	saveJSON, _ := json.Marshal(saveReq)
-
-	w = httptest.NewRecorder()
-	req, _ = http.NewRequest("POST", "/iwebapp", bytes.NewBuffer(saveJSON))
-	req.Header.Set("Content-Type", "application/json")
-	router.ServeHTTP(w, req)
-	require.Equal(t, 200, w.Code)
+	}, cookies)
+	require.Equal(t, 200, w.Code, w.Body.String())
 
 	// Load the file
-	loadReq := map[string]string{
+	w = postJSON(router, "/iwebapp", map[string]string{
 		"action":  "getfile",
 		"appname": "touchcalc",
 		"fname":   "test1.json",
-	}
-	loadJSON, _ := json.Marshal(loadReq)
-
-	w = httptest.NewRecorder()
-	req, _ = http.NewRequest("POST", "/iwebapp", bytes.NewBuffer(loadJSON))
-	req.Header.Set("Content-Type", "application/json")
-	router.ServeHTTP(w, req)
-	require.Equal(t, 200, w.Code)
+	}, cookies)
+	require.Equal(t, 200, w.Code, w.Body.String())
+	require.Contains(t, w.Body.String(), "Hello")
 }
@@ -1,10 +1,10 @@
 package testutils
 
 import (
-	"errors"
 	"strings"
 
 	"github.com/c4gt/tornado-nginx-go-backend/internal/models"
+	"github.com/c4gt/tornado-nginx-go-backend/internal/storage"
 )
 
 type MockStorage struct {
@@ -26,7 +26,12 @@ func (m *MockStorage) CreateDir(path []string) error {
 }
 
 func (m *MockStorage) DeleteDir(path []string) error {
-	delete(m.data, m.pathToString(path))
+	spath := m.pathToString(path)
+	for key := range m.data {
+		if key == spath || strings.HasPrefix(key, spath+"/") {
+			delete(m.data, key)
+		}
+	}
 	return nil
 }
 
@@ -36,13 +41,19 @@ func (m *MockStorage) CreateFile(path []string, data string) error {
 	return nil
 }
 
+// GetFile returns the stored item at path. Data stored by handlers, which
+// is not an item itself, is returned as the content of a file, as the
+// backends would store it.
 func (m *MockStorage) GetFile(path []string) (*models.StorageItem, error) {
 	spath := m.pathToString(path)
 	data, found := m.data[spath]
 	if !found {
-		return nil, errors.New("item not found")
+		return nil, storage.ErrNotFound
 	}
-	return models.StorageItemFromJSON(data)
+	if item, err := models.StorageItemFromJSON(data); err == nil && item.Type != "" {
+		return item, nil
+	}
+	return models.NewStorageItem(path, "file", data), nil
 }
 
 func (m *MockStorage) UpdateFile(path []string, data string) error {
@@ -64,7 +75,7 @@ func (m *MockStorage) PutItem(path string, data string, bucket ...string) error
 func (m *MockStorage) GetItem(path string, bucket ...string) (string, error) {
 	v, ok := m.data[path]
 	if !ok {
-		return "", errors.New("item not found")
+		return "", storage.ErrNotFound
 	}
 	return v, nil
 }
@@ -78,3 +89,21 @@ func (m *MockStorage) DeleteItem(path string, bucket ...string) error {
 	delete(m.data, path)
 	return nil
 }
+
+func (m *MockStorage) ListItems(prefix string, bucket ...string) ([]string, error) {
+	var paths []string
+	for key := range m.data {
+		if strings.HasPrefix(key, prefix+"/") {
+			paths = append(paths, key)
+		}
+	}
+	return paths, nil
+}
+
+func (m *MockStorage) SwapItem(path, old, data string, bucket ...string) (bool, error) {
+	if current, ok := m.data[path]; current != old || ok && old == "" {
+		return false, nil
+	}
+	m.data[path] = data
+	return true, nil
+}
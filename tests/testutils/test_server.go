@@ -5,8 +5,10 @@ import (
 	"net/http/httptest"
 	"testing"
 
+	"github.com/c4gt/tornado-nginx-go-backend/internal/auth"
 	"github.com/c4gt/tornado-nginx-go-backend/internal/config"
 	"github.com/c4gt/tornado-nginx-go-backend/internal/handlers"
+	"github.com/c4gt/tornado-nginx-go-backend/internal/session"
 	"github.com/c4gt/tornado-nginx-go-backend/pkg/middleware"
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/require"
@@ -21,15 +23,18 @@ func SetupTestServer(t *testing.T) (*gin.Engine, *handlers.Handler) {
 	}
 
 	router := gin.Default()
-	router.Use(middleware.CORS(), middleware.Logger(), middleware.Recovery())
+	router.Use(middleware.CORS(nil), middleware.Logger(), middleware.Recovery())
 
 	// Use mock storage
 	h := &handlers.Handler{
 		Config:  cfg,
 		Storage: NewMockStorage(),
+		Session: session.NewManager(),
 	}
 
-	h.Auth = handlers.NewAuthHandler(h, nil)
+	authService := auth.NewService(h.Storage)
+	authService.SetLockoutPolicy(auth.DefaultLockoutPolicy())
+	h.Auth = handlers.NewAuthHandler(h, authService)
 	h.WebApp = handlers.NewWebAppHandler(h)
 	h.App = handlers.NewAppHandler(h)
 
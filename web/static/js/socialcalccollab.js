@@ -0,0 +1,367 @@
+//
+// SocialCalc Collaborative Editing
+//
+// Connects a spreadsheet control to the server's /collab/:app/:file
+// WebSocket, which relays the commands of everyone editing the same file.
+//
+// Sheet commands are not executed when issued but sent to the server, which
+// numbers them and sends them back to every editor; each editor executes
+// them in that order, so that all copies of the sheet stay the same.
+// Workbook commands are executed at once and relayed. The cell each editor
+// is on is shown to the others with the defaultPeer style.
+//
+// When asked, the editor sends a save of its sheet, which the server stores
+// in place of the file; other saves are not needed while connected.
+//
+// Usage:
+//
+//    SocialCalc.Collab.Connect("/collab/touchcalc/budget", spreadsheet, {
+//       status: function(message) {...} // optional
+//       });
+//
+
+var SocialCalc;
+if (!SocialCalc) {
+   alert("Main SocialCalc code module needed");
+   SocialCalc = {};
+   }
+
+SocialCalc.Collab = {
+
+   socket: null,
+   control: null,
+   status: function(message) {},
+
+   connected: false,
+   clientid: "",
+   seq: 0, // number of the last command executed
+   pending: 0, // commands sent and not yet back
+   queue: [], // commands to execute once the editor is not busy
+   queuetimer: null,
+   snapshotasked: false,
+   peers: {}, // client id: {user, ecell}
+
+   // Commands that only concern this editor's display
+
+   localcommands: {"redisplay": true, "recalc": true, "set sheet defaulttextvalueformat text-wiki": true}
+
+   };
+
+//
+// SocialCalc.Collab.Connect(path, control, options)
+//
+// Opens the WebSocket at path on this server for the spreadsheet control.
+//
+
+SocialCalc.Collab.Connect = function(path, control, options) {
+
+   var collab = SocialCalc.Collab;
+   var scheme = window.location.protocol == "https:" ? "wss://" : "ws://";
+
+   if (!window.WebSocket) return;
+
+   collab.control = control;
+   if (options && options.status) collab.status = options.status;
+
+   control.editor.context.highlightTypes.peer = {style: "", className: "defaultPeer"};
+
+   collab.socket = new WebSocket(scheme + window.location.host + path);
+   collab.socket.onmessage = function(event) {
+      var msg;
+      try {
+         msg = JSON.parse(event.data);
+         }
+      catch (e) {
+         return;
+         }
+      SocialCalc.Collab.HandleMessage(msg);
+      };
+   collab.socket.onclose = function() {
+      var wasconnected = collab.connected;
+      collab.connected = false;
+      collab.socket = null;
+      if (wasconnected) {
+         collab.status("Collaboration disconnected - reload the page to rejoin");
+         }
+      };
+
+   SocialCalc.Callbacks.broadcast = SocialCalc.Collab.Broadcast;
+
+   }
+
+//
+// SocialCalc.Collab.IsConnected()
+//
+
+SocialCalc.Collab.IsConnected = function() {
+
+   return SocialCalc.Collab.connected;
+
+   }
+
+//
+// SocialCalc.Collab.Send(msg)
+//
+
+SocialCalc.Collab.Send = function(msg) {
+
+   var collab = SocialCalc.Collab;
+
+   if (!collab.socket || collab.socket.readyState != 1) return false;
+   collab.socket.send(JSON.stringify(msg));
+   return true;
+
+   }
+
+//
+// SocialCalc.Collab.Broadcast(type, data)
+//
+// The SocialCalc.Callbacks.broadcast of connected editors.
+//
+
+SocialCalc.Collab.Broadcast = function(type, data) {
+
+   var collab = SocialCalc.Collab;
+
+   if (!collab.connected) return;
+   collab.Send({type: type, data: data});
+
+   }
+
+//
+// Sheet commands of connected editors go to the server first
+//
+
+SocialCalc.Collab.ScheduleSheetCommands = SocialCalc.ScheduleSheetCommands;
+
+SocialCalc.ScheduleSheetCommands = function(sheet, cmdstr, saveundo, isRemote) {
+
+   var collab = SocialCalc.Collab;
+
+   if (isRemote || !collab.connected || collab.localcommands[cmdstr] || sheet != collab.control.sheet) {
+      return collab.ScheduleSheetCommands(sheet, cmdstr, saveundo, isRemote);
+      }
+   if (collab.Send({type: "execute", data: {cmdtype: "scmd", id: sheet.sheetid || "", cmdstr: cmdstr, saveundo: saveundo}})) {
+      collab.pending++;
+      }
+
+   }
+
+//
+// SocialCalc.Collab.HandleMessage(msg)
+//
+
+SocialCalc.Collab.HandleMessage = function(msg) {
+
+   var collab = SocialCalc.Collab;
+   var i;
+
+   switch (msg.type) {
+
+      case "welcome":
+         collab.clientid = msg.client;
+         collab.peers = {};
+         if (msg.snapshot) {
+            collab.control.sheet.ParseSheetSave(msg.snapshot);
+            }
+         // The snapshot holds the commands before the log
+         collab.seq = msg.log && msg.log.length ? msg.log[0].seq - 1 : msg.seq || 0;
+         if (msg.log) {
+            for (i=0; i<msg.log.length; i++) {
+               collab.Execute(msg.log[i]);
+               }
+            }
+         if (msg.editors) {
+            for (i=0; i<msg.editors.length; i++) {
+               collab.peers[msg.editors[i].client] = {user: msg.editors[i].user, ecell: ""};
+               if (msg.editors[i].ecell) collab.MovePeer(msg.editors[i].client, msg.editors[i].ecell.ecell);
+               }
+            }
+         collab.connected = true;
+         collab.queue.push({cmdstr: "redisplay", saveundo: false});
+         collab.RunQueue();
+         collab.ShowEditors();
+         break;
+
+      case "execute":
+         if (msg.client == collab.clientid && collab.pending > 0) {
+            collab.pending--;
+            }
+         if (msg.client == collab.clientid && msg.data.cmdtype != "scmd") {
+            // Workbook commands were executed when issued
+            collab.seq = msg.seq;
+            }
+         else {
+            collab.Execute(msg);
+            }
+         if (collab.snapshotasked) collab.SendSnapshot();
+         break;
+
+      case "ecell":
+         if (msg.data) collab.MovePeer(msg.client, msg.data.ecell);
+         break;
+
+      case "ask.ecell":
+         var editor = collab.control.editor;
+         if (editor.ecell) collab.Send({type: "ecell", data: {ecell: editor.ecell.coord}});
+         break;
+
+      case "join":
+         collab.peers[msg.client] = {user: msg.user, ecell: ""};
+         collab.ShowEditors();
+         break;
+
+      case "leave":
+         collab.MovePeer(msg.client, "");
+         delete collab.peers[msg.client];
+         collab.ShowEditors();
+         break;
+
+      case "ask.snapshot":
+         collab.snapshotasked = true;
+         collab.SendSnapshot();
+         break;
+
+      case "error":
+         collab.status("Collaboration error: " + msg.error);
+         break;
+
+      }
+
+   }
+
+//
+// SocialCalc.Collab.Execute(msg)
+//
+// Executes a command from the log. Only the editor's own commands go on
+// its undo stack.
+//
+
+SocialCalc.Collab.Execute = function(msg) {
+
+   var collab = SocialCalc.Collab;
+   var data = msg.data || {};
+
+   if (msg.seq <= collab.seq) return; // already in the sheet
+   collab.seq = msg.seq;
+
+   if (data.cmdtype == "scmd") {
+      collab.queue.push({cmdstr: data.cmdstr, saveundo: msg.client == collab.clientid && data.saveundo});
+      collab.RunQueue();
+      }
+   else if (data.cmdtype == "wcmd" && SocialCalc.GetCurrentWorkBookControl) {
+      SocialCalc.GetCurrentWorkBookControl().ExecuteWorkBookControlCommand(data, true);
+      }
+
+   }
+
+//
+// SocialCalc.Collab.RunQueue()
+//
+// Executes the queued commands one at a time, waiting while the editor is
+// busy with the last one. The editor's own deferred commands cannot be
+// used, since they are executed as new local commands.
+//
+
+SocialCalc.Collab.RunQueue = function() {
+
+   var collab = SocialCalc.Collab;
+   var editor = collab.control.editor;
+   var cmd;
+
+   if (collab.queuetimer) return;
+   while (collab.queue.length) {
+      if (editor.busy) {
+         collab.queuetimer = window.setTimeout(function() {
+            collab.queuetimer = null;
+            collab.RunQueue();
+            }, 50);
+         return;
+         }
+      cmd = collab.queue.shift();
+      collab.control.sheet.ScheduleSheetCommands(cmd.cmdstr, cmd.saveundo, true);
+      }
+
+   }
+
+//
+// SocialCalc.Collab.SendSnapshot()
+//
+// Sends the snapshot the server asked for once the sheet holds the log up to
+// collab.seq and nothing else: own commands on their way are in no copy of
+// the sheet yet, and queued ones are not executed yet.
+//
+
+SocialCalc.Collab.SendSnapshot = function() {
+
+   var collab = SocialCalc.Collab;
+
+   if (!collab.snapshotasked || collab.pending > 0) return; // sent when own commands are back
+   if (collab.queue.length || collab.control.editor.busy) {
+      window.setTimeout(collab.SendSnapshot, 100);
+      return;
+      }
+   collab.snapshotasked = false;
+   collab.Send({type: "snapshot", seq: collab.seq, snapshot: SocialCalc.CreateSheetSave(collab.control.sheet)});
+
+   }
+
+//
+// SocialCalc.Collab.MovePeer(clientid, coord)
+//
+// Shows a peer on the cell at coord, or nowhere when coord is "".
+//
+
+SocialCalc.Collab.MovePeer = function(clientid, coord) {
+
+   var collab = SocialCalc.Collab;
+   var editor = collab.control.editor;
+   var highlights = editor.context.highlights;
+   var peer = collab.peers[clientid];
+   var cr;
+
+   if (!peer) return;
+   if (peer.ecell && highlights[peer.ecell] == "peer") {
+      delete highlights[peer.ecell];
+      cr = SocialCalc.coordToCr(peer.ecell);
+      collab.UpdateCell(cr.row, cr.col);
+      }
+   peer.ecell = coord || "";
+   if (peer.ecell && !highlights[peer.ecell]) {
+      highlights[peer.ecell] = "peer";
+      cr = SocialCalc.coordToCr(peer.ecell);
+      collab.UpdateCell(cr.row, cr.col);
+      }
+
+   }
+
+SocialCalc.Collab.UpdateCell = function(row, col) {
+
+   var editor = SocialCalc.Collab.control.editor;
+   var cell = SocialCalc.GetEditorCellElement(editor, row, col);
+
+   if (cell) editor.UpdateCellCSS(cell, row, col);
+
+   }
+
+//
+// SocialCalc.Collab.ShowEditors()
+//
+
+SocialCalc.Collab.ShowEditors = function() {
+
+   var collab = SocialCalc.Collab;
+   var users = [];
+   var id;
+
+   for (id in collab.peers) {
+      users.push(collab.peers[id].user);
+      }
+   if (users.length) {
+      collab.status("Editing with " + users.join(", "));
+      }
+   else {
+      collab.status("Connected for collaborative editing");
+      }
+
+   }
@@ -816,6 +816,10 @@ SocialCalc.WorkBookControlAjaxCall = function(url, contents) {
 	http_request.onreadystatechange = SocialCalc.WorkBookControlAlertContents;
 	http_request.open('POST', document.URL, true); // async
 	http_request.setRequestHeader('Content-Type', 'application/x-www-form-urlencoded');
+	var csrfToken = document.querySelector('meta[name="csrf-token"]');
+	if (csrfToken) {
+		http_request.setRequestHeader('X-CSRF-Token', csrfToken.getAttribute('content'));
+	}
 	http_request.send(contents);
 	
 	return true;